@@ -1,8 +1,30 @@
 module old-attendance
 
-go 1.10
+go 1.21
 
 require (
 	github.com/canhlinh/gozk v0.0.0-20250418030849-538b9550e710
 	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
+	go.etcd.io/bbolt v1.3.9
+	golang.org/x/text v0.21.0
+	modernc.org/sqlite v1.33.1
+)
+
+require (
+	github.com/canhlinh/go-binary-pack v0.0.0-20181203110405-72348cf47f32 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	github.com/sirupsen/logrus v1.9.3 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
+	modernc.org/strutil v1.2.0 // indirect
+	modernc.org/token v1.1.0 // indirect
 )
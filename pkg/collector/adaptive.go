@@ -0,0 +1,143 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Adaptive polling defaults
+const (
+	defaultPeakInterval    = time.Minute
+	defaultIdleCycles      = 3
+	defaultMaxIdleInterval = 30 * time.Minute
+)
+
+// adaptivePolling tracks the interval the daemon currently polls at in adaptive mode:
+// PEAK_INTERVAL inside PEAK_WINDOWS, SYNC_INTERVAL normally, and doubling up to
+// MAX_IDLE_INTERVAL once IDLE_CYCLES cycles in a row have found nothing new
+var adaptivePolling = struct {
+	sync.Mutex
+	enabled     bool
+	emptyCycles int
+	interval    time.Duration // Global interval in effect, standing in for SYNC_INTERVAL
+}{}
+
+// adaptiveSettings are the adaptive polling settings read from the environment
+type adaptiveSettings struct {
+	base, peak, maxIdle time.Duration
+	idleCycles          int
+	peakWindows         []clockWindow
+}
+
+// loadAdaptiveSettings reads PEAK_WINDOWS, PEAK_INTERVAL, IDLE_CYCLES and MAX_IDLE_INTERVAL
+func loadAdaptiveSettings() adaptiveSettings {
+	settings := adaptiveSettings{
+		base:       syncInterval(),
+		peak:       defaultPeakInterval,
+		maxIdle:    defaultMaxIdleInterval,
+		idleCycles: defaultIdleCycles,
+	}
+	windows, err := parseClockWindows(os.Getenv("PEAK_WINDOWS"))
+	if err != nil {
+		log.Printf("Ignoring PEAK_WINDOWS: %v", err)
+	}
+	settings.peakWindows = windows
+	if value := os.Getenv("PEAK_INTERVAL"); value != "" {
+		if interval, ok := parseSyncInterval(value); ok {
+			settings.peak = interval
+		} else {
+			log.Printf("Invalid PEAK_INTERVAL=%q, ignoring", value)
+		}
+	}
+	if value := os.Getenv("MAX_IDLE_INTERVAL"); value != "" {
+		if interval, ok := parseSyncInterval(value); ok {
+			settings.maxIdle = interval
+		} else {
+			log.Printf("Invalid MAX_IDLE_INTERVAL=%q, ignoring", value)
+		}
+	}
+	if n := parseCount("IDLE_CYCLES", os.Getenv("IDLE_CYCLES")); n > 0 {
+		settings.idleCycles = n
+	}
+	return settings
+}
+
+// inPeak reports whether t falls inside a peak window
+func (s adaptiveSettings) inPeak(t time.Time) bool {
+	for _, w := range s.peakWindows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// untilNextPeak returns the time from now to the start of the next peak window, or 0 when none are set
+func (s adaptiveSettings) untilNextPeak(now time.Time) time.Duration {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var soonest time.Duration
+	for _, w := range s.peakWindows {
+		start := midnight.Add(w.Start)
+		if !start.After(now) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if wait := start.Sub(now); soonest == 0 || wait < soonest {
+			soonest = wait
+		}
+	}
+	return soonest
+}
+
+// interval returns the global interval to poll at, given how many cycles in a row found nothing
+func (s adaptiveSettings) interval(now time.Time, emptyCycles int) time.Duration {
+	if s.inPeak(now) {
+		return s.peak
+	}
+	interval := s.base
+	for i := s.idleCycles; i <= emptyCycles && interval < s.maxIdle; i++ {
+		interval *= 2
+	}
+	if interval > s.maxIdle && s.base < s.maxIdle {
+		interval = s.maxIdle
+	}
+	return interval
+}
+
+// observeCycleActivity counts cycles in a row that found no new records
+func observeCycleActivity(fetched int) {
+	adaptivePolling.Lock()
+	defer adaptivePolling.Unlock()
+	if fetched > 0 {
+		adaptivePolling.emptyCycles = 0
+	} else {
+		adaptivePolling.emptyCycles++
+	}
+}
+
+// globalInterval returns the interval devices without their own SYNC_INTERVAL_<DEVICE> are
+// read at: the adaptive interval in adaptive mode, SYNC_INTERVAL otherwise
+func globalInterval() time.Duration {
+	adaptivePolling.Lock()
+	defer adaptivePolling.Unlock()
+	if adaptivePolling.enabled {
+		return adaptivePolling.interval
+	}
+	return syncInterval()
+}
+
+// adaptiveReason explains the current polling interval for the log
+func adaptiveReason(settings adaptiveSettings, now time.Time) string {
+	if settings.inPeak(now) {
+		return "peak window"
+	}
+	adaptivePolling.Lock()
+	empty := adaptivePolling.emptyCycles
+	adaptivePolling.Unlock()
+	if empty >= settings.idleCycles {
+		return fmt.Sprintf("idle for %d cycle(s)", empty)
+	}
+	return "normal"
+}
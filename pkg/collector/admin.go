@@ -0,0 +1,59 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// startAdminServer serves monitoring endpoints on ADMIN_ADDR (e.g. 127.0.0.1:9090) when set
+func startAdminServer() {
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/version", handleVersion)
+	mux.HandleFunc("/api/status.json", handleStatus)
+	mux.HandleFunc("/api/events", handleEvents)
+	mux.HandleFunc("/api/occupancy.json", handleOccupancy)
+	mux.HandleFunc("/api/records", handleRecords)
+	mux.HandleFunc("/api/stats.json", handleStats)
+	mux.HandleFunc("/api/tasks/run", handleTaskRun)
+	mux.HandleFunc("/api/log-level", handleLogLevel)
+	mux.HandleFunc("/api/commands.json", handleDeviceCommands)
+	mux.HandleFunc("/api/devices/diagnostics", handleDeviceDiagnostics)
+	mux.HandleFunc("/api/devices/restart", handleDeviceRestart)
+
+	go func() {
+		log.Printf("Admin server listening on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Admin server stopped: %v", err)
+		}
+	}()
+}
+
+// handleMetrics serves metrics in Prometheus text format, or in OpenMetrics with exemplars
+// carrying sync and batch IDs when the scraper asks for it
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set(contentTypeHeader, "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set(contentTypeHeader, "text/plain; version=0.0.4")
+	}
+	writeLagMetrics(w)
+	writeErrorMetrics(w, openMetrics)
+	writeDeliveredMetrics(w, openMetrics)
+	writeDiskMetrics(w)
+	writeRetentionMetrics(w)
+	writeStatsMetrics(w)
+	writeJobMetrics(w)
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
@@ -0,0 +1,278 @@
+package collector
+
+import (
+	"encoding/json"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// State key of each employee's recent punches, so anomalies spanning cycles are caught
+	anomalyHistoryFile = "anomaly_history.json"
+	// Event type streamed on /api/events for each anomalous punch
+	eventAnomaly = "anomaly"
+	// Punches in a burst unless ANOMALY_BURST_MINUTES overrides the window
+	defaultBurstWindow = 10 * time.Minute
+	// How long an employee's punches are remembered after their newest, allowing for devices
+	// read late
+	anomalyHistoryRetention = 24 * time.Hour
+
+	// Flags set on anomalous punches
+	flagUnusualHours     = "unusual_hours"
+	flagImpossibleTravel = "impossible_travel"
+	flagPunchBurst       = "punch_burst"
+)
+
+// anomalyPunch is a punch remembered for anomaly checks
+type anomalyPunch struct {
+	Time   string `json:"time"`
+	Device string `json:"device"`
+}
+
+// anomalyRules configures the checks; a zero setting turns its check off
+type anomalyRules struct {
+	TravelWindow time.Duration // Punches at two branches this close together
+	BurstCount   int           // This many punches by one employee within BurstWindow
+	BurstWindow  time.Duration
+}
+
+// enabled reports whether any check is active. ANOMALY_HOURS is per device, so it is
+// always looked at.
+func (r anomalyRules) enabled() bool {
+	return r.TravelWindow > 0 || r.BurstCount > 0
+}
+
+// retention returns how far before an employee's newest punch the checks look
+func (r anomalyRules) retention() time.Duration {
+	if r.BurstWindow > r.TravelWindow {
+		return r.BurstWindow
+	}
+	return r.TravelWindow
+}
+
+// loadAnomalyRules reads ANOMALY_TRAVEL_MINUTES, ANOMALY_BURST_COUNT and ANOMALY_BURST_MINUTES
+func loadAnomalyRules() anomalyRules {
+	rules := anomalyRules{
+		TravelWindow: time.Duration(parseCount("ANOMALY_TRAVEL_MINUTES", os.Getenv("ANOMALY_TRAVEL_MINUTES"))) * time.Minute,
+		BurstCount:   parseCount("ANOMALY_BURST_COUNT", os.Getenv("ANOMALY_BURST_COUNT")),
+		BurstWindow:  time.Duration(parseCount("ANOMALY_BURST_MINUTES", os.Getenv("ANOMALY_BURST_MINUTES"))) * time.Minute,
+	}
+	if rules.BurstCount > 0 && rules.BurstWindow == 0 {
+		rules.BurstWindow = defaultBurstWindow
+	}
+	return rules
+}
+
+// usualHours returns the windows punches are expected in at a device, ANOMALY_HOURS_<DEVICE>
+func usualHours(deviceID string) []clockWindow {
+	windows, err := parseClockWindows(deviceEnv("ANOMALY_HOURS", deviceID))
+	if err != nil {
+		log.Printf("Ignoring ANOMALY_HOURS for %s: %v", deviceID, err)
+		return nil
+	}
+	return windows
+}
+
+// loadAnomalyHistory returns the remembered punches by employee ID
+func loadAnomalyHistory() map[string][]anomalyPunch {
+	history := map[string][]anomalyPunch{}
+	data, err := state().Get(anomalyHistoryFile)
+	if err != nil || data == nil {
+		return history
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", anomalyHistoryFile, err)
+		return map[string][]anomalyPunch{}
+	}
+	return history
+}
+
+// saveAnomalyHistory stores each employee's punches within the rules' windows of their
+// newest, dropping employees who haven't punched for a day
+func saveAnomalyHistory(history map[string][]anomalyPunch, rules anomalyRules, now time.Time) {
+	stale := now.Add(-anomalyHistoryRetention).Format("2006-01-02T15:04:05")
+	for id, punches := range history {
+		newest := ""
+		for _, p := range punches {
+			if p.Time > newest {
+				newest = p.Time
+			}
+		}
+		cutoff := stale
+		if at, err := time.ParseInLocation("2006-01-02T15:04:05", newest, time.Local); err == nil {
+			if window := at.Add(-rules.retention()).Format("2006-01-02T15:04:05"); window > cutoff {
+				cutoff = window
+			}
+		}
+		kept := punches[:0]
+		for _, p := range punches {
+			if p.Time >= cutoff {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(history, id)
+		} else {
+			history[id] = kept
+		}
+	}
+	data, err := json.Marshal(history)
+	if err == nil {
+		err = state().Put(anomalyHistoryFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving anomaly history: %v", err)
+	}
+}
+
+// burstAround reports whether some window of the given length that contains at holds count
+// or more of the sorted times
+func burstAround(times []time.Time, at time.Time, window time.Duration, count int) bool {
+	for i, start := range times {
+		if start.After(at) {
+			break
+		}
+		if at.Sub(start) > window {
+			continue
+		}
+		n := 0
+		for _, t := range times[i:] {
+			if t.Sub(start) > window {
+				break
+			}
+			n++
+		}
+		if n >= count {
+			return true
+		}
+	}
+	return false
+}
+
+// flagAnomalies flags punches outside the device's usual hours (ANOMALY_HOURS), punches at
+// two branches closer together than anyone can travel (ANOMALY_TRAVEL_MINUTES), and bursts of
+// punches by one employee (ANOMALY_BURST_COUNT within ANOMALY_BURST_MINUTES). Punches seen
+// before are checked again but only new ones raise alerts. Manual punches are skipped.
+func flagAnomalies(logs []zk.AttendanceRecord) {
+	rules := loadAnomalyRules()
+	var history map[string][]anomalyPunch
+	if rules.enabled() {
+		history = loadAnomalyHistory()
+	}
+
+	// Each employee's punches, remembered and new, without repeats
+	type punch struct {
+		at     time.Time
+		device string
+	}
+	known := map[string]bool{}
+	byUser := map[string][]punch{}
+	addPunch := func(id string, p anomalyPunch) bool {
+		key := id + "|" + p.Time + "|" + p.Device
+		if known[key] {
+			return false
+		}
+		at, err := time.ParseInLocation("2006-01-02T15:04:05", p.Time, time.Local)
+		if err != nil {
+			return false
+		}
+		known[key] = true
+		byUser[id] = append(byUser[id], punch{at, p.Device})
+		return true
+	}
+	for id, punches := range history {
+		for _, p := range punches {
+			addPunch(id, p)
+		}
+	}
+	fresh := map[int]bool{}
+	if rules.enabled() {
+		for i, record := range logs {
+			if record.Manual {
+				continue
+			}
+			id := strconv.Itoa(record.UserID)
+			p := anomalyPunch{Time: record.Timestamp, Device: record.DeviceID}
+			if addPunch(id, p) {
+				fresh[i] = true
+				history[id] = append(history[id], p)
+			}
+		}
+		for id := range byUser {
+			punches := byUser[id]
+			sort.Slice(punches, func(i, j int) bool { return punches[i].at.Before(punches[j].at) })
+		}
+	} else {
+		// Only new punches matter to the hours check, and without history all of them are new
+		for i := range logs {
+			fresh[i] = true
+		}
+	}
+
+	counts := map[string]int{}
+	for i, record := range logs {
+		if record.Manual {
+			continue
+		}
+		at, err := record.Time()
+		if err != nil {
+			continue
+		}
+		var flags []string
+		if windows := usualHours(record.DeviceID); len(windows) > 0 {
+			usual := false
+			for _, w := range windows {
+				usual = usual || w.contains(at)
+			}
+			if !usual {
+				flags = append(flags, flagUnusualHours)
+			}
+		}
+		punches := byUser[strconv.Itoa(record.UserID)]
+		if rules.TravelWindow > 0 {
+			branch := deviceBranch(record.DeviceID)
+			for _, p := range punches {
+				gap := p.at.Sub(at)
+				if gap < 0 {
+					gap = -gap
+				}
+				if gap <= rules.TravelWindow && deviceBranch(p.device) != branch {
+					flags = append(flags, flagImpossibleTravel)
+					break
+				}
+			}
+		}
+		if rules.BurstCount > 0 {
+			times := make([]time.Time, len(punches))
+			for j, p := range punches {
+				times[j] = p.at
+			}
+			if burstAround(times, at, rules.BurstWindow, rules.BurstCount) {
+				flags = append(flags, flagPunchBurst)
+			}
+		}
+
+		logs[i].Flags = append(logs[i].Flags, flags...)
+		if !fresh[i] {
+			continue
+		}
+		for _, flag := range flags {
+			counts[flag]++
+			log.Printf("ALERT: %s punch by employee %d at %s on device %s", flag, record.UserID, record.Timestamp, record.DeviceID)
+			publishEvent(eventAnomaly, map[string]interface{}{
+				"anomaly": flag, "employee_id": record.UserID, "timestamp": record.Timestamp, "device": record.DeviceID,
+			})
+		}
+	}
+	if len(counts) > 0 {
+		log.Printf("Anomaly check: %d unusual hours, %d impossible travel, %d burst punch(es)",
+			counts[flagUnusualHours], counts[flagImpossibleTravel], counts[flagPunchBurst])
+	}
+	if rules.enabled() {
+		saveAnomalyHistory(history, rules, time.Now())
+	}
+}
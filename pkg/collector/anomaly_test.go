@@ -0,0 +1,122 @@
+package collector
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"old-attendance/pkg/zk"
+)
+
+func TestBurstAround(t *testing.T) {
+	base := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	at := func(minutes ...int) []time.Time {
+		var times []time.Time
+		for _, m := range minutes {
+			times = append(times, base.Add(time.Duration(m)*time.Minute))
+		}
+		return times
+	}
+	tests := []struct {
+		name  string
+		times []time.Time
+		at    int
+		want  bool
+	}{
+		{"three within the window", at(0, 4, 9), 4, true},
+		{"window boundary", at(0, 5, 10), 0, true},
+		{"spread out", at(0, 6, 12), 6, false},
+		{"burst before the punch", at(0, 1, 2, 30), 30, false},
+		{"burst after the punch", at(0, 20, 21, 22), 0, false},
+		{"punch at the end of a burst", at(0, 1, 2, 11), 2, true},
+		{"too few", at(0, 1), 1, false},
+	}
+	for _, tt := range tests {
+		if got := burstAround(tt.times, base.Add(time.Duration(tt.at)*time.Minute), 10*time.Minute, 3); got != tt.want {
+			t.Errorf("%s: burstAround = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFlagAnomalies(t *testing.T) {
+	manual := punch("gate", 1, "06:00:00")
+	manual.Manual = true
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		history map[string][]anomalyPunch
+		logs    []zk.AttendanceRecord
+		flags   []string // Comma-separated flags of each punch
+	}{
+		{"usual hours", map[string]string{"ANOMALY_HOURS": "07:00-19:00"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "06:59:59"), punch("gate", 1, "07:00:00"), punch("gate", 1, "18:59:59"), punch("gate", 1, "19:00:00")},
+			[]string{flagUnusualHours, "", "", flagUnusualHours}},
+		{"usual hours overnight", map[string]string{"ANOMALY_HOURS": "22:00-06:00"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "23:30:00"), punch("gate", 1, "05:59:00"), punch("gate", 1, "12:00:00")},
+			[]string{"", "", flagUnusualHours}},
+		{"usual hours per device", map[string]string{"ANOMALY_HOURS": "07:00-19:00", "ANOMALY_HOURS_LOBBY": ""},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "03:00:00"), punch("lobby", 1, "03:00:00")},
+			[]string{flagUnusualHours, ""}},
+		{"manual punch", map[string]string{"ANOMALY_HOURS": "07:00-19:00"},
+			nil, []zk.AttendanceRecord{manual}, []string{""}},
+		{"impossible travel", map[string]string{"ANOMALY_TRAVEL_MINUTES": "30"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("dock", 1, "09:20:00")},
+			[]string{flagImpossibleTravel, flagImpossibleTravel}},
+		{"travel at the window", map[string]string{"ANOMALY_TRAVEL_MINUTES": "30"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("dock", 1, "09:30:00")},
+			[]string{flagImpossibleTravel, flagImpossibleTravel}},
+		{"possible travel", map[string]string{"ANOMALY_TRAVEL_MINUTES": "30"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("dock", 1, "09:31:00")},
+			[]string{"", ""}},
+		{"same branch", map[string]string{"ANOMALY_TRAVEL_MINUTES": "30"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("lobby", 1, "09:01:00")},
+			[]string{"", ""}},
+		{"other employee", map[string]string{"ANOMALY_TRAVEL_MINUTES": "30"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("dock", 2, "09:01:00")},
+			[]string{"", ""}},
+		{"travel from an earlier cycle", map[string]string{"ANOMALY_TRAVEL_MINUTES": "30"},
+			map[string][]anomalyPunch{"1": {{Time: "2024-03-01T08:50:00", Device: "gate"}}},
+			[]zk.AttendanceRecord{punch("dock", 1, "09:00:00")},
+			[]string{flagImpossibleTravel}},
+		{"burst", map[string]string{"ANOMALY_BURST_COUNT": "3"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("gate", 1, "09:04:00"), punch("gate", 1, "09:09:00"), punch("gate", 1, "09:30:00")},
+			[]string{flagPunchBurst, flagPunchBurst, flagPunchBurst, ""}},
+		{"no burst", map[string]string{"ANOMALY_BURST_COUNT": "3", "ANOMALY_BURST_MINUTES": "5"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("gate", 1, "09:04:00"), punch("gate", 1, "09:09:00")},
+			[]string{"", "", ""}},
+		{"burst across cycles", map[string]string{"ANOMALY_BURST_COUNT": "3"},
+			map[string][]anomalyPunch{"1": {{Time: "2024-03-01T09:00:00", Device: "gate"}, {Time: "2024-03-01T09:02:00", Device: "gate"}}},
+			[]zk.AttendanceRecord{punch("gate", 1, "09:03:00")},
+			[]string{flagPunchBurst}},
+		{"punch read again", map[string]string{"ANOMALY_BURST_COUNT": "2"},
+			map[string][]anomalyPunch{"1": {{Time: "2024-03-01T09:00:00", Device: "gate"}}},
+			[]zk.AttendanceRecord{punch("gate", 1, "09:00:00")},
+			[]string{""}},
+		{"every check", map[string]string{"ANOMALY_HOURS": "07:00-19:00", "ANOMALY_TRAVEL_MINUTES": "30", "ANOMALY_BURST_COUNT": "2"},
+			nil, []zk.AttendanceRecord{punch("gate", 1, "06:00:00"), punch("dock", 1, "06:05:00")},
+			[]string{flagUnusualHours + "," + flagImpossibleTravel + "," + flagPunchBurst, flagUnusualHours + "," + flagImpossibleTravel + "," + flagPunchBurst}},
+	}
+	for _, tt := range tests {
+		inStateDir(t)
+		for _, key := range []string{"ANOMALY_HOURS", "ANOMALY_HOURS_LOBBY", "ANOMALY_TRAVEL_MINUTES", "ANOMALY_BURST_COUNT", "ANOMALY_BURST_MINUTES"} {
+			t.Setenv(key, tt.env[key])
+		}
+		t.Setenv("DEVICE_BRANCH_GATE", "hq")
+		t.Setenv("DEVICE_BRANCH_LOBBY", "hq")
+		t.Setenv("DEVICE_BRANCH_DOCK", "north")
+		if tt.history != nil {
+			data, _ := json.Marshal(tt.history)
+			if err := state().Put(anomalyHistoryFile, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flagAnomalies(tt.logs)
+		for i, record := range tt.logs {
+			if got := strings.Join(record.Flags, ","); got != tt.flags[i] {
+				t.Errorf("%s: punch %d at %s flagged %q, want %q", tt.name, i, record.Timestamp, got, tt.flags[i])
+			}
+		}
+	}
+}
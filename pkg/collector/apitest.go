@@ -0,0 +1,68 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"os"
+	"time"
+)
+
+// Header marking self-test requests so the backend can tell them from real uploads
+const testRequestHeader = "X-Test-Request"
+
+// runTestAPICommand checks API reachability and credentials before the first real sync.
+// It POSTs an empty batch to API_URL, or GETs API_HEALTH_URL when that is set.
+func runTestAPICommand(args []string) error {
+	fs := flag.NewFlagSet("test-api", flag.ExitOnError)
+	healthURL := fs.String("health-url", os.Getenv("API_HEALTH_URL"), "GET this URL instead of posting an empty batch to API_URL")
+	fs.Parse(args)
+
+	apiURL := os.Getenv("API_URL")
+	apiKey := os.Getenv("API_KEY")
+
+	method, url, body := "POST", apiURL, []byte("[]")
+	if *healthURL != "" {
+		method, url, body = "GET", *healthURL, nil
+	}
+	if url == "" {
+		return configError("API_URL is not set")
+	}
+	if apiKey == "" && !sink.HasAuthProvider() {
+		log.Println("Warning: API_KEY is not set, sending the request without authentication")
+	}
+
+	req, err := sink.NewAPIRequest(method, url, body, apiKey)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(testRequestHeader, "true")
+
+	log.Printf("Sending %s %s", method, url)
+	client := &http.Client{Timeout: 45 * time.Second}
+	start := time.Now()
+	resp, err := client.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		return fmt.Errorf("API unreachable after %v: %v", latency, err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	log.Printf("Status: %s", resp.Status)
+	log.Printf("Latency: %v", latency.Round(time.Millisecond))
+	log.Printf("Response body: %s", string(respBody))
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		sink.RejectAuthToken()
+		return fmt.Errorf("%w (status %d), check API_KEY or the token provider", sink.ErrAuthFailed, resp.StatusCode)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("%w with status %d", sink.ErrAPIRejected, resp.StatusCode)
+	}
+	log.Println("API test passed.")
+	return nil
+}
@@ -0,0 +1,328 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// File to append audit events to
+const auditFile = "audit.log"
+
+// auditCompactedEvent records that entries past AUDIT_RETENTION were removed. It is chained
+// like any event, and an unhashed copy heads the log, carrying the hash the first entry left
+// links to.
+const auditCompactedEvent = "audit_compacted"
+
+// auditCompaction is the details of an auditCompactedEvent
+type auditCompaction struct {
+	Removed  int    `json:"removed"`
+	Through  string `json:"through"`   // Time of the last entry removed
+	LastHash string `json:"last_hash"` // Hash of the last entry removed
+}
+
+// AuditEntry is a single line of the append-only audit log. Each entry carries the hash
+// of the previous one, so altering or removing any line breaks the chain after it.
+type AuditEntry struct {
+	Time     string          `json:"time"`
+	Event    string          `json:"event"`
+	Details  json.RawMessage `json:"details,omitempty"`
+	PrevHash string          `json:"prev_hash,omitempty"`
+	Hash     string          `json:"hash,omitempty"`
+}
+
+// auditMu serializes appends so the chain stays linear
+var auditMu sync.Mutex
+
+// auditTail caches the hash of the last audit entry, so an append doesn't read the whole log.
+// It holds for the file it was read from at the size it had then; the log being replaced,
+// compacted or written by anything else has it read again. Guarded by auditMu.
+var auditTail struct {
+	info os.FileInfo
+	hash string
+}
+
+// computeHash returns the SHA-256 of the entry serialized without its own hash
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// appendAudit writes an event to the audit log as one hash-chained JSON line
+func appendAudit(event string, details interface{}) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	return appendAuditLocked(event, details)
+}
+
+// appendAuditLocked is appendAudit for a caller holding auditMu
+func appendAuditLocked(event string, details interface{}) error {
+	rawDetails, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+	prevHash, err := lastAuditHash()
+	if err != nil {
+		return err
+	}
+
+	entry := AuditEntry{
+		Time:     time.Now().Format(time.RFC3339),
+		Event:    event,
+		Details:  rawDetails,
+		PrevHash: prevHash,
+	}
+	if entry.Hash, err = entry.computeHash(); err != nil {
+		return fmt.Errorf("failed to hash audit entry: %w", err)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	f, err := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	auditTail.info = nil
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil {
+		auditTail.info, auditTail.hash = info, entry.Hash
+	}
+	return nil
+}
+
+// lastAuditHash returns the hash of the last audit entry, or "" for an empty log. The
+// caller holds auditMu. An unreadable line fails it rather than chaining past the entry.
+func lastAuditHash() (string, error) {
+	info, err := os.Stat(auditFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if auditTail.info != nil && os.SameFile(info, auditTail.info) && info.Size() == auditTail.info.Size() {
+		return auditTail.hash, nil
+	}
+
+	f, err := os.Open(auditFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+	info, err = f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	hash := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return "", fmt.Errorf("audit log line %d is unreadable, not appending past it: %w", line, err)
+		}
+		hash = entry.Hash
+		if entry.Event == auditCompactedEvent && entry.Hash == "" {
+			// Only the compaction marker is left; the chain goes on from what it removed
+			var compaction auditCompaction
+			if json.Unmarshal(entry.Details, &compaction) == nil {
+				hash = compaction.LastHash
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	auditTail.info, auditTail.hash = info, hash
+	return hash, nil
+}
+
+// readAuditEntries returns every readable entry of the audit log
+func readAuditEntries() ([]AuditEntry, error) {
+	f, err := os.Open(auditFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// verifyAuditLog checks every entry's hash and its link to the previous entry.
+// Entries written before hash chaining was introduced are counted but can't be verified.
+// A log compacted by AUDIT_RETENTION starts from the hash its compaction marker carries,
+// which must be the one the last chained compaction event recorded.
+func verifyAuditLog() (verified, legacy int, err error) {
+	f, err := os.Open(auditFile)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	prevHash := ""
+	chained := false
+	var anchor, lastCompaction *auditCompaction
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return verified, legacy, fmt.Errorf("line %d: unreadable entry: %w", line, err)
+		}
+		if entry.Event == auditCompactedEvent {
+			var compaction auditCompaction
+			if err := json.Unmarshal(entry.Details, &compaction); err != nil {
+				return verified, legacy, fmt.Errorf("line %d: unreadable compaction details: %w", line, err)
+			}
+			if entry.Hash == "" {
+				if line != 1 {
+					return verified, legacy, fmt.Errorf("line %d: compaction marker inside the log", line)
+				}
+				anchor = &compaction
+				prevHash = compaction.LastHash
+				continue
+			}
+			lastCompaction = &compaction
+		}
+		if entry.Hash == "" {
+			if chained {
+				return verified, legacy, fmt.Errorf("line %d: unhashed entry inside the hash chain", line)
+			}
+			legacy++
+			continue
+		}
+		chained = true
+		if entry.PrevHash != prevHash {
+			return verified, legacy, fmt.Errorf("line %d: previous-hash link broken, an entry was altered or removed before it", line)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return verified, legacy, fmt.Errorf("line %d: %w", line, err)
+		}
+		if hash != entry.Hash {
+			return verified, legacy, fmt.Errorf("line %d: hash mismatch, the entry was altered", line)
+		}
+		prevHash = entry.Hash
+		verified++
+	}
+	if err := scanner.Err(); err != nil {
+		return verified, legacy, err
+	}
+	if anchor != nil && (lastCompaction == nil || *lastCompaction != *anchor) {
+		return verified, legacy, errors.New("compaction marker does not match the last compaction in the chain, entries were removed")
+	}
+	return verified, legacy, nil
+}
+
+// compactAuditLog removes the entries from before cutoff, heading the log with a compaction
+// marker and recording the compaction as an event. It returns how many entries went.
+func compactAuditLog(cutoff time.Time) (int, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	data, err := os.ReadFile(auditFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	var compaction auditCompaction
+	removed := 0
+	for ; removed < len(lines); removed++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(lines[removed], &entry); err != nil {
+			break
+		}
+		if entry.Event == auditCompactedEvent && entry.Hash == "" {
+			// The marker of the last compaction, replaced by this one's
+			json.Unmarshal(entry.Details, &compaction)
+			compaction.Removed = 0
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, entry.Time)
+		if err != nil || !t.Before(cutoff) {
+			break
+		}
+		compaction.Removed++
+		compaction.Through = entry.Time
+		compaction.LastHash = entry.Hash
+	}
+	if compaction.Removed == 0 {
+		return 0, nil
+	}
+
+	rawDetails, err := json.Marshal(compaction)
+	if err != nil {
+		return 0, err
+	}
+	marker, err := json.Marshal(AuditEntry{Time: time.Now().Format(time.RFC3339), Event: auditCompactedEvent, Details: rawDetails})
+	if err != nil {
+		return 0, err
+	}
+	kept := append(append(marker, '\n'), bytes.Join(lines[removed:], nil)...)
+	tmp := auditFile + ".tmp"
+	if err := os.WriteFile(tmp, kept, 0644); err != nil {
+		return 0, fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if err := os.Rename(tmp, auditFile); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("failed to replace audit log: %w", err)
+	}
+	if err := appendAuditLocked(auditCompactedEvent, compaction); err != nil {
+		return compaction.Removed, err
+	}
+	return compaction.Removed, nil
+}
+
+// runVerifyAuditCommand verifies the audit log hash chain
+func runVerifyAuditCommand(args []string) error {
+	verified, legacy, err := verifyAuditLog()
+	if err != nil {
+		return fmt.Errorf("audit log verification failed after %d valid entries: %w", verified, err)
+	}
+	if verified == 0 && legacy == 0 {
+		return errors.New("audit log is empty")
+	}
+	if legacy > 0 {
+		log.Printf("%d entries predate hash chaining and were not verified", legacy)
+	}
+	log.Printf("Audit log intact: %d entries verified", verified)
+	return nil
+}
@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditChain(t *testing.T) {
+	inStateDir(t)
+	for i := 0; i < 3; i++ {
+		if err := appendAudit("config_changed", map[string]int{"step": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Written by another process, so not in the cached tail
+	entry := AuditEntry{Time: time.Now().Format(time.RFC3339), Event: "manual_note"}
+	var err error
+	if entry.PrevHash, err = lastAuditHash(); err != nil {
+		t.Fatal(err)
+	}
+	entry.Hash, _ = entry.computeHash()
+	data, _ := json.Marshal(entry)
+	f, err := os.OpenFile(auditFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(append(data, '\n'))
+	f.Close()
+
+	if err := appendAudit("config_changed", nil); err != nil {
+		t.Fatal(err)
+	}
+	if verified, _, err := verifyAuditLog(); err != nil || verified != 5 {
+		t.Errorf("verifyAuditLog() = %d, %v, want 5 entries verified", verified, err)
+	}
+}
+
+func TestAuditUnreadableLine(t *testing.T) {
+	inStateDir(t)
+	if err := appendAudit("config_changed", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"not json\n", `{"time":"2024-03-01T09:00:00Z","ev` + "\n"} {
+		before, _ := os.ReadFile(auditFile)
+		if err := os.WriteFile(auditFile, append(before, line...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := appendAudit("config_changed", nil); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("append after %q: error = %v, want line 2 unreadable", line, err)
+		}
+		if after, _ := os.ReadFile(auditFile); len(after) != len(before)+len(line) {
+			t.Errorf("append after %q wrote to the log", line)
+		}
+		os.WriteFile(auditFile, before, 0644)
+	}
+}
+
+func TestAuditCompactedAway(t *testing.T) {
+	inStateDir(t)
+	for i := 0; i < 2; i++ {
+		if err := appendAudit("config_changed", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if removed, err := compactAuditLog(time.Now().Add(time.Hour)); err != nil || removed != 2 {
+		t.Fatalf("compactAuditLog() = %d, %v, want both entries removed", removed, err)
+	}
+	if verified, _, err := verifyAuditLog(); err != nil || verified != 1 {
+		t.Errorf("verifyAuditLog() = %d, %v, want the compaction event verified", verified, err)
+	}
+
+	// A log holding only the marker chains on from the entries it removed
+	data, _ := os.ReadFile(auditFile)
+	marker := strings.SplitAfter(string(data), "\n")[0]
+	var compaction auditCompaction
+	var entry AuditEntry
+	if json.Unmarshal([]byte(marker), &entry) != nil || json.Unmarshal(entry.Details, &compaction) != nil {
+		t.Fatalf("unreadable compaction marker %q", marker)
+	}
+	if err := os.WriteFile(auditFile, []byte(marker), 0644); err != nil {
+		t.Fatal(err)
+	}
+	auditMu.Lock()
+	hash, err := lastAuditHash()
+	auditMu.Unlock()
+	if err != nil || hash != compaction.LastHash {
+		t.Errorf("lastAuditHash() = %q, %v, want the marker's %q", hash, err, compaction.LastHash)
+	}
+}
@@ -0,0 +1,71 @@
+package collector
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Backlog records sent to a sink per cycle, unless BACKLOG_BATCH_SIZE overrides it
+const defaultBacklogBatchSize = 1000
+
+// Backlog flush orders accepted by BACKLOG_ORDER
+const (
+	backlogFIFO        = "fifo"         // Oldest stored first
+	backlogLIFO        = "lifo"         // Most recently stored first
+	backlogNewestFirst = "newest-first" // Latest punch time first
+)
+
+// backlogOrder returns the configured BACKLOG_ORDER, defaulting to FIFO
+func backlogOrder() string {
+	switch order := os.Getenv("BACKLOG_ORDER"); order {
+	case "", backlogFIFO:
+		return backlogFIFO
+	case backlogLIFO, backlogNewestFirst:
+		return order
+	default:
+		log.Printf("Invalid BACKLOG_ORDER %q, defaulting to %s", order, backlogFIFO)
+		return backlogFIFO
+	}
+}
+
+// backlogBatchSize returns how many backlog records to send per cycle; 0 means all
+func backlogBatchSize() int {
+	value := os.Getenv("BACKLOG_BATCH_SIZE")
+	if value == "" {
+		return defaultBacklogBatchSize
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Invalid BACKLOG_BATCH_SIZE %q, defaulting to %d", value, defaultBacklogBatchSize)
+		return defaultBacklogBatchSize
+	}
+	return n
+}
+
+// nextBacklogBatch picks up to size records from the backlog in the given order
+func nextBacklogBatch(backlog []storedRecord, order string, size int) []storedRecord {
+	if size <= 0 || size > len(backlog) {
+		size = len(backlog)
+	}
+
+	indexes := make([]int, len(backlog))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	switch order {
+	case backlogLIFO:
+		sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+	case backlogNewestFirst:
+		sort.SliceStable(indexes, func(i, j int) bool {
+			return backlog[indexes[i]].Record.Timestamp > backlog[indexes[j]].Record.Timestamp
+		})
+	}
+
+	batch := make([]storedRecord, 0, size)
+	for _, i := range indexes[:size] {
+		batch = append(batch, backlog[i])
+	}
+	return batch
+}
@@ -0,0 +1,83 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"strconv"
+	"strings"
+)
+
+// Default rendering of a normalized badge, see CARD_TEMPLATE
+const defaultCardTemplate = "{facility}:{card}"
+
+// badgeFormat describes how an external reader packs a badge into the card number the
+// terminal stores: the facility code and card number bit fields, and the total width
+type badgeFormat struct {
+	bits         uint // Width of the stored value, which must fit
+	facilityBits uint
+	cardBits     uint
+	shift        uint // Low bits to drop first, e.g. the trailing parity bit of a raw frame
+}
+
+// Badge formats selectable with CARD_FORMAT. Terminals usually strip the parity bits of a
+// Wiegand frame; readers passed through unprocessed need the *_parity variants.
+var badgeFormats = map[string]badgeFormat{
+	"wiegand26":        {bits: 24, facilityBits: 8, cardBits: 16},
+	"wiegand26_parity": {bits: 26, facilityBits: 8, cardBits: 16, shift: 1},
+	"wiegand34":        {bits: 32, facilityBits: 16, cardBits: 16},
+}
+
+// parseBadge splits a stored card number into facility code and card number
+func parseBadge(raw string, format badgeFormat) (facility, card uint64, err error) {
+	n, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("card number %q is not numeric", raw)
+	}
+	if n >= 1<<format.bits {
+		return 0, 0, fmt.Errorf("card number %s is wider than %d bits", raw, format.bits)
+	}
+	n >>= format.shift
+	card = n & (1<<format.cardBits - 1)
+	facility = (n >> format.cardBits) & (1<<format.facilityBits - 1)
+	return facility, card, nil
+}
+
+// normalizeBadges rewrites the card numbers of records from devices with a CARD_FORMAT into
+// facility code and card number, rendered with CARD_TEMPLATE ("{facility}:{card}" by default,
+// "{raw}" is the stored number). Both can be set per device. Card numbers that don't fit the
+// format are left as read. Roster matching by card number sees the normalized form.
+func normalizeBadges(logs []zk.AttendanceRecord) {
+	invalid := map[string]int{}
+	for i, record := range logs {
+		if record.CardNumber == "" {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(deviceEnv("CARD_FORMAT", record.DeviceID)))
+		if name == "" || name == "raw" {
+			continue
+		}
+		format, ok := badgeFormats[name]
+		if !ok {
+			invalid[fmt.Sprintf("unknown CARD_FORMAT %q for %s", name, record.DeviceID)]++
+			continue
+		}
+		facility, card, err := parseBadge(record.CardNumber, format)
+		if err != nil {
+			invalid[fmt.Sprintf("%v on %s", err, record.DeviceID)]++
+			continue
+		}
+		template := deviceEnv("CARD_TEMPLATE", record.DeviceID)
+		if template == "" {
+			template = defaultCardTemplate
+		}
+		logs[i].CardNumber = strings.NewReplacer(
+			"{facility}", strconv.FormatUint(facility, 10),
+			"{card}", strconv.FormatUint(card, 10),
+			"{raw}", record.CardNumber,
+		).Replace(template)
+	}
+	for problem, n := range invalid {
+		log.Printf("Card numbers left as read: %s (%d record(s))", problem, n)
+	}
+}
@@ -0,0 +1,79 @@
+package collector
+
+import (
+	"os"
+	"testing"
+
+	"old-attendance/pkg/zk"
+)
+
+func TestParseBadge(t *testing.T) {
+	tests := []struct {
+		name           string
+		raw            string
+		format         string
+		facility, card uint64
+		wantErr        bool
+	}{
+		{"wiegand26", "8065495", "wiegand26", 123, 4567, false},
+		{"wiegand26 zero", "0", "wiegand26", 0, 0, false},
+		{"wiegand26 largest", "16777215", "wiegand26", 255, 65535, false},
+		{"wiegand26 too wide", "16777216", "wiegand26", 0, 0, true},
+		{"wiegand26 with parity bits", "49685423", "wiegand26_parity", 123, 4567, false},
+		{"wiegand26 parity frame too wide", "67108864", "wiegand26_parity", 0, 0, true},
+		{"wiegand34", "65667071", "wiegand34", 1001, 65535, false},
+		{"wiegand34 too wide", "4294967296", "wiegand34", 0, 0, true},
+		{"not numeric", "AB12", "wiegand26", 0, 0, true},
+		{"negative", "-5", "wiegand26", 0, 0, true},
+		{"empty", "", "wiegand26", 0, 0, true},
+	}
+	for _, tt := range tests {
+		facility, card, err := parseBadge(tt.raw, badgeFormats[tt.format])
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if facility != tt.facility || card != tt.card {
+			t.Errorf("%s: parseBadge(%q) = %d, %d, want %d, %d", tt.name, tt.raw, facility, card, tt.facility, tt.card)
+		}
+	}
+}
+
+func TestNormalizeBadges(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		device   string
+		raw      string
+		rendered string
+	}{
+		{"no format passes through", nil, "gate", "8065495", "8065495"},
+		{"raw passes through", map[string]string{"CARD_FORMAT": "raw"}, "gate", "8065495", "8065495"},
+		{"default template", map[string]string{"CARD_FORMAT": "wiegand26"}, "gate", "8065495", "123:4567"},
+		{"format name case and spaces", map[string]string{"CARD_FORMAT": " Wiegand26 "}, "gate", "8065495", "123:4567"},
+		{"template", map[string]string{"CARD_FORMAT": "wiegand26", "CARD_TEMPLATE": "{facility}-{card} ({raw})"}, "gate", "8065495", "123-4567 (8065495)"},
+		{"template without fields", map[string]string{"CARD_FORMAT": "wiegand26", "CARD_TEMPLATE": "{card}"}, "gate", "8065495", "4567"},
+		{"per-device format", map[string]string{"CARD_FORMAT": "wiegand26", "CARD_FORMAT_LOBBY_2": "wiegand34"}, "lobby-2", "65667071", "1001:65535"},
+		{"per-device passthrough", map[string]string{"CARD_FORMAT": "wiegand26", "CARD_FORMAT_LOBBY": "raw"}, "lobby", "8065495", "8065495"},
+		{"unknown format passes through", map[string]string{"CARD_FORMAT": "wiegand99"}, "gate", "8065495", "8065495"},
+		{"too wide passes through", map[string]string{"CARD_FORMAT": "wiegand26"}, "gate", "16777216", "16777216"},
+		{"not numeric passes through", map[string]string{"CARD_FORMAT": "wiegand26"}, "gate", "AB12", "AB12"},
+		{"no card", map[string]string{"CARD_FORMAT": "wiegand26"}, "gate", "", ""},
+	}
+	for _, tt := range tests {
+		for _, key := range []string{"CARD_FORMAT", "CARD_TEMPLATE", "CARD_FORMAT_LOBBY", "CARD_FORMAT_LOBBY_2"} {
+			t.Setenv(key, "")
+		}
+		for _, key := range []string{"CARD_FORMAT_LOBBY", "CARD_FORMAT_LOBBY_2"} {
+			os.Unsetenv(key)
+		}
+		for key, value := range tt.env {
+			t.Setenv(key, value)
+		}
+		logs := []zk.AttendanceRecord{{UserID: 1, DeviceID: tt.device, CardNumber: tt.raw}}
+		normalizeBadges(logs)
+		if logs[0].CardNumber != tt.rendered {
+			t.Errorf("%s: card %q rendered as %q, want %q", tt.name, tt.raw, logs[0].CardNumber, tt.rendered)
+		}
+	}
+}
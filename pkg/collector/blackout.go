@@ -0,0 +1,73 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// clockWindow is a daily local-time range, such as a blackout or peak window
+type clockWindow struct {
+	Start, End time.Duration // Offsets from midnight; End may be before Start to wrap past midnight
+	Raw        string
+}
+
+// contains reports whether t falls inside the window
+func (w clockWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// parseClockWindows parses a comma-separated list of "HH:MM-HH:MM" ranges
+func parseClockWindows(value string) ([]clockWindow, error) {
+	var windows []clockWindow
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.Split(part, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", part)
+		}
+		start, err := parseClock(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window %q: %w", part, err)
+		}
+		end, err := parseClock(bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window %q: %w", part, err)
+		}
+		windows = append(windows, clockWindow{Start: start, End: end, Raw: part})
+	}
+	return windows, nil
+}
+
+// parseClock parses "HH:MM" into an offset from midnight
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// activeBlackout returns the blackout window covering now for the device, if any.
+// Windows come from BLACKOUT_WINDOWS or its per-device override.
+func activeBlackout(deviceID string, now time.Time) (clockWindow, bool) {
+	windows, err := parseClockWindows(deviceEnv("BLACKOUT_WINDOWS", deviceID))
+	if err != nil {
+		log.Printf("Ignoring blackout windows for %s: %v", deviceID, err)
+		return clockWindow{}, false
+	}
+	for _, w := range windows {
+		if w.contains(now) {
+			return w, true
+		}
+	}
+	return clockWindow{}, false
+}
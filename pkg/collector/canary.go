@@ -0,0 +1,213 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CanaryStatus is the state of one canary sink in /api/status.json
+type CanaryStatus struct {
+	Name             string `json:"name"`
+	Primary          string `json:"primary"`
+	Batches          int    `json:"batches"`
+	Accepted         int    `json:"accepted"`
+	Rejected         int    `json:"rejected"`
+	Skipped          int    `json:"skipped"` // Batches not copied while the canary was still busy
+	Differences      int    `json:"differences"`
+	LastError        string `json:"last_error,omitempty"`
+	LastDifference   string `json:"last_difference,omitempty"`
+	LastDifferenceAt string `json:"last_difference_at,omitempty"`
+}
+
+// canaries are the sinks in CANARY_SINKS. They are set aside by configuredSinks and sent a
+// copy of each batch the primary sink is sent, so they keep no offsets, hold no records in
+// the store, and their failures neither stop a cycle nor raise alerts.
+var canaries = struct {
+	sync.Mutex
+	sinks  []sink.Sink
+	busy   map[string]bool
+	status map[string]*CanaryStatus
+}{busy: map[string]bool{}, status: map[string]*CanaryStatus{}}
+
+// canaryPrimary is the sink whose traffic canaries are sent: CANARY_PRIMARY, or the API
+func canaryPrimary() string {
+	if name := os.Getenv("CANARY_PRIMARY"); name != "" {
+		return name
+	}
+	return "api"
+}
+
+// splitCanaries sets aside the sinks named in CANARY_SINKS and returns the others. The
+// primary sink is never a canary.
+func splitCanaries(sinks []sink.Sink) []sink.Sink {
+	names := map[string]bool{}
+	for _, name := range splitList(os.Getenv("CANARY_SINKS")) {
+		names[name] = true
+	}
+	var kept, set []sink.Sink
+	for _, s := range sinks {
+		if names[s.Name()] && s.Name() != canaryPrimary() {
+			set = append(set, s)
+		} else {
+			kept = append(kept, s)
+		}
+	}
+	canaries.Lock()
+	canaries.sinks = set
+	canaries.Unlock()
+	return kept
+}
+
+// canaryStatusLocked returns the status entry of a canary; the caller holds the lock
+func canaryStatusLocked(name string) *CanaryStatus {
+	s, ok := canaries.status[name]
+	if !ok {
+		s = &CanaryStatus{Name: name}
+		canaries.status[name] = s
+	}
+	return s
+}
+
+// copyToCanaries sends the canaries a batch the primary sink was sent, with the primary's
+// result to compare theirs with. A canary still busy with the last batch skips this one,
+// so a slow canary never holds up delivery.
+func copyToCanaries(primary string, logs []zk.AttendanceRecord, syncID, batchID string, primaryErr error) {
+	if primary != canaryPrimary() {
+		return
+	}
+	canaries.Lock()
+	set := canaries.sinks
+	canaries.Unlock()
+	for _, c := range set {
+		canaries.Lock()
+		status := canaryStatusLocked(c.Name())
+		status.Primary = primary
+		busy := canaries.busy[c.Name()]
+		if busy {
+			status.Skipped++
+		} else {
+			canaries.busy[c.Name()] = true
+		}
+		canaries.Unlock()
+		if busy {
+			continue
+		}
+
+		// The canary gets its own copy, as sinks may rewrite records while encoding them
+		batch := sink.Batch{SyncID: syncID, BatchID: batchID, Logs: append([]zk.AttendanceRecord(nil), logs...)}
+		sinkPasses.Add(1)
+		go func(c sink.Sink) {
+			defer sinkPasses.Done()
+			var err error
+			if bs, ok := c.(sink.BatchSink); ok {
+				err = bs.SendBatch(batch)
+			} else {
+				err = c.Send(batch.Logs)
+			}
+			recordCanaryResult(c.Name(), primary, batch, err, primaryErr)
+		}(c)
+	}
+}
+
+// recordCanaryResult counts a canary's delivery and reports where the canary and the
+// primary disagreed on accepting the batch
+func recordCanaryResult(name, primary string, batch sink.Batch, err, primaryErr error) {
+	canaries.Lock()
+	defer canaries.Unlock()
+	delete(canaries.busy, name)
+	status := canaryStatusLocked(name)
+	status.Batches++
+	if err != nil {
+		status.Rejected++
+		status.LastError = err.Error()
+	} else {
+		status.Accepted++
+	}
+
+	var difference string
+	switch {
+	case err != nil && primaryErr == nil:
+		difference = fmt.Sprintf("rejected %d log(s) that %s accepted: %v", len(batch.Logs), primary, err)
+	case err == nil && primaryErr != nil:
+		difference = fmt.Sprintf("accepted %d log(s) that %s rejected: %v", len(batch.Logs), primary, primaryErr)
+	}
+	if difference == "" {
+		if err != nil {
+			log.Printf("Canary %s: delivery failed, as it did on %s: %v (batch_id=%s)", name, primary, err, batch.BatchID)
+		}
+		return
+	}
+	status.Differences++
+	status.LastDifference = difference
+	status.LastDifferenceAt = time.Now().Format(time.RFC3339)
+	log.Printf("Canary %s: %s (code=%s sync_id=%s batch_id=%s)", name, difference, countError(firstError(err, primaryErr)), batch.SyncID, batch.BatchID)
+}
+
+// firstError returns the first of errs that is not nil
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canaryStatuses snapshots the canaries' counters, sorted by name
+func canaryStatuses() []CanaryStatus {
+	canaries.Lock()
+	defer canaries.Unlock()
+	var statuses []CanaryStatus
+	for _, s := range canaries.status {
+		statuses = append(statuses, *s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// configuredSinkNames returns the names of the sinks the settings configure, without those
+// registered by an embedding program
+func configuredSinkNames() []string {
+	names := []string{"api"}
+	for key, name := range map[string]string{
+		"ARCHIVE_DIR": "file", "GRAPHQL_URL": "graphql", "WEBSOCKET_URL": "websocket",
+		"SOAP_URL": "soap", "FILEDROP_URL": "filedrop",
+	} {
+		if os.Getenv(key) != "" {
+			names = append(names, name)
+		}
+	}
+	for _, label := range splitList(os.Getenv("TEMPLATE_SINKS")) {
+		names = append(names, "template-"+label)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkCanaries checks CANARY_SINKS and CANARY_PRIMARY against the configured sinks. Names
+// that match none are warnings, as they may be registered by an embedding program.
+func (c *configCheck) checkCanaries() {
+	if os.Getenv("CANARY_SINKS") == "" {
+		return
+	}
+	names := configuredSinkNames()
+	primary := canaryPrimary()
+	if !containsString(names, primary) {
+		c.warnf("CANARY_PRIMARY", "%q is not a configured sink (configured: %s)", primary, strings.Join(names, ", "))
+	}
+	for _, name := range splitList(os.Getenv("CANARY_SINKS")) {
+		switch {
+		case name == primary:
+			c.errorf("CANARY_SINKS", "%q is the primary sink and can't be a canary", name)
+		case !containsString(names, name):
+			c.warnf("CANARY_SINKS", "%q is not a configured sink (configured: %s)", name, strings.Join(names, ", "))
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package collector
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// captureDevice records an operation against a terminal to a capture file, for reproducing
+// a parsing problem without the terminal with "replay"
+func captureDevice(zkManager *zk.ZKManager, operation, out string) error {
+	capture, err := zkManager.Capture(operation)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		out = fmt.Sprintf("capture-%s-%s.json", safeFileName(zkManager.Name), operation)
+	}
+	if err := writeCapture(out, capture); err != nil {
+		return err
+	}
+	if capture.Error != "" {
+		log.Printf("Captured %d packet(s) of a failed %s read from %s to %s: %s", len(capture.Exchanges), operation, zkManager.Name, out, capture.Error)
+	} else {
+		log.Printf("Captured %d packet(s) of %s from %s to %s", len(capture.Exchanges), operation, zkManager.Name, out)
+	}
+	return nil
+}
+
+// safeFileName replaces the characters of a device name that don't belong in a file name
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>| `, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// writeCapture writes a capture file, indented so golden files diff well
+func writeCapture(path string, capture *zk.Capture) error {
+	data, err := json.MarshalIndent(capture, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// readCapture reads a capture file
+func readCapture(path string) (*zk.Capture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var capture zk.Capture
+	if err := json.Unmarshal(data, &capture); err != nil {
+		return nil, fmt.Errorf("invalid capture %s: %w", path, err)
+	}
+	return &capture, nil
+}
+
+// captureFiles expands the arguments of replay: capture files, and directories of them
+func captureFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// runReplayCommand feeds capture files to the protocol client and parsers and compares what
+// they return with the result recorded in each file, as a regression suite of golden files.
+// After a parser fix, --update records the new results.
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	update := fs.Bool("update", false, "record the replayed results in the capture files")
+	show := fs.Bool("show", false, "print the replayed result of each capture")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: replay [--update] [--show] FILE|DIR...")
+	}
+	files, err := captureFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, file := range files {
+		capture, err := readCapture(file)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", file, err)
+			continue
+		}
+		result, replayErr := zk.Replay(capture)
+		var got json.RawMessage
+		var gotErr string
+		if replayErr != nil {
+			gotErr = replayErr.Error()
+		} else if got, err = json.Marshal(result); err != nil {
+			return err
+		}
+		if *show {
+			data, _ := json.MarshalIndent(result, "", "  ")
+			fmt.Printf("%s:\n%s\n", file, data)
+		}
+
+		if *update {
+			capture.Result, capture.Error = got, gotErr
+			if err := writeCapture(file, capture); err != nil {
+				return err
+			}
+			fmt.Printf("updated %s\n", file)
+			continue
+		}
+		switch {
+		case gotErr != capture.Error:
+			failed++
+			fmt.Printf("FAIL %s: replay returned %q, captured %q\n", file, gotErr, capture.Error)
+		case gotErr == "" && !sameJSON(got, capture.Result):
+			failed++
+			fmt.Printf("FAIL %s: %s result differs from the captured one\n", file, capture.Operation)
+		default:
+			fmt.Printf("ok   %s (%s, %d packet(s))\n", file, capture.Operation, len(capture.Exchanges))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d capture(s) failed to replay", failed, len(files))
+	}
+	return nil
+}
+
+// sameJSON reports whether two JSON documents hold the same values
+func sameJSON(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
@@ -0,0 +1,85 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chaosSettings are the failure rates of CHAOS, in percent
+type chaosSettings struct {
+	DeviceTimeout   int // Device operations failing as timed out
+	APIError        int // Uploads answered with a 500 without being sent
+	PartialResponse int // Uploads delivered whose response is cut off
+}
+
+// parseChaos parses CHAOS, e.g. "device_timeout=20,api_error=10,partial_response=5"
+func parseChaos(value string) (chaosSettings, error) {
+	var settings chaosSettings
+	for _, entry := range splitList(value) {
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return settings, fmt.Errorf("invalid entry %q, expected fault=percent", entry)
+		}
+		name := strings.TrimSpace(entry[:i])
+		percent, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(entry[i+1:]), "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			return settings, fmt.Errorf("invalid percentage in %q", entry)
+		}
+		switch name {
+		case "device_timeout":
+			settings.DeviceTimeout = percent
+		case "api_error":
+			settings.APIError = percent
+		case "partial_response":
+			settings.PartialResponse = percent
+		default:
+			return settings, fmt.Errorf("unknown fault %q (known: device_timeout, api_error, partial_response)", name)
+		}
+	}
+	if settings.APIError+settings.PartialResponse > 100 {
+		return settings, fmt.Errorf("api_error and partial_response add up to more than 100 percent")
+	}
+	return settings, nil
+}
+
+// chaosSeed returns CHAOS_SEED, which replays the same sequence of faults, or a random seed
+func chaosSeed() (int64, error) {
+	value := os.Getenv("CHAOS_SEED")
+	if value == "" {
+		return time.Now().UnixNano(), nil
+	}
+	seed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CHAOS_SEED %q", value)
+	}
+	return seed, nil
+}
+
+// applyChaos turns on the faults CHAOS asks for. It is meant for development and staging
+// profiles, to see retries and buffering recover before trusting them with payroll data, and
+// can't be set through CONFIG_URL.
+func applyChaos() error {
+	value := os.Getenv("CHAOS")
+	if value == "" {
+		return nil
+	}
+	settings, err := parseChaos(value)
+	if err != nil {
+		return configError("CHAOS: %v", err)
+	}
+	seed, err := chaosSeed()
+	if err != nil {
+		return configError("%v", err)
+	}
+	zk.SetDeviceChaos(settings.DeviceTimeout, seed)
+	// The sinks roll their own sequence, so device and upload faults don't coincide
+	sink.SetUploadChaos(settings.APIError, settings.PartialResponse, seed+1)
+	log.Printf("Warning: chaos mode is on, device reads and uploads fail on purpose: %s (CHAOS_SEED=%d)", value, seed)
+	return nil
+}
@@ -0,0 +1,588 @@
+// Package collector polls attendance terminals and delivers their records to sinks.
+// It holds everything the old-attendance binary does, so other Go services can embed
+// attendance collection. Configuration is read from the environment.
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define constants for headers served by the admin server
+const (
+	contentTypeHeader   = "Content-Type"
+	authorizationHeader = "Authorization"
+	jsonContentType     = "application/json"
+	bearerPrefix        = "Bearer "
+
+	// File to persist the last check timestamp
+	lastCheckFile = "last_check.txt"
+	// File to save the latest fetched logs
+	logsFile = "latest_logs.json"
+)
+
+// Run starts the collector daemon: an initial sync, then one every SYNC_INTERVAL minutes, or
+// more often when a device has a shorter SYNC_INTERVAL_<DEVICE> of its own.
+// baseEnv is the process environment from before any .env file was loaded; tenant
+// collectors are started with it in multi-tenant mode. Run only returns on startup errors.
+func Run(baseEnv []string) error {
+	restart.Lock()
+	restart.env = baseEnv
+	restart.Unlock()
+	if tenant := tenantName(); tenant != "" {
+		// The supervisor holds the instance lock on behalf of its tenant collectors
+		log.SetPrefix(fmt.Sprintf("[tenant=%s] ", tenant))
+	} else {
+		// Refuse to start a second collector polling the same devices
+		lock, err := acquireInstanceLock()
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+
+		// In multi-tenant mode this process only supervises one collector per tenant
+		if dir := os.Getenv("TENANTS_DIR"); dir != "" {
+			return superviseTenants(dir, baseEnv)
+		}
+	}
+
+	// Central settings from CONFIG_URL, or the last copy of them when it can't be reached
+	loadCachedRemoteConfig()
+	refreshRemoteConfig(true)
+
+	// Terminals found on the discovery subnets are added to DEVICE_IPS
+	if envBool("AUTO_DISCOVER") {
+		if err := startAutoDiscovery(); err != nil {
+			return err
+		}
+	}
+
+	// A signing key that was meant to be used must not leave payloads going out unsigned
+	if err := sink.CheckSigningKey(); err != nil {
+		return err
+	}
+
+	initLogLevel()
+	watchLogLevelSignal()
+	startAdminServer()
+	// The backend's fleet view learns of this collector and hears from it periodically
+	startHeartbeats()
+	// New releases named by UPDATE_URL are installed and restarted into
+	startSelfUpdate()
+	// Compare the devices configured here with those registered for the org
+	checkOrgMetadata()
+	applyDeviceRegistrations()
+
+	// Initial sync on startup
+	log.Println("Performing initial sync...")
+	logSyncError(performSync())
+
+	// Sync, user sync and maintenance each run on the scheduler SCHEDULE_<TASK> picks
+	runScheduledTasks()
+	return nil
+}
+
+// SyncOnce runs a single sync cycle and waits for the sinks to finish delivering it.
+// It returns the cycle's first error, falling back to the first sink delivery error.
+func SyncOnce() error {
+	err := performSync()
+	waitJobs()
+	sinkPasses.Wait()
+	if err == nil {
+		err = lastSinkPassError()
+	}
+	return err
+}
+
+// logSyncError logs the error a daemon sync cycle ended with
+func logSyncError(err error) {
+	if err != nil {
+		log.Printf("Sync cycle ended with error: %v (code=%s)", err, ErrorCode(err))
+	}
+}
+
+// RunCommand runs a one-off CLI subcommand such as "punch" or "initial-sync"
+func RunCommand(name string, args []string) error {
+	initLogLevel()
+	loadCachedRemoteConfig()
+	// Commands address discovered devices at their last known address
+	if envBool("AUTO_DISCOVER") {
+		applyDiscoveredDevices(loadDiscoveredDevices())
+	}
+	applyDeviceRegistrations()
+	switch name {
+	case "punch":
+		return runPunchCommand(args)
+	case "initial-sync":
+		return runInitialSyncCommand(args)
+	case "test-api":
+		return runTestAPICommand(args)
+	case "provision":
+		return runProvisionCommand(args)
+	case "verify-audit":
+		return runVerifyAuditCommand(args)
+	case "keygen":
+		return runKeygenCommand(args)
+	case "prove":
+		return runProveCommand(args)
+	case "verify-proof":
+		return runVerifyProofCommand(args)
+	case "device-command":
+		return runDeviceCommandCommand(args)
+	case "device":
+		return runDeviceCommand(args)
+	case "sync":
+		return runSyncCommand(args)
+	case "user-punches":
+		return runUserPunchesCommand(args)
+	case "sync-users":
+		return runSyncUsersCommand(args)
+	case "config":
+		return runConfigCommand(args)
+	case "init":
+		return runInitCommand(args)
+	case "holidays":
+		return runHolidaysCommand(args)
+	case "digest":
+		return runDigestCommand(args)
+	case "export":
+		return runExportCommand(args)
+	case "ics":
+		return runICSCommand(args)
+	case "loadtest":
+		return runLoadTestCommand(args)
+	case "conformance":
+		return runConformanceCommand(args)
+	case "replay":
+		return runReplayCommand(args)
+	case "verify":
+		return runVerifyCommand(args)
+	case "attendance":
+		return runAttendanceCommand(args)
+	case "update":
+		return runUpdateCommand(args)
+	case "version":
+		return runVersionCommand(args)
+	case "compact":
+		return runCompactCommand(args)
+	case "records":
+		return runRecordsCommand(args)
+	case "stats":
+		return runStatsCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// performSync handles connecting to devices, fetching logs, sending them to the API, and persisting state.
+// It returns ErrConfig when required settings are missing, and otherwise the first device or
+// storage error of the cycle. Sink deliveries finish in the background and report separately.
+func performSync() (err error) {
+	cycleMu.Lock()
+	defer cycleMu.Unlock()
+	refreshRemoteConfig(false)
+	cycle := newSyncCycle()
+	log.Printf("Sync process started. (sync_id=%s)", cycle.ID())
+	cycleStart := cycle.start
+	defer func() { cycle.finish(err) }()
+
+	// Load last checked time from disk
+	lastChecked := getLastCheckTime()
+
+	// Get configuration from environment variables
+	deviceIPs := os.Getenv("DEVICE_IPS")
+	apiURL := os.Getenv("API_URL")
+	orgID := os.Getenv("ORG_ID")
+	apiKey := os.Getenv("API_KEY")
+
+	// Basic validation
+	if deviceIPs == "" || apiURL == "" || orgID == "" {
+		err := configError("missing required environment variables (DEVICE_IPS, API_URL, ORG_ID)")
+		log.Printf("Error: %v. Sync aborted. (code=%s)", err, countError(err))
+		return err
+	}
+
+	allLogs, fetchErr := fetchDeviceLogs(deviceIPs, lastChecked, cycle)
+	observeCycleActivity(len(allLogs))
+	// Device failures and recoveries go to the backend's support view
+	sendErrorReports(cycle)
+
+	// Records journaled by a cycle that was interrupted before storing them, by a crash for
+	// instance, go through this cycle with its own
+	journaled, journalSyncs := pendingJournal(cycle.ID())
+	if len(journaled) > 0 {
+		log.Printf("Replaying %d record(s) journaled by %d interrupted sync cycle(s)", len(journaled), len(journalSyncs))
+		allLogs = mergeJournaled(allLogs, journaled)
+	}
+	journalSyncs = append(journalSyncs, cycle.ID())
+
+	// A fresh deployment must not dump years of device history without an operator's say-so
+	if lastChecked.IsZero() && holdInitialSync(allLogs) {
+		// The history stays on the devices for the initial-sync command
+		commitJournal(journalSyncs)
+		log.Println("Sync process finished.")
+		return fetchErr
+	}
+
+	stored := deliverLogs(allLogs, orgID, apiURL, apiKey, cycle)
+	if stored {
+		commitJournal(journalSyncs)
+		commitRecordCounters(cycle)
+	}
+
+	// Maintenance that has come due joins the queue, then devices that were offline may have
+	// come back, so this is the time to run queued commands
+	if !taskScheduled(taskMaintenance) {
+		scheduleMaintenance(time.Now())
+	}
+	runDeviceCommandsJob(cycleStart, stored)
+
+	// User lists go up only when they changed since the last upload
+	if !taskScheduled(taskUserSync) {
+		syncUserLists(cycle)
+	}
+	// Users enrolled or removed on a terminal itself are alerted on
+	snapshotUserLists(cycle)
+	// Operation logs go to the security sink, apart from attendance records
+	collectSecurityEvents(cycle)
+	// Devices without punches by NO_PUNCH_ALERT_AT on a working day are alerted on
+	checkNoPunches(cycle)
+	// Reports don't need the devices, so they run as a job of their own while the next
+	// cycle goes ahead
+	sinks := configuredSinks(orgID, apiURL, apiKey)
+	submitJob(&job{group: jobGroupReport, name: "reports", run: func() error {
+		// Statistics count what this cycle stored
+		if stored {
+			updatePunchStats()
+		}
+		// The end-of-day digest goes out once DIGEST_AT has passed
+		sendDailyDigest()
+		// Records collected for the file drop go up on its own schedule
+		uploadFileDrop()
+		// Delivered records and audit entries past their retention are removed once a day
+		compactIfDue(sinks, time.Now())
+		return nil
+	}})
+
+	log.Println("Sync process finished.")
+	if fetchErr == nil && !stored {
+		return errors.New("failed to store fetched logs")
+	}
+	return fetchErr
+}
+
+// fetchDeviceLogs reads logs newer than since from every configured device in parallel.
+// Records from the devices that could be read are returned even when others failed, along
+// with an error wrapping the first failure. Device outcomes are counted in cycle. Outside a
+// cycle every device is read; within one, devices wait for their own SYNC_INTERVAL_<DEVICE>.
+func fetchDeviceLogs(deviceIPs string, since time.Time, cycle *syncCycle) ([]zk.AttendanceRecord, error) {
+	ipAddresses := strings.Split(deviceIPs, ",")
+	marks := map[string]time.Time{}
+	var counters map[string]recordCounter // Record counter checks only run within a cycle
+	if cycle != nil {
+		marks = loadDeviceSince()
+		counters = loadRecordCounters()
+	}
+	var allLogs []zk.AttendanceRecord
+	var zkErrs []error
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for _, ipPort := range ipAddresses {
+		addr := strings.TrimSpace(ipPort)
+		if addr == "" {
+			continue
+		}
+		device, err := parseDevice(addr)
+		if err != nil {
+			cycle.update(func(c *syncCycle) { c.devicesFailed++ })
+			mu.Lock()
+			zkErrs = append(zkErrs, err)
+			mu.Unlock()
+			continue
+		}
+		// Each device is read as a job of its own, which no other job touching the device overlaps
+		group := jobGroupSync
+		if cycle == nil {
+			group = jobGroupBackfill
+		}
+		wg.Add(1)
+		submitJob(&job{group: group, name: "read " + device.ID, devices: []string{device.ID}, run: func() error {
+			defer wg.Done()
+			from := deviceSince(marks, device.ID, since)
+			// Blackouts are planned downtime, so skipping is not an error
+			if window, ok := activeBlackout(device.ID, time.Now()); ok {
+				log.Printf("Skipping device %s during blackout window %s", device.ID, window.Raw)
+				cycle.update(func(c *syncCycle) {
+					c.devicesSkipped++
+					c.devicesHeld[device.ID] = from
+				})
+				return nil
+			}
+			// Devices with a longer interval of their own sit out until they are due
+			if cycle != nil {
+				if due, next := deviceDue(device.ID, cycle.start); !due {
+					log.Printf("Skipping device %s until it is due at %s", device.ID, next.Format("15:04"))
+					cycle.update(func(c *syncCycle) {
+						c.devicesSkipped++
+						c.devicesHeld[device.ID] = from
+					})
+					return nil
+				}
+			}
+			log.Printf("Connecting to device %s", device.Addr())
+
+			zkManager, err := newDeviceManager(device)
+			if err != nil {
+				// The device keeps its mark, or the last check time moving on would skip its punches
+				cycle.update(func(c *syncCycle) {
+					c.devicesFailed++
+					c.devicesHeld[device.ID] = from
+				})
+				mu.Lock()
+				zkErrs = append(zkErrs, err)
+				mu.Unlock()
+				return err
+			}
+
+			// A different terminal at the device's address must not have its punches attributed to it
+			if err := verifyDeviceSerial(zkManager, device); err != nil {
+				recordDeviceError(device.ID, err)
+				recoverDeviceError(device.ID, err)
+				reportDeviceError(device.ID, err)
+				cycle.update(func(c *syncCycle) {
+					c.devicesFailed++
+					c.devicesHeld[device.ID] = from
+				})
+				mu.Lock()
+				zkErrs = append(zkErrs, err)
+				mu.Unlock()
+				return err
+			}
+			// New devices announce themselves to the backend, which answers with their settings
+			registerDevice(zkManager, device)
+
+			// An unchanged record counter means nothing new, so the full read can be skipped
+			var newLogs []zk.AttendanceRecord
+			count, unchanged := checkRecordCount(zkManager, device.ID, counters)
+			if unchanged {
+				log.Printf("Record count on %s unchanged at %d, skipping read", device.ID, count.Records)
+			} else {
+				measureClockDrift(zkManager, device.ID)
+				newLogs, err = zkManager.GetAttendance(from)
+			}
+			if err != nil {
+				recordDeviceError(device.ID, err)
+				recoverDeviceError(device.ID, err)
+				reportDeviceError(device.ID, err)
+				cycle.update(func(c *syncCycle) {
+					c.devicesFailed++
+					c.devicesHeld[device.ID] = from
+				})
+				mu.Lock()
+				zkErrs = append(zkErrs, fmt.Errorf("failed to get attendance from %s: %w", device.Addr(), err))
+				mu.Unlock()
+				return err
+			}
+			// The punches are on disk before anything else happens to them
+			if cycle != nil {
+				if err := journalFetched(cycle.ID(), device.ID, newLogs); err != nil {
+					log.Printf("ALERT: records from %s are not journaled: %v", device.ID, err)
+				}
+			}
+
+			recordDeviceSuccess(device.ID, len(newLogs))
+			noteDeviceStatus(zkManager, device.ID)
+			recoverDeviceRead(device.ID, zkManager)
+			reportDeviceRead(device.ID)
+			cycle.update(func(c *syncCycle) {
+				c.devicesOK++
+				c.fetched += len(newLogs)
+				c.devicesRead[device.ID] = true
+				if count.Records >= 0 {
+					c.recordCounts[device.ID] = count
+				}
+				markDeviceRead(device.ID, c.start)
+			})
+			mu.Lock()
+			if len(newLogs) > 0 {
+				allLogs = append(allLogs, newLogs...)
+				publishRecordsFetched(device.ID, cycle.ID(), newLogs)
+				updateOccupancy(device.ID, newLogs)
+				noteLastPunch(device.ID, newLogs)
+				log.Printf("Found %d logs from %s (sync_id=%s)", len(newLogs), device.Addr(), cycle.ID())
+			} else {
+				log.Printf("No new logs found from %s", device.Addr())
+			}
+			mu.Unlock()
+			return nil
+		}})
+	}
+
+	wg.Wait()
+
+	if len(zkErrs) > 0 {
+		log.Printf("Encountered %d error(s) during device communication:", len(zkErrs))
+		for _, e := range zkErrs {
+			log.Printf("-  %v (code=%s)", e, countError(e))
+		}
+		return allLogs, fmt.Errorf("%d device error(s), first: %w", len(zkErrs), zkErrs[0])
+	}
+
+	return allLogs, nil
+}
+
+// deliverLogs adds queued manual punches, collapses duplicates, stores the batch in the local
+// record store, and starts delivery to every configured sink. It reports false if the batch
+// could not be stored.
+func deliverLogs(allLogs []zk.AttendanceRecord, orgID, apiURL, apiKey string, cycle *syncCycle) bool {
+	return deliverRecords(allLogs, orgID, apiURL, apiKey, cycle, time.Now())
+}
+
+// deliverRecords is deliverLogs for records read from the devices up to checked, the last
+// check time saved once they are stored, or with checked zero for records from elsewhere,
+// such as an imported file, which leave the queued manual punches and the last check time
+// the device reads go by alone
+func deliverRecords(allLogs []zk.AttendanceRecord, orgID, apiURL, apiKey string, cycle *syncCycle, checked time.Time) bool {
+	fromDevices := !checked.IsZero()
+	// Include manual punches queued by operators
+	var manualPunches []zk.AttendanceRecord
+	var err error
+	if fromDevices {
+		manualPunches, err = loadManualPunches()
+	}
+	if err != nil {
+		log.Printf("Error loading manual punches: %v", err)
+	} else if len(manualPunches) > 0 {
+		log.Printf("Including %d manual punch(es)", len(manualPunches))
+		allLogs = append(allLogs, manualPunches...)
+	}
+
+	// Never upload records from before the configured date floor
+	allLogs, dropped := filterByMinRecordDate(allLogs)
+	if dropped > 0 {
+		log.Printf("Skipped %d record(s) dated before MIN_RECORD_DATE", dropped)
+	}
+
+	// Split external reader badges into facility code and card number
+	normalizeBadges(allLogs)
+
+	// Map device users to employees and flag punches from unknown or terminated staff
+	if roster := loadRoster(); roster != nil {
+		allLogs = applyRoster(allLogs, roster)
+	}
+
+	// Tag punches as on time, late or early leave against the employee's shift
+	applyShifts(allLogs)
+
+	// Collapse double taps on the same device and repeat punches on paired readers
+	var collapsedLogs []zk.AttendanceRecord
+	var nextDedupState dedupState
+	if rules := loadCollapseRules(); rules.enabled() {
+		allLogs, collapsedLogs, nextDedupState = collapseDuplicatePunches(allLogs, rules, loadDedupState())
+		if len(collapsedLogs) > 0 {
+			log.Printf("Collapsed %d duplicate punch(es)", len(collapsedLogs))
+		}
+	}
+
+	// Flag and alert on punches at odd hours, at two branches at once, or in bursts
+	flagAnomalies(allLogs)
+
+	// Add employee names and departments for sinks that show people rather than IDs
+	enrichRecords(allLogs)
+
+	if len(allLogs) > 0 {
+		log.Printf("Total logs collected: %d", len(allLogs))
+	} else if len(collapsedLogs) > 0 {
+		log.Println("All collected logs were duplicates; nothing to send.")
+	} else {
+		log.Println("No logs collected from any device in this cycle.")
+	}
+
+	freshFrom := int64(math.MaxInt64) // Nothing new this cycle
+	if len(allLogs) > 0 || len(collapsedLogs) > 0 {
+		// Once stored locally the batch is safe, so the device needn't be read for it again
+		if len(allLogs) > 0 {
+			// Keep the store within STORE_MAX_SIZE; with the stop policy the records stay on
+			// the devices, since the last check time is not advanced
+			sinks := configuredSinks(orgID, apiURL, apiKey)
+			if err := makeStoreRoom(allLogs, sinks); err != nil {
+				log.Printf("Error storing logs: %v", err)
+				// Sinks still work through the backlog, which is what frees up room
+				dispatchSinks(sinks, math.MaxInt64, cycle)
+				return false
+			}
+			first, err := appendToStore(allLogs, cycle.ID())
+			if err != nil {
+				log.Printf("Error storing logs: %v", err)
+				return false
+			}
+			freshFrom = first
+			cycle.update(func(c *syncCycle) { c.stored += len(allLogs) })
+			// Persist logs locally
+			if err := saveLogsToFile(allLogs); err != nil {
+				log.Printf("Error saving logs to file: %v", err)
+			}
+		}
+		if len(manualPunches) > 0 {
+			if err := dropManualPunches(len(manualPunches)); err != nil {
+				log.Printf("Error clearing stored manual punches: %v", err)
+			}
+		}
+		commitCollapsedLogs(collapsedLogs, nextDedupState)
+		// Update last check timestamp
+		if !fromDevices {
+			// The devices haven't been read
+		} else if err := saveLastCheckTime(checked); err != nil {
+			log.Printf("Error saving last check time: %v", err)
+		} else {
+			commitDeviceSince(cycle)
+		}
+	}
+
+	// Each sink sends this batch first, then works through whatever it still owes from the store
+	dispatchSinks(configuredSinks(orgID, apiURL, apiKey), freshFrom, cycle)
+	return true
+}
+
+// getLastCheckTime reads the last check time from the state store, or returns zero time
+func getLastCheckTime() time.Time {
+	data, err := state().Get(lastCheckFile)
+	if err != nil {
+		log.Printf("Error reading last check time: %v", err)
+		return time.Time{}
+	}
+	if data == nil {
+		log.Println("No previous check time found")
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Printf("Invalid time in %s: %v", lastCheckFile, err)
+		return time.Time{}
+	}
+	return t
+}
+
+// saveLastCheckTime writes the given time to the state store
+func saveLastCheckTime(t time.Time) error {
+	return state().Put(lastCheckFile, []byte(t.Format(time.RFC3339)))
+}
+
+// saveLogsToFile writes the logs to a JSON file
+func saveLogsToFile(logs []zk.AttendanceRecord) error {
+	data, err := json.MarshalIndent(logs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeLocalFile(logsFile, data)
+}
@@ -0,0 +1,99 @@
+package collector
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseByteSize parses a size setting in bytes, with an optional k, m or g suffix for KiB,
+// MiB and GiB. It logs and ignores invalid values, returning 0 like an unset one.
+func parseByteSize(key, value string) int64 {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return 0
+	}
+	unit := int64(1)
+	for suffix, size := range map[string]int64{"k": 1 << 10, "m": 1 << 20, "g": 1 << 30} {
+		if strings.HasSuffix(value, suffix) {
+			unit, value = size, strings.TrimSuffix(value, suffix)
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s=%q, ignoring", key, value)
+		return 0
+	}
+	return n * unit
+}
+
+// envSeconds reads a whole number of seconds from the environment, returning 0 when unset or invalid
+func envSeconds(key string) time.Duration {
+	return time.Duration(parseCount(key, os.Getenv(key))) * time.Second
+}
+
+// deviceEnvSeconds is envSeconds with per-device overrides, see deviceEnv
+func deviceEnvSeconds(key, deviceID string) time.Duration {
+	return time.Duration(parseCount(key, deviceEnv(key, deviceID))) * time.Second
+}
+
+// deviceEnvInt reads a non-negative whole number with per-device overrides, returning 0
+// when unset or invalid
+func deviceEnvInt(key, deviceID string) int {
+	return parseCount(key, deviceEnv(key, deviceID))
+}
+
+// parseCount parses a non-negative whole number setting, logging and ignoring invalid values
+func parseCount(key, value string) int {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s=%q, ignoring", key, value)
+		return 0
+	}
+	return n
+}
+
+// deviceEnv returns the per-device override of key (KEY_<DEVICE>, with the device ID
+// upper-cased and non-alphanumerics replaced by "_"), falling back to the global KEY
+func deviceEnv(key, deviceID string) string {
+	if value, ok := os.LookupEnv(key + "_" + envSuffix(deviceID)); ok {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// envSuffix turns a device ID such as "HQ-1" or "10.0.0.5:4370" into an env var suffix
+func envSuffix(deviceID string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, deviceID)
+}
+
+// envBool reports whether the environment variable is set to a true value such as "true" or "1"
+func envBool(key string) bool {
+	return isTrue(os.Getenv(key))
+}
+
+// deviceEnvBool is envBool with per-device overrides, see deviceEnv
+func deviceEnvBool(key, deviceID string) bool {
+	return isTrue(deviceEnv(key, deviceID))
+}
+
+// isTrue parses a boolean setting, treating anything invalid as false
+func isTrue(value string) bool {
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	return err == nil && b
+}
@@ -0,0 +1,59 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"old-attendance/pkg/zk"
+	"regexp"
+	"time"
+)
+
+// runConformanceCommand runs the protocol conformance checks against the built-in device
+// simulator, so a change to the protocol clients can be checked without a terminal at hand
+func runConformanceCommand(args []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	run := fs.String("run", "", "only run checks whose name matches this regular expression")
+	list := fs.Bool("list", false, "list the checks without running them")
+	debug := fs.Bool("debug", false, "log every packet exchanged with the simulator")
+	fs.Parse(args)
+
+	var match func(string) bool
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			return fmt.Errorf("invalid --run: %w", err)
+		}
+		match = re.MatchString
+	}
+	if *list {
+		for _, check := range zk.ConformanceChecks() {
+			if match == nil || match(check.Name) {
+				fmt.Println(check.Name)
+			}
+		}
+		return nil
+	}
+	if *debug {
+		zk.SetProtocolDebug(true, nil)
+	}
+
+	results := zk.RunConformance(match)
+	if len(results) == 0 {
+		return fmt.Errorf("no check matches %q", *run)
+	}
+	failed := 0
+	for _, result := range results {
+		took := result.Took.Round(time.Millisecond)
+		if result.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s (%v): %v\n", result.Name, took, result.Err)
+		} else {
+			fmt.Printf("ok   %s (%v)\n", result.Name, took)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d conformance check(s) failed", failed, len(results))
+	}
+	fmt.Printf("%d conformance check(s) passed\n", len(results))
+	return nil
+}
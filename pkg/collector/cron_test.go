@@ -0,0 +1,105 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+		wantErr  bool
+	}{
+		{"*", 0, 6, []int{0, 1, 2, 3, 4, 5, 6}, false},
+		{"5", 0, 59, []int{5}, false},
+		{"1,15", 1, 31, []int{1, 15}, false},
+		{"8-11", 0, 23, []int{8, 9, 10, 11}, false},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}, false},
+		{"8-18/4", 0, 23, []int{8, 12, 16}, false},
+		{"50/5", 0, 59, []int{50, 55}, false},
+		{"1-3,20-21", 1, 31, []int{1, 2, 3, 20, 21}, false},
+		{"60", 0, 59, nil, true},
+		{"0", 1, 12, nil, true},
+		{"5-3", 0, 59, nil, true},
+		{"1-x", 0, 59, nil, true},
+		{"*/0", 0, 59, nil, true},
+		{"*/x", 0, 59, nil, true},
+		{"mon", 0, 7, nil, true},
+		{"", 0, 59, nil, true},
+	}
+	for _, tt := range tests {
+		values, err := parseCronField(tt.field, tt.min, tt.max)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCronField(%q) error = %v, want error %v", tt.field, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		var got []int
+		for v := tt.min; v <= tt.max; v++ {
+			if values[v] {
+				got = append(got, v)
+			}
+		}
+		if !equalInts(got, tt.want) || len(values) != len(tt.want) {
+			t.Errorf("parseCronField(%q) = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"7", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "@often"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+
+	s, err := parseCron("@Daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.minute[0] || len(s.minute) != 1 || !s.hour[0] || len(s.hour) != 1 || !s.domAny || !s.dowAny {
+		t.Errorf("@daily parsed to %+v, want midnight every day", s)
+	}
+	if s.String() != "@Daily" {
+		t.Errorf("String() = %q, want the expression as given", s.String())
+	}
+
+	s, err = parseCron("0 9 * * 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.dow[0] {
+		t.Errorf("day of week 7 does not allow Sunday")
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// Saturday
+	from := time.Date(2024, 3, 2, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 3, 2, 10, 45, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2024, 3, 3, 10, 30, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: the 15th or any Sunday
+		{"0 0 15 * 0", time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: Next = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package collector
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// syncCycle collects what one sync cycle did, for the summary line logged once its sink
+// passes have finished. A nil *syncCycle ignores everything, for callers outside a cycle.
+type syncCycle struct {
+	id     string // Correlation ID carried into logs, the store, metrics and API requests
+	start  time.Time
+	passes sync.WaitGroup // Sink passes started by this cycle
+
+	mu             sync.Mutex
+	devicesOK      int
+	devicesFailed  int
+	devicesSkipped int
+	fetched        int
+	stored         int
+	delivered      int
+	devicesRead    map[string]bool          // Devices read successfully
+	devicesHeld    map[string]time.Time     // Devices not due, in a blackout or failed, with the time to read them from
+	recordCounts   map[string]recordCounter // Record counters of devices read, taken before reading
+}
+
+// newSyncCycle starts tracking a cycle
+func newSyncCycle() *syncCycle {
+	return &syncCycle{
+		id:           newCorrelationID(),
+		start:        time.Now(),
+		devicesRead:  map[string]bool{},
+		devicesHeld:  map[string]time.Time{},
+		recordCounts: map[string]recordCounter{},
+	}
+}
+
+// newCorrelationID returns a random ID for tracing a cycle or batch across logs and the backend
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ID returns the cycle's correlation ID, or "" outside a cycle
+func (c *syncCycle) ID() string {
+	if c == nil {
+		return ""
+	}
+	return c.id
+}
+
+// update applies fn to the cycle's counters under its lock
+func (c *syncCycle) update(fn func(c *syncCycle)) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn(c)
+}
+
+// finish logs the cycle summary once the cycle's sink passes are done. It runs in the
+// background, counted in sinkPasses so one-shot commands wait for the summary too.
+func (c *syncCycle) finish(err error) {
+	sinkPasses.Add(1)
+	go func() {
+		defer sinkPasses.Done()
+		c.passes.Wait()
+
+		backlog := 0
+		for _, s := range buildStatusReport().Sinks {
+			backlog += s.Backlog
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		noteCycleSummary(cycleSummary{
+			SyncID:        c.id,
+			FinishedAt:    time.Now().Format(time.RFC3339),
+			DevicesOK:     c.devicesOK,
+			DevicesFailed: c.devicesFailed,
+			Fetched:       c.fetched,
+			Delivered:     c.delivered,
+			ErrorCode:     ErrorCode(err),
+		})
+		// One logfmt line per cycle, for monitoring to parse
+		log.Printf("sync_summary sync_id=%s devices_ok=%d devices_failed=%d devices_skipped=%d fetched=%d stored=%d delivered=%d backlog=%d duration=%s error_code=%s",
+			c.id, c.devicesOK, c.devicesFailed, c.devicesSkipped, c.fetched, c.stored, c.delivered, backlog,
+			time.Since(c.start).Round(time.Millisecond), ErrorCode(err))
+	}()
+}
@@ -0,0 +1,43 @@
+package collector
+
+import (
+	"log"
+	"old-attendance/pkg/zk"
+	"strings"
+	"time"
+)
+
+// minRecordDate returns the MIN_RECORD_DATE (YYYY-MM-DD) configured for a device, or zero when unset
+func minRecordDate(deviceID string) time.Time {
+	value := strings.TrimSpace(deviceEnv("MIN_RECORD_DATE", deviceID))
+	if value == "" {
+		return time.Time{}
+	}
+	floor, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		log.Printf("Invalid MIN_RECORD_DATE %q for %s, ignoring", value, deviceID)
+		return time.Time{}
+	}
+	return floor
+}
+
+// filterByMinRecordDate drops records dated before their device's MIN_RECORD_DATE.
+// It applies regardless of the last check time, so old records are never uploaded.
+func filterByMinRecordDate(logs []zk.AttendanceRecord) ([]zk.AttendanceRecord, int) {
+	floors := map[string]time.Time{}
+	kept := make([]zk.AttendanceRecord, 0, len(logs))
+	dropped := 0
+	for _, record := range logs {
+		floor, ok := floors[record.DeviceID]
+		if !ok {
+			floor = minRecordDate(record.DeviceID)
+			floors[record.DeviceID] = floor
+		}
+		if t, err := record.Time(); err == nil && t.Before(floor) {
+			dropped++
+			continue
+		}
+		kept = append(kept, record)
+	}
+	return kept, dropped
+}
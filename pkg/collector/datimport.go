@@ -0,0 +1,251 @@
+package collector
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runAttendanceCommand handles the attendance subcommands
+func runAttendanceCommand(args []string) error {
+	if len(args) == 0 || args[0] != "import" {
+		return errors.New("usage: attendance import --file attlog.dat|export.csv|dump.sql [--device-serial SERIAL]")
+	}
+	return runAttendanceImport(args[1:])
+}
+
+// deviceBySerial finds the configured device with a serial number, set in DEVICE_SERIAL_<DEVICE>
+// or pinned on first contact
+func deviceBySerial(serial string) (deviceConfig, bool) {
+	pinned := loadDeviceSerials()
+	for _, device := range configuredDevices() {
+		expected := strings.TrimSpace(deviceEnv("DEVICE_SERIAL", device.ID))
+		if expected == "" {
+			expected = pinned[device.ID]
+		}
+		if expected != "" && expected == serial {
+			return device, true
+		}
+	}
+	return deviceConfig{}, false
+}
+
+// runAttendanceImport loads history into the same pipeline as a sync: a terminal's
+// attendance log exported to USB, such as the punches from before the collector was
+// deployed, or an export of ZKTeco's desktop software for customers migrating from ZKTime
+// or BioTime. Punches already in the record store are skipped, as are those a sync reads
+// from the device anyway, so importing a file twice or after the device was synced sends
+// nothing twice.
+func runAttendanceImport(args []string) error {
+	fs := flag.NewFlagSet("attendance import", flag.ExitOnError)
+	file := fs.String("file", "", "attendance log exported by the terminal (attlog.dat), or a CSV export or SQL dump of ZKTime or BioTime")
+	format := fs.String("format", "", "dat or export (default dat for .dat files, export otherwise)")
+	serial := fs.String("device-serial", "", "serial number of the terminal the punches were made on")
+	name := fs.String("device", "", "device ID as configured in DEVICE_IPS, in place of --device-serial")
+	users := fs.String("users", "", "with a ZKTime CHECKINOUT export, the USERINFO export mapping its users to badge numbers")
+	terminals := fs.String("terminals", "", "with an export, devices by the terminal's machine number or serial number, as 1=front,2=back")
+	dryRun := fs.Bool("dry-run", false, "print what would be imported without storing or sending it")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("--file is required")
+	}
+	var device deviceConfig
+	var ok bool
+	switch {
+	case *serial != "":
+		if device, ok = deviceBySerial(*serial); !ok {
+			return fmt.Errorf("no device in DEVICE_IPS has serial number %q; set DEVICE_SERIAL_<DEVICE> or pass --device", *serial)
+		}
+	case *name != "":
+		if device, ok = configuredDevice(*name); !ok {
+			return fmt.Errorf("--device %q is not in DEVICE_IPS", *name)
+		}
+	}
+	if *format == "" {
+		*format = "export"
+		if strings.EqualFold(filepath.Ext(*file), ".dat") {
+			*format = "dat"
+		}
+	}
+
+	apiURL := os.Getenv("API_URL")
+	orgID := os.Getenv("ORG_ID")
+	apiKey := os.Getenv("API_KEY")
+	if !*dryRun && (apiURL == "" || orgID == "") {
+		return configError("missing required environment variables (API_URL, ORG_ID)")
+	}
+
+	var records []zk.AttendanceRecord
+	switch *format {
+	case "dat":
+		if device.ID == "" {
+			return errors.New("--device-serial or --device is required")
+		}
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		zkManager, err := newDeviceManager(device)
+		if err != nil {
+			return err
+		}
+		if records, err = zkManager.ParseAttendanceDat(data); err != nil {
+			return fmt.Errorf("%s: %w", *file, err)
+		}
+	case "export":
+		var err error
+		if records, err = readExportPunches(*file, *users, *terminals, device.ID); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown --format %q (known: dat, export)", *format)
+	}
+	log.Printf("Read %d punch(es) from %s", len(records), *file)
+
+	stored := map[string]bool{}
+	storedRecords, err := readStore()
+	if err != nil {
+		return err
+	}
+	for _, r := range storedRecords {
+		stored[fmt.Sprintf("%d|%s|%s", r.Record.UserID, r.Record.Timestamp, r.Record.DeviceID)] = true
+	}
+	lastChecked := getLastCheckTime()
+	marks := loadDeviceSince()
+
+	// The store holds punches mapped to employees, so they are compared with a mapped copy
+	mapped := append([]zk.AttendanceRecord(nil), records...)
+	normalizeBadges(mapped)
+	if roster := loadRoster(); roster != nil {
+		mapped = applyRoster(mapped, roster)
+	}
+	var logs []zk.AttendanceRecord
+	known, later := 0, 0
+	for i, r := range records {
+		key := fmt.Sprintf("%d|%s|%s", mapped[i].UserID, r.Timestamp, r.DeviceID)
+		since := time.Time{}
+		if !lastChecked.IsZero() {
+			since = deviceSince(marks, r.DeviceID, lastChecked)
+		}
+		if t, err := r.Time(); err == nil && !since.IsZero() && t.After(since) {
+			later++
+		} else if stored[key] {
+			known++
+		} else {
+			stored[key] = true
+			logs = append(logs, r)
+		}
+	}
+	if known > 0 {
+		log.Printf("Skipping %d punch(es) already in the record store", known)
+	}
+	if later > 0 {
+		log.Printf("Skipping %d punch(es) since the last sync, which the next sync reads from the devices", later)
+	}
+	if len(logs) == 0 {
+		log.Println("Nothing to import")
+		return nil
+	}
+	log.Printf("Importing:")
+	printLogSummary(summarizeLogs(logs))
+	if *dryRun {
+		log.Println("Dry run: nothing stored or sent.")
+		return nil
+	}
+
+	if !deliverRecords(logs, orgID, apiURL, apiKey, nil, time.Time{}) {
+		return errors.New("failed to store imported logs")
+	}
+	sinkPasses.Wait()
+	return lastSinkPassError()
+}
+
+// readExportPunches reads the punches of a ZKTime or BioTime export and attributes them to
+// devices: all to device when set, otherwise by the terminal the software recorded, looked
+// up in terminals or among the serial numbers of the configured devices
+func readExportPunches(file, usersFile, terminals, device string) ([]zk.AttendanceRecord, error) {
+	tables, err := readLegacyFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var users []legacyTable
+	if usersFile != "" {
+		if users, err = readLegacyFile(usersFile); err != nil {
+			return nil, err
+		}
+	}
+	punches, err := legacyPunches(tables, users)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	byTerminal := map[string]string{}
+	for _, entry := range splitList(terminals) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --terminals entry %q, expected TERMINAL=DEVICE", entry)
+		}
+		if _, ok := configuredDevice(strings.TrimSpace(parts[1])); !ok {
+			return nil, fmt.Errorf("--terminals: device %q is not in DEVICE_IPS", parts[1])
+		}
+		terminal := strings.TrimSpace(parts[0])
+		if _, err := strconv.Atoi(terminal); err == nil {
+			terminal = "#" + terminal
+		}
+		byTerminal[terminal] = strings.TrimSpace(parts[1])
+	}
+
+	var records []zk.AttendanceRecord
+	unmatched := map[string]int{}
+	for _, p := range punches {
+		switch {
+		case device != "":
+			p.record.DeviceID = device
+		case byTerminal[p.terminal] != "":
+			p.record.DeviceID = byTerminal[p.terminal]
+		default:
+			if d, ok := deviceBySerial(p.terminal); ok && p.terminal != "" {
+				p.record.DeviceID = d.ID
+			} else {
+				unmatched[p.terminal]++
+				continue
+			}
+		}
+		records = append(records, p.record)
+	}
+	if len(unmatched) > 0 {
+		var names []string
+		for terminal, count := range unmatched {
+			if terminal == "" {
+				terminal = "unknown"
+			}
+			names = append(names, fmt.Sprintf("%s (%d punch(es))", strings.TrimPrefix(terminal, "#"), count))
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("punches from terminals not matched to a device: %s; map them with --terminals or pass --device", strings.Join(names, ", "))
+	}
+	return records, nil
+}
+
+// readLegacyFile reads a CSV export or SQL dump of the desktop software
+func readLegacyFile(file string) ([]legacyTable, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tables, err := readLegacyExport(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return tables, nil
+}
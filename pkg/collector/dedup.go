@@ -0,0 +1,205 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// File remembering the last accepted punch per user and device
+	dedupStateFile = "dedup_state.json"
+	// File collapsed duplicate punches are archived to, one JSON record per line
+	collapsedLogsFile = "collapsed_logs.jsonl"
+	// How long accepted punches are remembered beyond the collapse window,
+	// allowing for clock differences between devices and late deliveries
+	dedupStateRetention = 24 * time.Hour
+)
+
+// dedupState maps "device|user" to the timestamp of the last accepted punch
+type dedupState map[string]string
+
+// collapseRules configures which punches count as duplicates
+type collapseRules struct {
+	// Window collapses repeat punches by a user on the same device
+	Window time.Duration
+	// PairWindow collapses punches by a user on the partner of a paired device
+	PairWindow time.Duration
+	// Pairs maps a device ID to the devices it is paired with
+	Pairs map[string][]string
+}
+
+// enabled reports whether any collapse rule is active
+func (r collapseRules) enabled() bool {
+	return r.Window > 0 || (r.PairWindow > 0 && len(r.Pairs) > 0)
+}
+
+// loadCollapseRules reads the collapse configuration from the environment.
+// DEVICE_PAIRS lists paired devices as "A+B", separated by commas.
+func loadCollapseRules() collapseRules {
+	rules := collapseRules{
+		Window:     envSeconds("DUPLICATE_PUNCH_WINDOW"),
+		PairWindow: envSeconds("DEVICE_PAIR_WINDOW"),
+		Pairs:      map[string][]string{},
+	}
+	for _, pair := range strings.Split(os.Getenv("DEVICE_PAIRS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		devices := strings.Split(pair, "+")
+		if len(devices) != 2 || strings.TrimSpace(devices[0]) == "" || strings.TrimSpace(devices[1]) == "" {
+			log.Printf("Invalid DEVICE_PAIRS entry %q, expected DEVICE_A+DEVICE_B", pair)
+			continue
+		}
+		a, b := strings.TrimSpace(devices[0]), strings.TrimSpace(devices[1])
+		rules.Pairs[a] = append(rules.Pairs[a], b)
+		rules.Pairs[b] = append(rules.Pairs[b], a)
+	}
+	return rules
+}
+
+// collapseDuplicatePunches drops punches that follow an accepted punch by the same user
+// within the configured windows, either on the same device or on a paired device.
+// Manual punches are always kept. It returns the kept records, the collapsed ones,
+// and the updated state to persist after delivery.
+func collapseDuplicatePunches(logs []zk.AttendanceRecord, rules collapseRules, state dedupState) ([]zk.AttendanceRecord, []zk.AttendanceRecord, dedupState) {
+	sorted := make([]zk.AttendanceRecord, len(logs))
+	copy(sorted, logs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+
+	next := dedupState{}
+	for k, v := range state {
+		next[k] = v
+	}
+	// Punches accepted in this batch; a repeat of the same second is a double tap
+	seenInBatch := map[string]bool{}
+
+	// isDuplicate checks t against the last accepted punch stored under key
+	isDuplicate := func(key string, t time.Time, window time.Duration) bool {
+		if window <= 0 {
+			return false
+		}
+		last, ok := next[key]
+		if !ok {
+			return false
+		}
+		lastTime, err := time.ParseInLocation(zk.TimestampLayout, last, time.Local)
+		if err != nil {
+			return false
+		}
+		return (t.After(lastTime) || seenInBatch[key]) && t.Sub(lastTime) <= window
+	}
+
+	var kept, collapsed []zk.AttendanceRecord
+	for _, record := range sorted {
+		t, err := record.Time()
+		if record.Manual || err != nil {
+			kept = append(kept, record)
+			continue
+		}
+		key := dedupKey(record.DeviceID, record.UserID)
+		duplicate := isDuplicate(key, t, rules.Window)
+		for _, partner := range rules.Pairs[record.DeviceID] {
+			if duplicate {
+				break
+			}
+			duplicate = isDuplicate(dedupKey(partner, record.UserID), t, rules.PairWindow)
+		}
+		if duplicate {
+			collapsed = append(collapsed, record)
+			continue
+		}
+		last, ok := next[key]
+		if lastTime, err := time.ParseInLocation(zk.TimestampLayout, last, time.Local); !ok || err != nil || t.After(lastTime) {
+			next[key] = record.Timestamp
+		}
+		seenInBatch[key] = true
+		kept = append(kept, record)
+	}
+
+	window := rules.Window
+	if rules.PairWindow > window {
+		window = rules.PairWindow
+	}
+	pruneDedupState(next, window)
+	return kept, collapsed, next
+}
+
+// dedupKey builds the dedupState key for a user on a device
+func dedupKey(deviceID string, userID int) string {
+	return fmt.Sprintf("%s|%d", deviceID, userID)
+}
+
+// pruneDedupState forgets punches too old to collapse anything anymore
+func pruneDedupState(state dedupState, window time.Duration) {
+	var newest time.Time
+	for _, v := range state {
+		if t, err := time.ParseInLocation(zk.TimestampLayout, v, time.Local); err == nil && t.After(newest) {
+			newest = t
+		}
+	}
+	for k, v := range state {
+		t, err := time.ParseInLocation(zk.TimestampLayout, v, time.Local)
+		if err != nil || newest.Sub(t) > window+dedupStateRetention {
+			delete(state, k)
+		}
+	}
+}
+
+// loadDedupState reads the collapse state from the state store, or returns an empty state
+func loadDedupState() dedupState {
+	dedup := dedupState{}
+	data, err := state().Get(dedupStateFile)
+	if err != nil || data == nil {
+		return dedup
+	}
+	if err := json.Unmarshal(data, &dedup); err != nil {
+		return dedupState{}
+	}
+	return dedup
+}
+
+// saveDedupState writes the collapse state to the state store
+func saveDedupState(dedup dedupState) error {
+	data, err := json.Marshal(dedup)
+	if err != nil {
+		return err
+	}
+	return state().Put(dedupStateFile, data)
+}
+
+// archiveCollapsedLogs appends collapsed punches to the local archive
+func archiveCollapsedLogs(logs []zk.AttendanceRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range logs {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return appendLocalFile(collapsedLogsFile, buf.Bytes())
+}
+
+// commitCollapsedLogs archives collapsed punches and persists the collapse state once a batch is done
+func commitCollapsedLogs(collapsed []zk.AttendanceRecord, state dedupState) {
+	if state == nil {
+		return
+	}
+	if len(collapsed) > 0 {
+		if err := archiveCollapsedLogs(collapsed); err != nil {
+			log.Printf("Error archiving collapsed logs: %v", err)
+		}
+	}
+	if err := saveDedupState(state); err != nil {
+		log.Printf("Error saving dedup state: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"old-attendance/pkg/zk"
+)
+
+// punch is a record of a user on a device at a clock time on March 1st, 2024
+func punch(deviceID string, userID int, clock string) zk.AttendanceRecord {
+	return zk.AttendanceRecord{UserID: userID, DeviceID: deviceID, Timestamp: "2024-03-01T" + clock}
+}
+
+func TestCollapseDuplicatePunches(t *testing.T) {
+	rules := collapseRules{Window: time.Minute}
+	manual := punch("gate", 1, "09:00:20")
+	manual.Manual = true
+
+	tests := []struct {
+		name      string
+		logs      []zk.AttendanceRecord
+		state     dedupState
+		collapsed []string // Timestamps of the collapsed punches
+	}{
+		{"repeat within the window", []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("gate", 1, "09:00:45")}, nil, []string{"09:00:45"}},
+		{"repeat at the end of the window", []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("gate", 1, "09:01:00")}, nil, []string{"09:01:00"}},
+		{"repeat after the window", []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("gate", 1, "09:01:01")}, nil, nil},
+		{"window from the accepted punch", []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("gate", 1, "09:00:40"), punch("gate", 1, "09:01:20")}, nil, []string{"09:00:40"}},
+		{"out of order", []zk.AttendanceRecord{punch("gate", 1, "09:00:30"), punch("gate", 1, "09:00:00")}, nil, []string{"09:00:30"}},
+		{"double tap", []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("gate", 1, "09:00:00")}, nil, []string{"09:00:00"}},
+		{"other user", []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("gate", 2, "09:00:10")}, nil, nil},
+		{"other device", []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("lobby", 1, "09:00:10")}, nil, nil},
+		{"manual punch", []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), manual}, nil, nil},
+		{"last batch", []zk.AttendanceRecord{punch("gate", 1, "09:00:30")}, dedupState{"gate|1": "2024-03-01T09:00:00"}, []string{"09:00:30"}},
+		{"punch read again", []zk.AttendanceRecord{punch("gate", 1, "09:00:00")}, dedupState{"gate|1": "2024-03-01T09:00:00"}, nil},
+	}
+	for _, tt := range tests {
+		kept, collapsed, _ := collapseDuplicatePunches(tt.logs, rules, tt.state)
+		if len(kept)+len(collapsed) != len(tt.logs) {
+			t.Errorf("%s: %d kept and %d collapsed of %d punches", tt.name, len(kept), len(collapsed), len(tt.logs))
+		}
+		var got []string
+		for _, record := range collapsed {
+			got = append(got, record.Timestamp[len("2024-03-01T"):])
+		}
+		if !equalStrings(got, tt.collapsed) {
+			t.Errorf("%s: collapsed %v, want %v", tt.name, got, tt.collapsed)
+		}
+	}
+}
+
+func TestCollapseDuplicatePunchesState(t *testing.T) {
+	rules := collapseRules{Window: time.Minute}
+	state := dedupState{
+		"gate|1":  "2024-03-01T08:00:00",
+		"gate|2":  "2024-02-28T09:00:00",
+		"gate|3":  "garbage",
+		"lobby|1": "2024-03-01T09:30:00",
+	}
+	logs := []zk.AttendanceRecord{punch("gate", 1, "09:00:00"), punch("gate", 1, "09:00:30"), punch("gate", 4, "09:10:00")}
+	_, _, next := collapseDuplicatePunches(logs, rules, state)
+
+	want := dedupState{
+		"gate|1":  "2024-03-01T09:00:00",
+		"gate|4":  "2024-03-01T09:10:00",
+		"lobby|1": "2024-03-01T09:30:00",
+	}
+	if len(next) != len(want) {
+		t.Errorf("state = %v, want %v", next, want)
+	}
+	for key, value := range want {
+		if next[key] != value {
+			t.Errorf("state[%q] = %q, want %q", key, next[key], value)
+		}
+	}
+	if state["gate|1"] != "2024-03-01T08:00:00" || len(state) != 4 {
+		t.Errorf("the given state was modified: %v", state)
+	}
+
+	// A punch older than the stored one leaves the state alone
+	_, _, next = collapseDuplicatePunches([]zk.AttendanceRecord{punch("lobby", 1, "09:00:00")}, rules, next)
+	if next["lobby|1"] != "2024-03-01T09:30:00" {
+		t.Errorf("state[lobby|1] = %q, want the newer punch kept", next["lobby|1"])
+	}
+}
+
+func TestCollapsePairedPunches(t *testing.T) {
+	rules := collapseRules{
+		Window:     time.Minute,
+		PairWindow: 2 * time.Minute,
+		Pairs:      map[string][]string{"in": {"out"}, "out": {"in"}},
+	}
+	tests := []struct {
+		name      string
+		logs      []zk.AttendanceRecord
+		state     dedupState
+		collapsed []string
+	}{
+		{"paired device", []zk.AttendanceRecord{punch("in", 1, "09:00:00"), punch("out", 1, "09:01:30")}, nil, []string{"09:01:30"}},
+		{"paired device after its window", []zk.AttendanceRecord{punch("in", 1, "09:00:00"), punch("out", 1, "09:02:30")}, nil, nil},
+		{"other user on the paired device", []zk.AttendanceRecord{punch("in", 1, "09:00:00"), punch("out", 2, "09:00:30")}, nil, nil},
+		{"unpaired device", []zk.AttendanceRecord{punch("in", 1, "09:00:00"), punch("lobby", 1, "09:00:30")}, nil, nil},
+		{"last batch on the paired device", []zk.AttendanceRecord{punch("out", 1, "09:01:00")}, dedupState{"in|1": "2024-03-01T09:00:00"}, []string{"09:01:00"}},
+	}
+	for _, tt := range tests {
+		_, collapsed, _ := collapseDuplicatePunches(tt.logs, rules, tt.state)
+		var got []string
+		for _, record := range collapsed {
+			got = append(got, record.Timestamp[len("2024-03-01T"):])
+		}
+		if !equalStrings(got, tt.collapsed) {
+			t.Errorf("%s: collapsed %v, want %v", tt.name, got, tt.collapsed)
+		}
+	}
+}
+
+func TestLoadCollapseRulesPairs(t *testing.T) {
+	t.Setenv("DEVICE_PAIRS", " in + out ,lobby+,broken, a+b+c ,dock+in")
+	rules := loadCollapseRules()
+	want := map[string][]string{"in": {"out", "dock"}, "out": {"in"}, "dock": {"in"}}
+	if len(rules.Pairs) != len(want) {
+		t.Errorf("pairs = %v, want %v", rules.Pairs, want)
+	}
+	for device, partners := range want {
+		if !equalStrings(rules.Pairs[device], partners) {
+			t.Errorf("partners of %s = %v, want %v", device, rules.Pairs[device], partners)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File holding queued device commands and their outcome
+const deviceCommandsFile = "device_commands.json"
+
+// Device command actions
+const (
+	actionSetTime     = "set_time"
+	actionClearLogs   = "clear_logs"
+	actionAddUser     = "add_user"
+	actionDisableUser = "disable_user"
+	actionUnlockDoor  = "unlock_door"
+	actionReboot      = "reboot"
+)
+
+// Device command states
+const (
+	commandPending = "pending"
+	commandDone    = "done"
+	commandFailed  = "failed"
+)
+
+// DeviceCommand is an operation queued for a device, run the next time the device is reachable
+type DeviceCommand struct {
+	ID        string            `json:"id"`
+	Device    string            `json:"device"`
+	Action    string            `json:"action"`
+	Args      map[string]string `json:"args,omitempty"`
+	Status    string            `json:"status"`
+	Attempts  int               `json:"attempts"`
+	LastError string            `json:"last_error,omitempty"`
+	CreatedAt string            `json:"created_at"`
+	UpdatedAt string            `json:"updated_at,omitempty"`
+}
+
+// deviceCommandsMu serializes read-modify-write cycles of the command queue within this process
+var deviceCommandsMu sync.Mutex
+
+// runDeviceCommandCommand handles the "device-command" subcommands
+func runDeviceCommandCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: device-command add --device NAME --action ACTION [options] | list | cancel --id ID")
+	}
+	switch args[0] {
+	case "add":
+		return addDeviceCommand(args[1:])
+	case "list":
+		return listDeviceCommands()
+	case "cancel":
+		return cancelDeviceCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown device-command command %q", args[0])
+	}
+}
+
+// addDeviceCommand queues a command for a device and records it in the audit log
+func addDeviceCommand(args []string) error {
+	fs := flag.NewFlagSet("device-command add", flag.ExitOnError)
+	device := fs.String("device", "", "device ID as configured in DEVICE_IPS")
+	action := fs.String("action", "", "set_time, clear_logs, add_user, disable_user, unlock_door, reboot, check_capacity or snapshot_users")
+	timeStr := fs.String("time", "", "set_time: clock value, default is the time the command runs")
+	userID := fs.Int("user", 0, "add_user, disable_user: user ID")
+	name := fs.String("name", "", "add_user: name shown on the terminal")
+	card := fs.Uint("card", 0, "add_user: card number")
+	seconds := fs.Int("seconds", 5, "unlock_door: how long to hold the door open")
+	fs.Parse(args)
+
+	if _, ok := configuredDevice(*device); !ok {
+		return fmt.Errorf("--device %q is not in DEVICE_IPS", *device)
+	}
+
+	cmdArgs := map[string]string{}
+	switch *action {
+	case actionSetTime:
+		if *timeStr != "" {
+			t, err := parsePunchTime(*timeStr)
+			if err != nil {
+				return err
+			}
+			cmdArgs["time"] = t.Format(time.RFC3339)
+		}
+	case actionAddUser:
+		if *userID <= 0 {
+			return errors.New("--user is required for add_user")
+		}
+		cmdArgs["user"] = strconv.Itoa(*userID)
+		cmdArgs["name"] = *name
+		cmdArgs["card"] = strconv.FormatUint(uint64(*card), 10)
+	case actionDisableUser:
+		if *userID <= 0 {
+			return errors.New("--user is required for disable_user")
+		}
+		cmdArgs["user"] = strconv.Itoa(*userID)
+	case actionUnlockDoor:
+		if *seconds <= 0 {
+			return errors.New("--seconds must be positive")
+		}
+		cmdArgs["seconds"] = strconv.Itoa(*seconds)
+	case actionClearLogs, actionReboot, actionCheckCapacity, actionSnapshotUsers:
+	default:
+		return fmt.Errorf("unknown --action %q", *action)
+	}
+
+	cmd := newDeviceCommand(*device, *action, cmdArgs)
+	if err := queueDeviceCommand(cmd); err != nil {
+		return err
+	}
+	log.Printf("Queued %s for device %s (id %s)", cmd.Action, cmd.Device, cmd.ID)
+	return nil
+}
+
+// lastCommandID keeps command IDs unique when commands are queued faster than the clock ticks
+var lastCommandID = struct {
+	sync.Mutex
+	nanos int64
+}{}
+
+// newDeviceCommand creates a pending command
+func newDeviceCommand(device, action string, args map[string]string) DeviceCommand {
+	now := time.Now()
+	lastCommandID.Lock()
+	id := now.UnixNano()
+	if id <= lastCommandID.nanos {
+		id = lastCommandID.nanos + 1
+	}
+	lastCommandID.nanos = id
+	lastCommandID.Unlock()
+	cmd := DeviceCommand{
+		ID:        strconv.FormatInt(id, 36),
+		Device:    device,
+		Action:    action,
+		Status:    commandPending,
+		CreatedAt: now.Format(time.RFC3339),
+	}
+	if len(args) > 0 {
+		cmd.Args = args
+	}
+	return cmd
+}
+
+// queueDeviceCommand appends a command to the queue and records it in the audit log
+func queueDeviceCommand(cmd DeviceCommand) error {
+	deviceCommandsMu.Lock()
+	defer deviceCommandsMu.Unlock()
+	commands, err := loadDeviceCommands()
+	if err != nil {
+		return err
+	}
+	if err := saveDeviceCommands(append(commands, cmd)); err != nil {
+		return fmt.Errorf("failed to queue device command: %w", err)
+	}
+	if err := appendAudit("device_command_queued", cmd); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+	return nil
+}
+
+// listDeviceCommands prints the queue with each command's status
+func listDeviceCommands() error {
+	commands, err := loadDeviceCommands()
+	if err != nil {
+		return err
+	}
+	if len(commands) == 0 {
+		log.Println("No device commands queued.")
+		return nil
+	}
+	for _, cmd := range commands {
+		line := fmt.Sprintf("%s  %-12s %-20s %-8s attempts=%d", cmd.ID, cmd.Action, cmd.Device, cmd.Status, cmd.Attempts)
+		if cmd.LastError != "" {
+			line += "  error: " + cmd.LastError
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// cancelDeviceCommand removes a pending command from the queue
+func cancelDeviceCommand(args []string) error {
+	fs := flag.NewFlagSet("device-command cancel", flag.ExitOnError)
+	id := fs.String("id", "", "ID of the command to cancel")
+	fs.Parse(args)
+
+	deviceCommandsMu.Lock()
+	defer deviceCommandsMu.Unlock()
+	commands, err := loadDeviceCommands()
+	if err != nil {
+		return err
+	}
+	for i, cmd := range commands {
+		if cmd.ID != *id {
+			continue
+		}
+		if cmd.Status != commandPending {
+			return fmt.Errorf("command %s already %s", cmd.ID, cmd.Status)
+		}
+		if err := saveDeviceCommands(append(commands[:i], commands[i+1:]...)); err != nil {
+			return err
+		}
+		if err := appendAudit("device_command_cancelled", cmd); err != nil {
+			log.Printf("Error writing audit log: %v", err)
+		}
+		log.Printf("Cancelled %s for device %s", cmd.Action, cmd.Device)
+		return nil
+	}
+	return fmt.Errorf("no command with id %q", *id)
+}
+
+// runDeviceCommandsJob runs the device command queue as a job holding every device, as any
+// of them may have commands
+func runDeviceCommandsJob(cycleStart time.Time, stored bool) {
+	runJob(&job{group: jobGroupMaintenance, name: "device commands", devices: allDeviceIDs(), run: func() error {
+		runDeviceCommands(cycleStart, stored)
+		return nil
+	}})
+}
+
+// runDeviceCommands executes pending commands in queue order. Devices that cannot be
+// reached keep their commands for the next cycle; commands a device rejects are failed.
+// clear_logs only runs when the device was read this cycle and the batch was stored, so
+// no punch is ever deleted before it is safe locally.
+func runDeviceCommands(cycleStart time.Time, stored bool) {
+	deviceCommandsMu.Lock()
+	defer deviceCommandsMu.Unlock()
+	commands, err := loadDeviceCommands()
+	if err != nil {
+		log.Printf("Error loading device commands: %v", err)
+		return
+	}
+
+	unreachable := map[string]bool{}
+	changed := false
+	for i := range commands {
+		cmd := &commands[i]
+		if cmd.Status != commandPending || unreachable[cmd.Device] {
+			continue
+		}
+		if cmd.Action == actionClearLogs && !(stored && deviceReadSince(cmd.Device, cycleStart)) {
+			continue
+		}
+		device, ok := configuredDevice(cmd.Device)
+		if !ok {
+			cmd.Status = commandFailed
+			cmd.LastError = "device is no longer configured"
+			changed = true
+			continue
+		}
+		if _, ok := activeBlackout(device.ID, time.Now()); ok {
+			continue
+		}
+
+		cmd.Attempts++
+		cmd.UpdatedAt = time.Now().Format(time.RFC3339)
+		changed = true
+		err := executeDeviceCommand(device, *cmd)
+		switch {
+		case err == nil:
+			cmd.Status = commandDone
+			cmd.LastError = ""
+			log.Printf("Device command %s (%s) done on %s", cmd.ID, cmd.Action, cmd.Device)
+		case errors.Is(err, zk.ErrDeviceUnreachable):
+			// Try again once the device is back online
+			unreachable[cmd.Device] = true
+			cmd.LastError = err.Error()
+		default:
+			cmd.Status = commandFailed
+			cmd.LastError = err.Error()
+			log.Printf("Device command %s (%s) failed on %s: %v", cmd.ID, cmd.Action, cmd.Device, err)
+		}
+		if cmd.Status != commandPending {
+			if err := appendAudit("device_command_"+cmd.Status, cmd); err != nil {
+				log.Printf("Error writing audit log: %v", err)
+			}
+		}
+	}
+
+	if !changed {
+		return
+	}
+	// Commands may have been queued or cancelled from the CLI meanwhile, so merge into the
+	// current queue instead of overwriting it
+	updated := map[string]DeviceCommand{}
+	for _, cmd := range commands {
+		updated[cmd.ID] = cmd
+	}
+	current, err := loadDeviceCommands()
+	if err != nil {
+		log.Printf("Error loading device commands: %v", err)
+		return
+	}
+	for i, cmd := range current {
+		if u, ok := updated[cmd.ID]; ok {
+			current[i] = u
+		}
+	}
+	if err := saveDeviceCommands(current); err != nil {
+		log.Printf("Error saving device commands: %v", err)
+	}
+}
+
+// disableDeviceUser sets the disabled bit of a user, keeping the rest of the record. A user
+// not on the terminal is left alone.
+func disableDeviceUser(zkManager *zk.ZKManager, deviceID string, userID int) error {
+	users, err := zkManager.GetUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.UserID == userID && !user.Disabled() {
+			user.Privilege |= zk.PrivilegeDisabled
+			if err := zkManager.SetUser(user); err != nil {
+				return err
+			}
+			noteEnrolledUser(deviceID, user)
+			return nil
+		}
+	}
+	return nil
+}
+
+// executeDeviceCommand runs one command against a device
+func executeDeviceCommand(device deviceConfig, cmd DeviceCommand) error {
+	zkManager, err := newDeviceManager(device)
+	if err != nil {
+		return err
+	}
+
+	switch cmd.Action {
+	case actionSetTime:
+		t := time.Now()
+		if value := cmd.Args["time"]; value != "" {
+			if t, err = time.Parse(time.RFC3339, value); err != nil {
+				return fmt.Errorf("invalid time argument: %w", err)
+			}
+		}
+		return zkManager.SetTime(t)
+	case actionClearLogs:
+		// Forgotten first, so a clear whose reply is lost still ends in a full read
+		forgetRecordCounter(device.ID)
+		return zkManager.ClearAttendance()
+	case actionAddUser:
+		userID, err := strconv.Atoi(cmd.Args["user"])
+		if err != nil {
+			return fmt.Errorf("invalid user argument: %w", err)
+		}
+		card, _ := strconv.ParseUint(cmd.Args["card"], 10, 32)
+		privilege, _ := strconv.Atoi(cmd.Args["privilege"])
+		user := zk.User{UserID: userID, Name: cmd.Args["name"], CardNumber: uint32(card), Privilege: privilege}
+		if err := zkManager.SetUser(user); err != nil {
+			return err
+		}
+		noteEnrolledUser(device.ID, user)
+		return nil
+	case actionDisableUser:
+		userID, err := strconv.Atoi(cmd.Args["user"])
+		if err != nil {
+			return fmt.Errorf("invalid user argument: %w", err)
+		}
+		return disableDeviceUser(zkManager, device.ID, userID)
+	case actionUnlockDoor:
+		seconds, _ := strconv.Atoi(cmd.Args["seconds"])
+		return zkManager.UnlockDoor(time.Duration(seconds) * time.Second)
+	case actionReboot:
+		return zkManager.Restart()
+	case actionCheckCapacity:
+		return checkDeviceCapacity(device)
+	case actionSnapshotUsers:
+		return snapshotDeviceUsers(device)
+	default:
+		return fmt.Errorf("unknown action %q", cmd.Action)
+	}
+}
+
+// configuredDevice looks up a device in DEVICE_IPS by ID
+func configuredDevice(id string) (deviceConfig, bool) {
+	for _, entry := range strings.Split(os.Getenv("DEVICE_IPS"), ",") {
+		device, err := parseDevice(strings.TrimSpace(entry))
+		if err == nil && device.ID == id {
+			return device, true
+		}
+	}
+	return deviceConfig{}, false
+}
+
+// loadDeviceCommands reads the command queue, returning none if nothing was ever queued
+func loadDeviceCommands() ([]DeviceCommand, error) {
+	data, err := state().Get(deviceCommandsFile)
+	if data == nil && err == nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", deviceCommandsFile, err)
+	}
+	var commands []DeviceCommand
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", deviceCommandsFile, err)
+	}
+	return commands, nil
+}
+
+// saveDeviceCommands overwrites the command queue
+func saveDeviceCommands(commands []DeviceCommand) error {
+	data, err := json.MarshalIndent(commands, "", "  ")
+	if err != nil {
+		return err
+	}
+	return state().Put(deviceCommandsFile, data)
+}
+
+// handleDeviceCommands serves the command queue and its status as JSON. It needs the
+// ADMIN_TOKEN bearer token, as user commands carry names and cards.
+func handleDeviceCommands(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	commands, err := loadDeviceCommands()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if commands == nil {
+		commands = []DeviceCommand{}
+	}
+	w.Header().Set(contentTypeHeader, jsonContentType)
+	json.NewEncoder(w).Encode(commands)
+}
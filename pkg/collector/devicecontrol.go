@@ -0,0 +1,230 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runDeviceCommand handles the "device" subcommands, which act on a terminal immediately
+func runDeviceCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: device restart|diagnostics|users|capture --device NAME")
+	}
+	fs := flag.NewFlagSet("device "+args[0], flag.ExitOnError)
+	name := fs.String("device", "", "device ID as configured in DEVICE_IPS")
+	operation := fs.String("op", "attendance", "with capture, the operation to record: "+strings.Join(zk.CaptureOperations(), ", "))
+	out := fs.String("out", "", "with capture, the file to write (default capture-<device>-<op>.json)")
+	fs.Parse(args[1:])
+
+	device, ok := configuredDevice(*name)
+	if !ok {
+		return fmt.Errorf("--device %q is not in DEVICE_IPS", *name)
+	}
+	zkManager, err := newDeviceManager(device)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "restart":
+		if err := restartDevice(zkManager); err != nil {
+			return err
+		}
+		log.Printf("Restart sent to device %s", device.ID)
+		return nil
+	case "diagnostics":
+		diagnostics, err := zkManager.GetDiagnostics()
+		if err != nil {
+			return fmt.Errorf("failed to read diagnostics from %s: %w", device.ID, err)
+		}
+		data, _ := json.MarshalIndent(diagnostics, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	case "users":
+		users, err := zkManager.GetUsers()
+		if err != nil {
+			return fmt.Errorf("failed to read users from %s: %w", device.ID, err)
+		}
+		for _, user := range users {
+			fmt.Printf("%8d  %10d  %s\n", user.UserID, user.CardNumber, user.Name)
+		}
+		log.Printf("%d user(s) on device %s", len(users), device.ID)
+		return nil
+	case "capture":
+		return captureDevice(zkManager, *operation, *out)
+	default:
+		return fmt.Errorf("unknown device command %q", args[0])
+	}
+}
+
+// readTimeoutOnce applies ZK_READ_TIMEOUT to attendance reads, which share one process-wide deadline
+var readTimeoutOnce sync.Once
+
+// deviceLocation returns the time zone of a device's clock, from ZK_TIMEZONE
+func deviceLocation(deviceID string) *time.Location {
+	if tz := deviceEnv("ZK_TIMEZONE", deviceID); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			return loc
+		}
+	}
+	loc, err := time.LoadLocation(zk.DefaultTimezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// newDeviceManager creates a device client with the configured connection settings
+func newDeviceManager(device deviceConfig) (*zk.ZKManager, error) {
+	readTimeoutOnce.Do(func() {
+		zk.SetReadTimeout(envSeconds("ZK_READ_TIMEOUT"))
+	})
+
+	var zkManager *zk.ZKManager
+	if device.Serial != "" {
+		zkManager = zk.NewSerialZKManager(device.Serial, deviceEnvInt("ZK_BAUD_RATE", device.ID))
+	} else {
+		var err error
+		zkManager, err = zk.NewZKManager(device.IP, device.Port)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ZKManager for %s: %w", device.Addr(), err)
+		}
+	}
+	zkManager.Name = device.ID
+	zkManager.Persistent = envBool("ZK_PERSISTENT_CONNECTIONS")
+	if strings.TrimSpace(deviceEnv("ZK_KEEPALIVE", device.ID)) == "0" {
+		zkManager.KeepAlive = -1
+	} else {
+		zkManager.KeepAlive = deviceEnvSeconds("ZK_KEEPALIVE", device.ID)
+	}
+	zkManager.DisableDuringRead = deviceEnvBool("ZK_DISABLE_DURING_READ", device.ID)
+	zkManager.ConnectTimeout = deviceEnvSeconds("ZK_CONNECT_TIMEOUT", device.ID)
+	zkManager.ReadTimeout = deviceEnvSeconds("ZK_READ_TIMEOUT", device.ID)
+	zkManager.Retries = deviceEnvInt("ZK_RETRIES", device.ID)
+	zkManager.ReadModality = deviceEnvBool("ZK_READ_MODALITY", device.ID)
+	zkManager.ReadCardNumbers = deviceEnvBool("ZK_READ_CARDS", device.ID)
+	if pause := deviceEnv("ZK_CHUNK_PAUSE", device.ID); pause != "" {
+		if d, err := time.ParseDuration(pause); err == nil && d >= 0 {
+			zkManager.ChunkPause = d
+		} else {
+			log.Printf("Invalid ZK_CHUNK_PAUSE=%q for %s, ignoring", pause, device.ID)
+		}
+	}
+	if tz := deviceEnv("ZK_TIMEZONE", device.ID); tz != "" {
+		if err := zkManager.SetTimezone(tz); err != nil {
+			log.Printf("Invalid ZK_TIMEZONE=%q for %s, using %s", tz, device.ID, zkManager.Timezone())
+		}
+	}
+	if encoding := deviceEnv("ZK_NAME_ENCODING", device.ID); zk.ValidNameEncoding(encoding) {
+		zkManager.NameEncoding = encoding
+	} else {
+		log.Printf("Invalid ZK_NAME_ENCODING=%q for %s, guessing name encodings", encoding, device.ID)
+	}
+	return zkManager, nil
+}
+
+// restartDevice reboots a terminal and records it in the audit log
+func restartDevice(zkManager *zk.ZKManager) error {
+	if err := zkManager.Restart(); err != nil {
+		return fmt.Errorf("failed to restart %s: %w", zkManager.Name, err)
+	}
+	if err := appendAudit("device_restarted", map[string]string{"device": zkManager.Name}); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+	return nil
+}
+
+// handleDeviceDiagnostics serves GET /api/devices/diagnostics?device=NAME. It needs the
+// ADMIN_TOKEN bearer token, as it talks to the device.
+func handleDeviceDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	zkManager, ok := adminDeviceManager(w, r)
+	if !ok {
+		return
+	}
+	// Like every job talking to the device, the read waits for a sync cycle's read of it
+	var diagnostics *zk.Diagnostics
+	err := runJob(&job{group: jobGroupMaintenance, name: "diagnostics " + zkManager.Name, devices: []string{zkManager.Name}, run: func() error {
+		var err error
+		diagnostics, err = zkManager.GetDiagnostics()
+		return err
+	}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set(contentTypeHeader, jsonContentType)
+	json.NewEncoder(w).Encode(diagnostics)
+}
+
+// handleDeviceRestart serves POST /api/devices/restart?device=NAME. It needs the
+// ADMIN_TOKEN bearer token.
+func handleDeviceRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !adminAuthorized(w, r) {
+		return
+	}
+	zkManager, ok := adminDeviceManager(w, r)
+	if !ok {
+		return
+	}
+	err := runJob(&job{group: jobGroupMaintenance, name: "restart " + zkManager.Name, devices: []string{zkManager.Name}, run: func() error {
+		return restartDevice(zkManager)
+	}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// adminAuthorized checks the ADMIN_TOKEN bearer token of a request that changes state or
+// reads personal data, writing an error response if it is missing or wrong. Without an
+// ADMIN_TOKEN such requests are refused, whoever can reach the admin server.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		http.Error(w, "forbidden: set ADMIN_TOKEN to use this endpoint", http.StatusForbidden)
+		return false
+	}
+	// Compared as hashes in constant time, so neither the token nor its length shows in timing
+	got := sha256.Sum256([]byte(r.Header.Get(authorizationHeader)))
+	want := sha256.Sum256([]byte(bearerPrefix + token))
+	if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// adminDeviceManager resolves the device query parameter, writing an error response if it is unknown
+func adminDeviceManager(w http.ResponseWriter, r *http.Request) (*zk.ZKManager, bool) {
+	name := strings.TrimSpace(r.URL.Query().Get("device"))
+	device, ok := configuredDevice(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown device %q", name), http.StatusNotFound)
+		return nil, false
+	}
+	zkManager, err := newDeviceManager(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return zkManager, true
+}
@@ -0,0 +1,86 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuthorized(t *testing.T) {
+	tests := []struct {
+		token  string
+		header string
+		want   bool
+	}{
+		{"", "", false},
+		{"", "Bearer ", false},
+		{"secret", "Bearer secret", true},
+		{"secret", "", false},
+		{"secret", "Bearer secre", false},
+		{"secret", "Bearer secret2", false},
+		{"secret", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("ADMIN_TOKEN", tt.token)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set(authorizationHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		if got := adminAuthorized(w, r); got != tt.want {
+			t.Errorf("token %q, header %q: authorized = %v, want %v", tt.token, tt.header, got, tt.want)
+		}
+		wantCode := http.StatusUnauthorized
+		if tt.token == "" {
+			wantCode = http.StatusForbidden
+		}
+		if !tt.want && w.Code != wantCode {
+			t.Errorf("token %q, header %q: status %d, want %d", tt.token, tt.header, w.Code, wantCode)
+		}
+	}
+}
+
+func TestDeviceDiagnosticsNeedsAdminToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	t.Setenv("DEVICE_IPS", "gate=127.0.0.1:1")
+	for header, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusNotFound, // Authorized, then the device is looked up
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/devices/diagnostics?device=unknown", nil)
+		if header != "" {
+			r.Header.Set(authorizationHeader, header)
+		}
+		w := httptest.NewRecorder()
+		handleDeviceDiagnostics(w, r)
+		if w.Code != want {
+			t.Errorf("Authorization %q: status %d, want %d", header, w.Code, want)
+		}
+	}
+}
+
+func TestAdminEndpointsNeedToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "")
+	tests := []struct {
+		method, target string
+		handler        http.HandlerFunc
+	}{
+		{http.MethodGet, "/api/records", handleRecords},
+		{http.MethodGet, "/api/events", handleEvents},
+		{http.MethodGet, "/api/commands.json", handleDeviceCommands},
+		{http.MethodPost, "/api/tasks/run?task=sync", handleTaskRun},
+		{http.MethodPost, "/api/log-level?level=debug", handleLogLevel},
+		{http.MethodPost, "/api/devices/restart?device=gate", handleDeviceRestart},
+		{http.MethodGet, "/api/devices/diagnostics?device=gate", handleDeviceDiagnostics},
+		{http.MethodGet, "/api/occupancy.json?employees=true", handleOccupancy},
+		{http.MethodGet, "/api/stats.json?by=user", handleStats},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s without ADMIN_TOKEN: status %d, want 403", tt.method, tt.target, w.Code)
+		}
+	}
+}
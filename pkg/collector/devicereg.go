@@ -0,0 +1,207 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State key of the devices registered with DEVICE_REGISTER_URL and the settings received
+const deviceRegistrationsFile = "device_registrations.json"
+
+// deviceSettingKey is the form of a setting the backend may set per device
+var deviceSettingKey = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// DeviceRegistration is the body posted to DEVICE_REGISTER_URL for a device
+type DeviceRegistration struct {
+	OrgID    string `json:"org_id"`
+	DeviceID string `json:"device_id"`
+	Serial   string `json:"serial,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	Address  string `json:"address"` // ip:port, or the serial port path
+}
+
+// DeviceSettings is the backend's answer to a registration: the org the device belongs to,
+// the time zone its punches are expected in, and settings for the device such as
+// DEVICE_BRANCH or ZK_READ_MODALITY, applied as DEVICE_BRANCH_<DEVICE> and so on
+type DeviceSettings struct {
+	OrgID    string            `json:"org_id,omitempty"`
+	Timezone string            `json:"timezone,omitempty"`
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// deviceRegistration is a registered device in the state store
+type deviceRegistration struct {
+	Serial       string         `json:"serial,omitempty"`
+	Address      string         `json:"address"`
+	RegisteredAt time.Time      `json:"registered_at"`
+	Settings     DeviceSettings `json:"settings"`
+}
+
+// registrations guards the registrations state, and remembers the device settings this
+// process set so a later answer can replace them
+var registrations = struct {
+	sync.Mutex
+	applied map[string]bool
+}{applied: map[string]bool{}}
+
+// loadDeviceRegistrations reads the registered devices by device ID. The caller holds the
+// registrations lock.
+func loadDeviceRegistrations() map[string]deviceRegistration {
+	registered := map[string]deviceRegistration{}
+	data, err := state().Get(deviceRegistrationsFile)
+	if err != nil || data == nil {
+		return registered
+	}
+	if err := json.Unmarshal(data, &registered); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", deviceRegistrationsFile, err)
+		return map[string]deviceRegistration{}
+	}
+	return registered
+}
+
+// postDeviceRegistration registers a device with DEVICE_REGISTER_URL
+func postDeviceRegistration(url string, registration DeviceRegistration) (DeviceSettings, error) {
+	var settings DeviceSettings
+	body, err := json.Marshal(registration)
+	if err != nil {
+		return settings, err
+	}
+	req, err := sink.NewAPIRequest("POST", url, body, os.Getenv("API_KEY"))
+	if err != nil {
+		return settings, err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return settings, fmt.Errorf("failed to execute device registration request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return settings, fmt.Errorf("device registration failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	if len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, &settings); err != nil {
+			return settings, fmt.Errorf("invalid device registration response: %w", err)
+		}
+	}
+	return settings, nil
+}
+
+// applyDeviceSettings sets the settings the backend sent for a device, as <KEY>_<DEVICE>.
+// Settings given in the local configuration win. It logs where the device's org or time
+// zone disagree with this collector. The caller holds the registrations lock.
+func applyDeviceSettings(deviceID string, settings DeviceSettings) {
+	keys := make([]string, 0, len(settings.Settings))
+	for key := range settings.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !deviceSettingKey.MatchString(key) {
+			log.Printf("Ignoring invalid setting %q registered for device %s", key, deviceID)
+			continue
+		}
+		name := key + "_" + envSuffix(deviceID)
+		if _, set := os.LookupEnv(name); set && !registrations.applied[name] {
+			continue
+		}
+		os.Setenv(name, settings.Settings[key])
+		registrations.applied[name] = true
+	}
+	if orgID := os.Getenv("ORG_ID"); settings.OrgID != "" && settings.OrgID != orgID {
+		log.Printf("Backend registration: device %s belongs to org %q, not ORG_ID %q", deviceID, settings.OrgID, orgID)
+	}
+	if problem := timezoneProblem("device "+deviceID, settings.Timezone); problem != "" {
+		log.Printf("Backend registration: %s", problem)
+	}
+}
+
+// applyDeviceRegistrations applies the settings last received for each registered device,
+// so they hold from startup and while the backend is unreachable
+func applyDeviceRegistrations() {
+	if os.Getenv("DEVICE_REGISTER_URL") == "" {
+		return
+	}
+	registrations.Lock()
+	defer registrations.Unlock()
+	registered := loadDeviceRegistrations()
+	ids := make([]string, 0, len(registered))
+	for id := range registered {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		applyDeviceSettings(id, registered[id].Settings)
+	}
+}
+
+// registerDevice registers a device with DEVICE_REGISTER_URL when it is new or its serial
+// number or address changed, and applies the settings received. They take effect from the
+// device's next connection. A failed registration is logged and retried next cycle.
+func registerDevice(zkManager *zk.ZKManager, device deviceConfig) {
+	url := os.Getenv("DEVICE_REGISTER_URL")
+	if url == "" {
+		return
+	}
+	registrations.Lock()
+	known, ok := loadDeviceRegistrations()[device.ID]
+	registrations.Unlock()
+	pinned := loadDeviceSerials()[device.ID]
+	if ok && known.Address == device.Addr() && (pinned == "" || known.Serial == "" || known.Serial == pinned) {
+		return
+	}
+
+	diagnostics, err := zkManager.GetDiagnostics()
+	if err != nil {
+		log.Printf("Cannot register device %s, reading its details failed: %v", device.ID, err)
+		return
+	}
+	if ok && known.Address == device.Addr() && known.Serial == diagnostics.SerialNumber {
+		return
+	}
+	registration := DeviceRegistration{
+		OrgID:    os.Getenv("ORG_ID"),
+		DeviceID: device.ID,
+		Serial:   diagnostics.SerialNumber,
+		Model:    diagnostics.Platform,
+		Firmware: diagnostics.Firmware,
+		Address:  device.Addr(),
+	}
+	settings, err := postDeviceRegistration(url, registration)
+	if err != nil {
+		log.Printf("Error registering device %s: %v", device.ID, err)
+		return
+	}
+	log.Printf("Device %s registered with the backend (serial %s, %d setting(s))", device.ID, registration.Serial, len(settings.Settings))
+
+	registrations.Lock()
+	defer registrations.Unlock()
+	registered := loadDeviceRegistrations()
+	registered[device.ID] = deviceRegistration{
+		Serial:       registration.Serial,
+		Address:      registration.Address,
+		RegisteredAt: time.Now(),
+		Settings:     settings,
+	}
+	data, err := json.Marshal(registered)
+	if err == nil {
+		err = state().Put(deviceRegistrationsFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving device registrations: %v", err)
+	}
+	applyDeviceSettings(device.ID, settings)
+}
@@ -0,0 +1,70 @@
+package collector
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// deviceConfig is one entry of DEVICE_IPS, written as "ip:port" or "name=ip:port", or
+// "serial:/dev/ttyUSB0" (optionally named) for a terminal on a serial port
+type deviceConfig struct {
+	ID     string // The device name, or the address when the entry is unnamed
+	IP     string
+	Port   string
+	Serial string // Serial port path, in place of IP and Port
+}
+
+// Addr returns the device address for log lines
+func (d deviceConfig) Addr() string {
+	if d.Serial != "" {
+		return d.Serial
+	}
+	return d.IP + ":" + d.Port
+}
+
+// parseDevice parses a single DEVICE_IPS entry
+func parseDevice(entry string) (deviceConfig, error) {
+	var device deviceConfig
+	addr := entry
+	if i := strings.Index(entry, "="); i >= 0 {
+		device.ID = strings.TrimSpace(entry[:i])
+		addr = strings.TrimSpace(entry[i+1:])
+		if device.ID == "" {
+			return device, fmt.Errorf("invalid device format: %s", entry)
+		}
+	}
+	if strings.HasPrefix(addr, "serial:") {
+		device.Serial = strings.TrimSpace(strings.TrimPrefix(addr, "serial:"))
+		if device.Serial == "" {
+			return device, fmt.Errorf("invalid device format: %s", entry)
+		}
+		if device.ID == "" {
+			device.ID = addr
+		}
+		return device, nil
+	}
+	parts := strings.Split(addr, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return device, fmt.Errorf("invalid device format: %s", entry)
+	}
+	device.IP, device.Port = parts[0], parts[1]
+	if device.ID == "" {
+		device.ID = addr
+	}
+	return device, nil
+}
+
+// configuredDevices returns the valid DEVICE_IPS entries
+func configuredDevices() []deviceConfig {
+	var devices []deviceConfig
+	for _, entry := range strings.Split(os.Getenv("DEVICE_IPS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if device, err := parseDevice(entry); err == nil {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
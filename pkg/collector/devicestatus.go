@@ -0,0 +1,79 @@
+package collector
+
+import (
+	"log"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"sort"
+	"time"
+)
+
+// noteDeviceStatus reads a device's serial number and record counts after its log is read,
+// when API_DEVICE_STATUS is on for it, for the status report and the device_status section
+// of uploads. The serial number is read once; the counts take one small exchange per read.
+func noteDeviceStatus(zkManager *zk.ZKManager, deviceID string) {
+	if !deviceEnvBool("API_DEVICE_STATUS", deviceID) {
+		return
+	}
+	collectorStatus.Lock()
+	serial := deviceStatusLocked(deviceID).Serial
+	collectorStatus.Unlock()
+	if serial == "" {
+		var err error
+		if serial, err = zkManager.GetSerialNumber(); err != nil {
+			log.Printf("Could not read serial number of %s for its status: %v", deviceID, err)
+		}
+	}
+	records, capacity, err := zkManager.GetRecordCount()
+	if err != nil {
+		log.Printf("Could not read record count of %s for its status: %v", deviceID, err)
+	}
+
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	d := deviceStatusLocked(deviceID)
+	d.Serial = serial
+	if err == nil {
+		d.Records, d.RecordCapacity = &records, &capacity
+	} else {
+		d.Records, d.RecordCapacity = nil, nil
+	}
+}
+
+// batchDeviceStatus returns the latest status of each device with records in logs, for
+// sinks that send it along. Devices without API_DEVICE_STATUS are left out.
+func batchDeviceStatus(logs []zk.AttendanceRecord) []sink.DeviceStatus {
+	seen := map[string]bool{}
+	var ids []string
+	for _, record := range logs {
+		if id := record.DeviceID; id != "" && !seen[id] && deviceEnvBool("API_DEVICE_STATUS", id) {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	var devices []sink.DeviceStatus
+	for _, id := range ids {
+		d, ok := collectorStatus.devices[id]
+		if !ok {
+			// Not read since the collector started, as for a backlog left from before
+			continue
+		}
+		status := sink.DeviceStatus{
+			DeviceID:       id,
+			Serial:         d.Serial,
+			FetchedAt:      d.LastSuccess,
+			Records:        d.Records,
+			RecordCapacity: d.RecordCapacity,
+		}
+		if d.drift != nil {
+			seconds := int(*d.drift / time.Second)
+			status.ClockDriftSeconds = &seconds
+		}
+		devices = append(devices, status)
+	}
+	return devices
+}
@@ -0,0 +1,324 @@
+package collector
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// State key of the date of the last digest sent, so a restart doesn't send it again
+	digestSentFile = "digest_sent.txt"
+	// Event type streamed on /api/events with each digest
+	eventDigest = "digest"
+)
+
+// DigestPunch is an employee's punch named in a digest
+type DigestPunch struct {
+	EmployeeID int    `json:"employee_id"`
+	Time       string `json:"time"`
+	Device     string `json:"device"`
+}
+
+// BranchDigest is one branch's day
+type BranchDigest struct {
+	Branch    string       `json:"branch"`
+	Headcount int          `json:"headcount"` // Employees who punched at the branch
+	Punches   int          `json:"punches"`
+	First     *DigestPunch `json:"first_punch,omitempty"`
+	Last      *DigestPunch `json:"last_punch,omitempty"`
+	Missing   []int        `json:"missing"`       // Expected employees without a punch anywhere
+	Issues    []string     `json:"device_issues"` // Devices of the branch that need a look
+}
+
+// Digest is the end-of-day report delivered to DIGEST_URL and DIGEST_FILE
+type Digest struct {
+	OrgID    string         `json:"org_id"`
+	Date     string         `json:"date"`
+	DayOff   string         `json:"day_off,omitempty"` // Missing employees aren't listed on days off
+	Branches []BranchDigest `json:"branches"`
+}
+
+// digestState guards the sent date against two cycles sending at once
+var digestState sync.Mutex
+
+// expectedEmployees returns the employees expected at work on a date by branch: active roster
+// employees at the branches of the devices they are enrolled on, and employees of shifts
+// running that day. Employees expected without a known device are under "".
+func expectedEmployees(date time.Time) map[string]map[int]bool {
+	expected := map[string]map[int]bool{}
+	add := func(branch string, id int) {
+		if expected[branch] == nil {
+			expected[branch] = map[int]bool{}
+		}
+		expected[branch][id] = true
+	}
+	for _, employee := range loadRoster() {
+		if !employee.Active {
+			continue
+		}
+		if len(employee.Devices) == 0 {
+			add("", employee.EmployeeID)
+		}
+		for _, device := range employee.Devices {
+			add(deviceBranch(device), employee.EmployeeID)
+		}
+	}
+	schedule, err := loadShiftSchedule()
+	if err != nil || schedule == nil {
+		return expected
+	}
+	for id, s := range schedule.employees {
+		if s.Days[date.Weekday()] {
+			add("", id)
+		}
+	}
+	return expected
+}
+
+// deviceIssues returns what is wrong with each configured device right now, by branch
+func deviceIssues(today bool) map[string][]string {
+	issues := map[string][]string{}
+	status := buildStatusReport()
+	byID := map[string]DeviceStatus{}
+	for _, d := range status.Devices {
+		byID[d.ID] = d
+	}
+	for _, entry := range strings.Split(os.Getenv("DEVICE_IPS"), ",") {
+		device, err := parseDevice(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		branch := deviceBranch(device.ID)
+		d, read := byID[device.ID]
+		switch {
+		case d.ErrorStreak > 0:
+			issues[branch] = append(issues[branch], fmt.Sprintf("%s: %d failed read(s), last: %s", device.ID, d.ErrorStreak, d.LastError))
+		case !read || d.LastSuccess == "":
+			issues[branch] = append(issues[branch], fmt.Sprintf("%s: not read since the collector started", device.ID))
+		case today && d.RecordsToday == 0 && status.DayOff == "":
+			issues[branch] = append(issues[branch], fmt.Sprintf("%s: no punches today", device.ID))
+		}
+	}
+	return issues
+}
+
+// buildDigest summarizes a date's stored punches per branch
+func buildDigest(date time.Time) (Digest, error) {
+	day := date.Format("2006-01-02")
+	digest := Digest{OrgID: os.Getenv("ORG_ID"), Date: day}
+	if reason, off := dayOff(date); off {
+		digest.DayOff = reason
+	}
+	records, err := readStore()
+	if err != nil {
+		return digest, err
+	}
+
+	branches := map[string]*BranchDigest{}
+	branch := func(name string) *BranchDigest {
+		if branches[name] == nil {
+			branches[name] = &BranchDigest{Branch: name, Missing: []int{}, Issues: []string{}}
+		}
+		return branches[name]
+	}
+	for _, entry := range strings.Split(os.Getenv("DEVICE_IPS"), ",") {
+		if device, err := parseDevice(strings.TrimSpace(entry)); err == nil {
+			branch(deviceBranch(device.ID))
+		}
+	}
+
+	present := map[int]bool{}
+	seen := map[string]map[int]bool{}
+	for _, stored := range records {
+		record := stored.Record
+		if !strings.HasPrefix(record.Timestamp, day) {
+			continue
+		}
+		b := branch(deviceBranch(record.DeviceID))
+		punch := &DigestPunch{EmployeeID: record.UserID, Time: record.Timestamp, Device: record.DeviceID}
+		if b.First == nil || record.Timestamp < b.First.Time {
+			b.First = punch
+		}
+		if b.Last == nil || record.Timestamp > b.Last.Time {
+			b.Last = punch
+		}
+		b.Punches++
+		if seen[b.Branch] == nil {
+			seen[b.Branch] = map[int]bool{}
+		}
+		if !seen[b.Branch][record.UserID] {
+			seen[b.Branch][record.UserID] = true
+			b.Headcount++
+		}
+		present[record.UserID] = true
+	}
+
+	if digest.DayOff == "" {
+		for name, ids := range expectedEmployees(date) {
+			// Employees without a known branch are listed under the default one
+			if name == "" {
+				name = defaultBranch
+			}
+			b := branch(name)
+			for id := range ids {
+				if !present[id] {
+					b.Missing = append(b.Missing, id)
+				}
+			}
+		}
+	}
+	now := time.Now()
+	for name, issues := range deviceIssues(day == now.Format("2006-01-02")) {
+		branch(name).Issues = issues
+	}
+
+	for _, b := range branches {
+		sort.Ints(b.Missing)
+		b.Missing = uniqueInts(b.Missing)
+		digest.Branches = append(digest.Branches, *b)
+	}
+	sort.Slice(digest.Branches, func(i, j int) bool { return digest.Branches[i].Branch < digest.Branches[j].Branch })
+	return digest, nil
+}
+
+// uniqueInts drops repeats from a sorted slice
+func uniqueInts(values []int) []int {
+	out := values[:0]
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// digestChannelsConfigured reports whether DIGEST_URL or DIGEST_FILE is set
+func digestChannelsConfigured() bool {
+	return os.Getenv("DIGEST_URL") != "" || os.Getenv("DIGEST_FILE") != ""
+}
+
+// deliverDigest sends a digest to the notification channels: posted to DIGEST_URL, appended
+// as a JSON line to DIGEST_FILE, and streamed on /api/events
+func deliverDigest(digest Digest) error {
+	for _, b := range digest.Branches {
+		log.Printf("Digest %s, branch %s: %d employee(s), %d punch(es), %d missing, %d device issue(s)",
+			digest.Date, b.Branch, b.Headcount, b.Punches, len(b.Missing), len(b.Issues))
+	}
+	publishEvent(eventDigest, map[string]interface{}{"date": digest.Date, "branches": digest.Branches})
+
+	body, err := json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+	if path := os.Getenv("DIGEST_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open digest file: %w", err)
+		}
+		_, err = f.Write(append(body, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write digest file: %w", err)
+		}
+	}
+
+	url := os.Getenv("DIGEST_URL")
+	if url == "" {
+		return nil
+	}
+	req, err := sink.NewAPIRequest("POST", url, body, os.Getenv("API_KEY"))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute digest request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("digest upload failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// sendDailyDigest sends today's digest once the time of day reaches DIGEST_AT (HH:MM). It runs
+// every sync cycle and sends at most once a day; a failed delivery is retried next cycle.
+func sendDailyDigest() {
+	value := strings.TrimSpace(os.Getenv("DIGEST_AT"))
+	if value == "" {
+		return
+	}
+	at, err := parseClock(value)
+	if err != nil {
+		log.Printf("Invalid DIGEST_AT=%q: %v", value, err)
+		return
+	}
+	now := time.Now()
+	today := now.Format("2006-01-02")
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if now.Before(midnight.Add(at)) {
+		return
+	}
+
+	digestState.Lock()
+	defer digestState.Unlock()
+	if sent, err := state().Get(digestSentFile); err == nil && strings.TrimSpace(string(sent)) == today {
+		return
+	}
+	digest, err := buildDigest(now)
+	if err == nil {
+		err = deliverDigest(digest)
+	}
+	if err != nil {
+		log.Printf("Error sending daily digest: %v", err)
+		return
+	}
+	if err := state().Put(digestSentFile, []byte(today)); err != nil {
+		log.Printf("Error saving digest date: %v", err)
+	}
+}
+
+// runDigestCommand prints a day's digest, and with --send delivers it to the configured
+// channels, for scheduling from cron instead of DIGEST_AT
+func runDigestCommand(args []string) error {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	dateStr := fs.String("date", "", "day to summarize as YYYY-MM-DD (default today)")
+	send := fs.Bool("send", false, "deliver to DIGEST_URL and DIGEST_FILE instead of printing")
+	fs.Parse(args)
+
+	date := time.Now()
+	if *dateStr != "" {
+		t, err := time.ParseInLocation("2006-01-02", *dateStr, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid --date %q, expected YYYY-MM-DD", *dateStr)
+		}
+		date = t
+	}
+	digest, err := buildDigest(date)
+	if err != nil {
+		return err
+	}
+	if !*send {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(digest)
+	}
+	if !digestChannelsConfigured() {
+		return configError("DIGEST_URL or DIGEST_FILE is required with --send")
+	}
+	return deliverDigest(digest)
+}
@@ -0,0 +1,266 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Auto-discovery defaults
+const (
+	discoveredDevicesFile    = "discovered_devices.json" // State key of the last addresses found, by device ID
+	defaultDiscoveryPort     = 4370
+	defaultDiscoveryTimeout  = time.Second
+	defaultDiscoveryInterval = 60 * time.Minute
+	discoveryWorkers         = 64
+	maxDiscoveryHosts        = 1 << 16 // Largest subnet scanned, a /16
+)
+
+// staticDeviceIPs holds DEVICE_IPS as configured, before discovered devices are added to it
+var staticDeviceIPs struct {
+	once  sync.Once
+	value string
+}
+
+// discoveryAllowlist parses DISCOVERY_SERIALS, "NAME=SERIAL" or bare serial numbers, into
+// device IDs by serial number. Unnamed devices are identified by their serial number.
+func discoveryAllowlist() map[string]string {
+	allowed := map[string]string{}
+	for _, entry := range strings.Split(os.Getenv("DISCOVERY_SERIALS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, serial := entry, entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			id, serial = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+		allowed[serial] = id
+	}
+	return allowed
+}
+
+// subnetHosts lists the host addresses of a subnet in CIDR notation, without the network
+// and broadcast addresses
+func subnetHosts(cidr string) ([]string, error) {
+	ip, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid subnet %q, expected IPv4 CIDR such as 192.168.1.0/24", cidr)
+	}
+	ones, bits := network.Mask.Size()
+	size := 1 << uint(bits-ones)
+	if size > maxDiscoveryHosts {
+		return nil, fmt.Errorf("subnet %s is larger than a /16", cidr)
+	}
+	base := network.IP.To4()
+	start := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	var hosts []string
+	for i := 0; i < size; i++ {
+		if size > 2 && (i == 0 || i == size-1) {
+			continue
+		}
+		n := start + uint32(i)
+		hosts = append(hosts, net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).String())
+	}
+	return hosts, nil
+}
+
+// discoverDevices scans DISCOVERY_SUBNETS for terminals listening on DISCOVERY_PORT and
+// returns the address of each whose serial number is in the allowlist, by device ID
+func discoverDevices(allowed map[string]string) (map[string]string, error) {
+	port := defaultDiscoveryPort
+	if n := parseCount("DISCOVERY_PORT", os.Getenv("DISCOVERY_PORT")); n > 0 {
+		port = n
+	}
+	terminals, err := scanSubnets(strings.Split(os.Getenv("DISCOVERY_SUBNETS"), ","), port)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]string{}
+	for addr, serial := range terminals {
+		id, listed := allowed[serial]
+		if !listed {
+			log.Printf("Discovery: ignoring terminal %s with serial number %s, not in DISCOVERY_SERIALS", addr, serial)
+			continue
+		}
+		found[id] = addr
+	}
+	return found, nil
+}
+
+// scanSubnets probes every host of the subnets for a terminal on port and returns the serial
+// numbers of those that answer, by "ip:port" address. Probes time out after DISCOVERY_TIMEOUT.
+func scanSubnets(subnets []string, port int) (map[string]string, error) {
+	var hosts []string
+	for _, subnet := range subnets {
+		if strings.TrimSpace(subnet) == "" {
+			continue
+		}
+		subnetHosts, err := subnetHosts(subnet)
+		if err != nil {
+			return nil, configError(err.Error())
+		}
+		hosts = append(hosts, subnetHosts...)
+	}
+	if len(hosts) == 0 {
+		return nil, configError("DISCOVERY_SUBNETS is not set")
+	}
+	timeout := envSeconds("DISCOVERY_TIMEOUT")
+	if timeout <= 0 {
+		timeout = defaultDiscoveryTimeout
+	}
+
+	found := map[string]string{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	addrs := make(chan string)
+	for i := 0; i < discoveryWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for addr := range addrs {
+				serial, ok := probeTerminal(addr, port, timeout)
+				if !ok {
+					continue
+				}
+				mu.Lock()
+				found[fmt.Sprintf("%s:%d", addr, port)] = serial
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, host := range hosts {
+		addrs <- host
+	}
+	close(addrs)
+	wg.Wait()
+	return found, nil
+}
+
+// probeTerminal reads the serial number of a terminal at addr, reporting false when nothing
+// answers the device protocol there
+func probeTerminal(addr string, port int, timeout time.Duration) (string, bool) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", addr, port), timeout)
+	if err != nil {
+		return "", false
+	}
+	conn.Close()
+	zkManager, err := zk.NewZKManager(addr, strconv.Itoa(port))
+	if err != nil {
+		return "", false
+	}
+	zkManager.ConnectTimeout = timeout
+	serial, err := zkManager.GetSerialNumber()
+	if err != nil || serial == "" {
+		return "", false
+	}
+	return serial, true
+}
+
+// loadDiscoveredDevices returns the addresses found by the last discovery scan
+func loadDiscoveredDevices() map[string]string {
+	found := map[string]string{}
+	data, err := state().Get(discoveredDevicesFile)
+	if err != nil || data == nil {
+		return found
+	}
+	if err := json.Unmarshal(data, &found); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", discoveredDevicesFile, err)
+		return map[string]string{}
+	}
+	return found
+}
+
+// applyDiscoveredDevices sets DEVICE_IPS to the configured devices plus the discovered ones,
+// so everything reading it sees them. Configured devices win over discovered ones of the same ID.
+func applyDiscoveredDevices(found map[string]string) {
+	entries := []string{}
+	configured := map[string]bool{}
+	staticDeviceIPs.once.Do(func() { staticDeviceIPs.value = os.Getenv("DEVICE_IPS") })
+	for _, entry := range strings.Split(staticDeviceIPs.value, ",") {
+		if device, err := parseDevice(strings.TrimSpace(entry)); err == nil {
+			configured[device.ID] = true
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	ids := make([]string, 0, len(found))
+	for id := range found {
+		if !configured[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		entries = append(entries, id+"="+found[id])
+	}
+	os.Setenv("DEVICE_IPS", strings.Join(entries, ","))
+}
+
+// refreshDiscoveredDevices runs a discovery scan and applies and saves its result. Devices
+// not seen in the scan keep their last known address, as they may just be switched off.
+func refreshDiscoveredDevices() error {
+	allowed := discoveryAllowlist()
+	if len(allowed) == 0 {
+		return configError("AUTO_DISCOVER needs DISCOVERY_SERIALS, the serial numbers of the terminals to sync")
+	}
+	known := loadDiscoveredDevices()
+	found, err := discoverDevices(allowed)
+	if err != nil {
+		return err
+	}
+	for id, addr := range found {
+		if known[id] != addr {
+			log.Printf("Discovery: device %s found at %s", id, addr)
+		}
+		known[id] = addr
+	}
+	for serial, id := range allowed {
+		if _, ok := found[id]; !ok {
+			log.Printf("Discovery: device %s (serial number %s) not found", id, serial)
+		}
+	}
+	applyDiscoveredDevices(known)
+
+	data, err := json.Marshal(known)
+	if err == nil {
+		err = state().Put(discoveredDevicesFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving discovered devices: %v", err)
+	}
+	return nil
+}
+
+// startAutoDiscovery adds the devices found on DISCOVERY_SUBNETS to DEVICE_IPS and rescans
+// every DISCOVERY_INTERVAL minutes, so terminals are followed when DHCP moves them. The last
+// known addresses are used until the first scan completes.
+func startAutoDiscovery() error {
+	applyDiscoveredDevices(loadDiscoveredDevices())
+	if err := refreshDiscoveredDevices(); err != nil {
+		return err
+	}
+	interval := defaultDiscoveryInterval
+	if value := os.Getenv("DISCOVERY_INTERVAL"); value != "" {
+		if parsed, ok := parseSyncInterval(value); ok {
+			interval = parsed
+		} else {
+			log.Printf("Invalid DISCOVERY_INTERVAL=%q, using %v", value, interval)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := refreshDiscoveredDevices(); err != nil {
+				log.Printf("Discovery failed: %v", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,56 @@
+package collector
+
+import (
+	"log"
+	"old-attendance/pkg/zk"
+	"time"
+)
+
+const (
+	// Drift below CLOCK_DRIFT_THRESHOLD is left alone unless the setting overrides it
+	defaultDriftThreshold = time.Minute
+	// A clock further off than this was reset, by a flat battery for instance, rather than
+	// drifting: the punches in its log straddle the reset, so no one offset places them
+	maxDriftCorrection = 24 * time.Hour
+)
+
+// measureClockDrift reads a device's clock before its log is read, when CLOCK_DRIFT_CORRECTION
+// is on for it, and shows how far off it is in the status report. Drift of at least
+// CLOCK_DRIFT_THRESHOLD seconds is then corrected in the punches read, so a terminal running
+// 12 minutes fast doesn't mark everyone late. The offset is measured at each read, so it
+// fits the punches since the last one; a clock that is put right is no longer corrected.
+func measureClockDrift(zkManager *zk.ZKManager, deviceID string) {
+	if !deviceEnvBool("CLOCK_DRIFT_CORRECTION", deviceID) {
+		return
+	}
+	before := time.Now()
+	deviceTime, err := zkManager.GetTime()
+	if err != nil {
+		log.Printf("Could not read the clock of %s, punches are not corrected for drift: %v", deviceID, err)
+		return
+	}
+	// The device clock has whole seconds, read somewhere during the exchange
+	now := before.Add(time.Since(before) / 2)
+	offset := deviceTime.Sub(now).Round(time.Second)
+	recordDeviceDrift(deviceID, offset)
+
+	threshold := defaultDriftThreshold
+	if value := deviceEnv("CLOCK_DRIFT_THRESHOLD", deviceID); value != "" {
+		threshold = deviceEnvSeconds("CLOCK_DRIFT_THRESHOLD", deviceID)
+	}
+	switch magnitude := absDuration(offset); {
+	case magnitude < threshold || magnitude == 0:
+	case magnitude > maxDriftCorrection:
+		log.Printf("Clock of %s is %v off, too far to correct; set its time", deviceID, offset)
+	default:
+		log.Printf("Clock of %s is %v off, correcting its punches", deviceID, offset)
+		zkManager.ClockOffset = offset
+	}
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// State key caching employee details from ENRICH_URL
+	enrichCacheFile = "enrich_cache.json"
+	// How long looked-up details are used, unless ENRICH_CACHE_TTL overrides it
+	defaultEnrichTTL = 24 * time.Hour
+	// Employees per lookup request, unless ENRICH_BATCH_SIZE overrides it
+	defaultEnrichBatch = 100
+)
+
+// EmployeeDetails is one employee as returned by the lookup endpoint
+type EmployeeDetails struct {
+	EmployeeID int    `json:"employee_id"`
+	Name       string `json:"name"`
+	Department string `json:"department,omitempty"`
+}
+
+// enrichEntry is a cached lookup. Employees the endpoint doesn't know are cached too, so they
+// aren't asked for again every cycle.
+type enrichEntry struct {
+	Name       string    `json:"name,omitempty"`
+	Department string    `json:"department,omitempty"`
+	FetchedAt  time.Time `json:"fetched_at"`
+}
+
+// enrichRequest is the body POSTed to ENRICH_URL
+type enrichRequest struct {
+	OrgID       string `json:"org_id"`
+	EmployeeIDs []int  `json:"employee_ids"`
+}
+
+// loadEnrichCache returns the cached details by employee ID
+func loadEnrichCache() map[string]enrichEntry {
+	cache := map[string]enrichEntry{}
+	data, err := state().Get(enrichCacheFile)
+	if err != nil || data == nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", enrichCacheFile, err)
+		return map[string]enrichEntry{}
+	}
+	return cache
+}
+
+// fetchEmployeeDetails POSTs employee IDs to the lookup endpoint, which answers with a JSON
+// array of {"employee_id", "name", "department"} objects
+func fetchEmployeeDetails(url, apiKey string, ids []int) ([]EmployeeDetails, error) {
+	body, err := json.Marshal(enrichRequest{OrgID: os.Getenv("ORG_ID"), EmployeeIDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	req, err := sink.NewAPIRequest("POST", url, body, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute lookup request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("lookup request failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	var details []EmployeeDetails
+	if err := json.Unmarshal(respBody, &details); err != nil {
+		return nil, fmt.Errorf("invalid lookup response: %w", err)
+	}
+	return details, nil
+}
+
+// enrichRecords adds employee names and departments from ENRICH_URL to records, for sinks
+// where bare IDs mean nothing to the reader. Employees missing from the cache or looked up
+// longer than ENRICH_CACHE_TTL ago are looked up in batches of ENRICH_BATCH_SIZE. A failed
+// lookup falls back to the cache, however old, and never holds up the upload.
+func enrichRecords(logs []zk.AttendanceRecord) {
+	url := os.Getenv("ENRICH_URL")
+	if url == "" || len(logs) == 0 {
+		return
+	}
+	ttl := defaultEnrichTTL
+	if value := os.Getenv("ENRICH_CACHE_TTL"); value != "" {
+		if parsed, err := parseAge(value); err == nil {
+			ttl = parsed
+		} else {
+			log.Printf("Invalid ENRICH_CACHE_TTL=%q, using %v", value, defaultEnrichTTL)
+		}
+	}
+	batchSize := parseCount("ENRICH_BATCH_SIZE", os.Getenv("ENRICH_BATCH_SIZE"))
+	if batchSize == 0 {
+		batchSize = defaultEnrichBatch
+	}
+
+	cache := loadEnrichCache()
+	now := time.Now()
+	var stale []int
+	wanted := map[int]bool{}
+	for _, record := range logs {
+		entry, ok := cache[strconv.Itoa(record.UserID)]
+		if (!ok || now.Sub(entry.FetchedAt) >= ttl) && !wanted[record.UserID] {
+			wanted[record.UserID] = true
+			stale = append(stale, record.UserID)
+		}
+	}
+	sort.Ints(stale)
+
+	looked := 0
+	for start := 0; start < len(stale); start += batchSize {
+		end := start + batchSize
+		if end > len(stale) {
+			end = len(stale)
+		}
+		details, err := fetchEmployeeDetails(url, os.Getenv("API_KEY"), stale[start:end])
+		if err != nil {
+			log.Printf("Error looking up employee details, using the cache: %v", err)
+			break
+		}
+		for _, id := range stale[start:end] {
+			cache[strconv.Itoa(id)] = enrichEntry{FetchedAt: now}
+		}
+		for _, d := range details {
+			cache[strconv.Itoa(d.EmployeeID)] = enrichEntry{Name: d.Name, Department: d.Department, FetchedAt: now}
+		}
+		looked += end - start
+	}
+	if looked > 0 {
+		log.Printf("Looked up details of %d employee(s)", looked)
+		data, err := json.Marshal(cache)
+		if err == nil {
+			err = state().Put(enrichCacheFile, data)
+		}
+		if err != nil {
+			log.Printf("Error caching employee details: %v", err)
+		}
+	}
+
+	for i, record := range logs {
+		if entry, ok := cache[strconv.Itoa(record.UserID)]; ok {
+			logs[i].EmployeeName, logs[i].Department = entry.Name, entry.Department
+		}
+	}
+}
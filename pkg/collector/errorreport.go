@@ -0,0 +1,215 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// State key of the error reports ERROR_REPORT_URL has not accepted yet
+	errorReportsFile = "error_reports.json"
+	// State key of each failing device's streak, kept across runs of the sync command
+	errorStreaksFile = "error_streaks.json"
+	// Reports kept for a backend that can't be reached; the oldest go first
+	maxPendingErrorReports = 500
+)
+
+// Statuses of an error report
+const (
+	reportFailing  = "failing"  // A read of the device failed
+	reportResolved = "resolved" // The device was read again after failing
+)
+
+// ErrorReport tells the backend about a device problem, so support sees it without access to
+// the branch's logs
+type ErrorReport struct {
+	DeviceID   string `json:"device_id"`
+	Status     string `json:"status"`                // "failing" or "resolved"
+	ErrorClass string `json:"error_class,omitempty"` // Error code, e.g. "device_unreachable"
+	Condition  string `json:"condition,omitempty"`   // "timeout" or "connection_reset" when told apart
+	Error      string `json:"error,omitempty"`
+	// Consecutive failed reads, this one included; for a resolved report, the streak that ended
+	Streak       int    `json:"streak"`
+	FailingSince string `json:"failing_since"` // First failed read of the streak
+	Time         string `json:"time"`
+	SyncID       string `json:"sync_id,omitempty"`
+}
+
+// errorStreak is a device's run of failed reads
+type errorStreak struct {
+	Count int       `json:"count"`
+	Since time.Time `json:"since"`
+}
+
+// errorReportUpload is the body posted to ERROR_REPORT_URL
+type errorReportUpload struct {
+	OrgID     string        `json:"org_id"`
+	Collector string        `json:"collector"`
+	Reports   []ErrorReport `json:"reports"`
+}
+
+// errorReports holds the reports of the running cycle, and serializes updates of the
+// streaks, which devices read in parallel make
+var errorReports = struct {
+	sync.Mutex
+	queued []ErrorReport
+}{}
+
+// reportDeviceError queues a report of a failed read of a device when ERROR_REPORT_URL is set
+func reportDeviceError(deviceID string, err error) {
+	if os.Getenv("ERROR_REPORT_URL") == "" {
+		return
+	}
+	now := time.Now()
+	errorReports.Lock()
+	defer errorReports.Unlock()
+	streaks := loadErrorStreaks()
+	streak := streaks[deviceID]
+	if streak.Count == 0 {
+		streak.Since = now
+	}
+	streak.Count++
+	streaks[deviceID] = streak
+	saveErrorStreaks(streaks)
+
+	report := ErrorReport{
+		DeviceID:     deviceID,
+		Status:       reportFailing,
+		ErrorClass:   ErrorCode(err),
+		Error:        err.Error(),
+		Streak:       streak.Count,
+		FailingSince: streak.Since.Format(time.RFC3339),
+		Time:         now.Format(time.RFC3339),
+	}
+	for _, condition := range errorConditions(err) {
+		if condition != conditionUnreachable {
+			report.Condition = condition
+		}
+	}
+	errorReports.queued = append(errorReports.queued, report)
+}
+
+// reportDeviceRead queues a report that a failing device was read again, ending its streak
+func reportDeviceRead(deviceID string) {
+	if os.Getenv("ERROR_REPORT_URL") == "" {
+		return
+	}
+	errorReports.Lock()
+	defer errorReports.Unlock()
+	streaks := loadErrorStreaks()
+	streak, ok := streaks[deviceID]
+	if !ok {
+		return
+	}
+	delete(streaks, deviceID)
+	saveErrorStreaks(streaks)
+	errorReports.queued = append(errorReports.queued, ErrorReport{
+		DeviceID:     deviceID,
+		Status:       reportResolved,
+		Streak:       streak.Count,
+		FailingSince: streak.Since.Format(time.RFC3339),
+		Time:         time.Now().Format(time.RFC3339),
+	})
+}
+
+// loadErrorStreaks returns the streaks of the failing devices; the caller holds the lock
+func loadErrorStreaks() map[string]errorStreak {
+	streaks := map[string]errorStreak{}
+	data, err := state().Get(errorStreaksFile)
+	if err != nil || data == nil {
+		return streaks
+	}
+	if err := json.Unmarshal(data, &streaks); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", errorStreaksFile, err)
+		return map[string]errorStreak{}
+	}
+	return streaks
+}
+
+// saveErrorStreaks stores the streaks of the failing devices; the caller holds the lock
+func saveErrorStreaks(streaks map[string]errorStreak) {
+	data, err := json.Marshal(streaks)
+	if err == nil {
+		err = state().Put(errorStreaksFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving device error streaks: %v", err)
+	}
+}
+
+// sendErrorReports posts the reports queued this cycle, after those left from earlier ones,
+// to ERROR_REPORT_URL in one request. Reports that can't be posted are kept for the next
+// cycle, so a device failing along with the branch's connection is still reported.
+func sendErrorReports(cycle *syncCycle) {
+	url := os.Getenv("ERROR_REPORT_URL")
+	errorReports.Lock()
+	queued := errorReports.queued
+	errorReports.queued = nil
+	errorReports.Unlock()
+	if url == "" {
+		return
+	}
+	for i := range queued {
+		queued[i].SyncID = cycle.ID()
+	}
+
+	var reports []ErrorReport
+	data, err := state().Get(errorReportsFile)
+	if err == nil && data != nil {
+		if err := json.Unmarshal(data, &reports); err != nil {
+			log.Printf("Invalid %s, ignoring: %v", errorReportsFile, err)
+			reports = nil
+		}
+	}
+	reports = append(reports, queued...)
+	if len(reports) == 0 {
+		return
+	}
+
+	if err := postErrorReports(url, reports); err != nil {
+		log.Printf("Error sending %d error report(s): %v", len(reports), err)
+		if len(reports) > maxPendingErrorReports {
+			reports = reports[len(reports)-maxPendingErrorReports:]
+		}
+	} else {
+		log.Printf("Sent %d error report(s)", len(reports))
+		reports = nil
+	}
+	data, err = json.Marshal(reports)
+	if err == nil {
+		err = state().Put(errorReportsFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving error reports: %v", err)
+	}
+}
+
+// postErrorReports posts reports to ERROR_REPORT_URL
+func postErrorReports(url string, reports []ErrorReport) error {
+	body, err := json.Marshal(errorReportUpload{OrgID: os.Getenv("ORG_ID"), Collector: collectorID(), Reports: reports})
+	if err != nil {
+		return err
+	}
+	req, err := sink.NewAPIRequest("POST", url, body, os.Getenv("API_KEY"))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute error report request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error report upload failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"sort"
+	"sync"
+)
+
+// ErrConfig means the collector is missing or has invalid configuration
+var ErrConfig = errors.New("configuration error")
+
+// Machine-readable error codes used in logs and metrics
+const (
+	codeDeviceUnreachable = "device_unreachable"
+	codeAuthFailed        = "auth_failed"
+	codeAPIRejected       = "api_rejected"
+	codeDeviceMismatch    = "device_mismatch"
+	codeConfig            = "config"
+	codeOther             = "other"
+)
+
+// Process exit codes of one-shot commands, for cron wrappers. 2 matches the flag
+// package's exit code for bad usage.
+const (
+	exitOther             = 1
+	exitConfig            = 2
+	exitDeviceUnreachable = 3
+	exitAuthFailed        = 4
+	exitAPIRejected       = 5
+)
+
+// ErrorCode returns the machine-readable code of err, or "" for nil
+func ErrorCode(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrConfig), errors.Is(err, sink.ErrSigningKey):
+		return codeConfig
+	case errors.Is(err, zk.ErrAuthFailed), errors.Is(err, sink.ErrAuthFailed):
+		return codeAuthFailed
+	case errors.Is(err, zk.ErrDeviceUnreachable):
+		return codeDeviceUnreachable
+	case errors.Is(err, sink.ErrAPIRejected):
+		return codeAPIRejected
+	case errors.Is(err, ErrDeviceMismatch):
+		return codeDeviceMismatch
+	default:
+		return codeOther
+	}
+}
+
+// ExitCode returns the process exit code for err: 0 for nil, otherwise 1-5 by error code
+func ExitCode(err error) int {
+	switch ErrorCode(err) {
+	case "":
+		return 0
+	case codeConfig:
+		return exitConfig
+	case codeDeviceUnreachable:
+		return exitDeviceUnreachable
+	case codeAuthFailed:
+		return exitAuthFailed
+	case codeAPIRejected:
+		return exitAPIRejected
+	default:
+		return exitOther
+	}
+}
+
+// configError reports a configuration problem as ErrConfig
+func configError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrConfig, fmt.Sprintf(format, args...))
+}
+
+// errorCounts counts errors by code for /metrics
+var errorCounts = struct {
+	sync.Mutex
+	byCode map[string]int64
+}{byCode: map[string]int64{}}
+
+// countError records err under its code and returns the code for logging
+func countError(err error) string {
+	code := ErrorCode(err)
+	errorCounts.Lock()
+	errorCounts.byCode[code]++
+	errorCounts.Unlock()
+	return code
+}
+
+// writeErrorMetrics writes error counts in Prometheus text or OpenMetrics format
+func writeErrorMetrics(w io.Writer, openMetrics bool) {
+	errorCounts.Lock()
+	defer errorCounts.Unlock()
+	codes := make([]string, 0, len(errorCounts.byCode))
+	for code := range errorCounts.byCode {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	writeCounterHeader(w, "attendance_errors", "Errors by machine-readable code.", openMetrics)
+	for _, code := range codes {
+		fmt.Fprintf(w, "attendance_errors_total{%s} %d\n", tenantLabel(fmt.Sprintf("code=%q", code)), errorCounts.byCode[code])
+	}
+}
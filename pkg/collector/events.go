@@ -0,0 +1,183 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types streamed on /api/events
+const (
+	eventDeviceUp       = "device_up"   // First successful read, or the first after failures
+	eventDeviceDown     = "device_down" // First failed read after a success
+	eventRecordsFetched = "records_fetched"
+	eventDelivered      = "delivered"
+	eventDeliveryFailed = "delivery_failed"
+)
+
+const (
+	eventReplaySize      = 100              // Recent events kept for clients reconnecting with Last-Event-ID
+	eventSubscriberQueue = 64               // Events buffered per client; a client further behind is dropped
+	eventKeepAlive       = 15 * time.Second // Comment lines keeping idle streams open through proxies
+	maxEventArrivals     = 100              // Records listed in one records_fetched event
+)
+
+// collectorEvent is one event on the stream
+type collectorEvent struct {
+	ID   int64
+	Type string
+	Data interface{}
+}
+
+// arrival is a punch listed in a records_fetched event
+type arrival struct {
+	EmployeeID int    `json:"employee_id"`
+	Timestamp  string `json:"timestamp"`
+	Modality   string `json:"modality,omitempty"`
+}
+
+// eventHub fans events out to the connected stream clients
+var eventHub = struct {
+	sync.Mutex
+	nextID      int64
+	recent      []collectorEvent
+	subscribers map[chan collectorEvent]bool
+}{subscribers: map[chan collectorEvent]bool{}}
+
+// publishEvent sends an event to every client without waiting on any of them. Clients
+// whose queue is full are disconnected, and can catch up by reconnecting.
+func publishEvent(eventType string, data map[string]interface{}) {
+	data["time"] = time.Now().Format(time.RFC3339)
+	eventHub.Lock()
+	defer eventHub.Unlock()
+	eventHub.nextID++
+	event := collectorEvent{ID: eventHub.nextID, Type: eventType, Data: data}
+	eventHub.recent = append(eventHub.recent, event)
+	if len(eventHub.recent) > eventReplaySize {
+		eventHub.recent = eventHub.recent[len(eventHub.recent)-eventReplaySize:]
+	}
+	for ch := range eventHub.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(eventHub.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishRecordsFetched announces the records read from a device, listing the first
+// maxEventArrivals of them
+func publishRecordsFetched(deviceID, syncID string, logs []zk.AttendanceRecord) {
+	arrivals := make([]arrival, 0, len(logs))
+	for i, record := range logs {
+		if i == maxEventArrivals {
+			break
+		}
+		arrivals = append(arrivals, arrival{EmployeeID: record.UserID, Timestamp: record.Timestamp, Modality: record.Modality})
+	}
+	publishEvent(eventRecordsFetched, map[string]interface{}{
+		"device":  deviceID,
+		"sync_id": syncID,
+		"count":   len(logs),
+		"records": arrivals,
+	})
+}
+
+// subscribeEvents registers a client, returning its channel and the recent events after
+// lastID that it missed
+func subscribeEvents(lastID int64) (chan collectorEvent, []collectorEvent) {
+	eventHub.Lock()
+	defer eventHub.Unlock()
+	var missed []collectorEvent
+	if lastID > 0 {
+		for _, event := range eventHub.recent {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+	ch := make(chan collectorEvent, eventSubscriberQueue)
+	eventHub.subscribers[ch] = true
+	return ch, missed
+}
+
+// unsubscribeEvents removes a client, unless it was already dropped
+func unsubscribeEvents(ch chan collectorEvent) {
+	eventHub.Lock()
+	defer eventHub.Unlock()
+	if eventHub.subscribers[ch] {
+		delete(eventHub.subscribers, ch)
+		close(ch)
+	}
+}
+
+// handleEvents serves GET /api/events as a server-sent events stream. ?types= limits it to
+// a comma-separated list of event types, and a Last-Event-ID header replays the recent
+// events a reconnecting client missed. It needs the ADMIN_TOKEN bearer token, as anomaly and
+// user change events name employees.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	types := map[string]bool{}
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	ch, missed := subscribeEvents(lastID)
+	defer unsubscribeEvents(ch)
+
+	w.Header().Set(contentTypeHeader, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	send := func(event collectorEvent) bool {
+		if len(types) > 0 && !types[event.Type] {
+			return true
+		}
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			return true
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		flusher.Flush()
+		return err == nil
+	}
+	for _, event := range missed {
+		if !send(event) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-ch:
+			if !open || !send(event) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportFormats reads the formats defined in EXPORT_FORMATS_FILE, see sink.ParseExportFormats
+func exportFormats() (map[string]sink.ExportFormat, error) {
+	path := os.Getenv("EXPORT_FORMATS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("EXPORT_FORMATS_FILE: %w", err)
+	}
+	formats, err := sink.ParseExportFormats(data)
+	if err != nil {
+		return nil, fmt.Errorf("EXPORT_FORMATS_FILE %s: %w", path, err)
+	}
+	return formats, nil
+}
+
+// exportFormat returns the named format of EXPORT_FORMATS_FILE
+func exportFormat(name string) (sink.ExportFormat, error) {
+	formats, err := exportFormats()
+	if err != nil {
+		return sink.ExportFormat{}, err
+	}
+	format, ok := formats[name]
+	if !ok {
+		if len(formats) == 0 {
+			return format, fmt.Errorf("unknown export format %q: EXPORT_FORMATS_FILE defines none", name)
+		}
+		return format, fmt.Errorf("unknown export format %q, EXPORT_FORMATS_FILE defines %s", name, strings.Join(exportFormatNames(formats), ", "))
+	}
+	return format, nil
+}
+
+// exportFormatNames returns the names of formats, sorted
+func exportFormatNames(formats map[string]sink.ExportFormat) []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseDayRange parses the --from and --to days of a command, YYYY-MM-DD. From defaults to
+// today and to defaults to from.
+func parseDayRange(fromStr, toStr string) (string, string, error) {
+	from := time.Now().Format("2006-01-02")
+	if fromStr != "" {
+		if _, err := time.Parse("2006-01-02", fromStr); err != nil {
+			return "", "", fmt.Errorf("invalid --from %q, expected YYYY-MM-DD", fromStr)
+		}
+		from = fromStr
+	}
+	to := from
+	if toStr != "" {
+		if _, err := time.Parse("2006-01-02", toStr); err != nil {
+			return "", "", fmt.Errorf("invalid --to %q, expected YYYY-MM-DD", toStr)
+		}
+		to = toStr
+	}
+	if to < from {
+		return "", "", fmt.Errorf("--to %s is before --from %s", to, from)
+	}
+	return from, to, nil
+}
+
+// recordDay returns the local date of a record, YYYY-MM-DD. Timestamps start with it, so
+// comparing days as strings selects date ranges.
+func recordDay(record zk.AttendanceRecord) string {
+	if len(record.Timestamp) > len("2006-01-02") {
+		return record.Timestamp[:len("2006-01-02")]
+	}
+	return record.Timestamp
+}
+
+// runExportCommand writes the stored records of a date range in an export format
+func runExportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	formatName := fs.String("format", "", "format defined in EXPORT_FORMATS_FILE")
+	fromStr := fs.String("from", "", "first day to export as YYYY-MM-DD (default today)")
+	toStr := fs.String("to", "", "last day to export as YYYY-MM-DD (default --from)")
+	out := fs.String("out", "", "file to write (default standard output)")
+	list := fs.Bool("list", false, "list the formats instead of exporting")
+	fs.Parse(args)
+
+	if *list {
+		formats, err := exportFormats()
+		if err != nil {
+			return configError(err.Error())
+		}
+		for _, name := range exportFormatNames(formats) {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	if *formatName == "" {
+		return configError("--format is required")
+	}
+	format, err := exportFormat(*formatName)
+	if err != nil {
+		return configError(err.Error())
+	}
+	from, to, err := parseDayRange(*fromStr, *toStr)
+	if err != nil {
+		return err
+	}
+
+	records, err := readStore()
+	if err != nil {
+		return err
+	}
+	var logs []zk.AttendanceRecord
+	for _, stored := range records {
+		if day := recordDay(stored.Record); day >= from && day <= to {
+			logs = append(logs, stored.Record)
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].Timestamp < logs[j].Timestamp })
+	lines, err := format.Render(logs)
+	if err != nil {
+		return err
+	}
+	if format.Header {
+		lines = append(format.HeaderLine(), lines...)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := w.Write(lines); err != nil {
+		return err
+	}
+	if *out != "" {
+		fmt.Fprintln(os.Stderr, tr("Exported %d record(s) to %s", len(logs), *out))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDayRange(t *testing.T) {
+	today := time.Now().Format("2006-01-02")
+	tests := []struct {
+		from, to         string
+		wantFrom, wantTo string
+		wantErr          bool
+	}{
+		{"", "", today, today, false},
+		{"2024-03-01", "", "2024-03-01", "2024-03-01", false},
+		{"2024-03-01", "2024-03-31", "2024-03-01", "2024-03-31", false},
+		{"2024-03-01", "2024-03-01", "2024-03-01", "2024-03-01", false},
+		{"2024-03-02", "2024-03-01", "", "", true},
+		{"2024-02-30", "", "", "", true},
+		{"01/03/2024", "", "", "", true},
+		{"2024-03-01", "2024-03-01T10:00", "", "", true},
+	}
+	for _, tt := range tests {
+		from, to, err := parseDayRange(tt.from, tt.to)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDayRange(%q, %q) error = %v, want error %v", tt.from, tt.to, err, tt.wantErr)
+			continue
+		}
+		if from != tt.wantFrom || to != tt.wantTo {
+			t.Errorf("parseDayRange(%q, %q) = %s, %s, want %s, %s", tt.from, tt.to, from, to, tt.wantFrom, tt.wantTo)
+		}
+	}
+}
+
+func TestExportFormat(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "formats.json")
+	if err := os.WriteFile(file, []byte(`{"payroll": {"columns": [{"field": "employee_id"}]}, "bank": {"columns": [{"field": "timestamp"}]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"payroll": {"columns": []}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, file, format string
+		errPart            string // "" for no error
+	}{
+		{"defined", file, "payroll", ""},
+		{"undefined", file, "vendor", "defines bank, payroll"},
+		{"no file", "", "payroll", "defines none"},
+		{"missing file", filepath.Join(dir, "none.json"), "payroll", "EXPORT_FORMATS_FILE"},
+		{"invalid file", invalid, "payroll", `format "payroll"`},
+	}
+	for _, tt := range tests {
+		t.Setenv("EXPORT_FORMATS_FILE", tt.file)
+		format, err := exportFormat(tt.format)
+		if tt.errPart == "" {
+			if err != nil || len(format.Columns) != 1 {
+				t.Errorf("%s: %+v, %v, want the format", tt.name, format, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.errPart) {
+			t.Errorf("%s: error = %v, want one mentioning %q", tt.name, err, tt.errPart)
+		}
+	}
+}
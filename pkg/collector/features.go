@@ -0,0 +1,199 @@
+package collector
+
+import (
+	"hash/fnv"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FeatureFlag is a feature delivered with the remote configuration, rolled out to the
+// collectors it targets. A flag's settings apply only where it is on, so a risky setting
+// such as ZK_READ_MODALITY can be turned on branch by branch.
+type FeatureFlag struct {
+	Enabled    bool              `json:"enabled"`
+	Collectors []string          `json:"collectors,omitempty"` // COLLECTOR_ID values, all when empty
+	Branches   []string          `json:"branches,omitempty"`   // On where a device is in one, all when empty
+	Percent    *int              `json:"percent,omitempty"`    // Share of the collectors targeted, chosen stably by collector ID
+	Settings   map[string]string `json:"settings,omitempty"`
+}
+
+// features holds the flags on for this collector, set when a remote configuration is applied
+var features = struct {
+	sync.Mutex
+	on map[string]bool
+}{on: map[string]bool{}}
+
+// collectorID identifies this collector to feature flags: COLLECTOR_ID, or else the host
+// name, with the tenant when there is one
+func collectorID() string {
+	if id := os.Getenv("COLLECTOR_ID"); id != "" {
+		return id
+	}
+	id, err := os.Hostname()
+	if err != nil {
+		id = "unknown"
+	}
+	if tenant := tenantName(); tenant != "" {
+		id += "/" + tenant
+	}
+	return id
+}
+
+// localFeatureOverrides parses FEATURE_FLAGS, e.g. "photo_upload=off,live_capture=on",
+// which turns flags on or off here whatever the backend says. Invalid entries are left
+// for config validate to report.
+func localFeatureOverrides() map[string]bool {
+	overrides := map[string]bool{}
+	for _, entry := range splitList(os.Getenv("FEATURE_FLAGS")) {
+		name, value := entry, "on"
+		if i := strings.Index(entry, "="); i >= 0 {
+			name, value = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+		switch strings.ToLower(value) {
+		case "on", "true", "1":
+			overrides[name] = true
+		case "off", "false", "0":
+			overrides[name] = false
+		}
+	}
+	return overrides
+}
+
+// evaluate reports whether a flag is on for this collector
+func (f FeatureFlag) evaluate(name, id string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if len(f.Collectors) > 0 && !containsString(f.Collectors, id) {
+		return false
+	}
+	if len(f.Branches) > 0 {
+		found := false
+		for _, device := range configuredDevices() {
+			if containsString(f.Branches, deviceBranch(device.ID)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Percent != nil {
+		// The same collector lands in the same bucket for a flag, so raising the percentage
+		// only adds collectors
+		h := fnv.New32a()
+		h.Write([]byte(name + "\x00" + id))
+		if int(h.Sum32()%100) >= *f.Percent {
+			return false
+		}
+	}
+	return true
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateFeatures returns the flags on for this collector, with FEATURE_FLAGS applied
+func evaluateFeatures(flags map[string]FeatureFlag) map[string]bool {
+	id := collectorID()
+	on := map[string]bool{}
+	for name, flag := range flags {
+		if flag.evaluate(name, id) {
+			on[name] = true
+		}
+	}
+	for name, enabled := range localFeatureOverrides() {
+		if enabled {
+			on[name] = true
+		} else {
+			delete(on, name)
+		}
+	}
+	return on
+}
+
+// featureSettings returns the settings of the flags that are on, applied over the remote
+// settings. Flags are applied by name, so a later one wins where two set the same key.
+func featureSettings(flags map[string]FeatureFlag, on map[string]bool) map[string]string {
+	names := make([]string, 0, len(on))
+	for name := range on {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	settings := map[string]string{}
+	for _, name := range names {
+		for key, value := range flags[name].Settings {
+			settings[key] = value
+		}
+	}
+	return settings
+}
+
+// setFeatures records the flags on for this collector and logs what changed
+func setFeatures(on map[string]bool) {
+	features.Lock()
+	defer features.Unlock()
+	var added, removed []string
+	for name := range on {
+		if !features.on[name] {
+			added = append(added, name)
+		}
+	}
+	for name := range features.on {
+		if !on[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	if len(added) > 0 {
+		log.Printf("Feature flags on: %s", strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		log.Printf("Feature flags off: %s", strings.Join(removed, ", "))
+	}
+	features.on = on
+}
+
+// FeatureEnabled reports whether a feature flag is on for this collector, for features
+// of the collector and of sinks registered by an embedding program
+func FeatureEnabled(name string) bool {
+	if enabled, ok := localFeatureOverrides()[name]; ok {
+		return enabled
+	}
+	features.Lock()
+	defer features.Unlock()
+	return features.on[name]
+}
+
+// enabledFeatures lists the flags on for this collector, for the status report
+func enabledFeatures() []string {
+	on := map[string]bool{}
+	features.Lock()
+	for name := range features.on {
+		on[name] = true
+	}
+	features.Unlock()
+	for name, enabled := range localFeatureOverrides() {
+		on[name] = enabled
+	}
+	var names []string
+	for name, enabled := range on {
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
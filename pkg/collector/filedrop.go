@@ -0,0 +1,169 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"old-attendance/pkg/sink"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// State key of when the file drop was last uploaded
+	fileDropUploadedFile = "filedrop_uploaded.txt"
+	// Directory collecting file drop records, unless FILEDROP_DIR overrides it
+	defaultFileDropDir = "filedrop"
+	// Name of uploaded files, unless FILEDROP_FILENAME overrides it
+	defaultFileDropName = "attendance-{date}-{time}.txt"
+	// How often the file drop is uploaded without FILEDROP_AT, unless FILEDROP_INTERVAL
+	// (minutes) overrides it
+	defaultFileDropInterval = time.Hour
+)
+
+// fileDropUploads keeps two cycles from uploading at once
+var fileDropUploads sync.Mutex
+
+// fileDropDir returns FILEDROP_DIR
+func fileDropDir() string {
+	if dir := os.Getenv("FILEDROP_DIR"); dir != "" {
+		return dir
+	}
+	return defaultFileDropDir
+}
+
+// fileDropFormat returns the FILEDROP_FORMAT export format, or else reads FILEDROP_COLUMNS,
+// FILEDROP_DELIMITER and FILEDROP_HEADER
+func fileDropFormat() (sink.ExportFormat, error) {
+	if name := os.Getenv("FILEDROP_FORMAT"); name != "" {
+		format, err := exportFormat(name)
+		if err != nil {
+			return format, fmt.Errorf("FILEDROP_FORMAT: %w", err)
+		}
+		return format, nil
+	}
+	columns, err := sink.ParseExportColumns(os.Getenv("FILEDROP_COLUMNS"))
+	if err != nil {
+		return sink.ExportFormat{}, fmt.Errorf("FILEDROP_COLUMNS: %w", err)
+	}
+	delimiter := os.Getenv("FILEDROP_DELIMITER")
+	if delimiter == `\t` || strings.EqualFold(delimiter, "tab") {
+		delimiter = "\t"
+	}
+	return sink.ExportFormat{Columns: columns, Delimiter: delimiter, Header: envBool("FILEDROP_HEADER")}, nil
+}
+
+// fileDropTarget reads FILEDROP_URL, FILEDROP_PASSWORD and FILEDROP_SSH_KEY
+func fileDropTarget() (sink.FileDropTarget, error) {
+	u, err := url.Parse(os.Getenv("FILEDROP_URL"))
+	if err != nil {
+		return sink.FileDropTarget{}, err
+	}
+	switch u.Scheme {
+	case "sftp", "ftp", "ftps":
+	default:
+		return sink.FileDropTarget{}, fmt.Errorf("unsupported scheme %q, use sftp, ftp or ftps", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return sink.FileDropTarget{}, fmt.Errorf("no host")
+	}
+	return sink.FileDropTarget{URL: u, Password: os.Getenv("FILEDROP_PASSWORD"), SSHKey: os.Getenv("FILEDROP_SSH_KEY")}, nil
+}
+
+// fileDropSink configures the file drop sink when FILEDROP_URL is set
+func fileDropSink() (*sink.FileDropSink, error) {
+	format, err := fileDropFormat()
+	if err != nil {
+		return nil, err
+	}
+	return &sink.FileDropSink{Dir: fileDropDir(), Format: format}, nil
+}
+
+// fileDropName fills in the {date}, {time} and {org} placeholders of FILEDROP_FILENAME
+func fileDropName(now time.Time) string {
+	name := os.Getenv("FILEDROP_FILENAME")
+	if name == "" {
+		name = defaultFileDropName
+	}
+	return strings.NewReplacer(
+		"{date}", now.Format("20060102"),
+		"{time}", now.Format("150405"),
+		"{org}", os.Getenv("ORG_ID"),
+	).Replace(name)
+}
+
+// fileDropDue reports whether an upload is due: at each FILEDROP_AT time of day (HH:MM,
+// comma-separated) passed since the last upload, or else every FILEDROP_INTERVAL minutes
+func fileDropDue(last, now time.Time) bool {
+	if value := os.Getenv("FILEDROP_AT"); value != "" {
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		for _, entry := range splitList(value) {
+			at, err := parseClock(entry)
+			if err != nil {
+				log.Printf("Invalid FILEDROP_AT time %q: %v", entry, err)
+				continue
+			}
+			// The latest occurrence of this time, today or yesterday
+			occurrence := midnight.Add(at)
+			if occurrence.After(now) {
+				occurrence = occurrence.AddDate(0, 0, -1)
+			}
+			if occurrence.After(last) {
+				return true
+			}
+		}
+		return false
+	}
+	interval := defaultFileDropInterval
+	if value := os.Getenv("FILEDROP_INTERVAL"); value != "" {
+		if parsed, ok := parseSyncInterval(value); ok {
+			interval = parsed
+		} else {
+			log.Printf("Invalid FILEDROP_INTERVAL=%q, using %v", value, defaultFileDropInterval)
+		}
+	}
+	return now.Sub(last) >= interval
+}
+
+// uploadFileDrop uploads the collected records to FILEDROP_URL when an upload is due. A
+// failed upload keeps its file and is retried next cycle under the same name.
+func uploadFileDrop() {
+	if os.Getenv("FILEDROP_URL") == "" {
+		return
+	}
+	fileDropUploads.Lock()
+	defer fileDropUploads.Unlock()
+	now := time.Now()
+	var last time.Time
+	if data, err := state().Get(fileDropUploadedFile); err == nil && data != nil {
+		last, _ = time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	}
+	if last.IsZero() {
+		// The first upload waits a schedule from when the file drop started collecting
+		if err := state().Put(fileDropUploadedFile, []byte(now.Format(time.RFC3339))); err != nil {
+			log.Printf("Error saving file drop upload time: %v", err)
+		}
+		return
+	}
+	if !fileDropDue(last, now) {
+		return
+	}
+	target, err := fileDropTarget()
+	if err != nil {
+		log.Printf("File drop upload skipped, invalid FILEDROP_URL: %v", err)
+		return
+	}
+	uploaded, err := sink.UploadFileDrop(fileDropDir(), fileDropName(now), target)
+	for _, name := range uploaded {
+		log.Printf("File drop: uploaded %s to %s://%s", name, target.URL.Scheme, target.URL.Host)
+	}
+	if err != nil {
+		log.Printf("Error uploading file drop: %v", err)
+		return
+	}
+	if err := state().Put(fileDropUploadedFile, []byte(now.Format(time.RFC3339))); err != nil {
+		log.Printf("Error saving file drop upload time: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// State key of the registration COLLECTOR_REGISTER_URL last accepted
+	collectorRegistrationFile = "collector_registration.json"
+	// Heartbeats go to HEARTBEAT_URL this often unless HEARTBEAT_INTERVAL (minutes) overrides it
+	defaultHeartbeatInterval = 5 * time.Minute
+)
+
+// processStart is when the collector started, for the uptime in heartbeats
+var processStart = time.Now()
+
+// CollectorRegistration is the body posted to COLLECTOR_REGISTER_URL, the first time and
+// whenever it changes, as with a new version or devices added
+type CollectorRegistration struct {
+	CollectorID string            `json:"collector_id"`
+	OrgID       string            `json:"org_id"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Hostname    string            `json:"hostname"`
+	Version     string            `json:"version"`
+	Platform    string            `json:"platform"` // GOOS/GOARCH
+	Devices     []CollectorDevice `json:"devices"`
+}
+
+// CollectorDevice is a device configured on a collector
+type CollectorDevice struct {
+	DeviceID string `json:"device_id"`
+	Address  string `json:"address"`          // ip:port, or the serial port path
+	Serial   string `json:"serial,omitempty"` // Once pinned, see VERIFY_DEVICE_SERIAL
+	Branch   string `json:"branch,omitempty"`
+}
+
+// Heartbeat is the body posted to HEARTBEAT_URL: the collector is alive, with a summary of
+// how its devices and sinks are doing
+type Heartbeat struct {
+	CollectorID   string         `json:"collector_id"`
+	OrgID         string         `json:"org_id"`
+	Version       string         `json:"version"`
+	Time          string         `json:"time"`
+	UptimeSeconds int64          `json:"uptime_seconds"`
+	LastCycle     *cycleSummary  `json:"last_cycle,omitempty"`
+	Devices       heartbeatCount `json:"devices"`
+	Sinks         heartbeatCount `json:"sinks"`
+	RecordsToday  int            `json:"records_today"` // Read from the devices today
+	Backlog       int            `json:"backlog"`       // Records waiting for a sink, over all sinks
+}
+
+// heartbeatCount counts devices or sinks by health
+type heartbeatCount struct {
+	Total   int `json:"total"`
+	Failing int `json:"failing"` // Last read or delivery failed
+}
+
+// cycleSummary is the outcome of a sync cycle, as in its sync_summary log line
+type cycleSummary struct {
+	SyncID        string `json:"sync_id"`
+	FinishedAt    string `json:"finished_at"`
+	DevicesOK     int    `json:"devices_ok"`
+	DevicesFailed int    `json:"devices_failed"`
+	Fetched       int    `json:"fetched"`
+	Delivered     int    `json:"delivered"`
+	ErrorCode     string `json:"error_code,omitempty"`
+}
+
+// fleet holds the outcome of the last cycle for heartbeats, and serializes registrations
+var fleet = struct {
+	sync.Mutex
+	lastCycle *cycleSummary
+}{}
+
+// noteCycleSummary remembers the outcome of the last sync cycle for heartbeats
+func noteCycleSummary(summary cycleSummary) {
+	fleet.Lock()
+	defer fleet.Unlock()
+	fleet.lastCycle = &summary
+}
+
+// startHeartbeats registers the collector with COLLECTOR_REGISTER_URL and sends a heartbeat
+// to HEARTBEAT_URL every HEARTBEAT_INTERVAL minutes, whichever are set, giving the backend a
+// view of its fleet of collectors. The registration is checked with each heartbeat, so a
+// failed one is tried again and a changed one sent.
+func startHeartbeats() {
+	if os.Getenv("COLLECTOR_REGISTER_URL") == "" && os.Getenv("HEARTBEAT_URL") == "" {
+		return
+	}
+	registerCollector()
+	interval := defaultHeartbeatInterval
+	if value := os.Getenv("HEARTBEAT_INTERVAL"); value != "" {
+		if parsed, ok := parseSyncInterval(value); ok {
+			interval = parsed
+		} else {
+			log.Printf("Invalid HEARTBEAT_INTERVAL=%q, using %v", value, interval)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			registerCollector()
+			sendHeartbeat()
+		}
+	}()
+}
+
+// registerCollector posts the collector's registration unless the backend already has it
+func registerCollector() {
+	url := os.Getenv("COLLECTOR_REGISTER_URL")
+	if url == "" {
+		return
+	}
+	fleet.Lock()
+	defer fleet.Unlock()
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	registration := CollectorRegistration{
+		CollectorID: collectorID(),
+		OrgID:       os.Getenv("ORG_ID"),
+		Tenant:      tenantName(),
+		Hostname:    hostname,
+		Version:     Version,
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		Devices:     []CollectorDevice{},
+	}
+	serials := loadDeviceSerials()
+	for _, device := range configuredDevices() {
+		registration.Devices = append(registration.Devices, CollectorDevice{
+			DeviceID: device.ID,
+			Address:  device.Addr(),
+			Serial:   serials[device.ID],
+			Branch:   deviceEnv("DEVICE_BRANCH", device.ID),
+		})
+	}
+	body, err := json.Marshal(registration)
+	if err != nil {
+		return
+	}
+	if last, err := state().Get(collectorRegistrationFile); err == nil && bytes.Equal(last, body) {
+		return
+	}
+	if err := postFleetUpdate(url, registration); err != nil {
+		log.Printf("Error registering collector: %v", err)
+		return
+	}
+	log.Printf("Registered collector %s with %d device(s)", registration.CollectorID, len(registration.Devices))
+	if err := state().Put(collectorRegistrationFile, body); err != nil {
+		log.Printf("Error saving collector registration: %v", err)
+	}
+}
+
+// sendHeartbeat posts a heartbeat to HEARTBEAT_URL
+func sendHeartbeat() {
+	url := os.Getenv("HEARTBEAT_URL")
+	if url == "" {
+		return
+	}
+	now := time.Now()
+	heartbeat := Heartbeat{
+		CollectorID:   collectorID(),
+		OrgID:         os.Getenv("ORG_ID"),
+		Version:       Version,
+		Time:          now.Format(time.RFC3339),
+		UptimeSeconds: int64(now.Sub(processStart) / time.Second),
+	}
+	fleet.Lock()
+	heartbeat.LastCycle = fleet.lastCycle
+	fleet.Unlock()
+	report := buildStatusReport()
+	for _, d := range report.Devices {
+		heartbeat.Devices.Total++
+		if d.ErrorStreak > 0 {
+			heartbeat.Devices.Failing++
+		}
+		heartbeat.RecordsToday += d.RecordsToday
+	}
+	for _, s := range report.Sinks {
+		heartbeat.Sinks.Total++
+		if s.ErrorStreak > 0 {
+			heartbeat.Sinks.Failing++
+		}
+		heartbeat.Backlog += s.Backlog
+	}
+	if err := postFleetUpdate(url, heartbeat); err != nil {
+		log.Printf("Error sending heartbeat: %v", err)
+	}
+}
+
+// postFleetUpdate posts a registration or heartbeat
+func postFleetUpdate(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := sink.NewAPIRequest("POST", url, body, os.Getenv("API_KEY"))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
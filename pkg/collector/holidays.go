@@ -0,0 +1,242 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// State key caching the holidays fetched from HOLIDAYS_URL
+	holidaysCacheFile = "holidays.json"
+	// How often HOLIDAYS_URL is fetched
+	holidaysRefresh = 24 * time.Hour
+	// How often HOLIDAYS_FILE is read again, so edits apply without a restart
+	holidaysReload = time.Hour
+	// Name of the days off given by WEEKEND_DAYS
+	weekendName = "weekend"
+)
+
+// Holiday is one entry of the holiday calendar. Date is YYYY-MM-DD, or MM-DD for a holiday on
+// the same date every year.
+type Holiday struct {
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+// holidaysCache is the stored form of the HOLIDAYS_URL calendar
+type holidaysCache struct {
+	FetchedAt time.Time `json:"fetched_at"`
+	Holidays  []Holiday `json:"holidays"`
+}
+
+// holidayCalendar tells working days from days off
+type holidayCalendar struct {
+	dates   map[string]string // Holiday names by YYYY-MM-DD or MM-DD
+	weekend [7]bool
+}
+
+// holidays is the calendar, rebuilt when its sources are due for a reload
+var holidays = struct {
+	sync.Mutex
+	calendar *holidayCalendar
+	loadedAt time.Time
+}{}
+
+// holiday returns the name of the holiday on t's date
+func (c *holidayCalendar) holiday(t time.Time) (string, bool) {
+	if name, ok := c.dates[t.Format("2006-01-02")]; ok {
+		return name, true
+	}
+	name, ok := c.dates[t.Format("01-02")]
+	return name, ok
+}
+
+// dayOff returns the holiday on t's date, "weekend" on a WEEKEND_DAYS day, or false on a
+// working day
+func (c *holidayCalendar) dayOff(t time.Time) (string, bool) {
+	if name, ok := c.holiday(t); ok {
+		return name, true
+	}
+	if c.weekend[t.Weekday()] {
+		return weekendName, true
+	}
+	return "", false
+}
+
+// add enters holidays into the calendar
+func (c *holidayCalendar) add(entries []Holiday) {
+	for _, h := range entries {
+		c.dates[h.Date] = h.Name
+	}
+}
+
+// parseHolidayFile parses a holiday file: one holiday per line as "DATE Name", where DATE is
+// YYYY-MM-DD, a range YYYY-MM-DD..YYYY-MM-DD, or MM-DD for every year. Blank lines and lines
+// starting with # are skipped.
+func parseHolidayFile(data []byte) ([]Holiday, error) {
+	var entries []Holiday
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		date, name := text, ""
+		if i := strings.IndexAny(text, " \t,"); i >= 0 {
+			date, name = text[:i], strings.TrimSpace(strings.TrimLeft(text[i:], " \t,"))
+		}
+		if name == "" {
+			name = "holiday"
+		}
+		if bounds := strings.Split(date, ".."); len(bounds) == 2 {
+			first, err1 := time.Parse("2006-01-02", bounds[0])
+			last, err2 := time.Parse("2006-01-02", bounds[1])
+			if err1 != nil || err2 != nil || last.Before(first) {
+				return nil, fmt.Errorf("line %d: invalid date range %q", line, date)
+			}
+			for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+				entries = append(entries, Holiday{Date: d.Format("2006-01-02"), Name: name})
+			}
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			if _, err := time.Parse("01-02", date); err != nil {
+				return nil, fmt.Errorf("line %d: invalid date %q, expected YYYY-MM-DD or MM-DD", line, date)
+			}
+		}
+		entries = append(entries, Holiday{Date: date, Name: name})
+	}
+	return entries, scanner.Err()
+}
+
+// fetchHolidays GETs the holiday calendar from HOLIDAYS_URL, a JSON array of
+// {"date": "YYYY-MM-DD", "name": "..."} objects
+func fetchHolidays(url, apiKey string) ([]Holiday, error) {
+	req, err := sink.NewAPIRequest("GET", url, nil, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute holidays request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("holidays request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	var entries []Holiday
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("invalid holidays response: %w", err)
+	}
+	return entries, nil
+}
+
+// urlHolidays returns the HOLIDAYS_URL calendar, fetching it when the cached copy is a day
+// old. A failed fetch falls back to the cache.
+func urlHolidays(url string) []Holiday {
+	var cache holidaysCache
+	data, err := state().Get(holidaysCacheFile)
+	cached := err == nil && data != nil && json.Unmarshal(data, &cache) == nil
+	if cached && time.Since(cache.FetchedAt) < holidaysRefresh {
+		return cache.Holidays
+	}
+	entries, err := fetchHolidays(url, os.Getenv("API_KEY"))
+	if err != nil {
+		log.Printf("Error refreshing holidays: %v", err)
+		return cache.Holidays
+	}
+	log.Printf("Holidays refreshed: %d day(s)", len(entries))
+	data, err = json.Marshal(holidaysCache{FetchedAt: time.Now(), Holidays: entries})
+	if err == nil {
+		err = state().Put(holidaysCacheFile, data)
+	}
+	if err != nil {
+		log.Printf("Error caching holidays: %v", err)
+	}
+	return entries
+}
+
+// buildHolidayCalendar reads WEEKEND_DAYS, HOLIDAYS_FILE and HOLIDAYS_URL
+func buildHolidayCalendar() (*holidayCalendar, error) {
+	calendar := &holidayCalendar{dates: map[string]string{}}
+	weekend, err := parseWeekdays(os.Getenv("WEEKEND_DAYS"))
+	if err != nil {
+		return calendar, fmt.Errorf("WEEKEND_DAYS: %w", err)
+	}
+	calendar.weekend = weekend
+	if path := os.Getenv("HOLIDAYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return calendar, fmt.Errorf("HOLIDAYS_FILE: %w", err)
+		}
+		entries, err := parseHolidayFile(data)
+		if err != nil {
+			return calendar, fmt.Errorf("HOLIDAYS_FILE %s: %w", path, err)
+		}
+		calendar.add(entries)
+	}
+	if url := os.Getenv("HOLIDAYS_URL"); url != "" {
+		calendar.add(urlHolidays(url))
+	}
+	return calendar, nil
+}
+
+// holidayCalendarNow returns the calendar, rebuilding it every holidaysReload. Invalid
+// settings are logged and the valid parts used.
+func holidayCalendarNow() *holidayCalendar {
+	holidays.Lock()
+	defer holidays.Unlock()
+	if holidays.calendar != nil && time.Since(holidays.loadedAt) < holidaysReload {
+		return holidays.calendar
+	}
+	calendar, err := buildHolidayCalendar()
+	if err != nil {
+		log.Printf("Holiday calendar: %v", err)
+	}
+	holidays.calendar, holidays.loadedAt = calendar, time.Now()
+	return calendar
+}
+
+// dayOff returns why t's date is not a working day: a holiday's name or "weekend"
+func dayOff(t time.Time) (string, bool) {
+	return holidayCalendarNow().dayOff(t)
+}
+
+// runHolidaysCommand lists the days off in the coming days
+func runHolidaysCommand(args []string) error {
+	fs := flag.NewFlagSet("holidays", flag.ExitOnError)
+	days := fs.Int("days", 60, "number of days to list, starting today")
+	fs.Parse(args)
+
+	calendar, err := buildHolidayCalendar()
+	if err != nil {
+		return configError(err.Error())
+	}
+	today := time.Now()
+	found := 0
+	for i := 0; i < *days; i++ {
+		date := today.AddDate(0, 0, i)
+		if name, ok := calendar.dayOff(date); ok {
+			fmt.Printf("%s %s %s\n", date.Format("2006-01-02"), date.Format("Mon"), name)
+			found++
+		}
+	}
+	if found == 0 {
+		fmt.Println(tr("No days off in the next %d day(s).", *days))
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseHolidayFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []Holiday
+		wantErr bool
+	}{
+		{"dated", "2024-03-26 Independence Day", []Holiday{{"2024-03-26", "Independence Day"}}, false},
+		{"every year", "12-16 Victory Day", []Holiday{{"12-16", "Victory Day"}}, false},
+		{"no name", "2024-05-01", []Holiday{{"2024-05-01", "holiday"}}, false},
+		{"comma separated", "2024-05-01, May Day", []Holiday{{"2024-05-01", "May Day"}}, false},
+		{"tab separated", "2024-05-01\tMay Day", []Holiday{{"2024-05-01", "May Day"}}, false},
+		{"comments and blank lines", "# Public holidays\n\n  2024-05-01 May Day  \n", []Holiday{{"2024-05-01", "May Day"}}, false},
+		{"range", "2024-04-09..2024-04-11 Eid", []Holiday{{"2024-04-09", "Eid"}, {"2024-04-10", "Eid"}, {"2024-04-11", "Eid"}}, false},
+		{"range over a month end", "2024-02-28..2024-03-01 Break", []Holiday{{"2024-02-28", "Break"}, {"2024-02-29", "Break"}, {"2024-03-01", "Break"}}, false},
+		{"one-day range", "2024-04-09..2024-04-09", []Holiday{{"2024-04-09", "holiday"}}, false},
+		{"empty", "", nil, false},
+		{"reversed range", "2024-04-11..2024-04-09 Eid", nil, true},
+		{"range of yearly dates", "04-09..04-11 Eid", nil, true},
+		{"no such day", "2024-02-30 Leap", nil, true},
+		{"no such month", "13-01 Nothing", nil, true},
+		{"other date format", "26/03/2024 Independence Day", nil, true},
+		{"later line invalid", "2024-05-01 May Day\nsoon Party", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHolidayFile([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: holidays %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: holidays %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHolidayCalendarDayOff(t *testing.T) {
+	weekend, _ := parseWeekdays("fri,sat")
+	calendar := &holidayCalendar{dates: map[string]string{}, weekend: weekend}
+	calendar.add([]Holiday{{"2024-03-26", "Independence Day"}, {"12-16", "Victory Day"}, {"2024-04-12", "Eid"}})
+
+	tests := []struct {
+		date   string
+		reason string // "" for a working day
+	}{
+		{"2024-03-26", "Independence Day"},
+		{"2025-03-26", ""}, // Dated holidays are for their year only
+		{"2024-12-16", "Victory Day"},
+		{"2031-12-16", "Victory Day"},
+		{"2024-04-12", "Eid"}, // A holiday on a weekend day is named
+		{"2024-03-29", weekendName},
+		{"2024-03-30", weekendName},
+		{"2024-03-31", ""},
+		{"2024-12-15", ""},
+	}
+	for _, tt := range tests {
+		day, _ := time.Parse("2006-01-02", tt.date)
+		reason, off := calendar.dayOff(day)
+		if off != (tt.reason != "") || reason != tt.reason {
+			t.Errorf("dayOff(%s) = %q, %v, want %q", tt.date, reason, off, tt.reason)
+		}
+	}
+}
+
+func TestBuildHolidayCalendar(t *testing.T) {
+	inStateDir(t)
+	file := filepath.Join(t.TempDir(), "holidays.txt")
+	if err := os.WriteFile(file, []byte("2024-03-26 Independence Day\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(t.TempDir(), "bad.txt")
+	if err := os.WriteFile(bad, []byte("someday\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.URL.Path == "/down" {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]Holiday{{"2024-04-10", "Eid"}})
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name               string
+		weekend, path, url string
+		holidays           []string
+		wantErr            bool
+	}{
+		{"nothing configured", "", "", "", nil, false},
+		{"file", "", file, "", []string{"2024-03-26"}, false},
+		{"file and URL", "fri", file, server.URL + "/holidays", []string{"2024-03-26", "2024-04-10"}, false},
+		{"missing file", "", filepath.Join(t.TempDir(), "none.txt"), "", nil, true},
+		{"invalid file", "", bad, "", nil, true},
+		{"invalid weekend", "weekends", file, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("WEEKEND_DAYS", tt.weekend)
+		t.Setenv("HOLIDAYS_FILE", tt.path)
+		t.Setenv("HOLIDAYS_URL", tt.url)
+		calendar, err := buildHolidayCalendar()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if len(calendar.dates) != len(tt.holidays) {
+			t.Errorf("%s: holidays %v, want %v", tt.name, calendar.dates, tt.holidays)
+		}
+		for _, date := range tt.holidays {
+			if _, ok := calendar.dates[date]; !ok {
+				t.Errorf("%s: no holiday on %s", tt.name, date)
+			}
+		}
+	}
+
+	// The fetched calendar is cached for a day, and kept when the URL is down
+	t.Setenv("HOLIDAYS_FILE", "")
+	t.Setenv("WEEKEND_DAYS", "")
+	before := fetches
+	if entries := urlHolidays(server.URL + "/holidays"); len(entries) != 1 || fetches != before {
+		t.Errorf("cached calendar: %v after %d fetch(es), want it without fetching", entries, fetches-before)
+	}
+	stale, _ := json.Marshal(holidaysCache{FetchedAt: time.Now().Add(-holidaysRefresh), Holidays: []Holiday{{"2024-04-10", "Eid"}}})
+	if err := state().Put(holidaysCacheFile, stale); err != nil {
+		t.Fatal(err)
+	}
+	if entries := urlHolidays(server.URL + "/down"); len(entries) != 1 || fetches != before+1 {
+		t.Errorf("URL down: %v after %d fetch(es), want the cached calendar after one", entries, fetches-before)
+	}
+}
+
+func TestNoPunchAlertOnDaysOff(t *testing.T) {
+	inStateDir(t)
+	t.Setenv("NO_PUNCH_ALERT_AT", "00:00")
+	today := time.Now()
+	var weekendToday [7]bool
+	weekendToday[today.Weekday()] = true
+
+	tests := []struct {
+		name     string
+		calendar *holidayCalendar
+		alert    bool
+	}{
+		{"working day", &holidayCalendar{dates: map[string]string{}}, true},
+		{"holiday", &holidayCalendar{dates: map[string]string{today.Format("2006-01-02"): "Test Day"}}, false},
+		{"yearly holiday", &holidayCalendar{dates: map[string]string{today.Format("01-02"): "Test Day"}}, false},
+		{"weekend", &holidayCalendar{dates: map[string]string{}, weekend: weekendToday}, false},
+	}
+	for _, tt := range tests {
+		withHolidays(t, tt.calendar)
+		lastPunches.Lock()
+		delete(lastPunches.alerted, "nopunch-gate")
+		lastPunches.Unlock()
+		events, _ := subscribeEvents(0)
+		cycle := newSyncCycle()
+		cycle.devicesRead["nopunch-gate"] = true
+		checkNoPunches(cycle)
+		unsubscribeEvents(events)
+		alerted := false
+		for event := range events {
+			alerted = alerted || event.Type == eventNoPunches
+		}
+		if alerted != tt.alert {
+			t.Errorf("%s: alerted %v, want %v", tt.name, alerted, tt.alert)
+		}
+	}
+}
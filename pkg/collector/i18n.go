@@ -0,0 +1,142 @@
+package collector
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+)
+
+// Languages with a message catalog. Messages are keyed by their English text, so English
+// needs no entries and anything missing from a catalog is shown in English.
+var supportedLocales = []language.Tag{language.English, language.Bengali}
+
+// bnMessages is the Bengali catalog for the output of the commands operators run: the init
+// wizard, config validate, record and stats queries, exports and key tools. Logs and the
+// admin server's JSON, which dashboards read, stay in English.
+var bnMessages = map[string]string{
+	// init
+	"Attendance collector setup. Press Enter to accept the value in brackets.": "হাজিরা কালেক্টর সেটআপ। বন্ধনীর মান গ্রহণ করতে Enter চাপুন।",
+	"%s already exists. Overwrite it?":                                         "%s আগে থেকেই আছে। এটি প্রতিস্থাপন করবেন?",
+	"setup cancelled, %s left unchanged":                                       "সেটআপ বাতিল হয়েছে, %s অপরিবর্তিত রাখা হয়েছে",
+	"Terminals":                                                                "টার্মিনাল",
+	"Search the local network for terminals?":                                  "লোকাল নেটওয়ার্কে টার্মিনাল খুঁজবেন?",
+	"Subnet to search":                                                         "যে সাবনেটে খুঁজবেন",
+	"Device port":                                                              "ডিভাইস পোর্ট",
+	"Searching %s, this can take a minute...":                                  "%s খোঁজা হচ্ছে, এক মিনিট পর্যন্ত লাগতে পারে...",
+	"Search failed: %v":                                                        "খোঁজা ব্যর্থ হয়েছে: %v",
+	"No terminals answered.":                                                   "কোনো টার্মিনাল সাড়া দেয়নি।",
+	"Found terminal %s (serial number %s)":                                     "টার্মিনাল পাওয়া গেছে %s (সিরিয়াল নম্বর %s)",
+	"Sync this terminal?":                                                      "এই টার্মিনাল সিঙ্ক করবেন?",
+	"Add a terminal by address?":                                               "ঠিকানা দিয়ে টার্মিনাল যোগ করবেন?",
+	"Address (ip:port, or serial:/dev/ttyUSB0)":                                "ঠিকানা (ip:port, অথবা serial:/dev/ttyUSB0)",
+	"%q is not a device address":                                               "%q কোনো ডিভাইসের ঠিকানা নয়",
+	"Name for this terminal, e.g. main-gate":                                   "এই টার্মিনালের নাম, যেমন main-gate",
+	"Use letters, digits, - and _ only.":                                       "শুধু ইংরেজি অক্ষর, অঙ্ক, - এবং _ ব্যবহার করুন।",
+	"%s is already used.":                                                      "%s আগেই ব্যবহার করা হয়েছে।",
+	"Attendance API":                                                           "হাজিরা API",
+	"API URL":                                                                  "API URL",
+	"Organization ID":                                                          "প্রতিষ্ঠানের আইডি",
+	"API key":                                                                  "API কী",
+	"Send a test request to the API now?":                                      "এখন API-তে একটি পরীক্ষামূলক অনুরোধ পাঠাবেন?",
+	"The API test failed: %v":                                                  "API পরীক্ষা ব্যর্থ হয়েছে: %v",
+	"Save the configuration anyway?":                                           "তবুও কনফিগারেশন সংরক্ষণ করবেন?",
+	"setup cancelled, fix the API settings and run init again":                 "সেটআপ বাতিল হয়েছে, API সেটিংস ঠিক করে আবার init চালান",
+	"Minutes between syncs":                                                    "দুই সিঙ্কের মাঝে কত মিনিট",
+	"Please enter a whole number of minutes":                                   "মিনিটের একটি পূর্ণ সংখ্যা লিখুন",
+	"Admin server address for monitoring (empty to disable)":                   "মনিটরিংয়ের জন্য অ্যাডমিন সার্ভারের ঠিকানা (বন্ধ রাখতে খালি রাখুন)",
+	"Wrote %s. Optional settings are described in .env.example.":               "%s লেখা হয়েছে। ঐচ্ছিক সেটিংসের বিবরণ .env.example-এ আছে।",
+	"Remaining configuration notes:":                                           "কনফিগারেশন সম্পর্কে বাকি মন্তব্য:",
+	"Start the collector without arguments to begin syncing.":                  "সিঙ্ক শুরু করতে কোনো আর্গুমেন্ট ছাড়া কালেক্টর চালু করুন।",
+	"y/N": "হ্যাঁ/না, Enter=না",
+	"Y/n": "হ্যাঁ/না, Enter=হ্যাঁ",
+
+	// config validate
+	"error":   "ত্রুটি",
+	"warning": "সতর্কতা",
+	"%d configuration error(s) and %d warning(s)":                                        "কনফিগারেশনে %d টি ত্রুটি ও %d টি সতর্কতা",
+	"Configuration OK (%d warning(s))":                                                   "কনফিগারেশন ঠিক আছে (%d টি সতর্কতা)",
+	`not set; list the terminals as "name=ip:port", e.g. gate=192.168.1.201:4370`:        `সেট করা হয়নি; টার্মিনালগুলো "name=ip:port" আকারে লিখুন, যেমন gate=192.168.1.201:4370`,
+	"device %s is listed twice; give each entry its own name":                            "ডিভাইস %s দুবার আছে; প্রতিটির আলাদা নাম দিন",
+	"device %s has an invalid host %q":                                                   "ডিভাইস %s-এর হোস্ট %q সঠিক নয়",
+	"device %s has an invalid port %q; ZKTeco terminals usually listen on 4370":          "ডিভাইস %s-এর পোর্ট %q সঠিক নয়; ZKTeco টার্মিনাল সাধারণত 4370 পোর্টে থাকে",
+	"not set; the attendance API endpoint records are posted to":                         "সেট করা হয়নি; যে API-তে হাজিরার রেকর্ড পাঠানো হয়",
+	"not set; the organization records are uploaded for":                                 "সেট করা হয়নি; যে প্রতিষ্ঠানের জন্য রেকর্ড আপলোড হয়",
+	"scheme %q is not supported, use %s":                                                 "%q স্কিম সমর্থিত নয়, %s ব্যবহার করুন",
+	"uses unencrypted %s; credentials and records cross the network in clear text":       "এনক্রিপশনহীন %s ব্যবহার করছে; পাসওয়ার্ড ও রেকর্ড নেটওয়ার্কে খোলাভাবে যায়",
+	"not set and no token provider configured; requests are sent without authentication": "সেট করা হয়নি এবং কোনো টোকেন প্রোভাইডারও নেই; অনুরোধ প্রমাণীকরণ ছাড়াই পাঠানো হবে",
+	"%q is not a positive number of minutes":                                             "%q মিনিটের কোনো ধনাত্মক সংখ্যা নয়",
+	"unknown timezone %q; use an IANA name such as Asia/Dhaka":                           "অজানা টাইমজোন %q; Asia/Dhaka-র মতো IANA নাম ব্যবহার করুন",
+	"%q is not a non-negative whole number":                                              "%q কোনো অঋণাত্মক পূর্ণ সংখ্যা নয়",
+	"unknown value %q; use %s":                                                           "অজানা মান %q; %s ব্যবহার করুন",
+
+	// records query, stats and user punches
+	"TIME\tUSER\tDEVICE\tSTATUS\tFLAGS\tDELIVERED": "সময়\tব্যবহারকারী\tডিভাইস\tঅবস্থা\tচিহ্ন\tপাঠানো",
+	"yes":                                "হ্যাঁ",
+	"pending: %s":                        "বাকি: %s",
+	"%d record(s)":                       "%d টি রেকর্ড",
+	"PERIOD\tUSER\tPUNCHES\tFIRST\tLAST": "সময়কাল\tব্যবহারকারী\tপাঞ্চ\tপ্রথম\tশেষ",
+	"PERIOD\tDEVICE\tPUNCHES\tUSERS\tFIRST\tLAST": "সময়কাল\tডিভাইস\tপাঞ্চ\tব্যবহারকারী\tপ্রথম\tশেষ",
+	"stored":                                          "সংরক্ষিত",
+	"not stored":                                      "সংরক্ষিত নয়",
+	"No days off in the next %d day(s).":              "সামনের %d দিনে কোনো ছুটি নেই।",
+	"Exported %d record(s) to %s":                     "%[2]s-এ %[1]d টি রেকর্ড এক্সপোর্ট করা হয়েছে",
+	"Exported %d session(s) to %s":                    "%[2]s-এ %[1]d টি সেশন এক্সপোর্ট করা হয়েছে",
+	"Exported %d session(s) for %d employee(s) to %s": "%[3]s-এ %[2]d জন কর্মীর %[1]d টি সেশন এক্সপোর্ট করা হয়েছে",
+
+	// config encrypt and keygen
+	"Passphrase: ":        "পাসফ্রেজ: ",
+	"Encrypted %s":        "%s এনক্রিপ্ট করা হয়েছে",
+	"Nothing to encrypt.": "এনক্রিপ্ট করার মতো কিছু নেই।",
+	"Set CONFIG_PASSPHRASE or CONFIG_PASSPHRASE_FILE for the collector to start.": "কালেক্টর চালু করতে CONFIG_PASSPHRASE বা CONFIG_PASSPHRASE_FILE সেট করুন।",
+	"The values can only be decrypted on this machine.":                           "মানগুলো শুধু এই মেশিনেই ডিক্রিপ্ট করা যাবে।",
+	"Public key (register with the backend): %s":                                  "পাবলিক কী (ব্যাকএন্ডে নিবন্ধন করুন): %s",
+	"Key ID: %s": "কী আইডি: %s",
+}
+
+// localePrinter is the printer for the configured locale
+var localePrinter struct {
+	once    sync.Once
+	printer *message.Printer
+}
+
+// messageCatalog builds the catalog from the message tables
+func messageCatalog() catalog.Catalog {
+	builder := catalog.NewBuilder(catalog.Fallback(language.English))
+	for key, text := range bnMessages {
+		builder.SetString(language.Bengali, key, text)
+	}
+	return builder
+}
+
+// userLocale picks the catalog language from LOCALE, or else from LC_ALL or LANG, such as
+// "bn" or "bn_BD.UTF-8". It defaults to English.
+func userLocale() language.Tag {
+	value := os.Getenv("LOCALE")
+	for _, key := range []string{"LC_ALL", "LANG"} {
+		if value == "" {
+			value = os.Getenv(key)
+		}
+	}
+	if i := strings.IndexAny(value, ".@"); i >= 0 {
+		value = value[:i]
+	}
+	tag, err := language.Parse(strings.Replace(value, "_", "-", -1))
+	if err != nil {
+		return language.English
+	}
+	_, index, _ := language.NewMatcher(supportedLocales).Match(tag)
+	return supportedLocales[index]
+}
+
+// tr formats a user-facing message in the configured locale. Numbers are written with the
+// locale's digits.
+func tr(format string, args ...interface{}) string {
+	localePrinter.once.Do(func() {
+		localePrinter.printer = message.NewPrinter(userLocale(), message.Catalog(messageCatalog()))
+	})
+	return localePrinter.printer.Sprintf(format, args...)
+}
@@ -0,0 +1,63 @@
+package collector
+
+import (
+	"regexp"
+	"sort"
+	"testing"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// formatVerb matches a format verb, with an optional explicit argument index
+var formatVerb = regexp.MustCompile(`%(\[\d+\])?[a-z]`)
+
+// verbs returns the verbs of a format, without their argument indexes, in a stable order
+func verbs(format string) []string {
+	var found []string
+	for _, verb := range formatVerb.FindAllString(format, -1) {
+		found = append(found, verb[len(verb)-1:])
+	}
+	sort.Strings(found)
+	return found
+}
+
+// Every translation takes the same arguments as its English message
+func TestBengaliCatalogVerbs(t *testing.T) {
+	for key, text := range bnMessages {
+		if !equalStrings(verbs(key), verbs(text)) {
+			t.Errorf("%q: translation %q has verbs %v, want %v", key, text, verbs(text), verbs(key))
+		}
+	}
+}
+
+func TestBengaliMessages(t *testing.T) {
+	printer := message.NewPrinter(language.Bengali, message.Catalog(messageCatalog()))
+	if got, want := printer.Sprintf("Exported %d record(s) to %s", 3, "out.csv"), "out.csv-এ ৩ টি রেকর্ড এক্সপোর্ট করা হয়েছে"; got != want {
+		t.Errorf("reordered arguments: got %q, want %q", got, want)
+	}
+	if got, want := printer.Sprintf("Missing from the catalog %d", 2), "Missing from the catalog ২"; got != want {
+		t.Errorf("fallback: got %q, want %q", got, want)
+	}
+}
+
+func TestUserLocale(t *testing.T) {
+	tests := []struct {
+		locale, lang string
+		want         language.Tag
+	}{
+		{"bn", "", language.Bengali},
+		{"", "bn_BD.UTF-8", language.Bengali},
+		{"", "de_DE.UTF-8", language.English},
+		{"", "", language.English},
+		{"en", "bn_BD.UTF-8", language.English},
+	}
+	for _, tt := range tests {
+		t.Setenv("LOCALE", tt.locale)
+		t.Setenv("LC_ALL", "")
+		t.Setenv("LANG", tt.lang)
+		if got := userLocale(); got != tt.want {
+			t.Errorf("LOCALE=%q LANG=%q: locale %v, want %v", tt.locale, tt.lang, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package collector
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"old-attendance/pkg/zk"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// icsTimeLayout is an RFC 5545 date-time in UTC
+const icsTimeLayout = "20060102T150405Z"
+
+// attendanceSession is an employee's stay from a punch in to the matching punch out
+type attendanceSession struct {
+	UserID int
+	Name   string // From the lookup API, when records were enriched
+	Branch string
+	In     time.Time
+	InAt   string // Device punched in at
+	Out    time.Time
+	OutAt  string // Device punched out at, empty while the session is open
+}
+
+// open reports whether the session has no punch out
+func (s attendanceSession) open() bool {
+	return s.Out.IsZero()
+}
+
+// pairSessions pairs each employee's punches into sessions in time order, with the direction
+// rules of the occupancy count: entrance and exit terminals decide, and on other devices a
+// punch at the branch an employee is in ends their session. A session without a punch out
+// within the maximum stay is left open, and a punch out without a punch in is dropped.
+func pairSessions(logs []zk.AttendanceRecord) []attendanceSession {
+	type punch struct {
+		at     time.Time
+		record zk.AttendanceRecord
+	}
+	byUser := map[int][]punch{}
+	for _, record := range logs {
+		if at, err := record.Time(); err == nil {
+			byUser[record.UserID] = append(byUser[record.UserID], punch{at, record})
+		}
+	}
+	users := make([]int, 0, len(byUser))
+	for userID := range byUser {
+		users = append(users, userID)
+	}
+	sort.Ints(users)
+
+	stay := maxStay()
+	var sessions []attendanceSession
+	for _, userID := range users {
+		punches := byUser[userID]
+		sort.SliceStable(punches, func(i, j int) bool { return punches[i].at.Before(punches[j].at) })
+		var current *attendanceSession
+		for _, p := range punches {
+			if current != nil && p.at.Sub(current.In) > stay {
+				sessions = append(sessions, *current)
+				current = nil
+			}
+			branch, direction := deviceBranch(p.record.DeviceID), deviceDirection(p.record.DeviceID)
+			arriving := direction == directionIn ||
+				direction == directionToggle && !(current != nil && current.Branch == branch)
+			if arriving {
+				if current != nil {
+					sessions = append(sessions, *current)
+				}
+				current = &attendanceSession{UserID: userID, Name: p.record.EmployeeName, Branch: branch, In: p.at, InAt: p.record.DeviceID}
+			} else if current != nil {
+				current.Out, current.OutAt = p.at, p.record.DeviceID
+				if current.Name == "" {
+					current.Name = p.record.EmployeeName
+				}
+				sessions = append(sessions, *current)
+				current = nil
+			}
+		}
+		if current != nil {
+			sessions = append(sessions, *current)
+		}
+	}
+	return sessions
+}
+
+// icsEscape escapes text for an RFC 5545 TEXT value
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icsLine writes a content line, folded at 75 octets without splitting a character
+func icsLine(buf *bytes.Buffer, line string) {
+	width := 75
+	for len(line) > width {
+		cut := width
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines start with a space
+		width = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// isRuneStart reports whether b starts a UTF-8 sequence
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// writeICS writes sessions as an iCalendar with an event per session. Open sessions are
+// events without an end, marked as missing a punch out.
+func writeICS(w io.Writer, name string, sessions []attendanceSession) error {
+	var buf bytes.Buffer
+	org := os.Getenv("ORG_ID")
+	stamp := time.Now().UTC().Format(icsTimeLayout)
+	icsLine(&buf, "BEGIN:VCALENDAR")
+	icsLine(&buf, "VERSION:2.0")
+	icsLine(&buf, "PRODID:-//old-attendance//attendance sessions//EN")
+	icsLine(&buf, "CALSCALE:GREGORIAN")
+	icsLine(&buf, "METHOD:PUBLISH")
+	icsLine(&buf, "X-WR-CALNAME:"+icsEscape(name))
+	for _, s := range sessions {
+		who := s.Name
+		if who == "" {
+			who = fmt.Sprintf("Employee %d", s.UserID)
+		}
+		summary := who
+		description := fmt.Sprintf("Employee %d, in at %s", s.UserID, s.InAt)
+		if s.open() {
+			summary += " (no punch out)"
+		} else {
+			description += fmt.Sprintf(", out at %s, %s", s.OutAt, strings.TrimSuffix(s.Out.Sub(s.In).String(), "0s"))
+		}
+		icsLine(&buf, "BEGIN:VEVENT")
+		icsLine(&buf, fmt.Sprintf("UID:%d-%d@%s", s.UserID, s.In.Unix(), icsEscape(org)))
+		icsLine(&buf, "DTSTAMP:"+stamp)
+		icsLine(&buf, "DTSTART:"+s.In.UTC().Format(icsTimeLayout))
+		if !s.open() {
+			icsLine(&buf, "DTEND:"+s.Out.UTC().Format(icsTimeLayout))
+		}
+		icsLine(&buf, "SUMMARY:"+icsEscape(summary))
+		icsLine(&buf, "LOCATION:"+icsEscape(s.Branch))
+		icsLine(&buf, "DESCRIPTION:"+icsEscape(description))
+		icsLine(&buf, "TRANSP:TRANSPARENT")
+		icsLine(&buf, "END:VEVENT")
+	}
+	icsLine(&buf, "END:VCALENDAR")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// runICSCommand exports the sessions of stored records as iCalendar files, merged into one
+// calendar or one per employee
+func runICSCommand(args []string) error {
+	fs := flag.NewFlagSet("ics", flag.ExitOnError)
+	fromStr := fs.String("from", "", "first day to export as YYYY-MM-DD (default today)")
+	toStr := fs.String("to", "", "last day to export as YYYY-MM-DD (default --from)")
+	users := fs.String("users", "", "comma-separated employee IDs (default everyone)")
+	out := fs.String("out", "", "calendar file to write (default standard output)")
+	dir := fs.String("dir", "", "write a calendar per employee, employee-<id>.ics, to this directory")
+	fs.Parse(args)
+
+	from, to, err := parseDayRange(*fromStr, *toStr)
+	if err != nil {
+		return err
+	}
+	wanted := map[int]bool{}
+	if *users != "" {
+		ids, err := parseEmployeeIDs(*users)
+		if err != nil {
+			return fmt.Errorf("invalid --users: %w", err)
+		}
+		for _, id := range ids {
+			wanted[id] = true
+		}
+	}
+	if *out != "" && *dir != "" {
+		return fmt.Errorf("use either --out or --dir")
+	}
+
+	records, err := readStore()
+	if err != nil {
+		return err
+	}
+	var logs []zk.AttendanceRecord
+	for _, stored := range records {
+		// Sessions are kept by the day they start. The day before is read so a night shift's
+		// punch out isn't taken for a punch in, and the day after for punch outs.
+		day := recordDay(stored.Record)
+		if day >= addDays(from, -1) && day <= addDays(to, 1) && (len(wanted) == 0 || wanted[stored.Record.UserID]) {
+			logs = append(logs, stored.Record)
+		}
+	}
+	var sessions []attendanceSession
+	for _, s := range pairSessions(logs) {
+		if day := s.In.Format("2006-01-02"); day >= from && day <= to {
+			sessions = append(sessions, s)
+		}
+	}
+
+	title := fmt.Sprintf("Attendance %s", from)
+	if to != from {
+		title += " to " + to
+	}
+	if *dir == "" {
+		w := io.Writer(os.Stdout)
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := writeICS(w, title, sessions); err != nil {
+			return err
+		}
+		if *out != "" {
+			fmt.Fprintln(os.Stderr, tr("Exported %d session(s) to %s", len(sessions), *out))
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	byUser := map[int][]attendanceSession{}
+	var ids []int
+	for _, s := range sessions {
+		if byUser[s.UserID] == nil {
+			ids = append(ids, s.UserID)
+		}
+		byUser[s.UserID] = append(byUser[s.UserID], s)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		path := filepath.Join(*dir, fmt.Sprintf("employee-%d.ics", id))
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s, employee %d", title, id)
+		if n := byUser[id][0].Name; n != "" {
+			name = fmt.Sprintf("%s, %s", title, n)
+		}
+		err = writeICS(f, name, byUser[id])
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(os.Stderr, tr("Exported %d session(s) for %d employee(s) to %s", len(sessions), len(ids), *dir))
+	return nil
+}
+
+// addDays adds days to a YYYY-MM-DD date
+func addDays(day string, days int) string {
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return day
+	}
+	return t.AddDate(0, 0, days).Format("2006-01-02")
+}
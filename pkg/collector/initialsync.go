@@ -0,0 +1,255 @@
+package collector
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// History older than this needs confirmation on the first sync, unless INITIAL_SYNC_MAX_AGE overrides it
+const defaultInitialSyncMaxAge = 30 * 24 * time.Hour
+
+// Pause between backfill windows, giving the sinks and the link room for regular traffic
+const defaultBackfillPause = 30 * time.Second
+
+// logSummary describes a set of fetched records
+type logSummary struct {
+	Count     int
+	Oldest    string
+	Newest    string
+	PerDevice map[string]int
+}
+
+// summarizeLogs computes the count, date range, and per-device counts of logs
+func summarizeLogs(logs []zk.AttendanceRecord) logSummary {
+	summary := logSummary{Count: len(logs), PerDevice: map[string]int{}}
+	for _, record := range logs {
+		if summary.Oldest == "" || record.Timestamp < summary.Oldest {
+			summary.Oldest = record.Timestamp
+		}
+		if record.Timestamp > summary.Newest {
+			summary.Newest = record.Timestamp
+		}
+		summary.PerDevice[record.DeviceID]++
+	}
+	return summary
+}
+
+// printLogSummary logs a human-readable report of a summary
+func printLogSummary(summary logSummary) {
+	log.Printf("%d record(s) from %s to %s", summary.Count, summary.Oldest, summary.Newest)
+	devices := make([]string, 0, len(summary.PerDevice))
+	for device := range summary.PerDevice {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		log.Printf("- %s: %d record(s)", device, summary.PerDevice[device])
+	}
+}
+
+// splitByAge separates records newer than maxAge from older ones
+func splitByAge(logs []zk.AttendanceRecord, maxAge time.Duration, now time.Time) ([]zk.AttendanceRecord, []zk.AttendanceRecord) {
+	cutoff := now.Add(-maxAge)
+	var recent, old []zk.AttendanceRecord
+	for _, record := range logs {
+		if t, err := record.Time(); err == nil && t.Before(cutoff) {
+			old = append(old, record)
+		} else {
+			recent = append(recent, record)
+		}
+	}
+	return recent, old
+}
+
+// initialSyncMaxAge returns the age beyond which first-sync history needs confirmation
+func initialSyncMaxAge() time.Duration {
+	value := os.Getenv("INITIAL_SYNC_MAX_AGE")
+	if value == "" {
+		return defaultInitialSyncMaxAge
+	}
+	age, err := parseAge(value)
+	if err != nil {
+		log.Printf("Invalid INITIAL_SYNC_MAX_AGE, defaulting to %v: %v", defaultInitialSyncMaxAge, err)
+		return defaultInitialSyncMaxAge
+	}
+	return age
+}
+
+// holdInitialSync reports what a first sync would upload and returns true when it includes
+// history older than the threshold, in which case nothing is uploaded until an operator
+// runs the initial-sync command
+func holdInitialSync(logs []zk.AttendanceRecord) bool {
+	// Records below the date floor are never uploaded, so they don't need confirming
+	logs, _ = filterByMinRecordDate(logs)
+	maxAge := initialSyncMaxAge()
+	_, old := splitByAge(logs, maxAge, time.Now())
+	if len(old) == 0 {
+		return false
+	}
+
+	log.Println("Initial sync: no previous sync recorded, devices hold the following history:")
+	printLogSummary(summarizeLogs(logs))
+	log.Printf("%d record(s) are older than %v. Nothing was uploaded.", len(old), maxAge)
+	log.Println("Run \"initial-sync --max-age <age>\" to upload recent history only, or \"initial-sync --confirm\" to upload everything.")
+	return true
+}
+
+// runInitialSyncCommand reports the history on the devices and, when told how much of it
+// to keep, uploads it and records the sync so the scheduled sync continues from there
+func runInitialSyncCommand(args []string) error {
+	fs := flag.NewFlagSet("initial-sync", flag.ExitOnError)
+	maxAgeStr := fs.String("max-age", "", "only upload records newer than this age, e.g. 90d or 72h")
+	confirm := fs.Bool("confirm", false, "upload the full device history")
+	windowStr := fs.String("window", os.Getenv("BACKFILL_WINDOW"), "upload the history one window at a time, e.g. 1d or 6h")
+	pause := fs.Duration("pause", defaultBackfillPause, "pause between windows")
+	fs.Parse(args)
+
+	var maxAge time.Duration
+	if *maxAgeStr != "" {
+		age, err := parseAge(*maxAgeStr)
+		if err != nil {
+			return fmt.Errorf("invalid --max-age: %w", err)
+		}
+		maxAge = age
+	}
+	var window time.Duration
+	if *windowStr != "" {
+		w, err := parseAge(*windowStr)
+		if err != nil {
+			return fmt.Errorf("invalid --window: %w", err)
+		}
+		window = w
+	}
+
+	deviceIPs := os.Getenv("DEVICE_IPS")
+	apiURL := os.Getenv("API_URL")
+	orgID := os.Getenv("ORG_ID")
+	apiKey := os.Getenv("API_KEY")
+	if deviceIPs == "" || apiURL == "" || orgID == "" {
+		return configError("missing required environment variables (DEVICE_IPS, API_URL, ORG_ID)")
+	}
+
+	logs, fetchErr := fetchDeviceLogs(deviceIPs, time.Time{}, nil)
+	log.Println("Device history:")
+	printLogSummary(summarizeLogs(logs))
+
+	if maxAge > 0 {
+		recent, old := splitByAge(logs, maxAge, time.Now())
+		log.Printf("Skipping %d record(s) older than %v", len(old), maxAge)
+		logs = recent
+	} else if !*confirm {
+		log.Println("Dry run: pass --max-age <age> or --confirm to upload.")
+		return nil
+	}
+
+	windows := [][]zk.AttendanceRecord{logs}
+	if window > 0 {
+		windows = splitByWindow(logs, window)
+	}
+	for i, chunk := range windows {
+		if i > 0 {
+			time.Sleep(*pause)
+		}
+		if len(windows) > 1 {
+			summary := summarizeLogs(chunk)
+			log.Printf("Backfill window %d of %d: %d record(s) from %s to %s", i+1, len(windows), summary.Count, summary.Oldest, summary.Newest)
+		}
+		// Until the last window is stored the last check time stays short of the windows to
+		// come, so a scheduled sync after an interruption reads them
+		checked := time.Now()
+		if i < len(windows)-1 {
+			checked = backfillWatermark(windows[i+1:])
+		}
+		if !deliverRecords(chunk, orgID, apiURL, apiKey, nil, checked) {
+			return errors.New("failed to store fetched logs")
+		}
+		sinkPasses.Wait()
+	}
+	if fetchErr != nil {
+		return fetchErr
+	}
+	return lastSinkPassError()
+}
+
+// splitByWindow groups records into consecutive time windows, oldest first, leaving out
+// windows without records. Records with an unreadable time go in the last window.
+func splitByWindow(logs []zk.AttendanceRecord, window time.Duration) [][]zk.AttendanceRecord {
+	var timed, untimed []zk.AttendanceRecord
+	for _, record := range logs {
+		if _, err := record.Time(); err == nil {
+			timed = append(timed, record)
+		} else {
+			untimed = append(untimed, record)
+		}
+	}
+	sort.SliceStable(timed, func(i, j int) bool {
+		ti, _ := timed[i].Time()
+		tj, _ := timed[j].Time()
+		return ti.Before(tj)
+	})
+
+	var windows [][]zk.AttendanceRecord
+	var end time.Time
+	for _, record := range timed {
+		t, _ := record.Time()
+		if len(windows) == 0 || !t.Before(end) {
+			// Windows are aligned to the local midnight of the record's day
+			midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+			end = midnight.Add(t.Sub(midnight).Truncate(window) + window)
+			windows = append(windows, nil)
+		}
+		windows[len(windows)-1] = append(windows[len(windows)-1], record)
+	}
+	if len(untimed) > 0 {
+		if len(windows) == 0 {
+			windows = append(windows, nil)
+		}
+		windows[len(windows)-1] = append(windows[len(windows)-1], untimed...)
+	}
+	return windows
+}
+
+// backfillWatermark returns the last check time to keep while windows are still to be
+// stored: a second before their earliest punch, as reads take punches after the last check
+// time and timestamps have whole seconds. It is the previous last check time if any of them
+// has an unreadable time.
+func backfillWatermark(windows [][]zk.AttendanceRecord) time.Time {
+	var earliest time.Time
+	for _, chunk := range windows {
+		for _, record := range chunk {
+			t, err := record.Instant(deviceLocation(record.DeviceID))
+			if err != nil {
+				return getLastCheckTime()
+			}
+			if earliest.IsZero() || t.Before(earliest) {
+				earliest = t
+			}
+		}
+	}
+	return earliest.Add(-time.Second)
+}
+
+// parseAge parses an age given in days ("90d") or as a Go duration ("72h")
+func parseAge(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid age %q", value)
+	}
+	return age, nil
+}
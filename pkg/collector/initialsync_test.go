@@ -0,0 +1,85 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"old-attendance/pkg/zk"
+)
+
+func TestSplitByWindow(t *testing.T) {
+	records := []zk.AttendanceRecord{
+		{UserID: 1, Timestamp: "2024-03-02T09:00:00"},
+		{UserID: 2, Timestamp: "2024-03-01T08:00:00"},
+		{UserID: 3, Timestamp: "not a time"},
+		{UserID: 4, Timestamp: "2024-03-01T23:59:59"},
+		{UserID: 5, Timestamp: "2024-03-04T00:00:00"},
+	}
+	tests := []struct {
+		window time.Duration
+		want   [][]int
+	}{
+		{24 * time.Hour, [][]int{{2, 4}, {1}, {5, 3}}},
+		{12 * time.Hour, [][]int{{2}, {4}, {1}, {5, 3}}},
+		{7 * 24 * time.Hour, [][]int{{2, 4, 1, 5, 3}}},
+	}
+	for _, tt := range tests {
+		got := splitByWindow(records, tt.window)
+		if len(got) != len(tt.want) {
+			t.Errorf("splitByWindow(%v) gave %d windows, want %d", tt.window, len(got), len(tt.want))
+			continue
+		}
+		for i, chunk := range got {
+			var users []int
+			for _, record := range chunk {
+				users = append(users, record.UserID)
+			}
+			if !equalInts(users, tt.want[i]) {
+				t.Errorf("splitByWindow(%v) window %d = %v, want %v", tt.window, i, users, tt.want[i])
+			}
+		}
+	}
+	if got := splitByWindow(nil, time.Hour); len(got) != 0 {
+		t.Errorf("splitByWindow(nil) = %v, want no windows", got)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBackfillWatermark(t *testing.T) {
+	inStateDir(t)
+	t.Setenv("ZK_TIMEZONE", "UTC")
+	windows := [][]zk.AttendanceRecord{
+		{{DeviceID: "gate", Timestamp: "2024-03-02T09:00:00"}},
+		// A device in a zone of its own can have the earliest punch of a window
+		{{DeviceID: "gate", Timestamp: "2024-03-03T08:00:00"}, {DeviceID: "yard", Timestamp: "2024-03-02T23:00:00", UTCOffset: "-05:00"}},
+	}
+	want := time.Date(2024, 3, 2, 8, 59, 59, 0, time.UTC)
+	if got := backfillWatermark(windows); !got.Equal(want) {
+		t.Errorf("backfillWatermark = %v, want %v", got, want)
+	}
+	want = time.Date(2024, 3, 3, 3, 59, 59, 0, time.UTC)
+	if got := backfillWatermark(windows[1:]); !got.Equal(want) {
+		t.Errorf("backfillWatermark of the last window = %v, want %v", got, want)
+	}
+
+	// Without a readable time the last check time stays where it was
+	checked := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := saveLastCheckTime(checked); err != nil {
+		t.Fatal(err)
+	}
+	untimed := [][]zk.AttendanceRecord{{{DeviceID: "gate", Timestamp: "garbled"}}}
+	if got := backfillWatermark(untimed); !got.Equal(checked) {
+		t.Errorf("backfillWatermark with an unreadable time = %v, want %v", got, checked)
+	}
+}
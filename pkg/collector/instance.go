@@ -0,0 +1,44 @@
+package collector
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Loopback port held while the collector runs, unless INSTANCE_LOCK_PORT overrides it
+const defaultInstanceLockPort = "47370"
+
+// instanceLock is the lock this process holds, for releasing it ahead of a restart
+var instanceLock struct {
+	sync.Mutex
+	listener net.Listener
+}
+
+// acquireInstanceLock binds a loopback port so that only one collector runs at a time.
+// The OS releases the port when the process exits, even after a crash.
+func acquireInstanceLock() (net.Listener, error) {
+	port := os.Getenv("INSTANCE_LOCK_PORT")
+	if port == "" {
+		port = defaultInstanceLockPort
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		return nil, fmt.Errorf("another instance is already running (lock port 127.0.0.1:%s is in use): %w", port, err)
+	}
+	instanceLock.Lock()
+	instanceLock.listener = listener
+	instanceLock.Unlock()
+	return listener, nil
+}
+
+// releaseInstanceLock releases the lock this process holds, if any
+func releaseInstanceLock() {
+	instanceLock.Lock()
+	defer instanceLock.Unlock()
+	if instanceLock.listener != nil {
+		instanceLock.listener.Close()
+		instanceLock.listener = nil
+	}
+}
@@ -0,0 +1,292 @@
+package collector
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job groups. A group sets the priority of its jobs and how many of them may run at once.
+const (
+	jobGroupSync        = "sync"        // Attendance reads of the sync cycle
+	jobGroupMaintenance = "maintenance" // Device commands, maintenance and device control
+	jobGroupUserSync    = "user-sync"   // User list uploads
+	jobGroupBackfill    = "backfill"    // History reads and uploads of initial-sync
+	jobGroupReport      = "report"      // Digest, file drop, retention and statistics
+)
+
+// jobGroups holds each group's priority, higher first, and default limit of jobs running at
+// once, 0 leaving it to the worker count alone. JOB_CONCURRENCY overrides the limits.
+var jobGroups = map[string]struct{ priority, limit int }{
+	jobGroupSync:        {50, 0},
+	jobGroupMaintenance: {40, 0},
+	jobGroupUserSync:    {30, 2},
+	jobGroupBackfill:    {20, 0},
+	jobGroupReport:      {10, 1},
+}
+
+// job is a unit of work run by the job runner. A job holds the devices it names for as long as
+// it runs, so two jobs never talk to one terminal at once.
+type job struct {
+	group   string
+	name    string   // For the log, e.g. "read gate"
+	devices []string // Device IDs the job needs to itself
+	run     func() error
+
+	seq    int64 // Submission order, which breaks ties in priority
+	queued time.Time
+	done   chan error
+}
+
+// jobRunner runs jobs on a bounded number of workers: the highest-priority job whose devices
+// are free and whose group is under its limit goes first, then the oldest
+var jobRunner = struct {
+	sync.Mutex
+	once     sync.Once
+	idle     *sync.Cond
+	workers  int // JOB_WORKERS, or 0 to follow the devices configured
+	limits   map[string]int
+	seq      int64
+	pending  []*job
+	running  map[string]int    // Jobs running by group
+	busy     map[string]string // Device ID to the job holding it
+	paused   bool
+	finished map[string]map[bool]int // Jobs finished by group and whether they failed
+	// Worker count following the devices, and the DEVICE_IPS it was counted from
+	deviceWorkers int
+	deviceIPs     string
+}{running: map[string]int{}, busy: map[string]string{}, finished: map[string]map[bool]int{}}
+
+// startJobRunner reads JOB_WORKERS and JOB_CONCURRENCY. Workers default to the devices
+// configured plus two, see jobWorkersLocked.
+func startJobRunner() {
+	jobRunner.idle = sync.NewCond(&jobRunner.Mutex)
+	jobRunner.workers = parseCount("JOB_WORKERS", os.Getenv("JOB_WORKERS"))
+	jobRunner.limits = map[string]int{}
+	for group, g := range jobGroups {
+		jobRunner.limits[group] = g.limit
+	}
+	limits, err := parseJobConcurrency(os.Getenv("JOB_CONCURRENCY"))
+	if err != nil {
+		log.Printf("Ignoring JOB_CONCURRENCY: %v", err)
+	}
+	for group, limit := range limits {
+		jobRunner.limits[group] = limit
+	}
+}
+
+// jobWorkersLocked returns how many jobs may run at once: JOB_WORKERS, or else the devices
+// configured plus two, so every device can be read at once with room for other jobs. The count
+// follows devices added or removed since startup by discovery or remote configuration. The
+// caller holds jobRunner.
+func jobWorkersLocked() int {
+	if jobRunner.workers > 0 {
+		return jobRunner.workers
+	}
+	if ips := os.Getenv("DEVICE_IPS"); jobRunner.deviceWorkers == 0 || ips != jobRunner.deviceIPs {
+		workers := len(configuredDevices()) + 2
+		if jobRunner.deviceWorkers != 0 && workers != jobRunner.deviceWorkers {
+			log.Printf("Devices changed, running up to %d jobs at once", workers)
+		}
+		jobRunner.deviceWorkers, jobRunner.deviceIPs = workers, ips
+	}
+	return jobRunner.deviceWorkers
+}
+
+// parseJobConcurrency parses JOB_CONCURRENCY, comma-separated GROUP=LIMIT pairs
+func parseJobConcurrency(value string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, entry := range splitList(value) {
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%q is not GROUP=LIMIT", entry)
+		}
+		group := strings.TrimSpace(entry[:i])
+		if _, ok := jobGroups[group]; !ok {
+			return nil, fmt.Errorf("unknown job group %q, use sync, maintenance, user-sync, backfill or report", group)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit in %q", entry)
+		}
+		limits[group] = limit
+	}
+	return limits, nil
+}
+
+// submitJob queues a job and returns a channel receiving its error once it has run
+func submitJob(j *job) <-chan error {
+	jobRunner.once.Do(startJobRunner)
+	j.done = make(chan error, 1)
+	jobRunner.Lock()
+	defer jobRunner.Unlock()
+	jobRunner.seq++
+	j.seq = jobRunner.seq
+	j.queued = time.Now()
+	jobRunner.pending = append(jobRunner.pending, j)
+	dispatchJobsLocked()
+	return j.done
+}
+
+// runJob runs a job and waits for it
+func runJob(j *job) error {
+	return <-submitJob(j)
+}
+
+// dispatchJobsLocked starts the pending jobs that can run, best first; the caller holds jobRunner
+func dispatchJobsLocked() {
+	if jobRunner.paused {
+		return
+	}
+	sort.SliceStable(jobRunner.pending, func(a, b int) bool {
+		pa, pb := jobGroups[jobRunner.pending[a].group].priority, jobGroups[jobRunner.pending[b].group].priority
+		if pa != pb {
+			return pa > pb
+		}
+		return jobRunner.pending[a].seq < jobRunner.pending[b].seq
+	})
+	total, workers := jobsRunningLocked(), jobWorkersLocked()
+	kept := jobRunner.pending[:0]
+	for _, j := range jobRunner.pending {
+		if total >= workers || !jobRunnableLocked(j) {
+			kept = append(kept, j)
+			continue
+		}
+		jobRunner.running[j.group]++
+		for _, id := range j.devices {
+			jobRunner.busy[id] = j.name
+		}
+		total++
+		if wait := time.Since(j.queued); wait > time.Minute {
+			log.Printf("Job %s waited %v to start", j.name, wait.Round(time.Second))
+		}
+		go executeJob(j)
+	}
+	jobRunner.pending = kept
+}
+
+// jobRunnableLocked reports whether a job's group has room and its devices are free
+func jobRunnableLocked(j *job) bool {
+	if limit := jobRunner.limits[j.group]; limit > 0 && jobRunner.running[j.group] >= limit {
+		return false
+	}
+	for _, id := range j.devices {
+		if _, ok := jobRunner.busy[id]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// executeJob runs a job on a worker and hands its place to the next one
+func executeJob(j *job) {
+	// Jobs log their own failures; the error counts toward the metrics and goes to the submitter
+	err := j.run()
+	jobRunner.Lock()
+	jobRunner.running[j.group]--
+	for _, id := range j.devices {
+		delete(jobRunner.busy, id)
+	}
+	if jobRunner.finished[j.group] == nil {
+		jobRunner.finished[j.group] = map[bool]int{}
+	}
+	jobRunner.finished[j.group][err != nil]++
+	dispatchJobsLocked()
+	jobRunner.idle.Broadcast()
+	jobRunner.Unlock()
+	j.done <- err
+}
+
+// allDeviceIDs returns the IDs of every configured device, for jobs that may touch any of them
+func allDeviceIDs() []string {
+	var ids []string
+	for _, device := range configuredDevices() {
+		ids = append(ids, device.ID)
+	}
+	return ids
+}
+
+// waitJobs waits until no job is queued or running, for one-off commands to finish the jobs
+// they started before exiting
+func waitJobs() {
+	jobRunner.once.Do(startJobRunner)
+	jobRunner.Lock()
+	defer jobRunner.Unlock()
+	for len(jobRunner.pending) > 0 || jobsRunningLocked() > 0 {
+		jobRunner.idle.Wait()
+	}
+}
+
+// pauseJobs stops starting jobs and waits for those running to finish. Queued jobs wait for
+// resumeJobs.
+func pauseJobs() {
+	jobRunner.once.Do(startJobRunner)
+	jobRunner.Lock()
+	defer jobRunner.Unlock()
+	jobRunner.paused = true
+	for jobsRunningLocked() > 0 {
+		jobRunner.idle.Wait()
+	}
+}
+
+// resumeJobs starts jobs again after pauseJobs
+func resumeJobs() {
+	jobRunner.Lock()
+	defer jobRunner.Unlock()
+	jobRunner.paused = false
+	dispatchJobsLocked()
+}
+
+// jobsRunningLocked counts the jobs running; the caller holds jobRunner
+func jobsRunningLocked() int {
+	total := 0
+	for _, n := range jobRunner.running {
+		total += n
+	}
+	return total
+}
+
+// writeJobMetrics writes the jobs queued, running and finished per group
+func writeJobMetrics(w io.Writer) {
+	jobRunner.Lock()
+	defer jobRunner.Unlock()
+	if jobRunner.seq == 0 {
+		return
+	}
+	groups := make([]string, 0, len(jobGroups))
+	for group := range jobGroups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	queued := map[string]int{}
+	for _, j := range jobRunner.pending {
+		queued[j.group]++
+	}
+	fmt.Fprintln(w, "# HELP attendance_jobs_queued Jobs waiting for a worker, their devices or room in their group.")
+	fmt.Fprintln(w, "# TYPE attendance_jobs_queued gauge")
+	for _, group := range groups {
+		fmt.Fprintf(w, "attendance_jobs_queued{%s} %d\n", tenantLabel(fmt.Sprintf("group=%q", group)), queued[group])
+	}
+	fmt.Fprintln(w, "# HELP attendance_jobs_running Jobs running.")
+	fmt.Fprintln(w, "# TYPE attendance_jobs_running gauge")
+	for _, group := range groups {
+		fmt.Fprintf(w, "attendance_jobs_running{%s} %d\n", tenantLabel(fmt.Sprintf("group=%q", group)), jobRunner.running[group])
+	}
+	fmt.Fprintln(w, "# HELP attendance_jobs_finished_total Jobs finished, by whether they failed.")
+	fmt.Fprintln(w, "# TYPE attendance_jobs_finished_total counter")
+	for _, group := range groups {
+		for _, failed := range []bool{false, true} {
+			outcome := "ok"
+			if failed {
+				outcome = "error"
+			}
+			fmt.Fprintf(w, "attendance_jobs_finished_total{%s} %d\n", tenantLabel(fmt.Sprintf("group=%q,outcome=%q", group, outcome)), jobRunner.finished[group][failed])
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package collector
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// withJobWorkers runs a test with the job runner at a fixed number of workers
+func withJobWorkers(t *testing.T, workers int) {
+	t.Helper()
+	jobRunner.once.Do(startJobRunner)
+	jobRunner.Lock()
+	saved := jobRunner.workers
+	jobRunner.workers = workers
+	jobRunner.Unlock()
+	t.Cleanup(func() {
+		waitJobs()
+		jobRunner.Lock()
+		jobRunner.workers = saved
+		jobRunner.Unlock()
+	})
+}
+
+// overlapCounter tracks how many jobs run at once
+type overlapCounter struct {
+	sync.Mutex
+	running, most int
+}
+
+// job returns a job in group on devices that counts itself while it runs
+func (c *overlapCounter) job(group string, devices ...string) *job {
+	return &job{group: group, name: "test", devices: devices, run: func() error {
+		c.Lock()
+		c.running++
+		if c.running > c.most {
+			c.most = c.running
+		}
+		c.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		c.Lock()
+		c.running--
+		c.Unlock()
+		return nil
+	}}
+}
+
+func TestParseJobConcurrency(t *testing.T) {
+	limits, err := parseJobConcurrency(" sync=4, report = 0,user-sync=1,, ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{jobGroupSync: 4, jobGroupReport: 0, jobGroupUserSync: 1}
+	if len(limits) != len(want) {
+		t.Errorf("limits = %v, want %v", limits, want)
+	}
+	for group, limit := range want {
+		if got, ok := limits[group]; !ok || got != limit {
+			t.Errorf("limit of %s = %d, want %d", group, got, limit)
+		}
+	}
+
+	if limits, err := parseJobConcurrency(""); err != nil || len(limits) != 0 {
+		t.Errorf("parseJobConcurrency(\"\") = %v, %v, want no limits", limits, err)
+	}
+	if limits, err := parseJobConcurrency("backfill=1,backfill=3"); err != nil || limits[jobGroupBackfill] != 3 {
+		t.Errorf("repeated group gave %v, %v, want the last limit", limits, err)
+	}
+
+	for _, value := range []string{"sync", "sync:2", "=2", "imports=2", "Sync=2", "sync=", "sync=two", "sync=-1", "sync=2,report"} {
+		if _, err := parseJobConcurrency(value); err == nil {
+			t.Errorf("parseJobConcurrency(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestJobsOnOneDeviceDoNotOverlap(t *testing.T) {
+	withJobWorkers(t, 8)
+	var gate overlapCounter
+	var done []<-chan error
+	for i := 0; i < 10; i++ {
+		group := jobGroupSync
+		if i%2 == 1 {
+			group = jobGroupMaintenance
+		}
+		done = append(done, submitJob(gate.job(group, "gate")))
+	}
+	for _, d := range done {
+		<-d
+	}
+	if gate.most != 1 {
+		t.Errorf("%d jobs ran on one device at once, want 1", gate.most)
+	}
+}
+
+func TestJobsOnOtherDevicesOverlap(t *testing.T) {
+	withJobWorkers(t, 8)
+	started := make(chan struct{})
+	first := submitJob(&job{group: jobGroupSync, name: "read gate", devices: []string{"gate"}, run: func() error {
+		select {
+		case <-started:
+			return nil
+		case <-time.After(5 * time.Second):
+			t.Error("job on another device did not start while the first ran")
+			return nil
+		}
+	}})
+	runJob(&job{group: jobGroupSync, name: "read lobby", devices: []string{"lobby"}, run: func() error {
+		close(started)
+		return nil
+	}})
+	<-first
+}
+
+func TestJobGroupLimit(t *testing.T) {
+	withJobWorkers(t, 8)
+	var reports overlapCounter
+	var done []<-chan error
+	for i := 0; i < 5; i++ {
+		done = append(done, submitJob(reports.job(jobGroupReport)))
+	}
+	for _, d := range done {
+		<-d
+	}
+	if reports.most != jobGroups[jobGroupReport].limit {
+		t.Errorf("%d report jobs ran at once, want %d", reports.most, jobGroups[jobGroupReport].limit)
+	}
+}
+
+func TestJobPriority(t *testing.T) {
+	withJobWorkers(t, 1)
+	var mu sync.Mutex
+	var order []string
+	record := func(name, group string) *job {
+		return &job{group: group, name: name, run: func() error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}}
+	}
+
+	pauseJobs()
+	var done []<-chan error
+	for _, j := range []*job{
+		record("report", jobGroupReport),
+		record("backfill", jobGroupBackfill),
+		record("users", jobGroupUserSync),
+		record("command", jobGroupMaintenance),
+		record("read 1", jobGroupSync),
+		record("read 2", jobGroupSync),
+	} {
+		done = append(done, submitJob(j))
+	}
+	resumeJobs()
+	for _, d := range done {
+		<-d
+	}
+	want := []string{"read 1", "read 2", "command", "users", "backfill", "report"}
+	if !equalStrings(order, want) {
+		t.Errorf("jobs ran in order %v, want %v", order, want)
+	}
+}
+
+func TestJobWorkersFollowDevices(t *testing.T) {
+	withJobWorkers(t, 0)
+	t.Setenv("DEVICE_IPS", "gate=10.0.0.1:4370")
+	jobRunner.Lock()
+	defer jobRunner.Unlock()
+	if n := jobWorkersLocked(); n != 3 {
+		t.Errorf("workers = %d for one device, want 3", n)
+	}
+	t.Setenv("DEVICE_IPS", "gate=10.0.0.1:4370,lobby=10.0.0.2:4370,dock=10.0.0.3:4370")
+	if n := jobWorkersLocked(); n != 5 {
+		t.Errorf("workers = %d after devices were added, want 5", n)
+	}
+	jobRunner.workers = 2
+	if n := jobWorkersLocked(); n != 2 {
+		t.Errorf("workers = %d with JOB_WORKERS=2, want 2", n)
+	}
+}
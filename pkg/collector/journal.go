@@ -0,0 +1,185 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"sync"
+	"time"
+)
+
+// State key of the journal of records read from the devices and not yet in the record store
+const fetchJournalFile = "fetch_journal.jsonl"
+
+// journalEntry is one line of the fetch journal: a record as the device gave it, before the
+// roster, shifts, dedup or anything else has touched it
+type journalEntry struct {
+	SyncID    string              `json:"sync_id"`
+	DeviceID  string              `json:"device_id"`
+	FetchedAt string              `json:"fetched_at"`
+	Record    zk.AttendanceRecord `json:"record"`
+}
+
+// journalMu serializes this process's changes to the journal
+var journalMu sync.Mutex
+
+// journalFetched appends the records read from a device to the fetch journal, synced to disk
+// before it returns, so a crash between the read and the record store can't lose them even
+// where the device is cleared after reading or a watermark has moved past them
+func journalFetched(syncID, deviceID string, logs []zk.AttendanceRecord) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	fetchedAt := time.Now().Format(time.RFC3339)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range logs {
+		if err := enc.Encode(journalEntry{SyncID: syncID, DeviceID: deviceID, FetchedAt: fetchedAt, Record: record}); err != nil {
+			return fmt.Errorf("failed to encode journal entry: %w", err)
+		}
+	}
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	data, err := state().Get(fetchJournalFile)
+	if err != nil {
+		return fmt.Errorf("failed to read fetch journal: %w", err)
+	}
+	if _, err := cutTornLine(fetchJournalFile, data); err != nil {
+		return err
+	}
+	if err := state().Append(fetchJournalFile, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write fetch journal: %w", err)
+	}
+	return nil
+}
+
+// readJournalLocked reads the fetch journal; the caller holds journalMu
+func readJournalLocked() ([]journalEntry, error) {
+	data, err := state().Get(fetchJournalFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fetch journal: %w", err)
+	}
+	var entries []journalEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final line from a crash mid-write, cut off by the next append; the
+			// batch it belonged to wasn't synced, so its device was never marked read
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// pendingJournal returns the records journaled by sync cycles other than syncID that never
+// reached the record store, with the IDs of every such cycle. A cycle that crashed after
+// storing its batch but before clearing its entries is recognized by its records in the
+// store, so they aren't stored twice.
+func pendingJournal(syncID string) ([]zk.AttendanceRecord, []string) {
+	journalMu.Lock()
+	entries, err := readJournalLocked()
+	journalMu.Unlock()
+	if err != nil {
+		log.Printf("Error reading fetch journal: %v", err)
+		return nil, nil
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	records, err := readStore()
+	if err != nil {
+		log.Printf("Error reading record store: %v", err)
+		return nil, nil
+	}
+	stored := map[string]bool{}
+	for _, record := range records {
+		stored[record.SyncID] = true
+	}
+
+	var logs []zk.AttendanceRecord
+	var syncIDs []string
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if entry.SyncID == syncID {
+			continue
+		}
+		if !seen[entry.SyncID] {
+			seen[entry.SyncID] = true
+			syncIDs = append(syncIDs, entry.SyncID)
+		}
+		if !stored[entry.SyncID] {
+			logs = append(logs, entry.Record)
+		}
+	}
+	return logs, syncIDs
+}
+
+// mergeJournaled adds journaled records to those read this cycle, leaving out the ones read
+// again because their device's watermark never moved past them
+func mergeJournaled(fetched, journaled []zk.AttendanceRecord) []zk.AttendanceRecord {
+	read := map[string]int{}
+	for _, r := range fetched {
+		read[journalKey(r)]++
+	}
+	for _, r := range journaled {
+		key := journalKey(r)
+		if read[key] > 0 {
+			read[key]--
+			continue
+		}
+		fetched = append(fetched, r)
+	}
+	return fetched
+}
+
+// journalKey identifies a punch on its device, by the time the terminal recorded so a clock
+// correction measured differently on the second read still matches
+func journalKey(r zk.AttendanceRecord) string {
+	t := r.DeviceTime
+	if t == "" {
+		t = r.Timestamp
+	}
+	return fmt.Sprintf("%s|%d|%s", r.DeviceID, r.UserID, t)
+}
+
+// commitJournal removes the entries of the given sync cycles from the fetch journal, once
+// their records are in the record store or were deliberately held back on the devices
+func commitJournal(syncIDs []string) {
+	done := map[string]bool{}
+	for _, id := range syncIDs {
+		done[id] = true
+	}
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	entries, err := readJournalLocked()
+	if err != nil {
+		log.Printf("Error clearing fetch journal: %v", err)
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	kept := 0
+	for _, entry := range entries {
+		if !done[entry.SyncID] {
+			enc.Encode(entry)
+			kept++
+		}
+	}
+	if kept == len(entries) {
+		return
+	}
+	if kept == 0 {
+		err = state().Delete(fetchJournalFile)
+	} else {
+		err = state().Put(fetchJournalFile, buf.Bytes())
+	}
+	if err != nil {
+		log.Printf("Error clearing fetch journal: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package collector
+
+import (
+	"os"
+	"testing"
+
+	"old-attendance/pkg/zk"
+)
+
+func TestJournalFetchedAfterTornLine(t *testing.T) {
+	inStateDir(t)
+	whole := `{"sync_id":"sync-1","device_id":"gate","fetched_at":"2024-03-01T09:00:00Z","record":{"employee_id":1,"timestamp":"2024-03-01T08:59:00"}}` + "\n"
+	torn := `{"sync_id":"sync-1","device_id":"gate","fetch`
+	if err := os.WriteFile(fetchJournalFile, []byte(whole+torn), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logs := []zk.AttendanceRecord{
+		{UserID: 2, Timestamp: "2024-03-01T09:05:00", DeviceID: "gate"},
+		{UserID: 3, Timestamp: "2024-03-01T09:06:00", DeviceID: "gate"},
+	}
+	if err := journalFetched("sync-2", "gate", logs); err != nil {
+		t.Fatal(err)
+	}
+	pending, syncIDs := pendingJournal("sync-3")
+	var users []int
+	for _, r := range pending {
+		users = append(users, r.UserID)
+	}
+	if !equalInts(users, []int{1, 2, 3}) {
+		t.Errorf("journaled users %v, want 1 and both appended", users)
+	}
+	if !equalStrings(syncIDs, []string{"sync-1", "sync-2"}) {
+		t.Errorf("journaled cycles %v, want sync-1 and sync-2", syncIDs)
+	}
+}
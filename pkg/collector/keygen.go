@@ -0,0 +1,26 @@
+package collector
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"old-attendance/pkg/sink"
+)
+
+// runKeygenCommand creates a signing key pair. The seed goes into SIGNING_KEY (or a file
+// referenced by SIGNING_KEY_FILE) and the public key is registered with the backend.
+func runKeygenCommand(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: keygen")
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	fmt.Printf("SIGNING_KEY=%s\n", base64.StdEncoding.EncodeToString(priv.Seed()))
+	fmt.Println(tr("Public key (register with the backend): %s", base64.StdEncoding.EncodeToString(pub)))
+	fmt.Println(tr("Key ID: %s", sink.SigningKeyID(pub)))
+	return nil
+}
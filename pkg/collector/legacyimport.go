@@ -0,0 +1,470 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"old-attendance/pkg/zk"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// legacyTable is a table read from an export of ZKTeco's desktop software
+type legacyTable struct {
+	name    string
+	columns map[string]int // Lower-case column name to index
+	rows    [][]string
+}
+
+// value returns a row's value in a column, or "" when the table has no such column
+func (t legacyTable) value(row []string, column string) string {
+	i, ok := t.columns[column]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// has reports whether the table has all the columns
+func (t legacyTable) has(columns ...string) bool {
+	for _, column := range columns {
+		if _, ok := t.columns[column]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func newLegacyTable(name string, columns []string) legacyTable {
+	t := legacyTable{name: name, columns: map[string]int{}}
+	for i, column := range columns {
+		column = strings.Trim(strings.TrimSpace(column), "`\"[]")
+		t.columns[strings.ToLower(column)] = i
+	}
+	return t
+}
+
+// readLegacyCSV reads a CSV export with a header line, as written by mdb-export or the
+// export of BioTime's transaction list. Semicolon-separated files are accepted too.
+func readLegacyCSV(data []byte) ([]legacyTable, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	r := csv.NewReader(bytes.NewReader(data))
+	header := string(data)
+	if i := strings.IndexByte(header, '\n'); i >= 0 {
+		header = header[:i]
+	}
+	if strings.Count(header, ";") > strings.Count(header, ",") {
+		r.Comma = ';'
+	}
+	r.FieldsPerRecord = -1
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("empty file")
+	}
+	t := newLegacyTable("", lines[0])
+	t.rows = lines[1:]
+	return []legacyTable{t}, nil
+}
+
+// readLegacySQL reads the INSERT statements of an SQL dump, such as mdb-export -I of a
+// ZKTime database or a MySQL or SQL Server dump of BioTime, and the COPY blocks of a
+// PostgreSQL dump. Statements without a column list are skipped, as their columns are
+// unknown.
+func readLegacySQL(data []byte) ([]legacyTable, error) {
+	tables := map[string]*legacyTable{}
+	var order []string
+	add := func(name string, columns []string, rows [][]string) {
+		key := strings.ToLower(name)
+		t, ok := tables[key]
+		if !ok {
+			nt := newLegacyTable(name, columns)
+			t = &nt
+			tables[key] = t
+			order = append(order, key)
+		}
+		// Rows are stored in the column order of the table's first statement
+		for _, row := range rows {
+			mapped := make([]string, len(t.columns))
+			for i, column := range columns {
+				if j, ok := t.columns[strings.ToLower(strings.Trim(strings.TrimSpace(column), "`\"[]"))]; ok && i < len(row) {
+					mapped[j] = row[i]
+				}
+			}
+			t.rows = append(t.rows, mapped)
+		}
+	}
+
+	// Statements start on a line of their own, so a newline is prepended for the first one
+	s := "\n" + string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	upper := asciiUpper(s)
+	skipped := 0
+	for at := 0; ; {
+		insert := strings.Index(upper[at:], "\nINSERT ")
+		copyAt := strings.Index(upper[at:], "\nCOPY ")
+		if insert < 0 && copyAt < 0 {
+			break
+		}
+		var rest string
+		switch {
+		case copyAt >= 0 && (insert < 0 || copyAt < insert):
+			name, columns, rows, r, err := parseCopyBlock(s[at+copyAt+1:])
+			if err != nil {
+				return nil, err
+			}
+			if columns != nil {
+				add(name, columns, rows)
+			}
+			rest = r
+		default:
+			name, columns, rows, r, err := parseInsert(s[at+insert+len("\nINSERT "):])
+			if err != nil {
+				return nil, err
+			}
+			if columns == nil {
+				skipped++
+			} else {
+				add(name, columns, rows)
+			}
+			rest = r
+		}
+		// Step back onto the newline ending the statement, so one on the next line is found
+		at = len(s) - len(rest)
+		if at > 0 && s[at-1] == '\n' {
+			at--
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d INSERT statement(s) without a column list", skipped)
+	}
+	var result []legacyTable
+	for _, key := range order {
+		result = append(result, *tables[key])
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no INSERT or COPY statements found")
+	}
+	return result, nil
+}
+
+// parseInsert parses an INSERT statement after INSERT, returning the rest of the dump. SQL
+// Server scripts leave out INTO.
+func parseInsert(s string) (name string, columns []string, rows [][]string, rest string, err error) {
+	s = strings.TrimLeft(s, " \t\r\n")
+	if hasPrefixFold(s, "INTO ") {
+		s = strings.TrimLeft(s[5:], " \t\r\n")
+	}
+	end := strings.IndexAny(s, " \t\r\n(")
+	if end < 0 {
+		return "", nil, nil, "", errors.New("truncated INSERT statement")
+	}
+	name = tableName(s[:end])
+	s = strings.TrimLeft(s[end:], " \t\r\n")
+	if strings.HasPrefix(s, "(") {
+		closing := strings.IndexByte(s, ')')
+		if closing < 0 {
+			return "", nil, nil, "", fmt.Errorf("truncated column list of INSERT INTO %s", name)
+		}
+		columns = strings.Split(s[1:closing], ",")
+		s = strings.TrimLeft(s[closing+1:], " \t\r\n")
+	}
+	if !hasPrefixFold(s, "VALUES") {
+		return "", nil, nil, "", fmt.Errorf("INSERT INTO %s: expected VALUES", name)
+	}
+	s = s[len("VALUES"):]
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "(") {
+			return "", nil, nil, "", fmt.Errorf("INSERT INTO %s: expected a row of values", name)
+		}
+		var row []string
+		row, s, err = parseSQLTuple(s[1:])
+		if err != nil {
+			return "", nil, nil, "", fmt.Errorf("INSERT INTO %s: %w", name, err)
+		}
+		rows = append(rows, row)
+		s = strings.TrimLeft(s, " \t\r\n")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+			continue
+		}
+		s = strings.TrimPrefix(s, ";")
+		return name, columns, rows, s, nil
+	}
+}
+
+// parseSQLTuple parses the values of a row after its opening parenthesis
+func parseSQLTuple(s string) (values []string, rest string, err error) {
+	for {
+		var value string
+		value, s, err = parseSQLValue(s)
+		if err != nil {
+			return nil, "", err
+		}
+		values = append(values, value)
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			return nil, "", errors.New("truncated row of values")
+		}
+		if s[0] == ')' {
+			return values, s[1:], nil
+		}
+		if s[0] != ',' {
+			return nil, "", fmt.Errorf("unexpected %q in row of values", s[0])
+		}
+		s = s[1:]
+	}
+}
+
+// parseSQLValue parses a value in a row. Strings are quoted with single quotes, doubled or
+// backslash-escaped; Access dates with # signs; SQL Server scripts wrap dates in CAST.
+func parseSQLValue(s string) (value, rest string, err error) {
+	s = strings.TrimLeft(s, " \t\r\n")
+	if s == "" {
+		return "", "", errors.New("truncated row of values")
+	}
+	if hasPrefixFold(s, "CAST(") {
+		value, s, err = parseSQLValue(s[5:])
+		if err != nil {
+			return "", "", err
+		}
+		closing := strings.IndexByte(s, ')')
+		if closing < 0 {
+			return "", "", errors.New("unterminated CAST")
+		}
+		return value, s[closing+1:], nil
+	}
+	if strings.HasPrefix(s, "N'") {
+		s = s[1:]
+	}
+	switch s[0] {
+	case '\'':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && i+1 < len(s):
+				i++
+				b.WriteByte(s[i])
+			case s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'':
+				b.WriteByte('\'')
+				i++
+			case s[i] == '\'':
+				return b.String(), s[i+1:], nil
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	case '#':
+		closing := strings.IndexByte(s[1:], '#')
+		if closing < 0 {
+			return "", "", errors.New("unterminated date")
+		}
+		return s[1 : closing+1], s[closing+2:], nil
+	}
+	end := strings.IndexAny(s, ",)")
+	if end < 0 {
+		return "", "", errors.New("truncated row of values")
+	}
+	value = strings.TrimSpace(s[:end])
+	if strings.EqualFold(value, "NULL") {
+		value = ""
+	}
+	return value, s[end:], nil
+}
+
+// parseCopyBlock parses a PostgreSQL COPY ... FROM stdin block: tab-separated rows ending
+// with a line holding \.
+func parseCopyBlock(s string) (name string, columns []string, rows [][]string, rest string, err error) {
+	end := strings.IndexByte(s, '\n')
+	if end < 0 {
+		return "", nil, nil, "", errors.New("truncated COPY statement")
+	}
+	statement, body := strings.TrimSpace(s[:end]), s[end+1:]
+	open, closing := strings.IndexByte(statement, '('), strings.IndexByte(statement, ')')
+	if open < 0 || closing < open || !strings.Contains(strings.ToUpper(statement), "FROM STDIN") {
+		// A COPY from a file; its rows aren't in the dump
+		return "", nil, nil, body, nil
+	}
+	name = tableName(strings.TrimSpace(statement[len("COPY "):open]))
+	columns = strings.Split(statement[open+1:closing], ",")
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	consumed := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		consumed += len(line) + 1
+		if line == `\.` {
+			if consumed > len(body) {
+				consumed = len(body)
+			}
+			return name, columns, rows, body[consumed:], nil
+		}
+		fields := strings.Split(strings.TrimSuffix(line, "\r"), "\t")
+		for i, field := range fields {
+			if field == `\N` {
+				fields[i] = ""
+			}
+		}
+		rows = append(rows, fields)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, nil, "", err
+	}
+	return "", nil, nil, "", fmt.Errorf("COPY %s: missing end of data", name)
+}
+
+// asciiUpper upper-cases the ASCII letters of s, keeping byte offsets the same
+func asciiUpper(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return string(b)
+}
+
+// hasPrefixFold reports whether s begins with prefix, ignoring case
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// tableName strips the schema and quoting from a table name
+func tableName(s string) string {
+	if i := strings.LastIndexByte(s, '.'); i >= 0 {
+		s = s[i+1:]
+	}
+	return strings.Trim(s, "`\"[]")
+}
+
+// Time layouts of the desktop software's exports and of mdb-export
+var legacyTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05-07",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05-07:00",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"01/02/06 15:04:05",
+	"01/02/2006 15:04:05",
+	"1/2/2006 15:04:05",
+	"1/2/2006 3:04:05 PM",
+	"2006/01/02 15:04:05",
+}
+
+// parseLegacyTime parses a punch time, keeping the wall-clock time where it has an offset
+func parseLegacyTime(s string) (string, error) {
+	for _, layout := range legacyTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format(zk.TimestampLayout), nil
+		}
+	}
+	return "", fmt.Errorf("unrecognized time %q", s)
+}
+
+// legacyPunch is a punch read from a desktop software export, with the terminal it was
+// made on as the software knows it
+type legacyPunch struct {
+	record   zk.AttendanceRecord
+	terminal string // Serial number, or the machine number with a "#" prefix
+}
+
+// legacyPunches extracts the punches from the tables of an export: ZKTime's CHECKINOUT,
+// whose USERID is mapped to the badge number enrolled on the terminals through USERINFO,
+// or BioTime's iclock_transaction. users holds USERINFO tables from a separate export.
+func legacyPunches(tables, users []legacyTable) ([]legacyPunch, error) {
+	badges := map[string]int{}
+	for _, t := range append(append([]legacyTable(nil), tables...), users...) {
+		if !t.has("userid", "badgenumber") {
+			continue
+		}
+		for _, row := range t.rows {
+			if badge, err := strconv.Atoi(t.value(row, "badgenumber")); err == nil {
+				badges[t.value(row, "userid")] = badge
+			}
+		}
+	}
+
+	var punches []legacyPunch
+	found := false
+	for _, t := range tables {
+		switch {
+		case t.has("userid", "checktime"):
+			found = true
+			if len(badges) == 0 {
+				return nil, errors.New("CHECKINOUT needs the USERINFO table to map users to badge numbers; pass it with --users")
+			}
+			for i, row := range t.rows {
+				badge, ok := badges[t.value(row, "userid")]
+				if !ok {
+					return nil, fmt.Errorf("CHECKINOUT row %d: USERID %q is not in USERINFO", i+1, t.value(row, "userid"))
+				}
+				p, err := newLegacyPunch(badge, t.value(row, "checktime"), t.value(row, "verifycode"))
+				if err != nil {
+					return nil, fmt.Errorf("CHECKINOUT row %d: %w", i+1, err)
+				}
+				if sn := t.value(row, "sn"); sn != "" {
+					p.terminal = sn
+				} else if sensor := t.value(row, "sensorid"); sensor != "" {
+					p.terminal = "#" + sensor
+				}
+				punches = append(punches, p)
+			}
+		case t.has("emp_code", "punch_time"):
+			found = true
+			for i, row := range t.rows {
+				userID, err := strconv.Atoi(t.value(row, "emp_code"))
+				if err != nil {
+					return nil, fmt.Errorf("%s row %d: invalid emp_code %q", t.name, i+1, t.value(row, "emp_code"))
+				}
+				p, err := newLegacyPunch(userID, t.value(row, "punch_time"), t.value(row, "verify_type"))
+				if err != nil {
+					return nil, fmt.Errorf("%s row %d: %w", t.name, i+1, err)
+				}
+				p.terminal = t.value(row, "terminal_sn")
+				punches = append(punches, p)
+			}
+		}
+	}
+	if !found {
+		return nil, errors.New("no attendance table found: expected ZKTime's CHECKINOUT (USERID, CHECKTIME) or BioTime's iclock_transaction (emp_code, punch_time)")
+	}
+	return punches, nil
+}
+
+func newLegacyPunch(userID int, checkTime, verifyCode string) (legacyPunch, error) {
+	timestamp, err := parseLegacyTime(checkTime)
+	if err != nil {
+		return legacyPunch{}, err
+	}
+	p := legacyPunch{record: zk.AttendanceRecord{UserID: userID, Timestamp: timestamp}}
+	if code, err := strconv.Atoi(verifyCode); err == nil {
+		p.record.Modality = zk.VerifyModality(code)
+	}
+	return p, nil
+}
+
+// readLegacyExport reads a CSV export or SQL dump, telling them apart by their content
+func readLegacyExport(r io.Reader) ([]legacyTable, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	upper := asciiUpper("\n" + string(data))
+	if strings.Contains(upper, "\nINSERT ") || strings.Contains(upper, "\nCOPY ") {
+		return readLegacySQL(data)
+	}
+	return readLegacyCSV(data)
+}
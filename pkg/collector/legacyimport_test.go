@@ -0,0 +1,306 @@
+package collector
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"old-attendance/pkg/zk"
+)
+
+func TestParseSQLValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		wantValue string
+		wantRest  string
+		wantErr   bool
+	}{
+		{"number", "42, 'x')", "42", ", 'x')", false},
+		{"last value", " 42 )", "42", ")", false},
+		{"null", "NULL,1)", "", ",1)", false},
+		{"null lower case", "null)", "", ")", false},
+		{"string", "'Ada',1)", "Ada", ",1)", false},
+		{"doubled quote", "'O''Brien')", "O'Brien", ")", false},
+		{"backslash escape", `'O\'Brien')`, "O'Brien", ")", false},
+		{"string with separators", "'a, b)')", "a, b)", ")", false},
+		{"national string", "N'Zoë')", "Zoë", ")", false},
+		{"access date", "#03/01/2024 08:00:00#,1)", "03/01/2024 08:00:00", ",1)", false},
+		{"sql server cast", "CAST(N'2024-03-01T08:00:00.000' AS DateTime), 1)", "2024-03-01T08:00:00.000", ", 1)", false},
+		{"empty", "  ", "", "", true},
+		{"unterminated string", "'Ada", "", "", true},
+		{"unterminated date", "#03/01/2024", "", "", true},
+		{"unterminated cast", "CAST('2024-03-01' AS DateTime", "", "", true},
+		{"no end of row", "42", "", "", true},
+	}
+	for _, tt := range tests {
+		value, rest, err := parseSQLValue(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseSQLValue(%q) error = %v, want error %v", tt.name, tt.in, err, tt.wantErr)
+			continue
+		}
+		if value != tt.wantValue || rest != tt.wantRest {
+			t.Errorf("%s: parseSQLValue(%q) = %q, %q, want %q, %q", tt.name, tt.in, value, rest, tt.wantValue, tt.wantRest)
+		}
+	}
+}
+
+func TestParseLegacyTime(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"2024-03-01 08:00:00", "2024-03-01T08:00:00", false},
+		{"2024-03-01 08:00:00.123", "2024-03-01T08:00:00", false},
+		{"2024-03-01 08:00:00+06", "2024-03-01T08:00:00", false},
+		{"2024-03-01 08:00:00.5+06:00", "2024-03-01T08:00:00", false},
+		{"2024-03-01T08:00:00", "2024-03-01T08:00:00", false},
+		{"2024-03-01 08:00", "2024-03-01T08:00:00", false},
+		{"03/01/24 08:00:00", "2024-03-01T08:00:00", false},
+		{"03/01/2024 08:00:00", "2024-03-01T08:00:00", false},
+		{"3/1/2024 8:00:00", "2024-03-01T08:00:00", false},
+		{"3/1/2024 8:00:00 PM", "2024-03-01T20:00:00", false},
+		{"2024/03/01 08:00:00", "2024-03-01T08:00:00", false},
+		{"", "", true},
+		{"2024-03-01", "", true},
+		{"2024-13-01 08:00:00", "", true},
+		{"yesterday", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseLegacyTime(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLegacyTime(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseLegacyTime(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// legacyRows flattens the tables of an export to "table: v1|v2|..." lines, with the values
+// in the order of the columns named
+func legacyRows(tables []legacyTable, columns ...string) []string {
+	var lines []string
+	for _, t := range tables {
+		for _, row := range t.rows {
+			values := make([]string, len(columns))
+			for i, column := range columns {
+				values[i] = t.value(row, column)
+			}
+			lines = append(lines, strings.ToLower(t.name)+": "+strings.Join(values, "|"))
+		}
+	}
+	return lines
+}
+
+func TestReadLegacyExport(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string // Rows as USERID|CHECKTIME
+		wantErr bool
+	}{
+		{
+			name: "csv",
+			data: "USERID,CHECKTIME,CHECKTYPE\n1,2024-03-01 08:00:00,I\n2,2024-03-01 08:05:00,I\n",
+			want: []string{": 1|2024-03-01 08:00:00", ": 2|2024-03-01 08:05:00"},
+		},
+		{
+			name: "csv with byte order mark and quoted header",
+			data: "\xef\xbb\xbf\"USERID\",\"CHECKTIME\"\n1,2024-03-01 08:00:00\n",
+			want: []string{": 1|2024-03-01 08:00:00"},
+		},
+		{
+			name: "semicolon csv",
+			data: "USERID;CHECKTIME\n1;01/03/2024 08:00:00\n",
+			want: []string{": 1|01/03/2024 08:00:00"},
+		},
+		{
+			name: "csv short row",
+			data: "USERID,CHECKTIME\n1\n",
+			want: []string{": 1|"},
+		},
+		{
+			name:    "empty csv",
+			data:    "",
+			wantErr: true,
+		},
+		{
+			name:    "csv with unterminated quote",
+			data:    "USERID,CHECKTIME\n\"1,2024-03-01 08:00:00\n",
+			wantErr: true,
+		},
+		{
+			name: "mdb-export inserts",
+			data: "INSERT INTO CHECKINOUT (USERID, CHECKTIME) VALUES (1,#03/01/24 08:00:00#);\n" +
+				"INSERT INTO CHECKINOUT (USERID, CHECKTIME) VALUES (2,#03/01/24 08:05:00#);\n",
+			want: []string{"checkinout: 1|03/01/24 08:00:00", "checkinout: 2|03/01/24 08:05:00"},
+		},
+		{
+			name: "mysql multi-row insert with quoted names",
+			data: "-- dump\nINSERT INTO `att`.`CHECKINOUT` (`USERID`,`CHECKTIME`) VALUES (1,'2024-03-01 08:00:00'),(2,'2024-03-01 08:05:00');\n",
+			want: []string{"checkinout: 1|2024-03-01 08:00:00", "checkinout: 2|2024-03-01 08:05:00"},
+		},
+		{
+			name: "sql server script without INTO",
+			data: "INSERT [dbo].[CHECKINOUT] ([USERID], [CHECKTIME]) VALUES (1, CAST(N'2024-03-01T08:00:00.000' AS DateTime))\nGO\n",
+			want: []string{"checkinout: 1|2024-03-01T08:00:00.000"},
+		},
+		{
+			name: "columns in a different order are mapped to the first statement's",
+			data: "INSERT INTO CHECKINOUT (USERID, CHECKTIME) VALUES (1,'2024-03-01 08:00:00');\n" +
+				"INSERT INTO checkinout (CHECKTIME, USERID) VALUES ('2024-03-01 08:05:00',2);\n",
+			want: []string{"checkinout: 1|2024-03-01 08:00:00", "checkinout: 2|2024-03-01 08:05:00"},
+		},
+		{
+			name: "insert without a column list is skipped",
+			data: "INSERT INTO CHECKINOUT VALUES (9,'2024-03-01 07:00:00');\n" +
+				"INSERT INTO CHECKINOUT (USERID, CHECKTIME) VALUES (1,'2024-03-01 08:00:00');\n",
+			want: []string{"checkinout: 1|2024-03-01 08:00:00"},
+		},
+		{
+			name: "postgresql copy block",
+			data: "COPY public.checkinout (userid, checktime) FROM stdin;\n1\t2024-03-01 08:00:00+06\n2\t\\N\n\\.\n" +
+				"INSERT INTO checkinout (userid, checktime) VALUES (3, '2024-03-01 08:10:00');\n",
+			want: []string{"checkinout: 1|2024-03-01 08:00:00+06", "checkinout: 2|", "checkinout: 3|2024-03-01 08:10:00"},
+		},
+		{
+			name: "copy from a file is skipped",
+			data: "COPY checkinout (userid, checktime) FROM '/tmp/att.csv';\nINSERT INTO checkinout (userid, checktime) VALUES (1, '2024-03-01 08:00:00');\n",
+			want: []string{"checkinout: 1|2024-03-01 08:00:00"},
+		},
+		{
+			name:    "only inserts without a column list",
+			data:    "INSERT INTO CHECKINOUT VALUES (1,'2024-03-01 08:00:00');\n",
+			wantErr: true,
+		},
+		{
+			name:    "copy block without end of data",
+			data:    "COPY checkinout (userid, checktime) FROM stdin;\n1\t2024-03-01 08:00:00\n",
+			wantErr: true,
+		},
+		{
+			name:    "insert without values",
+			data:    "INSERT INTO CHECKINOUT (USERID, CHECKTIME) SELECT * FROM old;\n",
+			wantErr: true,
+		},
+		{
+			name:    "truncated row",
+			data:    "INSERT INTO CHECKINOUT (USERID, CHECKTIME) VALUES (1,'2024-03-01 08:00:00'",
+			wantErr: true,
+		},
+		{
+			name:    "garbage between values",
+			data:    "INSERT INTO CHECKINOUT (USERID, CHECKTIME) VALUES (1,'x' 2);\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tables, err := readLegacyExport(strings.NewReader(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: readLegacyExport() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got := legacyRows(tables, "userid", "checktime"); !equalStrings(got, tt.want) {
+			t.Errorf("%s: readLegacyExport() rows = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLegacyPunches(t *testing.T) {
+	userInfo := newLegacyTable("USERINFO", []string{"USERID", "Badgenumber", "Name"})
+	userInfo.rows = [][]string{{"1", "1001", "Ada"}, {"2", "1002", "Grace"}, {"3", "", "Unenrolled"}}
+	checkInOut := func(rows ...[]string) legacyTable {
+		t := newLegacyTable("CHECKINOUT", []string{"USERID", "CHECKTIME", "VERIFYCODE", "SENSORID", "sn"})
+		t.rows = rows
+		return t
+	}
+	transactions := func(rows ...[]string) legacyTable {
+		t := newLegacyTable("iclock_transaction", []string{"emp_code", "punch_time", "verify_type", "terminal_sn"})
+		t.rows = rows
+		return t
+	}
+
+	tests := []struct {
+		name    string
+		tables  []legacyTable
+		users   []legacyTable
+		want    []string // user|timestamp|modality|terminal
+		wantErr string
+	}{
+		{
+			name:   "checkinout with userinfo in the same export",
+			tables: []legacyTable{userInfo, checkInOut([]string{"1", "2024-03-01 08:00:00", "1", "", "CQZ7224460185"})},
+			want:   []string{"1001|2024-03-01T08:00:00|" + zk.ModalityFingerprint + "|CQZ7224460185"},
+		},
+		{
+			name:   "checkinout with userinfo passed separately",
+			tables: []legacyTable{checkInOut([]string{"2", "03/01/24 17:30:00", "15", "3", ""})},
+			users:  []legacyTable{userInfo},
+			want:   []string{"1002|2024-03-01T17:30:00|" + zk.ModalityFace + "|#3"},
+		},
+		{
+			name:   "checkinout without a verify code or terminal",
+			tables: []legacyTable{checkInOut([]string{"1", "2024-03-01 08:00:00", "", "", ""})},
+			users:  []legacyTable{userInfo},
+			want:   []string{"1001|2024-03-01T08:00:00||"},
+		},
+		{
+			name:    "checkinout without userinfo",
+			tables:  []legacyTable{checkInOut([]string{"1", "2024-03-01 08:00:00", "1", "", ""})},
+			wantErr: "needs the USERINFO table",
+		},
+		{
+			name:    "checkinout user without a badge number",
+			tables:  []legacyTable{checkInOut([]string{"3", "2024-03-01 08:00:00", "1", "", ""})},
+			users:   []legacyTable{userInfo},
+			wantErr: `row 1: USERID "3" is not in USERINFO`,
+		},
+		{
+			name:    "checkinout invalid time",
+			tables:  []legacyTable{checkInOut([]string{"1", "2024-03-01 08:00:00", "1", "", ""}, []string{"2", "soon", "1", "", ""})},
+			users:   []legacyTable{userInfo},
+			wantErr: `CHECKINOUT row 2: unrecognized time "soon"`,
+		},
+		{
+			name:   "biotime transactions",
+			tables: []legacyTable{transactions([]string{"1001", "2024-03-01 08:00:00+06:00", "4", "BIO1"}, []string{"1002", "2024-03-01 08:01:00", "", "BIO1"})},
+			want: []string{
+				"1001|2024-03-01T08:00:00|" + zk.ModalityCard + "|BIO1",
+				"1002|2024-03-01T08:01:00||BIO1",
+			},
+		},
+		{
+			name:    "biotime non-numeric emp_code",
+			tables:  []legacyTable{transactions([]string{"A-17", "2024-03-01 08:00:00", "1", "BIO1"})},
+			wantErr: `iclock_transaction row 1: invalid emp_code "A-17"`,
+		},
+		{
+			name:    "no attendance table",
+			tables:  []legacyTable{userInfo},
+			wantErr: "no attendance table found",
+		},
+	}
+	for _, tt := range tests {
+		punches, err := legacyPunches(tt.tables, tt.users)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: legacyPunches() error = %v, want it to contain %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: legacyPunches() error = %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, p := range punches {
+			got = append(got, strings.Join([]string{strconv.Itoa(p.record.UserID), p.record.Timestamp, p.record.Modality, p.terminal}, "|"))
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("%s: legacyPunches() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
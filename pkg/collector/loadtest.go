@@ -0,0 +1,375 @@
+package collector
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadTestFlag marks synthetic records, so the backend can tell them from real punches
+const loadTestFlag = "load_test"
+
+// loadTestPlan describes the punches a load test synthesizes
+type loadTestPlan struct {
+	users   []int
+	devices []string
+	days    []string        // YYYY-MM-DD
+	peaks   []time.Duration // Times of day each employee punches around, from midnight
+	spread  time.Duration   // Standard deviation of a punch around its peak
+	absent  int             // Percentage of employees absent on a day
+	sampled map[int][]sampledDay
+	rng     *rand.Rand
+}
+
+// sampledDay is one employee's punches on one day of the record store, replayed by a
+// load test
+type sampledDay []zk.AttendanceRecord
+
+// sampleRecords groups the stored records by employee and day, to replay real punch
+// patterns with other dates
+func sampleRecords(records []storedRecord) map[int][]sampledDay {
+	byUserDay := map[int]map[string]sampledDay{}
+	for _, stored := range records {
+		record := stored.Record
+		if record.Manual {
+			continue
+		}
+		if byUserDay[record.UserID] == nil {
+			byUserDay[record.UserID] = map[string]sampledDay{}
+		}
+		day := recordDay(record)
+		byUserDay[record.UserID][day] = append(byUserDay[record.UserID][day], record)
+	}
+	sampled := map[int][]sampledDay{}
+	for userID, days := range byUserDay {
+		names := make([]string, 0, len(days))
+		for day := range days {
+			names = append(names, day)
+		}
+		sort.Strings(names)
+		for _, day := range names {
+			sampled[userID] = append(sampled[userID], days[day])
+		}
+	}
+	return sampled
+}
+
+// timeOfDay returns how long after midnight t is
+func timeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// punchAt returns a record of userID at device on day, offset from midnight by at and kept
+// within the day
+func punchAt(userID int, device, day string, at time.Duration) (zk.AttendanceRecord, error) {
+	midnight, err := time.ParseInLocation("2006-01-02", day, time.Local)
+	if err != nil {
+		return zk.AttendanceRecord{}, err
+	}
+	if at < 0 {
+		at = 0
+	}
+	if last := 24*time.Hour - time.Second; at > last {
+		at = last
+	}
+	return zk.AttendanceRecord{
+		UserID:    userID,
+		Timestamp: midnight.Add(at).Format(zk.TimestampLayout),
+		DeviceID:  device,
+		Flags:     []string{loadTestFlag},
+	}, nil
+}
+
+// generate synthesizes the plan's punches in time order. Employees punch on the device
+// they are assigned to around each peak, or replay a random day of their stored punches
+// with the times moved by around the spread when records were sampled.
+func (p *loadTestPlan) generate() ([]zk.AttendanceRecord, error) {
+	var logs []zk.AttendanceRecord
+	for _, day := range p.days {
+		for i, userID := range p.users {
+			if p.rng.Intn(100) < p.absent {
+				continue
+			}
+			if days := p.sampled[userID]; len(days) > 0 {
+				for _, record := range days[p.rng.Intn(len(days))] {
+					t, err := record.Time()
+					if err != nil {
+						continue
+					}
+					shift := time.Duration(p.rng.NormFloat64() * float64(p.spread))
+					punch, err := punchAt(userID, record.DeviceID, day, timeOfDay(t)+shift)
+					if err != nil {
+						return nil, err
+					}
+					punch.Modality, punch.CardNumber = record.Modality, record.CardNumber
+					logs = append(logs, punch)
+				}
+				continue
+			}
+			device := p.devices[i%len(p.devices)]
+			var times []time.Duration
+			for _, peak := range p.peaks {
+				times = append(times, peak+time.Duration(p.rng.NormFloat64()*float64(p.spread)))
+			}
+			// A late punch in must still come before the punch out
+			sort.Slice(times, func(a, b int) bool { return times[a] < times[b] })
+			for _, at := range times {
+				punch, err := punchAt(userID, device, day, at)
+				if err != nil {
+					return nil, err
+				}
+				logs = append(logs, punch)
+			}
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].Timestamp < logs[j].Timestamp })
+	return logs, nil
+}
+
+// loadTestResult is the outcome of one batch sent by a load test
+type loadTestResult struct {
+	records int
+	took    time.Duration
+	err     error
+}
+
+// findSink returns the configured sink named name, canaries included
+func findSink(name string) (sink.Sink, error) {
+	sinks := configuredSinks(os.Getenv("ORG_ID"), os.Getenv("API_URL"), os.Getenv("API_KEY"))
+	canaries.Lock()
+	sinks = append(sinks, canaries.sinks...)
+	canaries.Unlock()
+	var names []string
+	for _, s := range sinks {
+		if s.Name() == name {
+			return s, nil
+		}
+		names = append(names, s.Name())
+	}
+	return nil, configError(fmt.Sprintf("no sink %q is configured (configured: %s)", name, strings.Join(names, ", ")))
+}
+
+// sendLoad sends logs to s in batches from workers at once, at no more than rate records
+// per second when rate is set, and returns each batch's result
+func sendLoad(s sink.Sink, logs []zk.AttendanceRecord, batchSize, workers int, rate float64) []loadTestResult {
+	syncID := "loadtest-" + newCorrelationID()
+	batches := make(chan []zk.AttendanceRecord)
+	go func() {
+		start, queued := time.Now(), 0
+		for len(logs) > 0 {
+			n := batchSize
+			if n <= 0 || n > len(logs) {
+				n = len(logs)
+			}
+			if rate > 0 {
+				if wait := time.Duration(float64(queued)/rate*float64(time.Second)) - time.Since(start); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+			batches <- logs[:n]
+			queued += n
+			logs = logs[n:]
+		}
+		close(batches)
+	}()
+
+	var mu sync.Mutex
+	var results []loadTestResult
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				started := time.Now()
+				var err error
+				if bs, ok := s.(sink.BatchSink); ok {
+					err = bs.SendBatch(sink.Batch{SyncID: syncID, BatchID: newCorrelationID(), Logs: batch})
+				} else {
+					err = s.Send(batch)
+				}
+				mu.Lock()
+				results = append(results, loadTestResult{records: len(batch), took: time.Since(started), err: err})
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// printLoadTestReport prints the throughput, batch latencies and failures of a load test
+func printLoadTestReport(name string, results []loadTestResult, elapsed time.Duration) {
+	var sent, failed int
+	var latencies []time.Duration
+	failures := map[string]int{}
+	for _, r := range results {
+		latencies = append(latencies, r.took)
+		if r.err != nil {
+			failed++
+			failures[countError(r.err)+": "+r.err.Error()]++
+			continue
+		}
+		sent += r.records
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[(len(latencies)-1)*p/100]
+	}
+	fmt.Printf("Sink:        %s\n", name)
+	fmt.Printf("Batches:     %d sent, %d failed\n", len(results)-failed, failed)
+	fmt.Printf("Records:     %d accepted in %s (%.1f/s)\n", sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds())
+	fmt.Printf("Latency:     p50 %s, p95 %s, max %s\n", percentile(50).Round(time.Millisecond), percentile(95).Round(time.Millisecond), percentile(100).Round(time.Millisecond))
+	var keys []string
+	for key := range failures {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %d x %s\n", failures[key], key)
+	}
+}
+
+// runLoadTestCommand synthesizes punches and sends them through the record pipeline to one
+// sink, for capacity testing a backend before go-live. Nothing is stored or marked delivered,
+// and every record carries the load_test flag. The duplicate and anomaly checks are left out,
+// as they keep state across cycles.
+func runLoadTestCommand(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	sinkName := fs.String("sink", "", "sink to send to, e.g. api or template-<label> (required unless --dry-run)")
+	users := fs.Int("users", 100, "employees punching each day")
+	firstUser := fs.Int("first-user", 1, "employee ID of the first synthetic employee")
+	fromStr := fs.String("from", "", "first day to synthesize as YYYY-MM-DD (default today)")
+	days := fs.Int("days", 1, "days to synthesize")
+	peaks := fs.String("peaks", "08:30,17:30", "comma-separated times of day each employee punches around")
+	spread := fs.Duration("spread", 20*time.Minute, "standard deviation of punch times around a peak")
+	absent := fs.Int("absent", 5, "percentage of employees absent each day")
+	devices := fs.String("devices", "", "comma-separated device IDs employees are spread over (default DEVICE_IPS)")
+	sample := fs.Bool("sample", false, "replay the employees and punch patterns of the record store instead of --peaks")
+	batchSize := fs.Int("batch", backlogBatchSize(), "records per batch")
+	workers := fs.Int("concurrency", 1, "batches in flight at once")
+	rate := fs.Float64("rate", 0, "records per second to send at most, 0 for as fast as the sink takes them")
+	seed := fs.Int64("seed", 0, "random seed, for repeatable runs (default random)")
+	dryRun := fs.Bool("dry-run", false, "print the records as JSON lines instead of sending them")
+	fs.Parse(args)
+
+	if *sinkName == "" && !*dryRun {
+		return configError("--sink is required")
+	}
+	if *users < 0 || *days < 1 || *workers < 1 || *absent < 0 || *absent > 100 {
+		return configError("--users, --days, --concurrency and --absent must be in range")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	plan := &loadTestPlan{spread: *spread, absent: *absent, rng: rand.New(rand.NewSource(*seed))}
+
+	from, _, err := parseDayRange(*fromStr, "")
+	if err != nil {
+		return err
+	}
+	for i := 0; i < *days; i++ {
+		plan.days = append(plan.days, addDays(from, i))
+	}
+	if *sample {
+		records, err := readStore()
+		if err != nil {
+			return err
+		}
+		plan.sampled = sampleRecords(records)
+		if len(plan.sampled) == 0 {
+			return fmt.Errorf("the record store has no punches to sample")
+		}
+		for userID := range plan.sampled {
+			plan.users = append(plan.users, userID)
+		}
+		sort.Ints(plan.users)
+		// Employees are drawn from the store, as many as --users asks for
+		plan.rng.Shuffle(len(plan.users), func(i, j int) { plan.users[i], plan.users[j] = plan.users[j], plan.users[i] })
+		if *users < len(plan.users) {
+			plan.users = plan.users[:*users]
+		}
+		sort.Ints(plan.users)
+	} else {
+		for i := 0; i < *users; i++ {
+			plan.users = append(plan.users, *firstUser+i)
+		}
+		for _, entry := range splitList(*peaks) {
+			at, err := parseClock(entry)
+			if err != nil {
+				return configError(fmt.Sprintf("invalid --peaks: %v", err))
+			}
+			plan.peaks = append(plan.peaks, at)
+		}
+		if len(plan.peaks) == 0 {
+			return configError("--peaks is empty")
+		}
+		plan.devices = splitList(*devices)
+		if len(plan.devices) == 0 {
+			for _, device := range configuredDevices() {
+				plan.devices = append(plan.devices, device.ID)
+			}
+		}
+		if len(plan.devices) == 0 {
+			plan.devices = []string{"loadtest"}
+		}
+	}
+
+	logs, err := plan.generate()
+	if err != nil {
+		return err
+	}
+	// The record stages of a sync cycle, without the stateful ones
+	normalizeBadges(logs)
+	if roster := loadRoster(); roster != nil {
+		logs = applyRoster(logs, roster)
+	}
+	applyShifts(logs)
+	enrichRecords(logs)
+
+	if *dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		for _, record := range logs {
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Synthesized %d record(s) for %d employee(s) over %d day(s) (seed %d)\n", len(logs), len(plan.users), len(plan.days), *seed)
+		return nil
+	}
+
+	s, err := findSink(*sinkName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sending %d synthetic record(s) for %d employee(s) over %d day(s) to %s (seed %d)\n", len(logs), len(plan.users), len(plan.days), s.Name(), *seed)
+	started := time.Now()
+	results := sendLoad(s, logs, *batchSize, *workers, *rate)
+	printLoadTestReport(s.Name(), results, time.Since(started))
+	if failed := countFailed(results); failed > 0 {
+		return fmt.Errorf("%d of %d batch(es) failed", failed, len(results))
+	}
+	return nil
+}
+
+// countFailed counts the failed batches of a load test
+func countFailed(results []loadTestResult) int {
+	n := 0
+	for _, r := range results {
+		if r.err != nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,156 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels accepted by LOG_LEVEL and /api/log-level
+const (
+	logLevelInfo  = "info"
+	logLevelDebug = "debug" // Adds device protocol packets to the log
+)
+
+// logLevel is the current level, changed at runtime without losing in-memory state
+var logLevel = struct {
+	sync.Mutex
+	level   string
+	devices []string  // Devices debugged at the debug level, all when empty
+	until   time.Time // When a temporary level reverts to info, zero if it doesn't
+	revert  *time.Timer
+}{level: logLevelInfo}
+
+// LogLevelState is the body of /api/log-level
+type LogLevelState struct {
+	Level    string   `json:"level"`
+	Devices  []string `json:"devices,omitempty"`
+	RevertAt string   `json:"revert_at,omitempty"`
+}
+
+// setLogLevel switches between info and debug, for all devices or only the given ones.
+// With a positive duration the level reverts to info afterwards, so forgotten debug
+// logging doesn't fill the disk.
+func setLogLevel(level string, devices []string, duration time.Duration) error {
+	if level != logLevelInfo && level != logLevelDebug {
+		return fmt.Errorf("unknown log level %q, use info or debug", level)
+	}
+	logLevel.Lock()
+	defer logLevel.Unlock()
+	if logLevel.revert != nil {
+		logLevel.revert.Stop()
+		logLevel.revert = nil
+	}
+	logLevel.level, logLevel.devices, logLevel.until = level, devices, time.Time{}
+	if level == logLevelDebug {
+		zk.SetProtocolDebug(len(devices) == 0, devices)
+	} else {
+		zk.SetProtocolDebug(false, nil)
+	}
+	scope := "all devices"
+	if len(devices) > 0 {
+		scope = strings.Join(devices, ", ")
+	}
+	if level == logLevelDebug && duration > 0 {
+		logLevel.until = time.Now().Add(duration)
+		logLevel.revert = time.AfterFunc(duration, func() {
+			if err := setLogLevel(logLevelInfo, nil, 0); err == nil {
+				log.Println("Debug logging period ended")
+			}
+		})
+		log.Printf("Log level set to %s for %s, reverting in %v", level, scope, duration)
+	} else if level == logLevelDebug {
+		log.Printf("Log level set to %s for %s", level, scope)
+	} else {
+		log.Printf("Log level set to %s", level)
+	}
+	return nil
+}
+
+// toggleLogLevel switches between info and debug for all devices, for SIGUSR1
+func toggleLogLevel() {
+	logLevel.Lock()
+	level := logLevel.level
+	logLevel.Unlock()
+	next := logLevelDebug
+	if level == logLevelDebug {
+		next = logLevelInfo
+	}
+	setLogLevel(next, nil, 0)
+}
+
+// currentLogLevel snapshots the log level
+func currentLogLevel() LogLevelState {
+	logLevel.Lock()
+	defer logLevel.Unlock()
+	state := LogLevelState{Level: logLevel.level, Devices: logLevel.devices}
+	if !logLevel.until.IsZero() {
+		state.RevertAt = logLevel.until.Format(time.RFC3339)
+	}
+	return state
+}
+
+// initLogLevel applies LOG_LEVEL and LOG_DEBUG_DEVICES, a comma-separated list of devices to
+// limit debug logging to
+func initLogLevel() {
+	level := strings.ToLower(strings.TrimSpace(os.Getenv("LOG_LEVEL")))
+	if level == "" || level == logLevelInfo {
+		return
+	}
+	if err := setLogLevel(level, splitList(os.Getenv("LOG_DEBUG_DEVICES")), 0); err != nil {
+		log.Printf("Invalid LOG_LEVEL: %v", err)
+	}
+}
+
+// splitList splits a comma-separated setting, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// handleLogLevel serves /api/log-level. GET reports the level; POST ?level=debug changes
+// it, optionally with device=NAME (repeatable) and for=15m. POST needs the ADMIN_TOKEN
+// bearer token.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !adminAuthorized(w, r) {
+			return
+		}
+		query := r.URL.Query()
+		var duration time.Duration
+		if value := query.Get("for"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", value), http.StatusBadRequest)
+				return
+			}
+			duration = d
+		}
+		var devices []string
+		for _, device := range query["device"] {
+			devices = append(devices, splitList(device)...)
+		}
+		if err := setLogLevel(strings.ToLower(query.Get("level")), devices, duration); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set(contentTypeHeader, jsonContentType)
+	json.NewEncoder(w).Encode(currentLogLevel())
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package collector
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogLevelSignal toggles debug logging on SIGUSR1
+func watchLogLevelSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			toggleLogLevel()
+		}
+	}()
+}
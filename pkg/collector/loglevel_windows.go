@@ -0,0 +1,4 @@
+package collector
+
+// watchLogLevelSignal does nothing on Windows, which has no SIGUSR1; use /api/log-level
+func watchLogLevelSignal() {}
@@ -0,0 +1,210 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State key of when each maintenance entry last fired, by device and entry
+const maintenanceFile = "maintenance.json"
+
+// Event type streamed on /api/events when a device's storage is filling up
+const eventCapacity = "capacity"
+
+// Share of a device's storage, in percent, at which check_capacity alerts by default
+const defaultCapacityAlert = 80
+
+// Device command actions only queued by maintenance entries, or by hand
+const (
+	actionCheckCapacity = "check_capacity"
+	actionSnapshotUsers = "snapshot_users"
+)
+
+// Actions a maintenance entry can queue; those needing arguments can't be scheduled
+var maintenanceActions = map[string]bool{
+	actionSetTime:       true,
+	actionCheckCapacity: true,
+	actionSnapshotUsers: true,
+	actionReboot:        true,
+}
+
+// maintenanceEntry is a device command queued on a cron schedule
+type maintenanceEntry struct {
+	schedule *cronSchedule
+	action   string
+	raw      string
+}
+
+// maintenanceMu serializes read-modify-write cycles of the maintenance state
+var maintenanceMu sync.Mutex
+
+// parseMaintenance parses MAINTENANCE: entries separated by semicolons, each a cron
+// expression followed by an action, as "0 2 * * * set_time; @weekly check_capacity"
+func parseMaintenance(value string) ([]maintenanceEntry, error) {
+	var entries []maintenanceEntry
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.LastIndexAny(part, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("entry %q is not a cron expression followed by an action", part)
+		}
+		action := part[i+1:]
+		if !maintenanceActions[action] {
+			return nil, fmt.Errorf("entry %q: unknown action %q; use set_time, check_capacity, snapshot_users or reboot", part, action)
+		}
+		schedule, err := parseCron(part[:i])
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %v", part, err)
+		}
+		entries = append(entries, maintenanceEntry{schedule: schedule, action: action, raw: schedule.String() + " " + action})
+	}
+	return entries, nil
+}
+
+// loadMaintenanceState returns when each entry last fired, keyed by device and entry
+func loadMaintenanceState() map[string]time.Time {
+	fired := map[string]time.Time{}
+	data, err := state().Get(maintenanceFile)
+	if err != nil || data == nil {
+		return fired
+	}
+	if err := json.Unmarshal(data, &fired); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", maintenanceFile, err)
+		return map[string]time.Time{}
+	}
+	return fired
+}
+
+// scheduleMaintenance queues the maintenance commands that have come due for each device,
+// from MAINTENANCE or MAINTENANCE_<DEVICE>. They run through the device command queue like
+// commands queued by hand, so a device that is offline gets them when it is back. An entry
+// missed while the collector was down is queued once when it starts again; a new entry
+// first fires at its next scheduled time. A command still pending from the last time isn't
+// queued again.
+func scheduleMaintenance(now time.Time) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	var fired map[string]time.Time
+	changed := false
+	for _, device := range configuredDevices() {
+		entries, err := parseMaintenance(deviceEnv("MAINTENANCE", device.ID))
+		if err != nil {
+			log.Printf("Invalid MAINTENANCE for %s: %v", device.ID, err)
+			continue
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if fired == nil {
+			fired = loadMaintenanceState()
+		}
+		for _, entry := range entries {
+			key := device.ID + "|" + entry.raw
+			last, ok := fired[key]
+			if !ok {
+				fired[key], changed = now, true
+				continue
+			}
+			if next := entry.schedule.Next(last); next.IsZero() || next.After(now) {
+				continue
+			}
+			fired[key], changed = now, true
+			if pendingDeviceCommand(device.ID, entry.action) {
+				log.Printf("Maintenance %s for %s is still pending, not queued again", entry.action, device.ID)
+				continue
+			}
+			cmd := newDeviceCommand(device.ID, entry.action, map[string]string{"schedule": entry.schedule.String()})
+			if err := queueDeviceCommand(cmd); err != nil {
+				log.Printf("Error queueing maintenance %s for %s: %v", entry.action, device.ID, err)
+				continue
+			}
+			log.Printf("Queued maintenance %s for device %s (%s)", entry.action, device.ID, entry.schedule)
+		}
+	}
+	if !changed {
+		return
+	}
+	data, err := json.Marshal(fired)
+	if err == nil {
+		err = state().Put(maintenanceFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving maintenance state: %v", err)
+	}
+}
+
+// pendingDeviceCommand reports whether a device has a command with an action still queued
+func pendingDeviceCommand(deviceID, action string) bool {
+	commands, err := loadDeviceCommands()
+	if err != nil {
+		return false
+	}
+	for _, cmd := range commands {
+		if cmd.Device == deviceID && cmd.Action == action && cmd.Status == commandPending {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDeviceCapacity reads how full a device's storage is and alerts on every kind of
+// entry at or above MAINTENANCE_CAPACITY_ALERT percent (default 80) of its capacity. A full
+// attendance log overwrites its oldest punches, or stops taking new ones, depending on the
+// firmware.
+func checkDeviceCapacity(device deviceConfig) error {
+	threshold := defaultCapacityAlert
+	if value := deviceEnv("MAINTENANCE_CAPACITY_ALERT", device.ID); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 && n <= 100 {
+			threshold = n
+		} else {
+			log.Printf("Invalid MAINTENANCE_CAPACITY_ALERT=%q for %s, using %d", value, device.ID, threshold)
+		}
+	}
+	zkManager, err := newDeviceManager(device)
+	if err != nil {
+		return err
+	}
+	d, err := zkManager.GetDiagnostics()
+	if err != nil {
+		return fmt.Errorf("failed to read storage use from %s: %w", device.ID, err)
+	}
+
+	usage := []struct {
+		kind           string
+		used, capacity int
+	}{
+		{"records", d.Records, d.RecordCapacity},
+		{"users", d.Users, d.UserCapacity},
+		{"fingers", d.Fingers, d.FingerCapacity},
+		{"faces", d.Faces, d.FaceCapacity},
+	}
+	var parts []string
+	for _, u := range usage {
+		if u.capacity <= 0 {
+			continue
+		}
+		percent := u.used * 100 / u.capacity
+		parts = append(parts, fmt.Sprintf("%s %d/%d (%d%%)", u.kind, u.used, u.capacity, percent))
+		if percent < threshold {
+			continue
+		}
+		log.Printf("ALERT: device %s %s storage is %d%% full (%d of %d)", device.ID, u.kind, percent, u.used, u.capacity)
+		publishEvent(eventCapacity, map[string]interface{}{
+			"device":   device.ID,
+			"kind":     u.kind,
+			"used":     u.used,
+			"capacity": u.capacity,
+			"percent":  percent,
+		})
+	}
+	log.Printf("Storage of device %s: %s", device.ID, strings.Join(parts, ", "))
+	return nil
+}
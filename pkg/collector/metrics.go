@@ -0,0 +1,161 @@
+package collector
+
+import (
+	"fmt"
+	"io"
+	"old-attendance/pkg/zk"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Deliveries kept per sink and device for lag percentiles
+const lagSampleSize = 1000
+
+// lagKey identifies a lag series
+type lagKey struct {
+	Sink, Device string
+}
+
+// lagSeries holds recent lag samples plus running totals for one sink and device
+type lagSeries struct {
+	samples []float64 // Seconds, ring buffer of the latest deliveries
+	next    int
+	count   int64
+	sum     float64
+}
+
+// recordLags holds punch-to-acknowledgment lag per sink and device
+var recordLags = struct {
+	sync.Mutex
+	series map[lagKey]*lagSeries
+}{series: map[lagKey]*lagSeries{}}
+
+// observeDeliveryLag records the time between each punch and its acknowledgment by a sink.
+// Manual punches are skipped since they are entered long after the fact by design.
+func observeDeliveryLag(sink string, logs []zk.AttendanceRecord, ackedAt time.Time) {
+	recordLags.Lock()
+	defer recordLags.Unlock()
+	for _, record := range logs {
+		t, err := record.Time()
+		if record.Manual || err != nil {
+			continue
+		}
+		key := lagKey{Sink: sink, Device: record.DeviceID}
+		s, ok := recordLags.series[key]
+		if !ok {
+			s = &lagSeries{}
+			recordLags.series[key] = s
+		}
+		lag := ackedAt.Sub(t).Seconds()
+		if len(s.samples) < lagSampleSize {
+			s.samples = append(s.samples, lag)
+		} else {
+			s.samples[s.next] = lag
+			s.next = (s.next + 1) % lagSampleSize
+		}
+		s.count++
+		s.sum += lag
+	}
+}
+
+// deliveredSeries counts records a sink has acknowledged, with the IDs of the latest batch
+// as its exemplar
+type deliveredSeries struct {
+	count            int64
+	syncID, batchID  string
+	batchSize        int
+	exemplarRecorded time.Time
+}
+
+// deliveredCounts holds delivered-record counters per sink
+var deliveredCounts = struct {
+	sync.Mutex
+	bySink map[string]*deliveredSeries
+}{bySink: map[string]*deliveredSeries{}}
+
+// observeDelivered counts a delivered batch and makes it the sink's exemplar
+func observeDelivered(sink string, n int, syncID, batchID string) {
+	deliveredCounts.Lock()
+	defer deliveredCounts.Unlock()
+	s, ok := deliveredCounts.bySink[sink]
+	if !ok {
+		s = &deliveredSeries{}
+		deliveredCounts.bySink[sink] = s
+	}
+	s.count += int64(n)
+	s.syncID, s.batchID, s.batchSize = syncID, batchID, n
+	s.exemplarRecorded = time.Now()
+}
+
+// writeDeliveredMetrics writes delivered-record counters. Exemplars linking the count to the
+// latest batch's sync and batch IDs are only valid in OpenMetrics, so they are left out otherwise.
+func writeDeliveredMetrics(w io.Writer, openMetrics bool) {
+	deliveredCounts.Lock()
+	defer deliveredCounts.Unlock()
+	sinks := make([]string, 0, len(deliveredCounts.bySink))
+	for name := range deliveredCounts.bySink {
+		sinks = append(sinks, name)
+	}
+	sort.Strings(sinks)
+
+	writeCounterHeader(w, "attendance_records_delivered", "Records acknowledged by each sink.", openMetrics)
+	for _, name := range sinks {
+		s := deliveredCounts.bySink[name]
+		fmt.Fprintf(w, "attendance_records_delivered_total{%s} %d", tenantLabel(fmt.Sprintf("sink=%q", name)), s.count)
+		if openMetrics && s.batchID != "" {
+			fmt.Fprintf(w, " # {sync_id=%q,batch_id=%q} %d %.3f", s.syncID, s.batchID, s.batchSize,
+				float64(s.exemplarRecorded.UnixNano())/1e9)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// writeCounterHeader writes HELP and TYPE lines for a counter. OpenMetrics names the family
+// without the _total suffix its samples carry.
+func writeCounterHeader(w io.Writer, family, help string, openMetrics bool) {
+	if !openMetrics {
+		family += "_total"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", family, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", family)
+}
+
+// percentile returns the p-th percentile (0-1) of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted)-1) + 0.5)
+	return sorted[i]
+}
+
+// writeLagMetrics writes record lag in Prometheus text format
+func writeLagMetrics(w io.Writer) {
+	recordLags.Lock()
+	defer recordLags.Unlock()
+
+	keys := make([]lagKey, 0, len(recordLags.series))
+	for key := range recordLags.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Sink != keys[j].Sink {
+			return keys[i].Sink < keys[j].Sink
+		}
+		return keys[i].Device < keys[j].Device
+	})
+
+	fmt.Fprintf(w, "# HELP attendance_record_lag_seconds Time from punch to sink acknowledgment, percentiles over the last %d deliveries.\n", lagSampleSize)
+	fmt.Fprintln(w, "# TYPE attendance_record_lag_seconds summary")
+	for _, key := range keys {
+		s := recordLags.series[key]
+		sorted := append([]float64(nil), s.samples...)
+		sort.Float64s(sorted)
+		labels := tenantLabel(fmt.Sprintf("sink=%q,device=%q", key.Sink, key.Device))
+		fmt.Fprintf(w, "attendance_record_lag_seconds{%s,quantile=\"0.5\"} %g\n", labels, percentile(sorted, 0.5))
+		fmt.Fprintf(w, "attendance_record_lag_seconds{%s,quantile=\"0.95\"} %g\n", labels, percentile(sorted, 0.95))
+		fmt.Fprintf(w, "attendance_record_lag_seconds_sum{%s} %g\n", labels, s.sum)
+		fmt.Fprintf(w, "attendance_record_lag_seconds_count{%s} %d\n", labels, s.count)
+	}
+}
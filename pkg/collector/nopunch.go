@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"encoding/json"
+	"log"
+	"old-attendance/pkg/zk"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State key of the newest punch timestamp seen per device
+const lastPunchesFile = "last_punches.json"
+
+// Event type streamed on /api/events when a device has no punches by NO_PUNCH_ALERT_AT
+const eventNoPunches = "no_punches"
+
+// lastPunches tracks the newest punch per device and the days already alerted on
+var lastPunches = struct {
+	sync.Mutex
+	alerted map[string]string // Date of the last no-punch alert by device ID
+}{alerted: map[string]string{}}
+
+// loadLastPunches returns the newest punch timestamp per device
+func loadLastPunches() map[string]string {
+	punches := map[string]string{}
+	data, err := state().Get(lastPunchesFile)
+	if err != nil || data == nil {
+		return punches
+	}
+	if err := json.Unmarshal(data, &punches); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", lastPunchesFile, err)
+		return map[string]string{}
+	}
+	return punches
+}
+
+// noteLastPunch remembers the newest of a device's fetched punches
+func noteLastPunch(deviceID string, logs []zk.AttendanceRecord) {
+	newest := ""
+	for _, record := range logs {
+		if record.Timestamp > newest {
+			newest = record.Timestamp
+		}
+	}
+	lastPunches.Lock()
+	defer lastPunches.Unlock()
+	punches := loadLastPunches()
+	if newest <= punches[deviceID] {
+		return
+	}
+	punches[deviceID] = newest
+	data, err := json.Marshal(punches)
+	if err == nil {
+		err = state().Put(lastPunchesFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving last punches: %v", err)
+	}
+}
+
+// checkNoPunches alerts, once a day, on devices read this cycle that have no punches today
+// by NO_PUNCH_ALERT_AT (HH:MM, per device), which usually means a broken reader or a
+// terminal nobody can get to. Weekends and holidays are skipped.
+func checkNoPunches(cycle *syncCycle) {
+	if cycle == nil {
+		return
+	}
+	var read []string
+	cycle.update(func(c *syncCycle) {
+		for id := range c.devicesRead {
+			read = append(read, id)
+		}
+	})
+	sort.Strings(read)
+	now := time.Now()
+	today := now.Format("2006-01-02")
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	lastPunches.Lock()
+	defer lastPunches.Unlock()
+	var punches map[string]string
+	for _, id := range read {
+		value := strings.TrimSpace(deviceEnv("NO_PUNCH_ALERT_AT", id))
+		if value == "" || lastPunches.alerted[id] == today {
+			continue
+		}
+		at, err := parseClock(value)
+		if err != nil {
+			log.Printf("Invalid NO_PUNCH_ALERT_AT for %s: %v", id, err)
+			continue
+		}
+		if now.Before(midnight.Add(at)) {
+			continue
+		}
+		if reason, off := dayOff(now); off {
+			log.Printf("Not checking device %s for punches today (%s)", id, reason)
+			lastPunches.alerted[id] = today
+			continue
+		}
+		if punches == nil {
+			punches = loadLastPunches()
+		}
+		if strings.HasPrefix(punches[id], today) {
+			continue
+		}
+		lastPunches.alerted[id] = today
+		last := punches[id]
+		if last == "" {
+			last = "never"
+		}
+		log.Printf("ALERT: device %s has no punches today by %s; last punch %s", id, value, last)
+		publishEvent(eventNoPunches, map[string]interface{}{"device": id, "last_punch": punches[id]})
+	}
+}
@@ -0,0 +1,240 @@
+package collector
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// State key of the employees on premises, so a restart doesn't empty the building
+	occupancyFile = "occupancy.json"
+	// How long a punch in counts without a punch out, unless OCCUPANCY_MAX_STAY overrides it.
+	// It clears employees who left without punching before the next shift arrives.
+	defaultMaxStay = 16 * time.Hour
+	// Branch of devices without DEVICE_BRANCH
+	defaultBranch = "main"
+)
+
+// Punch directions of a device, set with DEVICE_DIRECTION
+const (
+	directionIn     = "in"     // Entrance terminal: every punch is an arrival
+	directionOut    = "out"    // Exit terminal: every punch is a departure
+	directionToggle = "toggle" // Punches alternate between arrival and departure
+)
+
+// presence is an employee on premises
+type presence struct {
+	Device string    `json:"device"` // Where they punched in
+	Branch string    `json:"branch"`
+	Since  time.Time `json:"since"`
+}
+
+// occupancyState is who is on premises, with the last punch seen per employee so records
+// read again don't flip a toggle twice
+type occupancyState struct {
+	Present   map[int]presence  `json:"present"`
+	LastPunch map[int]time.Time `json:"last_punch"`
+}
+
+// occupancy is the live state, loaded from the state store on first use
+var occupancy = struct {
+	sync.Mutex
+	loaded bool
+	state  occupancyState
+}{}
+
+// BranchOccupancy is the count of one branch in /api/occupancy.json
+type BranchOccupancy struct {
+	Count     int            `json:"count"`
+	Devices   map[string]int `json:"devices"`             // By device punched in at
+	Employees []int          `json:"employees,omitempty"` // With ?employees=true
+}
+
+// OccupancyReport is the body of /api/occupancy.json
+type OccupancyReport struct {
+	Time     string                      `json:"time"`
+	Total    int                         `json:"total"`
+	Branches map[string]*BranchOccupancy `json:"branches"`
+}
+
+// deviceBranch returns the branch a device belongs to, DEVICE_BRANCH_<DEVICE>
+func deviceBranch(deviceID string) string {
+	if branch := strings.TrimSpace(deviceEnv("DEVICE_BRANCH", deviceID)); branch != "" {
+		return branch
+	}
+	return defaultBranch
+}
+
+// deviceDirection returns how a device's punches count, DEVICE_DIRECTION_<DEVICE>
+func deviceDirection(deviceID string) string {
+	switch direction := strings.ToLower(strings.TrimSpace(deviceEnv("DEVICE_DIRECTION", deviceID))); direction {
+	case directionIn, directionOut:
+		return direction
+	default:
+		return directionToggle
+	}
+}
+
+// maxStay returns OCCUPANCY_MAX_STAY, e.g. 16h
+func maxStay() time.Duration {
+	if value := os.Getenv("OCCUPANCY_MAX_STAY"); value != "" {
+		if stay, err := parseAge(value); err == nil {
+			return stay
+		}
+		log.Printf("Invalid OCCUPANCY_MAX_STAY=%q, using %v", value, defaultMaxStay)
+	}
+	return defaultMaxStay
+}
+
+// loadOccupancy reads the saved state once. The caller holds the occupancy lock.
+func loadOccupancy() {
+	if occupancy.loaded {
+		return
+	}
+	occupancy.loaded = true
+	occupancy.state = occupancyState{Present: map[int]presence{}, LastPunch: map[int]time.Time{}}
+	data, err := state().Get(occupancyFile)
+	if err != nil || data == nil {
+		return
+	}
+	var saved occupancyState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", occupancyFile, err)
+		return
+	}
+	if saved.Present != nil {
+		occupancy.state.Present = saved.Present
+	}
+	if saved.LastPunch != nil {
+		occupancy.state.LastPunch = saved.LastPunch
+	}
+}
+
+// updateOccupancy applies a device's new punches in time order. Entrance and exit terminals
+// decide the direction; on other devices a punch at the branch an employee is in marks them
+// as gone, and any other punch marks them as arrived.
+func updateOccupancy(deviceID string, logs []zk.AttendanceRecord) {
+	type punch struct {
+		userID int
+		at     time.Time
+	}
+	punches := make([]punch, 0, len(logs))
+	for _, record := range logs {
+		if at, err := record.Time(); err == nil {
+			punches = append(punches, punch{record.UserID, at})
+		}
+	}
+	sort.Slice(punches, func(i, j int) bool { return punches[i].at.Before(punches[j].at) })
+	branch, direction := deviceBranch(deviceID), deviceDirection(deviceID)
+
+	occupancy.Lock()
+	defer occupancy.Unlock()
+	loadOccupancy()
+	s := occupancy.state
+	for _, p := range punches {
+		if last, ok := s.LastPunch[p.userID]; ok && !p.at.After(last) {
+			continue
+		}
+		s.LastPunch[p.userID] = p.at
+		current, present := s.Present[p.userID]
+		arriving := direction == directionIn ||
+			direction == directionToggle && !(present && current.Branch == branch)
+		if arriving {
+			s.Present[p.userID] = presence{Device: deviceID, Branch: branch, Since: p.at}
+		} else {
+			delete(s.Present, p.userID)
+		}
+	}
+	saveOccupancy()
+}
+
+// expireOccupancy drops employees who punched in longer ago than the maximum stay, and the
+// last punches that no longer matter. The caller holds the occupancy lock.
+func expireOccupancy(now time.Time) {
+	cutoff := now.Add(-maxStay())
+	for userID, p := range occupancy.state.Present {
+		if p.Since.Before(cutoff) {
+			delete(occupancy.state.Present, userID)
+		}
+	}
+	for userID, at := range occupancy.state.LastPunch {
+		if _, present := occupancy.state.Present[userID]; !present && at.Before(cutoff) {
+			delete(occupancy.state.LastPunch, userID)
+		}
+	}
+}
+
+// saveOccupancy stores the state. The caller holds the occupancy lock.
+func saveOccupancy() {
+	expireOccupancy(time.Now())
+	data, err := json.Marshal(occupancy.state)
+	if err == nil {
+		err = state().Put(occupancyFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving occupancy: %v", err)
+	}
+}
+
+// buildOccupancyReport counts the employees on premises per branch and device
+func buildOccupancyReport(withEmployees bool) OccupancyReport {
+	occupancy.Lock()
+	defer occupancy.Unlock()
+	loadOccupancy()
+	now := time.Now()
+	expireOccupancy(now)
+
+	// Branches of the configured devices are listed even when empty
+	report := OccupancyReport{Time: now.Format(time.RFC3339), Branches: map[string]*BranchOccupancy{}}
+	for _, entry := range strings.Split(os.Getenv("DEVICE_IPS"), ",") {
+		if device, err := parseDevice(strings.TrimSpace(entry)); err == nil {
+			report.Branches[deviceBranch(device.ID)] = &BranchOccupancy{Devices: map[string]int{}}
+		}
+	}
+	for userID, p := range occupancy.state.Present {
+		branch := report.Branches[p.Branch]
+		if branch == nil {
+			branch = &BranchOccupancy{Devices: map[string]int{}}
+			report.Branches[p.Branch] = branch
+		}
+		branch.Count++
+		branch.Devices[p.Device]++
+		if withEmployees {
+			branch.Employees = append(branch.Employees, userID)
+		}
+		report.Total++
+	}
+	for _, branch := range report.Branches {
+		sort.Ints(branch.Employees)
+	}
+	return report
+}
+
+// handleOccupancy serves /api/occupancy.json, the employees currently on premises for
+// mustering. ?branch=NAME limits it to one branch; ?employees=true lists their IDs, which
+// needs the ADMIN_TOKEN bearer token.
+func handleOccupancy(w http.ResponseWriter, r *http.Request) {
+	withEmployees := isTrue(r.URL.Query().Get("employees"))
+	if withEmployees && !adminAuthorized(w, r) {
+		return
+	}
+	report := buildOccupancyReport(withEmployees)
+	if name := r.URL.Query().Get("branch"); name != "" {
+		branch := report.Branches[name]
+		report.Branches = map[string]*BranchOccupancy{}
+		report.Total = 0
+		if branch != nil {
+			report.Branches[name] = branch
+			report.Total = branch.Count
+		}
+	}
+	w.Header().Set(contentTypeHeader, jsonContentType)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,206 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"strings"
+	"time"
+)
+
+// errStoreFull means a batch did not fit in the record store under the stop policy
+var errStoreFull = errors.New("record store is full")
+
+// fullPolicy returns the policy setting key for a full local buffer, one of the sink.Policy
+// constants, defaulting to evict-oldest
+func fullPolicy(key string) string {
+	switch policy := strings.ToLower(strings.TrimSpace(os.Getenv(key))); policy {
+	case "", sink.PolicyEvictOldest:
+		return sink.PolicyEvictOldest
+	case sink.PolicyStop, sink.PolicyAlert:
+		return policy
+	default:
+		log.Printf("Invalid %s %q, defaulting to %s", key, policy, sink.PolicyEvictOldest)
+		return sink.PolicyEvictOldest
+	}
+}
+
+// makeStoreRoom keeps the record store under STORE_MAX_SIZE before logs are added to it.
+// Records every sink has delivered are dropped first; if that is not enough, STORE_FULL_POLICY
+// applies: the oldest undelivered records are evicted, errStoreFull is returned (stop), or an
+// alert is logged and the store grows past its limit (alert).
+func makeStoreRoom(logs []zk.AttendanceRecord, sinks []sink.Sink) error {
+	max := parseByteSize("STORE_MAX_SIZE", os.Getenv("STORE_MAX_SIZE"))
+	if max == 0 || len(logs) == 0 {
+		return nil
+	}
+	need := int64(0)
+	for _, record := range logs {
+		line, _ := json.Marshal(storedRecord{StoredAt: time.Now().Format(time.RFC3339), Record: record})
+		need += int64(len(line)) + 1
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	data, err := state().Get(recordStoreFile)
+	if err != nil {
+		return fmt.Errorf("failed to read record store: %w", err)
+	}
+	if int64(len(data))+need <= max {
+		return nil
+	}
+
+	records, err := readStoreLocked()
+	if err != nil {
+		return err
+	}
+	progress, err := readSinkOffsetsLocked()
+	if err != nil {
+		return err
+	}
+	deliveredEverywhere := func(seq int64) bool {
+		for _, s := range sinks {
+			p, ok := progress[s.Name()]
+			if !ok || !p.isDelivered(seq) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var kept []storedRecord
+	lines := map[int64][]byte{}
+	size := int64(0)
+	for _, record := range records {
+		if deliveredEverywhere(record.Seq) {
+			continue
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode record: %w", err)
+		}
+		kept = append(kept, record)
+		lines[record.Seq] = line
+		size += int64(len(line)) + 1
+	}
+
+	full := size+need > max
+	evicted := 0
+	policy := fullPolicy("STORE_FULL_POLICY")
+	if full && policy == sink.PolicyEvictOldest {
+		for len(kept) > 0 && size+need > max {
+			size -= int64(len(lines[kept[0].Seq])) + 1
+			kept = kept[1:]
+			evicted++
+		}
+		full = size+need > max
+	}
+
+	if len(kept) < len(records) {
+		var buf bytes.Buffer
+		for _, record := range kept {
+			buf.Write(lines[record.Seq])
+			buf.WriteByte('\n')
+		}
+		if err := rewriteStoreLocked(records, buf.Bytes()); err != nil {
+			return err
+		}
+		log.Printf("Record store over STORE_MAX_SIZE: removed %d delivered and evicted %d undelivered record(s)",
+			len(records)-len(kept)-evicted, evicted)
+	}
+	if evicted > 0 {
+		details := map[string]interface{}{"count": evicted, "first_seq": records[0].Seq}
+		if err := appendAudit("records_evicted", details); err != nil {
+			log.Printf("Error writing audit log: %v", err)
+		}
+	}
+	if full && policy == sink.PolicyAlert {
+		log.Printf("ALERT: record store is over STORE_MAX_SIZE: %d of %d bytes used", size+need, max)
+		return nil
+	}
+	if full {
+		return fmt.Errorf("%w: %d of %d bytes used, %d more needed (STORE_FULL_POLICY=stop)", errStoreFull, size, max, need)
+	}
+	return nil
+}
+
+// writeDiskMetrics writes the size of the local buffers, the record store and the archive,
+// and their limits where set
+func writeDiskMetrics(w io.Writer) {
+	type buffer struct {
+		name  string
+		usage int64
+		limit int64
+	}
+	var buffers []buffer
+	if data, err := state().Get(recordStoreFile); err == nil {
+		buffers = append(buffers, buffer{"store", int64(len(data)), parseByteSize("STORE_MAX_SIZE", os.Getenv("STORE_MAX_SIZE"))})
+	}
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		if usage, err := sink.ArchiveUsage(dir); err == nil {
+			buffers = append(buffers, buffer{"archive", usage, parseByteSize("ARCHIVE_MAX_SIZE", os.Getenv("ARCHIVE_MAX_SIZE"))})
+		}
+	}
+	if data, err := state().Get(fetchJournalFile); err == nil {
+		buffers = append(buffers, buffer{"journal", int64(len(data)), 0})
+	}
+	if info, err := os.Stat(auditFile); err == nil {
+		buffers = append(buffers, buffer{"audit", info.Size(), 0})
+	}
+
+	fmt.Fprintln(w, "# HELP attendance_disk_usage_bytes Size of the local record store, archive, fetch journal and audit log.")
+	fmt.Fprintln(w, "# TYPE attendance_disk_usage_bytes gauge")
+	for _, b := range buffers {
+		fmt.Fprintf(w, "attendance_disk_usage_bytes{%s} %d\n", tenantLabel(fmt.Sprintf("buffer=%q", b.name)), b.usage)
+	}
+	fmt.Fprintln(w, "# HELP attendance_disk_limit_bytes Configured size limit of the local record store and archive.")
+	fmt.Fprintln(w, "# TYPE attendance_disk_limit_bytes gauge")
+	for _, b := range buffers {
+		if b.limit > 0 {
+			fmt.Fprintf(w, "attendance_disk_limit_bytes{%s} %d\n", tenantLabel(fmt.Sprintf("buffer=%q", b.name)), b.limit)
+		}
+	}
+}
+
+// noteSinkUnreachable marks a sink offline when a delivery fails without the sink answering,
+// as opposed to rejecting the records, and logs the switch to offline collection once
+func noteSinkUnreachable(name string, err error) {
+	if errors.Is(err, sink.ErrAPIRejected) || errors.Is(err, sink.ErrAuthFailed) || errors.Is(err, sink.ErrArchiveFull) {
+		return
+	}
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	s := sinkStatusLocked(name)
+	if s.OfflineSince != "" {
+		return
+	}
+	s.OfflineSince = time.Now().Format(time.RFC3339)
+	log.Printf("Sink %s is unreachable, collecting offline: records stay in the local store until it is back", name)
+}
+
+// sinkIsOffline reports whether a sink's last delivery could not reach it
+func sinkIsOffline(name string) bool {
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	return sinkStatusLocked(name).OfflineSince != ""
+}
+
+// noteSinkReachable clears a sink's offline mark after a successful delivery
+func noteSinkReachable(name string) {
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	s := sinkStatusLocked(name)
+	if s.OfflineSince == "" {
+		return
+	}
+	if since, err := time.Parse(time.RFC3339, s.OfflineSince); err == nil {
+		log.Printf("Sink %s is reachable again after %v offline", name, time.Since(since).Round(time.Second))
+	}
+	s.OfflineSince = ""
+}
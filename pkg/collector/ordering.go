@@ -0,0 +1,88 @@
+package collector
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Delivery orderings accepted by SINK_ORDERING
+const (
+	orderingDevice  = "device"  // Each device's records reach every sink in punch time order
+	orderingRelaxed = "relaxed" // New records go first and the backlog in BACKLOG_ORDER
+)
+
+// sinkOrdering returns the configured SINK_ORDERING. It defaults to per-device order, unless
+// BACKLOG_ORDER asks for lifo or newest-first, which only relaxed ordering honours: a setup
+// from before SINK_ORDERING keeps the delivery order it was configured for.
+func sinkOrdering() string {
+	switch ordering := strings.ToLower(os.Getenv("SINK_ORDERING")); ordering {
+	case "":
+		if os.Getenv("BACKLOG_ORDER") != "" && backlogOrder() != backlogFIFO {
+			return orderingRelaxed
+		}
+		return orderingDevice
+	case orderingDevice:
+		return orderingDevice
+	case orderingRelaxed:
+		return ordering
+	default:
+		log.Printf("Invalid SINK_ORDERING %q, defaulting to %s", ordering, orderingDevice)
+		return orderingDevice
+	}
+}
+
+// orderPending arranges a sink's pending records so each device's are delivered in punch
+// time order, across cycles, chunks and retries. A device with records in the backlog has
+// its new records held back behind them, so a batch that failed is sent again before
+// anything newer from the same device; other devices' new records still go first. Both
+// lists come back sorted by punch time, so any prefix of the backlog is the oldest records
+// of each device in it.
+func orderPending(fresh, backlog []storedRecord) ([]storedRecord, []storedRecord) {
+	behind := map[string]bool{}
+	for _, record := range backlog {
+		behind[record.Record.DeviceID] = true
+	}
+	var ready []storedRecord
+	for _, record := range fresh {
+		if behind[record.Record.DeviceID] {
+			backlog = append(backlog, record)
+		} else {
+			ready = append(ready, record)
+		}
+	}
+	sortByPunchTime(ready)
+	sortByPunchTime(backlog)
+	return ready, backlog
+}
+
+// sortByPunchTime sorts records by punch time, then by the order they were stored
+func sortByPunchTime(records []storedRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Record.Timestamp != records[j].Record.Timestamp {
+			return records[i].Record.Timestamp < records[j].Record.Timestamp
+		}
+		return records[i].Seq < records[j].Seq
+	})
+}
+
+// reportLateRecords logs, by device, pending records older than a punch of the same device
+// the sink already has. They can't be put back in order, as happens with manual punches,
+// imported history or a device clock set back, so they are delivered late.
+func reportLateRecords(sinkName string, newest map[string]string, pending []storedRecord) {
+	late := map[string]int{}
+	for _, record := range pending {
+		if last, ok := newest[record.Record.DeviceID]; ok && record.Record.Timestamp < last {
+			late[record.Record.DeviceID]++
+		}
+	}
+	devices := make([]string, 0, len(late))
+	for device := range late {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		log.Printf("Sink %s: %d record(s) of device %s are older than punches it already has and go out of order", sinkName, late[device], device)
+	}
+}
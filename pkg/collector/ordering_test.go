@@ -0,0 +1,25 @@
+package collector
+
+import "testing"
+
+func TestSinkOrdering(t *testing.T) {
+	tests := []struct {
+		ordering, backlog, want string
+	}{
+		{"", "", orderingDevice},
+		{"", backlogFIFO, orderingDevice},
+		{"", backlogLIFO, orderingRelaxed},
+		{"", backlogNewestFirst, orderingRelaxed},
+		{"", "sideways", orderingDevice},
+		{"device", backlogLIFO, orderingDevice},
+		{"Relaxed", "", orderingRelaxed},
+		{"strict", backlogLIFO, orderingDevice},
+	}
+	for _, tt := range tests {
+		t.Setenv("SINK_ORDERING", tt.ordering)
+		t.Setenv("BACKLOG_ORDER", tt.backlog)
+		if got := sinkOrdering(); got != tt.want {
+			t.Errorf("SINK_ORDERING=%q, BACKLOG_ORDER=%q: ordering %s, want %s", tt.ordering, tt.backlog, got, tt.want)
+		}
+	}
+}
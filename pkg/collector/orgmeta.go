@@ -0,0 +1,183 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// State key of the org metadata last fetched from ORG_URL, for starting offline
+const orgMetadataFile = "org_metadata.json"
+
+// RegisteredDevice is a terminal the backend has on record for the org
+type RegisteredDevice struct {
+	DeviceID string `json:"device_id"`
+	Serial   string `json:"serial,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Branch   string `json:"branch,omitempty"`
+}
+
+// OrgMetadata is the body of ORG_URL: the org as the backend knows it, with its registered
+// devices
+type OrgMetadata struct {
+	OrgID    string             `json:"org_id"`
+	Name     string             `json:"name,omitempty"`
+	Timezone string             `json:"timezone,omitempty"` // IANA name, e.g. Asia/Dhaka
+	Devices  []RegisteredDevice `json:"devices"`
+}
+
+// orgMetadataCache is the cached form of the org metadata
+type orgMetadataCache struct {
+	FetchedAt time.Time   `json:"fetched_at"`
+	Metadata  OrgMetadata `json:"metadata"`
+}
+
+// fetchOrgMetadata GETs the org metadata from ORG_URL
+func fetchOrgMetadata(url, apiKey string) (OrgMetadata, error) {
+	var meta OrgMetadata
+	req, err := sink.NewAPIRequest("GET", url, nil, apiKey)
+	if err != nil {
+		return meta, err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return meta, fmt.Errorf("failed to execute org metadata request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return meta, fmt.Errorf("org metadata request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return meta, fmt.Errorf("invalid org metadata response: %w", err)
+	}
+	return meta, nil
+}
+
+// cachedOrgMetadata returns the org metadata last fetched, if any
+func cachedOrgMetadata() (orgMetadataCache, bool) {
+	var cache orgMetadataCache
+	data, err := state().Get(orgMetadataFile)
+	if err != nil || data == nil {
+		return cache, false
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", orgMetadataFile, err)
+		return cache, false
+	}
+	return cache, true
+}
+
+// refreshOrgMetadata fetches the org metadata from ORG_URL and caches it. When the backend
+// can't be reached the cached copy is used.
+func refreshOrgMetadata() (OrgMetadata, bool) {
+	meta, err := fetchOrgMetadata(os.Getenv("ORG_URL"), os.Getenv("API_KEY"))
+	if err != nil {
+		log.Printf("Error fetching org metadata: %v", err)
+		cache, ok := cachedOrgMetadata()
+		if ok {
+			log.Printf("Using cached org metadata from %s", cache.FetchedAt.Format(time.RFC3339))
+		}
+		return cache.Metadata, ok
+	}
+	data, err := json.Marshal(orgMetadataCache{FetchedAt: time.Now(), Metadata: meta})
+	if err == nil {
+		err = state().Put(orgMetadataFile, data)
+	}
+	if err != nil {
+		log.Printf("Error caching org metadata: %v", err)
+	}
+	return meta, true
+}
+
+// orgMetadataProblems compares the local configuration with the backend's records: the org
+// ID, configured devices the backend doesn't know or knows with another serial number or
+// branch, registered devices not configured here, and the timezone
+func orgMetadataProblems(meta OrgMetadata, devices []deviceConfig) []string {
+	var problems []string
+	if orgID := os.Getenv("ORG_ID"); meta.OrgID != "" && orgID != meta.OrgID {
+		problems = append(problems, fmt.Sprintf("ORG_ID is %q but the backend answers for org %q", orgID, meta.OrgID))
+	}
+	registered := map[string]RegisteredDevice{}
+	for _, device := range meta.Devices {
+		registered[device.DeviceID] = device
+	}
+	pinned := loadDeviceSerials()
+	configured := map[string]bool{}
+	for _, device := range devices {
+		configured[device.ID] = true
+		known, ok := registered[device.ID]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("device %s is not registered with the backend", device.ID))
+			continue
+		}
+		serial := strings.TrimSpace(deviceEnv("DEVICE_SERIAL", device.ID))
+		if serial == "" {
+			serial = pinned[device.ID]
+		}
+		if known.Serial != "" && serial != "" && serial != known.Serial {
+			problems = append(problems, fmt.Sprintf("device %s has serial number %s but is registered with %s", device.ID, serial, known.Serial))
+		}
+		if branch := deviceBranch(device.ID); known.Branch != "" && branch != known.Branch {
+			problems = append(problems, fmt.Sprintf("device %s is in branch %s but is registered in %s", device.ID, branch, known.Branch))
+		}
+	}
+	var missing []string
+	for id := range registered {
+		if !configured[id] {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	for _, id := range missing {
+		problems = append(problems, fmt.Sprintf("registered device %s is not in DEVICE_IPS", id))
+	}
+	if problem := timezoneProblem("org", meta.Timezone); problem != "" {
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// timezoneProblem describes how an expected IANA time zone differs from this machine's,
+// which device timestamps are read in. It returns "" when they agree or none is expected.
+func timezoneProblem(what, timezone string) string {
+	if timezone == "" {
+		return ""
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return fmt.Sprintf("unknown %s timezone %q", what, timezone)
+	}
+	now := time.Now()
+	_, expected := now.In(loc).Zone()
+	if _, local := now.Zone(); expected != local {
+		return fmt.Sprintf("the %s is in %s but this machine's time zone is %s", what, timezone, now.Format("MST -07:00"))
+	}
+	return ""
+}
+
+// checkOrgMetadata fetches the org metadata at startup when ORG_URL is set and logs where
+// the local configuration disagrees with the backend
+func checkOrgMetadata() {
+	if os.Getenv("ORG_URL") == "" {
+		return
+	}
+	meta, ok := refreshOrgMetadata()
+	if !ok {
+		return
+	}
+	problems := orgMetadataProblems(meta, configuredDevices())
+	for _, problem := range problems {
+		log.Printf("Backend registration: %s", problem)
+	}
+	log.Printf("Org metadata: %s, %d registered device(s), %d problem(s)", meta.OrgID, len(meta.Devices), len(problems))
+}
@@ -0,0 +1,436 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// sinkPasses tracks delivery passes in flight, so one-shot commands can wait for them
+	sinkPasses sync.WaitGroup
+	// sinksBusy marks sinks with a pass in progress; a slow sink skips cycles instead of piling up
+	sinksBusy = struct {
+		sync.Mutex
+		names map[string]bool
+	}{names: map[string]bool{}}
+	// sinkPassErrors holds the error each sink's last pass ended with
+	sinkPassErrors = struct {
+		sync.Mutex
+		byName map[string]error
+	}{byName: map[string]error{}}
+)
+
+// dispatchSinks starts a delivery pass for every sink that isn't still busy with the last one.
+// Each sink delivers from its own offset, so a slow sink lags without holding up the others.
+// The passes are counted in cycle, which may be nil.
+func dispatchSinks(sinks []sink.Sink, freshFrom int64, cycle *syncCycle) {
+	for _, s := range sinks {
+		sinksBusy.Lock()
+		busy := sinksBusy.names[s.Name()]
+		sinksBusy.names[s.Name()] = true
+		sinksBusy.Unlock()
+		if busy {
+			log.Printf("Sink %s is still delivering the previous batch, skipping this cycle", s.Name())
+			continue
+		}
+
+		sinkPasses.Add(1)
+		if cycle != nil {
+			cycle.passes.Add(1)
+		}
+		go func(s sink.Sink) {
+			defer sinkPasses.Done()
+			if cycle != nil {
+				defer cycle.passes.Done()
+			}
+			defer func() {
+				sinksBusy.Lock()
+				delete(sinksBusy.names, s.Name())
+				sinksBusy.Unlock()
+			}()
+			err := runSinkPass(s, freshFrom, cycle)
+			sinkPassErrors.Lock()
+			sinkPassErrors.byName[s.Name()] = err
+			sinkPassErrors.Unlock()
+		}(s)
+	}
+}
+
+// runSinkPass delivers the records a sink hasn't received yet. Records stored at or after
+// freshFrom go first; the older backlog follows in BACKLOG_ORDER, BACKLOG_BATCH_SIZE at a time.
+// With SINK_ORDERING=device, the default, each device's records go in punch time order
+// instead, see orderPending, and BACKLOG_ORDER doesn't apply.
+func runSinkPass(s sink.Sink, freshFrom int64, cycle *syncCycle) error {
+	records, err := readStore()
+	if err != nil {
+		log.Printf("Sink %s: error reading record store: %v", s.Name(), err)
+		return err
+	}
+	progress, err := loadSinkProgress(s.Name())
+	if err != nil {
+		log.Printf("Sink %s: error loading offsets: %v", s.Name(), err)
+		return err
+	}
+
+	var fresh, backlog []storedRecord
+	newest := map[string]string{} // Latest punch delivered of each device
+	for _, record := range records {
+		switch {
+		case progress.isDelivered(record.Seq):
+			if record.Record.Timestamp > newest[record.Record.DeviceID] {
+				newest[record.Record.DeviceID] = record.Record.Timestamp
+			}
+		case record.Seq >= freshFrom:
+			fresh = append(fresh, record)
+		default:
+			backlog = append(backlog, record)
+		}
+	}
+	order := backlogOrder()
+	if sinkOrdering() == orderingDevice {
+		fresh, backlog = orderPending(fresh, backlog)
+		order = backlogFIFO
+		reportLateRecords(s.Name(), newest, append(append([]storedRecord(nil), fresh...), backlog...))
+	}
+
+	pending := len(fresh) + len(backlog)
+	defer func() { setSinkBacklog(s.Name(), pending) }()
+	wasOffline := sinkIsOffline(s.Name())
+
+	if len(fresh) > 0 {
+		log.Printf("Sink %s: sending %d new log(s)", s.Name(), len(fresh))
+		if err := deliverToSink(s, fresh, cycle); err != nil {
+			return err
+		}
+		pending -= len(fresh)
+		cycle.update(func(c *syncCycle) { c.delivered += len(fresh) })
+	}
+	// Normally one backlog batch goes per cycle; a sink back from being offline is sent
+	// everything it missed right away
+	for len(backlog) > 0 {
+		batch := nextBacklogBatch(backlog, order, backlogBatchSize())
+		log.Printf("Sink %s: flushing %d of %d backlog log(s)", s.Name(), len(batch), len(backlog))
+		if err := deliverToSink(s, batch, cycle); err != nil {
+			return err
+		}
+		pending -= len(batch)
+		cycle.update(func(c *syncCycle) { c.delivered += len(batch) })
+		if !wasOffline {
+			break
+		}
+		if backlog = withoutRecords(backlog, batch); len(backlog) == 0 {
+			log.Printf("Sink %s: offline backlog flushed", s.Name())
+		}
+	}
+	return nil
+}
+
+// withoutRecords returns the records not in batch
+func withoutRecords(records, batch []storedRecord) []storedRecord {
+	sent := map[int64]bool{}
+	for _, record := range batch {
+		sent[record.Seq] = true
+	}
+	var rest []storedRecord
+	for _, record := range records {
+		if !sent[record.Seq] {
+			rest = append(rest, record)
+		}
+	}
+	return rest
+}
+
+// lastSinkPassError returns the error of a sink whose last pass failed, checking sinks in name order
+func lastSinkPassError() error {
+	sinkPassErrors.Lock()
+	defer sinkPassErrors.Unlock()
+	names := make([]string, 0, len(sinkPassErrors.byName))
+	for name := range sinkPassErrors.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := sinkPassErrors.byName[name]; err != nil {
+			return fmt.Errorf("sink %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// deliverToSink sends stored records to a sink and advances its offset on success. Each
+// attempt gets a batch ID, sent with the cycle's sync ID to sinks that accept them.
+func deliverToSink(s sink.Sink, batch []storedRecord, cycle *syncCycle) error {
+	logs := make([]zk.AttendanceRecord, len(batch))
+	seqs := make([]int64, len(batch))
+	for i, record := range batch {
+		logs[i] = record.Record
+		seqs[i] = record.Seq
+	}
+
+	syncID, batchID := cycle.ID(), newCorrelationID()
+	var err error
+	if bs, ok := s.(sink.BatchSink); ok {
+		err = bs.SendBatch(sink.Batch{SyncID: syncID, BatchID: batchID, Logs: logs, Devices: batchDeviceStatus(logs)})
+	} else {
+		err = s.Send(logs)
+	}
+	copyToCanaries(s.Name(), logs, syncID, batchID, err)
+	if err != nil {
+		log.Printf("Sink %s: delivery failed: %v (code=%s sync_id=%s batch_id=%s)", s.Name(), err, countError(err), syncID, batchID)
+		recordSinkError(s.Name(), err)
+		noteSinkUnreachable(s.Name(), err)
+		return err
+	}
+	recordSinkSuccess(s.Name(), len(logs))
+	noteSinkReachable(s.Name())
+	observeDeliveryLag(s.Name(), logs, time.Now())
+	observeDelivered(s.Name(), len(logs), syncID, batchID)
+	if err := markSinkDelivered(s.Name(), seqs); err != nil {
+		log.Printf("Sink %s: error saving offsets: %v", s.Name(), err)
+		return err
+	}
+	details := batchAuditDetails(s.Name(), batch, logs)
+	details["sync_id"] = syncID
+	details["batch_id"] = batchID
+	if err := appendAudit("batch_delivered", details); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+	log.Printf("Sink %s: delivered %d log(s) (sync_id=%s batch_id=%s)", s.Name(), len(batch), syncID, batchID)
+	return nil
+}
+
+// batchAuditDetails describes a delivered batch for the audit log, including a digest and
+// Merkle root of its records so the delivered data can later be checked against the store
+func batchAuditDetails(sinkName string, batch []storedRecord, logs []zk.AttendanceRecord) map[string]interface{} {
+	data, _ := json.Marshal(logs)
+	digest := sha256.Sum256(data)
+	seqs := make([]int64, len(batch))
+	for i, record := range batch {
+		seqs[i] = record.Seq
+	}
+	details := map[string]interface{}{
+		"sink":   sinkName,
+		"count":  len(batch),
+		"seqs":   seqs,
+		"sha256": hex.EncodeToString(digest[:]),
+	}
+	// Backlog batches mix records from several cycles; list the cycles that read them
+	var readBy []string
+	seen := map[string]bool{}
+	for _, record := range batch {
+		if record.SyncID != "" && !seen[record.SyncID] {
+			seen[record.SyncID] = true
+			readBy = append(readBy, record.SyncID)
+		}
+	}
+	if len(readBy) > 0 {
+		details["read_sync_ids"] = readBy
+	}
+	// The Merkle root lets single punches be proven part of this batch later
+	if root, err := zk.MerkleRoot(logs); err == nil {
+		details["merkle_root"] = root
+	}
+	return details
+}
+
+// extraSinks are sinks added by an embedding program with RegisterSink
+var extraSinks = struct {
+	sync.Mutex
+	sinks []sink.Sink
+}{}
+
+// RegisterSink adds a sink that every sync delivers to, alongside the configured ones.
+// Its Name is also its key in the sink offsets, so it must be stable across restarts.
+func RegisterSink(s sink.Sink) {
+	extraSinks.Lock()
+	defer extraSinks.Unlock()
+	extraSinks.sinks = append(extraSinks.sinks, s)
+}
+
+// configuredSinks returns the sinks records are delivered to: the API, plus a local
+// archive when ARCHIVE_DIR is set, a GraphQL endpoint when GRAPHQL_URL is set, a WebSocket
+// stream when WEBSOCKET_URL is set, a SOAP service when SOAP_URL is set, a file drop when
+// FILEDROP_URL is set, the TEMPLATE_SINKS, and any registered by an embedding program.
+// Sinks in CANARY_SINKS are left out, to be sent copies of the primary sink's batches.
+func configuredSinks(orgID, apiURL, apiKey string) []sink.Sink {
+	version, err := sink.ParsePayloadVersion(os.Getenv("API_PAYLOAD_VERSION"))
+	if err != nil {
+		log.Printf("Invalid API_PAYLOAD_VERSION, sending v%d: %v", version, err)
+	}
+	api := &sink.APISink{OrgID: orgID, URL: apiURL, APIKey: apiKey, PayloadVersion: version}
+	api.Template, err = envTemplate("API_TEMPLATE")
+	api.ContentType = os.Getenv("API_CONTENT_TYPE")
+	sinks := []sink.Sink{api}
+	if err != nil {
+		// The records wait in the store rather than go out in a shape the endpoint rejects
+		sinks[0] = &failingSink{name: api.Name(), err: configError("%v", err)}
+	}
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		sinks = append(sinks, &sink.FileSink{
+			Dir:     dir,
+			MaxSize: parseByteSize("ARCHIVE_MAX_SIZE", os.Getenv("ARCHIVE_MAX_SIZE")),
+			Policy:  fullPolicy("ARCHIVE_FULL_POLICY"),
+		})
+	}
+	if url := os.Getenv("GRAPHQL_URL"); url != "" {
+		if s, err := graphQLSink(url, orgID, apiKey); err != nil {
+			log.Printf("GraphQL sink disabled: %v", err)
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	if url := os.Getenv("WEBSOCKET_URL"); url != "" {
+		sinks = append(sinks, webSocketSink(url, orgID, apiKey))
+	}
+	if url := os.Getenv("SOAP_URL"); url != "" {
+		sinks = append(sinks, soapSink(url, orgID))
+	}
+	if os.Getenv("FILEDROP_URL") != "" {
+		if s, err := fileDropSink(); err != nil {
+			log.Printf("File drop sink disabled: %v", err)
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	for _, label := range splitList(os.Getenv("TEMPLATE_SINKS")) {
+		if s, err := templateSink(label, orgID, apiKey); err != nil {
+			log.Printf("Template sink %s disabled: %v", label, err)
+		} else {
+			sinks = append(sinks, s)
+		}
+	}
+	extraSinks.Lock()
+	sinks = append(sinks, extraSinks.sinks...)
+	extraSinks.Unlock()
+	return splitCanaries(sinks)
+}
+
+// webSocketSinks keeps one WebSocket sink per URL, so its connection stays open across cycles
+var webSocketSinks = struct {
+	sync.Mutex
+	byURL map[string]*sink.WebSocketSink
+}{byURL: map[string]*sink.WebSocketSink{}}
+
+// webSocketSink returns the WebSocket sink streaming to url
+func webSocketSink(url, orgID, apiKey string) *sink.WebSocketSink {
+	webSocketSinks.Lock()
+	defer webSocketSinks.Unlock()
+	s, ok := webSocketSinks.byURL[url]
+	if !ok {
+		s = &sink.WebSocketSink{URL: url, APIKey: apiKey, OrgID: orgID}
+		webSocketSinks.byURL[url] = s
+	}
+	return s
+}
+
+// failingSink stands in for a sink whose configuration can't be read, failing every delivery
+type failingSink struct {
+	name string
+	err  error
+}
+
+func (s *failingSink) Name() string { return s.name }
+
+func (s *failingSink) Send(logs []zk.AttendanceRecord) error { return s.err }
+
+// envTemplate returns the payload template in key, or read from the file in key_FILE
+func envTemplate(key string) (string, error) {
+	text := os.Getenv(key)
+	if path := os.Getenv(key + "_FILE"); text == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_FILE: %w", key, err)
+		}
+		text = string(data)
+	}
+	return text, nil
+}
+
+// templateSink configures a TEMPLATE_SINKS entry from TEMPLATE_SINK_URL_<LABEL>,
+// TEMPLATE_SINK_TEMPLATE_<LABEL> (or TEMPLATE_SINK_TEMPLATE_<LABEL>_FILE) and
+// TEMPLATE_SINK_CONTENT_TYPE_<LABEL>
+func templateSink(label, orgID, apiKey string) (*sink.TemplateSink, error) {
+	suffix := envSuffix(label)
+	url := os.Getenv("TEMPLATE_SINK_URL_" + suffix)
+	if url == "" {
+		return nil, fmt.Errorf("TEMPLATE_SINK_URL_%s is not set", suffix)
+	}
+	text, err := envTemplate("TEMPLATE_SINK_TEMPLATE_" + suffix)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("TEMPLATE_SINK_TEMPLATE_%s is not set", suffix)
+	}
+	if _, err := sink.ParsePayloadTemplate(label, text); err != nil {
+		return nil, err
+	}
+	return &sink.TemplateSink{
+		Label:       label,
+		URL:         url,
+		APIKey:      apiKey,
+		OrgID:       orgID,
+		Template:    text,
+		ContentType: os.Getenv("TEMPLATE_SINK_CONTENT_TYPE_" + suffix),
+	}, nil
+}
+
+// soapSink configures the SOAP sink from SOAP_ACTION, SOAP_OPERATION, SOAP_NAMESPACE,
+// SOAP_VERSION, and SOAP_USERNAME, SOAP_PASSWORD and SOAP_PASSWORD_TYPE for WS-Security
+func soapSink(url, orgID string) *sink.SOAPSink {
+	return &sink.SOAPSink{
+		URL:            url,
+		OrgID:          orgID,
+		Action:         os.Getenv("SOAP_ACTION"),
+		Operation:      os.Getenv("SOAP_OPERATION"),
+		Namespace:      os.Getenv("SOAP_NAMESPACE"),
+		SOAP12:         strings.TrimSpace(os.Getenv("SOAP_VERSION")) == "1.2",
+		Username:       os.Getenv("SOAP_USERNAME"),
+		Password:       os.Getenv("SOAP_PASSWORD"),
+		PasswordDigest: strings.EqualFold(strings.TrimSpace(os.Getenv("SOAP_PASSWORD_TYPE")), "digest"),
+	}
+}
+
+// graphQLSink configures the GraphQL sink from GRAPHQL_QUERY (or GRAPHQL_QUERY_FILE),
+// GRAPHQL_VARIABLES, GRAPHQL_FIELDS and GRAPHQL_BATCH_SIZE
+func graphQLSink(url, orgID, apiKey string) (*sink.GraphQLSink, error) {
+	query := os.Getenv("GRAPHQL_QUERY")
+	if path := os.Getenv("GRAPHQL_QUERY_FILE"); query == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GRAPHQL_QUERY_FILE: %w", err)
+		}
+		query = string(data)
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil, errors.New("GRAPHQL_QUERY is not set")
+	}
+	variables, err := sink.ParseGraphQLMapping(os.Getenv("GRAPHQL_VARIABLES"), true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GRAPHQL_VARIABLES: %w", err)
+	}
+	fields, err := sink.ParseGraphQLMapping(os.Getenv("GRAPHQL_FIELDS"), false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GRAPHQL_FIELDS: %w", err)
+	}
+	return &sink.GraphQLSink{
+		URL:       url,
+		APIKey:    apiKey,
+		OrgID:     orgID,
+		Query:     query,
+		Variables: variables,
+		Fields:    fields,
+		BatchSize: parseCount("GRAPHQL_BATCH_SIZE", os.Getenv("GRAPHQL_BATCH_SIZE")),
+	}, nil
+}
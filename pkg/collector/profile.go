@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// Environment variable selecting a profile when --profile isn't given
+const profileEnv = "ATTENDANCE_PROFILE"
+
+// LoadConfig applies the configuration layers and returns the arguments left after the
+// global flags. Later layers win: built-in defaults, .env, .env.<profile>, the process
+// environment, then flags. The global flags, which come before the command, are:
+//
+//	--profile NAME   load .env.NAME over .env and keep state in profile-NAME/
+//	--set KEY=VALUE  override a setting, may be repeated
+//	--auto-discover  the same as --set AUTO_DISCOVER=true
+//	--chaos SPEC     the same as --set CHAOS=SPEC, for development only
+//
+// A profile runs in its own state directory, so e.g. a staging profile never marks records
+// as delivered for production. Relative paths in its settings are resolved from there.
+func LoadConfig(args []string) ([]string, error) {
+	profile := os.Getenv(profileEnv)
+	environ := os.Environ()
+	var overrides []string
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		flag, value, hasValue := args[0], "", false
+		if i := strings.Index(flag, "="); i >= 0 {
+			flag, value, hasValue = flag[:i], flag[i+1:], true
+		}
+		switch flag {
+		case "--auto-discover":
+			overrides = append(overrides, "AUTO_DISCOVER=true")
+			args = args[1:]
+			continue
+		case "--profile", "--set", "--chaos":
+		default:
+			return nil, configError(fmt.Sprintf("unknown flag %s", flag))
+		}
+		if !hasValue {
+			if len(args) < 2 {
+				return nil, configError(fmt.Sprintf("%s needs a value", flag))
+			}
+			value, args = args[1], args[1:]
+		}
+		args = args[1:]
+		if flag == "--profile" {
+			profile = value
+		} else if flag == "--chaos" {
+			overrides = append(overrides, "CHAOS="+value)
+		} else if !strings.Contains(value, "=") {
+			return nil, configError(fmt.Sprintf("--set %q is not KEY=VALUE", value))
+		} else {
+			overrides = append(overrides, value)
+		}
+	}
+
+	// godotenv never overrides a variable that is already set, so the profile file goes first
+	if profile != "" {
+		if strings.ContainsAny(profile, `/\`) || strings.HasPrefix(profile, ".") {
+			return nil, configError(fmt.Sprintf("invalid profile name %q", profile))
+		}
+		if err := godotenv.Load(".env." + profile); err != nil {
+			return nil, configError(fmt.Sprintf("profile %s: %v", profile, err))
+		}
+	}
+	if err := godotenv.Load(); err != nil {
+		log.Println("Info: No .env file found or error loading it. Using environment variables directly.", err)
+	}
+	for _, override := range overrides {
+		i := strings.Index(override, "=")
+		os.Setenv(override[:i], override[i+1:])
+	}
+	// Remote configuration sits between the files and the process environment
+	recordLocalSettings(environ, overrides)
+	recordInheritedSettings(environ, overrides)
+	// Values written by "config encrypt" are decrypted once every layer is in place
+	if err := decryptSettings(); err != nil {
+		return nil, err
+	}
+	if err := applyChaos(); err != nil {
+		return nil, err
+	}
+
+	if profile != "" {
+		dir := "profile-" + profile
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create profile directory: %w", err)
+		}
+		if err := os.Chdir(dir); err != nil {
+			return nil, fmt.Errorf("failed to enter profile directory: %w", err)
+		}
+		log.Printf("Using profile %s, state is kept in %s", profile, dir)
+	}
+	return args, nil
+}
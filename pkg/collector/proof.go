@@ -0,0 +1,135 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+)
+
+// deliveredBatch is the part of a batch_delivered audit entry needed for proofs
+type deliveredBatch struct {
+	Sink       string  `json:"sink"`
+	Seqs       []int64 `json:"seqs"`
+	MerkleRoot string  `json:"merkle_root"`
+}
+
+// deliveredBatches returns the batches recorded in the audit log for a sink
+func deliveredBatches(sink string) ([]deliveredBatch, error) {
+	entries, err := readAuditEntries()
+	if err != nil {
+		return nil, err
+	}
+	var batches []deliveredBatch
+	for _, entry := range entries {
+		if entry.Event != "batch_delivered" {
+			continue
+		}
+		var batch deliveredBatch
+		if err := json.Unmarshal(entry.Details, &batch); err == nil && batch.Sink == sink && batch.MerkleRoot != "" {
+			batches = append(batches, batch)
+		}
+	}
+	return batches, nil
+}
+
+// runProveCommand prints an inclusion proof that a punch was part of a delivered batch
+func runProveCommand(args []string) error {
+	fs := flag.NewFlagSet("prove", flag.ExitOnError)
+	userID := fs.Int("user", 0, "employee ID of the punch")
+	timeStr := fs.String("time", "", "punch time, e.g. \"2024-05-02 09:01:30\"")
+	sink := fs.String("sink", "api", "sink the punch was delivered to")
+	fs.Parse(args)
+
+	if *userID <= 0 {
+		return errors.New("--user is required")
+	}
+	punchTime, err := parsePunchTime(*timeStr)
+	if err != nil {
+		return err
+	}
+	timestamp := punchTime.Format(zk.TimestampLayout)
+
+	records, err := readStore()
+	if err != nil {
+		return err
+	}
+	bySeq := make(map[int64]zk.AttendanceRecord, len(records))
+	for _, record := range records {
+		bySeq[record.Seq] = record.Record
+	}
+
+	batches, err := deliveredBatches(*sink)
+	if err != nil {
+		return err
+	}
+	for _, batch := range batches {
+		logs := make([]zk.AttendanceRecord, 0, len(batch.Seqs))
+		index := -1
+		for _, seq := range batch.Seqs {
+			record, ok := bySeq[seq]
+			if !ok {
+				break
+			}
+			if record.UserID == *userID && record.Timestamp == timestamp && index < 0 {
+				index = len(logs)
+			}
+			logs = append(logs, record)
+		}
+		if index < 0 || len(logs) != len(batch.Seqs) {
+			continue
+		}
+
+		proof, err := zk.BuildProof(logs, index)
+		if err != nil {
+			return err
+		}
+		if proof.Root != batch.MerkleRoot {
+			return fmt.Errorf("stored records no longer match the audited batch root %s", batch.MerkleRoot)
+		}
+		data, err := json.MarshalIndent(proof, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	return fmt.Errorf("no delivered batch for sink %s contains a punch by user %d at %s", *sink, *userID, timestamp)
+}
+
+// runVerifyProofCommand checks an inclusion proof and whether its root was audited here
+func runVerifyProofCommand(args []string) error {
+	fs := flag.NewFlagSet("verify-proof", flag.ExitOnError)
+	path := fs.String("file", "", "proof JSON produced by the prove command")
+	fs.Parse(args)
+
+	if *path == "" {
+		return errors.New("--file is required")
+	}
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+	if !zk.VerifyProof(data) {
+		return errors.New("proof is invalid: the record does not hash to the claimed root")
+	}
+
+	var proof zk.InclusionProof
+	json.Unmarshal(data, &proof)
+	entries, err := readAuditEntries()
+	if err != nil {
+		log.Printf("Proof is valid; could not check the root against the audit log: %v", err)
+		return nil
+	}
+	for _, entry := range entries {
+		var batch deliveredBatch
+		if entry.Event == "batch_delivered" && json.Unmarshal(entry.Details, &batch) == nil && batch.MerkleRoot == proof.Root {
+			log.Printf("Proof is valid: punch by user %d at %s was delivered to %s at %s", proof.Record.UserID, proof.Record.Timestamp, batch.Sink, entry.Time)
+			return nil
+		}
+	}
+	return errors.New("proof is internally consistent but its root does not appear in this collector's audit log")
+}
@@ -0,0 +1,199 @@
+package collector
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runProvisionCommand brings the users of each device in line with the roster: employees
+// assigned to a device are created on it, or updated where their card or enabled state
+// differs, and inactive ones are disabled. The changes go through the device command queue,
+// so a device that drops off midway gets the rest on a later cycle. --dry-run only prints them.
+func runProvisionCommand(args []string) error {
+	fs := flag.NewFlagSet("provision", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the changes without making them")
+	fs.Parse(args)
+
+	if os.Getenv("ROSTER_URL") == "" {
+		return configError("ROSTER_URL is not set")
+	}
+	roster := loadRoster()
+	if roster == nil {
+		return errors.New("no roster available")
+	}
+
+	var queued []string
+	unread := 0
+	for _, device := range configuredDevices() {
+		users, err := readDeviceUsers(device)
+		if err != nil {
+			// Writing users blind would overwrite the names and privileges they have
+			log.Printf("Device %s: cannot read its users, skipping: %v", device.ID, err)
+			unread++
+			continue
+		}
+		plan := provisionPlan(device.ID, roster, users)
+		if len(plan) == 0 {
+			log.Printf("Device %s: up to date", device.ID)
+			continue
+		}
+		log.Printf("Device %s:", device.ID)
+		for _, cmd := range plan {
+			log.Printf("- %s", describeProvisionCommand(cmd))
+			if *dryRun {
+				continue
+			}
+			if err := queueDeviceCommand(cmd); err != nil {
+				return err
+			}
+			queued = append(queued, cmd.ID)
+		}
+	}
+	if *dryRun {
+		log.Println("Dry run: nothing was written to the devices.")
+	} else if len(queued) > 0 {
+		runDeviceCommandsJob(time.Now(), false)
+		if err := reportProvisioned(queued); err != nil {
+			return err
+		}
+	}
+	if unread > 0 {
+		return fmt.Errorf("%d device(s) could not be read and were not provisioned", unread)
+	}
+	return nil
+}
+
+// readDeviceUsers reads the users enrolled on a device, as a job holding it
+func readDeviceUsers(device deviceConfig) ([]zk.User, error) {
+	var users []zk.User
+	err := runJob(&job{group: jobGroupMaintenance, name: "read users " + device.ID, devices: []string{device.ID}, run: func() error {
+		zkManager, err := newDeviceManager(device)
+		if err != nil {
+			return err
+		}
+		users, err = zkManager.GetUsers()
+		return err
+	}})
+	return users, err
+}
+
+// provisionPlan returns the add_user and disable_user commands that bring a device's users
+// in line with the roster. Existing users keep their name and privileges.
+func provisionPlan(deviceID string, roster []RosterEmployee, users []zk.User) []DeviceCommand {
+	byID := map[int]zk.User{}
+	byCard := map[uint32]zk.User{}
+	for _, user := range users {
+		byID[user.UserID] = user
+		if user.CardNumber != 0 {
+			byCard[user.CardNumber] = user
+		}
+	}
+	match := deviceEnv("ROSTER_MATCH", deviceID)
+
+	var plan []DeviceCommand
+	for _, employee := range roster {
+		if !employee.assignedTo(deviceID) {
+			continue
+		}
+		var card uint32
+		if employee.CardNumber != "" {
+			n, err := strconv.ParseUint(employee.CardNumber, 10, 32)
+			if err != nil {
+				log.Printf("Device %s: employee %d has card %q, which the terminal can't hold; leaving the card out", deviceID, employee.EmployeeID, employee.CardNumber)
+			}
+			card = uint32(n)
+		}
+		userID := employee.EmployeeID
+		if match == "badge_number" {
+			n, err := strconv.Atoi(employee.BadgeNumber)
+			if err != nil {
+				log.Printf("Device %s: employee %d has no numeric badge number, skipping", deviceID, employee.EmployeeID)
+				continue
+			}
+			userID = n
+		}
+		user, enrolled := byID[userID]
+		if match == "card_number" && card != 0 {
+			if u, ok := byCard[card]; ok {
+				user, enrolled = u, true
+			}
+		}
+
+		if !employee.Active {
+			if enrolled && !user.Disabled() {
+				plan = append(plan, newDeviceCommand(deviceID, actionDisableUser, map[string]string{"user": strconv.Itoa(user.UserID)}))
+			}
+			continue
+		}
+		if !enrolled {
+			user = zk.User{UserID: userID}
+		} else if !user.Disabled() && (card == 0 || user.CardNumber == card) {
+			continue
+		}
+		if card != 0 {
+			user.CardNumber = card
+		}
+		plan = append(plan, newDeviceCommand(deviceID, actionAddUser, map[string]string{
+			"user":      strconv.Itoa(user.UserID),
+			"name":      user.Name,
+			"card":      strconv.FormatUint(uint64(user.CardNumber), 10),
+			"privilege": strconv.Itoa(user.Privilege &^ zk.PrivilegeDisabled),
+		}))
+	}
+	return plan
+}
+
+// describeProvisionCommand says what a provisioning command changes
+func describeProvisionCommand(cmd DeviceCommand) string {
+	if cmd.Action == actionDisableUser {
+		return "disable user " + cmd.Args["user"]
+	}
+	if cmd.Args["card"] == "0" {
+		return fmt.Sprintf("write user %s (no card)", cmd.Args["user"])
+	}
+	return fmt.Sprintf("write user %s with card %s", cmd.Args["user"], cmd.Args["card"])
+}
+
+// reportProvisioned logs how the queued provisioning commands went, and fails if any did
+func reportProvisioned(ids []string) error {
+	commands, err := loadDeviceCommands()
+	if err != nil {
+		return err
+	}
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	counts := map[string]int{}
+	for _, cmd := range commands {
+		if wanted[cmd.ID] {
+			counts[cmd.Status]++
+		}
+	}
+	log.Printf("Provisioning: %d change(s) made, %d failed, %d waiting for their device (see device-command list)",
+		counts[commandDone], counts[commandFailed], counts[commandPending])
+	if counts[commandFailed] > 0 {
+		return fmt.Errorf("%d provisioning change(s) failed", counts[commandFailed])
+	}
+	return nil
+}
+
+// assignedTo reports whether the employee should be enrolled on the device.
+// Employees without a device list belong on every device.
+func (e RosterEmployee) assignedTo(deviceID string) bool {
+	if len(e.Devices) == 0 {
+		return true
+	}
+	for _, d := range e.Devices {
+		if d == deviceID {
+			return true
+		}
+	}
+	return false
+}
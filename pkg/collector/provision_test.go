@@ -0,0 +1,117 @@
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"old-attendance/pkg/zk"
+)
+
+// describePlan lists a plan as describeProvisionCommand puts it
+func describePlan(plan []DeviceCommand) []string {
+	var changes []string
+	for _, cmd := range plan {
+		changes = append(changes, describeProvisionCommand(cmd))
+	}
+	return changes
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProvisionPlan(t *testing.T) {
+	roster := []RosterEmployee{
+		{EmployeeID: 1, BadgeNumber: "101", CardNumber: "5551", Active: true},         // Enrolled as is
+		{EmployeeID: 2, BadgeNumber: "102", CardNumber: "5552", Active: true},         // Card changed
+		{EmployeeID: 3, BadgeNumber: "103", Active: true},                             // Missing
+		{EmployeeID: 4, BadgeNumber: "104", Active: false},                            // To disable
+		{EmployeeID: 5, BadgeNumber: "105", Active: false},                            // Not enrolled
+		{EmployeeID: 6, BadgeNumber: "106", Active: true},                             // Disabled, to enable
+		{EmployeeID: 7, BadgeNumber: "107", Active: true, Devices: []string{"yard"}},  // Other device
+		{EmployeeID: 8, BadgeNumber: "108", CardNumber: "not a number", Active: true}, // Card left out
+	}
+	users := []zk.User{
+		{UserID: 1, Name: "Ada", CardNumber: 5551},
+		{UserID: 2, Name: "Bo", CardNumber: 4000, Privilege: 14},
+		{UserID: 4, Name: "Cy"},
+		{UserID: 6, Name: "Di", Privilege: zk.PrivilegeDisabled},
+	}
+	t.Setenv("ROSTER_MATCH", "")
+	plan := provisionPlan("gate", roster, users)
+	want := []string{"write user 2 with card 5552", "write user 3 (no card)", "disable user 4", "write user 6 (no card)", "write user 8 (no card)"}
+	if got := describePlan(plan); !equalStrings(got, want) {
+		t.Fatalf("provisionPlan = %q, want %q", got, want)
+	}
+	// Existing users keep their name and privileges, less the disabled bit
+	if plan[0].Args["name"] != "Bo" || plan[0].Args["privilege"] != "14" {
+		t.Errorf("updated user args = %v, want name Bo and privilege 14", plan[0].Args)
+	}
+	if plan[3].Args["name"] != "Di" || plan[3].Args["privilege"] != "0" {
+		t.Errorf("enabled user args = %v, want name Di and privilege 0", plan[3].Args)
+	}
+	ids := map[string]bool{}
+	for _, cmd := range plan {
+		if ids[cmd.ID] {
+			t.Errorf("command ID %s is not unique", cmd.ID)
+		}
+		ids[cmd.ID] = true
+	}
+
+	t.Setenv("ROSTER_MATCH", "badge_number")
+	plan = provisionPlan("gate", roster[:3], []zk.User{{UserID: 101, CardNumber: 5551}})
+	want = []string{"write user 102 with card 5552", "write user 103 (no card)"}
+	if got := describePlan(plan); !equalStrings(got, want) {
+		t.Errorf("provisionPlan by badge number = %q, want %q", got, want)
+	}
+}
+
+func TestProvisionApplies(t *testing.T) {
+	inStateDir(t)
+	roster := []RosterEmployee{
+		{EmployeeID: 1, CardNumber: "5551", Active: true},
+		{EmployeeID: 2, Active: false},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(roster)
+	}))
+	defer server.Close()
+	t.Setenv("ROSTER_URL", server.URL)
+	sim := startSimulator(t)
+	sim.SetUsers([]zk.User{{UserID: 2, Name: "Bo"}})
+	t.Setenv("DEVICE_IPS", simulatorEntry("gate", sim))
+
+	if err := runProvisionCommand([]string{"--dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	if users := sim.Users(); len(users) != 1 || users[0].Disabled() {
+		t.Fatalf("dry run changed the users: %+v", users)
+	}
+	if err := runProvisionCommand(nil); err != nil {
+		t.Fatal(err)
+	}
+	got := map[int]zk.User{}
+	for _, user := range sim.Users() {
+		got[user.UserID] = user
+	}
+	if user, ok := got[1]; !ok || user.CardNumber != 5551 || user.Disabled() {
+		t.Errorf("user 1 = %+v, want enrolled with card 5551", user)
+	}
+	if user := got[2]; !user.Disabled() || user.Name != "Bo" {
+		t.Errorf("user 2 = %+v, want Bo disabled", user)
+	}
+	// A second run finds nothing to change
+	if plan := provisionPlan("gate", roster, sim.Users()); len(plan) != 0 {
+		t.Errorf("plan after provisioning = %q, want none", describePlan(plan))
+	}
+}
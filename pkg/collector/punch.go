@@ -0,0 +1,130 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"strings"
+	"time"
+)
+
+// File holding manual punches waiting to be sent with the next sync
+const manualPunchesFile = "manual_punches.json"
+
+// Accepted layouts for the --time flag of "punch add"
+var punchTimeLayouts = []string{
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+	zk.TimestampLayout,
+}
+
+// runPunchCommand handles the "punch" subcommands
+func runPunchCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: punch add --user ID --time \"YYYY-MM-DD HH:MM\" [--device NAME] --reason TEXT")
+	}
+	switch args[0] {
+	case "add":
+		return addManualPunch(args[1:])
+	default:
+		return fmt.Errorf("unknown punch command %q", args[0])
+	}
+}
+
+// addManualPunch queues an operator-entered punch for the next sync and records it in the audit log
+func addManualPunch(args []string) error {
+	fs := flag.NewFlagSet("punch add", flag.ExitOnError)
+	userID := fs.Int("user", 0, "employee ID the punch belongs to")
+	timeStr := fs.String("time", "", "punch time, e.g. \"2024-05-02 09:01\"")
+	device := fs.String("device", "", "device the punch should be attributed to")
+	reason := fs.String("reason", "", "why the punch is entered manually")
+	fs.Parse(args)
+
+	if *userID <= 0 {
+		return errors.New("--user is required")
+	}
+	if strings.TrimSpace(*reason) == "" {
+		return errors.New("--reason is required for manual punches")
+	}
+	punchTime, err := parsePunchTime(*timeStr)
+	if err != nil {
+		return err
+	}
+
+	record := zk.AttendanceRecord{
+		UserID:    *userID,
+		Timestamp: punchTime.Format(zk.TimestampLayout),
+		DeviceID:  *device,
+		Manual:    true,
+		Reason:    *reason,
+	}
+
+	pending, err := loadManualPunches()
+	if err != nil {
+		return err
+	}
+	if err := saveManualPunches(append(pending, record)); err != nil {
+		return fmt.Errorf("failed to queue manual punch: %w", err)
+	}
+	if err := appendAudit("manual_punch_added", record); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+
+	log.Printf("Manual punch for user %d at %s queued for the next sync", record.UserID, record.Timestamp)
+	return nil
+}
+
+// parsePunchTime parses a manual punch time in the local timezone
+func parsePunchTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, errors.New("--time is required")
+	}
+	for _, layout := range punchTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --time %q, expected format \"YYYY-MM-DD HH:MM\"", value)
+}
+
+// loadManualPunches reads the queued manual punches, returning none if nothing is queued
+func loadManualPunches() ([]zk.AttendanceRecord, error) {
+	data, err := state().Get(manualPunchesFile)
+	if data == nil && err == nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", manualPunchesFile, err)
+	}
+	var records []zk.AttendanceRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", manualPunchesFile, err)
+	}
+	return records, nil
+}
+
+// saveManualPunches overwrites the manual punch queue
+func saveManualPunches(records []zk.AttendanceRecord) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return state().Put(manualPunchesFile, data)
+}
+
+// dropManualPunches removes the first n queued punches once they have been delivered,
+// keeping any that were added while the sync was running
+func dropManualPunches(n int) error {
+	pending, err := loadManualPunches()
+	if err != nil {
+		return err
+	}
+	if n >= len(pending) {
+		return state().Delete(manualPunchesFile)
+	}
+	return saveManualPunches(pending[n:])
+}
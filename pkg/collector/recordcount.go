@@ -0,0 +1,136 @@
+package collector
+
+import (
+	"encoding/json"
+	"log"
+	"old-attendance/pkg/zk"
+	"sync"
+	"time"
+)
+
+// State key of the record counter each device had at its last stored read
+const recordCountersFile = "record_counters.json"
+
+// Minutes a device's read may be skipped on an unchanged counter before it is read in full
+// anyway, unless RECORD_COUNTER_MAX_AGE says otherwise
+const defaultRecordCounterMaxAge = 60
+
+// recordCountersMu serializes updates of the stored counters by sync cycles and by commands
+// clearing a device's log
+var recordCountersMu sync.Mutex
+
+// recordCounter is what a device's storage counters said when it was last read in full
+type recordCounter struct {
+	Records  int       `json:"records"`
+	Capacity int       `json:"capacity"`
+	Read     time.Time `json:"read"` // When the device was last read in full
+}
+
+// loadRecordCounters returns the stored record counter of each device
+func loadRecordCounters() map[string]recordCounter {
+	counters := map[string]recordCounter{}
+	data, err := state().Get(recordCountersFile)
+	if err != nil || data == nil {
+		return counters
+	}
+	var stored map[string]json.RawMessage
+	if err := json.Unmarshal(data, &stored); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", recordCountersFile, err)
+		return counters
+	}
+	for id, value := range stored {
+		var counter recordCounter
+		if err := json.Unmarshal(value, &counter); err != nil {
+			// Counts stored as bare numbers by older versions carry no read time, so the
+			// device is read in full once
+			continue
+		}
+		counters[id] = counter
+	}
+	return counters
+}
+
+// saveRecordCounters stores the record counters; the caller holds recordCountersMu
+func saveRecordCounters(counters map[string]recordCounter) {
+	data, err := json.Marshal(counters)
+	if err == nil {
+		err = state().Put(recordCountersFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving record counters: %v", err)
+	}
+}
+
+// checkRecordCount reads the device's record counter when RECORD_COUNTER_CHECK is on for it,
+// and reports whether the device has nothing new: its log is empty, or the count and capacity
+// match those of its last full read, which is no older than RECORD_COUNTER_MAX_AGE. Records
+// is -1 when the check is off or could not be made, leaving the full read to decide. A full
+// log keeps its count while old records are overwritten, so it never matches.
+func checkRecordCount(zkManager *zk.ZKManager, deviceID string, counters map[string]recordCounter) (recordCounter, bool) {
+	unknown := recordCounter{Records: -1}
+	if counters == nil || !deviceEnvBool("RECORD_COUNTER_CHECK", deviceID) {
+		return unknown, false
+	}
+	records, capacity, err := zkManager.GetRecordCount()
+	if err != nil {
+		log.Printf("Could not read record count from %s, reading full log: %v", deviceID, err)
+		return unknown, false
+	}
+	if capacity > 0 && records >= capacity {
+		return unknown, false
+	}
+	counter := recordCounter{Records: records, Capacity: capacity, Read: time.Now()}
+	if records == 0 {
+		return counter, true
+	}
+	stored, ok := counters[deviceID]
+	if !ok || stored.Records != records || stored.Capacity != capacity {
+		return counter, false
+	}
+	maxAge := deviceEnvInt("RECORD_COUNTER_MAX_AGE", deviceID)
+	if maxAge == 0 {
+		maxAge = defaultRecordCounterMaxAge
+	}
+	if time.Since(stored.Read) >= time.Duration(maxAge)*time.Minute {
+		return counter, false
+	}
+	// The skipped read keeps the time of the last full one
+	counter.Read = stored.Read
+	return counter, true
+}
+
+// commitRecordCounters saves the record counters taken this cycle once its records are stored,
+// so a batch that failed to store is read again in full
+func commitRecordCounters(cycle *syncCycle) {
+	if cycle == nil {
+		return
+	}
+	recordCountersMu.Lock()
+	defer recordCountersMu.Unlock()
+	counters := loadRecordCounters()
+	changed := false
+	cycle.update(func(c *syncCycle) {
+		for id, counter := range c.recordCounts {
+			if stored, ok := counters[id]; !ok || stored != counter {
+				counters[id] = counter
+				changed = true
+			}
+		}
+	})
+	if changed {
+		saveRecordCounters(counters)
+	}
+}
+
+// forgetRecordCounter drops a device's stored counter, so its next read is a full one. Its
+// log is about to be cleared, and refilled to the same count it would look unchanged.
+func forgetRecordCounter(deviceID string) {
+	recordCountersMu.Lock()
+	defer recordCountersMu.Unlock()
+	counters := loadRecordCounters()
+	if _, ok := counters[deviceID]; !ok {
+		return
+	}
+	delete(counters, deviceID)
+	saveRecordCounters(counters)
+}
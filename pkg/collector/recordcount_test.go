@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"old-attendance/pkg/zk"
+)
+
+func TestCheckRecordCount(t *testing.T) {
+	inStateDir(t)
+	t.Setenv("RECORD_COUNTER_CHECK", "true")
+	now := time.Now()
+	sim := startSimulator(t,
+		zk.SimulatedPunch{UserID: 1, Time: now.Add(-time.Hour)},
+		zk.SimulatedPunch{UserID: 2, Time: now.Add(-time.Minute)})
+	records, capacity, err := sim.Manager().GetRecordCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent := now.Add(-10 * time.Minute)
+
+	tests := []struct {
+		name      string
+		stored    map[string]recordCounter
+		unchanged bool
+	}{
+		{"no stored counter", map[string]recordCounter{}, false},
+		{"same count", map[string]recordCounter{"gate": {records, capacity, recent}}, true},
+		{"other count", map[string]recordCounter{"gate": {records - 1, capacity, recent}}, false},
+		{"other capacity", map[string]recordCounter{"gate": {records, capacity + 1, recent}}, false},
+		{"full read too old", map[string]recordCounter{"gate": {records, capacity, now.Add(-2 * time.Hour)}}, false},
+	}
+	for _, tt := range tests {
+		counter, unchanged := checkRecordCount(sim.Manager(), "gate", tt.stored)
+		if unchanged != tt.unchanged {
+			t.Errorf("%s: unchanged = %v, want %v", tt.name, unchanged, tt.unchanged)
+		}
+		if counter.Records != records {
+			t.Errorf("%s: records = %d, want %d", tt.name, counter.Records, records)
+		}
+		if unchanged && !counter.Read.Equal(recent) {
+			t.Errorf("%s: a skipped read moved the full read time to %v", tt.name, counter.Read)
+		}
+	}
+
+	t.Setenv("RECORD_COUNTER_MAX_AGE", "180")
+	stored := map[string]recordCounter{"gate": {records, capacity, now.Add(-2 * time.Hour)}}
+	if _, unchanged := checkRecordCount(sim.Manager(), "gate", stored); !unchanged {
+		t.Errorf("full read within RECORD_COUNTER_MAX_AGE was not skipped")
+	}
+}
+
+func TestClearLogsForgetsRecordCounter(t *testing.T) {
+	inStateDir(t)
+	sim := startSimulator(t, zk.SimulatedPunch{UserID: 1, Time: time.Now().Add(-time.Hour)})
+	device, err := parseDevice(simulatorEntry("gate", sim))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordCountersMu.Lock()
+	saveRecordCounters(map[string]recordCounter{
+		"gate":  {Records: 1, Capacity: 100, Read: time.Now()},
+		"other": {Records: 5, Capacity: 100, Read: time.Now()},
+	})
+	recordCountersMu.Unlock()
+
+	if err := executeDeviceCommand(device, newDeviceCommand("gate", actionClearLogs, nil)); err != nil {
+		t.Fatal(err)
+	}
+	counters := loadRecordCounters()
+	if _, ok := counters["gate"]; ok {
+		t.Errorf("counter of the cleared device was kept")
+	}
+	if _, ok := counters["other"]; !ok {
+		t.Errorf("counter of another device was dropped")
+	}
+	if len(sim.Punches()) != 0 {
+		t.Errorf("device log was not cleared")
+	}
+}
+
+func TestLoadRecordCountersOldFormat(t *testing.T) {
+	inStateDir(t)
+	if err := state().Put(recordCountersFile, []byte(`{"gate":12,"new":{"records":3,"capacity":100}}`)); err != nil {
+		t.Fatal(err)
+	}
+	counters := loadRecordCounters()
+	if _, ok := counters["gate"]; ok {
+		t.Errorf("a bare count was taken for a counter")
+	}
+	if counters["new"].Records != 3 {
+		t.Errorf("counter = %+v, want 3 records", counters["new"])
+	}
+}
@@ -0,0 +1,278 @@
+package collector
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// recordQuery selects records of the local record store
+type recordQuery struct {
+	users   map[int]bool    // Employee IDs, all when empty
+	devices map[string]bool // Device IDs, all when empty
+	from    string          // First timestamp, in zk.TimestampLayout; none when empty
+	to      string          // Last timestamp, likewise
+	flag    string          // Only records with this flag, e.g. "late_punch"
+	pending bool            // Only records some sink hasn't delivered
+	limit   int             // Most recent records kept, all when 0
+}
+
+// queriedRecord is a stored record found by a query, with the sinks yet to deliver it
+type queriedRecord struct {
+	Seq      int64  `json:"seq"`
+	StoredAt string `json:"stored_at"`
+	SyncID   string `json:"sync_id,omitempty"`
+	zk.AttendanceRecord
+	PendingSinks []string `json:"pending_sinks,omitempty"`
+}
+
+// Output formats of a records query
+const (
+	queryFormatTable = "table"
+	queryFormatJSON  = "json"
+	queryFormatCSV   = "csv"
+)
+
+// newRecordQuery builds a query from its textual filters: comma-separated users and
+// devices, and from and to as YYYY-MM-DD or YYYY-MM-DDTHH:MM[:SS] (a space works too). A
+// day alone as to includes the whole day.
+func newRecordQuery(users, devices, from, to, flag string, pending bool, limit int) (recordQuery, error) {
+	q := recordQuery{users: map[int]bool{}, devices: map[string]bool{}, flag: flag, pending: pending, limit: limit}
+	for _, user := range splitList(users) {
+		id, err := strconv.Atoi(user)
+		if err != nil {
+			return q, fmt.Errorf("invalid user %q, expected an employee ID", user)
+		}
+		q.users[id] = true
+	}
+	for _, device := range splitList(devices) {
+		q.devices[device] = true
+	}
+	var err error
+	if q.from, err = queryBound(from, "00:00:00"); err != nil {
+		return q, fmt.Errorf("invalid from: %w", err)
+	}
+	if q.to, err = queryBound(to, "23:59:59"); err != nil {
+		return q, fmt.Errorf("invalid to: %w", err)
+	}
+	if q.from != "" && q.to != "" && q.to < q.from {
+		return q, errors.New("to is before from")
+	}
+	if limit < 0 {
+		return q, errors.New("limit must not be negative")
+	}
+	return q, nil
+}
+
+// queryBound normalizes a time bound to zk.TimestampLayout, completing a day alone with
+// clock, and a time without seconds with clock's seconds
+func queryBound(value, clock string) (string, error) {
+	value = strings.Replace(strings.TrimSpace(value), " ", "T", 1)
+	switch len(value) {
+	case 0:
+		return "", nil
+	case len("2006-01-02"):
+		value += "T" + clock
+	case len("2006-01-02T15:04"):
+		value += clock[len("15:04"):]
+	}
+	if _, err := time.Parse(zk.TimestampLayout, value); err != nil {
+		return "", fmt.Errorf("%q, expected YYYY-MM-DD or YYYY-MM-DDTHH:MM[:SS]", value)
+	}
+	return value, nil
+}
+
+// matches reports whether a record passes the query's filters other than pending
+func (q recordQuery) matches(record zk.AttendanceRecord) bool {
+	if len(q.users) > 0 && !q.users[record.UserID] {
+		return false
+	}
+	if len(q.devices) > 0 && !q.devices[record.DeviceID] {
+		return false
+	}
+	t := queryTime(record)
+	if q.from != "" && t < q.from {
+		return false
+	}
+	if q.to != "" && t > q.to {
+		return false
+	}
+	return q.flag == "" || containsString(record.Flags, q.flag)
+}
+
+// queryTime is a record's timestamp in the form query bounds are, so that they compare as
+// strings; records written before the layout had the T have a space
+func queryTime(record zk.AttendanceRecord) string {
+	return strings.Replace(record.Timestamp, " ", "T", 1)
+}
+
+// queryRecords runs a query against the record store, oldest punch first. Records removed
+// by STORE_RETENTION are no longer found.
+func queryRecords(q recordQuery) ([]queriedRecord, error) {
+	records, err := readStore()
+	if err != nil {
+		return nil, err
+	}
+	storeMu.Lock()
+	progress, err := readSinkOffsetsLocked()
+	storeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	sinks := configuredSinks(os.Getenv("ORG_ID"), os.Getenv("API_URL"), os.Getenv("API_KEY"))
+
+	var found []queriedRecord
+	for _, stored := range records {
+		if !q.matches(stored.Record) {
+			continue
+		}
+		result := queriedRecord{Seq: stored.Seq, StoredAt: stored.StoredAt, SyncID: stored.SyncID, AttendanceRecord: stored.Record}
+		for _, s := range sinks {
+			if p, ok := progress[s.Name()]; !ok || !p.isDelivered(stored.Seq) {
+				result.PendingSinks = append(result.PendingSinks, s.Name())
+			}
+		}
+		if q.pending && len(result.PendingSinks) == 0 {
+			continue
+		}
+		found = append(found, result)
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return queryTime(found[i].AttendanceRecord) < queryTime(found[j].AttendanceRecord)
+	})
+	if q.limit > 0 && len(found) > q.limit {
+		found = found[len(found)-q.limit:]
+	}
+	return found, nil
+}
+
+// writeQueriedRecords writes query results in a format: an aligned table, JSON or CSV
+func writeQueriedRecords(w io.Writer, found []queriedRecord, format string) error {
+	switch format {
+	case queryFormatJSON:
+		if found == nil {
+			found = []queriedRecord{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(found)
+	case queryFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"seq", "timestamp", "employee_id", "device_id", "status", "flags", "stored_at", "sync_id", "pending_sinks"})
+		for _, r := range found {
+			cw.Write([]string{strconv.FormatInt(r.Seq, 10), r.Timestamp, strconv.Itoa(r.UserID), r.DeviceID, r.Status,
+				strings.Join(r.Flags, ";"), r.StoredAt, r.SyncID, strings.Join(r.PendingSinks, ";")})
+		}
+		cw.Flush()
+		return cw.Error()
+	case queryFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, tr("TIME\tUSER\tDEVICE\tSTATUS\tFLAGS\tDELIVERED"))
+		for _, r := range found {
+			delivered := tr("yes")
+			if len(r.PendingSinks) > 0 {
+				delivered = tr("pending: %s", strings.Join(r.PendingSinks, ", "))
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", r.Timestamp, r.UserID, dashIfEmpty(r.DeviceID), dashIfEmpty(r.Status),
+				dashIfEmpty(strings.Join(r.Flags, ",")), delivered)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintln(w, tr("%d record(s)", len(found)))
+		return err
+	default:
+		return fmt.Errorf("unknown format %q, use table, json or csv", format)
+	}
+}
+
+// dashIfEmpty fills an empty table cell
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runRecordsCommand handles the records subcommands
+func runRecordsCommand(args []string) error {
+	if len(args) == 0 || args[0] != "query" {
+		return errors.New("usage: records query [--user ID,...] [--device ID,...] [--from TIME] [--to TIME] [--flag FLAG] [--pending] [--limit N] [--format table|json|csv]")
+	}
+	fs := flag.NewFlagSet("records query", flag.ExitOnError)
+	users := fs.String("user", "", "employee IDs, comma-separated")
+	devices := fs.String("device", "", "device IDs, comma-separated")
+	from := fs.String("from", "", "first day or time, YYYY-MM-DD or YYYY-MM-DDTHH:MM")
+	to := fs.String("to", "", "last day or time, YYYY-MM-DD or YYYY-MM-DDTHH:MM")
+	flagName := fs.String("flag", "", "only records with this flag, e.g. late_punch")
+	pending := fs.Bool("pending", false, "only records a sink has yet to deliver")
+	limit := fs.Int("limit", 0, "show only the latest N records")
+	format := fs.String("format", queryFormatTable, "table, json or csv")
+	fs.Parse(args[1:])
+
+	q, err := newRecordQuery(*users, *devices, *from, *to, *flagName, *pending, *limit)
+	if err != nil {
+		return err
+	}
+	found, err := queryRecords(q)
+	if err != nil {
+		return err
+	}
+	return writeQueriedRecords(os.Stdout, found, *format)
+}
+
+// handleRecords serves a records query: GET /api/records?user=&device=&from=&to=&flag=
+// &pending=true&limit=&format=json|csv. Records are personal data, so ADMIN_TOKEN applies.
+func handleRecords(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !adminAuthorized(w, r) {
+		return
+	}
+	params := r.URL.Query()
+	limit := 0
+	if value := params.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	q, err := newRecordQuery(params.Get("user"), params.Get("device"), params.Get("from"), params.Get("to"),
+		params.Get("flag"), isTrue(params.Get("pending")), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := params.Get("format")
+	switch format {
+	case "", queryFormatJSON:
+		format = queryFormatJSON
+		w.Header().Set(contentTypeHeader, jsonContentType)
+	case queryFormatCSV:
+		w.Header().Set(contentTypeHeader, "text/csv; charset=utf-8")
+	default:
+		http.Error(w, "unknown format, use json or csv", http.StatusBadRequest)
+		return
+	}
+	found, err := queryRecords(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeQueriedRecords(w, found, format)
+}
@@ -0,0 +1,78 @@
+package collector
+
+import "testing"
+
+func TestQueryBound(t *testing.T) {
+	tests := []struct {
+		value, clock string
+		want         string
+		wantErr      bool
+	}{
+		{"", "00:00:00", "", false},
+		{"  ", "00:00:00", "", false},
+		{"2024-03-01", "00:00:00", "2024-03-01T00:00:00", false},
+		{"2024-03-01", "23:59:59", "2024-03-01T23:59:59", false},
+		{"2024-03-01T09:15", "23:59:59", "2024-03-01T09:15:59", false},
+		{"2024-03-01 09:15", "00:00:00", "2024-03-01T09:15:00", false},
+		{"2024-03-01T09:15:30", "23:59:59", "2024-03-01T09:15:30", false},
+		{"2024-02-30", "00:00:00", "", true},
+		{"2024-03-01T25:00", "00:00:00", "", true},
+		{"01/03/2024", "00:00:00", "", true},
+		{"yesterday", "00:00:00", "", true},
+	}
+	for _, tt := range tests {
+		got, err := queryBound(tt.value, tt.clock)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("queryBound(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("queryBound(%q, %q) = %q, want %q", tt.value, tt.clock, got, tt.want)
+		}
+	}
+}
+
+func TestNewRecordQuery(t *testing.T) {
+	q, err := newRecordQuery("12, 7", "gate,lobby", "2024-03-01", "2024-03-01", "late_punch", true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.users[12] || !q.users[7] || len(q.users) != 2 {
+		t.Errorf("users = %v, want 12 and 7", q.users)
+	}
+	if !q.devices["gate"] || !q.devices["lobby"] || len(q.devices) != 2 {
+		t.Errorf("devices = %v, want gate and lobby", q.devices)
+	}
+	if q.from != "2024-03-01T00:00:00" || q.to != "2024-03-01T23:59:59" {
+		t.Errorf("from, to = %q, %q, want the whole day", q.from, q.to)
+	}
+	if q.flag != "late_punch" || !q.pending || q.limit != 10 {
+		t.Errorf("query = %+v, want flag, pending and limit kept", q)
+	}
+
+	q, err = newRecordQuery("", "", "", "", "", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.users) != 0 || len(q.devices) != 0 || q.from != "" || q.to != "" {
+		t.Errorf("empty filters gave %+v, want no filters", q)
+	}
+
+	invalid := []struct {
+		name                     string
+		users, devices, from, to string
+		limit                    int
+	}{
+		{"non-numeric user", "12,bob", "", "", "", 0},
+		{"invalid from", "", "", "2024-13-01", "", 0},
+		{"invalid to", "", "", "", "soon", 0},
+		{"to before from", "", "", "2024-03-02", "2024-03-01", 0},
+		{"to before from within a day", "", "", "2024-03-01T10:00", "2024-03-01T09:00", 0},
+		{"negative limit", "", "", "", "", -1},
+	}
+	for _, tt := range invalid {
+		if _, err := newRecordQuery(tt.users, tt.devices, tt.from, tt.to, "", false, tt.limit); err == nil {
+			t.Errorf("%s: newRecordQuery succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// State key of each device's streak of reads failing with each recovery condition
+const recoveryFile = "recovery.json"
+
+// Conditions a recovery policy reacts to
+const (
+	conditionConnectionReset = "connection_reset" // The device dropped the connection mid-exchange
+	conditionTimeout         = "timeout"          // The device stopped answering
+	conditionUnreachable     = "unreachable"      // Any failure to talk to the device, the two above included
+	conditionLogFull         = "log_full"         // The attendance log is at capacity, checked after each read
+)
+
+// Actions a recovery policy can queue
+var recoveryActions = map[string]bool{actionReboot: true, actionClearLogs: true, actionSetTime: true}
+
+// recoveryPolicy queues a device command once a condition has been seen on streak
+// consecutive reads of the device
+type recoveryPolicy struct {
+	condition string
+	streak    int
+	action    string
+}
+
+// recoveryMu serializes read-modify-write cycles of the recovery state, which devices read
+// in parallel update
+var recoveryMu sync.Mutex
+
+// parseRecovery parses RECOVERY: comma-separated CONDITION[>=N]:ACTION entries, as
+// "connection_reset>=3:reboot,log_full:clear_logs". N defaults to 1.
+func parseRecovery(value string) ([]recoveryPolicy, error) {
+	var policies []recoveryPolicy
+	for _, entry := range splitList(value) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("entry %q is not CONDITION[>=N]:ACTION", entry)
+		}
+		policy := recoveryPolicy{condition: strings.TrimSpace(parts[0]), streak: 1, action: strings.TrimSpace(parts[1])}
+		if i := strings.Index(policy.condition, ">="); i >= 0 {
+			n, err := strconv.Atoi(strings.TrimSpace(policy.condition[i+2:]))
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("entry %q: %q is not a positive count", entry, policy.condition[i+2:])
+			}
+			policy.condition, policy.streak = strings.TrimSpace(policy.condition[:i]), n
+		}
+		switch policy.condition {
+		case conditionConnectionReset, conditionTimeout, conditionUnreachable, conditionLogFull:
+		default:
+			return nil, fmt.Errorf("entry %q: unknown condition %q; use connection_reset, timeout, unreachable or log_full", entry, policy.condition)
+		}
+		if !recoveryActions[policy.action] {
+			return nil, fmt.Errorf("entry %q: unknown action %q; use reboot, clear_logs or set_time", entry, policy.action)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// errorConditions returns the recovery conditions a failed read matches
+func errorConditions(err error) []string {
+	if !errors.Is(err, zk.ErrDeviceUnreachable) {
+		return nil
+	}
+	conditions := []string{conditionUnreachable}
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "connection reset"), strings.Contains(message, "broken pipe"), strings.Contains(message, "eof"):
+		conditions = append(conditions, conditionConnectionReset)
+	case strings.Contains(message, "timeout"), strings.Contains(message, "timed out"), strings.Contains(message, "deadline exceeded"):
+		conditions = append(conditions, conditionTimeout)
+	}
+	return conditions
+}
+
+// loadRecoveryStreaks returns each device's streaks by condition
+func loadRecoveryStreaks() map[string]map[string]int {
+	streaks := map[string]map[string]int{}
+	data, err := state().Get(recoveryFile)
+	if err != nil || data == nil {
+		return streaks
+	}
+	if err := json.Unmarshal(data, &streaks); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", recoveryFile, err)
+		return map[string]map[string]int{}
+	}
+	return streaks
+}
+
+// recoverDeviceError counts a failed read of a device against its RECOVERY policies
+func recoverDeviceError(deviceID string, err error) {
+	policies := devicePolicies(deviceID)
+	if len(policies) == 0 {
+		return
+	}
+	applyRecovery(deviceID, policies, errorConditions(err), err.Error())
+}
+
+// recoverDeviceRead checks a device read successfully against its RECOVERY policies: the
+// streaks of failures end, and with a log_full policy the log's fill is checked
+func recoverDeviceRead(deviceID string, zkManager *zk.ZKManager) {
+	policies := devicePolicies(deviceID)
+	if len(policies) == 0 {
+		return
+	}
+	var conditions []string
+	detail := ""
+	for _, policy := range policies {
+		if policy.condition != conditionLogFull {
+			continue
+		}
+		records, capacity, err := zkManager.GetRecordCount()
+		if err != nil {
+			log.Printf("Could not read record count from %s for recovery: %v", deviceID, err)
+		} else if capacity > 0 && records >= capacity {
+			conditions = append(conditions, conditionLogFull)
+			detail = fmt.Sprintf("attendance log full: %d of %d records", records, capacity)
+		}
+		break
+	}
+	applyRecovery(deviceID, policies, conditions, detail)
+}
+
+// devicePolicies returns the recovery policies of a device, from RECOVERY or RECOVERY_<DEVICE>
+func devicePolicies(deviceID string) []recoveryPolicy {
+	policies, err := parseRecovery(deviceEnv("RECOVERY", deviceID))
+	if err != nil {
+		log.Printf("Invalid RECOVERY for %s: %v", deviceID, err)
+		return nil
+	}
+	return policies
+}
+
+// applyRecovery updates a device's streaks with the conditions seen on its last read, which
+// ends the streaks of the others, and queues the action of each policy whose streak is
+// reached. The streak then starts over, so a device that stays broken gets the action again
+// only after as many reads more. Every action queued is written to the audit log.
+func applyRecovery(deviceID string, policies []recoveryPolicy, conditions []string, detail string) {
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	all := loadRecoveryStreaks()
+	streaks := map[string]int{}
+	for _, condition := range conditions {
+		streaks[condition] = all[deviceID][condition] + 1
+	}
+
+	for _, policy := range policies {
+		streak := streaks[policy.condition]
+		if streak < policy.streak {
+			continue
+		}
+		streaks[policy.condition] = 0
+		if pendingDeviceCommand(deviceID, policy.action) {
+			continue
+		}
+		cmd := newDeviceCommand(deviceID, policy.action, map[string]string{"recovery": policy.condition})
+		if err := queueDeviceCommand(cmd); err != nil {
+			log.Printf("Error queueing recovery %s for %s: %v", policy.action, deviceID, err)
+			continue
+		}
+		log.Printf("Recovery: queued %s for device %s after %d read(s) with %s", policy.action, deviceID, streak, policy.condition)
+		details := map[string]interface{}{
+			"device":    deviceID,
+			"condition": policy.condition,
+			"streak":    streak,
+			"action":    policy.action,
+			"command":   cmd.ID,
+			"error":     detail,
+		}
+		if err := appendAudit("recovery_action", details); err != nil {
+			log.Printf("Error writing audit log: %v", err)
+		}
+	}
+
+	for condition, streak := range streaks {
+		if streak == 0 {
+			delete(streaks, condition)
+		}
+	}
+	if len(streaks) == 0 && len(all[deviceID]) == 0 {
+		return
+	}
+	if len(streaks) == 0 {
+		delete(all, deviceID)
+	} else {
+		all[deviceID] = streaks
+	}
+	data, err := json.Marshal(all)
+	if err == nil {
+		err = state().Put(recoveryFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving recovery state: %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// State key of the last remote configuration applied, for starting offline
+	remoteConfigFile = "remote_config.json"
+	// How often CONFIG_URL is polled, unless CONFIG_REFRESH_INTERVAL (minutes) overrides it
+	defaultConfigRefresh = 15 * time.Minute
+)
+
+// bootstrapSettings can't be set remotely: they are needed to reach CONFIG_URL, decide
+// where state and the instance lock live, or hold the keys and update source whose
+// replacement would hand the collector to whoever controls CONFIG_URL
+var bootstrapSettings = map[string]bool{
+	"CONFIG_URL": true, "CONFIG_REFRESH_INTERVAL": true, "CONFIG_LOCAL_KEYS": true,
+	"API_KEY": true, "STATE_STORE": true, "STATE_NAMESPACE": true, "CONFIG_PASSPHRASE": true, "CONFIG_PASSPHRASE_FILE": true,
+	profileEnv: true, "TENANTS_DIR": true, "COLLECTOR_ID": true, "FEATURE_FLAGS": true,
+	"CHAOS": true, "CHAOS_SEED": true,
+	"UPDATE_URL": true, "UPDATE_PUBLIC_KEY": true, "SIGNING_KEY": true, "SIGNING_KEY_FILE": true,
+	"STATE_ENCRYPTION_KEY": true, "STATE_ENCRYPTION_KEY_FILE": true, "ADMIN_TOKEN": true,
+}
+
+// RemoteConfig is the body of CONFIG_URL: settings by name and feature flags, with a
+// version for the logs
+type RemoteConfig struct {
+	Version  string                 `json:"version,omitempty"`
+	Settings map[string]string      `json:"settings"`
+	Flags    map[string]FeatureFlag `json:"flags,omitempty"`
+}
+
+// remoteConfigCache is the cached form of the remote configuration
+type remoteConfigCache struct {
+	FetchedAt time.Time    `json:"fetched_at"`
+	Config    RemoteConfig `json:"config"`
+}
+
+// remoteConfig is the state of remote configuration in this process
+var remoteConfig = struct {
+	sync.Mutex
+	// local holds the settings of the process environment and --set, which remote values
+	// don't override, recorded by LoadConfig
+	local map[string]bool
+	// previous holds the values settings had before a remote value replaced them, unset
+	// ones as nil, so a setting dropped remotely goes back to its local value
+	previous  map[string]*string
+	applied   RemoteConfig
+	settings  map[string]string // Settings of the applied configuration and its flags that are on
+	checkedAt time.Time
+}{local: map[string]bool{}, previous: map[string]*string{}}
+
+// recordLocalSettings marks the settings of the process environment and the --set
+// overrides, which win over remote configuration
+func recordLocalSettings(environ []string, overrides []string) {
+	remoteConfig.Lock()
+	defer remoteConfig.Unlock()
+	for _, entry := range append(append([]string{}, environ...), overrides...) {
+		if i := strings.Index(entry, "="); i > 0 {
+			remoteConfig.local[entry[:i]] = true
+		}
+	}
+}
+
+// remoteSettable reports whether a setting may be set by CONFIG_URL. The caller holds the
+// remoteConfig lock.
+func remoteSettable(key string) bool {
+	if bootstrapSettings[key] || remoteConfig.local[key] || !deviceSettingKey.MatchString(key) {
+		return false
+	}
+	for _, local := range splitList(os.Getenv("CONFIG_LOCAL_KEYS")) {
+		if local == key {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchRemoteConfig GETs the configuration from CONFIG_URL
+func fetchRemoteConfig(url, apiKey string) (RemoteConfig, error) {
+	var config RemoteConfig
+	req, err := sink.NewAPIRequest("GET", url, nil, apiKey)
+	if err != nil {
+		return config, err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return config, fmt.Errorf("failed to execute configuration request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return config, fmt.Errorf("configuration request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return config, fmt.Errorf("invalid configuration response: %w", err)
+	}
+	return config, nil
+}
+
+// setRemoteSettings makes the environment hold the local settings overlaid with remote
+// ones, and returns the settings whose value changed. The caller holds the remoteConfig lock.
+func setRemoteSettings(settings map[string]string) ([]string, error) {
+	values := map[string]string{}
+	for key, value := range settings {
+		if !remoteSettable(key) {
+			continue
+		}
+		if strings.HasPrefix(value, "enc:") {
+			plain, err := decryptSetting(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			value = plain
+		}
+		values[key] = value
+	}
+	var changed []string
+	// Settings no longer set remotely go back to their local value
+	for key, previous := range remoteConfig.previous {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if previous == nil {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, *previous)
+		}
+		delete(remoteConfig.previous, key)
+		changed = append(changed, key)
+	}
+	for key, value := range values {
+		current, set := os.LookupEnv(key)
+		if _, ok := remoteConfig.previous[key]; !ok {
+			if set {
+				local := current
+				remoteConfig.previous[key] = &local
+			} else {
+				remoteConfig.previous[key] = nil
+			}
+		}
+		if !set || current != value {
+			os.Setenv(key, value)
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// configErrors returns the errors validateConfig finds, as "KEY: message"
+func configErrors() map[string]bool {
+	errors := map[string]bool{}
+	for _, p := range validateConfig() {
+		if !p.Warning {
+			errors[p.Key+": "+p.Message] = true
+		}
+	}
+	return errors
+}
+
+// applyRemoteConfig applies a remote configuration unless it makes the configuration
+// invalid, in which case the settings in effect are kept. Errors the configuration already
+// had don't count against it. It returns the settings changed. The caller holds the
+// remoteConfig lock.
+func applyRemoteConfig(config RemoteConfig) ([]string, error) {
+	previous := remoteConfig.settings
+	before := configErrors()
+	// Flags are evaluated once the settings are in place, as they may target the branches
+	// those settings assign devices to
+	settings := map[string]string{}
+	for key, value := range config.Settings {
+		settings[key] = value
+	}
+	changed, err := setRemoteSettings(settings)
+	on := evaluateFeatures(config.Flags)
+	if flagged := featureSettings(config.Flags, on); err == nil && len(flagged) > 0 {
+		for key, value := range flagged {
+			settings[key] = value
+		}
+		var more []string
+		more, err = setRemoteSettings(settings)
+		for _, key := range more {
+			if !containsString(changed, key) {
+				changed = append(changed, key)
+			}
+		}
+		sort.Strings(changed)
+	}
+	if err == nil {
+		var introduced []string
+		for problem := range configErrors() {
+			if !before[problem] {
+				introduced = append(introduced, problem)
+			}
+		}
+		if len(introduced) > 0 {
+			sort.Strings(introduced)
+			err = fmt.Errorf("%s", strings.Join(introduced, "; "))
+		}
+	}
+	if err != nil {
+		setRemoteSettings(previous)
+		return nil, err
+	}
+	remoteConfig.applied, remoteConfig.settings = config, settings
+	setFeatures(on)
+	return changed, nil
+}
+
+// cachedRemoteConfig returns the remote configuration last applied, if any
+func cachedRemoteConfig() (remoteConfigCache, bool) {
+	var cache remoteConfigCache
+	data, err := state().Get(remoteConfigFile)
+	if err != nil || data == nil {
+		return cache, false
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", remoteConfigFile, err)
+		return cache, false
+	}
+	return cache, true
+}
+
+// loadCachedRemoteConfig applies the remote configuration last fetched, so commands and a
+// collector starting offline run with it
+func loadCachedRemoteConfig() {
+	if os.Getenv("CONFIG_URL") == "" {
+		return
+	}
+	cache, ok := cachedRemoteConfig()
+	if !ok {
+		return
+	}
+	remoteConfig.Lock()
+	defer remoteConfig.Unlock()
+	if _, err := applyRemoteConfig(cache.Config); err != nil {
+		log.Printf("Cached remote configuration %q not applied: %v", cache.Config.Version, err)
+	}
+}
+
+// refreshRemoteConfig polls CONFIG_URL every CONFIG_REFRESH_INTERVAL minutes, or right
+// away when force is set, and applies what it returns. Settings the collector reads at
+// startup only, such as SYNC_INTERVAL or ADMIN_ADDR, take effect after a restart.
+func refreshRemoteConfig(force bool) {
+	url := os.Getenv("CONFIG_URL")
+	if url == "" {
+		return
+	}
+	remoteConfig.Lock()
+	defer remoteConfig.Unlock()
+	refresh := defaultConfigRefresh
+	if value := os.Getenv("CONFIG_REFRESH_INTERVAL"); value != "" {
+		if parsed, ok := parseSyncInterval(value); ok {
+			refresh = parsed
+		}
+	}
+	if !force && time.Since(remoteConfig.checkedAt) < refresh {
+		return
+	}
+	remoteConfig.checkedAt = time.Now()
+
+	config, err := fetchRemoteConfig(url, os.Getenv("API_KEY"))
+	if err != nil {
+		log.Printf("Error fetching remote configuration, keeping version %q: %v", remoteConfig.applied.Version, err)
+		return
+	}
+	changed, err := applyRemoteConfig(config)
+	if err != nil {
+		log.Printf("ALERT: remote configuration %q rejected, keeping version %q: %v", config.Version, remoteConfig.applied.Version, err)
+		publishEvent("config_rejected", map[string]interface{}{"version": config.Version, "error": err.Error()})
+		return
+	}
+	if len(changed) > 0 {
+		// Only names are logged, values may be secrets
+		log.Printf("Remote configuration %q applied, changed: %s", config.Version, strings.Join(changed, ", "))
+	}
+	data, err := json.Marshal(remoteConfigCache{FetchedAt: time.Now(), Config: config})
+	if err == nil {
+		err = state().Put(remoteConfigFile, data)
+	}
+	if err != nil {
+		log.Printf("Error caching remote configuration: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"old-attendance/pkg/sink"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// State key of the time retention was last applied
+	lastCompactionFile = "last_compaction.txt"
+	// Retention is applied this often, from the sync cycle
+	compactionInterval = 24 * time.Hour
+)
+
+// compaction counts what retention removed since the collector started, for /metrics
+var compaction = struct {
+	sync.Mutex
+	removed map[string]int       // By buffer: "store" or "audit"
+	last    map[string]time.Time // When retention was last applied to each buffer
+}{removed: map[string]int{}, last: map[string]time.Time{}}
+
+// retentionSetting parses a retention setting such as STORE_RETENTION=90d; zero means
+// records are kept until there is no room for them
+func retentionSetting(key string) time.Duration {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return 0
+	}
+	age, err := parseAge(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, keeping everything: %v", key, value, err)
+		return 0
+	}
+	return age
+}
+
+// compactIfDue applies retention when it hasn't been applied for a day, so long-lived
+// installs don't grow without bound however the collector is run
+func compactIfDue(sinks []sink.Sink, now time.Time) {
+	if retentionSetting("STORE_RETENTION") == 0 && retentionSetting("AUDIT_RETENTION") == 0 {
+		return
+	}
+	if data, err := state().Get(lastCompactionFile); err == nil && data != nil {
+		if last, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data))); err == nil && now.Sub(last) < compactionInterval {
+			return
+		}
+	}
+	compactStores(sinks, now)
+	if err := state().Put(lastCompactionFile, []byte(now.Format(time.RFC3339))); err != nil {
+		log.Printf("Error saving %s: %v", lastCompactionFile, err)
+	}
+}
+
+// compactStores removes what has outlived its retention: records every sink has delivered
+// that were stored more than STORE_RETENTION ago, and audit entries older than
+// AUDIT_RETENTION. Records not yet delivered are kept however old, for STORE_MAX_SIZE alone
+// to decide on.
+func compactStores(sinks []sink.Sink, now time.Time) {
+	if retention := retentionSetting("STORE_RETENTION"); retention > 0 {
+		removed, err := compactRecordStore(sinks, now.Add(-retention))
+		if err != nil {
+			log.Printf("Error applying STORE_RETENTION: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d delivered record(s) older than STORE_RETENTION from the record store", removed)
+		}
+		noteCompaction("store", removed, now)
+	}
+	if retention := retentionSetting("AUDIT_RETENTION"); retention > 0 {
+		removed, err := compactAuditLog(now.Add(-retention))
+		if err != nil {
+			log.Printf("Error applying AUDIT_RETENTION: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d audit entr(ies) older than AUDIT_RETENTION", removed)
+		}
+		noteCompaction("audit", removed, now)
+	}
+}
+
+// noteCompaction counts records removed from a buffer
+func noteCompaction(buffer string, removed int, now time.Time) {
+	compaction.Lock()
+	defer compaction.Unlock()
+	compaction.removed[buffer] += removed
+	compaction.last[buffer] = now
+}
+
+// compactRecordStore rewrites the record store without the records stored before cutoff
+// that every sink has delivered
+func compactRecordStore(sinks []sink.Sink, cutoff time.Time) (int, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	records, err := readStoreLocked()
+	if err != nil {
+		return 0, err
+	}
+	progress, err := readSinkOffsetsLocked()
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	removed := 0
+	for _, record := range records {
+		if storedBefore(record, cutoff) && deliveredToAll(progress, sinks, record.Seq) {
+			removed++
+			continue
+		}
+		if err := enc.Encode(record); err != nil {
+			return 0, fmt.Errorf("failed to encode record: %w", err)
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := rewriteStoreLocked(records, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// storedBefore reports whether a record went into the store before t
+func storedBefore(record storedRecord, t time.Time) bool {
+	storedAt, err := time.Parse(time.RFC3339, record.StoredAt)
+	return err == nil && storedAt.Before(t)
+}
+
+// deliveredToAll reports whether every sink has delivered the record with the given seq
+func deliveredToAll(progress map[string]*sinkProgress, sinks []sink.Sink, seq int64) bool {
+	for _, s := range sinks {
+		p, ok := progress[s.Name()]
+		if !ok || !p.isDelivered(seq) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeRetentionMetrics writes the records in the store and what retention has removed
+func writeRetentionMetrics(w io.Writer) {
+	if data, err := state().Get(recordStoreFile); err == nil {
+		fmt.Fprintln(w, "# HELP attendance_buffer_records Records in the local record store, delivered or not.")
+		fmt.Fprintln(w, "# TYPE attendance_buffer_records gauge")
+		fmt.Fprintf(w, "attendance_buffer_records{%s} %d\n", tenantLabel(`buffer="store"`), bytes.Count(data, []byte("\n")))
+	}
+	compaction.Lock()
+	defer compaction.Unlock()
+	if len(compaction.last) == 0 {
+		return
+	}
+	buffers := []string{"store", "audit"}
+	fmt.Fprintln(w, "# HELP attendance_retention_removed_total Records and audit entries removed for being past their retention.")
+	fmt.Fprintln(w, "# TYPE attendance_retention_removed_total counter")
+	for _, buffer := range buffers {
+		if _, ok := compaction.last[buffer]; ok {
+			fmt.Fprintf(w, "attendance_retention_removed_total{%s} %d\n", tenantLabel(fmt.Sprintf("buffer=%q", buffer)), compaction.removed[buffer])
+		}
+	}
+	fmt.Fprintln(w, "# HELP attendance_last_compaction_timestamp_seconds When retention was last applied.")
+	fmt.Fprintln(w, "# TYPE attendance_last_compaction_timestamp_seconds gauge")
+	for _, buffer := range buffers {
+		if last, ok := compaction.last[buffer]; ok {
+			fmt.Fprintf(w, "attendance_last_compaction_timestamp_seconds{%s} %d\n", tenantLabel(fmt.Sprintf("buffer=%q", buffer)), last.Unix())
+		}
+	}
+}
+
+// runCompactCommand applies retention now, whenever it was last applied
+func runCompactCommand(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: compact")
+	}
+	if retentionSetting("STORE_RETENTION") == 0 && retentionSetting("AUDIT_RETENTION") == 0 {
+		return configError("neither STORE_RETENTION nor AUDIT_RETENTION is set")
+	}
+	now := time.Now()
+	compactStores(configuredSinks(os.Getenv("ORG_ID"), os.Getenv("API_URL"), os.Getenv("API_KEY")), now)
+	return state().Put(lastCompactionFile, []byte(now.Format(time.RFC3339)))
+}
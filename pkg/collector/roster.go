@@ -0,0 +1,176 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// File caching the last roster pulled from the HR API
+	rosterFile = "roster.json"
+	// How often the roster is refreshed, unless ROSTER_REFRESH_INTERVAL (minutes) overrides it
+	defaultRosterRefresh = 60 * time.Minute
+
+	// Flags set on records whose user doesn't map to an active employee
+	flagUnknownEmployee  = "unknown_employee"
+	flagInactiveEmployee = "inactive_employee"
+)
+
+// RosterEmployee is one employee as returned by the HR roster endpoint
+type RosterEmployee struct {
+	EmployeeID  int      `json:"employee_id"`
+	BadgeNumber string   `json:"badge_number"`
+	CardNumber  string   `json:"card_number,omitempty"`
+	Devices     []string `json:"devices,omitempty"` // Device IDs the employee is enrolled on, all when empty
+	Active      bool     `json:"active"`
+}
+
+// rosterCache is the on-disk form of the roster
+type rosterCache struct {
+	FetchedAt time.Time        `json:"fetched_at"`
+	Employees []RosterEmployee `json:"employees"`
+}
+
+// loadRoster returns the roster, refreshing it from ROSTER_URL when the cached copy is stale.
+// It returns nil when no roster is configured. A failed refresh falls back to the cache.
+func loadRoster() []RosterEmployee {
+	rosterURL := os.Getenv("ROSTER_URL")
+	if rosterURL == "" {
+		return nil
+	}
+
+	refresh := defaultRosterRefresh
+	if value := os.Getenv("ROSTER_REFRESH_INTERVAL"); value != "" {
+		if minutes, err := strconv.Atoi(value); err == nil && minutes > 0 {
+			refresh = time.Duration(minutes) * time.Minute
+		}
+	}
+
+	cache, cacheErr := readRosterCache()
+	if cacheErr == nil && time.Since(cache.FetchedAt) < refresh {
+		return cache.Employees
+	}
+
+	employees, err := fetchRoster(rosterURL, os.Getenv("API_KEY"))
+	if err != nil {
+		log.Printf("Error refreshing roster: %v", err)
+		if cacheErr != nil {
+			return nil
+		}
+		log.Printf("Using cached roster from %s", cache.FetchedAt.Format(time.RFC3339))
+		return cache.Employees
+	}
+
+	log.Printf("Roster refreshed: %d employee(s)", len(employees))
+	if err := writeRosterCache(rosterCache{FetchedAt: time.Now(), Employees: employees}); err != nil {
+		log.Printf("Error caching roster: %v", err)
+	}
+	return employees
+}
+
+// fetchRoster GETs the employee roster from the HR API
+func fetchRoster(url, apiKey string) ([]RosterEmployee, error) {
+	req, err := sink.NewAPIRequest("GET", url, nil, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute roster request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("roster request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	var employees []RosterEmployee
+	if err := json.Unmarshal(body, &employees); err != nil {
+		return nil, fmt.Errorf("invalid roster response: %w", err)
+	}
+	return employees, nil
+}
+
+// readRosterCache reads the cached roster from disk
+func readRosterCache() (rosterCache, error) {
+	var cache rosterCache
+	data, err := readLocalFile(rosterFile)
+	if err != nil {
+		return cache, err
+	}
+	err = json.Unmarshal(data, &cache)
+	return cache, err
+}
+
+// writeRosterCache writes the roster cache to disk, encrypted with the state key when there
+// is one, as it holds card numbers
+func writeRosterCache(cache rosterCache) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeLocalFile(rosterFile, data)
+}
+
+// applyRoster maps device user IDs to employee IDs and flags punches from unknown or
+// inactive employees. With ROSTER_MATCH=badge_number the device user ID is looked up
+// as a badge number, and with ROSTER_MATCH=card_number the record's card number is
+// (see ZK_READ_CARDS); otherwise the user ID must already be the employee ID. ROSTER_MATCH
+// can be overridden per device, for card-only readers among others. Manual punches are
+// entered by employee ID and only validated.
+func applyRoster(logs []zk.AttendanceRecord, roster []RosterEmployee) []zk.AttendanceRecord {
+	byID := map[int]RosterEmployee{}
+	byBadge := map[string]RosterEmployee{}
+	byCard := map[string]RosterEmployee{}
+	for _, employee := range roster {
+		byID[employee.EmployeeID] = employee
+		if employee.BadgeNumber != "" {
+			byBadge[employee.BadgeNumber] = employee
+		}
+		if employee.CardNumber != "" {
+			byCard[employee.CardNumber] = employee
+		}
+	}
+
+	unknown, inactive := 0, 0
+	for i, record := range logs {
+		var employee RosterEmployee
+		var ok bool
+		switch match := deviceEnv("ROSTER_MATCH", record.DeviceID); {
+		case record.Manual:
+			employee, ok = byID[record.UserID]
+		case match == "badge_number":
+			employee, ok = byBadge[strconv.Itoa(record.UserID)]
+		case match == "card_number":
+			employee, ok = byCard[record.CardNumber]
+		default:
+			employee, ok = byID[record.UserID]
+		}
+
+		switch {
+		case !ok:
+			logs[i].Flags = append(logs[i].Flags, flagUnknownEmployee)
+			unknown++
+		case !employee.Active:
+			logs[i].UserID = employee.EmployeeID
+			logs[i].Flags = append(logs[i].Flags, flagInactiveEmployee)
+			inactive++
+		default:
+			logs[i].UserID = employee.EmployeeID
+		}
+	}
+
+	if unknown > 0 || inactive > 0 {
+		log.Printf("Roster check: %d punch(es) from unknown employees, %d from inactive employees", unknown, inactive)
+	}
+	return logs
+}
@@ -0,0 +1,151 @@
+package collector
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State key of the read marks of devices held back by their own sync interval
+const deviceSinceFile = "device_since.json"
+
+// Default sync interval when SYNC_INTERVAL is unset or invalid
+const defaultSyncInterval = 5 * time.Minute
+
+// A device counts as due this close to its interval, so tick jitter doesn't push it a whole tick late
+const dueTolerance = 30 * time.Second
+
+// parseSyncInterval parses a SYNC_INTERVAL value in whole minutes
+func parseSyncInterval(value string) (time.Duration, bool) {
+	interval, err := time.ParseDuration(strings.TrimSpace(value) + "m")
+	if err != nil || interval <= 0 {
+		return 0, false
+	}
+	return interval, true
+}
+
+// syncInterval returns the global SYNC_INTERVAL, or the default when unset or invalid
+func syncInterval() time.Duration {
+	if interval, ok := parseSyncInterval(os.Getenv("SYNC_INTERVAL")); ok {
+		return interval
+	}
+	return defaultSyncInterval
+}
+
+// deviceSyncInterval returns how often a device is read: SYNC_INTERVAL_<DEVICE> when set,
+// otherwise the global interval
+func deviceSyncInterval(deviceID string, global time.Duration) time.Duration {
+	value, ok := os.LookupEnv("SYNC_INTERVAL_" + envSuffix(deviceID))
+	if !ok {
+		return global
+	}
+	interval, valid := parseSyncInterval(value)
+	if !valid {
+		log.Printf("Invalid SYNC_INTERVAL_%s=%q, using %v", envSuffix(deviceID), value, global)
+		return global
+	}
+	return interval
+}
+
+// tickInterval returns the daemon's tick: the shortest interval of any configured device,
+// so every device is looked at at least as often as it wants to be read
+func tickInterval(deviceIPs string, global time.Duration) time.Duration {
+	tick := global
+	for _, entry := range strings.Split(deviceIPs, ",") {
+		device, err := parseDevice(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		if interval := deviceSyncInterval(device.ID, global); interval < tick {
+			tick = interval
+		}
+	}
+	return tick
+}
+
+// deviceLastRead holds when each device was last read successfully, for due checks. It is
+// not persisted, so every device is read on the first sync after a restart.
+var deviceLastRead = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: map[string]time.Time{}}
+
+// deviceDue reports whether a device's interval has passed since its last successful read,
+// and when it is next due otherwise
+func deviceDue(deviceID string, now time.Time) (bool, time.Time) {
+	deviceLastRead.Lock()
+	last, ok := deviceLastRead.at[deviceID]
+	deviceLastRead.Unlock()
+	if !ok {
+		return true, now
+	}
+	next := last.Add(deviceSyncInterval(deviceID, globalInterval()))
+	return !now.Add(dueTolerance).Before(next), next
+}
+
+// markDeviceRead notes a successful read of a device at the start of cycle t
+func markDeviceRead(deviceID string, t time.Time) {
+	deviceLastRead.Lock()
+	defer deviceLastRead.Unlock()
+	deviceLastRead.at[deviceID] = t
+}
+
+// markDevicesDue forgets when devices were last read, so the next cycle reads all of them
+func markDevicesDue() {
+	deviceLastRead.Lock()
+	defer deviceLastRead.Unlock()
+	deviceLastRead.at = map[string]time.Time{}
+}
+
+// loadDeviceSince returns the read marks of devices that have been held back by their
+// interval while the last check time moved on. Such a device is read from its mark instead,
+// so punches made while it waited are not skipped.
+func loadDeviceSince() map[string]time.Time {
+	marks := map[string]time.Time{}
+	data, err := state().Get(deviceSinceFile)
+	if err != nil || data == nil {
+		return marks
+	}
+	if err := json.Unmarshal(data, &marks); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", deviceSinceFile, err)
+		return map[string]time.Time{}
+	}
+	return marks
+}
+
+// deviceSince returns the time to read a device from: its read mark when older than the
+// last check time, otherwise the last check time
+func deviceSince(marks map[string]time.Time, deviceID string, lastChecked time.Time) time.Time {
+	if mark, ok := marks[deviceID]; ok && mark.Before(lastChecked) {
+		return mark
+	}
+	return lastChecked
+}
+
+// commitDeviceSince updates the read marks once a cycle has advanced the last check time:
+// devices read this cycle drop their mark, and devices held back or failed keep the time they
+// were due from
+func commitDeviceSince(cycle *syncCycle) {
+	if cycle == nil {
+		return
+	}
+	marks := loadDeviceSince()
+	cycle.update(func(c *syncCycle) {
+		for id := range c.devicesRead {
+			delete(marks, id)
+		}
+		for id, since := range c.devicesHeld {
+			marks[id] = since
+		}
+	})
+	data, err := json.Marshal(marks)
+	if err == nil {
+		err = state().Put(deviceSinceFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving device read marks: %v", err)
+	}
+}
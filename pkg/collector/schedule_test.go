@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"old-attendance/pkg/zk"
+)
+
+// inStateDir runs a test with the working directory, where the file state store keeps its
+// files, set to a fresh temporary directory
+func inStateDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// startSimulator starts a simulated terminal holding punches
+func startSimulator(t *testing.T, punches ...zk.SimulatedPunch) *zk.Simulator {
+	t.Helper()
+	sim := &zk.Simulator{}
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Close)
+	sim.AddPunches(punches...)
+	return sim
+}
+
+// simulatorEntry is a DEVICE_IPS entry naming a simulator
+func simulatorEntry(id string, sim *zk.Simulator) string {
+	m := sim.Manager()
+	return fmt.Sprintf("%s=%s:%d", id, m.IP, m.Port)
+}
+
+func TestDeviceSince(t *testing.T) {
+	lastChecked := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	marks := map[string]time.Time{
+		"old": lastChecked.Add(-time.Hour),
+		"new": lastChecked.Add(time.Hour),
+	}
+	tests := []struct {
+		device string
+		want   time.Time
+	}{
+		{"old", lastChecked.Add(-time.Hour)},
+		{"new", lastChecked},
+		{"none", lastChecked},
+	}
+	for _, tt := range tests {
+		if got := deviceSince(marks, tt.device, lastChecked); !got.Equal(tt.want) {
+			t.Errorf("deviceSince(%q) = %v, want %v", tt.device, got, tt.want)
+		}
+	}
+}
+
+func TestCommitDeviceSince(t *testing.T) {
+	inStateDir(t)
+	held := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	data, _ := json.Marshal(map[string]time.Time{"read": held, "kept": held})
+	if err := state().Put(deviceSinceFile, data); err != nil {
+		t.Fatal(err)
+	}
+
+	cycle := newSyncCycle()
+	cycle.devicesRead["read"] = true
+	cycle.devicesHeld["failed"] = held.Add(time.Hour)
+	commitDeviceSince(cycle)
+
+	marks := loadDeviceSince()
+	if _, ok := marks["read"]; ok {
+		t.Errorf("mark of a device read was kept")
+	}
+	if !marks["kept"].Equal(held) {
+		t.Errorf("mark of a device not in the cycle = %v, want %v", marks["kept"], held)
+	}
+	if !marks["failed"].Equal(held.Add(time.Hour)) {
+		t.Errorf("mark of a failed device = %v, want %v", marks["failed"], held.Add(time.Hour))
+	}
+}
+
+// A device that fails while another is read and stored must not lose its punches when the
+// last check time moves on
+func TestFailedDeviceReadOnNextCycle(t *testing.T) {
+	inStateDir(t)
+	now := time.Now().Truncate(time.Second)
+	if err := saveLastCheckTime(now.Add(-2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	gate := startSimulator(t, zk.SimulatedPunch{UserID: 1, Time: now.Add(-time.Hour)})
+	punch := zk.SimulatedPunch{UserID: 2, Time: now.Add(-90 * time.Minute)}
+	down := startSimulator(t, punch)
+	downEntry := simulatorEntry("store", down)
+	down.Close()
+
+	// The first cycle reads the gate; the store terminal is unreachable
+	t.Setenv("DEVICE_IPS", simulatorEntry("gate", gate)+","+downEntry)
+	cycle := newSyncCycle()
+	logs, _ := fetchDeviceLogs(os.Getenv("DEVICE_IPS"), getLastCheckTime(), cycle)
+	if len(logs) != 1 || logs[0].DeviceID != "gate" {
+		t.Fatalf("first cycle fetched %v, want the gate's punch", logs)
+	}
+	if cycle.devicesFailed != 1 {
+		t.Fatalf("first cycle failed %d devices, want 1", cycle.devicesFailed)
+	}
+	if !deliverLogs(logs, "", "", "", cycle) {
+		t.Fatal("first cycle's records were not stored")
+	}
+	cycle.passes.Wait()
+	if !getLastCheckTime().After(now.Add(-time.Minute)) {
+		t.Fatalf("last check time %v did not move on", getLastCheckTime())
+	}
+
+	// The store terminal is back with the same punch; the next cycle reads it from its mark
+	back := startSimulator(t, punch)
+	t.Setenv("DEVICE_IPS", simulatorEntry("gate", gate)+","+simulatorEntry("store", back))
+	cycle = newSyncCycle()
+	logs, err := fetchDeviceLogs(os.Getenv("DEVICE_IPS"), getLastCheckTime(), cycle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].DeviceID != "store" || logs[0].UserID != punch.UserID {
+		t.Fatalf("second cycle fetched %v, want only the store terminal's punch", logs)
+	}
+}
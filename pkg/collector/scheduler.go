@@ -0,0 +1,312 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scheduler decides when a recurring task runs
+type Scheduler interface {
+	// Next returns when the task is next due after now, or the zero time when only a
+	// trigger runs it
+	Next(now time.Time) time.Time
+	String() string
+}
+
+// tickerScheduler runs a task at a fixed interval. Runs that overrun it skip the ticks they
+// missed, as a time.Ticker does.
+type tickerScheduler struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func (s *tickerScheduler) Next(now time.Time) time.Time {
+	if s.next.IsZero() {
+		s.next = now
+	}
+	for !s.next.After(now) {
+		s.next = s.next.Add(s.interval)
+	}
+	return s.next
+}
+
+func (s *tickerScheduler) String() string {
+	return fmt.Sprintf("every %v", s.interval)
+}
+
+// adaptiveScheduler runs the sync at the interval adaptive polling picks from the peak
+// windows and recent activity. A long idle delay is cut short when a peak window starts.
+type adaptiveScheduler struct {
+	settings  adaptiveSettings
+	deviceIPs string
+	current   time.Duration // Last delay logged
+}
+
+func (s *adaptiveScheduler) Next(now time.Time) time.Time {
+	adaptivePolling.Lock()
+	global := s.settings.interval(now, adaptivePolling.emptyCycles)
+	adaptivePolling.enabled = true
+	adaptivePolling.interval = global
+	adaptivePolling.Unlock()
+
+	delay := tickInterval(s.deviceIPs, global)
+	if wait := s.settings.untilNextPeak(now); wait > 0 && wait < delay && !s.settings.inPeak(now) {
+		delay = wait
+	}
+	if delay != s.current {
+		log.Printf("Adaptive polling: next sync in %v (%s)", delay, adaptiveReason(s.settings, now))
+		s.current = delay
+	}
+	return now.Add(delay)
+}
+
+func (s *adaptiveScheduler) String() string {
+	return "adaptive"
+}
+
+// triggerScheduler leaves a task to POST /api/tasks/run alone
+type triggerScheduler struct{}
+
+func (triggerScheduler) Next(time.Time) time.Time {
+	return time.Time{}
+}
+
+func (triggerScheduler) String() string {
+	return "on trigger only"
+}
+
+// Tasks the daemon schedules
+const (
+	taskSync        = "sync"
+	taskUserSync    = "user-sync"
+	taskMaintenance = "maintenance"
+)
+
+// scheduledTask is a recurring task with the setting choosing its scheduler. Triggers queue
+// up to one run, so a trigger arriving while the task runs isn't lost and a burst of them
+// runs it once more.
+type scheduledTask struct {
+	name    string
+	setting string
+	trigger chan struct{}
+}
+
+var scheduledTasks = []*scheduledTask{
+	{name: taskSync, setting: "SCHEDULE_SYNC", trigger: make(chan struct{}, 1)},
+	{name: taskUserSync, setting: "SCHEDULE_USER_SYNC", trigger: make(chan struct{}, 1)},
+	{name: taskMaintenance, setting: "SCHEDULE_MAINTENANCE", trigger: make(chan struct{}, 1)},
+}
+
+// findTask returns a scheduled task by name
+func findTask(name string) (*scheduledTask, bool) {
+	for _, t := range scheduledTasks {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// ownSchedule reports whether a task runs on a schedule of its own rather than after each
+// sync cycle, which is where user sync and maintenance run unless a valid SCHEDULE_<TASK>
+// says otherwise
+func (t *scheduledTask) ownSchedule() bool {
+	if t.name == taskSync {
+		return true
+	}
+	value := strings.TrimSpace(os.Getenv(t.setting))
+	if value == "" || value == taskSync {
+		return false
+	}
+	_, err := parseScheduler(t.name, value)
+	return err == nil
+}
+
+// taskScheduled reports whether the named task runs on a schedule of its own
+func taskScheduled(name string) bool {
+	t, ok := findTask(name)
+	return ok && t.ownSchedule()
+}
+
+// parseScheduler parses a task's SCHEDULE_<TASK> setting: "ticker:MINUTES" (fractions
+// allowed, as for SYNC_INTERVAL), "cron:EXPRESSION", "adaptive" (the sync task only) or
+// "trigger"
+func parseScheduler(task, value string) (Scheduler, error) {
+	value = strings.TrimSpace(value)
+	kind, arg := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		kind, arg = strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+	}
+	switch strings.ToLower(kind) {
+	case "ticker":
+		interval, ok := parseSyncInterval(arg)
+		if !ok {
+			return nil, fmt.Errorf("ticker needs a positive number of minutes, got %q", arg)
+		}
+		return &tickerScheduler{interval: interval}, nil
+	case "cron":
+		return parseCron(arg)
+	case "adaptive":
+		if task != taskSync {
+			return nil, fmt.Errorf("adaptive scheduling only applies to the %s task", taskSync)
+		}
+		return &adaptiveScheduler{settings: loadAdaptiveSettings(), deviceIPs: os.Getenv("DEVICE_IPS")}, nil
+	case "trigger":
+		return triggerScheduler{}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduler %q, use ticker:MINUTES, cron:EXPRESSION, adaptive or trigger", value)
+	}
+}
+
+// scheduler returns the task's scheduler: from SCHEDULE_<TASK>, or for the sync task
+// adaptive polling with ADAPTIVE_POLLING and otherwise a ticker at the shortest of
+// SYNC_INTERVAL and the devices' own intervals
+func (t *scheduledTask) scheduler() Scheduler {
+	if value := strings.TrimSpace(os.Getenv(t.setting)); value != "" {
+		s, err := parseScheduler(t.name, value)
+		if err == nil {
+			return s
+		}
+		log.Printf("Invalid %s=%q, using the default schedule: %v", t.setting, value, err)
+	}
+	if envBool("ADAPTIVE_POLLING") {
+		return &adaptiveScheduler{settings: loadAdaptiveSettings(), deviceIPs: os.Getenv("DEVICE_IPS")}
+	}
+	interval := syncInterval()
+	if _, ok := parseSyncInterval(os.Getenv("SYNC_INTERVAL")); !ok {
+		log.Printf("Invalid or missing SYNC_INTERVAL, defaulting to %v", interval)
+	}
+	// Devices with a longer interval of their own sit out the ticks they aren't due on
+	return &tickerScheduler{interval: tickInterval(os.Getenv("DEVICE_IPS"), interval)}
+}
+
+// loop runs the task whenever its scheduler or a trigger says so, forever
+func (t *scheduledTask) loop(s Scheduler) {
+	for {
+		var due <-chan time.Time
+		var timer *time.Timer
+		if next := s.Next(time.Now()); !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		triggered := false
+		select {
+		case <-due:
+		case <-t.trigger:
+			triggered = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		t.run(triggered)
+	}
+}
+
+// run runs the task once
+func (t *scheduledTask) run(triggered bool) {
+	switch t.name {
+	case taskSync:
+		runScheduledSync(triggered)
+	case taskUserSync:
+		runScheduledUserSync()
+	case taskMaintenance:
+		runScheduledMaintenance()
+	}
+}
+
+// runScheduledTasks starts the tasks with schedules of their own and runs the sync task's
+// schedule in the calling goroutine
+func runScheduledTasks() {
+	for _, t := range scheduledTasks {
+		if t.name == taskSync {
+			continue
+		}
+		if !t.ownSchedule() {
+			if value := strings.TrimSpace(os.Getenv(t.setting)); value != "" && value != taskSync {
+				_, err := parseScheduler(t.name, value)
+				log.Printf("Invalid %s=%q, running %s after each sync cycle: %v", t.setting, value, t.name, err)
+			}
+			continue
+		}
+		s := t.scheduler()
+		log.Printf("Scheduling %s: %s", t.name, s)
+		go t.loop(s)
+	}
+	t, _ := findTask(taskSync)
+	s := t.scheduler()
+	log.Printf("Scheduling %s: %s", t.name, s)
+	t.loop(s)
+}
+
+// runScheduledSync runs a sync cycle. A triggered one reads every device, not only those
+// whose interval has come round.
+func runScheduledSync(triggered bool) {
+	if triggered {
+		log.Println("Performing triggered sync...")
+		markDevicesDue()
+	} else {
+		log.Println("Performing scheduled sync...")
+	}
+	logSyncError(performSync())
+}
+
+// runScheduledUserSync uploads the user lists of every device outside a blackout that
+// changed since their last upload
+func runScheduledUserSync() {
+	if os.Getenv("USER_SYNC_URL") == "" {
+		log.Printf("Skipping %s: USER_SYNC_URL is not set", taskUserSync)
+		return
+	}
+	now := time.Now()
+	var done []<-chan error
+	for _, device := range configuredDevices() {
+		if _, ok := activeBlackout(device.ID, now); ok {
+			continue
+		}
+		done = append(done, syncUserListJob(device))
+	}
+	for _, d := range done {
+		<-d
+	}
+}
+
+// runScheduledMaintenance queues the maintenance that has come due and runs the device
+// command queue. clear_logs waits for a sync cycle that stored the device's records.
+func runScheduledMaintenance() {
+	now := time.Now()
+	scheduleMaintenance(now)
+	runDeviceCommandsJob(now, false)
+}
+
+// handleTaskRun triggers a task now: POST /api/tasks/run?task=sync|user-sync|maintenance,
+// with the ADMIN_TOKEN bearer token. Job schedulers and message queue consumers call it to
+// drive the collector from outside.
+func handleTaskRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !adminAuthorized(w, r) {
+		return
+	}
+	name := r.URL.Query().Get("task")
+	t, ok := findTask(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown task %q", name), http.StatusNotFound)
+		return
+	}
+	if !t.ownSchedule() {
+		http.Error(w, fmt.Sprintf("%s runs after each sync cycle; trigger %s or set %s", name, taskSync, t.setting), http.StatusConflict)
+		return
+	}
+	select {
+	case t.trigger <- struct{}{}:
+	default:
+		// A run is queued already and will pick up whatever this trigger was for
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
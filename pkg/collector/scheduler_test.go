@@ -0,0 +1,56 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduler(t *testing.T) {
+	tests := []struct {
+		task, value string
+		want        string // String() of the scheduler, empty for an error
+	}{
+		{taskSync, "ticker:5", "every 5m0s"},
+		{taskSync, " ticker : 0.5 ", "every 30s"},
+		{taskMaintenance, "TICKER:60", "every 1h0m0s"},
+		{taskSync, "cron:*/10 8-18 * * 1-5", "*/10 8-18 * * 1-5"},
+		{taskMaintenance, "cron:@daily", "@daily"},
+		{taskSync, "adaptive", "adaptive"},
+		{taskSync, "trigger", "on trigger only"},
+		{taskSync, "ticker:0", ""},
+		{taskSync, "ticker:-5", ""},
+		{taskSync, "ticker:", ""},
+		{taskSync, "cron:* * *", ""},
+		{taskMaintenance, "adaptive", ""},
+		{taskSync, "hourly", ""},
+		{taskSync, "", ""},
+	}
+	for _, tt := range tests {
+		s, err := parseScheduler(tt.task, tt.value)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseScheduler(%q, %q) = %v, want an error", tt.task, tt.value, s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseScheduler(%q, %q): %v", tt.task, tt.value, err)
+			continue
+		}
+		if s.String() != tt.want {
+			t.Errorf("parseScheduler(%q, %q) = %q, want %q", tt.task, tt.value, s.String(), tt.want)
+		}
+	}
+}
+
+func TestTickerSchedulerSkipsMissedTicks(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	s := &tickerScheduler{interval: 5 * time.Minute}
+	if next := s.Next(start); !next.Equal(start.Add(5 * time.Minute)) {
+		t.Fatalf("first Next = %v, want one interval on", next)
+	}
+	// A run overran two ticks
+	if next := s.Next(start.Add(17 * time.Minute)); !next.Equal(start.Add(20 * time.Minute)) {
+		t.Errorf("Next after an overrun = %v, want the next tick still ahead", next)
+	}
+}
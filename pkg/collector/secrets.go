@@ -0,0 +1,257 @@
+package collector
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Prefixes of encrypted setting values, naming the key they are encrypted with
+const (
+	encryptedMachinePrefix    = "enc:machine:"    // Key derived from the machine ID
+	encryptedPassphrasePrefix = "enc:passphrase:" // Key derived from CONFIG_PASSPHRASE
+)
+
+const (
+	secretSaltSize   = 16
+	secretIterations = 100000
+)
+
+// Settings encrypted by "config encrypt" when no keys are named
+var sensitiveSettings = []string{"API_KEY", "AUTH_CLIENT_SECRET", "SIGNING_KEY", "ADMIN_TOKEN", "STATE_STORE", "SOAP_PASSWORD", "FILEDROP_PASSWORD", "STATE_ENCRYPTION_KEY"}
+
+// machineSecret returns an identifier unique to this installation of the operating system,
+// which encrypted settings are bound to by default
+func machineSecret() (string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		out, err := exec.Command("reg", "query", `HKLM\SOFTWARE\Microsoft\Cryptography`, "/v", "MachineGuid").Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to read the machine GUID: %w", err)
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 {
+			return "", errors.New("machine GUID not found")
+		}
+		return fields[len(fields)-1], nil
+	default:
+		for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+			if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) != "" {
+				return strings.TrimSpace(string(data)), nil
+			}
+		}
+		return "", errors.New("no machine ID found, use a passphrase instead")
+	}
+}
+
+// configPassphrase returns CONFIG_PASSPHRASE, or the contents of CONFIG_PASSPHRASE_FILE
+func configPassphrase() (string, error) {
+	if passphrase := os.Getenv("CONFIG_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	if path := os.Getenv("CONFIG_PASSPHRASE_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read CONFIG_PASSPHRASE_FILE: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", errors.New("CONFIG_PASSPHRASE is not set")
+}
+
+// deriveKey stretches a secret into a 32-byte key with PBKDF2-HMAC-SHA256 (RFC 8018),
+// which needs a single block at this key size
+func deriveKey(secret string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(salt)
+	binary.Write(mac, binary.BigEndian, uint32(1))
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < secretIterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// secretCipher derives the AES-256-GCM cipher for a secret and salt
+func secretCipher(secret string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(secret, salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSetting encrypts a setting value, returning it with the prefix naming its key
+func encryptSetting(value, prefix, secret string) (string, error) {
+	salt := make([]byte, secretSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	aead, err := secretCipher(secret, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(append(salt, nonce...), nonce, []byte(value), nil)
+	return prefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSetting decrypts a value written by encryptSetting
+func decryptSetting(value string) (string, error) {
+	var secret string
+	var err error
+	switch {
+	case strings.HasPrefix(value, encryptedMachinePrefix):
+		value = strings.TrimPrefix(value, encryptedMachinePrefix)
+		secret, err = machineSecret()
+	case strings.HasPrefix(value, encryptedPassphrasePrefix):
+		value = strings.TrimPrefix(value, encryptedPassphrasePrefix)
+		secret, err = configPassphrase()
+	default:
+		return "", errors.New("unknown encryption")
+	}
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < secretSaltSize {
+		return "", errors.New("malformed encrypted value")
+	}
+	aead, err := secretCipher(secret, sealed[:secretSaltSize])
+	if err != nil {
+		return "", err
+	}
+	sealed = sealed[secretSaltSize:]
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("cannot decrypt, it was encrypted on another machine or with another passphrase")
+	}
+	return string(plain), nil
+}
+
+// decryptSettings replaces encrypted values in the environment with their plain text
+func decryptSettings() error {
+	for _, entry := range os.Environ() {
+		i := strings.Index(entry, "=")
+		key, value := entry[:i], entry[i+1:]
+		if !strings.HasPrefix(value, "enc:") {
+			continue
+		}
+		plain, err := decryptSetting(value)
+		if err != nil {
+			return configError(fmt.Sprintf("%s: %v", key, err))
+		}
+		os.Setenv(key, plain)
+	}
+	return nil
+}
+
+// runConfigEncryptCommand encrypts settings of a .env file in place. Without key names it
+// encrypts the sensitive settings present. Values are bound to this machine unless
+// --passphrase is given, in which case the collector needs CONFIG_PASSPHRASE to start.
+func runConfigEncryptCommand(args []string) error {
+	fs := flag.NewFlagSet("config encrypt", flag.ExitOnError)
+	file := fs.String("file", ".env", "config file to encrypt settings in")
+	usePassphrase := fs.Bool("passphrase", false, "encrypt with CONFIG_PASSPHRASE (asked for when unset) instead of the machine ID")
+	fs.Parse(args)
+
+	prefix := encryptedMachinePrefix
+	secret, err := machineSecret()
+	if *usePassphrase {
+		prefix = encryptedPassphrasePrefix
+		secret, err = configPassphrase()
+		if err != nil {
+			fmt.Print(tr("Passphrase: "))
+			line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			secret, err = strings.TrimSpace(line), nil
+			if secret == "" {
+				return configError("no passphrase given")
+			}
+		}
+	}
+	if err != nil {
+		return configError(err.Error())
+	}
+
+	keys := map[string]bool{}
+	for _, key := range fs.Args() {
+		keys[key] = true
+	}
+	if len(keys) == 0 {
+		for _, key := range sensitiveSettings {
+			keys[key] = true
+		}
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", *file, err)
+	}
+	lines := strings.Split(string(data), "\n")
+	encrypted := 0
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		eq := strings.Index(trimmed, "=")
+		if eq < 0 {
+			continue
+		}
+		key := strings.TrimSpace(strings.TrimPrefix(trimmed[:eq], "export "))
+		value := strings.TrimSpace(trimmed[eq+1:])
+		if !keys[key] || value == "" || strings.HasPrefix(value, "enc:") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		sealed, err := encryptSetting(value, prefix, secret)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", key, err)
+		}
+		lines[i] = key + "=" + sealed
+		encrypted++
+		fmt.Println(tr("Encrypted %s", key))
+	}
+	if encrypted == 0 {
+		fmt.Println(tr("Nothing to encrypt."))
+		return nil
+	}
+	if err := os.WriteFile(*file, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *file, err)
+	}
+	if *usePassphrase {
+		fmt.Println(tr("Set CONFIG_PASSPHRASE or CONFIG_PASSPHRASE_FILE for the collector to start."))
+	} else {
+		fmt.Println(tr("The values can only be decrypted on this machine."))
+	}
+	return nil
+}
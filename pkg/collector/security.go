@@ -0,0 +1,220 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State key of the time of the newest operation log entry delivered, by device ID
+const securitySinceFile = "security_since.json"
+
+// Event type streamed on /api/events for operations that raise an alert
+const eventSecurity = "security"
+
+// errSecurityDelivery means the security sink didn't take the events, which are read again
+var errSecurityDelivery = errors.New("security event delivery failed")
+
+// Operations logged as alerts rather than only delivered to the security sink
+var alertActions = map[string]bool{
+	"tamper":               true,
+	"factory_reset":        true,
+	"data_cleared":         true,
+	"attendance_cleared":   true,
+	"admin_rights_cleared": true,
+}
+
+// securityEvent is one event delivered to the security sink, kept apart from attendance
+// records so access to it can be restricted
+type securityEvent struct {
+	Device  string      `json:"device"`
+	Time    string      `json:"time"`
+	Event   string      `json:"event"`           // Operation such as "menu_access" or "tamper", or "users_changed"
+	Admin   int         `json:"admin,omitempty"` // Administrator signed in at the terminal
+	Params  []int       `json:"params,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// securityUpload is the body posted to SECURITY_URL
+type securityUpload struct {
+	OrgID  string          `json:"org_id"`
+	Events []securityEvent `json:"events"`
+}
+
+// noOperationLog remembers devices whose firmware rejected the operation log read, so
+// they are not asked again every cycle
+var noOperationLog = struct {
+	sync.Mutex
+	devices map[string]bool
+}{devices: map[string]bool{}}
+
+// securitySinkConfigured reports whether SECURITY_URL or SECURITY_FILE is set
+func securitySinkConfigured() bool {
+	return os.Getenv("SECURITY_URL") != "" || os.Getenv("SECURITY_FILE") != ""
+}
+
+// deliverSecurityEvents sends events to the security sink: posted to SECURITY_URL and
+// appended as JSON lines to SECURITY_FILE, whichever are set
+func deliverSecurityEvents(events []securityEvent) error {
+	if len(events) == 0 || !securitySinkConfigured() {
+		return nil
+	}
+	if path := os.Getenv("SECURITY_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open security file: %w", err)
+		}
+		enc := json.NewEncoder(f)
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				f.Close()
+				return fmt.Errorf("failed to write security file: %w", err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write security file: %w", err)
+		}
+	}
+
+	url := os.Getenv("SECURITY_URL")
+	if url == "" {
+		return nil
+	}
+	body, err := json.Marshal(securityUpload{OrgID: os.Getenv("ORG_ID"), Events: events})
+	if err != nil {
+		return err
+	}
+	req, err := sink.NewAPIRequest("POST", url, body, os.Getenv("API_KEY"))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute security request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("security event upload failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// loadSecuritySince returns the time of the newest delivered operation per device
+func loadSecuritySince() map[string]time.Time {
+	since := map[string]time.Time{}
+	data, err := state().Get(securitySinceFile)
+	if err != nil || data == nil {
+		return since
+	}
+	if err := json.Unmarshal(data, &since); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", securitySinceFile, err)
+		return map[string]time.Time{}
+	}
+	return since
+}
+
+// collectOperations reads a device's operation log and delivers the entries newer than the
+// last delivered one. Tamper alarms and destructive operations are also logged as alerts.
+func collectOperations(device deviceConfig, since time.Time) (time.Time, error) {
+	zkManager, err := newDeviceManager(device)
+	if err != nil {
+		return since, err
+	}
+	operations, err := zkManager.GetOperationLog()
+	if err != nil {
+		return since, err
+	}
+	sort.SliceStable(operations, func(i, j int) bool { return operations[i].Time.Before(operations[j].Time) })
+
+	var events []securityEvent
+	newest := since
+	for _, op := range operations {
+		if !op.Time.After(since) {
+			continue
+		}
+		event := securityEvent{Device: device.ID, Time: op.Time.Format(time.RFC3339), Event: op.Action, Admin: op.Admin}
+		if op.Params != [4]int{} {
+			event.Params = append([]int(nil), op.Params[:]...)
+		}
+		events = append(events, event)
+		newest = op.Time
+		if alertActions[op.Action] {
+			log.Printf("ALERT: device %s reported %s at %s (admin %d)", device.ID, op.Action, event.Time, op.Admin)
+			publishEvent(eventSecurity, map[string]interface{}{"device": device.ID, "event": op.Action, "at": event.Time, "admin": op.Admin})
+		}
+	}
+	if err := deliverSecurityEvents(events); err != nil {
+		return since, fmt.Errorf("%w: %v", errSecurityDelivery, err)
+	}
+	if len(events) > 0 {
+		log.Printf("Delivered %d operation log event(s) from device %s", len(events), device.ID)
+	}
+	return newest, nil
+}
+
+// collectSecurityEvents reads the operation logs of the devices read this cycle that have
+// SECURITY_EVENTS enabled. A device's position only advances once its events are delivered.
+func collectSecurityEvents(cycle *syncCycle) {
+	if cycle == nil {
+		return
+	}
+	var due []string
+	cycle.update(func(c *syncCycle) {
+		noOperationLog.Lock()
+		defer noOperationLog.Unlock()
+		for id := range c.devicesRead {
+			if deviceEnvBool("SECURITY_EVENTS", id) && !noOperationLog.devices[id] {
+				due = append(due, id)
+			}
+		}
+	})
+	if len(due) == 0 {
+		return
+	}
+	sort.Strings(due)
+	since := loadSecuritySince()
+	changed := false
+	for _, id := range due {
+		device, ok := configuredDevice(id)
+		if !ok {
+			continue
+		}
+		newest, err := collectOperations(device, since[id])
+		if err != nil {
+			if !errors.Is(err, zk.ErrDeviceUnreachable) && !errors.Is(err, zk.ErrAuthFailed) && !errors.Is(err, errSecurityDelivery) {
+				log.Printf("Device %s keeps no readable operation log, not collecting its security events: %v", id, err)
+				noOperationLog.Lock()
+				noOperationLog.devices[id] = true
+				noOperationLog.Unlock()
+				continue
+			}
+			log.Printf("Error collecting security events: %v", err)
+			continue
+		}
+		if !newest.Equal(since[id]) {
+			since[id] = newest
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	data, err := json.Marshal(since)
+	if err == nil {
+		err = state().Put(securitySinceFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving security event positions: %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package collector
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"old-attendance/pkg/sink"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Updates are checked for this often unless UPDATE_INTERVAL (minutes) overrides it
+	defaultUpdateInterval = time.Hour
+	// A release download taking longer, or larger, than this is abandoned
+	releaseDownloadTimeout = 10 * time.Minute
+	releaseMaxSize         = 256 << 20
+)
+
+// Release is the answer of UPDATE_URL: the collector version a machine should run. The
+// signature is made with the release key over releaseMessage, so a binary can't be passed
+// off as another version or platform.
+type Release struct {
+	Version   string `json:"version"`
+	URL       string `json:"url"`       // Download of the binary
+	SHA256    string `json:"sha256"`    // Hex digest of the binary
+	Signature string `json:"signature"` // Base64 Ed25519 signature, see releaseMessage
+}
+
+// cycleMu is held while a sync cycle runs, so an update doesn't restart the collector in
+// the middle of one
+var cycleMu sync.Mutex
+
+// restart holds what restarting the collector needs: its environment from before .env was
+// loaded, as in Run, and what must stop first, such as tenant collectors
+var restart = struct {
+	sync.Mutex
+	env   []string
+	hooks []func()
+}{}
+
+// onRestart adds a function run before the collector restarts
+func onRestart(fn func()) {
+	restart.Lock()
+	defer restart.Unlock()
+	restart.hooks = append(restart.hooks, fn)
+}
+
+// releaseMessage is what a release signature covers
+func releaseMessage(version, platform, digest string) []byte {
+	return []byte(fmt.Sprintf("attendance-release\n%s\n%s\n%s", version, platform, strings.ToLower(digest)))
+}
+
+// currentPlatform is the GOOS/GOARCH a release must be built for
+func currentPlatform() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// updatePublicKey returns the release key from UPDATE_PUBLIC_KEY
+func updatePublicKey() (ed25519.PublicKey, error) {
+	value := strings.TrimSpace(os.Getenv("UPDATE_PUBLIC_KEY"))
+	if value == "" {
+		return nil, configError("UPDATE_PUBLIC_KEY is required to verify updates")
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, configError("UPDATE_PUBLIC_KEY is not a base64 %d-byte Ed25519 public key", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// checkForUpdate asks UPDATE_URL which version to run, passing the running version, the
+// platform and the collector ID. It returns nil when the running version is the one.
+func checkForUpdate() (*Release, error) {
+	u, err := url.Parse(os.Getenv("UPDATE_URL"))
+	if err != nil {
+		return nil, configError("invalid UPDATE_URL: %v", err)
+	}
+	query := u.Query()
+	query.Set("version", Version)
+	query.Set("platform", currentPlatform())
+	query.Set("collector", collectorID())
+	u.RawQuery = query.Encode()
+
+	req, err := sink.NewAPIRequest("GET", u.String(), nil, os.Getenv("API_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute update check: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("update check failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	var release Release
+	if err := json.Unmarshal(body, &release); err != nil {
+		return nil, fmt.Errorf("invalid update check response: %w", err)
+	}
+	if release.Version == "" || release.Version == Version {
+		return nil, nil
+	}
+	// A validly signed older release must not be replayed to roll the collector back
+	if newer, ok := versionNewer(release.Version, Version); !ok {
+		return nil, fmt.Errorf("release version %q is not MAJOR.MINOR.PATCH", release.Version)
+	} else if !newer {
+		return nil, fmt.Errorf("release %s is not newer than the running %s", release.Version, Version)
+	}
+	return &release, nil
+}
+
+// versionNewer reports whether release is a later version than running, comparing their
+// dot-separated numbers, e.g. 1.10.0 after 1.9.2. ok is false if release isn't such a
+// version; a running version that isn't, such as "dev", is older than any release.
+func versionNewer(release, running string) (newer, ok bool) {
+	r, ok := parseVersion(release)
+	if !ok {
+		return false, false
+	}
+	c, ok := parseVersion(running)
+	if !ok {
+		return true, true
+	}
+	for i := 0; i < len(r) || i < len(c); i++ {
+		var a, b int
+		if i < len(r) {
+			a = r[i]
+		}
+		if i < len(c) {
+			b = c[i]
+		}
+		if a != b {
+			return a > b, true
+		}
+	}
+	return false, true
+}
+
+// parseVersion splits a version such as "1.4.0" or "v1.4" into its numbers
+func parseVersion(version string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		numbers[i] = n
+	}
+	return numbers, true
+}
+
+// downloadRelease downloads a release next to the running executable, so it can be renamed
+// over it, and verifies its digest and signature. The caller removes the file on failure.
+func downloadRelease(release *Release, exe string) (string, error) {
+	key, err := updatePublicKey()
+	if err != nil {
+		return "", err
+	}
+	signature, err := base64.StdEncoding.DecodeString(release.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return "", fmt.Errorf("release %s has no valid signature", release.Version)
+	}
+
+	client := &http.Client{Timeout: releaseDownloadTimeout}
+	resp, err := client.Get(release.URL)
+	if err != nil {
+		return "", fmt.Errorf("failed to download release %s: %w", release.Version, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download of release %s failed with status %d", release.Version, resp.StatusCode)
+	}
+	if resp.ContentLength > releaseMaxSize {
+		return "", fmt.Errorf("release %s is %d bytes, more than the %d allowed", release.Version, resp.ContentLength, releaseMaxSize)
+	}
+	path := exe + ".download"
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to save release: %w", err)
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, releaseMaxSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return path, fmt.Errorf("failed to save release: %w", err)
+	}
+	if n > releaseMaxSize {
+		return path, fmt.Errorf("release %s is more than the %d bytes allowed", release.Version, releaseMaxSize)
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(digest, release.SHA256) {
+		return path, fmt.Errorf("release %s does not match its digest: got %s, expected %s", release.Version, digest, release.SHA256)
+	}
+	if !ed25519.Verify(key, releaseMessage(release.Version, currentPlatform(), digest), signature) {
+		return path, fmt.Errorf("release %s is not signed with UPDATE_PUBLIC_KEY", release.Version)
+	}
+	return path, nil
+}
+
+// installRelease downloads, verifies and swaps in a release. The running executable is kept
+// as <name>.previous for going back by hand.
+func installRelease(release *Release) error {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to locate collector executable: %w", err)
+	}
+	path, err := downloadRelease(release, exe)
+	if err != nil {
+		if path != "" {
+			os.Remove(path)
+		}
+		return err
+	}
+	if err := swapExecutable(exe, path); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to install release %s: %w", release.Version, err)
+	}
+	details := map[string]string{"from": Version, "to": release.Version, "sha256": release.SHA256}
+	if err := appendAudit("collector_updated", details); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+	log.Printf("Installed release %s over %s", release.Version, Version)
+	return nil
+}
+
+// startSelfUpdate checks UPDATE_URL every UPDATE_INTERVAL minutes, when set, and installs
+// the version it names, then restarts the collector once the running sync cycle and its
+// deliveries are done. Tenant collectors leave this to their supervisor.
+func startSelfUpdate() {
+	if os.Getenv("UPDATE_URL") == "" || tenantName() != "" {
+		return
+	}
+	if _, err := updatePublicKey(); err != nil {
+		log.Printf("Automatic updates are off: %v", err)
+		return
+	}
+	interval := defaultUpdateInterval
+	if value := os.Getenv("UPDATE_INTERVAL"); value != "" {
+		if parsed, ok := parseSyncInterval(value); ok {
+			interval = parsed
+		} else {
+			log.Printf("Invalid UPDATE_INTERVAL=%q, using %v", value, interval)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			release, err := checkForUpdate()
+			if err != nil {
+				log.Printf("Update check failed: %v", err)
+				continue
+			}
+			if release == nil {
+				continue
+			}
+			log.Printf("Release %s is available, installing", release.Version)
+			if err := installRelease(release); err != nil {
+				log.Printf("ALERT: update to %s failed: %v", release.Version, err)
+				continue
+			}
+			cycleMu.Lock()
+			pauseJobs()
+			sinkPasses.Wait()
+			log.Printf("Restarting into release %s", release.Version)
+			if err := restartCollector(); err != nil {
+				// The new binary starts with the next restart, whoever makes it
+				log.Printf("ALERT: restart after update failed: %v", err)
+			}
+			resumeJobs()
+			cycleMu.Unlock()
+		}
+	}()
+}
+
+// restartCollector stops what must stop first and starts the installed executable in place
+// of this process
+func restartCollector() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	restart.Lock()
+	env, hooks := restart.env, restart.hooks
+	restart.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	return execSelf(exe, os.Args, env)
+}
+
+// runUpdateCommand handles the "update" subcommands: check asks UPDATE_URL for a newer
+// release, install also installs it, and sign makes the release answer for a binary
+func runUpdateCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: update check|install|sign")
+	}
+	switch args[0] {
+	case "check", "install":
+		if os.Getenv("UPDATE_URL") == "" {
+			return configError("UPDATE_URL is not set")
+		}
+		release, err := checkForUpdate()
+		if err != nil {
+			return err
+		}
+		if release == nil {
+			log.Printf("Version %s is current", Version)
+			return nil
+		}
+		if args[0] == "check" {
+			log.Printf("Release %s is available (running %s)", release.Version, Version)
+			return nil
+		}
+		if err := installRelease(release); err != nil {
+			return err
+		}
+		log.Printf("Restart the collector to run release %s", release.Version)
+		return nil
+	case "sign":
+		return runUpdateSignCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown update command %q", args[0])
+	}
+}
+
+// runUpdateSignCommand prints the UPDATE_URL answer for a release binary, signed with a key
+// from the keygen command
+func runUpdateSignCommand(args []string) error {
+	fs := flag.NewFlagSet("update sign", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "file holding the base64 Ed25519 seed printed by keygen")
+	version := fs.String("version", "", "version of the release")
+	platform := fs.String("platform", currentPlatform(), "GOOS/GOARCH the binary is built for")
+	download := fs.String("url", "", "URL the binary is downloaded from")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *keyFile == "" || *version == "" || *download == "" {
+		return errors.New("usage: update sign --key-file FILE --version VERSION --url URL [--platform GOOS/GOARCH] BINARY")
+	}
+	encoded, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("%s does not hold a base64 %d-byte Ed25519 seed", *keyFile, ed25519.SeedSize)
+	}
+	binary, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer binary.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, binary); err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	release := Release{
+		Version:   *version,
+		URL:       *download,
+		SHA256:    digest,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.NewKeyFromSeed(seed), releaseMessage(*version, *platform, digest))),
+	}
+	data, _ := json.MarshalIndent(release, "", "  ")
+	fmt.Println(string(data))
+	return nil
+}
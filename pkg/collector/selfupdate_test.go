@@ -0,0 +1,26 @@
+package collector
+
+import "testing"
+
+func TestVersionNewer(t *testing.T) {
+	tests := []struct {
+		release, running string
+		newer, ok        bool
+	}{
+		{"1.4.1", "1.4.0", true, true},
+		{"1.10.0", "1.9.2", true, true},
+		{"v2.0", "1.9.9", true, true},
+		{"1.4.0", "1.4.0", false, true},
+		{"1.4", "1.4.0", false, true},
+		{"1.3.9", "1.4.0", false, true},
+		{"1.4.0", "dev", true, true},
+		{"latest", "1.4.0", false, false},
+		{"1.4.0-rc1", "1.3.0", false, false},
+	}
+	for _, tt := range tests {
+		newer, ok := versionNewer(tt.release, tt.running)
+		if newer != tt.newer || ok != tt.ok {
+			t.Errorf("versionNewer(%q, %q) = %v, %v, want %v, %v", tt.release, tt.running, newer, ok, tt.newer, tt.ok)
+		}
+	}
+}
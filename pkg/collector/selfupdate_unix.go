@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package collector
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// swapExecutable renames the new executable over the running one, which Unix allows and
+// does atomically. The running one is first linked as <name>.previous, and the swap is
+// abandoned if it can't be, leaving no way back.
+func swapExecutable(exe, next string) error {
+	os.Remove(exe + ".previous")
+	if err := os.Link(exe, exe+".previous"); err != nil {
+		return fmt.Errorf("failed to keep the running executable as %s.previous: %w", exe, err)
+	}
+	return os.Rename(next, exe)
+}
+
+// execSelf replaces this process with the executable at exe. Listening sockets, the
+// instance lock among them, are closed on exec.
+func execSelf(exe string, args, env []string) error {
+	return syscall.Exec(exe, args, env)
+}
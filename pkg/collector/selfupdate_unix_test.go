@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapExecutable(t *testing.T) {
+	dir := t.TempDir()
+	exe, next := filepath.Join(dir, "collector"), filepath.Join(dir, "collector.new")
+	write := func(path, content string) {
+		if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(path string) string {
+		data, _ := os.ReadFile(path)
+		return string(data)
+	}
+
+	write(exe, "old")
+	write(next, "new")
+	if err := swapExecutable(exe, next); err != nil {
+		t.Fatal(err)
+	}
+	if read(exe) != "new" || read(exe+".previous") != "old" {
+		t.Errorf("after the swap exe = %q, previous = %q, want new and old", read(exe), read(exe+".previous"))
+	}
+
+	// Without a copy to go back to, the running executable stays
+	write(next, "newer")
+	os.Remove(exe + ".previous")
+	if err := os.MkdirAll(filepath.Join(exe+".previous", "in-use"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := swapExecutable(exe, next); err == nil {
+		t.Error("swap succeeded without linking the previous executable")
+	}
+	if read(exe) != "new" || read(next) != "newer" {
+		t.Errorf("after a failed swap exe = %q, next = %q, want both untouched", read(exe), read(next))
+	}
+}
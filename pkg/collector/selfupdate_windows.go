@@ -0,0 +1,40 @@
+package collector
+
+import (
+	"log"
+	"os"
+	"os/exec"
+)
+
+// swapExecutable puts the new executable in place of the running one. Windows doesn't let a
+// running executable be replaced, but does let it be renamed, so it moves to
+// <name>.previous first and comes back if the new one can't take its place.
+func swapExecutable(exe, next string) error {
+	os.Remove(exe + ".previous")
+	if err := os.Rename(exe, exe+".previous"); err != nil {
+		return err
+	}
+	if err := os.Rename(next, exe); err != nil {
+		os.Rename(exe+".previous", exe)
+		return err
+	}
+	return nil
+}
+
+// execSelf starts the executable at exe as a new process and exits. Windows has no exec, so
+// the instance lock is released first for the new process to take, and taken back if the
+// new process can't be started, since this one keeps running.
+func execSelf(exe string, args, env []string) error {
+	cmd := exec.Command(exe, args[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	releaseInstanceLock()
+	if err := cmd.Start(); err != nil {
+		if _, lockErr := acquireInstanceLock(); lockErr != nil {
+			log.Printf("ALERT: instance lock lost after a failed restart: %v", lockErr)
+		}
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
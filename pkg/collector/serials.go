@@ -0,0 +1,94 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"strings"
+	"sync"
+)
+
+// State key of the serial numbers pinned on first contact, by device ID
+const deviceSerialsFile = "device_serials.json"
+
+// ErrDeviceMismatch means a device address now answers with a different terminal
+var ErrDeviceMismatch = errors.New("device identity mismatch")
+
+// serialAlerts remembers the mismatches already written to the audit log, so a terminal
+// swapped in at a configured address is audited once rather than every cycle
+var serialAlerts = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+// loadDeviceSerials returns the pinned serial numbers by device ID
+func loadDeviceSerials() map[string]string {
+	serials := map[string]string{}
+	data, err := state().Get(deviceSerialsFile)
+	if err != nil || data == nil {
+		return serials
+	}
+	if err := json.Unmarshal(data, &serials); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", deviceSerialsFile, err)
+		return map[string]string{}
+	}
+	return serials
+}
+
+// verifyDeviceSerial checks that the terminal at a device's address is the one configured
+// for it, before its punches are attributed to the device. The expected serial number is
+// DEVICE_SERIAL_<DEVICE> when set; otherwise, with VERIFY_DEVICE_SERIAL, the serial number
+// seen on first contact is pinned. Firmware that doesn't report a serial number is let through.
+func verifyDeviceSerial(zkManager *zk.ZKManager, device deviceConfig) error {
+	deviceID := device.ID
+	expected := strings.TrimSpace(deviceEnv("DEVICE_SERIAL", deviceID))
+	if expected == "" && !deviceEnvBool("VERIFY_DEVICE_SERIAL", deviceID) {
+		return nil
+	}
+	serial, err := zkManager.GetSerialNumber()
+	if err != nil {
+		if errors.Is(err, zk.ErrDeviceUnreachable) || errors.Is(err, zk.ErrAuthFailed) {
+			return err
+		}
+		log.Printf("Cannot verify serial number of device %s: %v", deviceID, err)
+		return nil
+	}
+
+	if expected == "" {
+		serials := loadDeviceSerials()
+		pinned, ok := serials[deviceID]
+		if !ok {
+			log.Printf("Device %s has serial number %s, pinning it", deviceID, serial)
+			serials[deviceID] = serial
+			data, err := json.Marshal(serials)
+			if err == nil {
+				err = state().Put(deviceSerialsFile, data)
+			}
+			if err != nil {
+				log.Printf("Error saving device serial numbers: %v", err)
+			}
+			return nil
+		}
+		expected = pinned
+	}
+	if serial == expected {
+		return nil
+	}
+
+	log.Printf("ALERT: device %s at %s answers with serial number %s instead of %s; its punches are not collected until this is resolved",
+		deviceID, device.Addr(), serial, expected)
+	serialAlerts.Lock()
+	key := deviceID + "|" + serial
+	first := !serialAlerts.seen[key]
+	serialAlerts.seen[key] = true
+	serialAlerts.Unlock()
+	if first {
+		details := map[string]string{"device": deviceID, "expected_serial": expected, "found_serial": serial}
+		if err := appendAudit("device_serial_mismatch", details); err != nil {
+			log.Printf("Error writing audit log: %v", err)
+		}
+	}
+	return fmt.Errorf("%w: device %s expected serial number %s, found %s", ErrDeviceMismatch, deviceID, expected, serial)
+}
@@ -0,0 +1,219 @@
+package collector
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// wizard asks questions on the terminal, offering defaults that Enter accepts
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints a question and returns the answer, or def when it is empty
+func (w *wizard) ask(question, def string) string {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line == "" {
+		if err == io.EOF && def == "" {
+			fmt.Fprintln(w.out)
+		}
+		return def
+	}
+	return line
+}
+
+// confirm asks a yes/no question
+func (w *wizard) confirm(question string, def bool) bool {
+	hint := tr("y/N")
+	if def {
+		hint = tr("Y/n")
+	}
+	answer := strings.ToLower(w.ask(question+" ("+hint+")", ""))
+	if answer == "" {
+		return def
+	}
+	return strings.HasPrefix(answer, "y") || strings.HasPrefix(answer, "হ")
+}
+
+// runInitCommand walks through a first setup: it finds the terminals on the local network,
+// takes the API endpoint and credentials and tests them, and writes a starter .env
+func runInitCommand(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("output", ".env", "config file to write")
+	fs.Parse(args)
+
+	w := &wizard{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	fmt.Fprintln(w.out, tr("Attendance collector setup. Press Enter to accept the value in brackets."))
+	if _, err := os.Stat(*output); err == nil && !w.confirm(tr("%s already exists. Overwrite it?", *output), false) {
+		return errors.New(tr("setup cancelled, %s left unchanged", *output))
+	}
+
+	settings := map[string]string{}
+	if devices := w.askDevices(); devices != "" {
+		settings["DEVICE_IPS"] = devices
+	}
+
+	fmt.Fprintln(w.out, "\n"+tr("Attendance API"))
+	settings["API_URL"] = w.ask(tr("API URL"), os.Getenv("API_URL"))
+	settings["ORG_ID"] = w.ask(tr("Organization ID"), os.Getenv("ORG_ID"))
+	settings["API_KEY"] = w.ask(tr("API key"), os.Getenv("API_KEY"))
+	if settings["API_URL"] != "" && w.confirm(tr("Send a test request to the API now?"), true) {
+		os.Setenv("API_URL", settings["API_URL"])
+		os.Setenv("API_KEY", settings["API_KEY"])
+		if err := runTestAPICommand(nil); err != nil {
+			fmt.Fprintln(w.out, tr("The API test failed: %v", err))
+			if !w.confirm(tr("Save the configuration anyway?"), false) {
+				return errors.New(tr("setup cancelled, fix the API settings and run init again"))
+			}
+		}
+	}
+
+	interval := w.ask(tr("Minutes between syncs"), "5")
+	for {
+		if _, ok := parseSyncInterval(interval); ok {
+			break
+		}
+		interval = w.ask(tr("Please enter a whole number of minutes"), "5")
+	}
+	settings["SYNC_INTERVAL"] = interval
+	if addr := w.ask(tr("Admin server address for monitoring (empty to disable)"), "127.0.0.1:9090"); addr != "" {
+		settings["ADMIN_ADDR"] = addr
+	}
+
+	if err := writeEnvFile(*output, settings); err != nil {
+		return err
+	}
+	fmt.Fprintln(w.out, "\n"+tr("Wrote %s. Optional settings are described in .env.example.", *output))
+	for key, value := range settings {
+		os.Setenv(key, value)
+	}
+	if problems := validateConfig(); len(problems) > 0 {
+		fmt.Fprintln(w.out, tr("Remaining configuration notes:"))
+		for _, p := range problems {
+			fmt.Fprintf(w.out, "  %s: %s\n", p.Key, p.Message)
+		}
+	}
+	fmt.Fprintln(w.out, tr("Start the collector without arguments to begin syncing."))
+	return nil
+}
+
+// askDevices scans a subnet for terminals and names the ones found, then takes any others
+// by address. It returns the DEVICE_IPS value.
+func (w *wizard) askDevices() string {
+	fmt.Fprintln(w.out, "\n"+tr("Terminals"))
+	var entries []string
+	names := map[string]bool{}
+	if w.confirm(tr("Search the local network for terminals?"), true) {
+		subnet := w.ask(tr("Subnet to search"), localSubnet())
+		port := defaultDiscoveryPort
+		if p, err := strconv.Atoi(w.ask(tr("Device port"), strconv.Itoa(defaultDiscoveryPort))); err == nil && p > 0 {
+			port = p
+		}
+		fmt.Fprintln(w.out, tr("Searching %s, this can take a minute...", subnet))
+		found, err := scanSubnets([]string{subnet}, port)
+		if err != nil {
+			fmt.Fprintln(w.out, tr("Search failed: %v", err))
+		}
+		addrs := make([]string, 0, len(found))
+		for addr := range found {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		if len(addrs) == 0 && err == nil {
+			fmt.Fprintln(w.out, tr("No terminals answered."))
+		}
+		for i, addr := range addrs {
+			fmt.Fprintln(w.out, tr("Found terminal %s (serial number %s)", addr, found[addr]))
+			if !w.confirm(tr("Sync this terminal?"), true) {
+				continue
+			}
+			name := w.askDeviceName(fmt.Sprintf("device%d", i+1), names)
+			entries = append(entries, name+"="+addr)
+		}
+	}
+	for w.confirm(tr("Add a terminal by address?"), len(entries) == 0) {
+		addr := w.ask(tr("Address (ip:port, or serial:/dev/ttyUSB0)"), "")
+		if _, err := parseDevice(addr); err != nil || addr == "" {
+			fmt.Fprintln(w.out, tr("%q is not a device address", addr))
+			continue
+		}
+		name := w.askDeviceName(fmt.Sprintf("device%d", len(entries)+1), names)
+		entries = append(entries, name+"="+addr)
+	}
+	return strings.Join(entries, ",")
+}
+
+// askDeviceName asks for a unique device name made of letters, digits, "-" and "_"
+func (w *wizard) askDeviceName(def string, taken map[string]bool) string {
+	for {
+		name := w.ask(tr("Name for this terminal, e.g. main-gate"), def)
+		valid := name != ""
+		for _, r := range name {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				valid = false
+			}
+		}
+		switch {
+		case !valid:
+			fmt.Fprintln(w.out, tr("Use letters, digits, - and _ only."))
+		case taken[name]:
+			fmt.Fprintln(w.out, tr("%s is already used.", name))
+		default:
+			taken[name] = true
+			return name
+		}
+	}
+}
+
+// localSubnet guesses the /24 of the first private IPv4 address of this machine
+func localSubnet() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipNet.IP.To4(); ip != nil && ip.IsPrivate() {
+			return fmt.Sprintf("%d.%d.%d.0/24", ip[0], ip[1], ip[2])
+		}
+	}
+	return ""
+}
+
+// writeEnvFile writes settings as a .env file in a fixed order, quoting values that need it
+func writeEnvFile(path string, settings map[string]string) error {
+	var b strings.Builder
+	b.WriteString("# Written by \"init\". See .env.example for the optional settings.\n")
+	for _, key := range []string{"DEVICE_IPS", "API_URL", "ORG_ID", "API_KEY", "SYNC_INTERVAL", "ADMIN_ADDR"} {
+		value, ok := settings[key]
+		if !ok || value == "" {
+			continue
+		}
+		if strings.ContainsAny(value, " #\"'\\") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, "%s=%s\n", key, value)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
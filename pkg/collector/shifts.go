@@ -0,0 +1,222 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses set on punches that fall in a shift
+const (
+	statusOnTime     = "on_time"
+	statusLate       = "late"
+	statusEarlyLeave = "early_leave"
+)
+
+// How long before a shift starts and after it ends punches still count towards it
+const shiftPunchMargin = 4 * time.Hour
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// shift is a named working period, ending the next day when End is before Start
+type shift struct {
+	Name       string
+	Start, End time.Duration // Offsets from midnight
+	Days       [7]bool       // Weekdays the shift starts on
+}
+
+// shiftSchedule assigns shifts to employees
+type shiftSchedule struct {
+	shifts    map[string]*shift
+	employees map[int]*shift
+	fallback  *shift        // SHIFT_DEFAULT, for employees in no shift's list
+	grace     time.Duration // Lateness and early leave within it count as on time
+}
+
+// parseWeekdays parses "sun-thu" or "mon,wed,fri" into the weekdays listed
+func parseWeekdays(value string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.Split(part, "-")
+		first, ok := weekdayNames[strings.TrimSpace(bounds[0])]
+		last := first
+		if ok && len(bounds) == 2 {
+			last, ok = weekdayNames[strings.TrimSpace(bounds[1])]
+		}
+		if !ok || len(bounds) > 2 {
+			return days, fmt.Errorf("invalid weekdays %q, expected e.g. sun-thu or mon,wed,fri", part)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseEmployeeIDs parses "101,105-120" into the employee IDs listed
+func parseEmployeeIDs(value string) ([]int, error) {
+	var ids []int
+	for _, part := range splitList(value) {
+		bounds := strings.Split(part, "-")
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		}
+		if err != nil || len(bounds) > 2 || last < first {
+			return nil, fmt.Errorf("invalid employee IDs %q, expected e.g. 101 or 105-120", part)
+		}
+		for id := first; id <= last; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// loadShiftSchedule reads the schedule: SHIFTS lists the shifts as "name=HH:MM-HH:MM",
+// SHIFT_EMPLOYEES_<NAME> the employees working each, SHIFT_DAYS_<NAME> the weekdays it runs
+// (every day when unset) and SHIFT_DEFAULT the shift of everyone else. It returns nil
+// without SHIFTS.
+func loadShiftSchedule() (*shiftSchedule, error) {
+	value := os.Getenv("SHIFTS")
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	schedule := &shiftSchedule{shifts: map[string]*shift{}, employees: map[int]*shift{}}
+	for _, entry := range splitList(value) {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("SHIFTS entry %q is not name=HH:MM-HH:MM", entry)
+		}
+		name := strings.TrimSpace(entry[:i])
+		windows, err := parseClockWindows(entry[i+1:])
+		if err != nil || len(windows) != 1 {
+			return nil, fmt.Errorf("SHIFTS entry %q is not name=HH:MM-HH:MM", entry)
+		}
+		s := &shift{Name: name, Start: windows[0].Start, End: windows[0].End}
+		for d := range s.Days {
+			s.Days[d] = true
+		}
+		if days := os.Getenv("SHIFT_DAYS_" + envSuffix(name)); days != "" {
+			if s.Days, err = parseWeekdays(days); err != nil {
+				return nil, fmt.Errorf("SHIFT_DAYS_%s: %w", envSuffix(name), err)
+			}
+		}
+		ids, err := parseEmployeeIDs(os.Getenv("SHIFT_EMPLOYEES_" + envSuffix(name)))
+		if err != nil {
+			return nil, fmt.Errorf("SHIFT_EMPLOYEES_%s: %w", envSuffix(name), err)
+		}
+		for _, id := range ids {
+			if other, ok := schedule.employees[id]; ok {
+				return nil, fmt.Errorf("employee %d is assigned to shifts %s and %s", id, other.Name, name)
+			}
+			schedule.employees[id] = s
+		}
+		schedule.shifts[name] = s
+	}
+	if name := strings.TrimSpace(os.Getenv("SHIFT_DEFAULT")); name != "" {
+		if schedule.fallback = schedule.shifts[name]; schedule.fallback == nil {
+			return nil, fmt.Errorf("SHIFT_DEFAULT %q is not one of SHIFTS", name)
+		}
+	}
+	if value := os.Getenv("SHIFT_GRACE"); value != "" {
+		minutes, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || minutes < 0 {
+			return nil, fmt.Errorf("SHIFT_GRACE %q is not a number of minutes", value)
+		}
+		schedule.grace = time.Duration(minutes) * time.Minute
+	}
+	return schedule, nil
+}
+
+// classify finds the run of the shift a punch belongs to and compares the punch with its
+// start when it is in the first half, or with its end when in the second. Entrance and exit
+// terminals (DEVICE_DIRECTION) are always compared with the start or the end. It returns
+// false for a punch outside any run, e.g. on a day off or a holiday.
+func (s *shift) classify(at time.Time, direction string, grace time.Duration) (string, bool) {
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+	for _, date := range []time.Time{day, day.AddDate(0, 0, -1), day.AddDate(0, 0, 1)} {
+		if !s.Days[date.Weekday()] {
+			continue
+		}
+		if _, holiday := holidayCalendarNow().holiday(date); holiday {
+			continue
+		}
+		start := date.Add(s.Start)
+		end := date.Add(s.End)
+		if s.End <= s.Start {
+			end = end.Add(24 * time.Hour)
+		}
+		if at.Before(start.Add(-shiftPunchMargin)) || at.After(end.Add(shiftPunchMargin)) {
+			continue
+		}
+		arriving := at.Before(start.Add(end.Sub(start) / 2))
+		if direction == directionIn || direction == directionOut {
+			arriving = direction == directionIn
+		}
+		switch {
+		case arriving && at.After(start.Add(grace)):
+			return statusLate, true
+		case !arriving && at.Before(end.Add(-grace)):
+			return statusEarlyLeave, true
+		default:
+			return statusOnTime, true
+		}
+	}
+	return "", false
+}
+
+// applyShifts tags punches with their employee's shift and whether they were on time, late,
+// or left early, for backends without shift logic
+func applyShifts(logs []zk.AttendanceRecord) {
+	schedule, err := loadShiftSchedule()
+	if err != nil {
+		log.Printf("Invalid shift schedule, not tagging punches: %v", err)
+		return
+	}
+	if schedule == nil {
+		return
+	}
+	late, early := 0, 0
+	for i, record := range logs {
+		s := schedule.employees[record.UserID]
+		if s == nil {
+			s = schedule.fallback
+		}
+		if s == nil {
+			continue
+		}
+		at, err := record.Time()
+		if err != nil {
+			continue
+		}
+		status, ok := s.classify(at, deviceDirection(record.DeviceID), schedule.grace)
+		if !ok {
+			continue
+		}
+		logs[i].Shift, logs[i].Status = s.Name, status
+		switch status {
+		case statusLate:
+			late++
+		case statusEarlyLeave:
+			early++
+		}
+	}
+	if late > 0 || early > 0 {
+		log.Printf("Shift check: %d late arrival(s), %d early leave(s)", late, early)
+	}
+}
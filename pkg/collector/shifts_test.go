@@ -0,0 +1,130 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"old-attendance/pkg/zk"
+)
+
+// withHolidays runs a test with calendar in place of the configured holiday calendar
+func withHolidays(t *testing.T, calendar *holidayCalendar) {
+	t.Helper()
+	holidays.Lock()
+	saved, savedAt := holidays.calendar, holidays.loadedAt
+	holidays.calendar, holidays.loadedAt = calendar, time.Now()
+	holidays.Unlock()
+	t.Cleanup(func() {
+		holidays.Lock()
+		holidays.calendar, holidays.loadedAt = saved, savedAt
+		holidays.Unlock()
+	})
+}
+
+func TestShiftClassify(t *testing.T) {
+	withHolidays(t, &holidayCalendar{dates: map[string]string{"2024-03-11": "Test Day"}})
+	everyDay := [7]bool{true, true, true, true, true, true, true}
+	sunToThu, _ := parseWeekdays("sun-thu")
+	day := &shift{Name: "day", Start: 9 * time.Hour, End: 17 * time.Hour, Days: sunToThu}
+	night := &shift{Name: "night", Start: 22 * time.Hour, End: 6 * time.Hour, Days: everyDay}
+	nightSunToThu := &shift{Name: "night", Start: 22 * time.Hour, End: 6 * time.Hour, Days: sunToThu}
+	grace := 10 * time.Minute
+
+	// March 4th, 2024 is a Monday; the 11th is a holiday
+	tests := []struct {
+		name      string
+		shift     *shift
+		at        string
+		direction string
+		status    string // "" for no run of the shift
+	}{
+		{"early arrival", day, "2024-03-04 08:55", "", statusOnTime},
+		{"arrival at the end of the grace", day, "2024-03-04 09:10", "", statusOnTime},
+		{"late arrival", day, "2024-03-04 09:11", "", statusLate},
+		{"late in the first half", day, "2024-03-04 12:59", "", statusLate},
+		{"early leave from mid-shift", day, "2024-03-04 13:00", "", statusEarlyLeave},
+		{"leave within the grace", day, "2024-03-04 16:50", "", statusOnTime},
+		{"leave after the end", day, "2024-03-04 17:30", "", statusOnTime},
+		{"earliest counted punch", day, "2024-03-04 05:00", "", statusOnTime},
+		{"before the margin", day, "2024-03-04 04:59", "", ""},
+		{"after the margin", day, "2024-03-04 21:01", "", ""},
+		{"entrance terminal late in the afternoon", day, "2024-03-04 16:00", directionIn, statusLate},
+		{"exit terminal in the morning", day, "2024-03-04 10:00", directionOut, statusEarlyLeave},
+		{"day off", day, "2024-03-08 09:00", "", ""},
+		{"holiday", day, "2024-03-11 09:00", "", ""},
+
+		{"overnight early arrival", night, "2024-03-04 21:55", "", statusOnTime},
+		{"overnight late arrival", night, "2024-03-04 22:20", "", statusLate},
+		{"overnight late after midnight", night, "2024-03-05 00:30", "", statusLate},
+		{"overnight early leave", night, "2024-03-05 03:00", "", statusEarlyLeave},
+		{"overnight leave within the grace", night, "2024-03-05 05:55", "", statusOnTime},
+		{"overnight leave after the end", night, "2024-03-05 06:30", "", statusOnTime},
+		{"overnight run started the day before a day off", nightSunToThu, "2024-03-08 02:00", "", statusEarlyLeave},
+		{"overnight on a night off", nightSunToThu, "2024-03-09 01:00", "", ""},
+		{"overnight run starting on a holiday", night, "2024-03-12 02:00", "", ""},
+		{"overnight run ending on a holiday", night, "2024-03-11 05:55", "", statusOnTime},
+	}
+	for _, tt := range tests {
+		at, err := time.ParseInLocation("2006-01-02 15:04", tt.at, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, ok := tt.shift.classify(at, tt.direction, grace)
+		if ok != (tt.status != "") || status != tt.status {
+			t.Errorf("%s: classify(%s) = %q, %v, want %q", tt.name, tt.at, status, ok, tt.status)
+		}
+	}
+}
+
+func TestLoadShiftSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"none", map[string]string{}, false},
+		{"shifts", map[string]string{"SHIFTS": "day=09:00-17:00, night=22:00-06:00", "SHIFT_EMPLOYEES_NIGHT": "200-201", "SHIFT_DEFAULT": "day", "SHIFT_GRACE": "10"}, false},
+		{"no name", map[string]string{"SHIFTS": "=09:00-17:00"}, true},
+		{"no hours", map[string]string{"SHIFTS": "day"}, true},
+		{"two windows", map[string]string{"SHIFTS": "day=09:00-12:00,13:00-17:00"}, true},
+		{"invalid days", map[string]string{"SHIFTS": "day=09:00-17:00", "SHIFT_DAYS_DAY": "weekdays"}, true},
+		{"invalid employees", map[string]string{"SHIFTS": "day=09:00-17:00", "SHIFT_EMPLOYEES_DAY": "120-105"}, true},
+		{"employee in two shifts", map[string]string{"SHIFTS": "day=09:00-17:00,night=22:00-06:00", "SHIFT_EMPLOYEES_DAY": "1-5", "SHIFT_EMPLOYEES_NIGHT": "5"}, true},
+		{"unknown default", map[string]string{"SHIFTS": "day=09:00-17:00", "SHIFT_DEFAULT": "evening"}, true},
+		{"invalid grace", map[string]string{"SHIFTS": "day=09:00-17:00", "SHIFT_GRACE": "-5"}, true},
+	}
+	for _, tt := range tests {
+		for _, key := range []string{"SHIFTS", "SHIFT_DEFAULT", "SHIFT_GRACE", "SHIFT_DAYS_DAY", "SHIFT_EMPLOYEES_DAY", "SHIFT_EMPLOYEES_NIGHT"} {
+			t.Setenv(key, tt.env[key])
+		}
+		if _, err := loadShiftSchedule(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyShifts(t *testing.T) {
+	withHolidays(t, &holidayCalendar{dates: map[string]string{}})
+	t.Setenv("SHIFTS", "day=09:00-17:00,night=22:00-06:00")
+	t.Setenv("SHIFT_EMPLOYEES_NIGHT", "200-201")
+	t.Setenv("SHIFT_GRACE", "5")
+	logs := []zk.AttendanceRecord{
+		{UserID: 1, Timestamp: "2024-03-04T09:30:00"},
+		{UserID: 200, Timestamp: "2024-03-04T22:03:00"},
+		{UserID: 201, Timestamp: "2024-03-05T02:00:00"},
+	}
+	t.Setenv("SHIFT_DEFAULT", "")
+	applyShifts(logs)
+	if logs[0].Shift != "" || logs[0].Status != "" {
+		t.Errorf("employee in no shift tagged %s/%s without SHIFT_DEFAULT", logs[0].Shift, logs[0].Status)
+	}
+
+	t.Setenv("SHIFT_DEFAULT", "day")
+	applyShifts(logs)
+	want := [][2]string{{"day", statusLate}, {"night", statusOnTime}, {"night", statusEarlyLeave}}
+	for i, record := range logs {
+		if record.Shift != want[i][0] || record.Status != want[i][1] {
+			t.Errorf("user %d at %s tagged %s/%s, want %s/%s", record.UserID, record.Timestamp, record.Shift, record.Status, want[i][0], want[i][1])
+		}
+	}
+}
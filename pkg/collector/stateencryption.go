@@ -0,0 +1,443 @@
+package collector
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Encrypted state is a series of lines, each this prefix and a base64 AES-256-GCM sealed
+// chunk: one for a value that was put, another for each append, so appending stays cheap.
+// Each chunk is sealed with a hash of the line before it, so a line removed, repeated or
+// moved no longer opens.
+const encryptedFramePrefix = "enc1:"
+
+const stateKeySize = 32
+
+// stateKey holds the cipher for state at rest, from STATE_ENCRYPTION_KEY or
+// STATE_ENCRYPTION_KEY_FILE; nil when neither is set
+var stateKey struct {
+	once sync.Once
+	aead cipher.AEAD
+	err  error
+}
+
+// stateCipher returns the cipher state is encrypted with, or nil when it isn't
+func stateCipher() (cipher.AEAD, error) {
+	stateKey.once.Do(func() {
+		value := strings.TrimSpace(os.Getenv("STATE_ENCRYPTION_KEY"))
+		if path := os.Getenv("STATE_ENCRYPTION_KEY_FILE"); value == "" && path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				stateKey.err = fmt.Errorf("failed to read STATE_ENCRYPTION_KEY_FILE: %w", err)
+				return
+			}
+			value = strings.TrimSpace(string(data))
+		}
+		if value == "" {
+			return
+		}
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != stateKeySize {
+			stateKey.err = fmt.Errorf(`state encryption key is not a base64 %d-byte key; generate one with "config state-key"`, stateKeySize)
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err == nil {
+			stateKey.aead, err = cipher.NewGCM(block)
+		}
+		stateKey.err = err
+	})
+	return stateKey.aead, stateKey.err
+}
+
+// isEncrypted reports whether stored data was written encrypted
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedFramePrefix))
+}
+
+// frameChainStart is what the first frame of a value is chained to
+var frameChainStart = make([]byte, sha256.Size)
+
+// frameAAD is the data authenticated with a frame: the name it is stored under, so one
+// file's content can't be passed off as another's, and the hash of the frame before it
+func frameAAD(name string, prev []byte) []byte {
+	return append(append([]byte(name), 0), prev...)
+}
+
+// frameHash is the hash a frame's successor is chained to
+func frameHash(frame []byte) []byte {
+	sum := sha256.Sum256(bytes.TrimSuffix(frame, []byte("\n")))
+	return sum[:]
+}
+
+// sealFrame encrypts data as one frame following the frame hashed to prev
+func sealFrame(aead cipher.AEAD, name string, prev, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, data, frameAAD(name, prev))
+	frame := make([]byte, 0, len(encryptedFramePrefix)+base64.StdEncoding.EncodedLen(len(sealed))+1)
+	frame = append(frame, encryptedFramePrefix...)
+	frame = append(frame, base64.StdEncoding.EncodeToString(sealed)...)
+	return append(frame, '\n'), nil
+}
+
+// openFrames decrypts the frames of encrypted data and joins them
+func openFrames(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	plain, _, _, err := openChain(aead, name, data)
+	return plain, err
+}
+
+// openChain decrypts the frames of encrypted data and joins them, returning as well the hash
+// the next frame is chained to and whether the last frame was torn. A crash in the middle of
+// an append can only tear the last, unterminated line, which is dropped like a torn line of
+// a plain file; any other frame that doesn't open means the data was altered, or written
+// with another key.
+func openChain(aead cipher.AEAD, name string, data []byte) (plain, next []byte, torn bool, err error) {
+	if aead == nil {
+		return nil, nil, false, fmt.Errorf("%s is encrypted; set STATE_ENCRYPTION_KEY to read it", name)
+	}
+	plain, next = []byte{}, frameChainStart
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		chunk, err := openFrame(aead, name, next, line)
+		if err != nil {
+			if i == len(lines)-1 {
+				log.Printf("Dropped a torn encrypted chunk at the end of %s", name)
+				return plain, next, true, nil
+			}
+			if i == 0 {
+				return nil, nil, false, fmt.Errorf("cannot decrypt %s: it was written with another STATE_ENCRYPTION_KEY or altered", name)
+			}
+			return nil, nil, false, fmt.Errorf("cannot decrypt %s: chunk %d was altered, removed, repeated or moved", name, i+1)
+		}
+		plain = append(plain, chunk...)
+		next = frameHash(line)
+	}
+	return plain, next, false, nil
+}
+
+// openFrame decrypts one frame following the frame hashed to prev
+func openFrame(aead cipher.AEAD, name string, prev, line []byte) ([]byte, error) {
+	if !bytes.HasPrefix(line, []byte(encryptedFramePrefix)) {
+		return nil, errors.New("not an encrypted frame")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line[len(encryptedFramePrefix):]))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("short frame")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], frameAAD(name, prev))
+}
+
+// frameTarget is where a chain of frames is stored: a state key or a local file
+type frameTarget interface {
+	size() (int64, error)
+	read() ([]byte, error)
+	write(data []byte) error
+	append(data []byte) error
+}
+
+// frameTail is where a chain of frames ends: the stored size and the hash of the last frame
+type frameTail struct {
+	size int64
+	next []byte
+}
+
+// frameTails remembers the tails of the chains written, so an append needn't read the value
+// back while its size shows nobody else wrote to it
+type frameTails struct {
+	mu    sync.Mutex
+	tails map[string]frameTail
+}
+
+// remember notes the tail of a chain written or read
+func (t *frameTails) remember(name string, size int64, next []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rememberLocked(name, size, next)
+}
+
+func (t *frameTails) rememberLocked(name string, size int64, next []byte) {
+	if t.tails == nil {
+		t.tails = map[string]frameTail{}
+	}
+	t.tails[name] = frameTail{size: size, next: next}
+}
+
+// forget drops the tail of a chain deleted
+func (t *frameTails) forget(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tails, name)
+}
+
+// put replaces the target's value with value sealed as one frame
+func (t *frameTails) put(aead cipher.AEAD, name string, target frameTarget, value []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.putLocked(aead, name, target, value)
+}
+
+func (t *frameTails) putLocked(aead cipher.AEAD, name string, target frameTarget, value []byte) error {
+	frame, err := sealFrame(aead, name, frameChainStart, value)
+	if err != nil {
+		return err
+	}
+	delete(t.tails, name)
+	if err := target.write(frame); err != nil {
+		return err
+	}
+	t.rememberLocked(name, int64(len(frame)), frameHash(frame))
+	return nil
+}
+
+// append seals data as the next frame of the target's value. The value is only read when
+// its tail isn't known or its size changed behind our back.
+func (t *frameTails) append(aead cipher.AEAD, name string, target frameTarget, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tail, known := t.tails[name]
+	if known {
+		size, err := target.size()
+		if err != nil {
+			return err
+		}
+		known = size == tail.size
+	}
+	var kept []byte // what stays of a value with a torn frame, rewritten with the new one
+	torn := false
+	if !known {
+		existing, err := target.read()
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(existing) == 0:
+			tail = frameTail{next: frameChainStart}
+		case !isEncrypted(existing):
+			// Plain text from before the key was set goes in with the first append
+			return t.putLocked(aead, name, target, append(existing, data...))
+		default:
+			var next []byte
+			if _, next, torn, err = openChain(aead, name, existing); err != nil {
+				return err
+			}
+			tail = frameTail{size: int64(len(existing)), next: next}
+			kept = existing[:bytes.LastIndexByte(existing, '\n')+1]
+		}
+	}
+	frame, err := sealFrame(aead, name, tail.next, data)
+	if err != nil {
+		return err
+	}
+	delete(t.tails, name)
+	size := tail.size + int64(len(frame))
+	if torn {
+		// The new frame can't follow the torn one, so the value is written without it
+		value := append(kept, frame...)
+		err, size = target.write(value), int64(len(value))
+	} else {
+		err = target.append(frame)
+	}
+	if err != nil {
+		return err
+	}
+	t.rememberLocked(name, size, frameHash(frame))
+	return nil
+}
+
+// storeTarget keeps frames under a key of a state store
+type storeTarget struct {
+	store StateStore
+	key   string
+}
+
+func (t storeTarget) size() (int64, error)     { return t.store.Size(t.key) }
+func (t storeTarget) read() ([]byte, error)    { return t.store.Get(t.key) }
+func (t storeTarget) write(data []byte) error  { return t.store.Put(t.key, data) }
+func (t storeTarget) append(data []byte) error { return t.store.Append(t.key, data) }
+
+// fileTarget keeps frames in a local file
+type fileTarget string
+
+func (t fileTarget) size() (int64, error) {
+	info, err := os.Stat(string(t))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (t fileTarget) read() ([]byte, error) {
+	data, err := os.ReadFile(string(t))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (t fileTarget) write(data []byte) error {
+	return writeFileAtomic(string(t), data)
+}
+
+func (t fileTarget) append(data []byte) error {
+	f, err := os.OpenFile(string(t), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// encryptedStateStore encrypts the values of another state store with the state key.
+// Values stored in plain text before the key was set are read as they are and encrypted
+// the next time they are written.
+type encryptedStateStore struct {
+	inner StateStore
+	aead  cipher.AEAD // nil without a key, when encrypted values can't be read
+	tails frameTails
+}
+
+func (s *encryptedStateStore) Get(key string) ([]byte, error) {
+	data, err := s.inner.Get(key)
+	if err != nil || !isEncrypted(data) {
+		return data, err
+	}
+	plain, next, torn, err := openChain(s.aead, key, data)
+	if err == nil && !torn {
+		s.tails.remember(key, int64(len(data)), next)
+	}
+	return plain, err
+}
+
+func (s *encryptedStateStore) Put(key string, value []byte) error {
+	if s.aead == nil {
+		return s.inner.Put(key, value)
+	}
+	return s.tails.put(s.aead, key, storeTarget{s.inner, key}, value)
+}
+
+func (s *encryptedStateStore) Append(key string, data []byte) error {
+	if s.aead == nil {
+		return s.inner.Append(key, data)
+	}
+	return s.tails.append(s.aead, key, storeTarget{s.inner, key}, data)
+}
+
+// Size is the size of the encrypted value, which tells whether it changed but not how long
+// it is decrypted
+func (s *encryptedStateStore) Size(key string) (int64, error) {
+	return s.inner.Size(key)
+}
+
+func (s *encryptedStateStore) Delete(key string) error {
+	s.tails.forget(key)
+	return s.inner.Delete(key)
+}
+
+// localFrameTails are the chain tails of the local files, by path
+var localFrameTails frameTails
+
+// writeLocalFile writes a file kept next to the state, such as punches or the roster,
+// encrypted with the state key when there is one
+func writeLocalFile(path string, data []byte) error {
+	aead, err := stateCipher()
+	if err != nil {
+		return err
+	}
+	if aead == nil {
+		return writeFileAtomic(path, data)
+	}
+	return localFrameTails.put(aead, filepath.Base(path), fileTarget(path), data)
+}
+
+// appendLocalFile is writeLocalFile for appending
+func appendLocalFile(path string, data []byte) error {
+	aead, err := stateCipher()
+	if err != nil {
+		return err
+	}
+	if aead == nil {
+		return fileTarget(path).append(data)
+	}
+	return localFrameTails.append(aead, filepath.Base(path), fileTarget(path), data)
+}
+
+// readLocalFile reads a file written by writeLocalFile or appendLocalFile, decrypting it
+// when it is encrypted
+func readLocalFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !isEncrypted(data) {
+		return data, err
+	}
+	aead, err := stateCipher()
+	if err != nil {
+		return nil, err
+	}
+	return openFrames(aead, filepath.Base(path), data)
+}
+
+// runConfigStateKeyCommand prints a new key for STATE_ENCRYPTION_KEY
+func runConfigStateKeyCommand(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: config state-key")
+	}
+	key := make([]byte, stateKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	fmt.Printf("STATE_ENCRYPTION_KEY=%s\n", base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
+// runConfigReadStateCommand prints a state value, or with --file a local file, decrypted,
+// for support to look into encrypted state
+func runConfigReadStateCommand(args []string) error {
+	fs := flag.NewFlagSet("config read-state", flag.ExitOnError)
+	file := fs.Bool("file", false, "read a local file such as latest_logs.json rather than a state key")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: config read-state [--file] NAME")
+	}
+	name := fs.Arg(0)
+	if !*file {
+		data, err := state().Get(name)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return fmt.Errorf("no state %s", name)
+		}
+		os.Stdout.Write(data)
+		return nil
+	}
+	data, err := readLocalFile(name)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(data)
+	return nil
+}
@@ -0,0 +1,158 @@
+package collector
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testCipher returns a state cipher with a fixed key
+func testCipher(t *testing.T) cipher.AEAD {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{7}, stateKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// encryptedFileStore returns an encrypted store over the files of a temporary directory
+func encryptedFileStore(t *testing.T) (*encryptedStateStore, string) {
+	dir := t.TempDir()
+	return &encryptedStateStore{inner: &fileStateStore{dir: dir}, aead: testCipher(t)}, dir
+}
+
+// storedLines returns the frames stored under key
+func storedLines(t *testing.T, dir, key string) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.SplitAfter(data, []byte("\n"))
+}
+
+func TestEncryptedStateStore(t *testing.T) {
+	store, _ := encryptedFileStore(t)
+	testStateStore(t, store)
+}
+
+func TestEncryptedFramesTampering(t *testing.T) {
+	store, dir := encryptedFileStore(t)
+	for _, chunk := range []string{"a\n", "b\n", "c\n"} {
+		if err := store.Append("log", []byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := storedLines(t, dir, "log")
+	if len(lines) != 4 || len(lines[3]) != 0 {
+		t.Fatalf("stored %d frames, want 3", len(lines)-1)
+	}
+	flipped := append([]byte{}, lines[1]...)
+	flipped[10] ^= 1
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"altered", [][]byte{lines[0], flipped, lines[2]}},
+		{"removed", [][]byte{lines[0], lines[2]}},
+		{"repeated", [][]byte{lines[0], lines[1], lines[1], lines[2]}},
+		{"moved", [][]byte{lines[0], lines[2], lines[1]}},
+		{"repeated at the end", [][]byte{lines[0], lines[1], lines[2], lines[2]}},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(filepath.Join(dir, "log"), bytes.Join(tt.frames, nil), 0644); err != nil {
+			t.Fatal(err)
+		}
+		store.tails.forget("log")
+		if value, err := store.Get("log"); err == nil {
+			t.Errorf("%s frame: Get = %q, want an error", tt.name, value)
+		}
+		if err := store.Append("log", []byte("d\n")); err == nil {
+			t.Errorf("%s frame: Append succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestEncryptedFramesTornTail(t *testing.T) {
+	store, dir := encryptedFileStore(t)
+	for _, chunk := range []string{"a\n", "b\n"} {
+		if err := store.Append("log", []byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A crash in the middle of the second append leaves part of its frame
+	lines := storedLines(t, dir, "log")
+	torn := append(append([]byte{}, lines[0]...), lines[1][:len(lines[1])/2]...)
+	if err := os.WriteFile(filepath.Join(dir, "log"), torn, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get("log"); err != nil || string(value) != "a\n" {
+		t.Fatalf("Get of a torn value = %q, %v, want %q", value, err, "a\n")
+	}
+	if err := store.Append("log", []byte("c\n")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get("log"); err != nil || string(value) != "a\nc\n" {
+		t.Fatalf("Get after appending to a torn value = %q, %v, want %q", value, err, "a\nc\n")
+	}
+}
+
+func TestEncryptedAppendAfterOutsideWrite(t *testing.T) {
+	store, _ := encryptedFileStore(t)
+	if err := store.Append("log", []byte("a\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Another process appends to the same value, so the remembered tail is stale
+	other := &encryptedStateStore{inner: store.inner, aead: store.aead}
+	if err := other.Append("log", []byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append("log", []byte("c\n")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get("log"); err != nil || string(value) != "a\nb\nc\n" {
+		t.Fatalf("Get = %q, %v, want %q", value, err, "a\nb\nc\n")
+	}
+}
+
+func TestEncryptedPlainTextMigration(t *testing.T) {
+	store, dir := encryptedFileStore(t)
+	if err := os.WriteFile(filepath.Join(dir, "log"), []byte("plain\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get("log"); err != nil || string(value) != "plain\n" {
+		t.Fatalf("Get of plain text = %q, %v, want it as it is", value, err)
+	}
+	if err := store.Append("log", []byte("sealed\n")); err != nil {
+		t.Fatal(err)
+	}
+	if lines := storedLines(t, dir, "log"); len(lines) != 2 || !isEncrypted(lines[0]) {
+		t.Fatalf("plain text was not encrypted with the first append: %q", lines)
+	}
+	if value, err := store.Get("log"); err != nil || string(value) != "plain\nsealed\n" {
+		t.Fatalf("Get after migration = %q, %v, want %q", value, err, "plain\nsealed\n")
+	}
+}
+
+func TestEncryptedWrongKey(t *testing.T) {
+	store, _ := encryptedFileStore(t)
+	if err := store.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(bytes.Repeat([]byte{8}, stateKeySize))
+	other, _ := cipher.NewGCM(block)
+	wrong := &encryptedStateStore{inner: store.inner, aead: other}
+	if _, err := wrong.Get("key"); err == nil || !strings.Contains(err.Error(), "another STATE_ENCRYPTION_KEY") {
+		t.Fatalf("Get with another key = %v, want a wrong key error", err)
+	}
+}
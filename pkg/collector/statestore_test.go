@@ -0,0 +1,178 @@
+package collector
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// testStateStore checks a state store keeps values byte for byte, including the binary
+// frames of encrypted state
+func testStateStore(t *testing.T, store StateStore) {
+	t.Helper()
+	if value, err := store.Get("missing"); err != nil || value != nil {
+		t.Fatalf("Get of a missing key = %q, %v, want nil, nil", value, err)
+	}
+	binary := []byte{0, 0xff, 0xfe, 'a', 0, '\n', 0x80}
+	if err := store.Put("key", binary); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get("key"); err != nil || !bytes.Equal(value, binary) {
+		t.Fatalf("Get after Put = %q, %v, want %q", value, err, binary)
+	}
+	if err := store.Append("key", binary); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append("new", []byte("line\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, binary...), binary...)
+	if value, err := store.Get("key"); err != nil || !bytes.Equal(value, want) {
+		t.Fatalf("Get after Append = %q, %v, want %q", value, err, want)
+	}
+	if value, err := store.Get("new"); err != nil || string(value) != "line\n" {
+		t.Fatalf("Get after Append to a missing key = %q, %v, want %q", value, err, "line\n")
+	}
+	if err := store.Put("empty", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get("empty"); err != nil || value == nil || len(value) != 0 {
+		t.Fatalf("Get of an empty value = %q, %v, want an empty value", value, err)
+	}
+	for _, key := range []string{"key", "missing"} {
+		if err := store.Delete(key); err != nil {
+			t.Fatalf("Delete(%q) = %v", key, err)
+		}
+	}
+	if value, err := store.Get("key"); err != nil || value != nil {
+		t.Fatalf("Get after Delete = %q, %v, want nil, nil", value, err)
+	}
+}
+
+func TestStateStores(t *testing.T) {
+	dir := t.TempDir()
+	specs := map[string]string{
+		"file":   "file://" + dir,
+		"sqlite": "sqlite://" + filepath.Join(dir, "state.db"),
+		"bolt":   "bolt://" + filepath.Join(dir, "state.bolt"),
+	}
+	// A Postgres server is only tested when one is given, e.g.
+	// TEST_POSTGRES=postgres://postgres@localhost/attendance_test?sslmode=disable
+	if spec := os.Getenv("TEST_POSTGRES"); spec != "" {
+		specs["postgres"] = spec
+	}
+	for name, spec := range specs {
+		spec := spec
+		t.Run(name, func(t *testing.T) {
+			store, err := openStateStore(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testStateStore(t, store)
+			if err := store.Put("sized", []byte("12345")); err != nil {
+				t.Fatal(err)
+			}
+			if size, err := store.Size("sized"); err != nil || size != 5 {
+				t.Fatalf("Size = %d, %v, want 5", size, err)
+			}
+			if size, err := store.Size("missing"); err != nil || size != 0 {
+				t.Fatalf("Size of a missing key = %d, %v, want 0", size, err)
+			}
+		})
+	}
+}
+
+func TestOpenStateStoreErrors(t *testing.T) {
+	for _, spec := range []string{"sqlite://", "bolt:", "postgres:///attendance", "mysql://host/db", "redis://host/x"} {
+		if _, err := openStateStore(spec); err == nil {
+			t.Errorf("openStateStore(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestFileStatePutReplacesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	store := &fileStateStore{dir: dir}
+	if err := store.Put("records.jsonl", []byte("old\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("records.jsonl", []byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get("records.jsonl"); err != nil || string(value) != "new\n" {
+		t.Fatalf("Get after Put = %q, %v, want %q", value, err, "new\n")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("files left in the state directory: %v, want records.jsonl alone", names)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(dir, "records.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0644 {
+			t.Errorf("mode = %v, want 0644", info.Mode().Perm())
+		}
+	}
+	if err := (&fileStateStore{dir: filepath.Join(dir, "missing")}).Put("key", []byte("value")); err == nil {
+		t.Error("Put into a missing directory succeeded, want an error")
+	}
+}
+
+func TestStateNamespaces(t *testing.T) {
+	spec := "sqlite://" + filepath.Join(t.TempDir(), "state.db")
+	open := func(namespace string) StateStore {
+		t.Helper()
+		t.Setenv("STATE_NAMESPACE", namespace)
+		store, err := openStateStore(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	// State written by a version without namespaces
+	backend, err := openStateBackend(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Put("last_check.txt", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := open("site-a"), open("site-b")
+	for _, store := range []StateStore{a, b} {
+		if value, err := store.Get("last_check.txt"); err != nil || string(value) != "old" {
+			t.Fatalf("Get of state from before namespaces = %q, %v, want %q", value, err, "old")
+		}
+	}
+	if err := a.Put("last_check.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Append("records.jsonl", []byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := b.Get("last_check.txt"); string(value) != "old" {
+		t.Errorf("site-b sees last_check.txt = %q, want its own %q", value, "old")
+	}
+	if value, _ := a.Get("records.jsonl"); value != nil {
+		t.Errorf("site-a sees records.jsonl = %q of site-b", value)
+	}
+
+	// A deleted key stays deleted, in this process and the next
+	if err := a.Delete("last_check.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := open("site-a").Get("last_check.txt"); value != nil {
+		t.Errorf("deleted key came back as %q", value)
+	}
+}
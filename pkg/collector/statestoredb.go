@@ -0,0 +1,234 @@
+package collector
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	bolt "go.etcd.io/bbolt"
+	_ "modernc.org/sqlite"
+)
+
+// Table of the SQL state stores and bucket of the Bolt one
+const stateTable = "attendance_state"
+
+// sqlStateStore keeps each key as a row of a table: in an SQLite file for edge installs, or
+// in Postgres for collectors sharing central state. The database is opened and the table
+// created on first use, so an unreachable server is an error of the operation, not of the
+// configuration.
+type sqlStateStore struct {
+	driver string // "sqlite" or "postgres"
+	dsn    string
+
+	mu sync.Mutex
+	db *sql.DB
+}
+
+// placeholder returns the n-th query parameter in the driver's syntax
+func (s *sqlStateStore) placeholder(n int) string {
+	if s.driver == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// open opens the database and creates the table, once it succeeds
+func (s *sqlStateStore) open() (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		return s.db, nil
+	}
+	db, err := sql.Open(s.driver, s.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s state store: %w", s.driver, err)
+	}
+	blob := "BLOB"
+	if s.driver == "postgres" {
+		blob = "BYTEA"
+	} else {
+		// SQLite allows one writer; the busy timeout makes the others wait their turn
+		db.SetMaxOpenConns(1)
+		if _, err := db.Exec("PRAGMA busy_timeout = 10000"); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to open %s state store: %w", s.driver, err)
+		}
+	}
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key TEXT PRIMARY KEY, value %s NOT NULL)", stateTable, blob)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create %s state table: %w", s.driver, err)
+	}
+	s.db = db
+	return db, nil
+}
+
+func (s *sqlStateStore) Get(key string) ([]byte, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	err = db.QueryRow(fmt.Sprintf("SELECT value FROM %s WHERE key = %s", stateTable, s.placeholder(1)), key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+func (s *sqlStateStore) Put(key string, value []byte) error {
+	return s.upsert(key, value, "excluded.value")
+}
+
+func (s *sqlStateStore) Append(key string, data []byte) error {
+	concat := fmt.Sprintf("%s.value || excluded.value", stateTable)
+	if s.driver != "postgres" {
+		// SQLite concatenates as text, so the result is made a blob again
+		concat = "CAST(" + concat + " AS BLOB)"
+	}
+	return s.upsert(key, data, concat)
+}
+
+// upsert inserts a row, or sets an existing row's value to the expression given
+func (s *sqlStateStore) upsert(key string, value []byte, update string) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	_, err = db.Exec(fmt.Sprintf("INSERT INTO %s (key, value) VALUES (%s, %s) ON CONFLICT (key) DO UPDATE SET value = %s",
+		stateTable, s.placeholder(1), s.placeholder(2), update), key, value)
+	return err
+}
+
+func (s *sqlStateStore) Size(key string) (int64, error) {
+	db, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	length := "length"
+	if s.driver == "postgres" {
+		length = "octet_length"
+	}
+	var size int64
+	err = db.QueryRow(fmt.Sprintf("SELECT %s(value) FROM %s WHERE key = %s", length, stateTable, s.placeholder(1)), key).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return size, err
+}
+
+func (s *sqlStateStore) Delete(key string) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("DELETE FROM %s WHERE key = %s", stateTable, s.placeholder(1)), key)
+	return err
+}
+
+// boltStateStore keeps each key in a bucket of a Bolt file, for edge installs that want one
+// file with transactional writes. Bolt locks the file, so it can't be shared by collectors.
+type boltStateStore struct {
+	path string
+
+	mu sync.Mutex
+	db *bolt.DB
+}
+
+// open opens the file and creates the bucket, once it succeeds
+func (s *boltStateStore) open() (*bolt.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		return s.db, nil
+	}
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt state store %s: %w", s.path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(stateTable))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create bolt state bucket: %w", err)
+	}
+	s.db = db
+	return db, nil
+}
+
+func (s *boltStateStore) Get(key string) ([]byte, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		// Values are only valid during the transaction
+		if v := tx.Bucket([]byte(stateTable)).Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStateStore) Put(key string, value []byte) error {
+	return s.update(key, func([]byte) []byte { return value })
+}
+
+func (s *boltStateStore) Append(key string, data []byte) error {
+	return s.update(key, func(old []byte) []byte {
+		return append(append(make([]byte, 0, len(old)+len(data)), old...), data...)
+	})
+}
+
+// update sets a key to what fn makes of its current value, in one transaction
+func (s *boltStateStore) update(key string, fn func(old []byte) []byte) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(stateTable))
+		value := fn(bucket.Get([]byte(key)))
+		if value == nil {
+			value = []byte{}
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+func (s *boltStateStore) Size(key string) (int64, error) {
+	db, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	err = db.View(func(tx *bolt.Tx) error {
+		size = int64(len(tx.Bucket([]byte(stateTable)).Get([]byte(key))))
+		return nil
+	})
+	return size, err
+}
+
+func (s *boltStateStore) Delete(key string) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(stateTable)).Delete([]byte(key))
+	})
+}
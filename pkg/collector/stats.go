@@ -0,0 +1,403 @@
+package collector
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// State key of the punch statistics
+	punchStatsFile = "punch_stats.json"
+	// Statistics are kept this long unless STATS_RETENTION says otherwise
+	defaultStatsRetention = 90 * 24 * time.Hour
+)
+
+// Periods and groupings statistics are kept for
+const (
+	statsPeriodDay  = "day"
+	statsPeriodWeek = "week"
+	statsByDevice   = "device"
+	statsByUser     = "user"
+)
+
+// statsBucket is the statistics of one device or one employee over a day or an ISO week
+type statsBucket struct {
+	Period     string `json:"period"` // Day as 2006-01-02, or ISO week as 2006-W01
+	By         string `json:"by"`     // statsByDevice or statsByUser
+	Device     string `json:"device,omitempty"`
+	EmployeeID int    `json:"employee_id,omitempty"`
+	Punches    int    `json:"punches"`
+	FirstPunch string `json:"first_punch"`
+	LastPunch  string `json:"last_punch"`
+	Users      []int  `json:"users,omitempty"` // Distinct employees of a device's bucket, sorted
+}
+
+// punchStatsState is the persisted statistics, counted from the record store as records
+// arrive so they outlive STORE_RETENTION
+type punchStatsState struct {
+	NextSeq int64          `json:"next_seq"` // Seq of the first stored record not yet counted
+	Buckets []*statsBucket `json:"buckets"`
+
+	index map[string]*statsBucket
+}
+
+// PunchStat is one row of a statistics report
+type PunchStat struct {
+	Period        string `json:"period"`
+	Device        string `json:"device,omitempty"`
+	EmployeeID    int    `json:"employee_id,omitempty"`
+	Punches       int    `json:"punches"`
+	DistinctUsers int    `json:"distinct_users,omitempty"` // Of a device
+	FirstPunch    string `json:"first_punch"`
+	LastPunch     string `json:"last_punch"`
+}
+
+// statsMu serializes this process's updates of the statistics
+var statsMu sync.Mutex
+
+// loadPunchStats reads the persisted statistics
+func loadPunchStats() *punchStatsState {
+	s := &punchStatsState{}
+	data, err := state().Get(punchStatsFile)
+	if err == nil && data != nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			log.Printf("Invalid %s, counting again from the record store: %v", punchStatsFile, err)
+			s = &punchStatsState{}
+		}
+	} else if err != nil {
+		log.Printf("Error reading %s: %v", punchStatsFile, err)
+	}
+	s.index = map[string]*statsBucket{}
+	for _, b := range s.Buckets {
+		s.index[statsKey(b.Period, b.By, b.Device, b.EmployeeID)] = b
+	}
+	return s
+}
+
+// statsKey identifies a bucket
+func statsKey(period, by, device string, employeeID int) string {
+	return fmt.Sprintf("%s|%s|%s|%d", period, by, device, employeeID)
+}
+
+// bucket returns a bucket, adding it when it doesn't exist yet
+func (s *punchStatsState) bucket(period, by, device string, employeeID int) *statsBucket {
+	key := statsKey(period, by, device, employeeID)
+	b := s.index[key]
+	if b == nil {
+		b = &statsBucket{Period: period, By: by, Device: device, EmployeeID: employeeID}
+		s.index[key] = b
+		s.Buckets = append(s.Buckets, b)
+	}
+	return b
+}
+
+// count adds a stored record to the buckets of its day and week, for its device and employee
+func (s *punchStatsState) count(record storedRecord) {
+	day := recordDay(record.Record)
+	if _, err := time.Parse("2006-01-02", day); err != nil {
+		return
+	}
+	for _, period := range []string{day, isoWeek(day)} {
+		s.bucket(period, statsByDevice, record.Record.DeviceID, 0).add(record, true)
+		s.bucket(period, statsByUser, "", record.Record.UserID).add(record, false)
+	}
+}
+
+// add counts a punch in the bucket, and its employee among the distinct ones if asked
+func (b *statsBucket) add(record storedRecord, distinct bool) {
+	t := queryTime(record.Record)
+	b.Punches++
+	if b.FirstPunch == "" || t < b.FirstPunch {
+		b.FirstPunch = t
+	}
+	if t > b.LastPunch {
+		b.LastPunch = t
+	}
+	if !distinct {
+		return
+	}
+	i := sort.SearchInts(b.Users, record.Record.UserID)
+	if i < len(b.Users) && b.Users[i] == record.Record.UserID {
+		return
+	}
+	b.Users = append(b.Users, 0)
+	copy(b.Users[i+1:], b.Users[i:])
+	b.Users[i] = record.Record.UserID
+}
+
+// prune drops the buckets of periods that ended before a day
+func (s *punchStatsState) prune(before string) int {
+	kept := s.Buckets[:0]
+	for _, b := range s.Buckets {
+		if _, end := periodDays(b.Period); end < before {
+			delete(s.index, statsKey(b.Period, b.By, b.Device, b.EmployeeID))
+			continue
+		}
+		kept = append(kept, b)
+	}
+	removed := len(s.Buckets) - len(kept)
+	s.Buckets = kept
+	return removed
+}
+
+// isoWeek returns the ISO week of a day, as 2006-W01
+func isoWeek(day string) string {
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return ""
+	}
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+// periodDays returns the first and last day of a period, a day or an ISO week
+func periodDays(period string) (string, string) {
+	var year, week int
+	if !strings.Contains(period, "-W") {
+		return period, period
+	}
+	if _, err := fmt.Sscanf(period, "%d-W%d", &year, &week); err != nil {
+		return period, period
+	}
+	// ISO week 1 is the week with January 4th in it
+	jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC)
+	monday := jan4.AddDate(0, 0, -((int(jan4.Weekday())+6)%7)+(week-1)*7)
+	return monday.Format("2006-01-02"), monday.AddDate(0, 0, 6).Format("2006-01-02")
+}
+
+// refreshPunchStats counts the records stored since the statistics were last brought up to
+// date, drops those past STATS_RETENTION and, if save is set, persists the result
+func refreshPunchStats(save bool) (*punchStatsState, error) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	s := loadPunchStats()
+	records, err := readStore()
+	if err != nil {
+		return s, err
+	}
+	changed := false
+	for _, record := range records {
+		if record.Seq < s.NextSeq {
+			continue
+		}
+		s.count(record)
+		s.NextSeq = record.Seq + 1
+		changed = true
+	}
+	retention := retentionSetting("STATS_RETENTION")
+	if retention == 0 {
+		retention = defaultStatsRetention
+	}
+	if s.prune(time.Now().Add(-retention).Format("2006-01-02")) > 0 {
+		changed = true
+	}
+	if !save || !changed {
+		return s, nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return s, err
+	}
+	return s, state().Put(punchStatsFile, data)
+}
+
+// updatePunchStats brings the persisted statistics up to date after records were stored
+func updatePunchStats() {
+	if _, err := refreshPunchStats(true); err != nil {
+		log.Printf("Error updating punch statistics: %v", err)
+	}
+}
+
+// report returns the statistics of the days or weeks overlapping from to to (YYYY-MM-DD),
+// per device or per employee, in period order
+func (s *punchStatsState) report(period, by, from, to string) []PunchStat {
+	stats := []PunchStat{}
+	for _, b := range s.Buckets {
+		weekly := strings.Contains(b.Period, "-W")
+		if b.By != by || weekly != (period == statsPeriodWeek) {
+			continue
+		}
+		if first, last := periodDays(b.Period); last < from || first > to {
+			continue
+		}
+		stats = append(stats, PunchStat{Period: b.Period, Device: b.Device, EmployeeID: b.EmployeeID, Punches: b.Punches,
+			DistinctUsers: len(b.Users), FirstPunch: b.FirstPunch, LastPunch: b.LastPunch})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Period != stats[j].Period {
+			return stats[i].Period < stats[j].Period
+		}
+		if stats[i].Device != stats[j].Device {
+			return stats[i].Device < stats[j].Device
+		}
+		return stats[i].EmployeeID < stats[j].EmployeeID
+	})
+	return stats
+}
+
+// statsRange resolves a report's period, grouping and days, YYYY-MM-DD. Without days it
+// covers the last 7 days, or the last 4 weeks.
+func statsRange(period, by, from, to string) (string, string, error) {
+	if period != statsPeriodDay && period != statsPeriodWeek {
+		return "", "", fmt.Errorf("unknown period %q, use day or week", period)
+	}
+	if by != statsByDevice && by != statsByUser {
+		return "", "", fmt.Errorf("unknown grouping %q, use device or user", by)
+	}
+	if from == "" {
+		start := time.Now().AddDate(0, 0, -6)
+		if period == statsPeriodWeek {
+			start = time.Now().AddDate(0, 0, -27)
+		}
+		from = start.Format("2006-01-02")
+		if to == "" {
+			to = time.Now().Format("2006-01-02")
+		}
+	}
+	return parseDayRange(from, to)
+}
+
+// writePunchStats writes a statistics report as an aligned table, JSON or CSV
+func writePunchStats(w io.Writer, stats []PunchStat, by, format string) error {
+	who := func(s PunchStat) string {
+		if by == statsByUser {
+			return strconv.Itoa(s.EmployeeID)
+		}
+		return dashIfEmpty(s.Device)
+	}
+	switch format {
+	case queryFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	case queryFormatCSV:
+		cw := csv.NewWriter(w)
+		if by == statsByUser {
+			cw.Write([]string{"period", "employee_id", "punches", "first_punch", "last_punch"})
+		} else {
+			cw.Write([]string{"period", "device_id", "punches", "distinct_users", "first_punch", "last_punch"})
+		}
+		for _, s := range stats {
+			if by == statsByUser {
+				cw.Write([]string{s.Period, who(s), strconv.Itoa(s.Punches), s.FirstPunch, s.LastPunch})
+			} else {
+				cw.Write([]string{s.Period, who(s), strconv.Itoa(s.Punches), strconv.Itoa(s.DistinctUsers), s.FirstPunch, s.LastPunch})
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case queryFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		if by == statsByUser {
+			fmt.Fprintln(tw, tr("PERIOD\tUSER\tPUNCHES\tFIRST\tLAST"))
+		} else {
+			fmt.Fprintln(tw, tr("PERIOD\tDEVICE\tPUNCHES\tUSERS\tFIRST\tLAST"))
+		}
+		for _, s := range stats {
+			if by == statsByUser {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", s.Period, who(s), s.Punches, s.FirstPunch, s.LastPunch)
+			} else {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", s.Period, who(s), s.Punches, s.DistinctUsers, s.FirstPunch, s.LastPunch)
+			}
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown format %q, use table, json or csv", format)
+	}
+}
+
+// writeStatsMetrics writes today's and this week's punches and distinct employees per device
+func writeStatsMetrics(w io.Writer) {
+	statsMu.Lock()
+	s := loadPunchStats()
+	statsMu.Unlock()
+	today := time.Now().Format("2006-01-02")
+	periods := []struct{ name, period string }{{statsPeriodDay, today}, {statsPeriodWeek, isoWeek(today)}}
+	var buckets []*statsBucket
+	for _, p := range periods {
+		for _, b := range s.Buckets {
+			if b.By == statsByDevice && b.Period == p.period {
+				buckets = append(buckets, b)
+			}
+		}
+	}
+	if len(buckets) == 0 {
+		return
+	}
+	label := func(b *statsBucket) string {
+		name := statsPeriodDay
+		if strings.Contains(b.Period, "-W") {
+			name = statsPeriodWeek
+		}
+		return tenantLabel(fmt.Sprintf("device=%q,period=%q", b.Device, name))
+	}
+	fmt.Fprintln(w, "# HELP attendance_stats_punches Punches stored today and this week, per device.")
+	fmt.Fprintln(w, "# TYPE attendance_stats_punches gauge")
+	for _, b := range buckets {
+		fmt.Fprintf(w, "attendance_stats_punches{%s} %d\n", label(b), b.Punches)
+	}
+	fmt.Fprintln(w, "# HELP attendance_stats_distinct_users Employees who punched today and this week, per device.")
+	fmt.Fprintln(w, "# TYPE attendance_stats_distinct_users gauge")
+	for _, b := range buckets {
+		fmt.Fprintf(w, "attendance_stats_distinct_users{%s} %d\n", label(b), len(b.Users))
+	}
+}
+
+// runStatsCommand prints daily or weekly statistics per device or per employee
+func runStatsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	period := fs.String("period", statsPeriodDay, "day or week")
+	by := fs.String("by", statsByDevice, "device or user")
+	fromStr := fs.String("from", "", "first day as YYYY-MM-DD (default 7 days, or 4 weeks, ago)")
+	toStr := fs.String("to", "", "last day as YYYY-MM-DD (default today, or --from)")
+	format := fs.String("format", queryFormatTable, "table, json or csv")
+	fs.Parse(args)
+
+	from, to, err := statsRange(*period, *by, *fromStr, *toStr)
+	if err != nil {
+		return err
+	}
+	s, err := refreshPunchStats(false)
+	if err != nil {
+		return err
+	}
+	return writePunchStats(os.Stdout, s.report(*period, *by, from, to), *by, *format)
+}
+
+// handleStats serves statistics as JSON for dashboards: GET /api/stats.json?period=day|week
+// &by=device|user&from=&to=. Per-employee statistics need the ADMIN_TOKEN bearer token.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	period, by := params.Get("period"), params.Get("by")
+	if period == "" {
+		period = statsPeriodDay
+	}
+	if by == "" {
+		by = statsByDevice
+	}
+	if by == statsByUser && !adminAuthorized(w, r) {
+		return
+	}
+	from, to, err := statsRange(period, by, params.Get("from"), params.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	statsMu.Lock()
+	s := loadPunchStats()
+	statsMu.Unlock()
+	w.Header().Set(contentTypeHeader, jsonContentType)
+	json.NewEncoder(w).Encode(s.report(period, by, from, to))
+}
@@ -0,0 +1,46 @@
+package collector
+
+import "testing"
+
+func TestIsoWeek(t *testing.T) {
+	tests := []struct {
+		day, want string
+	}{
+		{"2024-03-01", "2024-W09"},
+		{"2024-01-01", "2024-W01"},
+		// Days early in January can fall in the last week of the year before, and late in
+		// December in the first week of the next
+		{"2021-01-03", "2020-W53"},
+		{"2024-12-30", "2025-W01"},
+		{"2024-02-30", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := isoWeek(tt.day); got != tt.want {
+			t.Errorf("isoWeek(%q) = %q, want %q", tt.day, got, tt.want)
+		}
+	}
+}
+
+func TestPeriodDays(t *testing.T) {
+	tests := []struct {
+		period      string
+		first, last string
+	}{
+		{"2024-03-01", "2024-03-01", "2024-03-01"},
+		{"2024-W09", "2024-02-26", "2024-03-03"},
+		{"2024-W01", "2024-01-01", "2024-01-07"},
+		{"2020-W53", "2020-12-28", "2021-01-03"},
+		{"2025-W01", "2024-12-30", "2025-01-05"},
+		{"2024-Wxx", "2024-Wxx", "2024-Wxx"},
+	}
+	for _, tt := range tests {
+		first, last := periodDays(tt.period)
+		if first != tt.first || last != tt.last {
+			t.Errorf("periodDays(%q) = %q, %q, want %q, %q", tt.period, first, last, tt.first, tt.last)
+		}
+		if tt.period != tt.first && isoWeek(first) != tt.period {
+			t.Errorf("periodDays(%q) starts in week %q", tt.period, isoWeek(first))
+		}
+	}
+}
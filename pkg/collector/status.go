@@ -0,0 +1,215 @@
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DeviceStatus is the state of one device in /api/status.json
+type DeviceStatus struct {
+	ID           string `json:"id"`
+	LastSuccess  string `json:"last_success,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+	LastErrorAt  string `json:"last_error_at,omitempty"`
+	ErrorStreak  int    `json:"error_streak"`
+	RecordsToday int    `json:"records_today"`
+	ClockDrift   string `json:"clock_drift,omitempty"` // Device clock minus true time, see CLOCK_DRIFT_CORRECTION
+	// Read with API_DEVICE_STATUS
+	Serial         string `json:"serial,omitempty"`
+	Records        *int   `json:"records,omitempty"`
+	RecordCapacity *int   `json:"record_capacity,omitempty"`
+
+	drift *time.Duration // ClockDrift as measured
+}
+
+// SinkStatus is the state of one sink in /api/status.json
+type SinkStatus struct {
+	Name         string `json:"name"`
+	LastSuccess  string `json:"last_success,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+	LastErrorAt  string `json:"last_error_at,omitempty"`
+	ErrorStreak  int    `json:"error_streak"`
+	Backlog      int    `json:"backlog"`
+	RecordsToday int    `json:"records_today"`
+	OfflineSince string `json:"offline_since,omitempty"` // Set while deliveries can't reach the sink
+}
+
+// StatusReport is the body of /api/status.json. Fields are only ever added, never renamed,
+// so dashboards built on it keep working.
+type StatusReport struct {
+	GeneratedAt string         `json:"generated_at"`
+	Tenant      string         `json:"tenant,omitempty"`
+	DayOff      string         `json:"day_off,omitempty"`  // Today's holiday, or "weekend"
+	Features    []string       `json:"features,omitempty"` // Feature flags on for this collector
+	Chaos       string         `json:"chaos,omitempty"`    // Faults injected on purpose, see CHAOS
+	Devices     []DeviceStatus `json:"devices"`
+	Sinks       []SinkStatus   `json:"sinks"`
+	Canaries    []CanaryStatus `json:"canaries,omitempty"`
+}
+
+// collectorStatus holds the live state behind the status report
+var collectorStatus = struct {
+	sync.Mutex
+	day     string // Local date the *Today counters belong to
+	devices map[string]*DeviceStatus
+	sinks   map[string]*SinkStatus
+}{devices: map[string]*DeviceStatus{}, sinks: map[string]*SinkStatus{}}
+
+// resetDailyCountsLocked zeroes the *Today counters when the date changes; the caller holds the lock
+func resetDailyCountsLocked(now time.Time) {
+	today := now.Format("2006-01-02")
+	if collectorStatus.day == today {
+		return
+	}
+	collectorStatus.day = today
+	for _, d := range collectorStatus.devices {
+		d.RecordsToday = 0
+	}
+	for _, s := range collectorStatus.sinks {
+		s.RecordsToday = 0
+	}
+}
+
+// deviceStatusLocked returns the status entry of a device; the caller holds the lock
+func deviceStatusLocked(id string) *DeviceStatus {
+	d, ok := collectorStatus.devices[id]
+	if !ok {
+		d = &DeviceStatus{ID: id}
+		collectorStatus.devices[id] = d
+	}
+	return d
+}
+
+// sinkStatusLocked returns the status entry of a sink; the caller holds the lock
+func sinkStatusLocked(name string) *SinkStatus {
+	s, ok := collectorStatus.sinks[name]
+	if !ok {
+		s = &SinkStatus{Name: name}
+		collectorStatus.sinks[name] = s
+	}
+	return s
+}
+
+// recordDeviceSuccess notes a successful read of n records from a device
+func recordDeviceSuccess(id string, n int) {
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	now := time.Now()
+	resetDailyCountsLocked(now)
+	d := deviceStatusLocked(id)
+	if d.LastSuccess == "" || d.ErrorStreak > 0 {
+		publishEvent(eventDeviceUp, map[string]interface{}{"device": id})
+	}
+	d.LastSuccess = now.Format(time.RFC3339)
+	d.ErrorStreak = 0
+	d.RecordsToday += n
+}
+
+// recordDeviceDrift notes how far a device's clock was off when last measured
+func recordDeviceDrift(id string, offset time.Duration) {
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	d := deviceStatusLocked(id)
+	d.ClockDrift, d.drift = offset.String(), &offset
+}
+
+// deviceReadSince reports whether the device was last read successfully at or after t
+func deviceReadSince(id string, t time.Time) bool {
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	d, ok := collectorStatus.devices[id]
+	if !ok || d.LastSuccess == "" {
+		return false
+	}
+	last, err := time.Parse(time.RFC3339, d.LastSuccess)
+	return err == nil && !last.Before(t.Truncate(time.Second))
+}
+
+// recordDeviceError notes a failed read from a device
+func recordDeviceError(id string, err error) {
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	now := time.Now()
+	resetDailyCountsLocked(now)
+	d := deviceStatusLocked(id)
+	d.LastError = err.Error()
+	d.LastErrorAt = now.Format(time.RFC3339)
+	d.ErrorStreak++
+	if d.ErrorStreak == 1 {
+		publishEvent(eventDeviceDown, map[string]interface{}{"device": id, "error": err.Error()})
+	}
+}
+
+// recordSinkSuccess notes a delivery of n records to a sink
+func recordSinkSuccess(name string, n int) {
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	now := time.Now()
+	resetDailyCountsLocked(now)
+	s := sinkStatusLocked(name)
+	s.LastSuccess = now.Format(time.RFC3339)
+	s.ErrorStreak = 0
+	s.RecordsToday += n
+	publishEvent(eventDelivered, map[string]interface{}{"sink": name, "count": n})
+}
+
+// recordSinkError notes a failed delivery to a sink
+func recordSinkError(name string, err error) {
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	now := time.Now()
+	resetDailyCountsLocked(now)
+	s := sinkStatusLocked(name)
+	s.LastError = err.Error()
+	s.LastErrorAt = now.Format(time.RFC3339)
+	s.ErrorStreak++
+	publishEvent(eventDeliveryFailed, map[string]interface{}{"sink": name, "error": err.Error()})
+}
+
+// setSinkBacklog records how many stored records a sink has yet to deliver
+func setSinkBacklog(name string, backlog int) {
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	sinkStatusLocked(name).Backlog = backlog
+}
+
+// buildStatusReport snapshots the current status, sorted for stable output
+func buildStatusReport() StatusReport {
+	off, _ := dayOff(time.Now())
+	on := enabledFeatures()
+	canaryReport := canaryStatuses()
+	collectorStatus.Lock()
+	defer collectorStatus.Unlock()
+	now := time.Now()
+	resetDailyCountsLocked(now)
+
+	report := StatusReport{
+		GeneratedAt: now.Format(time.RFC3339),
+		Tenant:      tenantName(),
+		DayOff:      off,
+		Features:    on,
+		Chaos:       os.Getenv("CHAOS"),
+		Devices:     []DeviceStatus{},
+		Sinks:       []SinkStatus{},
+		Canaries:    canaryReport,
+	}
+	for _, d := range collectorStatus.devices {
+		report.Devices = append(report.Devices, *d)
+	}
+	for _, s := range collectorStatus.sinks {
+		report.Sinks = append(report.Sinks, *s)
+	}
+	sort.Slice(report.Devices, func(i, j int) bool { return report.Devices[i].ID < report.Devices[j].ID })
+	sort.Slice(report.Sinks, func(i, j int) bool { return report.Sinks[i].Name < report.Sinks[j].Name })
+	return report
+}
+
+// handleStatus serves the status report as JSON
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(contentTypeHeader, jsonContentType)
+	json.NewEncoder(w).Encode(buildStatusReport())
+}
@@ -0,0 +1,258 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Append-only local store of every record accepted for delivery, one JSON line per record
+	recordStoreFile = "records.jsonl"
+	// File tracking how far each sink has delivered through the record store
+	sinkOffsetsFile = "sink_offsets.json"
+	// Next seq of the record store, saved when records are removed from it so seqs are never reused
+	storeSeqFile = "record_store_seq.txt"
+)
+
+// storeMu serializes this process's access to the record store and sink offsets
+var storeMu sync.Mutex
+
+// storedRecord is one line of the record store
+type storedRecord struct {
+	Seq      int64               `json:"seq"`
+	StoredAt string              `json:"stored_at"`
+	SyncID   string              `json:"sync_id,omitempty"` // Cycle that read the record
+	Record   zk.AttendanceRecord `json:"record"`
+}
+
+// seqRange is a half-open range [From, To) of store sequence numbers
+type seqRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// sinkProgress tracks which stored records a sink has delivered
+type sinkProgress struct {
+	Offset    int64      `json:"offset"`              // Every record with a lower seq is delivered
+	Delivered []seqRange `json:"delivered,omitempty"` // Ranges above Offset delivered out of order
+}
+
+// isDelivered reports whether the record with the given seq has been delivered
+func (p *sinkProgress) isDelivered(seq int64) bool {
+	if seq < p.Offset {
+		return true
+	}
+	for _, r := range p.Delivered {
+		if seq >= r.From && seq < r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// markDelivered records seqs as delivered, merging ranges and advancing the offset
+func (p *sinkProgress) markDelivered(seqs []int64) {
+	for _, seq := range seqs {
+		p.Delivered = append(p.Delivered, seqRange{From: seq, To: seq + 1})
+	}
+	sort.Slice(p.Delivered, func(i, j int) bool { return p.Delivered[i].From < p.Delivered[j].From })
+
+	var merged []seqRange
+	for _, r := range p.Delivered {
+		if n := len(merged); n > 0 && r.From <= merged[n-1].To {
+			if r.To > merged[n-1].To {
+				merged[n-1].To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	for len(merged) > 0 && merged[0].From <= p.Offset {
+		if merged[0].To > p.Offset {
+			p.Offset = merged[0].To
+		}
+		merged = merged[1:]
+	}
+	p.Delivered = merged
+}
+
+// appendToStore adds records read by sync cycle syncID to the record store and returns the
+// seq of the first one
+func appendToStore(logs []zk.AttendanceRecord, syncID string) (int64, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	data, err := state().Get(recordStoreFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read record store: %w", err)
+	}
+	// The batch goes after the last whole record, not onto the end of a torn one
+	if data, err = cutTornLine(recordStoreFile, data); err != nil {
+		return 0, err
+	}
+	existing, err := parseStore(data)
+	if err != nil {
+		return 0, err
+	}
+	next, err := storeNextSeqLocked(existing)
+	if err != nil {
+		return 0, err
+	}
+
+	first := next
+	storedAt := time.Now().Format(time.RFC3339)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range logs {
+		if err := enc.Encode(storedRecord{Seq: next, StoredAt: storedAt, SyncID: syncID, Record: record}); err != nil {
+			return 0, fmt.Errorf("failed to encode record: %w", err)
+		}
+		next++
+	}
+	if err := state().Append(recordStoreFile, buf.Bytes()); err != nil {
+		return 0, fmt.Errorf("failed to write record store: %w", err)
+	}
+	return first, nil
+}
+
+// storeNextSeqLocked returns the seq the next stored record gets; the caller holds storeMu
+func storeNextSeqLocked(records []storedRecord) (int64, error) {
+	next := int64(0)
+	if n := len(records); n > 0 {
+		next = records[n-1].Seq + 1
+	}
+	data, err := state().Get(storeSeqFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", storeSeqFile, err)
+	}
+	if saved, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && saved > next {
+		next = saved
+	}
+	return next, nil
+}
+
+// rewriteStoreLocked replaces the store of records with data, the encoded records to keep.
+// The next seq is saved first, so removing the newest records never lets their seqs be reused.
+// The caller holds storeMu.
+func rewriteStoreLocked(records []storedRecord, data []byte) error {
+	next, err := storeNextSeqLocked(records)
+	if err != nil {
+		return err
+	}
+	if err := state().Put(storeSeqFile, []byte(strconv.FormatInt(next, 10))); err != nil {
+		return fmt.Errorf("failed to write %s: %w", storeSeqFile, err)
+	}
+	if err := state().Put(recordStoreFile, data); err != nil {
+		return fmt.Errorf("failed to write record store: %w", err)
+	}
+	return nil
+}
+
+// readStore returns every record in the store in seq order
+func readStore() ([]storedRecord, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	return readStoreLocked()
+}
+
+// readStoreLocked reads the store; the caller holds storeMu
+func readStoreLocked() ([]storedRecord, error) {
+	data, err := state().Get(recordStoreFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record store: %w", err)
+	}
+	return parseStore(data)
+}
+
+// parseStore decodes the lines of the record store
+func parseStore(data []byte) ([]storedRecord, error) {
+	var records []storedRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record storedRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A torn final line from a crash mid-write; everything before it is intact
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// cutTornLine cuts a value of JSON lines back to its last newline before something is
+// appended to it. A crash or failed write in the middle of an append leaves part of a line,
+// and the next append would otherwise run its first line into it, to be skipped on every read.
+func cutTornLine(key string, data []byte) ([]byte, error) {
+	n := len(data)
+	if n == 0 || data[n-1] == '\n' {
+		return data, nil
+	}
+	kept := data[:bytes.LastIndexByte(data, '\n')+1]
+	log.Printf("Dropping a torn last line of %d bytes from %s", n-len(kept), key)
+	if err := state().Put(key, kept); err != nil {
+		return nil, fmt.Errorf("failed to drop torn line of %s: %w", key, err)
+	}
+	return kept, nil
+}
+
+// loadSinkProgress returns the delivery progress of a sink
+func loadSinkProgress(sink string) (*sinkProgress, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	all, err := readSinkOffsetsLocked()
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := all[sink]; ok {
+		return p, nil
+	}
+	return &sinkProgress{}, nil
+}
+
+// markSinkDelivered records seqs as delivered by a sink
+func markSinkDelivered(sink string, seqs []int64) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	all, err := readSinkOffsetsLocked()
+	if err != nil {
+		return err
+	}
+	p, ok := all[sink]
+	if !ok {
+		p = &sinkProgress{}
+		all[sink] = p
+	}
+	p.markDelivered(seqs)
+
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return state().Put(sinkOffsetsFile, data)
+}
+
+// readSinkOffsetsLocked reads all sink offsets; the caller holds storeMu
+func readSinkOffsetsLocked() (map[string]*sinkProgress, error) {
+	all := map[string]*sinkProgress{}
+	data, err := state().Get(sinkOffsetsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", sinkOffsetsFile, err)
+	}
+	if data == nil {
+		return all, nil
+	}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", sinkOffsetsFile, err)
+	}
+	return all, nil
+}
@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"os"
+	"testing"
+
+	"old-attendance/pkg/zk"
+)
+
+func TestSinkProgressMarkDelivered(t *testing.T) {
+	tests := []struct {
+		name      string
+		start     sinkProgress
+		seqs      []int64
+		offset    int64
+		delivered []seqRange
+	}{
+		{"in order", sinkProgress{}, []int64{0, 1, 2}, 3, nil},
+		{"out of order", sinkProgress{}, []int64{2, 0, 1}, 3, nil},
+		{"gap", sinkProgress{}, []int64{0, 1, 4, 5}, 2, []seqRange{{4, 6}}},
+		{"no gap filled", sinkProgress{Offset: 3}, []int64{7, 5}, 3, []seqRange{{5, 6}, {7, 8}}},
+		{"gap filled", sinkProgress{Offset: 3, Delivered: []seqRange{{5, 6}, {7, 8}}}, []int64{3, 4, 6}, 8, nil},
+		{"adjacent ranges merged", sinkProgress{Offset: 1, Delivered: []seqRange{{3, 5}}}, []int64{5, 2}, 1, []seqRange{{2, 6}}},
+		{"overlapping ranges merged", sinkProgress{Delivered: []seqRange{{3, 6}, {4, 9}}}, []int64{10}, 0, []seqRange{{3, 9}, {10, 11}}},
+		{"already delivered", sinkProgress{Offset: 5, Delivered: []seqRange{{7, 9}}}, []int64{2, 8}, 5, []seqRange{{7, 9}}},
+		{"range below the offset dropped", sinkProgress{Offset: 5, Delivered: []seqRange{{1, 3}}}, nil, 5, nil},
+		{"range across the offset", sinkProgress{Offset: 5, Delivered: []seqRange{{3, 8}}}, nil, 8, nil},
+	}
+	for _, tt := range tests {
+		p := tt.start
+		p.Delivered = append([]seqRange{}, tt.start.Delivered...)
+		p.markDelivered(tt.seqs)
+		if p.Offset != tt.offset {
+			t.Errorf("%s: offset = %d, want %d", tt.name, p.Offset, tt.offset)
+		}
+		if len(p.Delivered) != len(tt.delivered) {
+			t.Errorf("%s: delivered = %v, want %v", tt.name, p.Delivered, tt.delivered)
+			continue
+		}
+		for i := range p.Delivered {
+			if p.Delivered[i] != tt.delivered[i] {
+				t.Errorf("%s: delivered = %v, want %v", tt.name, p.Delivered, tt.delivered)
+				break
+			}
+		}
+	}
+}
+
+func TestSinkProgressIsDelivered(t *testing.T) {
+	p := &sinkProgress{Offset: 3, Delivered: []seqRange{{5, 7}, {9, 10}}}
+	for seq, want := range map[int64]bool{0: true, 2: true, 3: false, 4: false, 5: true, 6: true, 7: false, 8: false, 9: true, 10: false} {
+		if got := p.isDelivered(seq); got != want {
+			t.Errorf("isDelivered(%d) = %v, want %v", seq, got, want)
+		}
+	}
+	p.markDelivered([]int64{3, 4, 7, 8})
+	for seq := int64(0); seq < 10; seq++ {
+		if !p.isDelivered(seq) {
+			t.Errorf("isDelivered(%d) = false after the gaps were delivered", seq)
+		}
+	}
+	if p.Offset != 10 || len(p.Delivered) != 0 {
+		t.Errorf("progress = %+v, want offset 10 and no ranges", p)
+	}
+}
+
+func TestAppendToStoreAfterTornLine(t *testing.T) {
+	inStateDir(t)
+	whole := `{"seq":0,"stored_at":"2024-03-01T09:00:00Z","record":{"employee_id":1,"timestamp":"2024-03-01T08:59:00"}}` + "\n"
+	torn := `{"seq":1,"stored_at":"2024-03-01T09:00:00Z","rec`
+	if err := os.WriteFile(recordStoreFile, []byte(whole+torn), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logs := []zk.AttendanceRecord{
+		{UserID: 2, Timestamp: "2024-03-01T09:05:00"},
+		{UserID: 3, Timestamp: "2024-03-01T09:06:00"},
+	}
+	if _, err := appendToStore(logs, "sync-1"); err != nil {
+		t.Fatal(err)
+	}
+	records, err := readStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []int
+	for _, r := range records {
+		users = append(users, r.Record.UserID)
+	}
+	if !equalInts(users, []int{1, 2, 3}) {
+		t.Errorf("stored users %v, want 1 and both appended", users)
+	}
+	if records[len(records)-1].Seq != 2 {
+		t.Errorf("last seq = %d, want 2", records[len(records)-1].Seq)
+	}
+}
@@ -0,0 +1,27 @@
+package collector
+
+import (
+	"errors"
+	"flag"
+)
+
+// runSyncCommand runs one sync cycle and waits for delivery, for running the collector from
+// cron instead of as a daemon. The process exit code tells a wrapper what went wrong.
+func runSyncCommand(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: sync")
+	}
+	// Never poll alongside a running daemon
+	lock, err := acquireInstanceLock()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	err = SyncOnce()
+	// Collectors run from cron show in the fleet view too, with a heartbeat per run
+	registerCollector()
+	sendHeartbeat()
+	return err
+}
@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment variable naming the tenant a collector runs for, set by the supervisor
+const tenantEnv = "COLLECTOR_TENANT"
+
+// Delay before a tenant collector that exited is started again
+const tenantRestartDelay = 30 * time.Second
+
+// tenantName returns the tenant this collector serves, or "" in single-tenant mode
+func tenantName() string {
+	return os.Getenv(tenantEnv)
+}
+
+// tenantLabel prefixes Prometheus labels with the tenant, when there is one
+func tenantLabel(labels string) string {
+	if tenant := tenantName(); tenant != "" {
+		return fmt.Sprintf("tenant=%q,", tenant) + labels
+	}
+	return labels
+}
+
+// listTenants returns the tenant subdirectories of dir. Each holds that tenant's .env
+// (devices, API endpoint, credentials, SYNC_INTERVAL) and all of its state files.
+func listTenants(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TENANTS_DIR: %w", err)
+	}
+	var tenants []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), ".env")); err != nil {
+			log.Printf("Skipping tenant directory %s: no .env file", entry.Name())
+			continue
+		}
+		tenants = append(tenants, entry.Name())
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("no tenants found in %s", dir)
+	}
+	return tenants, nil
+}
+
+// superviseTenants runs one collector per tenant under dir and restarts any that exit.
+// Each collector runs in its tenant's directory with only baseEnv, the process environment
+// from before .env was loaded, so no tenant inherits another's devices or credentials.
+func superviseTenants(dir string, baseEnv []string) error {
+	tenants, err := listTenants(dir)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate collector executable: %w", err)
+	}
+
+	var mu sync.Mutex
+	stopping := false
+	running := map[string]*exec.Cmd{}
+
+	// Take the tenant collectors down with the supervisor, when it is stopped or restarts
+	// into a new release
+	stopTenants := func() {
+		mu.Lock()
+		stopping = true
+		for tenant, cmd := range running {
+			log.Printf("Stopping collector for tenant %s", tenant)
+			cmd.Process.Kill()
+		}
+		mu.Unlock()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		stopTenants()
+		os.Exit(0)
+	}()
+	// The tenant collectors share the executable, so the supervisor updates it for them
+	onRestart(stopTenants)
+	startSelfUpdate()
+
+	var wg sync.WaitGroup
+	for _, tenant := range tenants {
+		wg.Add(1)
+		go func(tenant string) {
+			defer wg.Done()
+			for {
+				cmd := exec.Command(exe)
+				cmd.Dir = filepath.Join(dir, tenant)
+				cmd.Env = append(append([]string(nil), baseEnv...), tenantEnv+"="+tenant)
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+
+				mu.Lock()
+				if stopping {
+					mu.Unlock()
+					return
+				}
+				err := cmd.Start()
+				if err == nil {
+					running[tenant] = cmd
+				}
+				mu.Unlock()
+
+				if err == nil {
+					log.Printf("Started collector for tenant %s (pid %d)", tenant, cmd.Process.Pid)
+					err = cmd.Wait()
+					mu.Lock()
+					delete(running, tenant)
+					mu.Unlock()
+				}
+				log.Printf("Collector for tenant %s exited: %v; restarting in %v", tenant, err, tenantRestartDelay)
+				time.Sleep(tenantRestartDelay)
+			}
+		}(tenant)
+	}
+	wg.Wait()
+	return nil
+}
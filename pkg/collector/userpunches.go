@@ -0,0 +1,99 @@
+package collector
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runUserPunchesCommand reads one employee's punches straight from the devices, for settling
+// attendance disputes. Each punch is marked with whether the collector has stored it, which
+// tells a punch the device never recorded apart from one lost on the way to the backend.
+func runUserPunchesCommand(args []string) error {
+	fs := flag.NewFlagSet("user-punches", flag.ExitOnError)
+	userID := fs.Int("user", 0, "employee ID as enrolled on the devices")
+	sinceStr := fs.String("since", "", "only punches after this time, e.g. \"2024-05-01 00:00\"")
+	deviceName := fs.String("device", "", "read only this device instead of all of DEVICE_IPS")
+	fs.Parse(args)
+
+	if *userID <= 0 {
+		return errors.New("--user is required")
+	}
+	var since time.Time
+	if *sinceStr != "" {
+		t, err := parsePunchTime(*sinceStr)
+		if err != nil {
+			return err
+		}
+		since = t
+	}
+
+	var devices []deviceConfig
+	for _, entry := range strings.Split(os.Getenv("DEVICE_IPS"), ",") {
+		device, err := parseDevice(strings.TrimSpace(entry))
+		if err != nil || (*deviceName != "" && device.ID != *deviceName) {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	if len(devices) == 0 {
+		return configError("no matching devices in DEVICE_IPS")
+	}
+
+	var records []zk.AttendanceRecord
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(device deviceConfig) {
+			defer wg.Done()
+			zkManager, err := newDeviceManager(device)
+			if err == nil {
+				var found []zk.AttendanceRecord
+				found, err = zkManager.GetAttendanceForUser(*userID, since)
+				mu.Lock()
+				records = append(records, found...)
+				mu.Unlock()
+			}
+			if err != nil {
+				log.Printf("Error reading %s: %v", device.ID, err)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(device)
+	}
+	wg.Wait()
+
+	stored := map[string]bool{}
+	if storedRecords, err := readStore(); err != nil {
+		log.Printf("Error reading record store: %v", err)
+	} else {
+		for _, record := range storedRecords {
+			if record.Record.UserID == *userID {
+				stored[record.Record.DeviceID+"|"+record.Record.Timestamp] = true
+			}
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Timestamp < records[j].Timestamp })
+	for _, record := range records {
+		status := tr("not stored")
+		if stored[record.DeviceID+"|"+record.Timestamp] {
+			status = tr("stored")
+		}
+		fmt.Printf("%s  %-20s %s\n", record.Timestamp, record.DeviceID, status)
+	}
+	log.Printf("%d punch(es) for user %d on %d device(s)", len(records), *userID, len(devices))
+	return firstErr
+}
@@ -0,0 +1,269 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// State key of the last snapshot of each device's enrolled users
+	userSnapshotsFile = "user_snapshots.json"
+	// How often enrolled users are compared, unless USER_SNAPSHOT_INTERVAL (minutes) overrides it
+	defaultUserSnapshotInterval = 60 * time.Minute
+	// Users listed per section of an alert log line; the audit entry has them all
+	maxLoggedUserChanges = 10
+)
+
+// Event type streamed on /api/events when users changed on a terminal
+const eventUsersChanged = "users_changed"
+
+// userSnapshot is the enrolled users of a device at one point in time
+type userSnapshot struct {
+	TakenAt time.Time    `json:"taken_at"`
+	Users   []deviceUser `json:"users"`
+}
+
+// userChange is a user whose name, card or admin right changed between snapshots
+type userChange struct {
+	Before deviceUser `json:"before"`
+	After  deviceUser `json:"after"`
+}
+
+// userListDiff is what changed on a device between two snapshots
+type userListDiff struct {
+	Added   []deviceUser `json:"added,omitempty"`
+	Removed []deviceUser `json:"removed,omitempty"`
+	Changed []userChange `json:"changed,omitempty"`
+}
+
+// empty reports whether the snapshots were the same
+func (d userListDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// userSnapshots serializes snapshot updates from the sync cycle and device commands
+var userSnapshots = struct {
+	sync.Mutex
+	taken map[string]time.Time // When each device was last compared, for USER_SNAPSHOT_INTERVAL
+}{taken: map[string]time.Time{}}
+
+// diffUserLists compares two user lists by user ID
+func diffUserLists(before, after []deviceUser) userListDiff {
+	var diff userListDiff
+	old := make(map[int]deviceUser, len(before))
+	for _, user := range before {
+		old[user.UserID] = user
+	}
+	for _, user := range after {
+		previous, ok := old[user.UserID]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, user)
+		case previous != user:
+			diff.Changed = append(diff.Changed, userChange{Before: previous, After: user})
+		}
+		delete(old, user.UserID)
+	}
+	for _, user := range old {
+		diff.Removed = append(diff.Removed, user)
+	}
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].UserID < diff.Removed[j].UserID })
+	return diff
+}
+
+// loadUserSnapshots returns the last snapshot per device
+func loadUserSnapshots() map[string]userSnapshot {
+	snapshots := map[string]userSnapshot{}
+	data, err := state().Get(userSnapshotsFile)
+	if err != nil || data == nil {
+		return snapshots
+	}
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", userSnapshotsFile, err)
+		return map[string]userSnapshot{}
+	}
+	return snapshots
+}
+
+// saveUserSnapshots stores the snapshots
+func saveUserSnapshots(snapshots map[string]userSnapshot) error {
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+	return state().Put(userSnapshotsFile, data)
+}
+
+// describeUsers lists users for an alert log line, e.g. "1042 (Rahim), 1043 (card 5566)"
+func describeUsers(users []deviceUser) string {
+	var parts []string
+	for i, user := range users {
+		if i == maxLoggedUserChanges {
+			parts = append(parts, fmt.Sprintf("and %d more", len(users)-i))
+			break
+		}
+		var labels []string
+		if user.Name != "" {
+			labels = append(labels, user.Name)
+		}
+		if user.CardNumber != "" {
+			labels = append(labels, "card "+user.CardNumber)
+		}
+		if user.Admin {
+			labels = append(labels, "admin")
+		}
+		if len(labels) > 0 {
+			parts = append(parts, fmt.Sprintf("%d (%s)", user.UserID, strings.Join(labels, ", ")))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d", user.UserID))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// alertUserChanges reports users enrolled, removed or changed on the terminal itself, which
+// bypasses HR and is how ghost employees get onto a device. The full diff goes to the audit
+// log, the security sink and the event stream.
+func alertUserChanges(deviceID string, since time.Time, diff userListDiff) {
+	var sections []string
+	if len(diff.Added) > 0 {
+		sections = append(sections, "added "+describeUsers(diff.Added))
+	}
+	if len(diff.Removed) > 0 {
+		sections = append(sections, "removed "+describeUsers(diff.Removed))
+	}
+	if len(diff.Changed) > 0 {
+		after := make([]deviceUser, len(diff.Changed))
+		for i, change := range diff.Changed {
+			after[i] = change.After
+		}
+		sections = append(sections, "changed "+describeUsers(after))
+	}
+	log.Printf("ALERT: users on device %s changed since %s: %s", deviceID, since.Format(time.RFC3339), strings.Join(sections, "; "))
+
+	details := map[string]interface{}{
+		"device":  deviceID,
+		"since":   since.Format(time.RFC3339),
+		"added":   diff.Added,
+		"removed": diff.Removed,
+		"changed": diff.Changed,
+	}
+	if err := appendAudit("device_users_changed", details); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+	event := securityEvent{Device: deviceID, Time: time.Now().Format(time.RFC3339), Event: eventUsersChanged, Details: diff}
+	if err := deliverSecurityEvents([]securityEvent{event}); err != nil {
+		log.Printf("Error delivering security event: %v", err)
+	}
+	publishEvent(eventUsersChanged, details)
+}
+
+// snapshotDeviceUsers reads a device's enrolled users and compares them with its last
+// snapshot. The first snapshot of a device is the baseline and raises no alert.
+func snapshotDeviceUsers(device deviceConfig) error {
+	zkManager, err := newDeviceManager(device)
+	if err != nil {
+		return err
+	}
+	users, err := zkManager.GetUsers()
+	if err != nil {
+		return fmt.Errorf("failed to read users from %s: %w", device.ID, err)
+	}
+	list := make([]deviceUser, len(users))
+	for i, user := range users {
+		list[i] = newDeviceUser(user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UserID < list[j].UserID })
+
+	userSnapshots.Lock()
+	defer userSnapshots.Unlock()
+	snapshots := loadUserSnapshots()
+	previous, ok := snapshots[device.ID]
+	if ok {
+		if diff := diffUserLists(previous.Users, list); !diff.empty() {
+			alertUserChanges(device.ID, previous.TakenAt, diff)
+		}
+	} else {
+		log.Printf("Took the first snapshot of device %s: %d user(s)", device.ID, len(list))
+	}
+	snapshots[device.ID] = userSnapshot{TakenAt: time.Now(), Users: list}
+	return saveUserSnapshots(snapshots)
+}
+
+// noteEnrolledUser updates a device's snapshot with a user the collector enrolled itself,
+// so the next comparison doesn't report it as added on the terminal
+func noteEnrolledUser(deviceID string, user zk.User) {
+	userSnapshots.Lock()
+	defer userSnapshots.Unlock()
+	snapshots := loadUserSnapshots()
+	snapshot, ok := snapshots[deviceID]
+	if !ok {
+		return
+	}
+	enrolled := newDeviceUser(user)
+	replaced := false
+	for i := range snapshot.Users {
+		if snapshot.Users[i].UserID == enrolled.UserID {
+			snapshot.Users[i], replaced = enrolled, true
+		}
+	}
+	if !replaced {
+		snapshot.Users = append(snapshot.Users, enrolled)
+		sort.Slice(snapshot.Users, func(i, j int) bool { return snapshot.Users[i].UserID < snapshot.Users[j].UserID })
+	}
+	snapshots[deviceID] = snapshot
+	if err := saveUserSnapshots(snapshots); err != nil {
+		log.Printf("Error saving user snapshots: %v", err)
+	}
+}
+
+// snapshotUserLists compares the enrolled users of the devices read this cycle that have
+// USER_SNAPSHOTS enabled, every USER_SNAPSHOT_INTERVAL minutes
+func snapshotUserLists(cycle *syncCycle) {
+	if cycle == nil {
+		return
+	}
+	interval := defaultUserSnapshotInterval
+	if value := os.Getenv("USER_SNAPSHOT_INTERVAL"); value != "" {
+		if parsed, ok := parseSyncInterval(value); ok {
+			interval = parsed
+		} else {
+			log.Printf("Invalid USER_SNAPSHOT_INTERVAL=%q, using %v", value, interval)
+		}
+	}
+
+	var due []string
+	cycle.update(func(c *syncCycle) {
+		userSnapshots.Lock()
+		defer userSnapshots.Unlock()
+		for id := range c.devicesRead {
+			if !deviceEnvBool("USER_SNAPSHOTS", id) {
+				continue
+			}
+			if last, ok := userSnapshots.taken[id]; !ok || c.start.Sub(last) >= interval {
+				due = append(due, id)
+			}
+		}
+	})
+	sort.Strings(due)
+	for _, id := range due {
+		device, ok := configuredDevice(id)
+		if !ok {
+			continue
+		}
+		if err := snapshotDeviceUsers(device); err != nil {
+			log.Printf("Error taking user snapshot: %v", err)
+			continue
+		}
+		userSnapshots.Lock()
+		userSnapshots.taken[id] = cycle.start
+		userSnapshots.Unlock()
+	}
+}
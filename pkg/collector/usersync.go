@@ -0,0 +1,225 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// State key of the hash of the user list last uploaded per device
+	userListHashesFile = "user_list_hashes.json"
+	// How often the daemon reads device user lists, unless USER_SYNC_INTERVAL overrides it
+	defaultUserSyncInterval = 60 * time.Minute
+)
+
+// deviceUser is one user of a device user list upload
+type deviceUser struct {
+	UserID     int    `json:"user_id"`
+	Name       string `json:"name"`
+	CardNumber string `json:"card_number,omitempty"`
+	Admin      bool   `json:"admin,omitempty"`
+}
+
+// userListUpload is the body posted to USER_SYNC_URL for one device
+type userListUpload struct {
+	OrgID    string       `json:"org_id"`
+	DeviceID string       `json:"device_id"`
+	Hash     string       `json:"hash"`
+	Users    []deviceUser `json:"users"`
+}
+
+// userListsRead holds when each device's user list was last read, for USER_SYNC_INTERVAL
+var userListsRead = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: map[string]time.Time{}}
+
+// newDeviceUser converts a user read from a device
+func newDeviceUser(user zk.User) deviceUser {
+	converted := deviceUser{UserID: user.UserID, Name: user.Name, Admin: user.Privilege == 14}
+	if user.CardNumber != 0 {
+		converted.CardNumber = strconv.FormatUint(uint64(user.CardNumber), 10)
+	}
+	return converted
+}
+
+// userListHash hashes a user list sorted by user ID, so the device's storage order doesn't matter
+func userListHash(users []deviceUser) string {
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+	data, _ := json.Marshal(users)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadUserListHashes returns the hash of the user list last uploaded per device
+func loadUserListHashes() map[string]string {
+	hashes := map[string]string{}
+	data, err := state().Get(userListHashesFile)
+	if err != nil || data == nil {
+		return hashes
+	}
+	if err := json.Unmarshal(data, &hashes); err != nil {
+		log.Printf("Invalid %s, ignoring: %v", userListHashesFile, err)
+		return map[string]string{}
+	}
+	return hashes
+}
+
+// syncUserList uploads a device's user list to USER_SYNC_URL when it differs from the last
+// upload, or always with full. It reports whether an upload was made.
+func syncUserList(device deviceConfig, full bool) (bool, error) {
+	zkManager, err := newDeviceManager(device)
+	if err != nil {
+		return false, err
+	}
+	users, err := zkManager.GetUsers()
+	if err != nil {
+		return false, fmt.Errorf("failed to read users from %s: %w", device.ID, err)
+	}
+	list := make([]deviceUser, len(users))
+	for i, user := range users {
+		list[i] = newDeviceUser(user)
+	}
+	hash := userListHash(list)
+	hashes := loadUserListHashes()
+	if !full && hashes[device.ID] == hash {
+		return false, nil
+	}
+
+	body, err := json.Marshal(userListUpload{OrgID: os.Getenv("ORG_ID"), DeviceID: device.ID, Hash: hash, Users: list})
+	if err != nil {
+		return false, err
+	}
+	req, err := sink.NewAPIRequest("POST", os.Getenv("USER_SYNC_URL"), body, os.Getenv("API_KEY"))
+	if err != nil {
+		return false, err
+	}
+	client := &http.Client{Timeout: 45 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to execute user list request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("user list upload for %s failed with status %d: %s", device.ID, resp.StatusCode, string(respBody))
+	}
+
+	hashes[device.ID] = hash
+	data, err := json.Marshal(hashes)
+	if err == nil {
+		err = state().Put(userListHashesFile, data)
+	}
+	if err != nil {
+		log.Printf("Error saving user list hashes: %v", err)
+	}
+	log.Printf("Uploaded %d user(s) from device %s", len(list), device.ID)
+	return true, nil
+}
+
+// syncUserLists uploads the user lists of the devices read this cycle that are due for a
+// check, every USER_SYNC_INTERVAL minutes. Only lists that changed since their last upload are sent.
+func syncUserLists(cycle *syncCycle) {
+	if os.Getenv("USER_SYNC_URL") == "" || cycle == nil {
+		return
+	}
+	interval := defaultUserSyncInterval
+	if value := os.Getenv("USER_SYNC_INTERVAL"); value != "" {
+		if parsed, ok := parseSyncInterval(value); ok {
+			interval = parsed
+		} else {
+			log.Printf("Invalid USER_SYNC_INTERVAL=%q, using %v", value, interval)
+		}
+	}
+
+	var due []string
+	cycle.update(func(c *syncCycle) {
+		userListsRead.Lock()
+		defer userListsRead.Unlock()
+		for id := range c.devicesRead {
+			if last, ok := userListsRead.at[id]; !ok || c.start.Sub(last) >= interval {
+				due = append(due, id)
+			}
+		}
+	})
+	sort.Strings(due)
+	done := map[string]<-chan error{}
+	for _, id := range due {
+		if device, ok := configuredDevice(id); ok {
+			done[id] = syncUserListJob(device)
+		}
+	}
+	for id, d := range done {
+		if err := <-d; err != nil {
+			continue
+		}
+		userListsRead.Lock()
+		userListsRead.at[id] = cycle.start
+		userListsRead.Unlock()
+	}
+}
+
+// syncUserListJob uploads a device's user list if it changed, as a job holding the device
+func syncUserListJob(device deviceConfig) <-chan error {
+	return submitJob(&job{group: jobGroupUserSync, name: "user sync " + device.ID, devices: []string{device.ID}, run: func() error {
+		_, err := syncUserList(device, false)
+		if err != nil {
+			log.Printf("Error syncing user list: %v", err)
+		}
+		return err
+	}})
+}
+
+// runSyncUsersCommand uploads device user lists now; --full sends them even when unchanged
+func runSyncUsersCommand(args []string) error {
+	fs := flag.NewFlagSet("sync-users", flag.ExitOnError)
+	full := fs.Bool("full", false, "upload every user list, even when unchanged since the last upload")
+	name := fs.String("device", "", "only this device instead of all of DEVICE_IPS")
+	fs.Parse(args)
+	if os.Getenv("USER_SYNC_URL") == "" {
+		return configError("USER_SYNC_URL is not set")
+	}
+
+	var devices []deviceConfig
+	for _, entry := range strings.Split(os.Getenv("DEVICE_IPS"), ",") {
+		device, err := parseDevice(strings.TrimSpace(entry))
+		if err == nil && (*name == "" || device.ID == *name) {
+			devices = append(devices, device)
+		}
+	}
+	if len(devices) == 0 {
+		return configError("no matching devices in DEVICE_IPS")
+	}
+	var firstErr error
+	for _, device := range devices {
+		uploaded, err := syncUserList(device, *full)
+		switch {
+		case err != nil:
+			log.Printf("Error syncing user list: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		case !uploaded:
+			log.Printf("User list of device %s unchanged, not uploaded", device.ID)
+		}
+	}
+	if firstErr != nil {
+		return errors.New("some user lists could not be synced")
+	}
+	return nil
+}
@@ -0,0 +1,575 @@
+package collector
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configProblem is one finding of config validate
+type configProblem struct {
+	Key     string
+	Message string
+	Warning bool // Works, but probably not as intended
+}
+
+// configCheck collects the problems found while validating
+type configCheck struct {
+	problems []configProblem
+}
+
+func (c *configCheck) errorf(key, format string, args ...interface{}) {
+	c.problems = append(c.problems, configProblem{Key: key, Message: tr(format, args...)})
+}
+
+func (c *configCheck) warnf(key, format string, args ...interface{}) {
+	c.problems = append(c.problems, configProblem{Key: key, Message: tr(format, args...), Warning: true})
+}
+
+// runConfigCommand handles "config <subcommand>"
+func runConfigCommand(args []string) error {
+	if len(args) == 0 {
+		return configError("usage: config validate|encrypt|state-key|read-state")
+	}
+	switch args[0] {
+	case "validate":
+		return runConfigValidateCommand(args[1:])
+	case "encrypt":
+		return runConfigEncryptCommand(args[1:])
+	case "state-key":
+		return runConfigStateKeyCommand(args[1:])
+	case "read-state":
+		return runConfigReadStateCommand(args[1:])
+	default:
+		return configError(fmt.Sprintf("unknown config command %q", args[0]))
+	}
+}
+
+// runConfigValidateCommand checks the configuration and prints every problem found. It
+// fails with ErrConfig when there are errors; warnings alone pass.
+func runConfigValidateCommand(args []string) error {
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	fs.Parse(args)
+
+	problems := validateConfig()
+	errors := 0
+	for _, p := range problems {
+		level := tr("warning")
+		if !p.Warning {
+			level = tr("error")
+			errors++
+		}
+		fmt.Printf("%-7s %s: %s\n", level, p.Key, p.Message)
+	}
+	if errors > 0 {
+		return configError(tr("%d configuration error(s) and %d warning(s)", errors, len(problems)-errors))
+	}
+	fmt.Println(tr("Configuration OK (%d warning(s))", len(problems)))
+	return nil
+}
+
+// validateConfig checks the settings the collector reads, without connecting to anything
+func validateConfig() []configProblem {
+	c := &configCheck{}
+	devices := c.checkDevices()
+	c.checkURLs()
+	c.checkAuth()
+	c.checkSchedules(devices)
+	c.checkValues(devices)
+	c.checkOrgMetadata(devices)
+	for _, entry := range splitList(os.Getenv("FEATURE_FLAGS")) {
+		value := "on"
+		if i := strings.Index(entry, "="); i >= 0 {
+			value = strings.TrimSpace(entry[i+1:])
+		}
+		switch strings.ToLower(value) {
+		case "on", "true", "1", "off", "false", "0":
+		default:
+			c.errorf("FEATURE_FLAGS", "invalid entry %q, expected name=on or name=off", entry)
+		}
+	}
+	return c.problems
+}
+
+// checkOrgMetadata compares the devices with the org metadata cached from ORG_URL at the
+// last start, if any
+func (c *configCheck) checkOrgMetadata(devices []deviceConfig) {
+	if os.Getenv("ORG_URL") == "" {
+		return
+	}
+	cache, ok := cachedOrgMetadata()
+	if !ok {
+		return
+	}
+	for _, problem := range orgMetadataProblems(cache.Metadata, devices) {
+		c.warnf("ORG_URL", "%s (as of %s)", problem, cache.FetchedAt.Format("2006-01-02 15:04"))
+	}
+}
+
+// checkDevices checks the DEVICE_IPS entries and returns the valid ones
+func (c *configCheck) checkDevices() []deviceConfig {
+	value := os.Getenv("DEVICE_IPS")
+	if strings.TrimSpace(value) == "" {
+		if envBool("AUTO_DISCOVER") {
+			if os.Getenv("DISCOVERY_SUBNETS") == "" {
+				c.errorf("DISCOVERY_SUBNETS", "required with AUTO_DISCOVER, e.g. 192.168.1.0/24")
+			}
+		} else {
+			c.errorf("DEVICE_IPS", `not set; list the terminals as "name=ip:port", e.g. gate=192.168.1.201:4370`)
+		}
+	}
+	for _, subnet := range strings.Split(os.Getenv("DISCOVERY_SUBNETS"), ",") {
+		if subnet = strings.TrimSpace(subnet); subnet != "" {
+			if _, err := subnetHosts(subnet); err != nil {
+				c.errorf("DISCOVERY_SUBNETS", "%v", err)
+			}
+		}
+	}
+
+	var devices []deviceConfig
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		device, err := parseDevice(entry)
+		if err != nil {
+			c.errorf("DEVICE_IPS", `%v; expected "ip:port", "name=ip:port" or "name=serial:/dev/ttyUSB0"`, err)
+			continue
+		}
+		if seen[device.ID] {
+			c.errorf("DEVICE_IPS", "device %s is listed twice; give each entry its own name", device.ID)
+			continue
+		}
+		seen[device.ID] = true
+		if device.Serial == "" {
+			if net.ParseIP(device.IP) == nil && !validHostname(device.IP) {
+				c.errorf("DEVICE_IPS", "device %s has an invalid host %q", device.ID, device.IP)
+			}
+			if port, err := strconv.Atoi(device.Port); err != nil || port < 1 || port > 65535 {
+				c.errorf("DEVICE_IPS", "device %s has an invalid port %q; ZKTeco terminals usually listen on 4370", device.ID, device.Port)
+			}
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// validHostname reports whether s is a syntactically valid DNS name
+func validHostname(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkURLs checks the endpoint settings
+func (c *configCheck) checkURLs() {
+	if os.Getenv("API_URL") == "" {
+		c.errorf("API_URL", "not set; the attendance API endpoint records are posted to")
+	}
+	if os.Getenv("ORG_ID") == "" {
+		c.errorf("ORG_ID", "not set; the organization records are uploaded for")
+	}
+	for _, key := range []string{"API_URL", "API_HEALTH_URL", "ROSTER_URL", "USER_SYNC_URL", "GRAPHQL_URL", "AUTH_TOKEN_URL", "SECURITY_URL", "HOLIDAYS_URL", "DIGEST_URL", "ENRICH_URL", "SOAP_URL", "ORG_URL", "DEVICE_REGISTER_URL", "CONFIG_URL", "RECORDS_URL", "ERROR_REPORT_URL", "COLLECTOR_REGISTER_URL", "HEARTBEAT_URL", "UPDATE_URL"} {
+		c.checkURL(key, "http", "https")
+	}
+	c.checkURL("WEBSOCKET_URL", "ws", "wss")
+	if envBool("SECURITY_EVENTS") && !securitySinkConfigured() {
+		c.warnf("SECURITY_EVENTS", "no SECURITY_URL or SECURITY_FILE; operation log events are only logged when they raise an alert")
+	}
+	if url := os.Getenv("SOAP_URL"); os.Getenv("SOAP_USERNAME") != "" && strings.HasPrefix(url, "http://") &&
+		!strings.EqualFold(strings.TrimSpace(os.Getenv("SOAP_PASSWORD_TYPE")), "digest") {
+		c.warnf("SOAP_PASSWORD_TYPE", "the SOAP password is sent as text over plain http; use https or SOAP_PASSWORD_TYPE=digest")
+	}
+	if os.Getenv("DIGEST_AT") != "" && !digestChannelsConfigured() {
+		c.warnf("DIGEST_AT", "no DIGEST_URL or DIGEST_FILE; the daily digest is only logged and streamed on /api/events")
+	}
+	if addr := os.Getenv("ADMIN_ADDR"); addr != "" {
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			c.errorf("ADMIN_ADDR", "%q is not host:port, e.g. 127.0.0.1:9090", addr)
+		}
+		if os.Getenv("ADMIN_TOKEN") == "" {
+			c.warnf("ADMIN_TOKEN", "not set; the admin server refuses record queries, task runs, log level changes and device control")
+		}
+	}
+	if spec := os.Getenv("STATE_STORE"); spec != "" {
+		if _, err := openStateStore(spec); err != nil {
+			c.errorf("STATE_STORE", "%v", err)
+		} else if scheme := strings.SplitN(spec, ":", 2)[0]; (scheme == "redis" || strings.HasPrefix(scheme, "postgres")) &&
+			os.Getenv("STATE_NAMESPACE") == "" && os.Getenv("COLLECTOR_ID") == "" {
+			c.warnf("STATE_NAMESPACE", "the host name keeps this collector's state apart from others on the server; set STATE_NAMESPACE or COLLECTOR_ID where it can change, e.g. in a container")
+		}
+	}
+}
+
+// checkURL checks that key, when set, is an absolute URL with one of the schemes
+func (c *configCheck) checkURL(key string, schemes ...string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		c.errorf(key, "invalid URL: %v", err)
+		return
+	}
+	if u.Host == "" {
+		c.errorf(key, "%q has no host; use a full URL such as %s://example.com/path", value, schemes[len(schemes)-1])
+		return
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			if scheme == "http" || scheme == "ws" {
+				if ip := net.ParseIP(u.Hostname()); (ip == nil || !ip.IsLoopback()) && u.Hostname() != "localhost" {
+					c.warnf(key, "uses unencrypted %s; credentials and records cross the network in clear text", scheme)
+				}
+			}
+			return
+		}
+	}
+	c.errorf(key, "scheme %q is not supported, use %s", u.Scheme, strings.Join(schemes, " or "))
+}
+
+// checkAuth checks that the credentials settings are complete and consistent
+func (c *configCheck) checkAuth() {
+	command, tokenURL := os.Getenv("AUTH_TOKEN_COMMAND"), os.Getenv("AUTH_TOKEN_URL")
+	switch {
+	case command != "" && tokenURL != "":
+		c.errorf("AUTH_TOKEN_COMMAND", "set together with AUTH_TOKEN_URL; configure one token provider")
+	case command == "" && tokenURL == "" && os.Getenv("API_KEY") == "":
+		c.warnf("API_KEY", "not set and no token provider configured; requests are sent without authentication")
+	case (command != "" || tokenURL != "") && os.Getenv("API_KEY") != "":
+		c.warnf("API_KEY", "ignored, tokens come from the configured token provider")
+	}
+	if tokenURL != "" && (os.Getenv("AUTH_CLIENT_ID") == "") != (os.Getenv("AUTH_CLIENT_SECRET") == "") {
+		c.errorf("AUTH_CLIENT_ID", "AUTH_CLIENT_ID and AUTH_CLIENT_SECRET must be set together")
+	}
+	if tokenURL == "" {
+		for _, key := range []string{"AUTH_CLIENT_ID", "AUTH_CLIENT_SECRET", "AUTH_SCOPE"} {
+			if os.Getenv(key) != "" {
+				c.warnf(key, "has no effect without AUTH_TOKEN_URL")
+			}
+		}
+	}
+	// The collector refuses to start with a signing key it can't use, rather than send unsigned
+	signingSetting, signingKey := "SIGNING_KEY", strings.TrimSpace(os.Getenv("SIGNING_KEY"))
+	if path := os.Getenv("SIGNING_KEY_FILE"); signingKey == "" && path != "" {
+		signingSetting = "SIGNING_KEY_FILE"
+		if data, err := os.ReadFile(path); err != nil {
+			c.errorf(signingSetting, "%v", err)
+		} else if signingKey = strings.TrimSpace(string(data)); signingKey == "" {
+			c.errorf(signingSetting, "%s is empty", path)
+		}
+	}
+	if signingKey != "" {
+		if seed, err := base64.StdEncoding.DecodeString(signingKey); err != nil || len(seed) != 32 {
+			c.errorf(signingSetting, `not a base64 32-byte Ed25519 seed; generate one with the "keygen" command`)
+		}
+	}
+	if _, err := stateCipher(); err != nil {
+		c.errorf("STATE_ENCRYPTION_KEY", "%v", err)
+	} else if os.Getenv("STATE_ENCRYPTION_KEY") != "" || os.Getenv("STATE_ENCRYPTION_KEY_FILE") != "" {
+		for _, key := range []string{"ARCHIVE_DIR", "FILEDROP_URL"} {
+			if os.Getenv(key) != "" {
+				c.warnf(key, "its files are sink output and are not encrypted with STATE_ENCRYPTION_KEY")
+			}
+		}
+	}
+	if os.Getenv("UPDATE_URL") != "" {
+		if _, err := updatePublicKey(); err != nil {
+			c.errorf("UPDATE_PUBLIC_KEY", "%v", err)
+		}
+	} else if os.Getenv("UPDATE_PUBLIC_KEY") != "" {
+		c.warnf("UPDATE_PUBLIC_KEY", "has no effect without UPDATE_URL")
+	}
+}
+
+// checkSchedules checks intervals and time windows, including per-device overrides
+func (c *configCheck) checkSchedules(devices []deviceConfig) {
+	for _, key := range []string{"SYNC_INTERVAL", "PEAK_INTERVAL", "MAX_IDLE_INTERVAL", "DISCOVERY_INTERVAL", "ROSTER_REFRESH_INTERVAL", "USER_SYNC_INTERVAL", "USER_SNAPSHOT_INTERVAL", "FILEDROP_INTERVAL", "CONFIG_REFRESH_INTERVAL", "HEARTBEAT_INTERVAL", "UPDATE_INTERVAL"} {
+		if value := os.Getenv(key); value != "" {
+			if _, ok := parseSyncInterval(value); !ok {
+				c.errorf(key, "%q is not a positive number of minutes", value)
+			}
+		}
+	}
+	for _, t := range scheduledTasks {
+		if value := os.Getenv(t.setting); value != "" && (t.name == taskSync || strings.TrimSpace(value) != taskSync) {
+			if _, err := parseScheduler(t.name, value); err != nil {
+				c.errorf(t.setting, "%v", err)
+			}
+		}
+	}
+	for _, key := range []string{"BLACKOUT_WINDOWS", "PEAK_WINDOWS", "ANOMALY_HOURS"} {
+		if _, err := parseClockWindows(os.Getenv(key)); err != nil {
+			c.errorf(key, "%v", err)
+		}
+	}
+	for _, key := range []string{"INITIAL_SYNC_MAX_AGE", "BACKFILL_WINDOW", "OCCUPANCY_MAX_STAY", "ENRICH_CACHE_TTL", "STORE_RETENTION", "AUDIT_RETENTION", "STATS_RETENTION"} {
+		if value := os.Getenv(key); value != "" {
+			if _, err := parseAge(value); err != nil {
+				c.errorf(key, "%v", err)
+			}
+		}
+	}
+	if tz := os.Getenv("TZ"); tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			c.errorf("TZ", "unknown timezone %q; use an IANA name such as Asia/Dhaka", tz)
+		}
+	}
+	for _, device := range devices {
+		suffix := "_" + envSuffix(device.ID)
+		if value, ok := os.LookupEnv("SYNC_INTERVAL" + suffix); ok {
+			if _, ok := parseSyncInterval(value); !ok {
+				c.errorf("SYNC_INTERVAL"+suffix, "%q is not a positive number of minutes", value)
+			}
+		}
+		for _, key := range []string{"BLACKOUT_WINDOWS", "ANOMALY_HOURS"} {
+			if value, ok := os.LookupEnv(key + suffix); ok {
+				if _, err := parseClockWindows(value); err != nil {
+					c.errorf(key+suffix, "%v", err)
+				}
+			}
+		}
+	}
+}
+
+// Settings holding a non-negative whole number, of seconds where that applies
+var countSettings = []string{
+	"ZK_CONNECT_TIMEOUT", "ZK_READ_TIMEOUT", "ZK_RETRIES", "ZK_BAUD_RATE", "DISCOVERY_TIMEOUT",
+	"DISCOVERY_PORT", "DUPLICATE_PUNCH_WINDOW", "DEVICE_PAIR_WINDOW", "IDLE_CYCLES",
+	"BACKLOG_BATCH_SIZE", "GRAPHQL_BATCH_SIZE", "AUTH_TOKEN_TTL", "INSTANCE_LOCK_PORT",
+	"ANOMALY_TRAVEL_MINUTES", "ANOMALY_BURST_COUNT", "ANOMALY_BURST_MINUTES", "ENRICH_BATCH_SIZE",
+	"JOB_WORKERS", "ZK_KEEPALIVE", "RECORD_COUNTER_MAX_AGE",
+}
+
+// Settings holding a byte size with an optional k, m or g suffix
+var byteSizeSettings = []string{"STORE_MAX_SIZE", "ARCHIVE_MAX_SIZE", "UPLOAD_BANDWIDTH"}
+
+// checkValues checks numbers, sizes and settings with a fixed set of values, including the
+// per-device overrides of device settings
+func (c *configCheck) checkValues(devices []deviceConfig) {
+	for _, key := range countSettings {
+		if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				c.errorf(key, "%q is not a non-negative whole number", value)
+			}
+		}
+	}
+	if _, err := parseJobConcurrency(os.Getenv("JOB_CONCURRENCY")); err != nil {
+		c.errorf("JOB_CONCURRENCY", "%v", err)
+	}
+	for _, key := range byteSizeSettings {
+		value := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+		value = strings.TrimRight(value, "kmg")
+		if value != "" {
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+				c.errorf(key, "%q is not a size such as 512k, 100m or 2g", os.Getenv(key))
+			}
+		}
+	}
+	c.checkChoice("API_FORMAT", os.Getenv("API_FORMAT"), "json", "protobuf", "xml")
+	c.checkChoice("SOAP_VERSION", strings.TrimSpace(os.Getenv("SOAP_VERSION")), "1.1", "1.2")
+	c.checkChoice("SOAP_PASSWORD_TYPE", strings.ToLower(strings.TrimSpace(os.Getenv("SOAP_PASSWORD_TYPE"))), "text", "digest")
+	c.checkChoice("BACKLOG_ORDER", os.Getenv("BACKLOG_ORDER"), backlogFIFO, backlogLIFO, backlogNewestFirst)
+	c.checkChoice("SINK_ORDERING", strings.ToLower(os.Getenv("SINK_ORDERING")), orderingDevice, orderingRelaxed)
+	if order := os.Getenv("BACKLOG_ORDER"); order != "" && order != backlogFIFO {
+		switch {
+		case os.Getenv("SINK_ORDERING") == "" && sinkOrdering() == orderingRelaxed:
+			c.warnf("SINK_ORDERING", "unset with BACKLOG_ORDER=%s, so relaxed ordering is kept; set it to relaxed or device to choose", order)
+		case sinkOrdering() == orderingDevice:
+			c.warnf("BACKLOG_ORDER", "%s is ignored unless SINK_ORDERING=relaxed; records go in punch time order", order)
+		}
+	}
+	for _, key := range []string{"STORE_FULL_POLICY", "ARCHIVE_FULL_POLICY"} {
+		c.checkChoice(key, strings.ToLower(os.Getenv(key)), sink.PolicyEvictOldest, sink.PolicyStop, sink.PolicyAlert)
+	}
+	if _, err := sink.ParsePayloadVersion(os.Getenv("API_PAYLOAD_VERSION")); err != nil {
+		c.errorf("API_PAYLOAD_VERSION", "%v; use 1 or 2", err)
+	}
+	if os.Getenv("GRAPHQL_URL") != "" {
+		if os.Getenv("GRAPHQL_QUERY") == "" && os.Getenv("GRAPHQL_QUERY_FILE") == "" {
+			c.errorf("GRAPHQL_QUERY", "required with GRAPHQL_URL")
+		}
+		if _, err := sink.ParseGraphQLMapping(os.Getenv("GRAPHQL_VARIABLES"), true); err != nil {
+			c.errorf("GRAPHQL_VARIABLES", "%v", err)
+		}
+		if _, err := sink.ParseGraphQLMapping(os.Getenv("GRAPHQL_FIELDS"), false); err != nil {
+			c.errorf("GRAPHQL_FIELDS", "%v", err)
+		}
+	}
+	if text, err := envTemplate("API_TEMPLATE"); err != nil {
+		c.errorf("API_TEMPLATE_FILE", "%v", err)
+	} else if _, err := sink.ParsePayloadTemplate("API_TEMPLATE", text); err != nil {
+		c.errorf("API_TEMPLATE", "%v", err)
+	}
+	var formats map[string]sink.ExportFormat
+	if path := os.Getenv("EXPORT_FORMATS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			formats, err = sink.ParseExportFormats(data)
+		}
+		if err != nil {
+			c.errorf("EXPORT_FORMATS_FILE", "%v", err)
+		}
+	}
+	if os.Getenv("FILEDROP_URL") != "" {
+		target, err := fileDropTarget()
+		if err != nil {
+			c.errorf("FILEDROP_URL", "%v", err)
+		} else if target.URL.Scheme == "sftp" && os.Getenv("FILEDROP_PASSWORD") != "" {
+			c.errorf("FILEDROP_PASSWORD", "SFTP uploads use key authentication; set FILEDROP_SSH_KEY instead")
+		} else if target.URL.Scheme == "ftp" && (os.Getenv("FILEDROP_PASSWORD") != "" || target.URL.User != nil) {
+			c.warnf("FILEDROP_URL", "plain ftp sends the password unencrypted; use ftps or sftp")
+		}
+		if name := os.Getenv("FILEDROP_FORMAT"); name != "" {
+			if os.Getenv("FILEDROP_COLUMNS") != "" {
+				c.warnf("FILEDROP_COLUMNS", "ignored, FILEDROP_FORMAT is set")
+			}
+			if _, ok := formats[name]; !ok && os.Getenv("EXPORT_FORMATS_FILE") == "" {
+				c.errorf("FILEDROP_FORMAT", "EXPORT_FORMATS_FILE is required")
+			} else if !ok && formats != nil {
+				c.errorf("FILEDROP_FORMAT", "%q is not defined in EXPORT_FORMATS_FILE", name)
+			}
+		} else if _, err := sink.ParseExportColumns(os.Getenv("FILEDROP_COLUMNS")); err != nil {
+			c.errorf("FILEDROP_COLUMNS", "%v", err)
+		}
+		for _, entry := range splitList(os.Getenv("FILEDROP_AT")) {
+			if _, err := parseClock(entry); err != nil {
+				c.errorf("FILEDROP_AT", "%v", err)
+			}
+		}
+	}
+	for _, label := range splitList(os.Getenv("TEMPLATE_SINKS")) {
+		if _, err := templateSink(label, "", ""); err != nil {
+			c.errorf("TEMPLATE_SINKS", "%s: %v", label, err)
+		}
+		c.checkURL("TEMPLATE_SINK_URL_"+envSuffix(label), "http", "https")
+	}
+	c.checkCanaries()
+	if _, err := parseChaos(os.Getenv("CHAOS")); err != nil {
+		c.errorf("CHAOS", "%v", err)
+	} else if os.Getenv("CHAOS") != "" {
+		c.warnf("CHAOS", "chaos mode makes device reads and uploads fail on purpose, for development only")
+	}
+	if _, err := chaosSeed(); err != nil {
+		c.errorf("CHAOS_SEED", "%v", err)
+	}
+	if _, err := parseWeekdays(os.Getenv("WEEKEND_DAYS")); err != nil {
+		c.errorf("WEEKEND_DAYS", "%v", err)
+	}
+	if path := os.Getenv("HOLIDAYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			_, err = parseHolidayFile(data)
+		}
+		if err != nil {
+			c.errorf("HOLIDAYS_FILE", "%v", err)
+		}
+	}
+	if value := os.Getenv("DIGEST_AT"); value != "" {
+		if _, err := parseClock(value); err != nil {
+			c.errorf("DIGEST_AT", "%v", err)
+		}
+	}
+	if _, err := loadShiftSchedule(); err != nil {
+		c.errorf("SHIFTS", "%v", err)
+	}
+	for _, pair := range strings.Split(os.Getenv("DEVICE_PAIRS"), ",") {
+		if pair = strings.TrimSpace(pair); pair != "" && strings.Count(pair, "+") != 1 {
+			c.errorf("DEVICE_PAIRS", "entry %q is not DEVICE_A+DEVICE_B", pair)
+		}
+	}
+
+	for _, device := range devices {
+		key := func(name string) string {
+			if _, ok := os.LookupEnv(name + "_" + envSuffix(device.ID)); ok {
+				return name + "_" + envSuffix(device.ID)
+			}
+			return name
+		}
+		if format := strings.ToLower(deviceEnv("CARD_FORMAT", device.ID)); format != "" && format != "raw" {
+			if _, ok := badgeFormats[format]; !ok {
+				c.errorf(key("CARD_FORMAT"), "unknown card format %q; use raw, wiegand26, wiegand26_parity or wiegand34", format)
+			}
+		}
+		if encoding := deviceEnv("ZK_NAME_ENCODING", device.ID); !zk.ValidNameEncoding(encoding) {
+			c.errorf(key("ZK_NAME_ENCODING"), "unknown encoding %q; use auto, utf-8, utf-16le, gb2312 or latin1", encoding)
+		}
+		c.checkChoice(key("ROSTER_MATCH"), deviceEnv("ROSTER_MATCH", device.ID), "employee_id", "badge_number", "card_number")
+		if _, err := parseMaintenance(deviceEnv("MAINTENANCE", device.ID)); err != nil {
+			c.errorf(key("MAINTENANCE"), "%v", err)
+		}
+		if _, err := parseRecovery(deviceEnv("RECOVERY", device.ID)); err != nil {
+			c.errorf(key("RECOVERY"), "%v", err)
+		}
+		if value := deviceEnv("MAINTENANCE_CAPACITY_ALERT", device.ID); value != "" {
+			if n, err := strconv.Atoi(value); err != nil || n <= 0 || n > 100 {
+				c.errorf(key("MAINTENANCE_CAPACITY_ALERT"), "%q is not a percentage from 1 to 100", value)
+			}
+		}
+		if value := deviceEnv("NO_PUNCH_ALERT_AT", device.ID); value != "" {
+			if _, err := parseClock(value); err != nil {
+				c.errorf(key("NO_PUNCH_ALERT_AT"), "%v", err)
+			}
+		}
+		c.checkChoice(key("DEVICE_DIRECTION"), strings.ToLower(deviceEnv("DEVICE_DIRECTION", device.ID)), directionToggle, directionIn, directionOut)
+		if tz := deviceEnv("ZK_TIMEZONE", device.ID); tz != "" {
+			if _, err := time.LoadLocation(tz); err != nil {
+				c.errorf(key("ZK_TIMEZONE"), "unknown timezone %q; use an IANA name such as Asia/Dhaka", tz)
+			}
+		}
+		if value := strings.TrimSpace(deviceEnv("CLOCK_DRIFT_THRESHOLD", device.ID)); value != "" {
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				c.errorf(key("CLOCK_DRIFT_THRESHOLD"), "%q is not a non-negative whole number of seconds", value)
+			}
+		}
+		if pause := deviceEnv("ZK_CHUNK_PAUSE", device.ID); pause != "" {
+			if d, err := time.ParseDuration(pause); err != nil || d < 0 {
+				c.errorf(key("ZK_CHUNK_PAUSE"), "%q is not a duration such as 200ms", pause)
+			}
+		}
+		if value := strings.TrimSpace(deviceEnv("MIN_RECORD_DATE", device.ID)); value != "" {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				c.errorf(key("MIN_RECORD_DATE"), "%q is not a date in YYYY-MM-DD form", value)
+			}
+		}
+		if device.Serial != "" && runtime.GOOS != "linux" {
+			c.errorf("DEVICE_IPS", "device %s uses a serial port, which this platform doesn't support", device.ID)
+		}
+	}
+}
+
+// checkChoice checks that key, when set, is one of the allowed values
+func (c *configCheck) checkChoice(key, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	c.errorf(key, "unknown value %q; use %s", value, strings.Join(allowed, ", "))
+}
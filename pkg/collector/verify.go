@@ -0,0 +1,290 @@
+package collector
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"old-attendance/pkg/sink"
+	"old-attendance/pkg/zk"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pages of RECORDS_URL followed before giving up, in case the backend links back to a page
+const maxRecordPages = 1000
+
+// recordsPage is the body of RECORDS_URL: a page of records, with the URL of the next one
+// when there are more. A plain array of records is accepted too.
+type recordsPage struct {
+	Logs []zk.AttendanceRecord `json:"logs"`
+	Next string                `json:"next,omitempty"`
+}
+
+// fetchBackendRecords GETs the records the backend holds for a range of days, following
+// the pages it returns
+func fetchBackendRecords(recordsURL, apiKey, from, to, device string) ([]zk.AttendanceRecord, error) {
+	u, err := url.Parse(recordsURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RECORDS_URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("from", from)
+	query.Set("to", to)
+	if device != "" {
+		query.Set("device_id", device)
+	}
+	u.RawQuery = query.Encode()
+
+	var records []zk.AttendanceRecord
+	next := u.String()
+	for page := 0; next != ""; page++ {
+		if page == maxRecordPages {
+			return nil, fmt.Errorf("records request returned more than %d pages", maxRecordPages)
+		}
+		req, err := sink.NewAPIRequest("GET", next, nil, apiKey)
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{Timeout: 45 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute records request: %w", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("records request failed with status %d: %s", resp.StatusCode, string(body))
+		}
+
+		var p recordsPage
+		if err := json.Unmarshal(body, &p.Logs); err != nil {
+			if err := json.Unmarshal(body, &p); err != nil {
+				return nil, fmt.Errorf("invalid records response: %w", err)
+			}
+		}
+		records = append(records, p.Logs...)
+		next = ""
+		if p.Next != "" {
+			ref, err := url.Parse(p.Next)
+			if err != nil {
+				return nil, fmt.Errorf("invalid next page %q: %w", p.Next, err)
+			}
+			next = u.ResolveReference(ref).String()
+		}
+	}
+	return records, nil
+}
+
+// readDevicesForVerify reads the punches of a range of days from the devices, with the user
+// IDs mapped to employees as a sync would. It returns the devices that could be read.
+func readDevicesForVerify(devices []deviceConfig, from, to string) ([]zk.AttendanceRecord, map[string]bool) {
+	since, _ := time.ParseInLocation("2006-01-02", from, time.Local)
+	var records []zk.AttendanceRecord
+	read := map[string]bool{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(device deviceConfig) {
+			defer wg.Done()
+			zkManager, err := newDeviceManager(device)
+			var found []zk.AttendanceRecord
+			if err == nil {
+				// A day's punches are a second or more after midnight, so none are lost to After
+				found, err = zkManager.GetAttendance(since.Add(-time.Second))
+			}
+			if err != nil {
+				log.Printf("Error reading %s, its punches are left out: %v", device.ID, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			read[device.ID] = true
+			for _, record := range found {
+				if day := recordDay(record); day >= from && day <= to {
+					records = append(records, record)
+				}
+			}
+		}(device)
+	}
+	wg.Wait()
+
+	normalizeBadges(records)
+	if roster := loadRoster(); roster != nil {
+		records = applyRoster(records, roster)
+	}
+	return records, read
+}
+
+// verifyDifference is a punch found on one side only
+type verifyDifference struct {
+	Kind   string // "missing" from the backend, or "extra" in it
+	Record zk.AttendanceRecord
+	Note   string
+}
+
+// diffPunches matches device punches with backend records by employee, time and device.
+// Backend records without a device match a punch by employee and time on any device.
+func diffPunches(device, backend []zk.AttendanceRecord) (missing, extra []zk.AttendanceRecord) {
+	exact := map[string]int{}
+	loose := map[string]int{}
+	for _, r := range backend {
+		if r.DeviceID == "" {
+			loose[fmt.Sprintf("%d|%s", r.UserID, r.Timestamp)]++
+		} else {
+			exact[fmt.Sprintf("%d|%s|%s", r.UserID, r.Timestamp, r.DeviceID)]++
+		}
+	}
+	for _, r := range device {
+		key := fmt.Sprintf("%d|%s", r.UserID, r.Timestamp)
+		switch {
+		case exact[key+"|"+r.DeviceID] > 0:
+			exact[key+"|"+r.DeviceID]--
+		case loose[key] > 0:
+			loose[key]--
+		default:
+			missing = append(missing, r)
+		}
+	}
+	for _, r := range backend {
+		key := fmt.Sprintf("%d|%s", r.UserID, r.Timestamp)
+		if r.DeviceID != "" {
+			key += "|" + r.DeviceID
+		}
+		counts := exact
+		if r.DeviceID == "" {
+			counts = loose
+		}
+		if counts[key] > 0 {
+			counts[key]--
+			extra = append(extra, r)
+		}
+	}
+	return missing, extra
+}
+
+// runVerifyCommand compares the punches on the devices with the records the backend holds
+// for a range of days, from RECORDS_URL, and prints the punches missing from the backend and
+// those it has that no device does. Nothing is stored or sent, so it is safe to run against
+// production when an employee disputes their attendance. Missing punches are marked with
+// whether the collector stored them, which tells a punch still queued or dropped as a double
+// tap apart from one never read. Extra punches on devices that couldn't be read are left out.
+func runVerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fromStr := fs.String("from", "", "first day to verify as YYYY-MM-DD (default today)")
+	toStr := fs.String("to", "", "last day to verify as YYYY-MM-DD (default --from)")
+	deviceName := fs.String("device", "", "verify only this device instead of all of DEVICE_IPS")
+	userID := fs.Int("user", 0, "verify only this employee")
+	fs.Parse(args)
+
+	recordsURL := os.Getenv("RECORDS_URL")
+	if recordsURL == "" {
+		return configError("RECORDS_URL is not set; verify needs the backend's records API")
+	}
+	from, to, err := parseDayRange(*fromStr, *toStr)
+	if err != nil {
+		return err
+	}
+	var devices []deviceConfig
+	for _, device := range configuredDevices() {
+		if *deviceName == "" || device.ID == *deviceName {
+			devices = append(devices, device)
+		}
+	}
+	if len(devices) == 0 {
+		return configError("no matching devices in DEVICE_IPS")
+	}
+
+	backend, err := fetchBackendRecords(recordsURL, os.Getenv("API_KEY"), from, to, *deviceName)
+	if err != nil {
+		return err
+	}
+	onDevices, read := readDevicesForVerify(devices, from, to)
+	if len(read) == 0 {
+		return fmt.Errorf("no device could be read")
+	}
+
+	wanted := func(r zk.AttendanceRecord) bool {
+		day := recordDay(r)
+		return day >= from && day <= to && (*userID == 0 || r.UserID == *userID)
+	}
+	var deviceRecords, backendRecords []zk.AttendanceRecord
+	for _, r := range onDevices {
+		if wanted(r) {
+			deviceRecords = append(deviceRecords, r)
+		}
+	}
+	for _, r := range backend {
+		// The backend may hold the records of other collectors' devices too
+		inScope := containsDevice(devices, r.DeviceID) || (*deviceName == "" && (r.Manual || r.DeviceID == ""))
+		if wanted(r) && inScope {
+			backendRecords = append(backendRecords, r)
+		}
+	}
+	missing, extra := diffPunches(deviceRecords, backendRecords)
+
+	stored := map[string]bool{}
+	if storedRecords, err := readStore(); err != nil {
+		log.Printf("Error reading record store: %v", err)
+	} else {
+		for _, r := range storedRecords {
+			stored[fmt.Sprintf("%d|%s|%s", r.Record.UserID, r.Record.Timestamp, r.Record.DeviceID)] = true
+		}
+	}
+	var differences []verifyDifference
+	for _, r := range missing {
+		note := "not stored"
+		if stored[fmt.Sprintf("%d|%s|%s", r.UserID, r.Timestamp, r.DeviceID)] {
+			note = "stored"
+		}
+		differences = append(differences, verifyDifference{Kind: "missing", Record: r, Note: note})
+	}
+	skipped := 0
+	for _, r := range extra {
+		switch {
+		case r.Manual:
+			differences = append(differences, verifyDifference{Kind: "extra", Record: r, Note: "manual"})
+		case r.DeviceID != "" && !read[r.DeviceID] && containsDevice(devices, r.DeviceID):
+			skipped++
+		default:
+			differences = append(differences, verifyDifference{Kind: "extra", Record: r})
+		}
+	}
+
+	sort.Slice(differences, func(i, j int) bool {
+		if differences[i].Record.Timestamp != differences[j].Record.Timestamp {
+			return differences[i].Record.Timestamp < differences[j].Record.Timestamp
+		}
+		return differences[i].Record.UserID < differences[j].Record.UserID
+	})
+	for _, d := range differences {
+		line := fmt.Sprintf("%-8s %s  %8d  %-20s %s", d.Kind, d.Record.Timestamp, d.Record.UserID, d.Record.DeviceID, d.Note)
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	if skipped > 0 {
+		log.Printf("Left out %d backend record(s) of devices that couldn't be read", skipped)
+	}
+	log.Printf("%d punch(es) on %d of %d device(s), %d in the backend, from %s to %s: %d missing, %d extra",
+		len(deviceRecords), len(read), len(devices), len(backendRecords), from, to, len(missing), len(differences)-len(missing))
+	if len(differences) > 0 {
+		return fmt.Errorf("%d punch(es) differ between the devices and the backend", len(differences))
+	}
+	return nil
+}
+
+// containsDevice reports whether a device is among those configured
+func containsDevice(devices []deviceConfig, id string) bool {
+	for _, device := range devices {
+		if device.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Version is the collector release, set when building a release with
+// -ldflags "-X old-attendance/pkg/collector.Version=1.4.0"
+var Version = "dev"
+
+// Commit and BuildTime identify the source a binary was built from. Go records them when
+// building in a git checkout; builds from a source archive set them the same way as Version.
+var (
+	Commit    = ""
+	BuildTime = ""
+)
+
+// BuildInfo is what a binary is and how it is configured, for support to tell exactly what
+// a site runs
+type BuildInfo struct {
+	Version      string   `json:"version"`
+	Commit       string   `json:"commit,omitempty"`
+	Modified     bool     `json:"modified,omitempty"` // Built from a checkout with uncommitted changes
+	BuildTime    string   `json:"build_time,omitempty"`
+	GoVersion    string   `json:"go_version"`
+	Platform     string   `json:"platform"` // GOOS/GOARCH
+	CollectorID  string   `json:"collector_id"`
+	Tenant       string   `json:"tenant,omitempty"`
+	ConfigHash   string   `json:"config_hash"`
+	Features     []string `json:"features"`      // Optional parts turned on by their settings
+	FeatureFlags []string `json:"feature_flags"` // Flags on, from CONFIG_URL and FEATURE_FLAGS
+}
+
+// optionalFeatures are the optional parts of the collector reported as features, each with
+// the setting that turns it on: a true value for switches, any value for the rest
+var optionalFeatures = []struct {
+	name, key string
+	isSwitch  bool
+}{
+	{"admin_server", "ADMIN_ADDR", false},
+	{"archive", "ARCHIVE_DIR", false},
+	{"auto_discover", "AUTO_DISCOVER", true},
+	{"auto_update", "UPDATE_URL", false},
+	{"clock_drift_correction", "CLOCK_DRIFT_CORRECTION", true},
+	{"device_status", "API_DEVICE_STATUS", true},
+	{"error_reports", "ERROR_REPORT_URL", false},
+	{"filedrop", "FILEDROP_URL", false},
+	{"graphql", "GRAPHQL_URL", false},
+	{"heartbeat", "HEARTBEAT_URL", false},
+	{"read_modality", "ZK_READ_MODALITY", true},
+	{"remote_config", "CONFIG_URL", false},
+	{"signing", "SIGNING_KEY", false},
+	{"signing", "SIGNING_KEY_FILE", false},
+	{"soap", "SOAP_URL", false},
+	{"template_sinks", "TEMPLATE_SINKS", false},
+	{"tenants", "TENANTS_DIR", false},
+	{"websocket", "WEBSOCKET_URL", false},
+}
+
+// inheritedSettings holds the keys of the process environment, recorded by LoadConfig. The
+// config hash leaves them out, as the environment holds the machine's own variables too.
+var inheritedSettings = map[string]bool{}
+
+// recordInheritedSettings marks the keys of the process environment, less those --set overrides
+func recordInheritedSettings(environ []string, overrides []string) {
+	for _, entry := range environ {
+		if i := strings.Index(entry, "="); i > 0 {
+			inheritedSettings[entry[:i]] = true
+		}
+	}
+	for _, override := range overrides {
+		if i := strings.Index(override, "="); i > 0 {
+			delete(inheritedSettings, override[:i])
+		}
+	}
+}
+
+// configHash hashes the settings from the .env and profile files, --set and CONFIG_URL, so
+// two sites can be compared without showing either's secrets
+func configHash() string {
+	var settings []string
+	for _, entry := range os.Environ() {
+		if i := strings.Index(entry, "="); i > 0 && !inheritedSettings[entry[:i]] {
+			settings = append(settings, entry)
+		}
+	}
+	sort.Strings(settings)
+	hash := sha256.New()
+	for _, setting := range settings {
+		hash.Write([]byte(setting))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// featureOn reports whether a setting turns its feature on, globally or for any device
+func featureOn(key string, isSwitch bool) bool {
+	on := func(value string) bool {
+		if isSwitch {
+			return isTrue(value)
+		}
+		return strings.TrimSpace(value) != ""
+	}
+	if on(os.Getenv(key)) {
+		return true
+	}
+	for _, device := range configuredDevices() {
+		if on(deviceEnv(key, device.ID)) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildInfo describes this binary and its configuration
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:      Version,
+		Commit:       Commit,
+		BuildTime:    BuildTime,
+		GoVersion:    runtime.Version(),
+		Platform:     currentPlatform(),
+		CollectorID:  collectorID(),
+		Tenant:       tenantName(),
+		ConfigHash:   configHash(),
+		Features:     []string{},
+		FeatureFlags: enabledFeatures(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	for _, feature := range optionalFeatures {
+		n := len(info.Features)
+		if (n == 0 || info.Features[n-1] != feature.name) && featureOn(feature.key, feature.isSwitch) {
+			info.Features = append(info.Features, feature.name)
+		}
+	}
+	if info.FeatureFlags == nil {
+		info.FeatureFlags = []string{}
+	}
+	return info
+}
+
+// runVersionCommand prints the version, and with --verbose the build and configuration
+// details support asks for
+func runVersionCommand(args []string) error {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	verbose := fs.Bool("verbose", false, "also print the build, platform and configuration")
+	asJSON := fs.Bool("json", false, "print the details as JSON")
+	fs.Parse(args)
+
+	info := buildInfo()
+	if *asJSON {
+		data, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Println(info.Version)
+	if !*verbose {
+		return nil
+	}
+	commit := info.Commit
+	if commit == "" {
+		commit = "unknown"
+	} else if info.Modified {
+		commit += " (modified)"
+	}
+	fmt.Printf("commit:        %s\n", commit)
+	if info.BuildTime != "" {
+		fmt.Printf("built:         %s\n", info.BuildTime)
+	}
+	fmt.Printf("go:            %s\n", info.GoVersion)
+	fmt.Printf("platform:      %s\n", info.Platform)
+	fmt.Printf("collector:     %s\n", info.CollectorID)
+	fmt.Printf("config hash:   %s\n", info.ConfigHash)
+	fmt.Printf("features:      %s\n", listOrNone(info.Features))
+	fmt.Printf("feature flags: %s\n", listOrNone(info.FeatureFlags))
+	return nil
+}
+
+// listOrNone joins names for printing, or says there are none
+func listOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// handleVersion serves the build info as JSON
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(contentTypeHeader, jsonContentType)
+	json.NewEncoder(w).Encode(buildInfo())
+}
@@ -0,0 +1,135 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Define constants for headers and prefixes
+const (
+	contentTypeHeader   = "Content-Type"
+	acceptHeader        = "Accept"
+	authorizationHeader = "Authorization"
+	jsonContentType     = "application/json"
+	bearerPrefix        = "Bearer "
+	syncIDHeader        = "X-Sync-Id"
+	batchIDHeader       = "X-Batch-Id"
+)
+
+// AttendancePayload defines the structure for the data sent to the API in protobuf and XML
+// formats. JSON uploads send the logs array on its own. See schema/ for the wire formats.
+type AttendancePayload struct {
+	OrgID   string                `json:"org_id"`
+	Logs    []zk.AttendanceRecord `json:"logs"`
+	Devices []DeviceStatus        `json:"device_status,omitempty"` // Protobuf only; the XML schema has no place for it
+}
+
+// SendToAPI marshals the logs and sends them via HTTP POST
+func SendToAPI(logs []zk.AttendanceRecord, orgID, apiURL, apiKey string) error {
+	return sendBatchToAPI(Batch{Logs: logs}, orgID, apiURL, apiKey, PayloadV1)
+}
+
+// sendBatchToAPI posts a batch, adding its correlation IDs as headers when set. JSON bodies
+// are encoded in the payload version the endpoint takes, and sent again once in the version
+// it asks for if it rejects them.
+func sendBatchToAPI(batch Batch, orgID, apiURL, apiKey string, version int) error {
+	version = payloadVersionFor(apiURL, version)
+	var body []byte
+	contentType := jsonContentType
+	switch os.Getenv("API_FORMAT") {
+	case "protobuf":
+		// The protobuf schema is versioned by its package name, attendance.v1
+		body = marshalPayloadProto(AttendancePayload{OrgID: orgID, Logs: batch.Logs, Devices: batch.Devices})
+		contentType = protobufContentType
+		version = PayloadV1
+	case "xml":
+		// The XML schema is versioned by its namespace, urn:attendance:v1
+		xmlData, err := marshalPayloadXML(AttendancePayload{OrgID: orgID, Logs: batch.Logs})
+		if err != nil {
+			return fmt.Errorf("failed to marshal logs to XML: %w", err)
+		}
+		body = xmlData
+		contentType = xmlContentType
+		version = PayloadV1
+	default:
+		jsonData, err := marshalPayloadJSON(batch, orgID, version)
+		if err != nil {
+			return fmt.Errorf("failed to marshal logs to JSON: %w", err)
+		}
+		body = jsonData
+	}
+
+	req, err := NewAPIRequest("POST", apiURL, body, apiKey)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(contentTypeHeader, contentType)
+	req.Header.Set(payloadVersionHeader, strconv.Itoa(version))
+	if batch.SyncID != "" {
+		req.Header.Set(syncIDHeader, batch.SyncID)
+	}
+	if batch.BatchID != "" {
+		req.Header.Set(batchIDHeader, batch.BatchID)
+	}
+
+	// Bodies are paced to UPLOAD_BANDWIDTH, with the time that takes added to the timeout
+	req.Body = io.NopCloser(throttle(bytes.NewReader(body)))
+	client := &http.Client{Timeout: uploadTimeout(45*time.Second, len(body)), Transport: uploadTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute API request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		log.Printf("API request successful (Status: %d)", resp.StatusCode)
+		return nil
+	}
+
+	if contentType == jsonContentType {
+		if retry, ok := negotiateVersion(apiURL, version, resp); ok {
+			return sendBatchToAPI(batch, orgID, apiURL, apiKey, retry)
+		}
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	return statusError(resp.StatusCode, respBody)
+}
+
+// statusError classifies a non-2xx API response
+func statusError(status int, body []byte) error {
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		RejectAuthToken()
+		return fmt.Errorf("%w with status %d: %s", ErrAuthFailed, status, string(body))
+	}
+	return fmt.Errorf("%w with status %d: %s", ErrAPIRejected, status, string(body))
+}
+
+// NewAPIRequest builds a JSON API request with the standard headers, optional bearer auth,
+// and a payload signature when a signing key is configured. The bearer token comes from the
+// configured AuthProvider when there is one, and is apiKey otherwise.
+func NewAPIRequest(method, url string, body []byte, apiKey string) (*http.Request, error) {
+	token, err := bearerToken(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API request: %w", err)
+	}
+	req.Header.Set(contentTypeHeader, jsonContentType)
+	req.Header.Set(acceptHeader, jsonContentType)
+	if token != "" {
+		req.Header.Set(authorizationHeader, bearerPrefix+token)
+	}
+	if err := signRequest(req, body); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
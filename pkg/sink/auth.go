@@ -0,0 +1,204 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default lifetime of a token whose source doesn't state one, see AUTH_TOKEN_TTL
+const defaultTokenTTL = 5 * time.Minute
+
+// Tokens are refreshed this long before they expire, so requests in flight don't outlive them
+const tokenRefreshMargin = 30 * time.Second
+
+// AuthProvider mints the bearer token sent to the API in place of API_KEY, for backends that
+// only accept short-lived tokens. A ttl of zero means the source didn't say how long the
+// token lasts.
+type AuthProvider interface {
+	Token() (token string, ttl time.Duration, err error)
+}
+
+// CommandTokenProvider runs a shell command and uses what it prints as the token
+type CommandTokenProvider struct {
+	Command string
+	Timeout time.Duration
+}
+
+// Token runs the command. Its output is either the token itself or a token response as
+// returned by URLTokenProvider endpoints.
+func (p *CommandTokenProvider) Token() (string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	cmd := exec.CommandContext(ctx, shell, flag, p.Command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", 0, fmt.Errorf("token command failed: %w", err)
+	}
+	return parseTokenResponse(out)
+}
+
+// URLTokenProvider fetches a token from an endpoint with a client credentials grant. The
+// client ID and secret are sent as HTTP basic auth when set.
+type URLTokenProvider struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+}
+
+// Token posts the grant and reads the token from the response
+func (p *URLTokenProvider) Token() (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if p.Scope != "" {
+		form.Set("scope", p.Scope)
+	}
+	req, err := http.NewRequest("POST", p.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set(contentTypeHeader, "application/x-www-form-urlencoded")
+	req.Header.Set(acceptHeader, jsonContentType)
+	if p.ClientID != "" {
+		req.SetBasicAuth(p.ClientID, p.ClientSecret)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to execute token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", 0, fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return parseTokenResponse(body)
+}
+
+// parseTokenResponse reads a token from a JSON object with access_token (or token) and
+// optionally expires_in seconds, or from plain text
+func parseTokenResponse(data []byte) (string, time.Duration, error) {
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "{") {
+		var response struct {
+			AccessToken string `json:"access_token"`
+			Token       string `json:"token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		if err := json.Unmarshal([]byte(text), &response); err != nil {
+			return "", 0, fmt.Errorf("invalid token response: %w", err)
+		}
+		text = response.AccessToken
+		if text == "" {
+			text = response.Token
+		}
+		if text == "" {
+			return "", 0, errors.New("token response has no access_token")
+		}
+		return text, time.Duration(response.ExpiresIn) * time.Second, nil
+	}
+	if text == "" || strings.ContainsAny(text, " \t\r\n") {
+		return "", 0, errors.New("token source returned no single-line token")
+	}
+	return text, 0, nil
+}
+
+// authToken caches the current provider token. Tenants run as separate processes, so one
+// cache per process is enough.
+var authToken = struct {
+	sync.Mutex
+	once     sync.Once
+	provider AuthProvider
+	token    string
+	expires  time.Time
+}{}
+
+// authProvider returns the provider configured with AUTH_TOKEN_COMMAND or AUTH_TOKEN_URL,
+// or nil when requests use API_KEY
+func authProvider() AuthProvider {
+	authToken.once.Do(func() {
+		if command := os.Getenv("AUTH_TOKEN_COMMAND"); command != "" {
+			authToken.provider = &CommandTokenProvider{Command: command, Timeout: 30 * time.Second}
+		} else if tokenURL := os.Getenv("AUTH_TOKEN_URL"); tokenURL != "" {
+			authToken.provider = &URLTokenProvider{
+				URL:          tokenURL,
+				ClientID:     os.Getenv("AUTH_CLIENT_ID"),
+				ClientSecret: os.Getenv("AUTH_CLIENT_SECRET"),
+				Scope:        os.Getenv("AUTH_SCOPE"),
+			}
+		}
+	})
+	return authToken.provider
+}
+
+// HasAuthProvider reports whether API tokens come from a provider rather than API_KEY
+func HasAuthProvider() bool {
+	return authProvider() != nil
+}
+
+// tokenTTL returns AUTH_TOKEN_TTL in seconds, the lifetime of tokens whose source doesn't
+// state one
+func tokenTTL() time.Duration {
+	value := os.Getenv("AUTH_TOKEN_TTL")
+	if value == "" {
+		return defaultTokenTTL
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid AUTH_TOKEN_TTL=%q, using %v", value, defaultTokenTTL)
+		return defaultTokenTTL
+	}
+	return time.Duration(n) * time.Second
+}
+
+// bearerToken returns the token to authenticate with: the provider's, minted again when
+// the cached one is about to expire, or apiKey when there is no provider
+func bearerToken(apiKey string) (string, error) {
+	provider := authProvider()
+	if provider == nil {
+		return apiKey, nil
+	}
+	authToken.Lock()
+	defer authToken.Unlock()
+	if authToken.token != "" && time.Now().Before(authToken.expires) {
+		return authToken.token, nil
+	}
+	token, ttl, err := provider.Token()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	if ttl <= 0 {
+		ttl = tokenTTL()
+	}
+	if ttl > 2*tokenRefreshMargin {
+		ttl -= tokenRefreshMargin
+	}
+	authToken.token, authToken.expires = token, time.Now().Add(ttl)
+	log.Printf("Obtained API token, valid for %v", ttl.Round(time.Second))
+	return token, nil
+}
+
+// RejectAuthToken drops the cached provider token after the API refused it, so the next
+// request mints a new one
+func RejectAuthToken() {
+	authToken.Lock()
+	authToken.token = ""
+	authToken.Unlock()
+}
@@ -0,0 +1,186 @@
+package sink
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseTokenResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		token   string
+		ttl     time.Duration
+		wantErr bool
+	}{
+		{"plain token", "abc.def.ghi\n", "abc.def.ghi", 0, false},
+		{"access_token", `{"access_token":"abc","expires_in":3600}`, "abc", time.Hour, false},
+		{"token field", `{"token":"abc"}`, "abc", 0, false},
+		{"access_token preferred", `{"access_token":"abc","token":"xyz"}`, "abc", 0, false},
+		{"surrounding space", "  \n{\"access_token\":\"abc\"}\n", "abc", 0, false},
+		{"no token in object", `{"expires_in":60}`, "", 0, true},
+		{"invalid JSON", `{"access_token":`, "", 0, true},
+		{"wrong expires_in type", `{"access_token":"abc","expires_in":"60"}`, "", 0, true},
+		{"empty", "", "", 0, true},
+		{"several lines", "abc\ndef", "", 0, true},
+		{"words", "Error: not logged in", "", 0, true},
+	}
+	for _, tt := range tests {
+		token, ttl, err := parseTokenResponse([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if token != tt.token || ttl != tt.ttl {
+			t.Errorf("%s: got %q valid %v, want %q valid %v", tt.name, token, ttl, tt.token, tt.ttl)
+		}
+	}
+}
+
+func TestURLTokenProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		user, secret, _ := r.BasicAuth()
+		switch {
+		case r.Method != "POST" || r.Form.Get("grant_type") != "client_credentials":
+			http.Error(w, "bad grant", http.StatusBadRequest)
+		case user != "" && (user != "collector" || secret != "s3cret"):
+			http.Error(w, "bad client", http.StatusUnauthorized)
+		case r.Form.Get("scope") != "":
+			w.Write([]byte(`{"access_token":"scoped-` + r.Form.Get("scope") + `","expires_in":120}`))
+		default:
+			w.Write([]byte(`{"access_token":"open"}`))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		provider URLTokenProvider
+		token    string
+		ttl      time.Duration
+		wantErr  bool
+	}{
+		{"no client", URLTokenProvider{URL: server.URL}, "open", 0, false},
+		{"client and scope", URLTokenProvider{URL: server.URL, ClientID: "collector", ClientSecret: "s3cret", Scope: "punches"}, "scoped-punches", 2 * time.Minute, false},
+		{"wrong secret", URLTokenProvider{URL: server.URL, ClientID: "collector", ClientSecret: "guess"}, "", 0, true},
+		{"unreachable", URLTokenProvider{URL: "http://127.0.0.1:1/token"}, "", 0, true},
+		{"invalid URL", URLTokenProvider{URL: "://token"}, "", 0, true},
+	}
+	for _, tt := range tests {
+		token, ttl, err := tt.provider.Token()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if token != tt.token || ttl != tt.ttl {
+			t.Errorf("%s: got %q valid %v, want %q valid %v", tt.name, token, ttl, tt.token, tt.ttl)
+		}
+	}
+}
+
+func TestCommandTokenProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		token   string
+		wantErr bool
+	}{
+		{"plain token", "echo abc123", "abc123", false},
+		{"token response", `echo '{"access_token":"abc123"}'`, "abc123", false},
+		{"failing command", "exit 3", "", true},
+		{"no output", "exit 0", "", true},
+	}
+	for _, tt := range tests {
+		token, _, err := (&CommandTokenProvider{Command: tt.command, Timeout: 10 * time.Second}).Token()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if token != tt.token {
+			t.Errorf("%s: token %q, want %q", tt.name, token, tt.token)
+		}
+	}
+}
+
+// fakeProvider mints numbered tokens, or fails with err
+type fakeProvider struct {
+	minted int
+	ttl    time.Duration
+	err    error
+}
+
+func (p *fakeProvider) Token() (string, time.Duration, error) {
+	if p.err != nil {
+		return "", 0, p.err
+	}
+	p.minted++
+	return "token-" + strconv.Itoa(p.minted), p.ttl, nil
+}
+
+// withAuthProvider runs a test with provider in place of the configured one
+func withAuthProvider(t *testing.T, provider AuthProvider) {
+	t.Helper()
+	authProvider()
+	authToken.Lock()
+	saved := authToken.provider
+	authToken.provider, authToken.token = provider, ""
+	authToken.Unlock()
+	t.Cleanup(func() {
+		authToken.Lock()
+		authToken.provider, authToken.token = saved, ""
+		authToken.Unlock()
+	})
+}
+
+func TestBearerToken(t *testing.T) {
+	withAuthProvider(t, nil)
+	if token, err := bearerToken("api-key"); err != nil || token != "api-key" {
+		t.Errorf("without a provider: %q, %v, want API_KEY", token, err)
+	}
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		envTTL  string
+		expires time.Duration // Cached token lifetime, after the refresh margin
+	}{
+		{"stated lifetime", time.Hour, "", time.Hour - tokenRefreshMargin},
+		{"default lifetime", 0, "", defaultTokenTTL - tokenRefreshMargin},
+		{"AUTH_TOKEN_TTL", 0, "600", 10*time.Minute - tokenRefreshMargin},
+		{"invalid AUTH_TOKEN_TTL", 0, "-1", defaultTokenTTL - tokenRefreshMargin},
+		{"lifetime too short for the margin", 45 * time.Second, "", 45 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTH_TOKEN_TTL", tt.envTTL)
+		provider := &fakeProvider{ttl: tt.ttl}
+		withAuthProvider(t, provider)
+		first, err := bearerToken("api-key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := bearerToken("api-key"); again != first || provider.minted != 1 {
+			t.Errorf("%s: second request got %q after %d mint(s), want the cached %q", tt.name, again, provider.minted, first)
+		}
+		authToken.Lock()
+		left := time.Until(authToken.expires)
+		authToken.Unlock()
+		if left > tt.expires || left < tt.expires-time.Second {
+			t.Errorf("%s: token cached for %v, want %v", tt.name, left, tt.expires)
+		}
+
+		RejectAuthToken()
+		if next, _ := bearerToken("api-key"); next == first || provider.minted != 2 {
+			t.Errorf("%s: after rejection got %q, want a new token", tt.name, next)
+		}
+	}
+
+	withAuthProvider(t, &fakeProvider{err: errors.New("endpoint down")})
+	if _, err := bearerToken("api-key"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("provider failure gave %v, want ErrAuthFailed", err)
+	}
+}
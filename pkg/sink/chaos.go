@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// uploadChaos makes uploads fail on purpose, see SetUploadChaos
+var uploadChaos = struct {
+	sync.Mutex
+	errorPercent int
+	lostPercent  int
+	rng          *rand.Rand
+}{}
+
+// SetUploadChaos makes the HTTP upload sinks (API, GraphQL, SOAP and template sinks) fail a
+// share of their requests, so retries and buffering can be tested against a healthy backend:
+// errorPercent percent are answered with a 500 without being sent, and lostPercent percent
+// are delivered but their response is cut off, as when the connection drops mid-response,
+// so the batch is sent again. Zero percentages turn it off.
+func SetUploadChaos(errorPercent, lostPercent int, seed int64) {
+	uploadChaos.Lock()
+	defer uploadChaos.Unlock()
+	uploadChaos.errorPercent, uploadChaos.lostPercent = errorPercent, lostPercent
+	uploadChaos.rng = rand.New(rand.NewSource(seed))
+}
+
+// uploadTransport returns the transport of upload requests: the default one, or one that
+// injects failures when SetUploadChaos turned them on
+func uploadTransport() http.RoundTripper {
+	uploadChaos.Lock()
+	defer uploadChaos.Unlock()
+	if uploadChaos.errorPercent == 0 && uploadChaos.lostPercent == 0 {
+		return http.DefaultTransport
+	}
+	return chaosTransport{}
+}
+
+// chaosTransport rolls for each request whether it fails, and how
+type chaosTransport struct{}
+
+func (chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	uploadChaos.Lock()
+	roll := uploadChaos.rng.Intn(100)
+	serverError := roll < uploadChaos.errorPercent
+	lost := !serverError && roll < uploadChaos.errorPercent+uploadChaos.lostPercent
+	uploadChaos.Unlock()
+
+	if serverError {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return &http.Response{
+			Status: "500 Internal Server Error", StatusCode: http.StatusInternalServerError,
+			Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{},
+			Body:    io.NopCloser(strings.NewReader("injected server error (CHAOS)")),
+			Request: req,
+		}, nil
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || !lost {
+		return resp, err
+	}
+	resp.Body.Close()
+	return nil, errors.New("injected lost response (CHAOS)")
+}
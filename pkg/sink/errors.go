@@ -0,0 +1,14 @@
+package sink
+
+import "errors"
+
+var (
+	// ErrAuthFailed means the API refused the collector's credentials (HTTP 401 or 403)
+	ErrAuthFailed = errors.New("API authentication failed")
+	// ErrAPIRejected means the API answered with any other non-2xx status
+	ErrAPIRejected = errors.New("API rejected the request")
+	// ErrArchiveFull means the archive directory reached its size limit under the stop policy
+	ErrArchiveFull = errors.New("archive is full")
+	// ErrSigningKey means SIGNING_KEY or SIGNING_KEY_FILE is set but holds no usable key
+	ErrSigningKey = errors.New("invalid signing key")
+)
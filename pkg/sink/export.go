@@ -0,0 +1,282 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"old-attendance/pkg/zk"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportColumn is one column of a text export: a v2 record field such as employee_id or
+// timestamp, or a fixed value
+type ExportColumn struct {
+	Field      string `json:"field,omitempty"`
+	Value      string `json:"value,omitempty"`       // Written on every line instead of a field
+	Header     string `json:"header,omitempty"`      // Name in the header line, the field name when empty
+	Width      int    `json:"width,omitempty"`       // Characters in a fixed-width file
+	Align      string `json:"align,omitempty"`       // "left" (default) or "right" within the width
+	Pad        string `json:"pad,omitempty"`         // Fills the width, a space when empty; "0" zero-pads IDs
+	DateFormat string `json:"date_format,omitempty"` // Go layout for timestamp and time, e.g. "02/01/2006"
+}
+
+// exportFields are the v2 record fields a column can hold
+var exportFields = map[string]bool{
+	"record_id": true, "employee_id": true, "timestamp": true, "time": true, "device_id": true,
+	"source": true, "reason": true, "flags": true, "modality": true, "card_number": true,
+	"shift": true, "status": true, "employee_name": true, "department": true,
+	"utc_offset": true, "device_time": true,
+}
+
+// Quoting modes of delimited exports
+const (
+	QuoteAuto = "auto" // Quote values holding the delimiter, a quote or a line break, as in CSV
+	QuoteAll  = "all"  // Quote every value
+	QuoteNone = "none" // Never quote; the delimiter is removed from values
+)
+
+// ExportFormat renders records as delimited or fixed-width text lines, as defined per payroll
+// vendor in an export formats file
+type ExportFormat struct {
+	Columns    []ExportColumn `json:"columns"`
+	Delimiter  string         `json:"delimiter,omitempty"`       // Between delimited columns, "," when empty; unused for fixed width
+	Header     bool           `json:"header,omitempty"`          // Start each file with a line of the column names
+	Quote      string         `json:"quote,omitempty"`           // QuoteAuto when empty
+	LineEnding string         `json:"line_ending,omitempty"`     // "lf" (default) or "crlf"
+	DateFormat string         `json:"date_format,omitempty"`     // Default Go layout of timestamp and time columns
+	FlagsSep   string         `json:"flags_separator,omitempty"` // Joins a record's flags, ";" when empty
+}
+
+// ParseExportColumns parses a column list such as "employee_id:8,timestamp:19,device_id".
+// Either every column has a width, for a fixed-width file, or none has.
+func ParseExportColumns(value string) ([]ExportColumn, error) {
+	var columns []ExportColumn
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		column := ExportColumn{Field: part}
+		if i := strings.Index(part, ":"); i >= 0 {
+			width, err := strconv.Atoi(strings.TrimSpace(part[i+1:]))
+			if err != nil || width <= 0 {
+				return nil, fmt.Errorf("invalid column width in %q", part)
+			}
+			column = ExportColumn{Field: strings.TrimSpace(part[:i]), Width: width}
+		}
+		columns = append(columns, column)
+	}
+	if err := (ExportFormat{Columns: columns}).Validate(); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+// ParseExportFormats parses an export formats file: a JSON object of formats by name, e.g.
+// {"payroll": {"delimiter": ";", "header": true, "columns": [{"field": "employee_id",
+// "header": "EmpNo"}, {"field": "timestamp", "header": "Date", "date_format": "02.01.2006"}]}}
+func ParseExportFormats(data []byte) (map[string]ExportFormat, error) {
+	var formats map[string]ExportFormat
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&formats); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := formats[name].Validate(); err != nil {
+			return nil, fmt.Errorf("format %q: %w", name, err)
+		}
+	}
+	return formats, nil
+}
+
+// Validate checks the columns and options of a format
+func (f ExportFormat) Validate() error {
+	if len(f.Columns) == 0 {
+		return fmt.Errorf("no columns")
+	}
+	widths := 0
+	for _, column := range f.Columns {
+		name := column.Field
+		switch {
+		case column.Field != "" && column.Value != "":
+			return fmt.Errorf("column %q has both a field and a value", column.Field)
+		case column.Field == "" && column.Value == "":
+			return fmt.Errorf("a column needs a field or a value")
+		case column.Field != "" && !exportFields[column.Field]:
+			return fmt.Errorf("unknown column %q", column.Field)
+		case column.Field == "":
+			name = column.Value
+		}
+		if column.Width < 0 {
+			return fmt.Errorf("column %q: negative width", name)
+		}
+		if column.Width > 0 {
+			widths++
+		}
+		if column.Align != "" && column.Align != "left" && column.Align != "right" {
+			return fmt.Errorf("column %q: align must be left or right", name)
+		}
+		if len([]rune(column.Pad)) > 1 {
+			return fmt.Errorf("column %q: pad must be one character", name)
+		}
+		if column.DateFormat != "" && column.Field != "timestamp" && column.Field != "time" {
+			return fmt.Errorf("column %q: date_format only applies to timestamp and time", name)
+		}
+	}
+	if widths > 0 && widths < len(f.Columns) {
+		return fmt.Errorf("either every column needs a width, for a fixed-width file, or none")
+	}
+	switch f.Quote {
+	case "", QuoteAuto, QuoteAll, QuoteNone:
+	default:
+		return fmt.Errorf("quote must be auto, all or none")
+	}
+	switch f.LineEnding {
+	case "", "lf", "crlf":
+	default:
+		return fmt.Errorf("line_ending must be lf or crlf")
+	}
+	return nil
+}
+
+// fixedWidth reports whether the format is fixed width
+func (f ExportFormat) fixedWidth() bool {
+	return len(f.Columns) > 0 && f.Columns[0].Width > 0
+}
+
+// newline returns the line break of the format
+func (f ExportFormat) newline() string {
+	if f.LineEnding == "crlf" {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// line joins the values of one line, with its line break. Header lines are padded with
+// spaces whatever the columns' pad.
+func (f ExportFormat) line(values []string, header bool) string {
+	if f.fixedWidth() {
+		var b strings.Builder
+		for i, value := range values {
+			column := f.Columns[i]
+			runes := []rune(value)
+			if len(runes) > column.Width {
+				runes = runes[:column.Width]
+			}
+			pad := column.Pad
+			if pad == "" || header {
+				pad = " "
+			}
+			fill := strings.Repeat(pad, column.Width-len(runes))
+			if column.Align == "right" {
+				b.WriteString(fill)
+				b.WriteString(string(runes))
+			} else {
+				b.WriteString(string(runes))
+				b.WriteString(fill)
+			}
+		}
+		return b.String() + f.newline()
+	}
+	delimiter := f.Delimiter
+	if delimiter == "" {
+		delimiter = ","
+	}
+	for i, value := range values {
+		switch f.Quote {
+		case QuoteAll:
+			values[i] = `"` + strings.Replace(value, `"`, `""`, -1) + `"`
+		case QuoteNone:
+			values[i] = strings.NewReplacer(delimiter, " ", "\r", " ", "\n", " ").Replace(value)
+		default:
+			if strings.Contains(value, delimiter) || strings.ContainsAny(value, "\"\r\n") {
+				values[i] = `"` + strings.Replace(value, `"`, `""`, -1) + `"`
+			}
+		}
+	}
+	return strings.Join(values, delimiter) + f.newline()
+}
+
+// HeaderLine returns the line of column names, with its line break
+func (f ExportFormat) HeaderLine() []byte {
+	names := make([]string, len(f.Columns))
+	for i, column := range f.Columns {
+		switch {
+		case column.Header != "":
+			names[i] = column.Header
+		case column.Field != "":
+			names[i] = column.Field
+		}
+	}
+	return []byte(f.line(names, true))
+}
+
+// value returns the text of a column for a record's fields
+func (f ExportFormat) value(column ExportColumn, fields map[string]interface{}) (string, error) {
+	if column.Field == "" {
+		return column.Value, nil
+	}
+	switch value := fields[column.Field].(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		sep := f.FlagsSep
+		if sep == "" {
+			sep = ";"
+		}
+		parts := make([]string, len(value))
+		for i, v := range value {
+			parts[i] = fmt.Sprint(v)
+		}
+		return strings.Join(parts, sep), nil
+	default:
+		text := fmt.Sprint(value)
+		layout := column.DateFormat
+		if layout == "" {
+			layout = f.DateFormat
+		}
+		if layout == "" || text == "" || (column.Field != "timestamp" && column.Field != "time") {
+			return text, nil
+		}
+		var t time.Time
+		var err error
+		if column.Field == "time" {
+			t, err = time.Parse(time.RFC3339, text)
+		} else {
+			t, err = time.ParseInLocation(zk.TimestampLayout, text, time.Local)
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid %s %q: %w", column.Field, text, err)
+		}
+		return t.Format(layout), nil
+	}
+}
+
+// Render returns a line per record. Flags are joined with FlagsSep, ";" by default, and
+// fields a record doesn't have are left empty.
+func (f ExportFormat) Render(logs []zk.AttendanceRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, record := range logs {
+		fields, err := recordFields(record)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]string, len(f.Columns))
+		for i, column := range f.Columns {
+			if values[i], err = f.value(column, fields); err != nil {
+				return nil, err
+			}
+		}
+		buf.WriteString(f.line(values, false))
+	}
+	return buf.Bytes(), nil
+}
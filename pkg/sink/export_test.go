@@ -0,0 +1,147 @@
+package sink
+
+import (
+	"testing"
+
+	"old-attendance/pkg/zk"
+)
+
+func TestParseExportColumns(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []ExportColumn
+		wantErr bool
+	}{
+		{"employee_id,timestamp", []ExportColumn{{Field: "employee_id"}, {Field: "timestamp"}}, false},
+		{" employee_id : 8 , timestamp:19,", []ExportColumn{{Field: "employee_id", Width: 8}, {Field: "timestamp", Width: 19}}, false},
+		{"", nil, true},
+		{"employee_id:0", nil, true},
+		{"employee_id:wide", nil, true},
+		{"employee_id:8,timestamp", nil, true},
+		{"salary", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseExportColumns(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseExportColumns(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseExportColumns(%q) = %+v, want %+v", tt.value, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseExportColumns(%q) = %+v, want %+v", tt.value, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseExportFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"valid", `{"payroll": {"delimiter": ";", "header": true, "columns": [{"field": "employee_id", "header": "EmpNo"}, {"field": "timestamp", "date_format": "02.01.2006"}]}}`, false},
+		{"fixed width", `{"bank": {"columns": [{"field": "employee_id", "width": 6, "align": "right", "pad": "0"}, {"value": "IN", "width": 2}]}}`, false},
+		{"not JSON", `payroll: employee_id`, true},
+		{"unknown option", `{"payroll": {"columns": [{"field": "employee_id"}], "seperator": ";"}}`, true},
+		{"no columns", `{"payroll": {"delimiter": ";"}}`, true},
+		{"unknown field", `{"payroll": {"columns": [{"field": "salary"}]}}`, true},
+		{"field and value", `{"payroll": {"columns": [{"field": "employee_id", "value": "1"}]}}`, true},
+		{"neither field nor value", `{"payroll": {"columns": [{"header": "Empty"}]}}`, true},
+		{"some widths", `{"payroll": {"columns": [{"field": "employee_id", "width": 6}, {"field": "timestamp"}]}}`, true},
+		{"negative width", `{"payroll": {"columns": [{"field": "employee_id", "width": -1}]}}`, true},
+		{"align", `{"payroll": {"columns": [{"field": "employee_id", "align": "center"}]}}`, true},
+		{"long pad", `{"payroll": {"columns": [{"field": "employee_id", "pad": "00"}]}}`, true},
+		{"date format on an ID", `{"payroll": {"columns": [{"field": "employee_id", "date_format": "2006"}]}}`, true},
+		{"quote", `{"payroll": {"quote": "some", "columns": [{"field": "employee_id"}]}}`, true},
+		{"line ending", `{"payroll": {"line_ending": "cr", "columns": [{"field": "employee_id"}]}}`, true},
+	}
+	for _, tt := range tests {
+		if _, err := ParseExportFormats([]byte(tt.data)); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExportFormatRender(t *testing.T) {
+	record := zk.AttendanceRecord{UserID: 42, Timestamp: "2024-03-01T09:05:07", DeviceID: "gate", Flags: []string{"late_punch", "manual_review"}}
+	named := record
+	named.EmployeeName = `Rahim "Ray" Uddin, Jr.`
+	cols := func(fields ...string) []ExportColumn {
+		columns := make([]ExportColumn, len(fields))
+		for i, field := range fields {
+			columns[i] = ExportColumn{Field: field}
+		}
+		return columns
+	}
+
+	tests := []struct {
+		name   string
+		format ExportFormat
+		record zk.AttendanceRecord
+		header string
+		line   string
+	}{
+		{"default delimiter", ExportFormat{Columns: cols("employee_id", "timestamp", "device_id")}, record,
+			"employee_id,timestamp,device_id\n", "42,2024-03-01T09:05:07,gate\n"},
+		{"delimiter and header names", ExportFormat{Delimiter: ";", Columns: []ExportColumn{{Field: "employee_id", Header: "EmpNo"}, {Field: "device_id"}}}, record,
+			"EmpNo;device_id\n", "42;gate\n"},
+		{"tab delimiter", ExportFormat{Delimiter: "\t", Columns: cols("employee_id", "device_id")}, record,
+			"employee_id\tdevice_id\n", "42\tgate\n"},
+		{"CRLF", ExportFormat{LineEnding: "crlf", Columns: cols("employee_id")}, record,
+			"employee_id\r\n", "42\r\n"},
+		{"fixed value", ExportFormat{Columns: []ExportColumn{{Value: "IN"}, {Field: "employee_id"}}}, record,
+			",employee_id\n", "IN,42\n"},
+		{"quoted when needed", ExportFormat{Columns: cols("employee_id", "employee_name")}, named,
+			"employee_id,employee_name\n", `42,"Rahim ""Ray"" Uddin, Jr."` + "\n"},
+		{"quote all", ExportFormat{Quote: QuoteAll, Columns: cols("employee_id", "employee_name")}, named,
+			`"employee_id","employee_name"` + "\n", `"42","Rahim ""Ray"" Uddin, Jr."` + "\n"},
+		{"quote none", ExportFormat{Quote: QuoteNone, Columns: cols("employee_id", "employee_name")}, named,
+			"employee_id,employee_name\n", `42,Rahim "Ray" Uddin  Jr.` + "\n"},
+		{"flags", ExportFormat{Columns: cols("flags")}, record, "flags\n", "late_punch;manual_review\n"},
+		{"flags separator", ExportFormat{FlagsSep: "|", Columns: cols("flags")}, record, "flags\n", "late_punch|manual_review\n"},
+		{"missing field", ExportFormat{Columns: cols("employee_id", "department", "shift")}, record,
+			"employee_id,department,shift\n", "42,,\n"},
+		{"format date", ExportFormat{DateFormat: "02/01/2006 15:04", Columns: cols("timestamp")}, record,
+			"timestamp\n", "01/03/2024 09:05\n"},
+		{"column date over the format's", ExportFormat{DateFormat: "02/01/2006", Columns: []ExportColumn{{Field: "timestamp", DateFormat: "2006-01-02"}, {Field: "timestamp", Header: "Clock", DateFormat: "15:04:05"}}}, record,
+			"timestamp,Clock\n", "2024-03-01,09:05:07\n"},
+		{"fixed width", ExportFormat{Columns: []ExportColumn{{Field: "employee_id", Width: 6}, {Field: "device_id", Width: 6}}}, record,
+			"employdevice\n", "42    gate  \n"},
+		{"fixed width right-aligned and zero-padded", ExportFormat{Columns: []ExportColumn{{Field: "employee_id", Header: "ID", Width: 6, Align: "right", Pad: "0"}, {Value: "IN", Width: 3}}}, record,
+			"    ID   \n", "000042IN \n"},
+		{"fixed width truncated", ExportFormat{Columns: []ExportColumn{{Field: "employee_name", Width: 5}}}, named,
+			"emplo\n", "Rahim\n"},
+		{"fixed width ignores delimiters and quotes", ExportFormat{Delimiter: ";", Quote: QuoteAll, Columns: []ExportColumn{{Field: "employee_name", Width: 12}}}, named,
+			"employee_nam\n", `Rahim "Ray" ` + "\n"},
+	}
+	for _, tt := range tests {
+		if err := tt.format.Validate(); err != nil {
+			t.Errorf("%s: invalid format: %v", tt.name, err)
+			continue
+		}
+		if header := string(tt.format.HeaderLine()); header != tt.header {
+			t.Errorf("%s: header %q, want %q", tt.name, header, tt.header)
+		}
+		line, err := tt.format.Render([]zk.AttendanceRecord{tt.record})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(line) != tt.line {
+			t.Errorf("%s: line %q, want %q", tt.name, line, tt.line)
+		}
+	}
+
+	// A timestamp that can't be parsed for a date format fails the export
+	broken := record
+	broken.Timestamp = "yesterday"
+	if _, err := (ExportFormat{DateFormat: "02/01/2006", Columns: cols("timestamp")}).Render([]zk.AttendanceRecord{broken}); err == nil {
+		t.Error("rendered an unparsable timestamp with a date format, want an error")
+	}
+}
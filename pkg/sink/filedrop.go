@@ -0,0 +1,305 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"old-attendance/pkg/zk"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// File of the FileDropSink directory collecting records until the next upload
+	fileDropPending = "pending.txt"
+	// Subdirectory holding files named for upload, kept until they are uploaded
+	fileDropOutbox = "outbox"
+	// Suffix of files while they are uploaded, so the vendor never picks up half a file
+	partialSuffix = ".part"
+)
+
+// fileDropMu serializes appends to the pending file with moving it to the outbox
+var fileDropMu sync.Mutex
+
+// FileDropSink collects records as text lines in a local directory, for UploadFileDrop to
+// upload as one file per schedule. Records count as delivered once collected.
+type FileDropSink struct {
+	Dir    string
+	Format ExportFormat
+}
+
+func (s *FileDropSink) Name() string { return "filedrop" }
+
+// Send appends the records to the pending file, starting it with a header line when the
+// format has one
+func (s *FileDropSink) Send(logs []zk.AttendanceRecord) error {
+	lines, err := s.Format.Render(logs)
+	if err != nil {
+		return fmt.Errorf("failed to render file drop records: %w", err)
+	}
+	fileDropMu.Lock()
+	defer fileDropMu.Unlock()
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create file drop directory: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(s.Dir, fileDropPending), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file drop: %w", err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() == 0 && s.Format.Header {
+		lines = append(s.Format.HeaderLine(), lines...)
+	}
+	if _, err := f.Write(lines); err != nil {
+		return fmt.Errorf("failed to write file drop: %w", err)
+	}
+	return f.Sync()
+}
+
+// FileDropTarget is where files are uploaded: sftp://user@host[:port]/dir, uploaded with the
+// OpenSSH sftp client and key authentication, or ftp:// or ftps:// (explicit TLS) with a
+// password
+type FileDropTarget struct {
+	URL      *url.URL
+	Password string // FTP password when the URL has none
+	SSHKey   string // Private key file for SFTP, the ssh defaults when empty
+}
+
+// UploadFileDrop moves the pending records of dir to a file called name and uploads every
+// file waiting in the outbox, oldest first. Files are removed once uploaded, and left for
+// the next call when an upload fails. It returns the names uploaded.
+func UploadFileDrop(dir, name string, target FileDropTarget) ([]string, error) {
+	outbox := filepath.Join(dir, fileDropOutbox)
+	fileDropMu.Lock()
+	pending := filepath.Join(dir, fileDropPending)
+	if info, err := os.Stat(pending); err == nil && info.Size() > 0 {
+		if err := os.MkdirAll(outbox, 0755); err != nil {
+			fileDropMu.Unlock()
+			return nil, fmt.Errorf("failed to create file drop outbox: %w", err)
+		}
+		if err := os.Rename(pending, filepath.Join(outbox, name)); err != nil {
+			fileDropMu.Unlock()
+			return nil, fmt.Errorf("failed to move file drop to the outbox: %w", err)
+		}
+	}
+	fileDropMu.Unlock()
+
+	entries, err := os.ReadDir(outbox)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read file drop outbox: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	var uploaded []string
+	for _, file := range names {
+		local := filepath.Join(outbox, file)
+		if err := uploadFile(target, local, file); err != nil {
+			return uploaded, fmt.Errorf("failed to upload %s: %w", file, err)
+		}
+		if err := os.Remove(local); err != nil {
+			return uploaded, fmt.Errorf("failed to remove uploaded %s: %w", file, err)
+		}
+		uploaded = append(uploaded, file)
+	}
+	return uploaded, nil
+}
+
+// uploadFile uploads a local file to the target as name
+func uploadFile(target FileDropTarget, local, name string) error {
+	switch target.URL.Scheme {
+	case "sftp":
+		return sftpUpload(target, local, name)
+	case "ftp", "ftps":
+		data, err := os.ReadFile(local)
+		if err != nil {
+			return err
+		}
+		return ftpUpload(target, data, name)
+	default:
+		return fmt.Errorf("unsupported file drop scheme %q, use sftp, ftp or ftps", target.URL.Scheme)
+	}
+}
+
+// sftpUpload runs the OpenSSH sftp client in batch mode, which needs key authentication
+func sftpUpload(target FileDropTarget, local, name string) error {
+	u := target.URL
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if port := u.Port(); port != "" {
+		args = append(args, "-P", port)
+	}
+	if target.SSHKey != "" {
+		args = append(args, "-i", target.SSHKey)
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	args = append(args, host)
+
+	var batch bytes.Buffer
+	if dir := strings.TrimPrefix(u.Path, "/"); dir != "" {
+		fmt.Fprintf(&batch, "cd %s\n", strconv.Quote(dir))
+	}
+	fmt.Fprintf(&batch, "put %s %s\n", strconv.Quote(local), strconv.Quote(name+partialSuffix))
+	fmt.Fprintf(&batch, "rename %s %s\n", strconv.Quote(name+partialSuffix), strconv.Quote(name))
+
+	cmd := exec.Command("sftp", args...)
+	cmd.Stdin = &batch
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sftp: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ftpConn is an FTP control connection
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+	tls  *tls.Config // Set once the connection is protected with AUTH TLS
+}
+
+// cmd sends a command and reads its reply, which must have the expected code (a prefix such
+// as 2 for any 2xx)
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	_, msg, err := c.text.ReadResponse(expect)
+	return msg, err
+}
+
+// passive opens a data connection with PASV. The address in the reply is ignored for the
+// control connection's, which works behind NAT.
+func (c *ftpConn) passive() (net.Conn, error) {
+	msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return nil, err
+	}
+	start, end := strings.Index(msg, "("), strings.Index(msg, ")")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("unexpected PASV reply %q", msg)
+	}
+	parts := strings.Split(msg[start+1:end], ",")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("unexpected PASV reply %q", msg)
+	}
+	hi, err1 := strconv.Atoi(strings.TrimSpace(parts[4]))
+	lo, err2 := strconv.Atoi(strings.TrimSpace(parts[5]))
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("unexpected PASV reply %q", msg)
+	}
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	data, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(hi<<8|lo)), 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if c.tls != nil {
+		data = tls.Client(data, c.tls)
+	}
+	return data, nil
+}
+
+// ftpUpload stores data as name under the URL's directory, through a partial name renamed
+// once complete. ftps upgrades the connection with AUTH TLS and protects the data channel.
+func ftpUpload(target FileDropTarget, data []byte, name string) error {
+	u := target.URL
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(uploadTimeout(2*time.Minute, len(data))))
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	defer c.text.Close()
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return err
+	}
+
+	if u.Scheme == "ftps" {
+		if _, err := c.cmd(234, "AUTH TLS"); err != nil {
+			return fmt.Errorf("AUTH TLS: %w", err)
+		}
+		// The data connections resume the control connection's session, which servers
+		// commonly require
+		c.tls = &tls.Config{ServerName: u.Hostname(), ClientSessionCache: tls.NewLRUClientSessionCache(4)}
+		c.conn = tls.Client(conn, c.tls)
+		c.text = textproto.NewConn(c.conn)
+		if _, err := c.cmd(200, "PBSZ 0"); err != nil {
+			return fmt.Errorf("PBSZ: %w", err)
+		}
+		if _, err := c.cmd(200, "PROT P"); err != nil {
+			return fmt.Errorf("PROT: %w", err)
+		}
+	}
+
+	user, password := "anonymous", target.Password
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	// 331 asks for the password; 230 logs in without one
+	if _, err := c.cmd(3, "USER %s", user); err != nil {
+		if e, ok := err.(*textproto.Error); !ok || e.Code != 230 {
+			return fmt.Errorf("%w: login: %v", ErrAuthFailed, err)
+		}
+	} else if _, err := c.cmd(230, "PASS %s", password); err != nil {
+		return fmt.Errorf("%w: login: %v", ErrAuthFailed, err)
+	}
+	if _, err := c.cmd(200, "TYPE I"); err != nil {
+		return err
+	}
+	if dir := path.Clean("/" + u.Path); dir != "/" {
+		if _, err := c.cmd(250, "CWD %s", strings.TrimPrefix(dir, "/")); err != nil {
+			return fmt.Errorf("CWD: %w", err)
+		}
+	}
+
+	dataConn, err := c.passive()
+	if err != nil {
+		return err
+	}
+	if _, err := c.cmd(1, "STOR %s", name+partialSuffix); err != nil {
+		dataConn.Close()
+		return fmt.Errorf("STOR: %w", err)
+	}
+	_, err = io.Copy(dataConn, throttle(bytes.NewReader(data)))
+	if closeErr := dataConn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		return fmt.Errorf("STOR: %w", err)
+	}
+	if _, err := c.cmd(350, "RNFR %s", name+partialSuffix); err != nil {
+		return fmt.Errorf("RNFR: %w", err)
+	}
+	if _, err := c.cmd(250, "RNTO %s", name); err != nil {
+		return fmt.Errorf("RNTO: %w", err)
+	}
+	c.cmd(221, "QUIT")
+	return nil
+}
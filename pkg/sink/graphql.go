@@ -0,0 +1,195 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default number of records per GraphQL mutation
+const defaultGraphQLBatchSize = 100
+
+// Values a GraphQL variable can be mapped to, see GraphQLSink.Variables
+var graphQLSources = map[string]bool{
+	"records": true, "org_id": true, "sync_id": true, "batch_id": true, "count": true,
+}
+
+// GraphQLSink sends records to a GraphQL endpoint with a configured mutation
+type GraphQLSink struct {
+	URL, APIKey, OrgID string
+	Query              string // The mutation document
+	// Variables maps each variable of the mutation to what it carries: "records" (the list of
+	// records), "org_id", "sync_id", "batch_id" or "count". Defaults to {"records": "records"}.
+	Variables map[string]string
+	// Fields maps the input field names of a record to v2 payload fields such as employee_id
+	// or record_id. Nil sends every v2 field under its own name.
+	Fields map[string]string
+	// Records per mutation, defaultGraphQLBatchSize when zero. Larger deliveries are sent as
+	// several mutations; a failure after the first resends the earlier ones on retry, which
+	// the backend can deduplicate by record_id.
+	BatchSize int
+}
+
+func (s *GraphQLSink) Name() string { return "graphql" }
+
+func (s *GraphQLSink) Send(logs []zk.AttendanceRecord) error {
+	return s.SendBatch(Batch{Logs: logs})
+}
+
+// SendBatch sends the records in mutations of BatchSize records
+func (s *GraphQLSink) SendBatch(batch Batch) error {
+	size := s.BatchSize
+	if size <= 0 {
+		size = defaultGraphQLBatchSize
+	}
+	for start := 0; start < len(batch.Logs); start += size {
+		end := start + size
+		if end > len(batch.Logs) {
+			end = len(batch.Logs)
+		}
+		chunk := batch
+		chunk.Logs = batch.Logs[start:end]
+		if err := s.mutate(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mutate sends one mutation. GraphQL servers report failures in the errors array of a 200
+// response, which counts as a rejection like a non-2xx status.
+func (s *GraphQLSink) mutate(batch Batch) error {
+	records := make([]map[string]interface{}, len(batch.Logs))
+	for i, record := range batch.Logs {
+		input, err := s.recordInput(record)
+		if err != nil {
+			return err
+		}
+		records[i] = input
+	}
+	variables := s.Variables
+	if len(variables) == 0 {
+		variables = map[string]string{"records": "records"}
+	}
+	values := map[string]interface{}{}
+	for name, source := range variables {
+		switch source {
+		case "records":
+			values[name] = records
+		case "org_id":
+			values[name] = s.OrgID
+		case "sync_id":
+			values[name] = batch.SyncID
+		case "batch_id":
+			values[name] = batch.BatchID
+		case "count":
+			values[name] = len(records)
+		default:
+			return fmt.Errorf("GraphQL variable %s maps to unknown value %q", name, source)
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{"query": s.Query, "variables": values})
+	if err != nil {
+		return fmt.Errorf("failed to marshal GraphQL request: %w", err)
+	}
+
+	req, err := NewAPIRequest("POST", s.URL, body, s.APIKey)
+	if err != nil {
+		return err
+	}
+	if batch.SyncID != "" {
+		req.Header.Set(syncIDHeader, batch.SyncID)
+	}
+	if batch.BatchID != "" {
+		req.Header.Set(batchIDHeader, batch.BatchID)
+	}
+	req.Body = io.NopCloser(throttle(bytes.NewReader(body)))
+	client := &http.Client{Timeout: uploadTimeout(45*time.Second, len(body)), Transport: uploadTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute GraphQL request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return statusError(resp.StatusCode, respBody)
+	}
+
+	var result struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("%w: invalid GraphQL response: %v", ErrAPIRejected, err)
+	}
+	if len(result.Errors) > 0 {
+		messages := make([]string, len(result.Errors))
+		for i, e := range result.Errors {
+			messages[i] = e.Message
+		}
+		return fmt.Errorf("%w: GraphQL errors: %s", ErrAPIRejected, strings.Join(messages, "; "))
+	}
+	log.Printf("GraphQL mutation successful (%d record(s))", len(records))
+	return nil
+}
+
+// recordInput builds the input object of one record from its v2 fields
+func (s *GraphQLSink) recordInput(record zk.AttendanceRecord) (map[string]interface{}, error) {
+	r, err := newRecordV2(record)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if s.Fields == nil {
+		return fields, nil
+	}
+	input := make(map[string]interface{}, len(s.Fields))
+	for name, field := range s.Fields {
+		if value, ok := fields[field]; ok {
+			input[name] = value
+		}
+	}
+	return input, nil
+}
+
+// ParseGraphQLMapping parses a GRAPHQL_VARIABLES or GRAPHQL_FIELDS value, a JSON object of
+// names to sources. With variables set, the sources are checked against the supported ones.
+func ParseGraphQLMapping(value string, variables bool) (map[string]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	var mapping map[string]string
+	if err := json.Unmarshal([]byte(value), &mapping); err != nil {
+		return nil, fmt.Errorf("expected a JSON object of strings: %w", err)
+	}
+	if !variables {
+		return mapping, nil
+	}
+	var unknown []string
+	for name, source := range mapping {
+		if !graphQLSources[source] {
+			unknown = append(unknown, fmt.Sprintf("%s=%q", name, source))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown variable values %s", strings.Join(unknown, ", "))
+	}
+	return mapping, nil
+}
@@ -0,0 +1,170 @@
+package sink
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSON payload versions, sent in the X-Payload-Version header
+const (
+	PayloadV1 = 1 // Bare array of records, see schema/attendance.schema.json
+	PayloadV2 = 2 // Envelope with batch metadata and richer records, see schema/attendance.v2.schema.json
+)
+
+const payloadVersionHeader = "X-Payload-Version"
+
+// recordV2 is an attendance record in the v2 payload
+type recordV2 struct {
+	RecordID   string   `json:"record_id"` // Hex leaf hash of the record, stable across retries
+	EmployeeID int      `json:"employee_id"`
+	Timestamp  string   `json:"timestamp"`      // Device local time, as in v1
+	Time       string   `json:"time,omitempty"` // The same instant in RFC 3339 with the UTC offset
+	UTCOffset  string   `json:"utc_offset,omitempty"`
+	DeviceTime string   `json:"device_time,omitempty"` // Timestamp before clock correction
+	DeviceID   string   `json:"device_id,omitempty"`
+	Source     string   `json:"source"` // "device" or "manual"
+	Reason     string   `json:"reason,omitempty"`
+	Flags      []string `json:"flags,omitempty"`
+	Modality   string   `json:"modality,omitempty"`
+	CardNumber string   `json:"card_number,omitempty"`
+	Shift      string   `json:"shift,omitempty"`
+	Status     string   `json:"status,omitempty"` // "on_time", "late" or "early_leave"
+
+	// From the lookup API, for sinks that show people rather than IDs
+	EmployeeName string `json:"employee_name,omitempty"`
+	Department   string `json:"department,omitempty"`
+}
+
+// payloadV2 is the v2 upload body
+type payloadV2 struct {
+	Version int        `json:"version"`
+	OrgID   string     `json:"org_id"`
+	SyncID  string     `json:"sync_id,omitempty"`
+	BatchID string     `json:"batch_id,omitempty"`
+	SentAt  string     `json:"sent_at"`
+	Records []recordV2 `json:"records"`
+	// Status of the devices the records come from
+	DeviceStatus []DeviceStatus `json:"device_status,omitempty"`
+}
+
+// marshalPayloadJSON encodes a batch in the given payload version
+func marshalPayloadJSON(batch Batch, orgID string, version int) ([]byte, error) {
+	if version != PayloadV2 {
+		return json.Marshal(batch.Logs)
+	}
+	payload := payloadV2{
+		Version: PayloadV2,
+		OrgID:   orgID,
+		SyncID:  batch.SyncID,
+		BatchID: batch.BatchID,
+		SentAt:  time.Now().Format(time.RFC3339),
+		Records: make([]recordV2, len(batch.Logs)),
+
+		DeviceStatus: batch.Devices,
+	}
+	for i, record := range batch.Logs {
+		r, err := newRecordV2(record)
+		if err != nil {
+			return nil, err
+		}
+		payload.Records[i] = r
+	}
+	return json.Marshal(payload)
+}
+
+// newRecordV2 converts a record to its v2 form
+func newRecordV2(record zk.AttendanceRecord) (recordV2, error) {
+	leaf, err := zk.LeafHash(record)
+	if err != nil {
+		return recordV2{}, err
+	}
+	r := recordV2{
+		RecordID:     hex.EncodeToString(leaf),
+		EmployeeID:   record.UserID,
+		Timestamp:    record.Timestamp,
+		UTCOffset:    record.UTCOffset,
+		DeviceTime:   record.DeviceTime,
+		DeviceID:     record.DeviceID,
+		Source:       "device",
+		Reason:       record.Reason,
+		Flags:        record.Flags,
+		Modality:     record.Modality,
+		CardNumber:   record.CardNumber,
+		Shift:        record.Shift,
+		Status:       record.Status,
+		EmployeeName: record.EmployeeName,
+		Department:   record.Department,
+	}
+	if record.UTCOffset != "" {
+		r.Time = record.Timestamp + record.UTCOffset
+	} else if t, err := record.Time(); err == nil {
+		r.Time = t.Format(time.RFC3339)
+	}
+	if record.Manual {
+		r.Source = "manual"
+	}
+	return r, nil
+}
+
+// ParsePayloadVersion parses an API_PAYLOAD_VERSION value, "1" or "2", defaulting to v1
+func ParsePayloadVersion(value string) (int, error) {
+	value = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), "v")
+	if value == "" {
+		return PayloadV1, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || (version != PayloadV1 && version != PayloadV2) {
+		return PayloadV1, fmt.Errorf("unsupported payload version %q", value)
+	}
+	return version, nil
+}
+
+// negotiatedVersions holds the payload version each endpoint asked for instead of the
+// configured one, for the rest of the process
+var negotiatedVersions = struct {
+	sync.Mutex
+	byURL map[string]int
+}{byURL: map[string]int{}}
+
+// payloadVersionFor returns the version to send to url: the negotiated one if any
+func payloadVersionFor(url string, configured int) int {
+	negotiatedVersions.Lock()
+	defer negotiatedVersions.Unlock()
+	if version, ok := negotiatedVersions.byURL[url]; ok {
+		return version
+	}
+	return configured
+}
+
+// negotiateVersion handles an endpoint rejecting a payload version. When the response lists
+// the versions it accepts in X-Payload-Version, the newest one this collector can send is
+// remembered for url and returned, to retry with.
+func negotiateVersion(url string, sent int, resp *http.Response) (int, bool) {
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusNotAcceptable, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+	default:
+		return 0, false
+	}
+	best := 0
+	for _, field := range strings.Split(resp.Header.Get(payloadVersionHeader), ",") {
+		if version, err := ParsePayloadVersion(field); err == nil && strings.TrimSpace(field) != "" && version > best {
+			best = version
+		}
+	}
+	if best == 0 || best == sent {
+		return 0, false
+	}
+	negotiatedVersions.Lock()
+	negotiatedVersions.byURL[url] = best
+	negotiatedVersions.Unlock()
+	log.Printf("API at %s does not accept payload v%d, switching to v%d", url, sent, best)
+	return best, true
+}
@@ -0,0 +1,105 @@
+package sink
+
+import (
+	"old-attendance/pkg/zk"
+)
+
+// Content type for API_FORMAT=protobuf uploads, encoded per schema/attendance.proto
+const protobufContentType = "application/x-protobuf"
+
+// Protobuf wire types used by the schema
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// marshalPayloadProto encodes an AttendancePayload as an attendance.v1.AttendancePayload message
+func marshalPayloadProto(payload AttendancePayload) []byte {
+	var b []byte
+	b = appendProtoString(b, 1, payload.OrgID)
+	for _, record := range payload.Logs {
+		b = appendProtoBytes(b, 2, marshalRecordProto(record))
+	}
+	for _, device := range payload.Devices {
+		b = appendProtoBytes(b, 3, marshalDeviceStatusProto(device))
+	}
+	return b
+}
+
+// marshalDeviceStatusProto encodes a device's status as an attendance.v1.DeviceStatus message
+func marshalDeviceStatusProto(device DeviceStatus) []byte {
+	var b []byte
+	b = appendProtoString(b, 1, device.DeviceID)
+	b = appendProtoString(b, 2, device.Serial)
+	b = appendProtoString(b, 3, device.FetchedAt)
+	b = appendProtoOptionalInt(b, 4, device.ClockDriftSeconds)
+	b = appendProtoOptionalInt(b, 5, device.Records)
+	b = appendProtoOptionalInt(b, 6, device.RecordCapacity)
+	return b
+}
+
+// appendProtoOptionalInt appends an optional int64 field, which is sent even when zero unless unset
+func appendProtoOptionalInt(b []byte, field int, n *int) []byte {
+	if n == nil {
+		return b
+	}
+	b = appendProtoTag(b, field, wireVarint)
+	return appendProtoVarint(b, uint64(int64(*n)))
+}
+
+// marshalRecordProto encodes a record as an attendance.v1.AttendanceRecord message
+func marshalRecordProto(record zk.AttendanceRecord) []byte {
+	var b []byte
+	if record.UserID != 0 {
+		b = appendProtoTag(b, 1, wireVarint)
+		b = appendProtoVarint(b, uint64(int64(record.UserID)))
+	}
+	b = appendProtoString(b, 2, record.Timestamp)
+	b = appendProtoString(b, 3, record.DeviceID)
+	if record.Manual {
+		b = appendProtoTag(b, 4, wireVarint)
+		b = appendProtoVarint(b, 1)
+	}
+	b = appendProtoString(b, 5, record.Reason)
+	for _, flag := range record.Flags {
+		b = appendProtoBytes(b, 6, []byte(flag))
+	}
+	b = appendProtoString(b, 7, record.Modality)
+	b = appendProtoString(b, 8, record.CardNumber)
+	b = appendProtoString(b, 9, record.Shift)
+	b = appendProtoString(b, 10, record.Status)
+	b = appendProtoString(b, 11, record.EmployeeName)
+	b = appendProtoString(b, 12, record.Department)
+	b = appendProtoString(b, 13, record.UTCOffset)
+	b = appendProtoString(b, 14, record.DeviceTime)
+	return b
+}
+
+// appendProtoTag appends a field key
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return appendProtoVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendProtoVarint appends v in base-128 varint encoding
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendProtoBytes appends a length-delimited field
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendProtoTag(b, field, wireBytes)
+	b = appendProtoVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendProtoString appends a string field, omitting it when empty as proto3 does
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendProtoBytes(b, field, []byte(s))
+}
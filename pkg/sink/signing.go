@@ -0,0 +1,88 @@
+package sink
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers carrying the detached payload signature
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureKeyIDHeader     = "X-Signature-Key-Id"
+)
+
+var signingKey struct {
+	once sync.Once
+	key  ed25519.PrivateKey
+	err  error
+}
+
+// loadSigningKey returns the Ed25519 key from SIGNING_KEY (base64 seed) or SIGNING_KEY_FILE,
+// or nil when signing isn't configured. A key that is configured but can't be read is an
+// error, so payloads are never sent unsigned to a backend expecting signatures.
+func loadSigningKey() (ed25519.PrivateKey, error) {
+	signingKey.once.Do(func() {
+		signingKey.key, signingKey.err = parseSigningKey(os.Getenv("SIGNING_KEY"), os.Getenv("SIGNING_KEY_FILE"))
+	})
+	return signingKey.key, signingKey.err
+}
+
+// parseSigningKey decodes the key given in encoded, or when that is empty in the file at path
+func parseSigningKey(encoded, path string) (ed25519.PrivateKey, error) {
+	if encoded == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading SIGNING_KEY_FILE: %v", ErrSigningKey, err)
+		}
+		encoded = string(data)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		if path != "" {
+			return nil, fmt.Errorf("%w: SIGNING_KEY_FILE %s is empty", ErrSigningKey, path)
+		}
+		return nil, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%w: expected a base64 %d-byte Ed25519 seed", ErrSigningKey, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// CheckSigningKey reports an error when a signing key is configured but unusable
+func CheckSigningKey() error {
+	_, err := loadSigningKey()
+	return err
+}
+
+// SigningKeyID identifies a public key by the first 16 hex digits of its SHA-256
+func SigningKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signRequest attaches a detached Ed25519 signature over "<unix timestamp>\n<body>" when a
+// signing key is configured. The timestamp lets the backend reject replayed requests.
+func signRequest(req *http.Request, body []byte) error {
+	key, err := loadSigningKey()
+	if key == nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	message := append([]byte(ts+"\n"), body...)
+	req.Header.Set(signatureTimestampHeader, ts)
+	req.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, message)))
+	req.Header.Set(signatureKeyIDHeader, SigningKeyID(key.Public().(ed25519.PublicKey)))
+	return nil
+}
@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSigningKey(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = 1
+	encoded := base64.StdEncoding.EncodeToString(seed)
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "signing.key")
+	if err := os.WriteFile(keyFile, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty.key")
+	if err := os.WriteFile(emptyFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+		path    string
+		wantKey bool
+		wantErr bool
+	}{
+		{"not configured", "", "", false, false},
+		{"key", encoded, "", true, false},
+		{"key file", "", keyFile, true, false},
+		{"key wins over file", encoded, filepath.Join(dir, "missing.key"), true, false},
+		{"malformed key", "not base64!", "", false, true},
+		{"short seed", base64.StdEncoding.EncodeToString(seed[:16]), "", false, true},
+		{"unreadable file", "", filepath.Join(dir, "missing.key"), false, true},
+		{"empty file", "", emptyFile, false, true},
+	}
+	for _, tt := range tests {
+		key, err := parseSigningKey(tt.encoded, tt.path)
+		if (key != nil) != tt.wantKey {
+			t.Errorf("%s: key = %v, want a key %v", tt.name, key, tt.wantKey)
+		}
+		if tt.wantErr != (err != nil) || (err != nil && !errors.Is(err, ErrSigningKey)) {
+			t.Errorf("%s: error = %v, want ErrSigningKey %v", tt.name, err, tt.wantErr)
+		}
+		if key != nil && !key.Equal(ed25519.NewKeyFromSeed(seed)) {
+			t.Errorf("%s: wrong key", tt.name)
+		}
+	}
+}
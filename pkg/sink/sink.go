@@ -0,0 +1,195 @@
+// Package sink delivers attendance records to their destinations
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"old-attendance/pkg/zk"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sink delivers batches of records to one destination
+type Sink interface {
+	Name() string
+	Send(logs []zk.AttendanceRecord) error
+}
+
+// Batch is a delivery with the IDs that trace it back to the sync cycle that read it
+type Batch struct {
+	SyncID  string // Sync cycle delivering the batch
+	BatchID string // Unique per delivery attempt
+	Logs    []zk.AttendanceRecord
+	// Latest status of the devices with records in the batch, sent as the device_status
+	// section of v2 and protobuf payloads
+	Devices []DeviceStatus
+}
+
+// DeviceStatus is operational context about a device, so the backend can show device health.
+// Numbers are left out when they weren't read.
+type DeviceStatus struct {
+	DeviceID          string `json:"device_id"`
+	Serial            string `json:"serial,omitempty"`
+	FetchedAt         string `json:"fetched_at,omitempty"`          // Last successful read, RFC 3339
+	ClockDriftSeconds *int   `json:"clock_drift_seconds,omitempty"` // Device clock minus true time
+	Records           *int   `json:"records,omitempty"`             // Attendance records on the device
+	RecordCapacity    *int   `json:"record_capacity,omitempty"`     // Records it can hold
+}
+
+// BatchSink is implemented by sinks that pass correlation IDs on to their destination.
+// The collector calls SendBatch instead of Send on them.
+type BatchSink interface {
+	Sink
+	SendBatch(batch Batch) error
+}
+
+// APISink posts records to the attendance API
+type APISink struct {
+	OrgID, URL, APIKey string
+	PayloadVersion     int // JSON payload version, PayloadV1 when zero
+	// Template replaces the standard body with a rendered one, see ParsePayloadTemplate, sent
+	// as ContentType (application/json when empty)
+	Template, ContentType string
+}
+
+func (s *APISink) Name() string { return "api" }
+
+func (s *APISink) Send(logs []zk.AttendanceRecord) error {
+	return s.SendBatch(Batch{Logs: logs})
+}
+
+// SendBatch posts the batch with its IDs in the X-Sync-Id and X-Batch-Id headers and its
+// payload version in X-Payload-Version
+func (s *APISink) SendBatch(batch Batch) error {
+	if s.Template != "" {
+		return sendTemplateBatch(batch, s.Template, s.ContentType, s.OrgID, s.URL, s.APIKey)
+	}
+	version := s.PayloadVersion
+	if version == 0 {
+		version = PayloadV1
+	}
+	return sendBatchToAPI(batch, s.OrgID, s.URL, s.APIKey, version)
+}
+
+// Policies for a full archive or record store
+const (
+	PolicyEvictOldest = "evict-oldest" // Remove the oldest data to make room
+	PolicyStop        = "stop"         // Refuse new data until there is room
+	PolicyAlert       = "alert"        // Log an alert and keep writing
+)
+
+// FileSink appends records to daily JSON-lines files in a directory
+type FileSink struct {
+	Dir string
+	// Size limit of the archive files in bytes, 0 for none. When a write would exceed it,
+	// Policy applies: PolicyEvictOldest (the default) deletes the oldest daily files, PolicyStop
+	// fails with ErrArchiveFull so the records wait in the collector's store, and PolicyAlert
+	// only logs.
+	MaxSize int64
+	Policy  string
+}
+
+func (s *FileSink) Name() string { return "file" }
+
+func (s *FileSink) Send(logs []zk.AttendanceRecord) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range logs {
+		if err := enc.Encode(record); err != nil {
+			return fmt.Errorf("failed to encode archive records: %w", err)
+		}
+	}
+	name := archivePrefix + time.Now().Format("2006-01-02") + archiveSuffix
+	if err := s.makeRoom(name, int64(buf.Len())); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.Dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+	return f.Sync()
+}
+
+// Archive file names are archivePrefix + date + archiveSuffix, so they sort by date
+const (
+	archivePrefix = "attendance-"
+	archiveSuffix = ".jsonl"
+)
+
+// archiveFiles lists the archive files in dir, oldest first, with their total size
+func archiveFiles(dir string) ([]os.FileInfo, int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, archivePrefix) || !strings.HasSuffix(name, archiveSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, total, nil
+}
+
+// ArchiveUsage returns the total size of the archive files in dir
+func ArchiveUsage(dir string) (int64, error) {
+	_, total, err := archiveFiles(dir)
+	return total, err
+}
+
+// makeRoom applies the size limit before n bytes are appended to the archive file current
+func (s *FileSink) makeRoom(current string, n int64) error {
+	if s.MaxSize <= 0 {
+		return nil
+	}
+	files, total, err := archiveFiles(s.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read archive directory: %w", err)
+	}
+	if total+n <= s.MaxSize {
+		return nil
+	}
+	switch s.Policy {
+	case PolicyStop:
+		return fmt.Errorf("%w: %d of %d bytes used", ErrArchiveFull, total, s.MaxSize)
+	case PolicyAlert:
+		log.Printf("ALERT: archive %s is over its size limit: %d of %d bytes used", s.Dir, total+n, s.MaxSize)
+		return nil
+	}
+	for _, file := range files {
+		if total+n <= s.MaxSize || file.Name() == current {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.Dir, file.Name())); err != nil {
+			return fmt.Errorf("failed to remove old archive file: %w", err)
+		}
+		total -= file.Size()
+		log.Printf("Archive over its size limit, removed %s", file.Name())
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are the functions payload templates can use besides the text/template builtins
+var templateFuncs = template.FuncMap{
+	// json encodes a value as JSON, e.g. {{json .employee_name}} for a quoted string
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	// xml escapes a value for XML text and attributes
+	"xml": func(v interface{}) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(fmt.Sprint(v)))
+		return buf.String(), err
+	},
+	// date reformats a record timestamp with a Go layout, e.g. {{date .timestamp "02/01/2006"}}
+	"date": func(timestamp interface{}, layout string) (string, error) {
+		t, err := time.ParseInLocation(zk.TimestampLayout, fmt.Sprint(timestamp), time.Local)
+		if err != nil {
+			return "", err
+		}
+		return t.Format(layout), nil
+	},
+	"upper": func(v interface{}) string { return strings.ToUpper(fmt.Sprint(v)) },
+	"lower": func(v interface{}) string { return strings.ToLower(fmt.Sprint(v)) },
+}
+
+// ParsePayloadTemplate parses a payload template. It sees org_id, sync_id, batch_id, sent_at,
+// count and records, each record with its v2 payload fields such as employee_id, timestamp
+// and record_id, so {{range .records}}<Punch id="{{.employee_id}}"/>{{end}} renders a tag
+// per record. A field a record doesn't have renders as "<no value>".
+func ParsePayloadTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// recordFields returns the v2 fields of a record by their JSON names, for templates and
+// exports. Numbers are kept as json.Number so IDs render as written rather than as floats.
+func recordFields(record zk.AttendanceRecord) (map[string]interface{}, error) {
+	r, err := newRecordV2(record)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// renderPayload renders a batch with a payload template
+func renderPayload(text string, batch Batch, orgID string) ([]byte, error) {
+	tmpl, err := ParsePayloadTemplate("payload", text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload template: %w", err)
+	}
+	records := make([]map[string]interface{}, len(batch.Logs))
+	for i, record := range batch.Logs {
+		if records[i], err = recordFields(record); err != nil {
+			return nil, err
+		}
+	}
+	// Device statuses go through JSON too, so templates use the same names as v2 payloads
+	var devices []map[string]interface{}
+	if len(batch.Devices) > 0 {
+		encoded, err := json.Marshal(batch.Devices)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(encoded))
+		dec.UseNumber()
+		if err := dec.Decode(&devices); err != nil {
+			return nil, err
+		}
+	}
+	data := map[string]interface{}{
+		"org_id":        orgID,
+		"sync_id":       batch.SyncID,
+		"batch_id":      batch.BatchID,
+		"sent_at":       time.Now().Format(time.RFC3339),
+		"count":         len(records),
+		"records":       records,
+		"device_status": devices,
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render payload template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// sendTemplateBatch posts a batch rendered with a payload template, with its IDs in the
+// X-Sync-Id and X-Batch-Id headers. An empty content type sends application/json.
+func sendTemplateBatch(batch Batch, text, contentType, orgID, url, apiKey string) error {
+	body, err := renderPayload(text, batch, orgID)
+	if err != nil {
+		return err
+	}
+	req, err := NewAPIRequest("POST", url, body, apiKey)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set(contentTypeHeader, contentType)
+	}
+	if batch.SyncID != "" {
+		req.Header.Set(syncIDHeader, batch.SyncID)
+	}
+	if batch.BatchID != "" {
+		req.Header.Set(batchIDHeader, batch.BatchID)
+	}
+	req.Body = io.NopCloser(throttle(bytes.NewReader(body)))
+	client := &http.Client{Timeout: uploadTimeout(45*time.Second, len(body)), Transport: uploadTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute API request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return statusError(resp.StatusCode, respBody)
+	}
+	log.Printf("API request successful (Status: %d)", resp.StatusCode)
+	return nil
+}
+
+// TemplateSink posts records in a body shape defined by a payload template, for endpoints
+// that expect their own envelope
+type TemplateSink struct {
+	Label              string // Distinguishes several template sinks, and names the sink "template-<Label>"
+	URL, APIKey, OrgID string
+	Template           string // See ParsePayloadTemplate
+	ContentType        string // application/json when empty
+}
+
+func (s *TemplateSink) Name() string { return "template-" + s.Label }
+
+func (s *TemplateSink) Send(logs []zk.AttendanceRecord) error {
+	return s.SendBatch(Batch{Logs: logs})
+}
+
+// SendBatch posts the batch rendered with the template
+func (s *TemplateSink) SendBatch(batch Batch) error {
+	return sendTemplateBatch(batch, s.Template, s.ContentType, s.OrgID, s.URL, s.APIKey)
+}
@@ -0,0 +1,84 @@
+package sink
+
+import (
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadPacer spaces out upload bytes of all sinks together, since they share the site's link
+var uploadPacer = struct {
+	sync.Mutex
+	next time.Time // When the link is free again at the configured rate
+}{}
+
+// uploadBandwidth returns the UPLOAD_BANDWIDTH limit in bytes per second, or 0 for none.
+// The value may end in k or m for KiB/s and MiB/s.
+func uploadBandwidth() int {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("UPLOAD_BANDWIDTH")))
+	if value == "" {
+		return 0
+	}
+	unit := 1
+	switch {
+	case strings.HasSuffix(value, "k"):
+		unit, value = 1024, strings.TrimSuffix(value, "k")
+	case strings.HasSuffix(value, "m"):
+		unit, value = 1024*1024, strings.TrimSuffix(value, "m")
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid UPLOAD_BANDWIDTH=%q, not throttling uploads", os.Getenv("UPLOAD_BANDWIDTH"))
+		return 0
+	}
+	return n * unit
+}
+
+// throttledReader passes a request body on no faster than rate bytes per second
+type throttledReader struct {
+	r    io.Reader
+	rate int
+}
+
+// throttle wraps an upload body in the configured bandwidth limit, returning it unchanged
+// when there is none
+func throttle(r io.Reader) io.Reader {
+	rate := uploadBandwidth()
+	if rate == 0 {
+		return r
+	}
+	return &throttledReader{r: r, rate: rate}
+}
+
+// Read reads at most a tenth of a second's worth of bytes, then waits for the link's turn
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if max := t.rate / 10; len(p) > max && max > 0 {
+		p = p[:max]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		uploadPacer.Lock()
+		now := time.Now()
+		if uploadPacer.next.Before(now) {
+			uploadPacer.next = now
+		}
+		wait := uploadPacer.next.Sub(now)
+		uploadPacer.next = uploadPacer.next.Add(time.Duration(n) * time.Second / time.Duration(t.rate))
+		uploadPacer.Unlock()
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// uploadTimeout extends a request timeout by the time a body of size bytes takes to send
+// at the configured bandwidth
+func uploadTimeout(base time.Duration, size int) time.Duration {
+	if rate := uploadBandwidth(); rate > 0 {
+		return base + time.Duration(size/rate+1)*time.Second
+	}
+	return base
+}
@@ -0,0 +1,95 @@
+package sink
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadBandwidth(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 0},
+		{"  ", 0},
+		{"1000", 1000},
+		{" 64k ", 64 * 1024},
+		{"64K", 64 * 1024},
+		{"2m", 2 * 1024 * 1024},
+		{"2M", 2 * 1024 * 1024},
+		{"0", 0},
+		{"-5", 0},
+		{"k", 0},
+		{"1.5m", 0},
+		{"64kb", 0},
+		{"fast", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("UPLOAD_BANDWIDTH", tt.value)
+		if got := uploadBandwidth(); got != tt.want {
+			t.Errorf("UPLOAD_BANDWIDTH=%q: %d bytes/s, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestUploadTimeout(t *testing.T) {
+	tests := []struct {
+		bandwidth string
+		size      int
+		want      time.Duration
+	}{
+		{"", 1 << 20, 10 * time.Second},
+		{"1000", 0, 11 * time.Second},
+		{"1000", 999, 11 * time.Second},
+		{"1000", 1000, 12 * time.Second},
+		{"1k", 10 * 1024, 21 * time.Second},
+		{"invalid", 1 << 20, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Setenv("UPLOAD_BANDWIDTH", tt.bandwidth)
+		if got := uploadTimeout(10*time.Second, tt.size); got != tt.want {
+			t.Errorf("UPLOAD_BANDWIDTH=%q, %d bytes: timeout %v, want %v", tt.bandwidth, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	t.Setenv("UPLOAD_BANDWIDTH", "")
+	body := strings.NewReader("payload")
+	if throttle(body) != io.Reader(body) {
+		t.Error("body wrapped without a bandwidth limit")
+	}
+
+	tests := []struct {
+		rate, buffer, chunk int
+	}{
+		{10000, 4096, 1000}, // A tenth of a second's worth
+		{10000, 500, 500},   // Smaller than that
+		{5, 4096, 4096},     // Rates under 10 bytes/s aren't split
+	}
+	for _, tt := range tests {
+		r := &throttledReader{r: bytes.NewReader(make([]byte, 8192)), rate: tt.rate}
+		uploadPacer.Lock()
+		uploadPacer.next = time.Time{}
+		uploadPacer.Unlock()
+		if n, _ := r.Read(make([]byte, tt.buffer)); n != tt.chunk {
+			t.Errorf("rate %d, %d-byte buffer: read %d bytes, want %d", tt.rate, tt.buffer, n, tt.chunk)
+		}
+	}
+
+	// 3000 bytes at 10000 bytes/s take 300ms, less the last read, which doesn't wait
+	uploadPacer.Lock()
+	uploadPacer.next = time.Time{}
+	uploadPacer.Unlock()
+	start := time.Now()
+	data, err := io.ReadAll(&throttledReader{r: bytes.NewReader(make([]byte, 3000)), rate: 10000})
+	if err != nil || len(data) != 3000 {
+		t.Fatalf("read %d bytes, %v, want all 3000", len(data), err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("3000 bytes at 10000 bytes/s took %v, want most of 300ms", elapsed)
+	}
+}
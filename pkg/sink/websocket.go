@@ -0,0 +1,313 @@
+package sink
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"old-attendance/pkg/zk"
+	"sync"
+	"time"
+)
+
+// WebSocket frame opcodes (RFC 6455 section 5.2)
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+const (
+	wsAcceptGUID   = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // Hashed with the key into Sec-WebSocket-Accept
+	wsPingInterval = 30 * time.Second                       // Keeps idle connections alive through NAT and proxies
+	wsWriteTimeout = 10 * time.Second
+	wsMaxFrame     = 1 << 20 // Largest server frame read; dashboards only send control frames
+)
+
+// WebSocketSink streams each record as a message over a connection it keeps open, for
+// dashboards that show punches as they arrive. The connection is dialed on the first
+// delivery and again after it drops; a delivery interrupted by a drop is retried whole,
+// so consumers should deduplicate by record_id.
+type WebSocketSink struct {
+	URL, APIKey, OrgID string
+
+	mu   sync.Mutex
+	conn *wsConn
+}
+
+// wsMessage is one streamed punch
+type wsMessage struct {
+	Type    string   `json:"type"` // Always "punch"
+	OrgID   string   `json:"org_id"`
+	SyncID  string   `json:"sync_id,omitempty"`
+	BatchID string   `json:"batch_id,omitempty"`
+	Record  recordV2 `json:"record"`
+}
+
+func (s *WebSocketSink) Name() string { return "websocket" }
+
+func (s *WebSocketSink) Send(logs []zk.AttendanceRecord) error {
+	return s.SendBatch(Batch{Logs: logs})
+}
+
+// SendBatch writes one message per record, redialing first if the connection dropped
+func (s *WebSocketSink) SendBatch(batch Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil || s.conn.closed() {
+		conn, err := dialWebSocket(s.URL, s.APIKey)
+		if err != nil {
+			return err
+		}
+		log.Printf("WebSocket connected to %s", s.URL)
+		s.conn = conn
+	}
+	for _, record := range batch.Logs {
+		r, err := newRecordV2(record)
+		if err != nil {
+			return err
+		}
+		message, err := json.Marshal(wsMessage{Type: "punch", OrgID: s.OrgID, SyncID: batch.SyncID, BatchID: batch.BatchID, Record: r})
+		if err != nil {
+			return fmt.Errorf("failed to marshal WebSocket message: %w", err)
+		}
+		if err := s.conn.writeFrame(wsText, message); err != nil {
+			s.conn.close()
+			s.conn = nil
+			return fmt.Errorf("WebSocket write failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// wsConn is a client WebSocket connection. Writes are serialized; a background reader
+// answers pings and notices when the server closes the connection.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	writeMu sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+}
+
+// dialWebSocket connects to a ws:// or wss:// URL and performs the opening handshake,
+// authenticating like API requests
+func dialWebSocket(rawURL, apiKey string) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebSocket URL: %w", err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("WebSocket URL must start with ws:// or wss://, got %q", rawURL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect WebSocket: %w", err)
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.URL.Scheme = "http"
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	token, err := bearerToken(apiKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set(authorizationHeader, bearerPrefix+token)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send WebSocket handshake: %w", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read WebSocket handshake: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		conn.Close()
+		return nil, statusError(resp.StatusCode, body)
+	}
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		return nil, errors.New("WebSocket handshake has an invalid Sec-WebSocket-Accept")
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &wsConn{conn: conn, r: r, done: make(chan struct{})}
+	go c.readLoop()
+	go c.pingLoop()
+	return c, nil
+}
+
+// writeFrame sends one masked frame, as clients must
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	header[1] |= 0x80
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame := append(header, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// readFrame reads one frame from the server, which doesn't mask them
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := uint64(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxFrame {
+		return 0, nil, fmt.Errorf("WebSocket frame of %d bytes is too large", n)
+	}
+	var mask [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// readLoop answers pings and closes the connection when the server does or it fails.
+// Data messages from the server are ignored.
+func (c *wsConn) readLoop() {
+	defer c.close()
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				log.Printf("WebSocket connection lost: %v", err)
+			}
+			return
+		}
+		switch opcode {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			log.Println("WebSocket closed by the server")
+			return
+		}
+	}
+}
+
+// pingLoop pings the server while the connection is open
+func (c *wsConn) pingLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.writeFrame(wsPing, nil); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// closed reports whether the connection has been closed
+func (c *wsConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wsConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,266 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"old-attendance/pkg/zk"
+	"strings"
+	"time"
+)
+
+const (
+	// Content type for API_FORMAT=xml uploads
+	xmlContentType = "application/xml"
+	// Namespace of the XML payload, see schema/attendance.xsd
+	xmlNamespace = "urn:attendance:v1"
+)
+
+// SOAP envelope and WS-Security namespaces
+const (
+	soap11Namespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soap12Namespace = "http://www.w3.org/2003/05/soap-envelope"
+	wsseNamespace   = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd"
+	wsuNamespace    = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd"
+	wssTokenProfile = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0"
+	wssBase64Binary = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary"
+)
+
+// How long a WS-Security timestamp is valid for
+const wsseTimestampTTL = 5 * time.Minute
+
+// xmlRecord is an attendance record in the XML payload, with the JSON field names
+type xmlRecord struct {
+	EmployeeID   int       `xml:"employee_id"`
+	Timestamp    string    `xml:"timestamp"`
+	UTCOffset    string    `xml:"utc_offset,omitempty"`
+	DeviceTime   string    `xml:"device_time,omitempty"`
+	DeviceID     string    `xml:"device_id,omitempty"`
+	Manual       bool      `xml:"manual,omitempty"`
+	Reason       string    `xml:"reason,omitempty"`
+	Flags        *xmlFlags `xml:"flags,omitempty"`
+	Modality     string    `xml:"modality,omitempty"`
+	CardNumber   string    `xml:"card_number,omitempty"`
+	Shift        string    `xml:"shift,omitempty"`
+	Status       string    `xml:"status,omitempty"`
+	EmployeeName string    `xml:"employee_name,omitempty"`
+	Department   string    `xml:"department,omitempty"`
+}
+
+// xmlFlags lists a record's flags, left out when there are none
+type xmlFlags struct {
+	Flag []string `xml:"flag"`
+}
+
+// xmlPayload is the API_FORMAT=xml upload body
+type xmlPayload struct {
+	XMLName xml.Name    `xml:"urn:attendance:v1 attendance"`
+	OrgID   string      `xml:"org_id,attr"`
+	Records []xmlRecord `xml:"record"`
+}
+
+// newXMLRecords converts records to their XML form
+func newXMLRecords(logs []zk.AttendanceRecord) []xmlRecord {
+	records := make([]xmlRecord, len(logs))
+	for i, r := range logs {
+		records[i] = xmlRecord{
+			EmployeeID:   r.UserID,
+			Timestamp:    r.Timestamp,
+			UTCOffset:    r.UTCOffset,
+			DeviceTime:   r.DeviceTime,
+			DeviceID:     r.DeviceID,
+			Manual:       r.Manual,
+			Reason:       r.Reason,
+			Modality:     r.Modality,
+			CardNumber:   r.CardNumber,
+			Shift:        r.Shift,
+			Status:       r.Status,
+			EmployeeName: r.EmployeeName,
+			Department:   r.Department,
+		}
+		if len(r.Flags) > 0 {
+			records[i].Flags = &xmlFlags{Flag: r.Flags}
+		}
+	}
+	return records
+}
+
+// marshalPayloadXML encodes an AttendancePayload as an XML document
+func marshalPayloadXML(payload AttendancePayload) ([]byte, error) {
+	data, err := xml.Marshal(xmlPayload{OrgID: payload.OrgID, Records: newXMLRecords(payload.Logs)})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// SOAPSink calls a SOAP operation with the records, authenticating with a WS-Security
+// UsernameToken when a username is set
+type SOAPSink struct {
+	URL, OrgID string
+	Action     string // SOAPAction of the operation, may be empty
+	Operation  string // Element wrapping the records in the body, e.g. SubmitAttendance
+	Namespace  string // Namespace of the operation element, xmlNamespace when empty
+	SOAP12     bool   // SOAP 1.2 envelope instead of 1.1
+	Username   string
+	Password   string
+	// PasswordDigest sends the password as a digest with a nonce and creation time rather
+	// than as text; the service must support PasswordDigest
+	PasswordDigest bool
+}
+
+func (s *SOAPSink) Name() string { return "soap" }
+
+func (s *SOAPSink) Send(logs []zk.AttendanceRecord) error {
+	return s.SendBatch(Batch{Logs: logs})
+}
+
+// soapOperation is the body of the envelope
+type soapOperation struct {
+	XMLName xml.Name
+	OrgID   string      `xml:"org_id"`
+	SyncID  string      `xml:"sync_id,omitempty"`
+	BatchID string      `xml:"batch_id,omitempty"`
+	Records []xmlRecord `xml:"record"`
+}
+
+// xmlText escapes s for XML text
+func xmlText(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// securityHeader returns the WS-Security header with a timestamp and UsernameToken
+func (s *SOAPSink) securityHeader(now time.Time) (string, error) {
+	created := now.UTC().Format("2006-01-02T15:04:05.000Z")
+	expires := now.Add(wsseTimestampTTL).UTC().Format("2006-01-02T15:04:05.000Z")
+	password := fmt.Sprintf(`<wsse:Password Type="%s#PasswordText">%s</wsse:Password>`, wssTokenProfile, xmlText(s.Password))
+	nonce := ""
+	if s.PasswordDigest {
+		raw := make([]byte, 16)
+		if _, err := rand.Read(raw); err != nil {
+			return "", fmt.Errorf("failed to generate WS-Security nonce: %w", err)
+		}
+		// Password_Digest = Base64(SHA-1(nonce + created + password))
+		digest := sha1.Sum(append(append(append([]byte{}, raw...), created...), s.Password...))
+		password = fmt.Sprintf(`<wsse:Password Type="%s#PasswordDigest">%s</wsse:Password>`,
+			wssTokenProfile, base64.StdEncoding.EncodeToString(digest[:]))
+		nonce = fmt.Sprintf(`<wsse:Nonce EncodingType="%s">%s</wsse:Nonce>`, wssBase64Binary, base64.StdEncoding.EncodeToString(raw))
+	}
+	return fmt.Sprintf(`<soap:Header><wsse:Security xmlns:wsse="%s" xmlns:wsu="%s" soap:mustUnderstand="1">`+
+		`<wsu:Timestamp><wsu:Created>%s</wsu:Created><wsu:Expires>%s</wsu:Expires></wsu:Timestamp>`+
+		`<wsse:UsernameToken><wsse:Username>%s</wsse:Username>%s%s<wsu:Created>%s</wsu:Created></wsse:UsernameToken>`+
+		`</wsse:Security></soap:Header>`,
+		wsseNamespace, wsuNamespace, created, expires, xmlText(s.Username), password, nonce, created), nil
+}
+
+// envelope builds the SOAP request for a batch
+func (s *SOAPSink) envelope(batch Batch) ([]byte, error) {
+	envNS := soap11Namespace
+	if s.SOAP12 {
+		envNS = soap12Namespace
+	}
+	namespace, operation := s.Namespace, s.Operation
+	if namespace == "" {
+		namespace = xmlNamespace
+	}
+	if operation == "" {
+		operation = "SubmitAttendance"
+	}
+	body, err := xml.Marshal(soapOperation{
+		XMLName: xml.Name{Space: namespace, Local: operation},
+		OrgID:   s.OrgID,
+		SyncID:  batch.SyncID,
+		BatchID: batch.BatchID,
+		Records: newXMLRecords(batch.Logs),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal SOAP body: %w", err)
+	}
+	header := ""
+	if s.Username != "" {
+		if header, err = s.securityHeader(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, `<soap:Envelope xmlns:soap="%s">%s<soap:Body>`, envNS, header)
+	buf.Write(body)
+	buf.WriteString(`</soap:Body></soap:Envelope>`)
+	return buf.Bytes(), nil
+}
+
+// soapFault returns the reason of a SOAP 1.1 or 1.2 fault in a response, if it has one
+func soapFault(body []byte) string {
+	var fault struct {
+		Body struct {
+			Fault *struct {
+				String string `xml:"faultstring"`
+				Reason string `xml:"Reason>Text"`
+			} `xml:"Fault"`
+		} `xml:"Body"`
+	}
+	if xml.Unmarshal(body, &fault) != nil || fault.Body.Fault == nil {
+		return ""
+	}
+	if fault.Body.Fault.String != "" {
+		return fault.Body.Fault.String
+	}
+	return fault.Body.Fault.Reason
+}
+
+// SendBatch calls the operation with the batch. A SOAP fault counts as a rejection.
+func (s *SOAPSink) SendBatch(batch Batch) error {
+	body, err := s.envelope(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create SOAP request: %w", err)
+	}
+	if s.SOAP12 {
+		contentType := "application/soap+xml; charset=utf-8"
+		if s.Action != "" {
+			contentType += fmt.Sprintf(`; action="%s"`, s.Action)
+		}
+		req.Header.Set(contentTypeHeader, contentType)
+	} else {
+		req.Header.Set(contentTypeHeader, "text/xml; charset=utf-8")
+		req.Header.Set("SOAPAction", `"`+s.Action+`"`)
+	}
+	if batch.SyncID != "" {
+		req.Header.Set(syncIDHeader, batch.SyncID)
+	}
+	if batch.BatchID != "" {
+		req.Header.Set(batchIDHeader, batch.BatchID)
+	}
+	req.ContentLength = int64(len(body))
+	req.Body = io.NopCloser(throttle(bytes.NewReader(body)))
+	client := &http.Client{Timeout: uploadTimeout(45*time.Second, len(body)), Transport: uploadTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute SOAP request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if fault := soapFault(respBody); fault != "" {
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%w: SOAP fault: %s", ErrAuthFailed, fault)
+		}
+		return fmt.Errorf("%w: SOAP fault: %s", ErrAPIRejected, strings.TrimSpace(fault))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return statusError(resp.StatusCode, respBody)
+	}
+	log.Printf("SOAP request successful (%d record(s))", len(batch.Logs))
+	return nil
+}
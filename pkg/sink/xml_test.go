@@ -0,0 +1,227 @@
+package sink
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"old-attendance/pkg/zk"
+)
+
+// wsseHeader is the part of a WS-Security header the tests check
+type wsseHeader struct {
+	Security struct {
+		MustUnderstand string `xml:"mustUnderstand,attr"`
+		Timestamp      struct {
+			Created string `xml:"Created"`
+			Expires string `xml:"Expires"`
+		} `xml:"Timestamp"`
+		Token struct {
+			Username string `xml:"Username"`
+			Password struct {
+				Type  string `xml:"Type,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"Password"`
+			Nonce *struct {
+				EncodingType string `xml:"EncodingType,attr"`
+				Value        string `xml:",chardata"`
+			} `xml:"Nonce"`
+			Created string `xml:"Created"`
+		} `xml:"UsernameToken"`
+	} `xml:"Security"`
+}
+
+func TestSOAPSecurityHeader(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 15, 30, 123e6, time.FixedZone("BDT", 6*3600))
+	tests := []struct {
+		name     string
+		username string
+		password string
+		digest   bool
+	}{
+		{"text", "collector", "s3cret", false},
+		{"text escaped", "a&b", "p<w>&\"d'", false},
+		{"digest", "collector", "s3cret", true},
+		{"digest escaped", "a&b", "p<w>&\"d'", true},
+		{"digest empty password", "collector", "", true},
+		{"digest non-ASCII password", "collector", "পাসওয়ার্ড", true},
+	}
+	for _, tt := range tests {
+		s := &SOAPSink{Username: tt.username, Password: tt.password, PasswordDigest: tt.digest}
+		text, err := s.securityHeader(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var header wsseHeader
+		if err := xml.Unmarshal([]byte(text), &header); err != nil {
+			t.Errorf("%s: header is not XML: %v\n%s", tt.name, err, text)
+			continue
+		}
+		sec := header.Security
+		if sec.MustUnderstand != "1" {
+			t.Errorf("%s: mustUnderstand = %q, want 1", tt.name, sec.MustUnderstand)
+		}
+		if sec.Timestamp.Created != "2024-03-01T03:15:30.123Z" || sec.Timestamp.Expires != "2024-03-01T03:20:30.123Z" {
+			t.Errorf("%s: timestamp %s to %s, want five minutes from the UTC time", tt.name, sec.Timestamp.Created, sec.Timestamp.Expires)
+		}
+		if sec.Token.Created != sec.Timestamp.Created {
+			t.Errorf("%s: token created %s, timestamp created %s", tt.name, sec.Token.Created, sec.Timestamp.Created)
+		}
+		if sec.Token.Username != tt.username {
+			t.Errorf("%s: username %q, want %q", tt.name, sec.Token.Username, tt.username)
+		}
+
+		if !tt.digest {
+			if !strings.HasSuffix(sec.Token.Password.Type, "#PasswordText") || sec.Token.Password.Value != tt.password || sec.Token.Nonce != nil {
+				t.Errorf("%s: password %s %q, nonce %v, want the text password and no nonce", tt.name, sec.Token.Password.Type, sec.Token.Password.Value, sec.Token.Nonce)
+			}
+			continue
+		}
+		if !strings.HasSuffix(sec.Token.Password.Type, "#PasswordDigest") || sec.Token.Nonce == nil {
+			t.Errorf("%s: password type %s, nonce %v, want a digest with a nonce", tt.name, sec.Token.Password.Type, sec.Token.Nonce)
+			continue
+		}
+		if !strings.HasSuffix(sec.Token.Nonce.EncodingType, "#Base64Binary") {
+			t.Errorf("%s: nonce encoding %s, want Base64Binary", tt.name, sec.Token.Nonce.EncodingType)
+		}
+		nonce, err := base64.StdEncoding.DecodeString(sec.Token.Nonce.Value)
+		if err != nil || len(nonce) != 16 {
+			t.Errorf("%s: nonce %q is not 16 base64 bytes", tt.name, sec.Token.Nonce.Value)
+			continue
+		}
+		// Base64(SHA-1(nonce + created + password)), as the service recomputes it
+		sum := sha1.Sum([]byte(string(nonce) + sec.Token.Created + tt.password))
+		if want := base64.StdEncoding.EncodeToString(sum[:]); sec.Token.Password.Value != want {
+			t.Errorf("%s: digest %s, want %s", tt.name, sec.Token.Password.Value, want)
+		}
+		if strings.Contains(text, xmlText(tt.password)) && tt.password != "" {
+			t.Errorf("%s: password sent in the clear with a digest", tt.name)
+		}
+	}
+
+	// Every digest has its own nonce
+	s := &SOAPSink{Username: "collector", Password: "s3cret", PasswordDigest: true}
+	first, _ := s.securityHeader(now)
+	second, _ := s.securityHeader(now)
+	if first == second {
+		t.Error("two digest headers are identical, want a new nonce each")
+	}
+}
+
+func TestSOAPEnvelope(t *testing.T) {
+	batch := Batch{SyncID: "sync-1", BatchID: "batch-1", Logs: []zk.AttendanceRecord{{UserID: 7, Timestamp: "2024-03-01T09:00:00", DeviceID: "gate"}}}
+	tests := []struct {
+		name                string
+		sink                SOAPSink
+		envelope, operation string // Namespace and local name
+		opNamespace         string
+		security            bool
+	}{
+		{"defaults", SOAPSink{OrgID: "org"}, soap11Namespace, "SubmitAttendance", xmlNamespace, false},
+		{"SOAP 1.2", SOAPSink{OrgID: "org", SOAP12: true}, soap12Namespace, "SubmitAttendance", xmlNamespace, false},
+		{"operation", SOAPSink{OrgID: "org", Operation: "PostPunches", Namespace: "urn:gov:labour"}, soap11Namespace, "PostPunches", "urn:gov:labour", false},
+		{"username", SOAPSink{OrgID: "org", Username: "collector", Password: "s3cret"}, soap11Namespace, "SubmitAttendance", xmlNamespace, true},
+	}
+	for _, tt := range tests {
+		data, err := tt.sink.envelope(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var env struct {
+			XMLName xml.Name
+			Header  *struct{} `xml:"Header"`
+			Body    struct {
+				Operation struct {
+					XMLName xml.Name
+					OrgID   string `xml:"org_id"`
+					SyncID  string `xml:"sync_id"`
+					BatchID string `xml:"batch_id"`
+					Records []struct {
+						EmployeeID int `xml:"employee_id"`
+					} `xml:"record"`
+				} `xml:",any"`
+			} `xml:"Body"`
+		}
+		if err := xml.Unmarshal(data, &env); err != nil {
+			t.Errorf("%s: envelope is not XML: %v", tt.name, err)
+			continue
+		}
+		op := env.Body.Operation
+		if env.XMLName.Space != tt.envelope || env.XMLName.Local != "Envelope" {
+			t.Errorf("%s: envelope %v, want %s Envelope", tt.name, env.XMLName, tt.envelope)
+		}
+		if op.XMLName.Local != tt.operation || op.XMLName.Space != tt.opNamespace {
+			t.Errorf("%s: operation %v, want %s in %s", tt.name, op.XMLName, tt.operation, tt.opNamespace)
+		}
+		if op.OrgID != "org" || op.SyncID != "sync-1" || op.BatchID != "batch-1" || len(op.Records) != 1 || op.Records[0].EmployeeID != 7 {
+			t.Errorf("%s: body %+v, want the batch", tt.name, op)
+		}
+		if (env.Header != nil) != tt.security {
+			t.Errorf("%s: security header %v, want %v", tt.name, env.Header != nil, tt.security)
+		}
+	}
+}
+
+func TestSoapFault(t *testing.T) {
+	tests := []struct {
+		name, body, want string
+	}{
+		{"SOAP 1.1", `<s:Envelope xmlns:s="` + soap11Namespace + `"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>Invalid org</faultstring></s:Fault></s:Body></s:Envelope>`, "Invalid org"},
+		{"SOAP 1.2", `<s:Envelope xmlns:s="` + soap12Namespace + `"><s:Body><s:Fault><s:Code><s:Value>s:Sender</s:Value></s:Code><s:Reason><s:Text xml:lang="en">Bad token</s:Text></s:Reason></s:Fault></s:Body></s:Envelope>`, "Bad token"},
+		{"no fault", `<s:Envelope xmlns:s="` + soap11Namespace + `"><s:Body><Ok/></s:Body></s:Envelope>`, ""},
+		{"not XML", "Internal Server Error", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := soapFault([]byte(tt.body)); got != tt.want {
+			t.Errorf("%s: soapFault = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSOAPSendBatch(t *testing.T) {
+	fault := `<s:Envelope xmlns:s="` + soap11Namespace + `"><s:Body><s:Fault><faultstring>Denied</faultstring></s:Fault></s:Body></s:Envelope>`
+	tests := []struct {
+		name        string
+		soap12      bool
+		status      int
+		reply       string
+		contentType string
+		wantErr     error
+	}{
+		{"accepted", false, http.StatusOK, "<ok/>", "text/xml; charset=utf-8", nil},
+		{"accepted SOAP 1.2", true, http.StatusOK, "<ok/>", `application/soap+xml; charset=utf-8; action="urn:submit"`, nil},
+		{"fault", false, http.StatusInternalServerError, fault, "", ErrAPIRejected},
+		{"fault with status 200", false, http.StatusOK, fault, "", ErrAPIRejected},
+		{"fault refusing the credentials", false, http.StatusUnauthorized, fault, "", ErrAuthFailed},
+		{"error without a fault", false, http.StatusBadGateway, "upstream down", "", ErrAPIRejected},
+	}
+	for _, tt := range tests {
+		var gotType, gotAction string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotType, gotAction = r.Header.Get(contentTypeHeader), r.Header.Get("SOAPAction")
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.reply))
+		}))
+		s := &SOAPSink{URL: server.URL, OrgID: "org", Action: "urn:submit", SOAP12: tt.soap12}
+		err := s.SendBatch(Batch{Logs: []zk.AttendanceRecord{{UserID: 7, Timestamp: "2024-03-01T09:00:00"}}})
+		server.Close()
+		if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if tt.contentType != "" && gotType != tt.contentType {
+			t.Errorf("%s: content type %q, want %q", tt.name, gotType, tt.contentType)
+		}
+		if !tt.soap12 && gotAction != `"urn:submit"` {
+			t.Errorf("%s: SOAPAction %q, want the quoted action", tt.name, gotAction)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package zk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// Verification modalities reported on records read with ReadModality. Combined verification
+// modes and codes not listed here are reported as "verify_<code>".
+const (
+	ModalityPassword    = "password"
+	ModalityFingerprint = "fingerprint"
+	ModalityCard        = "card"
+	ModalityFace        = "face"
+	ModalityPalm        = "palm"
+)
+
+// Buffered read commands missing from gozk's constants
+const (
+	cmdPrepareBuffer = 1503
+	maxBufferChunk   = 0xFFC0 // Largest chunk the firmware hands out per CMD_READ_BUFFER
+	pacedBufferChunk = 0x4000 // Chunk size of reads paced with ChunkPause
+	// Largest bulk read accepted: well above a full log of 40-byte records or a user table
+	// with templates, so a size a device gets wrong can't take the collector's memory
+	maxBufferSize = 64 << 20
+	// Largest packet accepted from a device: a reply header and the largest chunk
+	maxPacketSize = 8 + maxBufferChunk
+)
+
+// attendanceEntry is one attendance log entry as read from the device
+type attendanceEntry struct {
+	UserID     int
+	Time       time.Time
+	Modality   string // Empty when read through gozk, which drops the verify code
+	CardNumber string // Set with ReadCardNumbers
+	Wall       string // Time as the terminal recorded it, see resolveDST
+	DST        string // FlagDSTGap or FlagDSTAmbiguous when the time falls on a transition
+}
+
+// verifyModality maps the verify code of an attendance log entry to a modality. Multi-bio
+// terminals (uFace, SpeedFace) report face and palm verification with codes 15 and 25.
+func verifyModality(code byte) string {
+	switch code {
+	case 0, 3:
+		return ModalityPassword
+	case 1:
+		return ModalityFingerprint
+	case 2, 4:
+		return ModalityCard
+	case 15:
+		return ModalityFace
+	case 25:
+		return ModalityPalm
+	default:
+		return "verify_" + strconv.Itoa(int(code))
+	}
+}
+
+// VerifyModality maps a verify code recorded by the terminal, as found in the attendance
+// tables of ZKTeco's desktop software, to a modality
+func VerifyModality(code int) string {
+	if code < 0 || code > 255 {
+		return "verify_" + strconv.Itoa(code)
+	}
+	return verifyModality(byte(code))
+}
+
+// parseAttendanceLog decodes an attendance log buffer: a 4-byte total size followed by
+// count fixed-size entries. Firmware uses 8-byte entries (internal user number only),
+// 16-byte entries (numeric user ID) or 40-byte entries (user ID as a string), which is
+// what uFace and SpeedFace terminals send. A 40-byte entry whose user ID isn't a number is
+// logged and skipped.
+func parseAttendanceLog(data []byte, count int, loc *time.Location) ([]attendanceEntry, error) {
+	if len(data) < 4 || count <= 0 {
+		return nil, nil
+	}
+	total := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	if total > len(data) {
+		return nil, fmt.Errorf("attendance log truncated: %d of %d bytes", len(data), total)
+	}
+	size := total / count
+	var entries []attendanceEntry
+	for len(data) >= size && size > 0 {
+		var entry attendanceEntry
+		var verify byte
+		switch size {
+		case 8:
+			entry.UserID = int(binary.LittleEndian.Uint16(data[0:]))
+			verify = data[2]
+			entry.Time = decodeDeviceTime(binary.LittleEndian.Uint32(data[3:]), time.UTC)
+		case 16:
+			entry.UserID = int(binary.LittleEndian.Uint32(data[0:]))
+			entry.Time = decodeDeviceTime(binary.LittleEndian.Uint32(data[4:]), time.UTC)
+			verify = data[8]
+		case 40:
+			userID, err := strconv.Atoi(strings.TrimSpace(cString(data[2:26])))
+			if err != nil {
+				// One badly enrolled user shouldn't cost the rest of the log
+				log.Printf("Skipping attendance entry with non-numeric user ID %q", cString(data[2:26]))
+				data = data[size:]
+				continue
+			}
+			entry.UserID = userID
+			verify = data[26]
+			entry.Time = decodeDeviceTime(binary.LittleEndian.Uint32(data[27:]), time.UTC)
+		default:
+			return nil, fmt.Errorf("unsupported attendance entry size %d", size)
+		}
+		entry.Modality = verifyModality(verify)
+		entries = append(entries, entry)
+		data = data[size:]
+	}
+	resolveDST(entries, loc)
+	return entries, nil
+}
+
+// readAttendanceLog reads the attendance log over the command connection, keeping each
+// entry's verify code, which gozk discards
+func (zk *ZKManager) readAttendanceLog() ([]attendanceEntry, error) {
+	var entries []attendanceEntry
+	err := zk.withCommandConn(func(c *commandConn) error {
+		sizes, err := c.readFreeSizes()
+		if err != nil {
+			return err
+		}
+		count := int(int32(binary.LittleEndian.Uint32(sizes[8*4:])))
+		if count == 0 {
+			return nil
+		}
+		if zk.DisableDuringRead {
+			if _, err := c.send(gozk.CMD_DISABLEDEVICE, nil); err != nil {
+				return fmt.Errorf("failed to disable device: %w", err)
+			}
+			defer c.send(gozk.CMD_ENABLEDEVICE, nil)
+		}
+		data, err := c.readBuffer(gozk.CMD_ATTLOG_RRQ, 0)
+		if err != nil {
+			return fmt.Errorf("failed to get attendance: %w", err)
+		}
+		entries, err = parseAttendanceLog(data, count, zk.location())
+		return err
+	})
+	return entries, err
+}
+
+// readBuffer reads the full result of a bulk read command, in chunks when it is large.
+// fct selects the kind of data for commands that serve several, such as FCT_USER.
+// Firmware without buffered reads is sent the command itself instead.
+func (c *commandConn) readBuffer(command, fct int) ([]byte, error) {
+	if c.caps != nil && !c.caps.BufferedReads {
+		return c.readDirect(command, fct)
+	}
+	request := make([]byte, 11)
+	request[0] = 1
+	binary.LittleEndian.PutUint16(request[1:], uint16(command))
+	binary.LittleEndian.PutUint32(request[3:], uint32(fct))
+	code, _, payload, err := c.exchange(cmdPrepareBuffer, request)
+	if err != nil {
+		return nil, err
+	}
+	if code == gozk.CMD_DATA {
+		return payload, nil // Small results come back right away
+	}
+	if code != gozk.CMD_ACK_OK || len(payload) < 5 {
+		return nil, fmt.Errorf("device rejected buffered read of command %d (reply code %d)", command, code)
+	}
+	defer c.exchange(gozk.CMD_FREE_DATA, nil)
+
+	size := int(binary.LittleEndian.Uint32(payload[1:]))
+	if size > maxBufferSize {
+		return nil, fmt.Errorf("device announced %d bytes for command %d, more than the %d accepted", size, command, maxBufferSize)
+	}
+	chunkSize := maxBufferChunk
+	if c.chunkPause > 0 {
+		chunkSize = pacedBufferChunk
+	}
+	data := make([]byte, 0, size)
+	for start := 0; start < size; start += chunkSize {
+		if start > 0 && c.chunkPause > 0 {
+			time.Sleep(c.chunkPause)
+		}
+		n := size - start
+		if n > chunkSize {
+			n = chunkSize
+		}
+		chunk, err := c.readChunk(start, n)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// readChunk reads n bytes of a prepared buffer from offset start. The device either returns
+// them in one reply or announces them and streams data packets followed by an acknowledgment.
+func (c *commandConn) readChunk(start, n int) ([]byte, error) {
+	request := make([]byte, 8)
+	binary.LittleEndian.PutUint32(request[0:], uint32(start))
+	binary.LittleEndian.PutUint32(request[4:], uint32(n))
+	code, _, payload, err := c.exchange(gozk.CMD_READ_BUFFER, request)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case gozk.CMD_DATA:
+		return payload, nil
+	case gozk.CMD_PREPARE_DATA:
+		return c.readStream(n)
+	default:
+		return nil, fmt.Errorf("device rejected buffer read at %d (reply code %d)", start, code)
+	}
+}
+
+// readDirect reads the result of a bulk read command in one transfer, the way firmware
+// older than 6.60 serves it. The reply either carries the data or announces its size.
+func (c *commandConn) readDirect(command, fct int) ([]byte, error) {
+	var request []byte
+	if fct != 0 {
+		request = []byte{byte(fct)}
+	}
+	code, _, payload, err := c.exchange(command, request)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case gozk.CMD_DATA:
+		return payload, nil
+	case gozk.CMD_PREPARE_DATA:
+		if len(payload) < 4 {
+			return nil, errors.New("short data announcement")
+		}
+		size := int(binary.LittleEndian.Uint32(payload))
+		if size > maxBufferSize {
+			return nil, fmt.Errorf("device announced %d bytes for command %d, more than the %d accepted", size, command, maxBufferSize)
+		}
+		return c.readStream(size)
+	default:
+		return nil, fmt.Errorf("device rejected read of command %d (reply code %d)", command, code)
+	}
+}
+
+// readStream collects n bytes of announced data packets and the acknowledgment that follows
+func (c *commandConn) readStream(n int) ([]byte, error) {
+	var chunk []byte
+	for len(chunk) < n {
+		code, _, payload, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if code != gozk.CMD_DATA {
+			return nil, fmt.Errorf("unexpected reply code %d in buffer data", code)
+		}
+		chunk = append(chunk, payload...)
+	}
+	if code, _, _, err := c.readReply(); err != nil {
+		return nil, err
+	} else if code != gozk.CMD_ACK_OK {
+		return nil, errors.New("buffer data not acknowledged")
+	}
+	return chunk, nil
+}
@@ -0,0 +1,174 @@
+package zk
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// attendanceLog builds an attendance log buffer of entries
+func attendanceLog(entries ...[]byte) []byte {
+	data := make([]byte, 4)
+	for _, entry := range entries {
+		data = append(data, entry...)
+	}
+	binary.LittleEndian.PutUint32(data, uint32(len(data)-4))
+	return data
+}
+
+func TestParseAttendanceLog(t *testing.T) {
+	punch := time.Date(2024, 3, 1, 9, 15, 30, 0, time.UTC)
+	clock := encodeDeviceTime(punch)
+
+	entry8 := make([]byte, 8)
+	binary.LittleEndian.PutUint16(entry8[0:], 42)
+	entry8[2] = 1
+	binary.LittleEndian.PutUint32(entry8[3:], clock)
+
+	entry16 := make([]byte, 16)
+	binary.LittleEndian.PutUint32(entry16[0:], 70000)
+	binary.LittleEndian.PutUint32(entry16[4:], clock)
+	entry16[8] = 4
+
+	entry40 := make([]byte, 40)
+	binary.LittleEndian.PutUint16(entry40[0:], 1)
+	copy(entry40[2:26], "1234")
+	entry40[26] = 15
+	binary.LittleEndian.PutUint32(entry40[27:], clock)
+
+	badUser := append([]byte{}, entry40...)
+	copy(badUser[2:26], "12ab")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		count    int
+		userIDs  []int
+		modality string
+		wantErr  bool
+	}{
+		{"8-byte entries", attendanceLog(entry8, entry8), 2, []int{42, 42}, ModalityFingerprint, false},
+		{"16-byte entries", attendanceLog(entry16), 1, []int{70000}, ModalityCard, false},
+		{"40-byte entries", attendanceLog(entry40, entry40, entry40), 3, []int{1234, 1234, 1234}, ModalityFace, false},
+		{"empty log", attendanceLog(), 0, nil, "", false},
+		{"no size", nil, 1, nil, "", false},
+		{"truncated", attendanceLog(entry16)[:12], 1, nil, "", true},
+		{"unsupported entry size", attendanceLog(make([]byte, 24)), 2, nil, "", true},
+		{"non-numeric user ID", attendanceLog(entry40, badUser, entry40), 3, []int{1234, 1234}, ModalityFace, false},
+	}
+	for _, tt := range tests {
+		entries, err := parseAttendanceLog(tt.data, tt.count, time.UTC)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if len(entries) != len(tt.userIDs) {
+			t.Errorf("%s: %d entries, want %d", tt.name, len(entries), len(tt.userIDs))
+			continue
+		}
+		for i, entry := range entries {
+			if entry.UserID != tt.userIDs[i] {
+				t.Errorf("%s: entry %d user = %d, want %d", tt.name, i, entry.UserID, tt.userIDs[i])
+			}
+			if !entry.Time.Equal(punch) {
+				t.Errorf("%s: entry %d time = %v, want %v", tt.name, i, entry.Time, punch)
+			}
+			if entry.Modality != tt.modality {
+				t.Errorf("%s: entry %d modality = %q, want %q", tt.name, i, entry.Modality, tt.modality)
+			}
+		}
+	}
+}
+
+// readHexFrame reads a hex dump under testdata, skipping # comments and whitespace
+func readHexFrame(t *testing.T, name string) []byte {
+	t.Helper()
+	text, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump strings.Builder
+	for _, line := range strings.Split(string(text), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			dump.WriteString(strings.Join(strings.Fields(line), ""))
+		}
+	}
+	data, err := hex.DecodeString(dump.String())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return data
+}
+
+func TestParseAttendanceLogFrames(t *testing.T) {
+	type punch struct {
+		userID   int
+		time     string
+		modality string
+	}
+	tests := []struct {
+		file    string
+		count   int
+		punches []punch
+	}{
+		{"attlog_uface.hex", 5, []punch{
+			{1, "2024-03-01T08:58:12", ModalityFace},
+			{23, "2024-03-01T09:01:40", ModalityFingerprint},
+			{1007, "2024-03-01T12:30:05", ModalityCard},
+			{1, "2024-03-01T17:45:59", ModalityFace},
+			{23, "2024-03-01T18:02:00", ModalityPassword},
+		}},
+		{"attlog_speedface.hex", 5, []punch{
+			{204, "2024-11-03T07:55:30", ModalityPalm},
+			{31, "2024-11-03T07:56:02", ModalityFace},
+			{31, "2024-11-03T16:30:00", "verify_11"},
+			{204, "2024-11-03T16:31:15", ModalityPalm},
+		}},
+	}
+	for _, tt := range tests {
+		entries, err := parseAttendanceLog(readHexFrame(t, tt.file), tt.count, time.UTC)
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if len(entries) != len(tt.punches) {
+			t.Errorf("%s: %d entries, want %d", tt.file, len(entries), len(tt.punches))
+			continue
+		}
+		for i, want := range tt.punches {
+			got := entries[i]
+			if got.UserID != want.userID || got.Time.Format(TimestampLayout) != want.time || got.Modality != want.modality {
+				t.Errorf("%s: entry %d is user %d at %s by %s, want user %d at %s by %s", tt.file, i,
+					got.UserID, got.Time.Format(TimestampLayout), got.Modality, want.userID, want.time, want.modality)
+			}
+		}
+	}
+}
+
+func TestVerifyModality(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{0, ModalityPassword},
+		{1, ModalityFingerprint},
+		{2, ModalityCard},
+		{3, ModalityPassword},
+		{4, ModalityCard},
+		{15, ModalityFace},
+		{25, ModalityPalm},
+		{9, "verify_9"},
+		{255, "verify_255"},
+		{-1, "verify_-1"},
+		{300, "verify_300"},
+	}
+	for _, tt := range tests {
+		if got := VerifyModality(tt.code); got != tt.want {
+			t.Errorf("VerifyModality(%d) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
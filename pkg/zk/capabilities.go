@@ -0,0 +1,107 @@
+package zk
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/canhlinh/gozk"
+)
+
+// Capabilities are the protocol features a terminal's firmware supports. They are detected
+// on the first connection to the device and kept until the collector restarts, so a firmware
+// upgrade is picked up after a restart.
+type Capabilities struct {
+	Firmware      string `json:"firmware"`
+	BufferedReads bool   `json:"buffered_reads"` // Chunked bulk reads, from firmware 6.60
+	Photos        bool   `json:"photos"`         // Attendance photos, on terminals with a camera
+	FaceTemplates bool   `json:"face_templates"`
+	Timezones     bool   `json:"timezones"` // Access control time zone commands
+}
+
+// Oldest firmware version serving CMD_PREPARE_BUFFER
+const bufferedReadsSince = 660
+
+var firmwareVersionPattern = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// firmwareVersion parses "Ver 6.60 Apr 28 2017" into 660, or returns false when the string
+// has no version number
+func firmwareVersion(firmware string) (int, bool) {
+	m := firmwareVersionPattern.FindStringSubmatch(firmware)
+	if m == nil {
+		return 0, false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	if minor < 10 && len(m[2]) == 1 {
+		minor *= 10 // "Ver 6.6" means 6.60
+	}
+	return major*100 + minor, true
+}
+
+// String lists the supported features for the log
+func (c *Capabilities) String() string {
+	var features []string
+	for _, f := range []struct {
+		on   bool
+		name string
+	}{
+		{c.BufferedReads, "buffered reads"},
+		{c.Photos, "photos"},
+		{c.FaceTemplates, "face templates"},
+		{c.Timezones, "time zones"},
+	} {
+		if f.on {
+			features = append(features, f.name)
+		}
+	}
+	if len(features) == 0 {
+		return "basic protocol only"
+	}
+	return strings.Join(features, ", ")
+}
+
+// detectCapabilities reads the firmware version and feature options. Options are missing on
+// old firmware, which is taken to mean the feature is absent. Firmware without a parsable
+// version is assumed to be current.
+func (c *commandConn) detectCapabilities() (*Capabilities, error) {
+	version, err := c.send(gozk.CMD_GET_VERSION, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read firmware version: %w", err)
+	}
+	caps := &Capabilities{Firmware: cString(version)}
+	if v, ok := firmwareVersion(caps.Firmware); !ok || v >= bufferedReadsSince {
+		caps.BufferedReads = true
+	}
+	caps.Photos = c.optionEnabled("PhotoFunOn")
+	caps.FaceTemplates = c.optionEnabled("FaceFunOn")
+	caps.Timezones = c.optionEnabled("~LockFunOn")
+	return caps, nil
+}
+
+// optionEnabled reports whether a numeric feature option is set and non-zero
+func (c *commandConn) optionEnabled(name string) bool {
+	value, err := c.readOption(name)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	return err == nil && n != 0
+}
+
+// capabilities returns the device's capabilities, detecting and logging them on first use.
+// The caller holds the session lock.
+func (s *session) capabilities(zk *ZKManager, c *commandConn) (*Capabilities, error) {
+	if s.caps != nil {
+		return s.caps, nil
+	}
+	caps, err := c.detectCapabilities()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Device %s firmware %q: %s", zk.Name, caps.Firmware, caps)
+	s.caps = caps
+	return caps, nil
+}
@@ -0,0 +1,230 @@
+package zk
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operations that can be captured and replayed
+var captureOperations = map[string]bool{"attendance": true, "users": true, "operation-log": true, "capabilities": true}
+
+// CaptureOperations lists the operations Capture records, sorted
+func CaptureOperations() []string {
+	var names []string
+	for name := range captureOperations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Capture is a recording of every packet exchanged with a terminal during one operation,
+// with what the parsers made of it. Fed back with Replay, it reproduces a firmware-specific
+// parsing problem from the field without the terminal, and kept as a golden file it guards
+// the fix against regressions.
+type Capture struct {
+	Operation       string             `json:"operation"`
+	Device          string             `json:"device"`
+	CapturedAt      string             `json:"captured_at"`
+	Timezone        string             `json:"timezone"`
+	NameEncoding    string             `json:"name_encoding,omitempty"`
+	ReadCardNumbers bool               `json:"read_card_numbers,omitempty"`
+	Paced           bool               `json:"paced,omitempty"` // Read in small chunks, see ChunkPause
+	Exchanges       []CapturedExchange `json:"exchanges"`
+	Result          json.RawMessage    `json:"result,omitempty"` // What the operation returned
+	Error           string             `json:"error,omitempty"`  // Or how it failed
+}
+
+// CapturedExchange is a packet written to the terminal and the bytes read back before the
+// next one was written
+type CapturedExchange struct {
+	Command  int    `json:"command"`
+	Sent     string `json:"sent"`     // Hex
+	Received string `json:"received"` // Hex
+}
+
+// capturedCommand returns the command code of a packet written to the terminal
+func capturedCommand(packet []byte) int {
+	if len(packet) < 10 {
+		return -1
+	}
+	return int(binary.LittleEndian.Uint16(packet[8:]))
+}
+
+// recorder collects the exchanges of a capture, across the connections an operation opens
+type recorder struct {
+	mu        sync.Mutex
+	exchanges []CapturedExchange
+	received  [][]byte // Bytes read for each exchange, hex-encoded when the capture ends
+}
+
+// recordingTransport passes packets through to the terminal, recording them
+type recordingTransport struct {
+	transport
+	rec *recorder
+}
+
+func (t *recordingTransport) Write(p []byte) (int, error) {
+	t.rec.mu.Lock()
+	t.rec.exchanges = append(t.rec.exchanges, CapturedExchange{Command: capturedCommand(p), Sent: hex.EncodeToString(p)})
+	t.rec.received = append(t.rec.received, nil)
+	t.rec.mu.Unlock()
+	return t.transport.Write(p)
+}
+
+func (t *recordingTransport) Read(p []byte) (int, error) {
+	n, err := t.transport.Read(p)
+	t.rec.mu.Lock()
+	if last := len(t.rec.received) - 1; last >= 0 && n > 0 {
+		t.rec.received[last] = append(t.rec.received[last], p[:n]...)
+	}
+	t.rec.mu.Unlock()
+	return n, err
+}
+
+// replaySource serves the bytes of a capture in place of the terminal
+type replaySource struct {
+	exchanges []CapturedExchange
+	next      int
+	pending   []byte
+}
+
+// replayTransport is a connection opened on a replay source. The source outlives it, so an
+// operation opening several connections gets the exchanges of each in turn.
+type replayTransport struct {
+	src *replaySource
+}
+
+func (t replayTransport) Write(p []byte) (int, error) {
+	src := t.src
+	if src.next >= len(src.exchanges) {
+		return 0, fmt.Errorf("capture ends before packet %d (command %d)", src.next+1, capturedCommand(p))
+	}
+	exchange := src.exchanges[src.next]
+	if command := capturedCommand(p); command != exchange.Command {
+		return 0, fmt.Errorf("replay diverged at packet %d: sent command %d, capture has %d", src.next+1, command, exchange.Command)
+	}
+	received, err := hex.DecodeString(exchange.Received)
+	if err != nil {
+		return 0, fmt.Errorf("invalid capture packet %d: %v", src.next+1, err)
+	}
+	src.next++
+	src.pending = received
+	return len(p), nil
+}
+
+// Read serves what the terminal sent after the last packet, then end of file as if it had
+// stopped answering, so a capture of a cut-off read replays as one
+func (t replayTransport) Read(p []byte) (int, error) {
+	if len(t.src.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, t.src.pending)
+	t.src.pending = t.src.pending[n:]
+	return n, nil
+}
+
+func (t replayTransport) Close() error                { return nil }
+func (t replayTransport) SetDeadline(time.Time) error { return nil }
+
+// runCaptured runs a capturable operation with the built-in protocol client and returns
+// its result
+func (zk *ZKManager) runCaptured(operation string) (interface{}, error) {
+	switch operation {
+	case "attendance":
+		records, err := zk.GetAttendance(time.Time{})
+		return records, err
+	case "users":
+		users, err := zk.GetUsers()
+		return users, err
+	case "operation-log":
+		operations, err := zk.GetOperationLog()
+		return operations, err
+	case "capabilities":
+		var caps *Capabilities
+		err := zk.withCommandConn(func(c *commandConn) error {
+			caps = c.caps
+			return nil
+		})
+		return caps, err
+	}
+	return nil, fmt.Errorf("unknown operation %q (known: %v)", operation, CaptureOperations())
+}
+
+// forgetCapabilities drops the capabilities detected for the device, so the next
+// connection detects them again
+func (zk *ZKManager) forgetCapabilities() {
+	s := zk.getSession()
+	s.mu.Lock()
+	s.caps = nil
+	s.mu.Unlock()
+}
+
+// Capture runs an operation against the terminal with the built-in protocol client, without
+// retries, and records every packet exchanged, capability detection included. The capture
+// is returned when the operation fails, with the error recorded, so a failing read can be
+// sent in from the field as well.
+func (zk *ZKManager) Capture(operation string) (*Capture, error) {
+	if !captureOperations[operation] {
+		return nil, fmt.Errorf("unknown operation %q (known: %v)", operation, CaptureOperations())
+	}
+	client := *zk
+	client.ReadModality, client.Retries = true, 0
+	client.recorder = &recorder{}
+	client.forgetCapabilities()
+	result, err := client.runCaptured(operation)
+
+	capture := &Capture{
+		Operation:       operation,
+		Device:          zk.Name,
+		CapturedAt:      time.Now().Format(time.RFC3339),
+		Timezone:        zk.location().String(),
+		NameEncoding:    zk.NameEncoding,
+		ReadCardNumbers: zk.ReadCardNumbers,
+		Paced:           zk.ChunkPause > 0,
+	}
+	for i, exchange := range client.recorder.exchanges {
+		exchange.Received = hex.EncodeToString(client.recorder.received[i])
+		capture.Exchanges = append(capture.Exchanges, exchange)
+	}
+	if err != nil {
+		capture.Error = err.Error()
+	} else if capture.Result, err = json.Marshal(result); err != nil {
+		return nil, err
+	}
+	return capture, nil
+}
+
+// Replay runs a captured operation against the recorded packets instead of the terminal and
+// returns its result, which can be compared with the capture's Result. It fails when the
+// client sends a command the terminal wasn't sent when capturing.
+func Replay(capture *Capture) (interface{}, error) {
+	if !captureOperations[capture.Operation] {
+		return nil, fmt.Errorf("unknown operation %q (known: %v)", capture.Operation, CaptureOperations())
+	}
+	if len(capture.Exchanges) == 0 {
+		return nil, errors.New("capture has no packets")
+	}
+	client := &ZKManager{
+		IP:              "replay",
+		Name:            capture.Device,
+		ReadModality:    true,
+		ReadCardNumbers: capture.ReadCardNumbers,
+		NameEncoding:    capture.NameEncoding,
+		zkTimezone:      capture.Timezone,
+		replay:          &replaySource{exchanges: capture.Exchanges},
+	}
+	if capture.Paced {
+		// Paced reads ask for smaller chunks; the pause itself doesn't matter here
+		client.ChunkPause = time.Nanosecond
+	}
+	client.forgetCapabilities()
+	return client.runCaptured(capture.Operation)
+}
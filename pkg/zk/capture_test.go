@@ -0,0 +1,80 @@
+package zk
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readCaptureFile reads a capture under testdata/captures
+func readCaptureFile(t *testing.T, path string) *Capture {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var capture Capture
+	if err := json.Unmarshal(data, &capture); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return &capture
+}
+
+// sameResult reports whether two JSON results hold the same values
+func sameResult(a, b []byte) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestReplayCaptures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "captures", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no captures under testdata/captures")
+	}
+	for _, file := range files {
+		capture := readCaptureFile(t, file)
+		result, err := Replay(capture)
+		if err != nil {
+			if err.Error() != capture.Error {
+				t.Errorf("%s: replay failed with %q, captured %q", file, err, capture.Error)
+			}
+			continue
+		}
+		if capture.Error != "" {
+			t.Errorf("%s: replay succeeded, captured the error %q", file, capture.Error)
+			continue
+		}
+		got, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameResult(got, capture.Result) {
+			t.Errorf("%s: replayed %s\nwant %s", file, got, capture.Result)
+		}
+	}
+}
+
+func TestReplayUncapturedCommand(t *testing.T) {
+	capture := readCaptureFile(t, filepath.Join("testdata", "captures", "attendance_16.json"))
+	capture.Exchanges = capture.Exchanges[:len(capture.Exchanges)/2]
+	if _, err := Replay(capture); err == nil {
+		t.Error("replay of a capture cut in half succeeded, want an error")
+	}
+
+	capture.Exchanges = nil
+	if _, err := Replay(capture); err == nil {
+		t.Error("replay of a capture without packets succeeded, want an error")
+	}
+	capture.Operation = "reboot"
+	if _, err := Replay(capture); err == nil {
+		t.Error("replay of an unknown operation succeeded, want an error")
+	}
+}
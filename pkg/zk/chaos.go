@@ -0,0 +1,43 @@
+package zk
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// deviceChaos makes device operations fail on purpose, see SetDeviceChaos
+var deviceChaos = struct {
+	sync.Mutex
+	timeoutPercent int
+	rng            *rand.Rand
+}{}
+
+// SetDeviceChaos makes timeoutPercent percent of device operations fail as if the device
+// had timed out, after waiting out the read timeout, so retries and buffering can be tested
+// without a flaky network. Each attempt of a retried operation rolls again. Zero turns it off.
+func SetDeviceChaos(timeoutPercent int, seed int64) {
+	deviceChaos.Lock()
+	defer deviceChaos.Unlock()
+	deviceChaos.timeoutPercent = timeoutPercent
+	deviceChaos.rng = rand.New(rand.NewSource(seed))
+}
+
+// chaosTimeout reports whether an operation should fail with an injected timeout
+func chaosTimeout() bool {
+	deviceChaos.Lock()
+	defer deviceChaos.Unlock()
+	return deviceChaos.timeoutPercent > 0 && deviceChaos.rng.Intn(100) < deviceChaos.timeoutPercent
+}
+
+// withChaos wraps an operation so it may fail with an injected timeout
+func (zk *ZKManager) withChaos(fn func() error) func() error {
+	return func() error {
+		if !chaosTimeout() {
+			return fn()
+		}
+		time.Sleep(zk.readTimeout())
+		return fmt.Errorf("%w: injected timeout (CHAOS)", ErrDeviceUnreachable)
+	}
+}
@@ -0,0 +1,201 @@
+package zk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// Markers opening every TCP packet in the device protocol
+const (
+	tcpMarker1 = 0x5050
+	tcpMarker2 = 0x7d82
+)
+
+// transport carries protocol packets to the device: a TCP connection or a serial port
+type transport interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+}
+
+// commandConn is a minimal client for device commands the gozk library does not expose.
+// It speaks the same TCP protocol on its own short-lived connection.
+type commandConn struct {
+	conn      transport
+	device    string        // Device name for protocol debug lines
+	timeout   time.Duration // Deadline for each write/reply exchange
+	sessionID uint16
+	replyID   uint16
+	caps      *Capabilities
+	// Pause between chunks of bulk reads, see ZKManager.ChunkPause
+	chunkPause time.Duration
+}
+
+// dialCommand opens a command connection to the device and starts a protocol session
+func (zk *ZKManager) dialCommand() (*commandConn, error) {
+	conn, err := zk.openTransport()
+	if err != nil {
+		return nil, err
+	}
+	c := &commandConn{conn: conn, device: zk.Name, timeout: zk.readTimeout(), replyID: gozk.USHRT_MAX - 1, chunkPause: zk.ChunkPause}
+	code, session, _, err := c.exchange(gozk.CMD_CONNECT, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if code == gozk.CMD_ACK_UNAUTH {
+		conn.Close()
+		return nil, fmt.Errorf("%w: device requires a comm key, which is not supported", ErrAuthFailed)
+	}
+	c.sessionID = session
+	return c, nil
+}
+
+// send runs a command and returns the reply payload, failing unless the device acknowledges it
+func (c *commandConn) send(command int, data []byte) ([]byte, error) {
+	code, _, payload, err := c.exchange(command, data)
+	if err != nil {
+		return nil, err
+	}
+	if code != gozk.CMD_ACK_OK && code != gozk.CMD_PREPARE_DATA && code != gozk.CMD_DATA {
+		return nil, fmt.Errorf("device rejected command %d (reply code %d)", command, code)
+	}
+	return payload, nil
+}
+
+// close ends the protocol session and the connection
+func (c *commandConn) close() {
+	c.exchange(gozk.CMD_EXIT, nil)
+	c.conn.Close()
+}
+
+// exchange writes one command packet and reads the reply header and payload
+func (c *commandConn) exchange(command int, data []byte) (code int, session uint16, payload []byte, err error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.debugPacket(">", command, data)
+	if _, err := c.conn.Write(c.packet(command, data)); err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+	return c.readReply()
+}
+
+// readReply reads one packet from the device, such as a command reply or streamed data
+func (c *commandConn) readReply() (code int, session uint16, payload []byte, err error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	top := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, top); err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+	return c.readPacket(top)
+}
+
+// readPacket reads the rest of a packet whose TCP top has been read
+func (c *commandConn) readPacket(top []byte) (code int, session uint16, payload []byte, err error) {
+	if binary.LittleEndian.Uint16(top[0:]) != tcpMarker1 || binary.LittleEndian.Uint16(top[2:]) != tcpMarker2 {
+		return 0, 0, nil, errors.New("invalid reply packet")
+	}
+	length := binary.LittleEndian.Uint32(top[4:])
+	if length < 8 {
+		return 0, 0, nil, errors.New("short reply packet")
+	}
+	// The length comes from the device; a wrong one mustn't make the collector allocate gigabytes
+	if length > maxPacketSize {
+		return 0, 0, nil, fmt.Errorf("reply packet of %d bytes, more than the %d accepted", length, maxPacketSize)
+	}
+	reply := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+	c.replyID = binary.LittleEndian.Uint16(reply[6:])
+	c.debugPacket("<", int(binary.LittleEndian.Uint16(reply[0:])), reply[8:])
+	return int(binary.LittleEndian.Uint16(reply[0:])), binary.LittleEndian.Uint16(reply[4:]), reply[8:], nil
+}
+
+// packet frames a command the way the device expects: TCP top, then a header whose
+// checksum covers the previous reply ID, then the command data
+func (c *commandConn) packet(command int, data []byte) []byte {
+	header := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint16(header[0:], uint16(command))
+	binary.LittleEndian.PutUint16(header[4:], c.sessionID)
+	binary.LittleEndian.PutUint16(header[6:], c.replyID)
+	header = append(header, data...)
+	binary.LittleEndian.PutUint16(header[2:], checksum(header))
+
+	c.replyID++
+	if c.replyID >= gozk.USHRT_MAX {
+		c.replyID -= gozk.USHRT_MAX
+	}
+	binary.LittleEndian.PutUint16(header[6:], c.replyID)
+
+	top := make([]byte, 8, 8+len(header))
+	binary.LittleEndian.PutUint16(top[0:], tcpMarker1)
+	binary.LittleEndian.PutUint16(top[2:], tcpMarker2)
+	binary.LittleEndian.PutUint32(top[4:], uint32(len(header)))
+	return append(top, header...)
+}
+
+// checksum is the protocol's ones' complement sum over little-endian 16-bit words
+func checksum(buf []byte) uint16 {
+	sum := 0
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += int(binary.LittleEndian.Uint16(buf[i:]))
+		if sum > gozk.USHRT_MAX {
+			sum -= gozk.USHRT_MAX
+		}
+	}
+	if len(buf)%2 == 1 {
+		sum += int(buf[len(buf)-1])
+	}
+	for sum > gozk.USHRT_MAX {
+		sum -= gozk.USHRT_MAX
+	}
+	sum = ^sum
+	for sum < 0 {
+		sum += gozk.USHRT_MAX
+	}
+	return uint16(sum)
+}
+
+// withCommandConn runs fn, which only reads from the device, on a command connection, holding
+// the device lock. A kept-open gozk session is closed first, since terminals generally serve
+// one client connection at a time.
+func (zk *ZKManager) withCommandConn(fn func(c *commandConn) error) error {
+	return zk.commandSession(true, fn)
+}
+
+// withCommandWrite is withCommandConn for fn changing the device. It is retried while the
+// device can't be connected to, but not once the write may have been sent: a reply lost
+// after a clear, a clock change or a user write is reported rather than risking it twice.
+func (zk *ZKManager) withCommandWrite(fn func(c *commandConn) error) error {
+	return zk.commandSession(false, fn)
+}
+
+// commandSession runs fn on a command connection, retrying a failed fn only if idempotent
+func (zk *ZKManager) commandSession(idempotent bool, fn func(c *commandConn) error) error {
+	return zk.withRetries(func() error {
+		s := zk.getSession()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.close()
+
+		c, err := zk.dialCommand()
+		if err != nil {
+			return err
+		}
+		defer c.close()
+		if c.caps, err = s.capabilities(zk, c); err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			if !idempotent {
+				return sentError{err}
+			}
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+package zk
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// packetTop is the TCP top of a packet announcing length bytes
+func packetTop(length uint32) []byte {
+	top := make([]byte, 8)
+	binary.LittleEndian.PutUint16(top[0:], tcpMarker1)
+	binary.LittleEndian.PutUint16(top[2:], tcpMarker2)
+	binary.LittleEndian.PutUint32(top[4:], length)
+	return top
+}
+
+func TestReadReplyLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  uint32
+		wantErr bool
+	}{
+		{"header only", 8, false},
+		{"largest chunk", maxPacketSize, false},
+		{"short", 7, true},
+		{"over the largest chunk", maxPacketSize + 1, true},
+		{"gigabytes", 0xFFFFFFFF, true},
+	}
+	for _, tt := range tests {
+		client, device := net.Pipe()
+		c := &commandConn{conn: client, timeout: time.Second}
+		go func(length uint32) {
+			device.Write(packetTop(length))
+			if length >= 8 && length <= maxPacketSize {
+				device.Write(make([]byte, length))
+			}
+		}(tt.length)
+		_, _, payload, err := c.readReply()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		} else if err == nil && len(payload) != int(tt.length)-8 {
+			t.Errorf("%s: payload of %d bytes, want %d", tt.name, len(payload), tt.length-8)
+		}
+		client.Close()
+		device.Close()
+	}
+}
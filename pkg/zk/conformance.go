@@ -0,0 +1,578 @@
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// How long a conformance check may run before it counts as hung
+const conformanceTimeout = 30 * time.Second
+
+// ConformanceCheck is one check of the protocol clients against a Simulator
+type ConformanceCheck struct {
+	Name string // Prefixed with its area: connect, auth, read, control, realtime or fault
+	Run  func() error
+}
+
+// ConformanceResult is the outcome of a conformance check
+type ConformanceResult struct {
+	Name string
+	Err  error
+	Took time.Duration
+}
+
+// ConformanceChecks lists the checks RunConformance runs. Each starts its own simulator, so
+// they don't depend on each other or on a terminal being at hand.
+func ConformanceChecks() []ConformanceCheck {
+	return []ConformanceCheck{
+		{"connect", checkConnect},
+		{"connect/persistent", checkPersistent},
+		{"auth/comm-key", checkCommKey},
+		{"read/chunked", checkChunkedRead},
+		{"read/paced", checkPacedRead},
+		{"read/record-formats", checkRecordFormats},
+		{"read/old-firmware", checkOldFirmware},
+		{"read/gozk", checkGozkRead},
+		{"read/users", checkReadUsers},
+		{"read/operation-log", checkOperationLog},
+		{"control", checkControl},
+		{"realtime", checkRealtime},
+		{"fault/truncated-frame", checkTruncatedFrame},
+		{"fault/truncated-frame/gozk", checkGozkTruncatedFrame},
+		{"fault/reset", checkReset},
+		{"fault/reset-retry", checkResetRetry},
+		{"fault/bad-marker", checkBadMarker},
+		{"fault/timeout", checkTimeout},
+		{"fault/rejected", checkRejected},
+	}
+}
+
+// RunConformance runs the checks whose name match accepts, all of them when match is nil.
+// A check that panics or hangs fails rather than stopping the run.
+func RunConformance(match func(name string) bool) []ConformanceResult {
+	var results []ConformanceResult
+	for _, check := range ConformanceChecks() {
+		if match != nil && !match(check.Name) {
+			continue
+		}
+		start := time.Now()
+		done := make(chan error, 1)
+		go func(run func() error) {
+			defer func() {
+				if r := recover(); r != nil {
+					done <- fmt.Errorf("panic: %v", r)
+				}
+			}()
+			done <- run()
+		}(check.Run)
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(conformanceTimeout):
+			err = fmt.Errorf("no result after %v", conformanceTimeout)
+		}
+		results = append(results, ConformanceResult{Name: check.Name, Err: err, Took: time.Since(start)})
+	}
+	return results
+}
+
+// simulate starts a simulator and returns a client for it with short timeouts. The caller
+// closes the simulator.
+func simulate(sim *Simulator) (*ZKManager, error) {
+	if err := sim.Start(); err != nil {
+		return nil, err
+	}
+	zk := sim.Manager()
+	zk.ConnectTimeout, zk.ReadTimeout = time.Second, time.Second
+	return zk, nil
+}
+
+// samplePunches returns n punches by 50 users over the verify codes of multi-bio terminals
+func samplePunches(n int, loc *time.Location) []SimulatedPunch {
+	codes := []byte{1, 15, 25, 2, 0}
+	start := time.Date(2026, 10, 16, 8, 0, 0, 0, loc)
+	punches := make([]SimulatedPunch, n)
+	for i := range punches {
+		punches[i] = SimulatedPunch{UserID: 100 + i%50, Time: start.Add(time.Duration(i) * 37 * time.Second), Verify: codes[i%len(codes)]}
+	}
+	return punches
+}
+
+// expectPunches compares records read from a simulator with its punches, and their
+// modalities unless the client drops them
+func expectPunches(records []AttendanceRecord, punches []SimulatedPunch, loc *time.Location, modality bool) error {
+	if len(records) != len(punches) {
+		return fmt.Errorf("read %d record(s), expected %d", len(records), len(punches))
+	}
+	for i, p := range punches {
+		r := records[i]
+		if want := p.Time.In(loc).Format(TimestampLayout); r.UserID != p.UserID || r.Timestamp != want {
+			return fmt.Errorf("record %d is user %d at %s, expected user %d at %s", i, r.UserID, r.Timestamp, p.UserID, want)
+		}
+		if want := verifyModality(p.Verify); modality && r.Modality != want {
+			return fmt.Errorf("record %d has modality %q, expected %q", i, r.Modality, want)
+		}
+	}
+	return nil
+}
+
+// expectClean fails when the simulator saw packets with a bad checksum
+func expectClean(sim *Simulator) error {
+	if n := sim.BadChecksums(); n > 0 {
+		return fmt.Errorf("%d packet(s) sent with a bad checksum", n)
+	}
+	return nil
+}
+
+func checkConnect() error {
+	sim := &Simulator{SerialNumber: "SIM4410001"}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	serial, err := zk.GetSerialNumber()
+	if err != nil {
+		return err
+	}
+	if serial != sim.SerialNumber {
+		return fmt.Errorf("serial number %q, expected %q", serial, sim.SerialNumber)
+	}
+	if sim.Commands(gozk.CMD_EXIT) != 1 {
+		return errors.New("session not ended with CMD_EXIT")
+	}
+	return expectClean(sim)
+}
+
+func checkPersistent() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	punches := samplePunches(20, sim.location())
+	sim.AddPunches(punches...)
+	zk.Persistent = true
+	defer CloseSessions()
+	for i := 0; i < 2; i++ {
+		records, err := zk.GetAttendance(time.Time{})
+		if err != nil {
+			return err
+		}
+		if err := expectPunches(records, punches, sim.location(), false); err != nil {
+			return err
+		}
+	}
+	if n := sim.Commands(gozk.CMD_CONNECT); n != 1 {
+		return fmt.Errorf("%d sessions opened for two reads, expected 1", n)
+	}
+	return expectClean(sim)
+}
+
+func checkCommKey() error {
+	sim := &Simulator{CommKey: true}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	if _, err := zk.GetSerialNumber(); !errors.Is(err, ErrAuthFailed) {
+		return fmt.Errorf("built-in client: %v, expected an authentication failure", err)
+	}
+	if _, err := zk.GetAttendance(time.Time{}); !errors.Is(err, ErrAuthFailed) {
+		return fmt.Errorf("gozk: %v, expected an authentication failure", err)
+	}
+	return nil
+}
+
+func checkChunkedRead() error {
+	sim := &Simulator{Stream: true}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	punches := samplePunches(3000, sim.location())
+	sim.AddPunches(punches...)
+	zk.ReadModality = true
+	records, err := zk.GetAttendance(time.Time{})
+	if err != nil {
+		return err
+	}
+	if err := expectPunches(records, punches, sim.location(), true); err != nil {
+		return err
+	}
+	// 3000 entries of 40 bytes take two chunks of at most maxBufferChunk
+	if n := sim.Commands(gozk.CMD_READ_BUFFER); n != 2 {
+		return fmt.Errorf("read in %d chunk(s), expected 2", n)
+	}
+	if sim.Commands(gozk.CMD_FREE_DATA) == 0 {
+		return errors.New("buffer not freed")
+	}
+	return expectClean(sim)
+}
+
+func checkPacedRead() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	punches := samplePunches(3000, sim.location())
+	sim.AddPunches(punches...)
+	zk.ChunkPause = time.Millisecond
+	records, err := zk.GetAttendance(time.Time{})
+	if err != nil {
+		return err
+	}
+	if err := expectPunches(records, punches, sim.location(), true); err != nil {
+		return err
+	}
+	if n, want := sim.Commands(gozk.CMD_READ_BUFFER), (4+3000*40+pacedBufferChunk-1)/pacedBufferChunk; n != want {
+		return fmt.Errorf("read in %d chunk(s), expected %d", n, want)
+	}
+	return expectClean(sim)
+}
+
+func checkRecordFormats() error {
+	for _, size := range []int{8, 16, 40} {
+		sim := &Simulator{RecordSize: size}
+		zk, err := simulate(sim)
+		if err != nil {
+			return err
+		}
+		punches := samplePunches(100, sim.location())
+		sim.AddPunches(punches...)
+		zk.ReadModality = true
+		records, err := zk.GetAttendance(time.Time{})
+		if err == nil {
+			err = expectPunches(records, punches, sim.location(), true)
+		}
+		sim.Close()
+		if err != nil {
+			return fmt.Errorf("%d-byte records: %v", size, err)
+		}
+	}
+	return nil
+}
+
+func checkOldFirmware() error {
+	sim := &Simulator{Firmware: "Ver 6.21 Dec 12 2012", RecordSize: 16}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	punches := samplePunches(500, sim.location())
+	sim.AddPunches(punches...)
+	zk.ReadModality = true
+	records, err := zk.GetAttendance(time.Time{})
+	if err != nil {
+		return err
+	}
+	if err := expectPunches(records, punches, sim.location(), true); err != nil {
+		return err
+	}
+	if sim.Commands(cmdPrepareBuffer) > 0 {
+		return errors.New("buffered read attempted on firmware without it")
+	}
+	return expectClean(sim)
+}
+
+func checkGozkRead() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	punches := samplePunches(3000, sim.location())
+	sim.AddPunches(punches...)
+	records, err := zk.GetAttendance(time.Time{})
+	if err != nil {
+		return err
+	}
+	if err := expectPunches(records, punches, sim.location(), false); err != nil {
+		return err
+	}
+	return expectClean(sim)
+}
+
+func checkReadUsers() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	want := []User{{UserID: 101, Name: "Ada", CardNumber: 5551}, {UserID: 102, Name: "Zoë", Privilege: 14}}
+	sim.SetUsers(want)
+	users, err := zk.GetUsers()
+	if err != nil {
+		return err
+	}
+	if fmt.Sprint(users) != fmt.Sprint(want) {
+		return fmt.Errorf("read users %v, expected %v", users, want)
+	}
+	return expectClean(sim)
+}
+
+func checkOperationLog() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	at := time.Date(2026, 10, 16, 7, 55, 0, 0, sim.location())
+	sim.SetOperations([]Operation{
+		{Code: opPowerOn, Time: at},
+		{Admin: 1, Code: opAlarm, Time: at.Add(time.Minute), Params: [4]int{alarmTamper}},
+	})
+	operations, err := zk.GetOperationLog()
+	if err != nil {
+		return err
+	}
+	var actions []string
+	for _, op := range operations {
+		actions = append(actions, op.Action+"@"+op.Time.Format("15:04"))
+	}
+	if got := strings.Join(actions, ","); got != "power_on@07:55,tamper@07:56" {
+		return fmt.Errorf("read operations %s, expected power_on@07:55,tamper@07:56", got)
+	}
+	return expectClean(sim)
+}
+
+func checkControl() error {
+	sim := &Simulator{SerialNumber: "SIM4410002"}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	sim.AddPunches(samplePunches(10, sim.location())...)
+
+	at := time.Now().Add(-90 * time.Minute)
+	if err := zk.SetTime(at); err != nil {
+		return fmt.Errorf("set time: %v", err)
+	}
+	if skew := sim.Clock().Sub(at); skew < -2*time.Second || skew > 2*time.Second {
+		return fmt.Errorf("clock set %v off", skew)
+	}
+	if err := zk.SetUser(User{UserID: 150, Name: "New Hire", CardNumber: 42}); err != nil {
+		return fmt.Errorf("set user: %v", err)
+	}
+	if users := sim.Users(); len(users) != 1 || users[0].Name != "New Hire" || users[0].CardNumber != 42 {
+		return fmt.Errorf("users after enrollment: %v", users)
+	}
+	d, err := zk.GetDiagnostics()
+	if err != nil {
+		return fmt.Errorf("diagnostics: %v", err)
+	}
+	if d.SerialNumber != sim.SerialNumber || d.Records != 10 || d.Users != 1 || d.Cards != 1 {
+		return fmt.Errorf("diagnostics report serial %q, %d records, %d users and %d cards", d.SerialNumber, d.Records, d.Users, d.Cards)
+	}
+	if err := zk.UnlockDoor(3 * time.Second); err != nil {
+		return fmt.Errorf("unlock: %v", err)
+	}
+	if err := zk.ClearAttendance(); err != nil {
+		return fmt.Errorf("clear attendance: %v", err)
+	}
+	if n := len(sim.Punches()); n != 0 {
+		return fmt.Errorf("%d punches left after clearing", n)
+	}
+	return expectClean(sim)
+}
+
+func checkRealtime() error {
+	for _, size := range []int{8, 16, 40} {
+		if err := checkRealtimeFormat(size); err != nil {
+			return fmt.Errorf("%d-byte records: %v", size, err)
+		}
+	}
+	return nil
+}
+
+// checkRealtimeFormat watches a simulator with the given record size for three punches
+func checkRealtimeFormat(size int) error {
+	sim := &Simulator{RecordSize: size}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	stop := make(chan struct{})
+	got := make(chan AttendanceRecord, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- zk.WatchAttendance(stop, func(r AttendanceRecord) { got <- r })
+	}()
+	for deadline := time.Now().Add(2 * time.Second); sim.Watchers() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			close(stop)
+			return errors.New("client did not register for events")
+		}
+	}
+
+	punches := samplePunches(3, sim.location())
+	var records []AttendanceRecord
+	for _, p := range punches {
+		sim.Punch(p)
+		select {
+		case r := <-got:
+			records = append(records, r)
+		case <-time.After(2 * time.Second):
+			close(stop)
+			return fmt.Errorf("received %d of %d events", len(records), len(punches))
+		}
+	}
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-time.After(3 * time.Second):
+		return errors.New("watch did not stop")
+	}
+	if err := expectPunches(records, punches, sim.location(), true); err != nil {
+		return err
+	}
+	if n := sim.Commands(gozk.CMD_ACK_OK); n != len(punches) {
+		return fmt.Errorf("%d event(s) acknowledged, expected %d", n, len(punches))
+	}
+	if sim.Watchers() != 0 {
+		return errors.New("still registered for events after stopping")
+	}
+	return expectClean(sim)
+}
+
+func checkTruncatedFrame() error {
+	sim := &Simulator{Stream: true}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	sim.AddPunches(samplePunches(3000, sim.location())...)
+	sim.Inject(SimFault{Command: gozk.CMD_READ_BUFFER, Kind: FaultTruncate})
+	zk.ReadModality = true
+	if _, err := zk.GetAttendance(time.Time{}); !errors.Is(err, ErrDeviceUnreachable) {
+		return fmt.Errorf("%v, expected the device to be unreachable", err)
+	}
+	return nil
+}
+
+func checkGozkTruncatedFrame() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	sim.AddPunches(samplePunches(10, sim.location())...)
+	sim.Inject(SimFault{Command: gozk.CMD_GET_FREE_SIZES, Kind: FaultTruncate})
+	if _, err := zk.GetAttendance(time.Time{}); err == nil {
+		return errors.New("read succeeded from a truncated reply")
+	}
+	return nil
+}
+
+func checkReset() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	sim.AddPunches(samplePunches(10, sim.location())...)
+	sim.Inject(SimFault{Command: gozk.CMD_GET_FREE_SIZES, Kind: FaultReset})
+	zk.ReadModality = true
+	if _, err := zk.GetAttendance(time.Time{}); !errors.Is(err, ErrDeviceUnreachable) {
+		return fmt.Errorf("%v, expected the device to be unreachable", err)
+	}
+	return nil
+}
+
+func checkResetRetry() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	punches := samplePunches(10, sim.location())
+	sim.AddPunches(punches...)
+	sim.Inject(SimFault{Command: gozk.CMD_GET_FREE_SIZES, Kind: FaultReset, Count: 1})
+	zk.ReadModality, zk.Retries = true, 1
+	records, err := zk.GetAttendance(time.Time{})
+	if err != nil {
+		return fmt.Errorf("not recovered by the retry: %v", err)
+	}
+	if n := sim.Commands(gozk.CMD_CONNECT); n != 2 {
+		return fmt.Errorf("%d session(s) opened, expected 2", n)
+	}
+	return expectPunches(records, punches, sim.location(), true)
+}
+
+func checkBadMarker() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	sim.AddPunches(samplePunches(10, sim.location())...)
+	sim.Inject(SimFault{Command: gozk.CMD_GET_FREE_SIZES, Kind: FaultCorrupt})
+	zk.ReadModality = true
+	if _, err := zk.GetAttendance(time.Time{}); err == nil || !strings.Contains(err.Error(), "invalid reply packet") {
+		return fmt.Errorf("%v, expected an invalid reply packet", err)
+	}
+	return nil
+}
+
+func checkTimeout() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	sim.AddPunches(samplePunches(10, sim.location())...)
+	delay := 3 * zk.ReadTimeout
+	sim.Inject(SimFault{Command: gozk.CMD_GET_FREE_SIZES, Kind: FaultDelay, Delay: delay})
+	zk.ReadModality = true
+	start := time.Now()
+	if _, err := zk.GetAttendance(time.Time{}); !errors.Is(err, ErrDeviceUnreachable) {
+		return fmt.Errorf("%v, expected the device to be unreachable", err)
+	}
+	if took := time.Since(start); took >= delay {
+		return fmt.Errorf("gave up after %v, past ReadTimeout %v", took, zk.ReadTimeout)
+	}
+	return nil
+}
+
+func checkRejected() error {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		return err
+	}
+	defer sim.Close()
+	sim.Inject(SimFault{Command: gozk.CMD_OPTIONS_RRQ, Kind: FaultReject})
+	_, err = zk.GetSerialNumber()
+	if err == nil {
+		return errors.New("serial number read from a rejected command")
+	}
+	// A rejection comes from a reachable device, so it must not be retried
+	if errors.Is(err, ErrDeviceUnreachable) {
+		return fmt.Errorf("%v, expected a rejection", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package zk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// User is a terminal user record as written by SetUser
+type User struct {
+	UserID     int    // Badge number the terminal stamps on punches
+	Name       string // Shown on the terminal, truncated to 24 bytes
+	CardNumber uint32 // 0 for no card
+	Privilege  int    // 0 for a normal user, 14 for an administrator
+}
+
+// PrivilegeDisabled is the privilege bit of users the terminal refuses to verify
+const PrivilegeDisabled = 1
+
+// Disabled reports whether the terminal refuses the user
+func (u User) Disabled() bool {
+	return u.Privilege&PrivilegeDisabled != 0
+}
+
+// SetTime sets the terminal clock to t, expressed in the device timezone
+func (zk *ZKManager) SetTime(t time.Time) error {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, encodeDeviceTime(t.In(zk.location())))
+	return zk.withCommandWrite(func(c *commandConn) error {
+		if _, err := c.send(gozk.CMD_SET_TIME, data); err != nil {
+			return fmt.Errorf("failed to set time: %w", err)
+		}
+		return nil
+	})
+}
+
+// ClearAttendance deletes every attendance record stored on the terminal
+func (zk *ZKManager) ClearAttendance() error {
+	return zk.withCommandWrite(func(c *commandConn) error {
+		if _, err := c.send(gozk.CMD_CLEAR_ATTLOG, nil); err != nil {
+			return fmt.Errorf("failed to clear attendance: %w", err)
+		}
+		return nil
+	})
+}
+
+// UnlockDoor releases the door relay for d
+func (zk *ZKManager) UnlockDoor(d time.Duration) error {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, uint32(d/(100*time.Millisecond))) // Tenths of a second
+	return zk.withCommandWrite(func(c *commandConn) error {
+		if _, err := c.send(gozk.CMD_UNLOCK, data); err != nil {
+			return fmt.Errorf("failed to unlock door: %w", err)
+		}
+		return nil
+	})
+}
+
+// SetUser creates or overwrites a user on the terminal. It writes the 72-byte user
+// record used by current firmware, keyed on the user ID as the internal slot number.
+func (zk *ZKManager) SetUser(user User) error {
+	if user.UserID <= 0 || user.UserID >= gozk.USHRT_MAX {
+		return fmt.Errorf("user ID %d out of range", user.UserID)
+	}
+	name, err := encodeName(user.Name, zk.NameEncoding, 24)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 72)
+	binary.LittleEndian.PutUint16(data[0:], uint16(user.UserID))
+	data[2] = byte(user.Privilege)
+	copy(data[11:35], name)
+	binary.LittleEndian.PutUint32(data[35:], user.CardNumber)
+	data[40] = '1' // Group
+	copy(data[48:72], fmt.Sprintf("%d", user.UserID))
+
+	return zk.withCommandWrite(func(c *commandConn) error {
+		if _, err := c.send(gozk.CMD_USER_WRQ, data); err != nil {
+			return fmt.Errorf("failed to write user %d: %w", user.UserID, err)
+		}
+		// Make the terminal pick up the new user without a reboot
+		if _, err := c.send(gozk.CMD_REFRESHDATA, nil); err != nil {
+			return fmt.Errorf("failed to refresh device data: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetUsers reads the users enrolled on the terminal
+func (zk *ZKManager) GetUsers() ([]User, error) {
+	var users []User
+	err := zk.withCommandConn(func(c *commandConn) error {
+		sizes, err := c.readFreeSizes()
+		if err != nil {
+			return err
+		}
+		count := int(int32(binary.LittleEndian.Uint32(sizes[4*4:])))
+		if count == 0 {
+			return nil
+		}
+		data, err := c.readBuffer(gozk.CMD_USERTEMP_RRQ, gozk.FCT_USER)
+		if err != nil {
+			return fmt.Errorf("failed to read users: %w", err)
+		}
+		users, err = parseUsers(data, count, zk.NameEncoding)
+		return err
+	})
+	return users, err
+}
+
+// parseUsers decodes a user table buffer: a 4-byte total size followed by count entries of
+// 72 bytes (user ID as a string), or 28 bytes on older firmware (numeric user ID). Names
+// are decoded with the given encoding, see decodeName.
+func parseUsers(data []byte, count int, encoding string) ([]User, error) {
+	if len(data) < 4 || count <= 0 {
+		return nil, nil
+	}
+	total := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	if total > len(data) {
+		return nil, fmt.Errorf("user table truncated: %d of %d bytes", len(data), total)
+	}
+	size := total / count
+	var users []User
+	for len(data) >= size && size > 0 {
+		var user User
+		switch size {
+		case 28:
+			user.Privilege = int(data[2])
+			user.Name = decodeName(data[8:16], encoding)
+			user.CardNumber = binary.LittleEndian.Uint32(data[16:])
+			user.UserID = int(binary.LittleEndian.Uint32(data[24:]))
+		case 72:
+			user.Privilege = int(data[2])
+			user.Name = decodeName(data[11:35], encoding)
+			user.CardNumber = binary.LittleEndian.Uint32(data[35:])
+			userID, err := strconv.Atoi(strings.TrimSpace(cString(data[48:72])))
+			if err != nil {
+				// Users enrolled without a numeric ID are not stamped on punches we can parse
+				data = data[size:]
+				continue
+			}
+			user.UserID = userID
+		default:
+			return nil, fmt.Errorf("unsupported user entry size %d", size)
+		}
+		users = append(users, user)
+		data = data[size:]
+	}
+	return users, nil
+}
+
+// Restart reboots the terminal. The device may drop the connection before acknowledging,
+// so only failures to reach it are reported.
+func (zk *ZKManager) Restart() error {
+	s := zk.getSession()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+
+	c, err := zk.dialCommand()
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	c.send(gozk.CMD_RESTART, nil)
+	return nil
+}
@@ -0,0 +1,86 @@
+package zk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseAttendanceDat decodes an attendance log exported to USB by a terminal, attributing
+// the punches to this device. Most firmware writes attlog.dat as text, one punch per line
+// with tab-separated user ID, time, device number, punch state and verify code; older
+// firmware writes the log's binary entries as they are held on the terminal.
+func (zk *ZKManager) ParseAttendanceDat(data []byte) ([]AttendanceRecord, error) {
+	var entries []attendanceEntry
+	var err error
+	if bytes.IndexByte(data, 0) >= 0 {
+		entries, err = parseBinaryDat(data, zk.location())
+	} else {
+		entries, err = parseTextDat(data, zk.location())
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := make([]AttendanceRecord, 0, len(entries))
+	for _, entry := range entries {
+		records = append(records, zk.toRecord(entry))
+	}
+	return records, nil
+}
+
+// parseTextDat decodes the text export. Lines with a user and a time but no verify code
+// come from firmware that doesn't record one.
+func parseTextDat(data []byte, loc *time.Location) ([]attendanceEntry, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	var entries []attendanceEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a user ID and a time, got %q", line, text)
+		}
+		userID, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid user ID %q", line, fields[0])
+		}
+		t, err := time.Parse("2006-01-02 15:04:05", strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid time %q", line, fields[1])
+		}
+		entry := attendanceEntry{UserID: userID, Time: t}
+		if len(fields) > 4 {
+			if code, err := strconv.Atoi(strings.TrimSpace(fields[4])); err == nil && code >= 0 && code < 256 {
+				entry.Modality = verifyModality(byte(code))
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	resolveDST(entries, loc)
+	return entries, nil
+}
+
+// parseBinaryDat decodes the binary export, which is the attendance log without its size
+// prefix: 40-byte entries, or 16-byte entries on firmware with numeric user IDs
+func parseBinaryDat(data []byte, loc *time.Location) ([]attendanceEntry, error) {
+	size := 40
+	if len(data)%40 != 0 {
+		size = 16
+	}
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("%d bytes is not a whole number of attendance entries", len(data))
+	}
+	buf := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(buf, uint32(len(data)))
+	return parseAttendanceLog(append(buf, data...), len(data)/size, loc)
+}
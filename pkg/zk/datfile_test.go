@@ -0,0 +1,148 @@
+package zk
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTextDat(t *testing.T) {
+	type punch struct {
+		userID   int
+		time     string
+		modality string
+	}
+	tests := []struct {
+		name    string
+		data    string
+		punches []punch
+		errLine string // Start of the error, "" for none
+	}{
+		{"fingerprint", "   42\t2024-03-01 09:15:30\t1\t0\t1\t0\n", []punch{{42, "2024-03-01T09:15:30", ModalityFingerprint}}, ""},
+		{"face and palm", "7\t2024-03-01 08:00:00\t1\t0\t15\t0\n8\t2024-03-01 08:01:00\t1\t1\t25\t0\n",
+			[]punch{{7, "2024-03-01T08:00:00", ModalityFace}, {8, "2024-03-01T08:01:00", ModalityPalm}}, ""},
+		{"no verify code", "7\t2024-03-01 08:00:00\n", []punch{{7, "2024-03-01T08:00:00", ""}}, ""},
+		{"verify code not a number", "7\t2024-03-01 08:00:00\t1\t0\tFP\t0\n", []punch{{7, "2024-03-01T08:00:00", ""}}, ""},
+		{"verify code out of range", "7\t2024-03-01 08:00:00\t1\t0\t300\t0\n", []punch{{7, "2024-03-01T08:00:00", ""}}, ""},
+		{"unknown verify code", "7\t2024-03-01 08:00:00\t1\t0\t9\t0\n", []punch{{7, "2024-03-01T08:00:00", "verify_9"}}, ""},
+		{"byte order mark, CRLF and blank lines", "\xef\xbb\xbf7\t2024-03-01 08:00:00\t1\t0\t1\t0\r\n\r\n  \n8\t2024-03-01 08:01:00\t1\t0\t1\t0\r\n",
+			[]punch{{7, "2024-03-01T08:00:00", ModalityFingerprint}, {8, "2024-03-01T08:01:00", ModalityFingerprint}}, ""},
+		{"empty", "", nil, ""},
+		{"no time", "7\t2024-03-01 08:00:00\n8\n", nil, "line 2:"},
+		{"spaces instead of tabs", "7 2024-03-01 08:00:00 1 0 1 0\n", nil, "line 1:"},
+		{"user ID not a number", "7\t2024-03-01 08:00:00\nabc\t2024-03-01 08:01:00\n", nil, "line 2:"},
+		{"other time format", "7\t2024/03/01 08:00\n", nil, "line 1:"},
+		{"no such day", "7\t2024-02-30 08:00:00\n", nil, "line 1:"},
+		{"cut-off last row", "7\t2024-03-01 08:00:00\t1\t0\t1\t0\n8\t2024-03-01 08:0", nil, "line 2:"},
+	}
+	for _, tt := range tests {
+		entries, err := parseTextDat([]byte(tt.data), time.UTC)
+		if tt.errLine != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.errLine) {
+				t.Errorf("%s: error = %v, want one starting %q", tt.name, err, tt.errLine)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(entries) != len(tt.punches) {
+			t.Errorf("%s: %d entries, want %d", tt.name, len(entries), len(tt.punches))
+			continue
+		}
+		for i, want := range tt.punches {
+			got := entries[i]
+			if got.UserID != want.userID || got.Time.Format(TimestampLayout) != want.time || got.Modality != want.modality {
+				t.Errorf("%s: entry %d is user %d at %s by %q, want user %d at %s by %q", tt.name, i,
+					got.UserID, got.Time.Format(TimestampLayout), got.Modality, want.userID, want.time, want.modality)
+			}
+		}
+	}
+}
+
+func TestParseBinaryDat(t *testing.T) {
+	clock := encodeDeviceTime(time.Date(2024, 3, 1, 9, 15, 30, 0, time.UTC))
+	entry16 := func(userID int) []byte {
+		entry := make([]byte, 16)
+		binary.LittleEndian.PutUint32(entry[0:], uint32(userID))
+		binary.LittleEndian.PutUint32(entry[4:], clock)
+		entry[8] = 1
+		return entry
+	}
+	entry40 := func(userID string) []byte {
+		entry := make([]byte, 40)
+		copy(entry[2:26], userID)
+		entry[26] = 15
+		binary.LittleEndian.PutUint32(entry[27:], clock)
+		return entry
+	}
+	join := func(entries ...[]byte) []byte {
+		var data []byte
+		for _, entry := range entries {
+			data = append(data, entry...)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		users   []int
+		wantErr bool
+	}{
+		{"40-byte entries", join(entry40("1001"), entry40("7")), []int{1001, 7}, false},
+		{"16-byte entries", join(entry16(70000), entry16(3), entry16(4)), []int{70000, 3, 4}, false},
+		{"non-numeric user ID skipped", join(entry40("1001"), entry40("V-12"), entry40("7")), []int{1001, 7}, false},
+		{"cut-off entry", join(entry40("1001"), entry40("7"))[:79], nil, true},
+		{"stray byte", append(join(entry16(3), entry16(4)), 0), nil, true},
+	}
+	for _, tt := range tests {
+		entries, err := parseBinaryDat(tt.data, time.UTC)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		var users []int
+		for _, entry := range entries {
+			users = append(users, entry.UserID)
+		}
+		if len(users) != len(tt.users) {
+			t.Errorf("%s: users %v, want %v", tt.name, users, tt.users)
+			continue
+		}
+		for i := range users {
+			if users[i] != tt.users[i] {
+				t.Errorf("%s: users %v, want %v", tt.name, users, tt.users)
+				break
+			}
+		}
+	}
+}
+
+func TestParseAttendanceDat(t *testing.T) {
+	zk := &ZKManager{Name: "gate", zkTimezone: "UTC"}
+	records, err := zk.ParseAttendanceDat([]byte("42\t2024-03-01 09:15:30\t1\t0\t15\t0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].DeviceID != "gate" || records[0].UserID != 42 || records[0].Timestamp != "2024-03-01T09:15:30" || records[0].Modality != ModalityFace {
+		t.Errorf("text export read as %+v, want user 42 on gate by face", records)
+	}
+
+	// Binary exports are told apart by their NUL bytes
+	entry := make([]byte, 40)
+	copy(entry[2:], "42")
+	binary.LittleEndian.PutUint32(entry[27:], encodeDeviceTime(time.Date(2024, 3, 1, 9, 15, 30, 0, time.UTC)))
+	records, err = zk.ParseAttendanceDat(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].UserID != 42 || records[0].Timestamp != "2024-03-01T09:15:30" {
+		t.Errorf("binary export read as %+v, want user 42", records)
+	}
+	if _, err := zk.ParseAttendanceDat([]byte("42\t2024-03-01\n")); err == nil {
+		t.Error("export with a malformed row succeeded, want an error")
+	}
+}
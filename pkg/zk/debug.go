@@ -0,0 +1,49 @@
+package zk
+
+import (
+	"encoding/hex"
+	"log"
+	"sync"
+)
+
+// Bytes of each packet shown in protocol debug lines
+const debugPacketBytes = 64
+
+// protocolDebug selects the devices whose protocol exchanges are logged
+var protocolDebug = struct {
+	sync.RWMutex
+	all     bool
+	devices map[string]bool
+}{}
+
+// SetProtocolDebug turns logging of every command and reply packet on for all devices, for
+// the named devices only, or off when all is false and no devices are given. It takes
+// effect on the next exchange, including on open persistent connections.
+func SetProtocolDebug(all bool, devices []string) {
+	protocolDebug.Lock()
+	defer protocolDebug.Unlock()
+	protocolDebug.all = all
+	protocolDebug.devices = map[string]bool{}
+	for _, device := range devices {
+		protocolDebug.devices[device] = true
+	}
+}
+
+// ProtocolDebug reports whether protocol exchanges with the device are logged
+func ProtocolDebug(device string) bool {
+	protocolDebug.RLock()
+	defer protocolDebug.RUnlock()
+	return protocolDebug.all || protocolDebug.devices[device]
+}
+
+// debugPacket logs a packet sent to or received from the device when debugging it
+func (c *commandConn) debugPacket(direction string, code int, payload []byte) {
+	if !ProtocolDebug(c.device) {
+		return
+	}
+	shown := payload
+	if len(shown) > debugPacketBytes {
+		shown = shown[:debugPacketBytes]
+	}
+	log.Printf("[debug] %s %s code=%d session=%d reply=%d len=%d %s", c.device, direction, code, c.sessionID, c.replyID, len(payload), hex.EncodeToString(shown))
+}
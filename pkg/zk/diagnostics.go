@@ -0,0 +1,197 @@
+package zk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// Diagnostics is a health snapshot of a terminal. The device fault log is not included:
+// reading it needs the protocol's bulk data transfer, which this client does not implement.
+type Diagnostics struct {
+	Firmware     string `json:"firmware"`
+	Platform     string `json:"platform,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	DeviceTime   string `json:"device_time"`
+	ClockSkew    string `json:"clock_skew"` // Device clock minus collector clock
+
+	Users          int `json:"users"`
+	UserCapacity   int `json:"user_capacity"`
+	Fingers        int `json:"fingers"`
+	FingerCapacity int `json:"finger_capacity"`
+	Records        int `json:"records"`
+	RecordCapacity int `json:"record_capacity"`
+	Cards          int `json:"cards"`
+	Faces          int `json:"faces,omitempty"`
+	FaceCapacity   int `json:"face_capacity,omitempty"`
+
+	// Remaining storage as reported by the terminal
+	FreeUsers   int `json:"free_users"`
+	FreeFingers int `json:"free_fingers"`
+	FreeRecords int `json:"free_records"`
+
+	Capabilities *Capabilities `json:"capabilities"`
+}
+
+// GetDiagnostics reads firmware details, the clock, and storage use from the terminal
+func (zk *ZKManager) GetDiagnostics() (*Diagnostics, error) {
+	d := &Diagnostics{}
+	err := zk.withCommandConn(func(c *commandConn) error {
+		d.Firmware, d.Capabilities = c.caps.Firmware, c.caps
+		// Options are missing on some firmware, so they are best effort
+		d.Platform, _ = c.readOption("~Platform")
+		d.SerialNumber, _ = c.readOption("~SerialNumber")
+
+		deviceTime, err := c.readClock(zk.location())
+		if err != nil {
+			return err
+		}
+		d.DeviceTime = deviceTime.Format(time.RFC3339)
+		d.ClockSkew = deviceTime.Sub(time.Now()).Truncate(time.Second).String()
+
+		sizes, err := c.readFreeSizes()
+		if err != nil {
+			return err
+		}
+		field := func(i int) int { return int(int32(binary.LittleEndian.Uint32(sizes[i*4:]))) }
+		d.Users, d.Fingers, d.Records, d.Cards = field(4), field(6), field(8), field(12)
+		d.FingerCapacity, d.UserCapacity, d.RecordCapacity = field(14), field(15), field(16)
+		d.FreeFingers, d.FreeUsers, d.FreeRecords = field(17), field(18), field(19)
+		if len(sizes) >= 92 && c.caps.FaceTemplates {
+			d.Faces, d.FaceCapacity = field(20), field(22)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// GetTime reads the terminal clock, in the device timezone. It is a single small exchange.
+func (zk *ZKManager) GetTime() (time.Time, error) {
+	var t time.Time
+	err := zk.withCommandConn(func(c *commandConn) error {
+		var err error
+		t, err = c.readClock(zk.location())
+		return err
+	})
+	return t, err
+}
+
+// readClock reads the terminal clock
+func (c *commandConn) readClock(loc *time.Location) (time.Time, error) {
+	clock, err := c.send(gozk.CMD_GET_TIME, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read device time: %w", err)
+	}
+	if len(clock) < 4 {
+		return time.Time{}, fmt.Errorf("short device time reply")
+	}
+	return decodeDeviceTime(binary.LittleEndian.Uint32(clock), loc), nil
+}
+
+// GetSerialNumber reads the terminal's serial number, which identifies it across address changes
+func (zk *ZKManager) GetSerialNumber() (string, error) {
+	var serial string
+	err := zk.withCommandConn(func(c *commandConn) error {
+		var err error
+		if serial, err = c.readOption("~SerialNumber"); err != nil {
+			return fmt.Errorf("failed to read serial number: %w", err)
+		}
+		return nil
+	})
+	return serial, err
+}
+
+// GetRecordCount returns how many attendance records the terminal holds and how many it
+// can hold. It is a single small exchange, much cheaper than reading the log itself.
+func (zk *ZKManager) GetRecordCount() (records, capacity int, err error) {
+	err = zk.withCommandConn(func(c *commandConn) error {
+		sizes, err := c.readFreeSizes()
+		if err != nil {
+			return err
+		}
+		records = int(int32(binary.LittleEndian.Uint32(sizes[8*4:])))
+		capacity = int(int32(binary.LittleEndian.Uint32(sizes[16*4:])))
+		return nil
+	})
+	return records, capacity, err
+}
+
+// readFreeSizes reads the storage use counters: users, fingers, records and so on
+func (c *commandConn) readFreeSizes() ([]byte, error) {
+	sizes, err := c.send(gozk.CMD_GET_FREE_SIZES, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage use: %w", err)
+	}
+	if len(sizes) < 80 {
+		return nil, fmt.Errorf("short storage use reply")
+	}
+	return sizes, nil
+}
+
+// readOption reads a device option such as "~SerialNumber"
+func (c *commandConn) readOption(name string) (string, error) {
+	reply, err := c.send(gozk.CMD_OPTIONS_RRQ, append([]byte(name), 0))
+	if err != nil {
+		return "", err
+	}
+	value := cString(reply)
+	if i := strings.Index(value, "="); i >= 0 {
+		value = value[i+1:]
+	}
+	return value, nil
+}
+
+// SetTimezone sets the IANA time zone the terminal's clock runs in, Asia/Dhaka unless set.
+// Its daylight saving rules are applied to the times in the attendance log.
+func (zk *ZKManager) SetTimezone(name string) error {
+	if _, err := time.LoadLocation(name); err != nil {
+		return fmt.Errorf("unknown timezone %q", name)
+	}
+	zk.zkTimezone = name
+	return nil
+}
+
+// Timezone returns the name of the time zone the terminal's clock runs in
+func (zk *ZKManager) Timezone() string {
+	return zk.zkTimezone
+}
+
+// location returns the device timezone
+func (zk *ZKManager) location() *time.Location {
+	return gozk.LoadLocation(zk.zkTimezone)
+}
+
+// decodeDeviceTime unpacks the protocol's packed clock value
+func decodeDeviceTime(t uint32, loc *time.Location) time.Time {
+	second := int(t % 60)
+	t /= 60
+	minute := int(t % 60)
+	t /= 60
+	hour := int(t % 24)
+	t /= 24
+	day := int(t%31) + 1
+	t /= 31
+	month := time.Month(t%12 + 1)
+	t /= 12
+	return time.Date(int(t)+2000, month, day, hour, minute, second, 0, loc)
+}
+
+// encodeDeviceTime packs a wall-clock time the way the terminal stores it, see decodeDeviceTime
+func encodeDeviceTime(t time.Time) uint32 {
+	days := (t.Year()%100)*12*31 + (int(t.Month())-1)*31 + t.Day() - 1
+	return uint32(days*24*60*60 + (t.Hour()*60+t.Minute())*60 + t.Second())
+}
+
+// cString trims a NUL-terminated device string
+func cString(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
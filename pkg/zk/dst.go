@@ -0,0 +1,122 @@
+package zk
+
+import "time"
+
+// Flags set on records whose device time falls on a daylight saving transition
+const (
+	// FlagDSTGap marks a time skipped when clocks went forward, which a terminal whose clock
+	// hadn't been moved on yet still records; it is taken as the time before the change
+	FlagDSTGap = "dst_gap"
+	// FlagDSTAmbiguous marks a time that occurs twice when clocks go back; which one is meant
+	// is told from the order of the log
+	FlagDSTAmbiguous = "dst_ambiguous"
+)
+
+// localCandidates returns the instants a wall-clock time, given in UTC, stands for in loc:
+// one for most times, two for a time repeated when clocks go back, in order, and for a time
+// skipped when they go forward, the instant it would have been without the change. The flag
+// tells the last two cases apart.
+func localCandidates(wall time.Time, loc *time.Location) (first, second time.Time, flag string) {
+	// The offsets in force a few hours either side cover any transition at the time. They
+	// are looked up around the instant the wall clock roughly stands for, as wall itself is
+	// up to 14 hours off it in zones far from UTC.
+	_, offset := wall.In(loc).Zone()
+	around := wall.Add(-time.Duration(offset) * time.Second)
+	var offsets []int
+	for _, shift := range []time.Duration{-6 * time.Hour, 0, 6 * time.Hour} {
+		_, offset := around.Add(shift).In(loc).Zone()
+		_, guess := time.Unix(wall.Unix()-int64(offset), 0).In(loc).Zone()
+		for _, o := range []int{offset, guess} {
+			if !containsInt(offsets, o) {
+				offsets = append(offsets, o)
+			}
+		}
+	}
+	var matches []time.Time
+	for _, offset := range offsets {
+		t := time.Unix(wall.Unix()-int64(offset), int64(wall.Nanosecond())).In(loc)
+		if sameWallClock(t, wall) && !containsTime(matches, t) {
+			matches = append(matches, t)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		// Skipped: read with the offset in force before the change
+		_, before := around.Add(-6 * time.Hour).In(loc).Zone()
+		return time.Unix(wall.Unix()-int64(before), int64(wall.Nanosecond())).In(loc), time.Time{}, FlagDSTGap
+	case 1:
+		return matches[0], time.Time{}, ""
+	}
+	if matches[1].Before(matches[0]) {
+		matches[0], matches[1] = matches[1], matches[0]
+	}
+	return matches[0], matches[1], FlagDSTAmbiguous
+}
+
+// resolveDST turns the wall-clock times of log entries, given in UTC as the terminal
+// recorded them, into instants in the device's time zone. The log is in punch order, so a
+// repeated time is the second of its two instants when the entries before it already
+// reached past the first.
+func resolveDST(entries []attendanceEntry, loc *time.Location) {
+	var last time.Time
+	for i := range entries {
+		wall := entries[i].Time
+		first, second, flag := localCandidates(wall, loc)
+		chosen := first
+		if flag == FlagDSTAmbiguous && first.Before(last) {
+			chosen = second
+		}
+		entries[i].Time = chosen
+		entries[i].Wall = wall.Format(TimestampLayout)
+		entries[i].DST = flag
+		if chosen.After(last) {
+			last = chosen
+		}
+	}
+}
+
+// observesDST reports whether a zone's offset changes during the year of t
+func observesDST(loc *time.Location, t time.Time) bool {
+	_, january := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, loc).Zone()
+	_, july := time.Date(t.Year(), time.July, 1, 0, 0, 0, 0, loc).Zone()
+	return january != july
+}
+
+// utcOffset returns the offset that places a wall-clock timestamp at instant t, as -05:00.
+// It differs from the zone's offset at t for a time skipped when clocks went forward.
+func utcOffset(timestamp string, t time.Time) string {
+	wall, err := time.Parse(TimestampLayout, timestamp)
+	if err != nil {
+		return t.Format("-07:00")
+	}
+	return t.In(time.FixedZone("", int(wall.Unix()-t.Unix()))).Format("-07:00")
+}
+
+// floatingTime returns the wall clock of t as a time in UTC, for resolveDST
+func floatingTime(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+func sameWallClock(t, wall time.Time) bool {
+	y, m, d := t.Date()
+	wy, wm, wd := wall.Date()
+	return y == wy && m == wm && d == wd && t.Hour() == wall.Hour() && t.Minute() == wall.Minute() && t.Second() == wall.Second()
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTime(list []time.Time, t time.Time) bool {
+	for _, v := range list {
+		if v.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
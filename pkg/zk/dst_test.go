@@ -0,0 +1,185 @@
+package zk
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func wallTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	wall, err := time.Parse(TimestampLayout, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wall
+}
+
+func TestLocalCandidates(t *testing.T) {
+	tests := []struct {
+		name       string
+		zone       string
+		wall       string
+		wantFirst  string // In UTC
+		wantSecond string // In UTC, for an ambiguous time
+		wantFlag   string
+	}{
+		{"new york winter", "America/New_York", "2024-01-15T08:00:00", "2024-01-15T13:00:00", "", ""},
+		{"new york summer", "America/New_York", "2024-07-15T08:00:00", "2024-07-15T12:00:00", "", ""},
+		{"new york before spring forward", "America/New_York", "2024-03-10T01:59:59", "2024-03-10T06:59:59", "", ""},
+		{"new york spring forward gap", "America/New_York", "2024-03-10T02:30:00", "2024-03-10T07:30:00", "", FlagDSTGap},
+		{"new york start of gap", "America/New_York", "2024-03-10T02:00:00", "2024-03-10T07:00:00", "", FlagDSTGap},
+		{"new york after spring forward", "America/New_York", "2024-03-10T03:00:00", "2024-03-10T07:00:00", "", ""},
+		{"new york fall back", "America/New_York", "2024-11-03T01:30:00", "2024-11-03T05:30:00", "2024-11-03T06:30:00", FlagDSTAmbiguous},
+		{"new york start of repeated hour", "America/New_York", "2024-11-03T01:00:00", "2024-11-03T05:00:00", "2024-11-03T06:00:00", FlagDSTAmbiguous},
+		{"new york after fall back", "America/New_York", "2024-11-03T02:00:00", "2024-11-03T07:00:00", "", ""},
+		{"sydney spring forward gap", "Australia/Sydney", "2024-10-06T02:30:00", "2024-10-05T16:30:00", "", FlagDSTGap},
+		{"sydney fall back", "Australia/Sydney", "2024-04-07T02:30:00", "2024-04-06T15:30:00", "2024-04-06T16:30:00", FlagDSTAmbiguous},
+		{"lord howe half-hour fall back", "Australia/Lord_Howe", "2024-04-07T01:45:00", "2024-04-06T14:45:00", "2024-04-06T15:15:00", FlagDSTAmbiguous},
+		{"no daylight saving", "Asia/Dhaka", "2024-03-10T02:30:00", "2024-03-09T20:30:00", "", ""},
+	}
+	for _, tt := range tests {
+		loc := mustLoadLocation(t, tt.zone)
+		first, second, flag := localCandidates(wallTime(t, tt.wall), loc)
+		var gotSecond string
+		if !second.IsZero() {
+			gotSecond = second.UTC().Format(TimestampLayout)
+		}
+		gotFirst := first.UTC().Format(TimestampLayout)
+		if gotFirst != tt.wantFirst || gotSecond != tt.wantSecond || flag != tt.wantFlag {
+			t.Errorf("%s: localCandidates(%s) = %s, %q, %q, want %s, %q, %q", tt.name, tt.wall, gotFirst, gotSecond, flag, tt.wantFirst, tt.wantSecond, tt.wantFlag)
+		}
+		if first.Location() != loc {
+			t.Errorf("%s: localCandidates(%s) returned a time in %v, want %v", tt.name, tt.wall, first.Location(), loc)
+		}
+	}
+}
+
+func TestResolveDST(t *testing.T) {
+	tests := []struct {
+		name  string
+		zone  string
+		walls []string
+		want  []string // Instant in UTC and flag of each entry
+	}{
+		{
+			name:  "repeated hour read in punch order",
+			zone:  "America/New_York",
+			walls: []string{"2024-11-03T01:10:00", "2024-11-03T01:50:00", "2024-11-03T01:20:00", "2024-11-03T01:40:00", "2024-11-03T02:05:00"},
+			want: []string{
+				"2024-11-03T05:10:00 " + FlagDSTAmbiguous,
+				"2024-11-03T05:50:00 " + FlagDSTAmbiguous,
+				"2024-11-03T06:20:00 " + FlagDSTAmbiguous,
+				"2024-11-03T06:40:00 " + FlagDSTAmbiguous,
+				"2024-11-03T07:05:00 ",
+			},
+		},
+		{
+			name:  "single punch in the repeated hour is the first one",
+			zone:  "America/New_York",
+			walls: []string{"2024-11-03T00:50:00", "2024-11-03T01:30:00"},
+			want:  []string{"2024-11-03T04:50:00 ", "2024-11-03T05:30:00 " + FlagDSTAmbiguous},
+		},
+		{
+			name:  "punch in the repeated hour after one past it",
+			zone:  "America/New_York",
+			walls: []string{"2024-11-03T02:10:00", "2024-11-03T01:30:00"},
+			want:  []string{"2024-11-03T07:10:00 ", "2024-11-03T06:30:00 " + FlagDSTAmbiguous},
+		},
+		{
+			name:  "terminal clock not moved forward",
+			zone:  "America/New_York",
+			walls: []string{"2024-03-10T01:45:00", "2024-03-10T02:15:00", "2024-03-10T03:15:00"},
+			want: []string{
+				"2024-03-10T06:45:00 ",
+				"2024-03-10T07:15:00 " + FlagDSTGap,
+				"2024-03-10T07:15:00 ",
+			},
+		},
+		{
+			name:  "southern hemisphere fall back",
+			zone:  "Australia/Sydney",
+			walls: []string{"2024-04-07T02:40:00", "2024-04-07T02:10:00"},
+			want:  []string{"2024-04-06T15:40:00 " + FlagDSTAmbiguous, "2024-04-06T16:10:00 " + FlagDSTAmbiguous},
+		},
+		{
+			name:  "no daylight saving",
+			zone:  "Asia/Dhaka",
+			walls: []string{"2024-11-03T01:30:00", "2024-11-03T01:10:00"},
+			want:  []string{"2024-11-02T19:30:00 ", "2024-11-02T19:10:00 "},
+		},
+	}
+	for _, tt := range tests {
+		loc := mustLoadLocation(t, tt.zone)
+		entries := make([]attendanceEntry, len(tt.walls))
+		for i, wall := range tt.walls {
+			entries[i] = attendanceEntry{UserID: i + 1, Time: wallTime(t, wall)}
+		}
+		resolveDST(entries, loc)
+		for i, e := range entries {
+			if got := e.Time.UTC().Format(TimestampLayout) + " " + e.DST; got != tt.want[i] {
+				t.Errorf("%s: entry %d at %s resolved to %q, want %q", tt.name, i+1, tt.walls[i], got, tt.want[i])
+			}
+			if e.Wall != tt.walls[i] {
+				t.Errorf("%s: entry %d Wall = %q, want %q", tt.name, i+1, e.Wall, tt.walls[i])
+			}
+			if got := e.Time.In(loc).Format(TimestampLayout); e.DST != FlagDSTGap && got != tt.walls[i] {
+				t.Errorf("%s: entry %d local time = %s, want %s", tt.name, i+1, got, tt.walls[i])
+			}
+		}
+	}
+}
+
+func TestObservesDST(t *testing.T) {
+	summer := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		zone string
+		at   time.Time
+		want bool
+	}{
+		{"America/New_York", summer, true},
+		{"Europe/London", summer, true},
+		{"Australia/Sydney", summer, true},
+		{"Asia/Dhaka", summer, false},
+		{"Asia/Dhaka", time.Date(2009, time.August, 1, 0, 0, 0, 0, time.UTC), true},
+		{"UTC", summer, false},
+		{"Asia/Tokyo", summer, false},
+	}
+	for _, tt := range tests {
+		if got := observesDST(mustLoadLocation(t, tt.zone), tt.at); got != tt.want {
+			t.Errorf("observesDST(%s, %d) = %v, want %v", tt.zone, tt.at.Year(), got, tt.want)
+		}
+	}
+}
+
+func TestUTCOffset(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	tests := []struct {
+		name      string
+		timestamp string
+		at        time.Time
+		want      string
+	}{
+		{"winter", "2024-01-15T08:00:00", time.Date(2024, time.January, 15, 13, 0, 0, 0, time.UTC), "-05:00"},
+		{"summer", "2024-07-15T08:00:00", time.Date(2024, time.July, 15, 12, 0, 0, 0, time.UTC), "-04:00"},
+		{"spring forward gap", "2024-03-10T02:30:00", time.Date(2024, time.March, 10, 7, 30, 0, 0, time.UTC), "-05:00"},
+		{"first of repeated hour", "2024-11-03T01:30:00", time.Date(2024, time.November, 3, 5, 30, 0, 0, time.UTC), "-04:00"},
+		{"second of repeated hour", "2024-11-03T01:30:00", time.Date(2024, time.November, 3, 6, 30, 0, 0, time.UTC), "-05:00"},
+		{"half-hour zone", "2024-01-15T18:30:00", time.Date(2024, time.January, 15, 13, 0, 0, 0, time.UTC), "+05:30"},
+		{"unparsable timestamp", "2024-07-15 08:00", time.Date(2024, time.July, 15, 12, 0, 0, 0, newYork), "-04:00"},
+	}
+	for _, tt := range tests {
+		if got := utcOffset(tt.timestamp, tt.at); got != tt.want {
+			t.Errorf("%s: utcOffset(%s, %s) = %s, want %s", tt.name, tt.timestamp, tt.at.UTC().Format(TimestampLayout), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package zk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// Character encodings for user names, see ZKManager.NameEncoding
+const (
+	EncodingAuto   = "auto"
+	EncodingUTF8   = "utf-8"
+	EncodingUTF16  = "utf-16le"
+	EncodingGB2312 = "gb2312"
+	EncodingLatin1 = "latin1"
+)
+
+// ValidNameEncoding reports whether name is a supported NameEncoding value
+func ValidNameEncoding(name string) bool {
+	switch strings.ToLower(name) {
+	case "", EncodingAuto, EncodingUTF8, EncodingUTF16, EncodingGB2312, EncodingLatin1:
+		return true
+	}
+	return false
+}
+
+// decodeName decodes a NUL-padded name field. Firmware stores names in whatever encoding
+// the terminal's language pack uses: UTF-8 on recent models, GB2312 on Chinese firmware,
+// and UTF-16LE on some multi-language firmware. With EncodingAuto the encoding is guessed
+// from the bytes, falling back to Latin-1 so nothing is dropped. Latin-1 names read as
+// GB2312 more often than not, so terminals using it need the encoding set explicitly.
+func decodeName(field []byte, encoding string) string {
+	switch strings.ToLower(encoding) {
+	case EncodingUTF8:
+		return strings.ToValidUTF8(cString(field), "�")
+	case EncodingUTF16:
+		return decodeUTF16(field)
+	case EncodingGB2312:
+		return decodeGB2312(cString(field))
+	case EncodingLatin1:
+		return decodeLatin1(cString(field))
+	}
+
+	s := cString(field)
+	if looksUTF16(field) {
+		if name := decodeUTF16(field); printable(name) {
+			return name
+		}
+	}
+	if utf8.ValidString(s) && printable(s) {
+		return s
+	}
+	if name := decodeGB2312(s); printable(name) {
+		return name
+	}
+	// UTF-16LE text without NUL bytes, e.g. Bangla, whose high bytes are all 0x09
+	if name := decodeUTF16(field); printable(name) {
+		return name
+	}
+	return decodeLatin1(s)
+}
+
+// encodeName encodes a name for a field of size bytes, truncated to fit. Auto and UTF-8
+// write UTF-8, which is what current firmware expects.
+func encodeName(name string, encoding string, size int) ([]byte, error) {
+	var data []byte
+	switch strings.ToLower(encoding) {
+	case EncodingUTF16:
+		units := utf16.Encode([]rune(name))
+		data = make([]byte, 2*len(units))
+		for i, u := range units {
+			binary.LittleEndian.PutUint16(data[2*i:], u)
+		}
+	case EncodingGB2312:
+		encoded, err := simplifiedchinese.GBK.NewEncoder().String(name)
+		if err != nil {
+			return nil, fmt.Errorf("name %q cannot be written in GB2312: %w", name, err)
+		}
+		data = []byte(encoded)
+	case EncodingLatin1:
+		for _, r := range name {
+			if r > 0xFF {
+				return nil, fmt.Errorf("name %q cannot be written in Latin-1", name)
+			}
+			data = append(data, byte(r))
+		}
+	default:
+		data = []byte(name)
+	}
+	if len(data) > size {
+		data = data[:size]
+	}
+	return data, nil
+}
+
+// looksUTF16 reports whether a name field holds UTF-16LE text: there are characters left
+// after the first NUL byte, which a single-byte or UTF-8 name never has
+func looksUTF16(field []byte) bool {
+	end := bytes.IndexByte(field, 0)
+	if end < 0 || end+1 >= len(field) {
+		return false
+	}
+	return bytes.IndexFunc(field[end+1:], func(r rune) bool { return r != 0 }) >= 0
+}
+
+// decodeUTF16 decodes a UTF-16LE field up to its first NUL character
+func decodeUTF16(field []byte) string {
+	var units []uint16
+	for i := 0; i+1 < len(field); i += 2 {
+		u := binary.LittleEndian.Uint16(field[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
+
+// decodeGB2312 decodes GB2312 text. GBK is a superset, so names using its extra characters
+// decode too.
+func decodeGB2312(s string) string {
+	decoded, err := simplifiedchinese.GBK.NewDecoder().String(s)
+	if err != nil {
+		return strings.ToValidUTF8(s, "�")
+	}
+	return decoded
+}
+
+// decodeLatin1 maps each byte to the code point of the same value
+func decodeLatin1(s string) string {
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
+
+// printable reports whether a decoded name is non-empty and has no control or replacement characters
+func printable(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,10 @@
+package zk
+
+import "errors"
+
+var (
+	// ErrDeviceUnreachable means the terminal could not be connected to or dropped the connection
+	ErrDeviceUnreachable = errors.New("device unreachable")
+	// ErrAuthFailed means the terminal refused the session, e.g. because it needs a comm key
+	ErrAuthFailed = errors.New("device authentication failed")
+)
@@ -0,0 +1,145 @@
+package zk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// Size of an operation log entry: admin (2), operation (1), padding (1), time (4) and
+// four parameters (2 each)
+const operationEntrySize = 16
+
+// Operation codes of the operation log
+const (
+	opPowerOn          = 0
+	opPowerOff         = 1
+	opVerifyFailed     = 2
+	opAlarm            = 3
+	opMenuAccess       = 4
+	opSettingsChanged  = 5
+	opEnrollFinger     = 6
+	opEnrollPassword   = 7
+	opEnrollCard       = 8
+	opDeleteUser       = 9
+	opDeleteFinger     = 10
+	opDeletePassword   = 11
+	opDeleteCard       = 12
+	opClearData        = 13
+	opSetTime          = 21
+	opFactoryReset     = 22
+	opClearAttendance  = 23
+	opClearAdminRights = 24
+)
+
+// Alarm kinds, the first parameter of an alarm operation
+const (
+	alarmExitButton = 53
+	alarmDoorOpened = 54
+	alarmTamper     = 55 // Cover opened or terminal taken off the wall
+	alarmFalse      = 58
+)
+
+// Operation is one entry of the terminal's operation log, which records what was done at the
+// terminal itself: menu access, setting changes, enrollments, deletions and alarms
+type Operation struct {
+	Admin  int       // User ID of the administrator, 0 when nobody was signed in
+	Code   int       // Operation code as stored by the firmware
+	Action string    // Name of the operation, e.g. "menu_access" or "tamper"
+	Time   time.Time // In the device timezone
+	Params [4]int    // Operation parameters, e.g. the affected user ID
+}
+
+// operationAction names an operation, telling alarms apart by their kind
+func operationAction(code int, params [4]int) string {
+	switch code {
+	case opPowerOn:
+		return "power_on"
+	case opPowerOff:
+		return "power_off"
+	case opVerifyFailed:
+		return "verify_failed"
+	case opAlarm:
+		switch params[0] {
+		case alarmExitButton:
+			return "exit_button"
+		case alarmDoorOpened:
+			return "door_opened"
+		case alarmTamper:
+			return "tamper"
+		case alarmFalse:
+			return "false_alarm"
+		}
+		return "alarm"
+	case opMenuAccess:
+		return "menu_access"
+	case opSettingsChanged:
+		return "settings_changed"
+	case opEnrollFinger, opEnrollPassword, opEnrollCard:
+		return "credential_enrolled"
+	case opDeleteUser:
+		return "user_deleted"
+	case opDeleteFinger, opDeletePassword, opDeleteCard:
+		return "credential_deleted"
+	case opClearData:
+		return "data_cleared"
+	case opSetTime:
+		return "time_set"
+	case opFactoryReset:
+		return "factory_reset"
+	case opClearAttendance:
+		return "attendance_cleared"
+	case opClearAdminRights:
+		return "admin_rights_cleared"
+	default:
+		return "operation_" + strconv.Itoa(code)
+	}
+}
+
+// parseOperationLog decodes an operation log buffer: a 4-byte total size followed by
+// fixed-size entries
+func parseOperationLog(data []byte, loc *time.Location) ([]Operation, error) {
+	if len(data) < 4 {
+		return nil, nil
+	}
+	total := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	if total > len(data) {
+		return nil, fmt.Errorf("operation log truncated: %d of %d bytes", len(data), total)
+	}
+	if total%operationEntrySize != 0 {
+		return nil, fmt.Errorf("unsupported operation log size %d", total)
+	}
+	operations := make([]Operation, 0, total/operationEntrySize)
+	for data = data[:total]; len(data) >= operationEntrySize; data = data[operationEntrySize:] {
+		op := Operation{
+			Admin: int(binary.LittleEndian.Uint16(data[0:])),
+			Code:  int(data[2]),
+			Time:  decodeDeviceTime(binary.LittleEndian.Uint32(data[4:]), loc),
+		}
+		for i := range op.Params {
+			op.Params[i] = int(binary.LittleEndian.Uint16(data[8+2*i:]))
+		}
+		op.Action = operationAction(op.Code, op.Params)
+		operations = append(operations, op)
+	}
+	return operations, nil
+}
+
+// GetOperationLog reads the terminal's operation log. Firmware that keeps no operation log
+// rejects the read.
+func (zk *ZKManager) GetOperationLog() ([]Operation, error) {
+	var operations []Operation
+	err := zk.withCommandConn(func(c *commandConn) error {
+		data, err := c.readBuffer(gozk.CMD_DB_RRQ, gozk.FCT_OPLOG)
+		if err != nil {
+			return fmt.Errorf("failed to read operation log: %w", err)
+		}
+		operations, err = parseOperationLog(data, zk.location())
+		return err
+	})
+	return operations, err
+}
@@ -0,0 +1,143 @@
+package zk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// Domain separation prefixes, so a leaf can never be passed off as an inner node
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// ProofStep is one sibling hash on the path from a leaf to the Merkle root
+type ProofStep struct {
+	Hash string `json:"hash"` // Hex-encoded sibling hash
+	Left bool   `json:"left"` // The sibling is on the left of the running hash
+}
+
+// InclusionProof shows that a record was part of a batch with the given Merkle root
+type InclusionProof struct {
+	Record AttendanceRecord `json:"record"`
+	Steps  []ProofStep      `json:"steps"`
+	Root   string           `json:"root"` // Hex-encoded Merkle root of the batch
+}
+
+// LeafHash hashes a record as a Merkle leaf over its JSON encoding
+func LeafHash(record AttendanceRecord) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte{merkleLeafPrefix}, data...))
+	return sum[:], nil
+}
+
+// nodeHash hashes two child nodes
+func nodeHash(left, right []byte) []byte {
+	data := make([]byte, 0, 1+len(left)+len(right))
+	data = append(data, merkleNodePrefix)
+	data = append(data, left...)
+	data = append(data, right...)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// merkleLevels returns every level of the tree, leaves first. A node without a
+// sibling is promoted to the next level unchanged.
+func merkleLevels(records []AttendanceRecord) ([][][]byte, error) {
+	if len(records) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	level := make([][]byte, len(records))
+	for i, record := range records {
+		hash, err := LeafHash(record)
+		if err != nil {
+			return nil, err
+		}
+		level[i] = hash
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, nodeHash(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels, nil
+}
+
+// MerkleRoot returns the hex-encoded Merkle root of a batch of records
+func MerkleRoot(records []AttendanceRecord) (string, error) {
+	levels, err := merkleLevels(records)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(levels[len(levels)-1][0]), nil
+}
+
+// BuildProof creates an inclusion proof for records[index] within the batch
+func BuildProof(records []AttendanceRecord, index int) (*InclusionProof, error) {
+	if index < 0 || index >= len(records) {
+		return nil, errors.New("record index out of range")
+	}
+	levels, err := merkleLevels(records)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &InclusionProof{Record: records[index]}
+	i := index
+	for _, level := range levels[:len(levels)-1] {
+		sibling := i ^ 1
+		if sibling < len(level) {
+			proof.Steps = append(proof.Steps, ProofStep{
+				Hash: hex.EncodeToString(level[sibling]),
+				Left: sibling < i,
+			})
+		}
+		i /= 2
+	}
+	proof.Root = hex.EncodeToString(levels[len(levels)-1][0])
+	return proof, nil
+}
+
+// VerifyProof checks a JSON-encoded InclusionProof: hashing the record up through the
+// proof steps must reproduce the claimed root. Whether that root belongs to a real batch
+// is checked separately against the collector's audit log.
+func VerifyProof(proof []byte) bool {
+	var p InclusionProof
+	if err := json.Unmarshal(proof, &p); err != nil {
+		return false
+	}
+	root, err := hex.DecodeString(p.Root)
+	if err != nil {
+		return false
+	}
+	hash, err := LeafHash(p.Record)
+	if err != nil {
+		return false
+	}
+	for _, step := range p.Steps {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		if step.Left {
+			hash = nodeHash(sibling, hash)
+		} else {
+			hash = nodeHash(hash, sibling)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
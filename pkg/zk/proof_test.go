@@ -0,0 +1,132 @@
+package zk
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// proofBatch returns a batch of n records
+func proofBatch(n int) []AttendanceRecord {
+	records := make([]AttendanceRecord, n)
+	for i := range records {
+		records[i] = AttendanceRecord{UserID: i + 1, Timestamp: fmt.Sprintf("2024-03-01T09:%02d:00", i), DeviceID: "gate"}
+	}
+	return records
+}
+
+func TestMerkleRoot(t *testing.T) {
+	if _, err := MerkleRoot(nil); err == nil {
+		t.Error("MerkleRoot of an empty batch succeeded, want an error")
+	}
+
+	records := proofBatch(3)
+	root, err := MerkleRoot(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := MerkleRoot(proofBatch(3)); again != root {
+		t.Errorf("root of the same batch changed: %s, %s", root, again)
+	}
+
+	// A single record is its own root
+	leaf, _ := LeafHash(records[0])
+	if single, _ := MerkleRoot(records[:1]); single != fmt.Sprintf("%x", leaf) {
+		t.Errorf("root of one record = %s, want its leaf hash %x", single, leaf)
+	}
+
+	changed := proofBatch(3)
+	changed[2].Timestamp = "2024-03-01T10:02:00"
+	swapped := []AttendanceRecord{records[1], records[0], records[2]}
+	for name, batch := range map[string][]AttendanceRecord{
+		"changed record":  changed,
+		"swapped records": swapped,
+		"dropped record":  records[:2],
+		"added record":    proofBatch(4),
+	} {
+		if other, _ := MerkleRoot(batch); other == root {
+			t.Errorf("%s: root unchanged", name)
+		}
+	}
+}
+
+func TestInclusionProofs(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8, 13} {
+		records := proofBatch(n)
+		root, err := MerkleRoot(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range records {
+			proof, err := BuildProof(records, i)
+			if err != nil {
+				t.Fatalf("%d records: proof of %d: %v", n, i, err)
+			}
+			if proof.Root != root {
+				t.Errorf("%d records: proof of %d has root %s, want %s", n, i, proof.Root, root)
+			}
+			data, err := json.Marshal(proof)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyProof(data) {
+				t.Errorf("%d records: proof of %d does not verify", n, i)
+			}
+		}
+	}
+
+	for _, index := range []int{-1, 3} {
+		if _, err := BuildProof(proofBatch(3), index); err == nil {
+			t.Errorf("BuildProof of index %d in 3 records succeeded, want an error", index)
+		}
+	}
+	if _, err := BuildProof(nil, 0); err == nil {
+		t.Error("BuildProof in an empty batch succeeded, want an error")
+	}
+}
+
+func TestVerifyProofTampering(t *testing.T) {
+	records := proofBatch(5)
+	proof, err := BuildProof(records, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := MerkleRoot(proofBatch(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(p *InclusionProof)
+	}{
+		{"record user", func(p *InclusionProof) { p.Record.UserID++ }},
+		{"record time", func(p *InclusionProof) { p.Record.Timestamp = "2024-03-01T08:02:00" }},
+		{"record flag", func(p *InclusionProof) { p.Record.Flags = []string{"manual_review"} }},
+		{"step hash", func(p *InclusionProof) { p.Steps[0].Hash = p.Steps[1].Hash }},
+		{"step side", func(p *InclusionProof) { p.Steps[0].Left = !p.Steps[0].Left }},
+		{"step dropped", func(p *InclusionProof) { p.Steps = p.Steps[1:] }},
+		{"steps swapped", func(p *InclusionProof) { p.Steps[0], p.Steps[1] = p.Steps[1], p.Steps[0] }},
+		{"other root", func(p *InclusionProof) { p.Root = other }},
+		{"root not hex", func(p *InclusionProof) { p.Root = "not hex" }},
+		{"step not hex", func(p *InclusionProof) { p.Steps[0].Hash = "zz" }},
+	}
+	for _, tt := range tests {
+		p := *proof
+		p.Steps = append([]ProofStep{}, proof.Steps...)
+		tt.tamper(&p)
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if VerifyProof(data) {
+			t.Errorf("proof with a tampered %s verifies", tt.name)
+		}
+	}
+
+	for _, data := range []string{"", "{", `{"root": 5}`} {
+		if VerifyProof([]byte(data)) {
+			t.Errorf("VerifyProof(%q) = true, want false", data)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package zk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// How long WatchAttendance waits for an event before checking whether it should stop
+const eventPoll = time.Second
+
+// WatchAttendance registers for realtime attendance events and calls fn with each punch as
+// the terminal reports it, until stop is closed or the connection fails. It uses its own
+// connection and doesn't hold the device lock, so syncs go on meanwhile on terminals that
+// accept a second client. Punches stay in the attendance log, so one missed while the
+// connection was down is still read by the next sync.
+func (zk *ZKManager) WatchAttendance(stop <-chan struct{}, fn func(AttendanceRecord)) error {
+	c, err := zk.dialCommand()
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	flags := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flags, gozk.EF_ATTLOG)
+	if _, err := c.send(gozk.CMD_REG_EVENT, flags); err != nil {
+		return fmt.Errorf("failed to register for events: %w", err)
+	}
+	defer c.send(gozk.CMD_REG_EVENT, make([]byte, 4))
+
+	loc := zk.location()
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		code, payload, ok, err := c.readEvent(eventPoll)
+		if err != nil {
+			return err
+		}
+		if !ok || code != gozk.CMD_REG_EVENT {
+			continue
+		}
+		// The terminal resends an event until it is acknowledged
+		c.debugPacket(">", gozk.CMD_ACK_OK, nil)
+		if _, err := c.conn.Write(c.packet(gozk.CMD_ACK_OK, nil)); err != nil {
+			return fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+		}
+		entry, err := parseRealtimeEvent(payload, loc)
+		if err != nil {
+			return err
+		}
+		fn(zk.toRecord(entry))
+	}
+}
+
+// readEvent waits up to wait for a packet the device sends unprompted, and reports false
+// when none arrived
+func (c *commandConn) readEvent(wait time.Duration) (code int, payload []byte, ok bool, err error) {
+	c.conn.SetDeadline(time.Now().Add(wait))
+	top := make([]byte, 8)
+	n, err := io.ReadFull(c.conn, top)
+	if netErr, timeout := err.(net.Error); n == 0 && timeout && netErr.Timeout() {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	code, _, payload, err = c.readPacket(top)
+	return code, payload, err == nil, err
+}
+
+// parseRealtimeEvent decodes an attendance event. Its size depends on the firmware: the
+// user is a 2-byte number in 10- and 14-byte events, a 4-byte number in 12-byte events and
+// a string of 24 bytes otherwise. The verify code and punch state follow, then the time as
+// year since 2000, month, day, hour, minute and second bytes.
+func parseRealtimeEvent(data []byte, loc *time.Location) (attendanceEntry, error) {
+	var entry attendanceEntry
+	var rest []byte
+	switch {
+	case len(data) == 10 || len(data) == 14:
+		entry.UserID, rest = int(binary.LittleEndian.Uint16(data)), data[2:]
+	case len(data) == 12:
+		entry.UserID, rest = int(binary.LittleEndian.Uint32(data)), data[4:]
+	case len(data) == 32 || len(data) == 36 || len(data) == 37 || len(data) >= 52:
+		userID, err := strconv.Atoi(strings.TrimSpace(cString(data[:24])))
+		if err != nil {
+			return entry, fmt.Errorf("invalid user ID in attendance event: %q", cString(data[:24]))
+		}
+		entry.UserID, rest = userID, data[24:]
+	default:
+		return entry, fmt.Errorf("unsupported attendance event size %d", len(data))
+	}
+	entry.Modality = verifyModality(rest[0])
+	t := rest[2:8]
+	entry.Time = time.Date(2000+int(t[0]), time.Month(t[1]), int(t[2]), int(t[3]), int(t[4]), int(t[5]), 0, time.UTC)
+	entries := []attendanceEntry{entry}
+	resolveDST(entries, loc)
+	return entries[0], nil
+}
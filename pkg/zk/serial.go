@@ -0,0 +1,61 @@
+package zk
+
+import (
+	"fmt"
+	"net"
+)
+
+// Serial line speed when BaudRate is unset, the factory setting of most terminals
+const defaultBaudRate = 115200
+
+// NewSerialZKManager creates a client for a terminal wired to a serial port, directly over
+// RS232 or through an RS485 converter. Packets are framed as over TCP. Attendance reads and
+// the commands of the built-in protocol client work over serial; Persistent does not apply.
+func NewSerialZKManager(port string, baudRate int) *ZKManager {
+	return &ZKManager{
+		Name:       port,
+		SerialPort: port,
+		BaudRate:   baudRate,
+		zkTimezone: DefaultTimezone,
+	}
+}
+
+// address identifies the device: its serial port, or "ip:port"
+func (zk *ZKManager) address() string {
+	if zk.SerialPort != "" {
+		return zk.SerialPort
+	}
+	return fmt.Sprintf("%s:%d", zk.IP, zk.Port)
+}
+
+// openTransport opens the connection the built-in protocol client talks over
+func (zk *ZKManager) openTransport() (transport, error) {
+	if zk.replay != nil {
+		return replayTransport{zk.replay}, nil
+	}
+	conn, err := zk.dialTransport()
+	if err != nil || zk.recorder == nil {
+		return conn, err
+	}
+	return &recordingTransport{transport: conn, rec: zk.recorder}, nil
+}
+
+// dialTransport opens the serial port or TCP connection to the device
+func (zk *ZKManager) dialTransport() (transport, error) {
+	if zk.SerialPort != "" {
+		baudRate := zk.BaudRate
+		if baudRate <= 0 {
+			baudRate = defaultBaudRate
+		}
+		port, err := openSerial(zk.SerialPort, baudRate)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+		}
+		return port, nil
+	}
+	conn, err := net.DialTimeout("tcp", zk.address(), zk.connectTimeout())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package zk
+
+import (
+	"errors"
+	"os"
+)
+
+// openSerial is only implemented on Linux. Elsewhere, put the terminal behind a serial-to-TCP
+// converter and address it by IP.
+func openSerial(port string, baudRate int) (*os.File, error) {
+	return nil, errors.New("serial ports are only supported on Linux")
+}
@@ -0,0 +1,209 @@
+package zk
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// session is the per-device state shared by every ZKManager for the same address
+type session struct {
+	// Serializes protocol conversations with the device. Some firmware corrupts its session
+	// when a sync, a manual command, and a user push talk to it at the same time. The lock
+	// covers this process only; the instance lock keeps a second daemon from polling.
+	mu     sync.Mutex
+	socket *gozk.ZK      // Connection kept open between syncs, with Persistent
+	caps   *Capabilities // Firmware capabilities, once detected
+	used   time.Time     // When the kept-open connection last talked to the device
+	// Whether a keepAlive goroutine watches the kept-open connection
+	keeping bool
+}
+
+// sessions holds per-device state by device address
+var sessions = struct {
+	sync.Mutex
+	byAddr map[string]*session
+}{byAddr: map[string]*session{}}
+
+// getSession returns the session for the device, creating an unconnected one if needed
+func (zk *ZKManager) getSession() *session {
+	addr := zk.address()
+	sessions.Lock()
+	defer sessions.Unlock()
+	s, ok := sessions.byAddr[addr]
+	if !ok {
+		s = &session{}
+		sessions.byAddr[addr] = s
+	}
+	return s
+}
+
+// withSocket runs fn against a connected socket, holding the device lock. Without Persistent
+// a fresh connection is opened for fn and closed afterwards. With Persistent the cached
+// connection is reused, and re-dialed once if an idempotent fn, a read, fails on it. Anything
+// else may have reached the device before the connection failed, so it isn't run again.
+func (zk *ZKManager) withSocket(idempotent bool, fn func(socket *gozk.ZK) error) error {
+	if zk.SerialPort != "" {
+		return fmt.Errorf("%s is connected by serial port, which this operation does not support", zk.Name)
+	}
+	if zk.DisableDuringRead {
+		fn = disabledDuring(fn)
+	}
+	fn = recovered(fn)
+
+	s := zk.getSession()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !zk.Persistent {
+		socket, err := zk.dial()
+		if err != nil {
+			return err
+		}
+		defer socket.Disconnect()
+		return fn(socket)
+	}
+
+	reused := s.socket != nil
+	if err := s.connect(zk); err != nil {
+		return err
+	}
+	err := fn(s.socket)
+	if err != nil && reused && idempotent {
+		// The kept-open connection may have been dropped by the device; retry on a fresh one
+		log.Printf("Re-dialing %s after error on kept-open connection: %v", zk.Name, err)
+		s.close()
+		if err := s.connect(zk); err != nil {
+			return err
+		}
+		err = fn(s.socket)
+	}
+	if err != nil {
+		s.close()
+		return err
+	}
+	s.used = time.Now()
+	if interval := zk.keepAlive(); interval > 0 && !s.keeping {
+		s.keeping = true
+		go s.keepAlive(zk.Name, interval)
+	}
+	return nil
+}
+
+// keepAlive asks the device its time whenever the kept-open connection has been idle for the
+// interval, until the connection is closed. A device that doesn't answer has its connection
+// closed, so the next call dials afresh instead of failing on it.
+func (s *session) keepAlive(name string, interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		if s.socket == nil {
+			s.keeping = false
+			s.mu.Unlock()
+			return
+		}
+		if time.Since(s.used) >= interval {
+			err := recovered(func(socket *gozk.ZK) error {
+				_, err := socket.GetTime()
+				return err
+			})(s.socket)
+			if err != nil {
+				log.Printf("Closing idle connection to %s, which failed its keepalive: %v", name, err)
+				s.close()
+			} else {
+				s.used = time.Now()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// disabledDuring wraps fn so the terminal is disabled while it runs. Punching is blocked
+// meanwhile, so this is only for firmware that returns inconsistent reads otherwise.
+func disabledDuring(fn func(socket *gozk.ZK) error) func(socket *gozk.ZK) error {
+	return func(socket *gozk.ZK) error {
+		if err := socket.DisableDevice(); err != nil {
+			log.Printf("Error disabling device: %v", err)
+		}
+		defer socket.EnableDevice()
+		return fn(socket)
+	}
+}
+
+// recovered wraps fn so a panic in the device library, which it raises on some failed socket
+// reads, is returned as an error instead of taking down the collector
+func recovered(fn func(socket *gozk.ZK) error) func(socket *gozk.ZK) error {
+	return func(socket *gozk.ZK) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%w: device library panic: %v", ErrDeviceUnreachable, r)
+			}
+		}()
+		return fn(socket)
+	}
+}
+
+// dial connects a gozk socket to the device. The library's own connect timeout is fixed at
+// 3s, so a configured ConnectTimeout is enforced by a plain TCP probe first.
+func (zk *ZKManager) dial() (*gozk.ZK, error) {
+	if zk.ConnectTimeout > 0 {
+		probe, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", zk.IP, zk.Port), zk.ConnectTimeout)
+		if err != nil {
+			log.Printf("Error connecting to ZK device: %v", err)
+			return nil, fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+		}
+		probe.Close()
+	}
+	socket := gozk.NewZK("", zk.IP, zk.Port, 0, zk.zkTimezone)
+	if err := socket.Connect(); err != nil {
+		log.Printf("Error connecting to ZK device: %v", err)
+		return nil, connectError(err)
+	}
+	return socket, nil
+}
+
+// connect dials the device unless the session is already connected
+func (s *session) connect(zk *ZKManager) error {
+	if s.socket != nil {
+		return nil
+	}
+	socket, err := zk.dial()
+	if err != nil {
+		return err
+	}
+	s.socket = socket
+	return nil
+}
+
+// close disconnects the session, ignoring errors from an already broken connection
+func (s *session) close() {
+	if s.socket == nil {
+		return
+	}
+	s.socket.Disconnect()
+	s.socket = nil
+}
+
+// CloseSessions disconnects all kept-open device connections
+func CloseSessions() {
+	sessions.Lock()
+	defer sessions.Unlock()
+	for _, s := range sessions.byAddr {
+		s.mu.Lock()
+		s.close()
+		s.mu.Unlock()
+	}
+}
+
+// connectError classifies a failed gozk connect, which reports a refused session as "unauthorized"
+func connectError(err error) error {
+	if err.Error() == "unauthorized" {
+		return fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	return fmt.Errorf("%w: %v", ErrDeviceUnreachable, err)
+}
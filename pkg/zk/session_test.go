@@ -0,0 +1,142 @@
+package zk
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+func TestKeepAlive(t *testing.T) {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	defer CloseSessions()
+	sim.AddPunches(samplePunches(5, sim.location())...)
+	zk.Persistent = true
+	zk.KeepAlive = 100 * time.Millisecond
+
+	if _, err := zk.GetAttendance(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	before := sim.Commands(gozk.CMD_GET_TIME)
+	time.Sleep(400 * time.Millisecond)
+	if sim.Commands(gozk.CMD_GET_TIME) == before {
+		t.Fatal("idle kept-open connection was not kept alive")
+	}
+	if _, err := zk.GetAttendance(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := sim.Commands(gozk.CMD_CONNECT); n != 1 {
+		t.Errorf("%d sessions opened, want the kept-open one", n)
+	}
+}
+
+func TestKeepAliveClosesDeadConnection(t *testing.T) {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	defer CloseSessions()
+	sim.AddPunches(samplePunches(5, sim.location())...)
+	zk.Persistent = true
+	zk.KeepAlive = 100 * time.Millisecond
+
+	if _, err := zk.GetAttendance(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	sim.Inject(SimFault{Command: gozk.CMD_GET_TIME, Kind: FaultReset, Count: 1})
+	time.Sleep(400 * time.Millisecond)
+	s := zk.getSession()
+	s.mu.Lock()
+	closed := s.socket == nil
+	s.mu.Unlock()
+	if !closed {
+		t.Fatal("connection that failed its keepalive was kept")
+	}
+	if _, err := zk.GetAttendance(time.Time{}); err != nil {
+		t.Fatalf("read after a failed keepalive: %v", err)
+	}
+}
+
+func TestKeepAliveOff(t *testing.T) {
+	zk := &ZKManager{KeepAlive: -1}
+	if d := zk.keepAlive(); d != 0 {
+		t.Errorf("keepAlive() = %v with KeepAlive negative, want off", d)
+	}
+	zk.KeepAlive = 0
+	if d := zk.keepAlive(); d != defaultKeepAlive {
+		t.Errorf("keepAlive() = %v by default, want %v", d, defaultKeepAlive)
+	}
+}
+
+func TestKeptOpenConnectionRetriesReadsOnly(t *testing.T) {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	defer CloseSessions()
+	sim.AddPunches(samplePunches(5, sim.location())...)
+	zk.Persistent = true
+	if _, err := zk.GetAttendance(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, idempotent := range []bool{true, false} {
+		// Keep the connection open for the next call
+		if _, err := zk.GetAttendance(time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		calls := 0
+		zk.withSocket(idempotent, func(socket *gozk.ZK) error {
+			calls++
+			return errors.New("connection dropped")
+		})
+		want := 1
+		if idempotent {
+			want = 2
+		}
+		if calls != want {
+			t.Errorf("idempotent %v: run %d times after failing on the kept-open connection, want %d", idempotent, calls, want)
+		}
+	}
+}
+
+func TestLostWriteReplyNotRetried(t *testing.T) {
+	sim := &Simulator{}
+	zk, err := simulate(sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	defer CloseSessions()
+	sim.AddPunches(samplePunches(5, sim.location())...)
+	zk.Retries = 2
+
+	// The device clears its log, then the connection drops before the reply
+	sim.Inject(SimFault{Command: gozk.CMD_CLEAR_ATTLOG, Kind: FaultReset, Count: 1})
+	if err := zk.ClearAttendance(); err == nil {
+		t.Fatal("ClearAttendance succeeded without a reply")
+	}
+	if n := sim.Commands(gozk.CMD_CLEAR_ATTLOG); n != 1 {
+		t.Errorf("clear sent %d times, want once", n)
+	}
+
+	// A read is run again
+	sim.Inject(SimFault{Command: gozk.CMD_GET_FREE_SIZES, Kind: FaultReset, Count: 1})
+	before := sim.Commands(gozk.CMD_GET_FREE_SIZES)
+	if _, _, err := zk.GetRecordCount(); err != nil {
+		t.Fatalf("read not retried: %v", err)
+	}
+	if n := sim.Commands(gozk.CMD_GET_FREE_SIZES) - before; n != 2 {
+		t.Errorf("read sent %d times, want twice", n)
+	}
+}
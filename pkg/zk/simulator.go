@@ -0,0 +1,631 @@
+package zk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// Faults a Simulator injects in its replies, see SimFault
+const (
+	FaultTruncate = "truncate" // Send half the reply, then close the connection
+	FaultReset    = "reset"    // Reset the connection instead of replying
+	FaultDelay    = "delay"    // Reply after the fault's Delay
+	FaultReject   = "reject"   // Reply CMD_ACK_ERROR
+	FaultCorrupt  = "corrupt"  // Reply with a packet missing its markers
+)
+
+// Replies up to this size are sent in one packet, as terminals do for small results
+const simSmallReply = 1024
+
+// SimulatedPunch is an entry of a Simulator's attendance log
+type SimulatedPunch struct {
+	UserID int
+	Time   time.Time
+	Verify byte // Verify code, e.g. 1 for fingerprint or 15 for face
+}
+
+// SimFault is a fault a Simulator injects in its replies to a command
+type SimFault struct {
+	Command int           // Command whose reply is hit, any when zero
+	Kind    string        // One of the Fault constants
+	Delay   time.Duration // For FaultDelay
+	Count   int           // Replies hit before the fault clears, every one when zero
+	hits    int
+}
+
+// Simulator is an in-process terminal speaking the TCP protocol, so the protocol clients can
+// be exercised without hardware, see RunConformance. It serves the attendance log, users and
+// operation log it is given, applies the commands that change them, pushes realtime events
+// to clients registered for them, and injects faults on request.
+type Simulator struct {
+	Firmware     string            // "Ver 6.60 Apr 28 2017" when empty; older versions have no buffered reads
+	SerialNumber string            // "SIM0000001" when empty
+	Platform     string            // "ZMM220_TFT" when empty
+	Options      map[string]string // Further options, e.g. "FaceFunOn": "1"
+	CommKey      bool              // Refuse sessions, as terminals with a comm key do for this client
+	RecordSize   int               // Attendance entry size: 8, 16, or 40 when zero
+	Stream       bool              // Serve reads as an announcement followed by data packets
+	PacketSize   int               // Payload of each streamed data packet, 1024 when zero
+	Location     *time.Location    // Timezone of the device clock, Asia/Dhaka when nil
+
+	mu           sync.Mutex
+	listener     net.Listener
+	conns        map[*simConn]bool
+	punches      []SimulatedPunch
+	users        []User
+	operations   []Operation
+	clockSkew    time.Duration
+	faults       []*SimFault
+	commands     map[int]int
+	badChecksums int
+	sessions     uint16
+}
+
+// simConn is a client connection to a Simulator
+type simConn struct {
+	net.Conn
+	write   sync.Mutex // Realtime events are written alongside replies
+	session uint16
+	events  bool   // Registered for realtime attendance events
+	buffer  []byte // Result prepared by the last buffered read
+}
+
+// simReply is one packet of a reply
+type simReply struct {
+	code    int
+	payload []byte
+}
+
+// Start listens on a free loopback port and serves clients until Close
+func (s *Simulator) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.conns = map[*simConn]bool{}
+	s.commands = map[int]int{}
+	s.mu.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c := &simConn{Conn: conn}
+			s.mu.Lock()
+			s.conns[c] = true
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	return nil
+}
+
+// Close stops the simulator and drops its clients
+func (s *Simulator) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Manager returns a client for the simulator
+func (s *Simulator) Manager() *ZKManager {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	zk, _ := NewZKManager(addr.IP.String(), strconv.Itoa(addr.Port))
+	zk.zkTimezone = s.location().String()
+	// The port may have served an earlier simulator, whose capabilities don't apply
+	sessions.Lock()
+	delete(sessions.byAddr, zk.address())
+	sessions.Unlock()
+	return zk
+}
+
+// location returns the timezone of the device clock
+func (s *Simulator) location() *time.Location {
+	if s.Location != nil {
+		return s.Location
+	}
+	return gozk.LoadLocation(DefaultTimezone)
+}
+
+// AddPunches appends entries to the attendance log without realtime events
+func (s *Simulator) AddPunches(punches ...SimulatedPunch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.punches = append(s.punches, punches...)
+}
+
+// Punch appends an entry to the attendance log and sends it to the clients registered for
+// realtime events
+func (s *Simulator) Punch(p SimulatedPunch) {
+	s.mu.Lock()
+	s.punches = append(s.punches, p)
+	var watchers []*simConn
+	for c := range s.conns {
+		if c.events {
+			watchers = append(watchers, c)
+		}
+	}
+	event := s.event(p)
+	s.mu.Unlock()
+	for _, c := range watchers {
+		c.send(s.frame(c, gozk.CMD_REG_EVENT, 0, event))
+	}
+}
+
+// Punches returns the attendance log
+func (s *Simulator) Punches() []SimulatedPunch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SimulatedPunch(nil), s.punches...)
+}
+
+// SetUsers replaces the enrolled users
+func (s *Simulator) SetUsers(users []User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append([]User(nil), users...)
+}
+
+// Users returns the enrolled users
+func (s *Simulator) Users() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]User(nil), s.users...)
+}
+
+// SetOperations replaces the operation log
+func (s *Simulator) SetOperations(operations []Operation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.operations = append([]Operation(nil), operations...)
+}
+
+// Clock returns the device clock
+func (s *Simulator) Clock() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Add(s.clockSkew).In(s.location())
+}
+
+// Inject adds a fault to the replies
+func (s *Simulator) Inject(f SimFault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// Commands returns how many times a command was received
+func (s *Simulator) Commands(command int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[command]
+}
+
+// BadChecksums returns how many packets arrived with a wrong checksum
+func (s *Simulator) BadChecksums() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.badChecksums
+}
+
+// Watchers returns how many clients are registered for realtime events
+func (s *Simulator) Watchers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for c := range s.conns {
+		if c.events {
+			n++
+		}
+	}
+	return n
+}
+
+// serve answers one client's commands until it exits or the connection fails
+func (s *Simulator) serve(c *simConn) {
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+	for {
+		top := make([]byte, 8)
+		if _, err := io.ReadFull(c, top); err != nil {
+			return
+		}
+		if binary.LittleEndian.Uint16(top[0:]) != tcpMarker1 || binary.LittleEndian.Uint16(top[2:]) != tcpMarker2 {
+			return
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(top[4:]))
+		if len(body) < 8 {
+			return
+		}
+		if _, err := io.ReadFull(c, body); err != nil {
+			return
+		}
+		command := int(binary.LittleEndian.Uint16(body[0:]))
+		replyID := binary.LittleEndian.Uint16(body[6:])
+
+		// The checksum covers the header as it was before the reply ID was advanced
+		check := append([]byte(nil), body...)
+		binary.LittleEndian.PutUint16(check[2:], 0)
+		binary.LittleEndian.PutUint16(check[6:], uint16((int(replyID)+gozk.USHRT_MAX-1)%gozk.USHRT_MAX))
+		s.mu.Lock()
+		s.commands[command]++
+		valid := checksum(check) == binary.LittleEndian.Uint16(body[2:])
+		if !valid {
+			s.badChecksums++
+		}
+		s.mu.Unlock()
+		if command == gozk.CMD_ACK_OK {
+			continue // A client acknowledging a realtime event
+		}
+
+		replies, exit := []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		if valid {
+			replies, exit = s.handle(c, command, body[8:])
+		}
+		var out []byte
+		for _, r := range replies {
+			out = append(out, s.frame(c, r.code, replyID, r.payload)...)
+		}
+		if !s.injectFault(c, command, out) {
+			return
+		}
+		if exit {
+			return
+		}
+	}
+}
+
+// injectFault sends a reply with the first fault that hits the command applied, and reports
+// whether the connection is still open
+func (s *Simulator) injectFault(c *simConn, command int, out []byte) bool {
+	s.mu.Lock()
+	var fault *SimFault
+	for i, f := range s.faults {
+		if f.Command == 0 || f.Command == command {
+			fault = f
+			f.hits++
+			if f.Count > 0 && f.hits >= f.Count {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+			break
+		}
+	}
+	s.mu.Unlock()
+	if fault == nil {
+		return c.send(out) == nil
+	}
+	switch fault.Kind {
+	case FaultTruncate:
+		c.send(out[:len(out)/2])
+		return false
+	case FaultReset:
+		if tcp, ok := c.Conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		return false
+	case FaultDelay:
+		time.Sleep(fault.Delay)
+	case FaultReject:
+		out = s.frame(c, gozk.CMD_ACK_ERROR, binary.LittleEndian.Uint16(out[14:]), nil)
+	case FaultCorrupt:
+		out = append([]byte(nil), out...)
+		binary.LittleEndian.PutUint16(out[0:], 0)
+	}
+	return c.send(out) == nil
+}
+
+// send writes packets to the client
+func (c *simConn) send(out []byte) error {
+	c.write.Lock()
+	defer c.write.Unlock()
+	_, err := c.Write(out)
+	return err
+}
+
+// frame builds a packet to the client
+func (s *Simulator) frame(c *simConn, code int, replyID uint16, payload []byte) []byte {
+	header := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint16(header[0:], uint16(code))
+	binary.LittleEndian.PutUint16(header[4:], c.session)
+	binary.LittleEndian.PutUint16(header[6:], replyID)
+	header = append(header, payload...)
+	binary.LittleEndian.PutUint16(header[2:], checksum(header))
+	top := make([]byte, 8, 8+len(header))
+	binary.LittleEndian.PutUint16(top[0:], tcpMarker1)
+	binary.LittleEndian.PutUint16(top[2:], tcpMarker2)
+	binary.LittleEndian.PutUint32(top[4:], uint32(len(header)))
+	return append(top, header...)
+}
+
+// handle runs a command and returns the reply packets, and whether the client is done
+func (s *Simulator) handle(c *simConn, command int, data []byte) ([]simReply, bool) {
+	ok := []simReply{{code: gozk.CMD_ACK_OK}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch command {
+	case gozk.CMD_CONNECT:
+		s.sessions++
+		c.session = s.sessions
+		if s.CommKey {
+			return []simReply{{code: gozk.CMD_ACK_UNAUTH}}, false
+		}
+		return ok, false
+	case gozk.CMD_AUTH:
+		return []simReply{{code: gozk.CMD_ACK_UNAUTH}}, false
+	case gozk.CMD_EXIT, gozk.CMD_RESTART:
+		return ok, true
+	case gozk.CMD_GET_VERSION:
+		return []simReply{{code: gozk.CMD_ACK_OK, payload: append([]byte(s.firmware()), 0)}}, false
+	case gozk.CMD_OPTIONS_RRQ:
+		name := cString(data)
+		value, found := s.option(name)
+		if !found {
+			return []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		}
+		return []simReply{{code: gozk.CMD_ACK_OK, payload: append([]byte(name+"="+value), 0)}}, false
+	case gozk.CMD_GET_TIME:
+		clock := make([]byte, 4)
+		binary.LittleEndian.PutUint32(clock, encodeDeviceTime(time.Now().Add(s.clockSkew).In(s.location())))
+		return []simReply{{code: gozk.CMD_ACK_OK, payload: clock}}, false
+	case gozk.CMD_SET_TIME:
+		if len(data) < 4 {
+			return []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		}
+		s.clockSkew = decodeDeviceTime(binary.LittleEndian.Uint32(data), s.location()).Sub(time.Now())
+		return ok, false
+	case gozk.CMD_GET_FREE_SIZES:
+		return []simReply{{code: gozk.CMD_ACK_OK, payload: s.freeSizes()}}, false
+	case gozk.CMD_CLEAR_ATTLOG:
+		s.punches = nil
+		return ok, false
+	case gozk.CMD_USER_WRQ:
+		if len(data) < 72 {
+			return []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		}
+		table := make([]byte, 4, 76)
+		binary.LittleEndian.PutUint32(table, 72)
+		users, err := parseUsers(append(table, data[:72]...), 1, EncodingUTF8)
+		if err != nil || len(users) != 1 {
+			return []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		}
+		for i, user := range s.users {
+			if user.UserID == users[0].UserID {
+				s.users[i] = users[0]
+				return ok, false
+			}
+		}
+		s.users = append(s.users, users[0])
+		return ok, false
+	case gozk.CMD_REG_EVENT:
+		c.events = len(data) >= 4 && binary.LittleEndian.Uint32(data)&gozk.EF_ATTLOG != 0
+		return ok, false
+	case gozk.CMD_DISABLEDEVICE, gozk.CMD_ENABLEDEVICE, gozk.CMD_REFRESHDATA, gozk.CMD_UNLOCK,
+		gozk.CMD_STARTVERIFY, gozk.CMD_FREE_DATA:
+		return ok, false
+	case cmdPrepareBuffer:
+		if !s.bufferedReads() || len(data) < 7 {
+			return []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		}
+		buffer, found := s.table(int(binary.LittleEndian.Uint16(data[1:])), int(binary.LittleEndian.Uint32(data[3:])))
+		if !found {
+			return []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		}
+		if len(buffer) <= simSmallReply {
+			return []simReply{{code: gozk.CMD_DATA, payload: buffer}}, false
+		}
+		c.buffer = buffer
+		size := make([]byte, 5)
+		binary.LittleEndian.PutUint32(size[1:], uint32(len(buffer)))
+		return []simReply{{code: gozk.CMD_ACK_OK, payload: size}}, false
+	case gozk.CMD_READ_BUFFER:
+		if len(data) < 8 {
+			return []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		}
+		start, n := int(binary.LittleEndian.Uint32(data)), int(binary.LittleEndian.Uint32(data[4:]))
+		if start < 0 || n < 0 || start+n > len(c.buffer) {
+			return []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		}
+		return s.transfer(c.buffer[start:start+n], false), false
+	case gozk.CMD_ATTLOG_RRQ, gozk.CMD_USERTEMP_RRQ, gozk.CMD_DB_RRQ:
+		fct := 0
+		if len(data) > 0 {
+			fct = int(data[0])
+		}
+		buffer, found := s.table(command, fct)
+		if !found {
+			return []simReply{{code: gozk.CMD_ACK_ERROR}}, false
+		}
+		return s.transfer(buffer, true), false
+	}
+	return []simReply{{code: gozk.CMD_ACK_UNKNOWN}}, false
+}
+
+// transfer returns the packets carrying data: one data reply, or with Stream an announcement
+// followed by data packets and an acknowledgment. A direct read announces results too large
+// for one packet whether or not Stream is set, as old firmware does.
+func (s *Simulator) transfer(data []byte, direct bool) []simReply {
+	if !s.Stream && !(direct && len(data) > simSmallReply) {
+		return []simReply{{code: gozk.CMD_DATA, payload: data}}
+	}
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(data)))
+	replies := []simReply{{code: gozk.CMD_PREPARE_DATA, payload: size}}
+	packet := s.PacketSize
+	if packet <= 0 {
+		packet = 1024
+	}
+	for len(data) > 0 {
+		n := packet
+		if n > len(data) {
+			n = len(data)
+		}
+		replies = append(replies, simReply{code: gozk.CMD_DATA, payload: data[:n]})
+		data = data[n:]
+	}
+	return append(replies, simReply{code: gozk.CMD_ACK_OK})
+}
+
+// firmware returns the firmware version string
+func (s *Simulator) firmware() string {
+	if s.Firmware != "" {
+		return s.Firmware
+	}
+	return "Ver 6.60 Apr 28 2017"
+}
+
+// bufferedReads reports whether the firmware serves buffered reads
+func (s *Simulator) bufferedReads() bool {
+	v, ok := firmwareVersion(s.firmware())
+	return !ok || v >= bufferedReadsSince
+}
+
+// option returns a device option. The caller holds the lock.
+func (s *Simulator) option(name string) (string, bool) {
+	if value, ok := s.Options[name]; ok {
+		return value, true
+	}
+	switch name {
+	case "~SerialNumber":
+		if s.SerialNumber != "" {
+			return s.SerialNumber, true
+		}
+		return "SIM0000001", true
+	case "~Platform":
+		if s.Platform != "" {
+			return s.Platform, true
+		}
+		return "ZMM220_TFT", true
+	}
+	return "", false
+}
+
+// freeSizes returns the storage use counters. The caller holds the lock.
+func (s *Simulator) freeSizes() []byte {
+	cards := 0
+	for _, user := range s.users {
+		if user.CardNumber != 0 {
+			cards++
+		}
+	}
+	fields := make([]int32, 23)
+	fields[4], fields[8], fields[12] = int32(len(s.users)), int32(len(s.punches)), int32(cards)
+	fields[14], fields[15], fields[16] = 3000, 1000, 100000
+	fields[17], fields[18], fields[19] = 3000, 1000-fields[4], 100000-fields[8]
+	sizes := make([]byte, 4*len(fields))
+	for i, field := range fields {
+		binary.LittleEndian.PutUint32(sizes[4*i:], uint32(field))
+	}
+	return sizes
+}
+
+// table returns the result of a bulk read: the attendance log, users or operation log, with
+// its 4-byte total size first. The caller holds the lock.
+func (s *Simulator) table(command, fct int) ([]byte, bool) {
+	var entries []byte
+	switch {
+	case command == gozk.CMD_ATTLOG_RRQ:
+		for i, p := range s.punches {
+			entries = append(entries, s.attendanceEntry(i, p)...)
+		}
+	case command == gozk.CMD_USERTEMP_RRQ && fct == gozk.FCT_USER:
+		for i, user := range s.users {
+			entry := make([]byte, 72)
+			binary.LittleEndian.PutUint16(entry[0:], uint16(i+1))
+			entry[2] = byte(user.Privilege)
+			copy(entry[11:35], user.Name)
+			binary.LittleEndian.PutUint32(entry[35:], user.CardNumber)
+			entry[40] = '1'
+			copy(entry[48:72], strconv.Itoa(user.UserID))
+			entries = append(entries, entry...)
+		}
+	case command == gozk.CMD_DB_RRQ && fct == gozk.FCT_OPLOG:
+		for _, op := range s.operations {
+			entry := make([]byte, operationEntrySize)
+			binary.LittleEndian.PutUint16(entry[0:], uint16(op.Admin))
+			entry[2] = byte(op.Code)
+			binary.LittleEndian.PutUint32(entry[4:], encodeDeviceTime(op.Time.In(s.location())))
+			for i, param := range op.Params {
+				binary.LittleEndian.PutUint16(entry[8+2*i:], uint16(param))
+			}
+			entries = append(entries, entry...)
+		}
+	default:
+		return nil, false
+	}
+	table := make([]byte, 4, 4+len(entries))
+	binary.LittleEndian.PutUint32(table, uint32(len(entries)))
+	return append(table, entries...), true
+}
+
+// attendanceEntry encodes the i-th attendance log entry in the simulator's record size
+func (s *Simulator) attendanceEntry(i int, p SimulatedPunch) []byte {
+	t := encodeDeviceTime(p.Time.In(s.location()))
+	switch s.RecordSize {
+	case 8:
+		entry := make([]byte, 8)
+		binary.LittleEndian.PutUint16(entry[0:], uint16(p.UserID))
+		entry[2] = p.Verify
+		binary.LittleEndian.PutUint32(entry[3:], t)
+		return entry
+	case 16:
+		entry := make([]byte, 16)
+		binary.LittleEndian.PutUint32(entry[0:], uint32(p.UserID))
+		binary.LittleEndian.PutUint32(entry[4:], t)
+		entry[8] = p.Verify
+		return entry
+	}
+	entry := make([]byte, 40)
+	binary.LittleEndian.PutUint16(entry[0:], uint16(i+1))
+	copy(entry[2:26], strconv.Itoa(p.UserID))
+	entry[26] = p.Verify
+	binary.LittleEndian.PutUint32(entry[27:], t)
+	return entry
+}
+
+// event encodes a realtime attendance event: the user as a number for the 8- and 16-byte
+// record formats and as a string otherwise, the verify code, the punch state, and the time
+// as year, month, day, hour, minute and second bytes
+func (s *Simulator) event(p SimulatedPunch) []byte {
+	var event []byte
+	switch s.RecordSize {
+	case 8:
+		event = make([]byte, 2)
+		binary.LittleEndian.PutUint16(event, uint16(p.UserID))
+	case 16:
+		event = make([]byte, 4)
+		binary.LittleEndian.PutUint32(event, uint32(p.UserID))
+	default:
+		event = make([]byte, 24)
+		copy(event, strconv.Itoa(p.UserID))
+	}
+	t := p.Time.In(s.location())
+	return append(event, p.Verify, 0, byte(t.Year()-2000), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()))
+}
+
+// String describes the simulator for logs
+func (s *Simulator) String() string {
+	if s.listener == nil {
+		return "simulator (not started)"
+	}
+	return fmt.Sprintf("simulator at %s", s.listener.Addr())
+}
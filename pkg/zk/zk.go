@@ -0,0 +1,303 @@
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/canhlinh/gozk"
+)
+
+// TimestampLayout is the format used for AttendanceRecord.Timestamp
+const TimestampLayout = "2006-01-02T15:04:05"
+
+// DefaultTimezone is the time zone terminal clocks are taken to run in unless set, see
+// SetTimezone
+const DefaultTimezone = "Asia/Dhaka"
+
+type AttendanceRecord struct {
+	UserID    int    `json:"employee_id"`
+	Timestamp string `json:"timestamp"` // Use string to store formatted time
+	// Offset from UTC of the device's zone at the punch, for zones with daylight saving time
+	UTCOffset string `json:"utc_offset,omitempty"`
+	// Timestamp the terminal recorded, when corrected for its clock; see ClockOffset
+	DeviceTime string   `json:"device_time,omitempty"`
+	DeviceID   string   `json:"device_id,omitempty"`
+	Manual     bool     `json:"manual,omitempty"` // Entered by an operator rather than read from a device
+	Reason     string   `json:"reason,omitempty"`
+	Flags      []string `json:"flags,omitempty"`    // Validation findings, e.g. "unknown_employee"
+	Modality   string   `json:"modality,omitempty"` // How the user verified, e.g. "face"; see ReadModality
+	// Card enrolled for the user on the device, see ReadCardNumbers
+	CardNumber string `json:"card_number,omitempty"`
+	// Shift the punch falls in and how it compares with it, e.g. "late"; see SHIFTS
+	Shift  string `json:"shift,omitempty"`
+	Status string `json:"status,omitempty"`
+	// Employee details from the lookup API; see ENRICH_URL
+	EmployeeName string `json:"employee_name,omitempty"`
+	Department   string `json:"department,omitempty"`
+}
+
+// FlagClockCorrected marks a record whose timestamp was corrected for the terminal's clock
+// being off, see ClockOffset
+const FlagClockCorrected = "clock_corrected"
+
+// Time parses the record timestamp in the local timezone
+func (r AttendanceRecord) Time() (time.Time, error) {
+	return time.ParseInLocation(TimestampLayout, r.Timestamp, time.Local)
+}
+
+// Instant returns the moment of the punch, taking the timestamp in the zone of the device
+// clock, loc, or at its UTC offset when it has one. It is what GetAttendance compares since
+// with.
+func (r AttendanceRecord) Instant(loc *time.Location) (time.Time, error) {
+	if r.UTCOffset != "" {
+		return time.Parse(TimestampLayout+"-07:00", r.Timestamp+r.UTCOffset)
+	}
+	return time.ParseInLocation(TimestampLayout, r.Timestamp, loc)
+}
+
+type ZKDevice struct {
+	IP   string
+	Port int
+}
+
+type ZKManager struct {
+	IP         string
+	Port       int
+	Name       string // Device ID stamped on fetched records, defaults to "ip:port"
+	Persistent bool   // Keep the connection open between calls instead of reconnecting
+	// With Persistent, how long the kept-open connection may sit idle before the terminal is
+	// asked its time to keep the session alive, 60s when zero. Firmware and NAT routers drop
+	// idle sessions, which would otherwise fail the next call. Negative turns it off.
+	KeepAlive time.Duration
+	// Disable the terminal while reading. Off by default since it blocks punching.
+	DisableDuringRead bool
+	// TCP connect timeout, 3s when zero. Lower it to give up quickly on devices behind
+	// flaky cellular routers.
+	ConnectTimeout time.Duration
+	// Deadline for each device reply to a command, 5s when zero. Attendance reads use the
+	// process-wide deadline set with SetReadTimeout instead.
+	ReadTimeout time.Duration
+	Retries     int // Extra attempts after the device could not be reached
+	// Read attendance with the built-in protocol client instead of gozk, which keeps each
+	// record's verification modality (fingerprint, face, palm, ...) and also understands the
+	// 8- and 16-byte record formats of older firmware. Persistent does not apply to it.
+	ReadModality bool
+	// Look up each punching user's card number in the terminal's user table, for card-only
+	// readers whose punches are identified by card
+	ReadCardNumbers bool
+	// Character encoding of user names on the terminal, one of the Encoding constants.
+	// Guessed per name when empty or EncodingAuto.
+	NameEncoding string
+	// Serial port the terminal is wired to (e.g. /dev/ttyUSB0) instead of IP and Port,
+	// see NewSerialZKManager
+	SerialPort string
+	BaudRate   int // Serial line speed, 115200 when zero
+	// Pause between chunks of bulk reads, which are then made in small chunks so the terminal
+	// keeps serving punches during a large read. Attendance is read with the built-in protocol
+	// client when set, as with ReadModality.
+	ChunkPause time.Duration
+	// How far the terminal clock is ahead of the true time, negative when behind. When set,
+	// attendance reads take since as the true time, and each record's timestamp is moved
+	// back by it and flagged FlagClockCorrected, with the terminal's own time in DeviceTime.
+	ClockOffset time.Duration
+	zkTimezone  string
+	recorder    *recorder     // Records packets while capturing, see Capture
+	replay      *replaySource // Serves captured packets instead of the device, see Replay
+}
+
+// Defaults for ConnectTimeout, ReadTimeout and KeepAlive
+const (
+	defaultConnectTimeout = 3 * time.Second
+	defaultReadTimeout    = 5 * time.Second
+	defaultKeepAlive      = 60 * time.Second
+)
+
+// Pause before the first retry of an unreachable device, doubled for each further retry
+const retryDelay = 2 * time.Second
+
+// SetReadTimeout sets the reply deadline of attendance reads. The device library keeps it
+// process-wide, so it cannot differ per device.
+func SetReadTimeout(d time.Duration) {
+	if d > 0 {
+		gozk.ReadSocketTimeout = d
+	}
+}
+
+// connectTimeout returns ConnectTimeout or its default
+func (zk *ZKManager) connectTimeout() time.Duration {
+	if zk.ConnectTimeout > 0 {
+		return zk.ConnectTimeout
+	}
+	return defaultConnectTimeout
+}
+
+// readTimeout returns ReadTimeout or its default
+func (zk *ZKManager) readTimeout() time.Duration {
+	if zk.ReadTimeout > 0 {
+		return zk.ReadTimeout
+	}
+	return defaultReadTimeout
+}
+
+// keepAlive returns KeepAlive or its default, 0 when keepalives are off
+func (zk *ZKManager) keepAlive() time.Duration {
+	switch {
+	case zk.KeepAlive < 0:
+		return 0
+	case zk.KeepAlive > 0:
+		return zk.KeepAlive
+	}
+	return defaultKeepAlive
+}
+
+// sentError is the failure of a command that may have reached the device, such as a lost
+// reply to a write. withRetries doesn't run it again, which could apply it twice.
+type sentError struct{ error }
+
+func (e sentError) Unwrap() error { return e.error }
+
+// withRetries runs fn, retrying up to Retries times while the device is unreachable
+func (zk *ZKManager) withRetries(fn func() error) error {
+	fn = zk.withChaos(fn)
+	err := fn()
+	delay := retryDelay
+	var sent sentError
+	for attempt := 1; attempt <= zk.Retries && errors.Is(err, ErrDeviceUnreachable) && !errors.As(err, &sent); attempt++ {
+		log.Printf("Device %s unreachable, retry %d of %d in %v", zk.Name, attempt, zk.Retries, delay)
+		time.Sleep(delay)
+		delay *= 2
+		err = fn()
+	}
+	return err
+}
+
+func NewZKManager(ip string, port string) (*ZKManager, error) {
+	intPort, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	return &ZKManager{
+		IP:         ip,
+		Port:       intPort,
+		Name:       fmt.Sprintf("%s:%d", ip, intPort),
+		zkTimezone: DefaultTimezone,
+	}, nil
+}
+
+func (zk *ZKManager) GetAttendance(since time.Time) ([]AttendanceRecord, error) {
+	attendances, err := zk.readAttendance()
+	if err != nil {
+		return nil, err
+	}
+	if len(attendances) == 0 {
+		return nil, fmt.Errorf("no attendance records found")
+	}
+
+	records := make([]AttendanceRecord, 0)
+	for _, attendance := range attendances {
+		if attendance.Time.After(since.Add(zk.ClockOffset)) {
+			records = append(records, zk.toRecord(attendance))
+		}
+	}
+	return records, nil
+}
+
+// GetAttendanceForUser returns one user's records newer than since. The protocol has no
+// per-user filter for attendance reads, so the whole log is read and filtered here.
+func (zk *ZKManager) GetAttendanceForUser(userID int, since time.Time) ([]AttendanceRecord, error) {
+	attendances, err := zk.readAttendance()
+	if err != nil {
+		return nil, err
+	}
+	var records []AttendanceRecord
+	for _, attendance := range attendances {
+		if attendance.UserID == userID && attendance.Time.After(since.Add(zk.ClockOffset)) {
+			records = append(records, zk.toRecord(attendance))
+		}
+	}
+	return records, nil
+}
+
+// readAttendance reads the full attendance log from the device
+func (zk *ZKManager) readAttendance() ([]attendanceEntry, error) {
+	attendances, err := zk.readAttendanceEntries()
+	if err != nil || !zk.ReadCardNumbers {
+		return attendances, err
+	}
+	users, err := zk.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	cards := map[int]string{}
+	for _, user := range users {
+		if user.CardNumber != 0 {
+			cards[user.UserID] = strconv.FormatUint(uint64(user.CardNumber), 10)
+		}
+	}
+	for i := range attendances {
+		attendances[i].CardNumber = cards[attendances[i].UserID]
+	}
+	return attendances, nil
+}
+
+// readAttendanceEntries reads the attendance log with the configured client
+func (zk *ZKManager) readAttendanceEntries() ([]attendanceEntry, error) {
+	// gozk only speaks TCP, so serial terminals are always read with the built-in client
+	if zk.ReadModality || zk.SerialPort != "" || zk.ChunkPause > 0 {
+		return zk.readAttendanceLog()
+	}
+	var attendances []attendanceEntry
+	err := zk.withRetries(func() error {
+		return zk.withSocket(true, func(socket *gozk.ZK) error {
+			events, err := socket.GetAllScannedEvents()
+			if err != nil {
+				return fmt.Errorf("failed to get attendance: %w", err)
+			}
+			attendances = make([]attendanceEntry, len(events))
+			for i, event := range events {
+				// gozk has already placed the times in the zone, so a time skipped when
+				// clocks went forward comes out an hour later and can't be flagged
+				attendances[i] = attendanceEntry{UserID: int(event.UserID), Time: floatingTime(event.Timestamp)}
+			}
+			resolveDST(attendances, zk.location())
+			return nil
+		})
+	})
+	return attendances, err
+}
+
+// toRecord converts a log entry to a record stamped with this device's name. The timestamp
+// is the time the terminal shows; in zones with daylight saving time, the UTC offset it was
+// taken at is added, with a flag when it falls on a transition. With a ClockOffset the
+// timestamp is corrected by it.
+func (zk *ZKManager) toRecord(entry attendanceEntry) AttendanceRecord {
+	record := AttendanceRecord{
+		UserID:     entry.UserID,
+		Timestamp:  entry.Time.Format(TimestampLayout),
+		DeviceID:   zk.Name,
+		Modality:   entry.Modality,
+		CardNumber: entry.CardNumber,
+	}
+	if entry.Wall != "" {
+		record.Timestamp = entry.Wall
+	}
+	if observesDST(entry.Time.Location(), entry.Time) {
+		record.UTCOffset = utcOffset(record.Timestamp, entry.Time)
+	}
+	if entry.DST != "" {
+		record.Flags = append(record.Flags, entry.DST)
+	}
+	if zk.ClockOffset != 0 {
+		corrected := entry.Time.Add(-zk.ClockOffset).In(zk.location())
+		record.DeviceTime = record.Timestamp
+		record.Timestamp = corrected.Format(TimestampLayout)
+		if record.UTCOffset != "" {
+			record.UTCOffset = corrected.Format("-07:00")
+		}
+		record.Flags = append(record.Flags, FlagClockCorrected)
+	}
+	return record
+}